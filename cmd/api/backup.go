@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+	"zabbixhw/pkg/backup"
+	"zabbixhw/pkg/clock"
+)
+
+// backupStatus is the state of the last backup, as sent to clients. States
+// are those of scrubs
+type backupStatus struct {
+	State      string           `json:"state"`
+	StartedAt  *time.Time       `json:"startedAt,omitempty"`
+	FinishedAt *time.Time       `json:"finishedAt,omitempty"`
+	Manifest   *backup.Manifest `json:"manifest,omitempty"`
+	Removed    []string         `json:"removed,omitempty"` // Backups dropped by the retention policy
+	Error      string           `json:"error,omitempty"`
+}
+
+// backupJob runs at most one backup at a time in the background
+type backupJob struct {
+	mu     sync.Mutex
+	status backupStatus
+	done   chan struct{} // Closed when the running backup finishes
+}
+
+// start begins a backup of db to store unless one is running already
+func (j *backupJob) start(db backup.Source, store backup.Store, retention backup.Retention) backupStatus {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if j.status.State == jobRunning {
+		return j.status
+	}
+
+	started := time.Now()
+	j.status = backupStatus{State: jobRunning, StartedAt: &started}
+	j.done = make(chan struct{})
+	go j.run(db, store, retention, j.done)
+	return j.status
+}
+
+// run takes the backup, prunes old ones and records the outcome. The backup
+// outlives the request that started it, so it does not use the request
+// context
+func (j *backupJob) run(db backup.Source, store backup.Store, retention backup.Retention, done chan struct{}) {
+	defer close(done)
+	ctx := context.Background()
+	manifest, err := backup.Create(ctx, db, store, time.Now())
+	var removed []string
+	if err == nil {
+		removed, err = backup.Prune(ctx, store, retention, time.Now())
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	finished := time.Now()
+	j.status.FinishedAt = &finished
+	j.status.Manifest = manifest
+	j.status.Removed = removed
+	if err != nil {
+		j.status.State = jobFailed
+		j.status.Error = err.Error()
+		log.Printf("backup to %s failed: %v", store, err)
+		return
+	}
+	j.status.State = jobDone
+	log.Printf("backup %s written to %s, %d records, %d bytes", manifest.ID, store, manifest.Records, manifest.Bytes)
+}
+
+// current returns the state of the last backup
+func (j *backupJob) current() backupStatus {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if j.status.State == "" {
+		return backupStatus{State: jobIdle}
+	}
+	return j.status
+}
+
+// backupSource returns the engine to back up, or false when backups are not
+// configured or the engine cannot take them. Wrappers are skipped, so
+// sensitive fields stay encrypted in backups
+func (app *application) backupSource() (backup.Source, bool) {
+	if app.Backups == nil {
+		return nil, false
+	}
+	db, ok := app.engine().(backup.Source)
+	return db, ok
+}
+
+// scheduleBackups starts a backup every interval until ctx is done
+func (app *application) scheduleBackups(ctx context.Context, c clock.Clock, interval time.Duration) {
+	db, ok := app.backupSource()
+	if !ok {
+		return
+	}
+	ticker := c.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C():
+			app.backup.start(db, app.Backups, app.Retention)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// postBackupHandler starts a background backup of the database
+func (app *application) postBackupHandler(w http.ResponseWriter, r *http.Request) {
+	db, ok := app.backupSource()
+	if !ok {
+		writeProblem(w, r, http.StatusNotImplemented, codeNotSupported, "No backup location is configured")
+		return
+	}
+
+	writeJSON(w, r, http.StatusAccepted, app.backup.start(db, app.Backups, app.Retention))
+}
+
+// getBackupHandler reports the state of the last backup
+func (app *application) getBackupHandler(w http.ResponseWriter, r *http.Request) {
+	if _, ok := app.backupSource(); !ok {
+		writeProblem(w, r, http.StatusNotImplemented, codeNotSupported, "No backup location is configured")
+		return
+	}
+
+	writeJSON(w, r, http.StatusOK, app.backup.current())
+}
+
+// listBackupsHandler lists the manifests of the stored backups, newest first
+func (app *application) listBackupsHandler(w http.ResponseWriter, r *http.Request) {
+	if _, ok := app.backupSource(); !ok {
+		writeProblem(w, r, http.StatusNotImplemented, codeNotSupported, "No backup location is configured")
+		return
+	}
+
+	manifests, err := backup.List(r.Context(), app.Backups)
+	if err != nil {
+		writeProblem(w, r, http.StatusServiceUnavailable, codeStorageUnavailable, err.Error())
+		return
+	}
+	if manifests == nil {
+		manifests = []backup.Manifest{}
+	}
+	writeJSON(w, r, http.StatusOK, manifests)
+}
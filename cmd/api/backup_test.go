@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+	"zabbixhw/pkg/backup"
+	"zabbixhw/pkg/backup/s3fake"
+	"zabbixhw/pkg/clock"
+	"zabbixhw/pkg/repository/dbfile"
+	"zabbixhw/pkg/repository/filedb"
+	"zabbixhw/pkg/repository/testdb"
+)
+
+// backupRequest sends a request to path and decodes the JSON response into v
+func backupRequest(t *testing.T, handler http.Handler, method, path string, expectedCode int, v interface{}) {
+	t.Helper()
+
+	req := httptest.NewRequest(method, path, nil)
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+
+	if rr.Code != expectedCode {
+		t.Fatalf("%s %s: expected status code %d, got %d: %s", method, path, expectedCode, rr.Code, rr.Body.String())
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), v); err != nil {
+		t.Fatalf("error decoding response: %v", err)
+	}
+}
+
+// waitBackup waits for the running backup of app to finish
+func waitBackup(t *testing.T, app *application) {
+	t.Helper()
+
+	app.backup.mu.Lock()
+	done := app.backup.done
+	app.backup.mu.Unlock()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("backup did not finish")
+	}
+}
+
+// newBackupApp serves a fresh database backed up to store
+func newBackupApp(t *testing.T, store backup.Store, retention backup.Retention) *application {
+	t.Helper()
+
+	db, err := filedb.Open(filepath.Join(t.TempDir(), "db.json"))
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return &application{DB: db, Backups: store, Retention: retention}
+}
+
+func Test_backupHandlers(t *testing.T) {
+	fake := s3fake.New("AKIDEXAMPLE", "backups")
+	server := httptest.NewServer(fake)
+	defer server.Close()
+	s3, err := backup.NewS3Store(backup.S3Config{Endpoint: server.URL, Region: "us-east-1", Bucket: "backups", Prefix: "zhw/", AccessKey: "AKIDEXAMPLE", SecretKey: "secret"})
+	if err != nil {
+		t.Fatalf("NewS3Store failed: %v", err)
+	}
+
+	for name, store := range map[string]backup.Store{"Directory": backup.DirStore(t.TempDir()), "S3": s3} {
+		t.Run(name, func(t *testing.T) {
+			app := newBackupApp(t, store, backup.Retention{Keep: 2})
+			handler := app.routes()
+
+			var status backupStatus
+			backupRequest(t, handler, "GET", "/admin/backup", http.StatusOK, &status)
+			if status.State != jobIdle {
+				t.Errorf("expected %q, got %q", jobIdle, status.State)
+			}
+
+			for i := 0; i < 3; i++ {
+				if err := app.DB.CreateRecord(context.Background(), map[string]interface{}{"host": "db"}); err != nil {
+					t.Fatalf("CreateRecord failed: %v", err)
+				}
+				backupRequest(t, handler, "POST", "/admin/backup", http.StatusAccepted, &status)
+				waitBackup(t, app)
+				// Backups are named to the millisecond
+				time.Sleep(2 * time.Millisecond)
+			}
+
+			backupRequest(t, handler, "GET", "/admin/backup", http.StatusOK, &status)
+			if status.State != jobDone || status.Manifest == nil || status.Manifest.Records != 3 || len(status.Removed) != 1 {
+				t.Fatalf("unexpected status %+v", status)
+			}
+
+			var manifests []backup.Manifest
+			backupRequest(t, handler, "GET", "/admin/backups", http.StatusOK, &manifests)
+			if len(manifests) != 2 || manifests[0].ID != status.Manifest.ID {
+				t.Errorf("expected the two newest backups, got %+v", manifests)
+			}
+
+			data, _, err := backup.Fetch(context.Background(), store, "")
+			if err != nil {
+				t.Fatalf("Fetch failed: %v", err)
+			}
+			if snap, err := dbfile.ReadWithKeys(bytes.NewReader(data), false, nil); err != nil || len(snap.Records) != 3 {
+				t.Errorf("unexpected backup content: %v", err)
+			}
+		})
+	}
+}
+
+func Test_backupHandlersFailure(t *testing.T) {
+	// A store that cannot be written fails the backup, not the server
+	dir := filepath.Join(t.TempDir(), "file")
+	app := newBackupApp(t, backup.DirStore(filepath.Join(dir, "backups")), backup.Retention{})
+	if err := backup.DirStore(filepath.Dir(dir)).Put(context.Background(), "file", []byte("not a directory")); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	handler := app.routes()
+
+	var status backupStatus
+	backupRequest(t, handler, "POST", "/admin/backup", http.StatusAccepted, &status)
+	waitBackup(t, app)
+	backupRequest(t, handler, "GET", "/admin/backup", http.StatusOK, &status)
+	if status.State != jobFailed || status.Error == "" || status.Manifest != nil {
+		t.Errorf("expected a failed backup, got %+v", status)
+	}
+}
+
+func Test_backupHandlersNotConfigured(t *testing.T) {
+	for _, app := range []*application{
+		{DB: &testdb.TestDB{}},
+		{DB: &testdb.TestDB{}, Backups: backup.DirStore(t.TempDir())},
+	} {
+		handler := app.routes()
+		for _, route := range []struct{ method, path string }{
+			{"POST", "/admin/backup"},
+			{"GET", "/admin/backup"},
+			{"GET", "/admin/backups"},
+		} {
+			var p problem
+			backupRequest(t, handler, route.method, route.path, http.StatusNotImplemented, &p)
+			if p.Code != codeNotSupported {
+				t.Errorf("%s %s: expected %q, got %q", route.method, route.path, codeNotSupported, p.Code)
+			}
+		}
+	}
+}
+
+func Test_scheduleBackups(t *testing.T) {
+	store := backup.DirStore(t.TempDir())
+	app := newBackupApp(t, store, backup.Retention{})
+	fake := clock.NewFake(time.Now())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+	go func() {
+		app.scheduleBackups(ctx, fake, time.Hour)
+		close(stopped)
+	}()
+	fake.BlockUntil(1)
+
+	for i := 1; i <= 2; i++ {
+		fake.Advance(time.Hour)
+		// The tick only starts the backup, wait for it to be stored
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			manifests, err := backup.List(context.Background(), store)
+			if err != nil {
+				t.Fatalf("List failed: %v", err)
+			}
+			if len(manifests) == i {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("expected %d scheduled backups, got %d", i, len(manifests))
+			}
+			time.Sleep(time.Millisecond)
+		}
+		waitBackup(t, app)
+		// Backups are named to the millisecond
+		time.Sleep(2 * time.Millisecond)
+	}
+	cancel()
+	<-stopped
+
+	if fake.Tickers() != 0 {
+		t.Error("expected the ticker stopped")
+	}
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"zabbixhw/pkg/raft"
+	"zabbixhw/pkg/replication"
+	"zabbixhw/pkg/repository/dbfile"
+	"zabbixhw/pkg/repository/idgen"
+)
+
+// clusterTokenEnv holds the shared secret of the members of a cluster when
+// the flag is not set
+const clusterTokenEnv = "ZHW_CLUSTER_TOKEN"
+
+// memberRequest is the body of POST /cluster/members
+type memberRequest struct {
+	ID      string `json:"id"`
+	Address string `json:"address"` // Base URL of the server of the member, such as http://db4:8080
+}
+
+// clusterNode returns the node of the cluster, writing a problem response
+// when clustering is not enabled
+func (app *application) clusterNode(w http.ResponseWriter, r *http.Request) (*raft.Node, bool) {
+	if app.Cluster == nil {
+		writeProblem(w, r, http.StatusNotImplemented, codeNotSupported, "Clustering is not enabled")
+		return nil, false
+	}
+	return app.Cluster, true
+}
+
+// memberAllowed checks the shared secret of another member, when one is
+// configured
+func (app *application) memberAllowed(w http.ResponseWriter, r *http.Request) bool {
+	if app.ClusterToken == "" {
+		return true
+	}
+	token := r.Header.Get(raft.TokenHeader)
+	if subtle.ConstantTimeCompare([]byte(token), []byte(app.ClusterToken)) != 1 {
+		writeProblem(w, r, http.StatusUnauthorized, codeInvalidToken, "Missing or invalid cluster token")
+		return false
+	}
+	return true
+}
+
+// raftMessage decodes the message another member sent into v. Numbers in
+// records are kept as json.Number, like the engines read them
+func (app *application) raftMessage(w http.ResponseWriter, r *http.Request, v interface{}) (*raft.Node, bool) {
+	node, ok := app.clusterNode(w, r)
+	if !ok || !app.memberAllowed(w, r) {
+		return nil, false
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	decoder.UseNumber()
+	if err := decoder.Decode(v); err != nil {
+		writeProblem(w, r, http.StatusBadRequest, codeInvalidJSON, "Invalid JSON in request body")
+		return nil, false
+	}
+	return node, true
+}
+
+// raftVoteHandler answers a candidate asking for the vote of the server
+func (app *application) raftVoteHandler(w http.ResponseWriter, r *http.Request) {
+	var req raft.VoteRequest
+	if node, ok := app.raftMessage(w, r, &req); ok {
+		writeJSON(w, r, http.StatusOK, node.HandleVote(&req))
+	}
+}
+
+// raftAppendHandler stores the log entries sent by the leader
+func (app *application) raftAppendHandler(w http.ResponseWriter, r *http.Request) {
+	var req raft.AppendRequest
+	if node, ok := app.raftMessage(w, r, &req); ok {
+		writeJSON(w, r, http.StatusOK, node.HandleAppend(&req))
+	}
+}
+
+// raftSnapshotHandler installs the snapshot sent by the leader
+func (app *application) raftSnapshotHandler(w http.ResponseWriter, r *http.Request) {
+	var req raft.SnapshotRequest
+	if node, ok := app.raftMessage(w, r, &req); ok {
+		writeJSON(w, r, http.StatusOK, node.HandleSnapshot(&req))
+	}
+}
+
+// raftForwardHandler makes a change a follower forwarded to the leader
+func (app *application) raftForwardHandler(w http.ResponseWriter, r *http.Request) {
+	var req raft.Request
+	if node, ok := app.raftMessage(w, r, &req); ok {
+		writeJSON(w, r, http.StatusOK, node.HandleForward(r.Context(), &req))
+	}
+}
+
+// clusterStatusHandler reports the role of the server in the cluster and
+// the members it knows
+func (app *application) clusterStatusHandler(w http.ResponseWriter, r *http.Request) {
+	node, ok := app.clusterNode(w, r)
+	if !ok {
+		return
+	}
+
+	writeJSON(w, r, http.StatusOK, node.Status())
+}
+
+// addMemberHandler adds the server in the request to the cluster
+func (app *application) addMemberHandler(w http.ResponseWriter, r *http.Request) {
+	node, ok := app.clusterNode(w, r)
+	if !ok || !app.memberAllowed(w, r) {
+		return
+	}
+
+	var input memberRequest
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		writeProblem(w, r, http.StatusBadRequest, codeInvalidJSON, "Invalid JSON in request body")
+		return
+	}
+	if input.ID == "" {
+		writeProblem(w, r, http.StatusBadRequest, codeValidation, "id is required")
+		return
+	}
+	if !validBaseURL(input.Address) {
+		writeProblem(w, r, http.StatusBadRequest, codeValidation, "address must be an http or https URL")
+		return
+	}
+
+	if err := node.AddMember(r.Context(), input.ID, strings.TrimSuffix(input.Address, "/")); err != nil {
+		dbErrorResponse(w, r, err)
+		return
+	}
+	log.Printf("added %s at %s to the cluster", input.ID, input.Address)
+	writeJSON(w, r, http.StatusOK, node.Status())
+}
+
+// removeMemberHandler removes a server from the cluster
+func (app *application) removeMemberHandler(w http.ResponseWriter, r *http.Request) {
+	node, ok := app.clusterNode(w, r)
+	if !ok || !app.memberAllowed(w, r) {
+		return
+	}
+
+	id := r.PathValue("id")
+	if err := node.RemoveMember(r.Context(), id); err != nil {
+		dbErrorResponse(w, r, err)
+		return
+	}
+	log.Printf("removed %s from the cluster", id)
+	writeJSON(w, r, http.StatusOK, node.Status())
+}
+
+// openCluster starts the node id of a cluster on db, keeping its state in
+// dir encrypted with keys when they are set. bootstrap lists the members of
+// a new cluster, see parseMembers
+func openCluster(db replication.Replica, ids idgen.Strategy, id, bootstrap, dir, token string, keys *dbfile.Keyring) (*raft.Node, error) {
+	var storageOpts []raft.StorageOption
+	if keys != nil {
+		storageOpts = append(storageOpts, raft.WithStorageKeys(keys))
+	}
+	storage, err := raft.NewFileStorage(dir, storageOpts...)
+	if err != nil {
+		return nil, err
+	}
+	opts := []raft.Option{raft.WithStorage(storage), raft.WithIDStrategy(ids)}
+	if bootstrap != "" {
+		members, err := parseMembers(bootstrap)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := members[id]; !ok {
+			return nil, fmt.Errorf("%s is not one of the members to bootstrap", id)
+		}
+		opts = append(opts, raft.WithBootstrap(members))
+	}
+	return raft.NewNode(id, db, raft.NewHTTPTransport(nil, token), opts...)
+}
+
+// validBaseURL reports whether address is an http or https URL
+func validBaseURL(address string) bool {
+	u, err := url.Parse(address)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+}
+
+// parseMembers parses a comma separated list of id=address pairs, such as
+// db1=http://db1:8080,db2=http://db2:8080
+func parseMembers(list string) (map[string]string, error) {
+	members := map[string]string{}
+	for _, pair := range strings.Split(list, ",") {
+		id, address, ok := strings.Cut(strings.TrimSpace(pair), "=")
+		if !ok || id == "" || !validBaseURL(address) {
+			return nil, fmt.Errorf("invalid member %q, expected id=http://host:port", pair)
+		}
+		if _, ok := members[id]; ok {
+			return nil, fmt.Errorf("member %s listed twice", id)
+		}
+		members[id] = strings.TrimSuffix(address, "/")
+	}
+	return members, nil
+}
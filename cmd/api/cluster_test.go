@@ -0,0 +1,217 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+	"zabbixhw/pkg/raft"
+	"zabbixhw/pkg/repository/filedb"
+	"zabbixhw/pkg/repository/idgen"
+	"zabbixhw/pkg/repository/testdb"
+)
+
+const clusterToken = "0123456789abcdef-cluster"
+
+// clusterServer serves a fresh database as the member id of a cluster on a
+// loopback port. bootstrap lists the members of a new cluster, nil for a
+// server joining one
+func clusterServer(t *testing.T, id string, server *httptest.Server, bootstrap map[string]string) *application {
+	t.Helper()
+
+	dir := t.TempDir()
+	db, err := filedb.Open(filepath.Join(dir, "db.json"))
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	storage, err := raft.NewFileStorage(filepath.Join(dir, "raft"))
+	if err != nil {
+		t.Fatalf("NewFileStorage failed: %v", err)
+	}
+	opts := []raft.Option{raft.WithStorage(storage), raft.WithElectionTimeout(100 * time.Millisecond), raft.WithHeartbeat(10 * time.Millisecond)}
+	if bootstrap != nil {
+		opts = append(opts, raft.WithBootstrap(bootstrap))
+	}
+	node, err := raft.NewNode(id, db, raft.NewHTTPTransport(nil, clusterToken), opts...)
+	if err != nil {
+		t.Fatalf("NewNode failed: %v", err)
+	}
+
+	app := &application{DB: node, Timeout: 5 * time.Second, Cluster: node, ClusterToken: clusterToken}
+	server.Config.Handler = app.routes()
+	server.Start()
+	t.Cleanup(func() {
+		server.Close()
+		node.Close()
+		db.Close()
+	})
+	return app
+}
+
+// unstartedServer returns a server whose URL is known before it is started
+func unstartedServer() (*httptest.Server, string) {
+	server := httptest.NewUnstartedServer(nil)
+	return server, "http://" + server.Listener.Addr().String()
+}
+
+// clusterRequest sends a request carrying the cluster token, like
+// replicaRequest
+func clusterRequest(t *testing.T, method, url, body string, expectedCode int, v interface{}) {
+	t.Helper()
+	tokenRequest(t, raft.TokenHeader, clusterToken, method, url, body, expectedCode, v)
+}
+
+// waitLeader waits for one of the servers at urls to lead the cluster and
+// returns its URL
+func waitLeader(t *testing.T, urls ...string) string {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		for _, url := range urls {
+			var status raft.Status
+			replicaRequest(t, "GET", url+"/cluster/status", "", http.StatusOK, &status)
+			if status.Role == raft.RoleLeader && status.CommitIndex == status.LastLogIndex {
+				return url
+			}
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("no leader elected among %v", urls)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func Test_cluster(t *testing.T) {
+	members := map[string]string{}
+	servers := map[string]*httptest.Server{}
+	for _, id := range []string{"db1", "db2", "db3"} {
+		servers[id], members[id] = unstartedServer()
+	}
+	for _, id := range []string{"db1", "db2", "db3"} {
+		var bootstrap map[string]string
+		if id == "db1" {
+			bootstrap = members
+		}
+		clusterServer(t, id, servers[id], bootstrap)
+	}
+
+	leader := waitLeader(t, members["db1"], members["db2"], members["db3"])
+	var followers []string
+	for _, url := range members {
+		if url != leader {
+			followers = append(followers, url)
+		}
+	}
+
+	// Changes sent to followers are forwarded to the leader, and read back
+	// from the follower at once
+	var created map[string]interface{}
+	replicaRequest(t, "POST", followers[0]+"/records", `{"host":"db01"}`, http.StatusOK, &created)
+	if created["id"] != float64(1) {
+		t.Errorf("expected ID 1, got %v", created["id"])
+	}
+	replicaRequest(t, "PUT", followers[1]+"/records/1", `{"host":"db01b"}`, http.StatusOK, nil)
+	replicaRequest(t, "GET", followers[1]+"/records/1", "", http.StatusOK, &created)
+	if created["host"] != "db01b" {
+		t.Errorf("expected the update, got %v", created)
+	}
+	var p problem
+	replicaRequest(t, "DELETE", followers[0]+"/records/7", "", http.StatusNotFound, &p)
+	if p.Code != codeNotFound {
+		t.Errorf("expected %q, got %q", codeNotFound, p.Code)
+	}
+
+	// A new server joins through a follower and is sent the database
+	server, url := unstartedServer()
+	clusterServer(t, "db4", server, nil)
+	var status raft.Status
+	replicaRequest(t, "POST", followers[0]+"/cluster/members", `{"id":"db4","address":"`+url+`"}`, http.StatusUnauthorized, nil)
+	clusterRequest(t, "POST", followers[0]+"/cluster/members", `{"id":"db4","address":"`+url+`"}`, http.StatusOK, &status)
+	replicaRequest(t, "POST", url+"/records", `{"host":"db02"}`, http.StatusOK, &created)
+	replicaRequest(t, "GET", url+"/records/1", "", http.StatusOK, &created)
+	replicaRequest(t, "GET", url+"/cluster/status", "", http.StatusOK, &status)
+	if len(status.Members) != 4 || status.Role != raft.RoleFollower {
+		t.Errorf("unexpected status %+v", status)
+	}
+
+	clusterRequest(t, "POST", leader+"/cluster/members", `{"id":"db4","address":"`+url+`"}`, http.StatusConflict, &p)
+	clusterRequest(t, "POST", leader+"/cluster/members", `{"id":"db5","address":"db5:8080"}`, http.StatusBadRequest, &p)
+	replicaRequest(t, "DELETE", leader+"/cluster/members/db4", "", http.StatusUnauthorized, &p)
+	clusterRequest(t, "DELETE", leader+"/cluster/members/db5", "", http.StatusNotFound, &p)
+	clusterRequest(t, "DELETE", leader+"/cluster/members/db4", "", http.StatusOK, &status)
+	if len(status.Members) != 3 {
+		t.Errorf("expected 3 members, got %+v", status.Members)
+	}
+
+	// Members only answer each other
+	replicaRequest(t, "POST", leader+raft.VotePath, `{}`, http.StatusUnauthorized, &p)
+	if p.Code != codeInvalidToken {
+		t.Errorf("expected %q, got %q", codeInvalidToken, p.Code)
+	}
+}
+
+func Test_clusterNotEnabled(t *testing.T) {
+	handler := (&application{DB: &testdb.TestDB{}}).routes()
+	for _, route := range []struct{ method, path string }{
+		{"POST", raft.VotePath},
+		{"POST", raft.AppendPath},
+		{"POST", raft.SnapshotPath},
+		{"POST", raft.ForwardPath},
+		{"GET", "/cluster/status"},
+		{"POST", "/cluster/members"},
+		{"DELETE", "/cluster/members/db1"},
+	} {
+		var p problem
+		backupRequest(t, handler, route.method, route.path, http.StatusNotImplemented, &p)
+		if p.Code != codeNotSupported {
+			t.Errorf("%s %s: expected %q, got %q", route.method, route.path, codeNotSupported, p.Code)
+		}
+	}
+}
+
+func Test_parseMembers(t *testing.T) {
+	tests := []struct {
+		name     string
+		list     string
+		expected map[string]string
+	}{
+		{"members", "db1=http://db1:8080, db2=https://db2/", map[string]string{"db1": "http://db1:8080", "db2": "https://db2"}},
+		{"missing address", "db1", nil},
+		{"missing ID", "=http://db1:8080", nil},
+		{"not a URL", "db1=db1:8080", nil},
+		{"listed twice", "db1=http://db1:8080,db1=http://db2:8080", nil},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			members, err := parseMembers(test.list)
+			if (err == nil) != (test.expected != nil) || !reflect.DeepEqual(members, test.expected) {
+				t.Errorf("expected %v, got %v (%v)", test.expected, members, err)
+			}
+		})
+	}
+}
+
+func Test_openCluster(t *testing.T) {
+	dir := t.TempDir()
+	db, err := filedb.Open(filepath.Join(dir, "db.json"))
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer db.Close()
+
+	if _, err := openCluster(db, idgen.Default(), "db3", "db1=http://db1:8080", filepath.Join(dir, "raft"), "", nil); err == nil {
+		t.Errorf("expected a server outside the bootstrap list to fail")
+	}
+	node, err := openCluster(db, idgen.Default(), "db1", "db1=http://db1:8080", filepath.Join(dir, "raft"), "", nil)
+	if err != nil {
+		t.Fatalf("openCluster failed: %v", err)
+	}
+	defer node.Close()
+	if status := node.Status(); len(status.Members) != 1 || status.Members[0].Address != "http://db1:8080" {
+		t.Errorf("unexpected status %+v", status)
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"zabbixhw/pkg/raft"
+	"zabbixhw/pkg/repository/dberr"
+)
+
+// Machine-readable problem codes returned in the "code" member
+const (
+	codeInvalidJSON        = "invalid-json"
+	codeIDNotAllowed       = "id-not-allowed"
+	codeInvalidID          = "invalid-id"
+	codeNotFound           = "not-found"
+	codeConflict           = "conflict"
+	codeValidation         = "validation-failed"
+	codeInvalidIDType      = "invalid-id-type"
+	codeStorageUnavailable = "storage-unavailable"
+	codeReadOnly           = "read-only"
+	codeTimeout            = "timeout"
+	codeNotSupported       = "not-supported"
+	codeInvalidKeys        = "invalid-keys"
+	codeInvalidToken       = "invalid-token"
+	codeNotLeader          = "not-leader"
+	codeResync             = "resync"
+	codeOutcomeUnknown     = "outcome-unknown"
+	codeMembershipChange   = "membership-change"
+	codeSyncFailed         = "sync-failed"
+	codeInternal           = "internal-error"
+)
+
+// problem is an RFC 7807 problem details body
+type problem struct {
+	Type     string `json:"type"`
+	Title    string `json:"title"`
+	Status   int    `json:"status"`
+	Detail   string `json:"detail,omitempty"`
+	Instance string `json:"instance,omitempty"`
+	Code     string `json:"code"`
+}
+
+// writeProblem sends an application/problem+json response
+func writeProblem(w http.ResponseWriter, r *http.Request, status int, code, detail string) {
+	response, err := json.Marshal(problem{
+		Type:     "/problems/" + code,
+		Title:    http.StatusText(status),
+		Status:   status,
+		Detail:   detail,
+		Instance: r.URL.Path,
+		Code:     code,
+	})
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.WriteHeader(status)
+	w.Write(response)
+}
+
+// dbErrorResponse maps an error returned by the database to a problem response
+func dbErrorResponse(w http.ResponseWriter, r *http.Request, err error) {
+	switch {
+	case errors.Is(err, dberr.ErrNotFound):
+		writeProblem(w, r, http.StatusNotFound, codeNotFound, err.Error())
+	case errors.Is(err, dberr.ErrConflict):
+		writeProblem(w, r, http.StatusConflict, codeConflict, err.Error())
+	case errors.Is(err, dberr.ErrValidation):
+		writeProblem(w, r, http.StatusBadRequest, codeValidation, err.Error())
+	case errors.Is(err, dberr.ErrInvalidIDType):
+		writeProblem(w, r, http.StatusInternalServerError, codeInvalidIDType, err.Error())
+	case errors.Is(err, dberr.ErrStorageUnavailable):
+		// The underlying cause may reveal file paths, keep it out of the response
+		writeProblem(w, r, http.StatusServiceUnavailable, codeStorageUnavailable, dberr.ErrStorageUnavailable.Error())
+	case errors.Is(err, dberr.ErrReadOnly):
+		writeProblem(w, r, http.StatusServiceUnavailable, codeReadOnly, err.Error())
+	case errors.Is(err, dberr.ErrNotLeader):
+		writeProblem(w, r, http.StatusServiceUnavailable, codeNotLeader, err.Error())
+	case errors.Is(err, raft.ErrOutcomeUnknown):
+		writeProblem(w, r, http.StatusServiceUnavailable, codeOutcomeUnknown, err.Error())
+	case errors.Is(err, raft.ErrMembershipChange):
+		writeProblem(w, r, http.StatusConflict, codeMembershipChange, err.Error())
+	case errors.Is(err, context.DeadlineExceeded), errors.Is(err, context.Canceled):
+		writeProblem(w, r, http.StatusServiceUnavailable, codeTimeout, "request timed out")
+	default:
+		writeProblem(w, r, http.StatusInternalServerError, codeInternal, "")
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"zabbixhw/pkg/repository/dberr"
+)
+
+func Test_dbErrorResponse(t *testing.T) {
+	tests := []struct {
+		name         string
+		err          error
+		expectedCode int
+		expectedBody string
+	}{
+		{"Not found", dberr.ErrNotFound, http.StatusNotFound, codeNotFound},
+		{"Wrapped not found", fmt.Errorf("lookup: %w", dberr.ErrNotFound), http.StatusNotFound, codeNotFound},
+		{"Conflict", dberr.Conflict("record changed"), http.StatusConflict, codeConflict},
+		{"Validation", dberr.Validation("bad field"), http.StatusBadRequest, codeValidation},
+		{"Invalid ID type", dberr.ErrInvalidIDType, http.StatusInternalServerError, codeInvalidIDType},
+		{"Storage unavailable", dberr.Unavailable(io.ErrShortWrite), http.StatusServiceUnavailable, codeStorageUnavailable},
+		{"Read-only", dberr.ErrReadOnly, http.StatusServiceUnavailable, codeReadOnly},
+		{"Deadline", context.DeadlineExceeded, http.StatusServiceUnavailable, codeTimeout},
+		{"Unknown", errors.New("boom"), http.StatusInternalServerError, codeInternal},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/records/1", nil)
+			rr := httptest.NewRecorder()
+			dbErrorResponse(rr, req, tt.err)
+
+			if rr.Code != tt.expectedCode {
+				t.Errorf("expected status code %d, got %d", tt.expectedCode, rr.Code)
+			}
+			checkResponseBody(t, rr, tt.expectedBody)
+		})
+	}
+}
+
+func Test_dbErrorResponseHidesCause(t *testing.T) {
+	req := httptest.NewRequest("GET", "/records/1", nil)
+	rr := httptest.NewRecorder()
+	dbErrorResponse(rr, req, dberr.Unavailable(errors.New("open /secret/path/db.json: permission denied")))
+
+	if strings.Contains(rr.Body.String(), "/secret/path") {
+		t.Errorf("expected storage details to be hidden, got %s", rr.Body.String())
+	}
+}
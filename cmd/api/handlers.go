@@ -2,39 +2,40 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
+	"io"
 	"net/http"
-	"strconv"
+	"zabbixhw/pkg/repository"
+	"zabbixhw/pkg/repository/idgen"
 )
 
 // postRecordHandler handles the creation of a new record
 func (app *application) postRecordHandler(w http.ResponseWriter, r *http.Request) {
 
 	// Decode the JSON body into a map
-	var record map[string]interface{}
-	decoder := json.NewDecoder(r.Body)
-	err := decoder.Decode(&record)
+	record, err := decodeRecord(r)
 	if err != nil {
-		http.Error(w, "Error decoding JSON", http.StatusBadRequest)
+		writeProblem(w, r, http.StatusBadRequest, codeInvalidJSON, "Error decoding JSON")
 		return
 	}
 
 	// Check if the JSON contains the field "id"
 	if _, exists := record["id"]; exists {
-		http.Error(w, "Field 'id' is not allowed", http.StatusBadRequest)
+		writeProblem(w, r, http.StatusBadRequest, codeIDNotAllowed, "Field 'id' is not allowed")
 		return
 	}
 
 	// Create the record in the database
-	err = app.DB.CreateRecord(record)
+	err = app.DB.CreateRecord(r.Context(), record)
 	if err != nil {
-		http.Error(w, "Error creating record", http.StatusInternalServerError)
+		dbErrorResponse(w, r, err)
 		return
 	}
 
 	// Respond back with the created record
 	response, err := json.Marshal(record)
 	if err != nil {
-		http.Error(w, "Error encoding response JSON", http.StatusInternalServerError)
+		writeProblem(w, r, http.StatusInternalServerError, codeInternal, "Error encoding response JSON")
 		return
 	}
 
@@ -44,24 +45,23 @@ func (app *application) postRecordHandler(w http.ResponseWriter, r *http.Request
 
 // getRecordHandler handles fetching a record by ID
 func (app *application) getRecordHandler(w http.ResponseWriter, r *http.Request) {
-	idStr := r.PathValue("id")
-	id, err := strconv.ParseUint(idStr, 10, 32)
+	id, err := app.parseID(r.PathValue("id"))
 	if err != nil {
-		http.Error(w, "Invalid ID", http.StatusBadRequest)
+		writeProblem(w, r, http.StatusBadRequest, codeInvalidID, "Invalid ID")
 		return
 	}
 
 	// Read the record from the database
-	record, err := app.DB.ReadRecord(uint32(id))
+	record, err := app.DB.ReadRecord(r.Context(), id)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		dbErrorResponse(w, r, err)
 		return
 	}
 
 	// Respond back with the fetched record
 	response, err := json.Marshal(record)
 	if err != nil {
-		http.Error(w, "Error encoding response JSON", http.StatusInternalServerError)
+		writeProblem(w, r, http.StatusInternalServerError, codeInternal, "Error encoding response JSON")
 		return
 	}
 
@@ -72,39 +72,36 @@ func (app *application) getRecordHandler(w http.ResponseWriter, r *http.Request)
 // putRecordHandler handles updating a record by ID
 func (app *application) putRecordHandler(w http.ResponseWriter, r *http.Request) {
 	// Getting id to update from URL parameters
-	idStr := r.PathValue("id")
-	id, err := strconv.ParseUint(idStr, 10, 32)
+	id, err := app.parseID(r.PathValue("id"))
 	if err != nil {
-		http.Error(w, "Invalid ID", http.StatusBadRequest)
+		writeProblem(w, r, http.StatusBadRequest, codeInvalidID, "Invalid ID")
 		return
 	}
 
 	// Decode the JSON body into a map
-	var record map[string]interface{}
-	decoder := json.NewDecoder(r.Body)
-	err = decoder.Decode(&record)
+	record, err := decodeRecord(r)
 	if err != nil {
-		http.Error(w, "Error decoding JSON", http.StatusBadRequest)
+		writeProblem(w, r, http.StatusBadRequest, codeInvalidJSON, "Error decoding JSON")
 		return
 	}
 
 	// Check if the JSON contains the field "id"
 	if _, exists := record["id"]; exists {
-		http.Error(w, "Field 'id' is not allowed", http.StatusBadRequest)
+		writeProblem(w, r, http.StatusBadRequest, codeIDNotAllowed, "Field 'id' is not allowed")
 		return
 	}
 
 	// Update the record in the database
-	err = app.DB.UpdateRecord(uint32(id), record)
+	err = app.DB.UpdateRecord(r.Context(), id, record)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		dbErrorResponse(w, r, err)
 		return
 	}
 
 	// Respond back with the updated record
 	response, err := json.Marshal(record)
 	if err != nil {
-		http.Error(w, "Error encoding response JSON", http.StatusInternalServerError)
+		writeProblem(w, r, http.StatusInternalServerError, codeInternal, "Error encoding response JSON")
 		return
 	}
 
@@ -114,20 +111,62 @@ func (app *application) putRecordHandler(w http.ResponseWriter, r *http.Request)
 
 // deleteRecordHandler handles deleting a record by ID
 func (app *application) deleteRecordHandler(w http.ResponseWriter, r *http.Request) {
-	idStr := r.PathValue("id")
-	id, err := strconv.ParseUint(idStr, 10, 32)
+	id, err := app.parseID(r.PathValue("id"))
 	if err != nil {
-		http.Error(w, "Invalid ID", http.StatusBadRequest)
+		writeProblem(w, r, http.StatusBadRequest, codeInvalidID, "Invalid ID")
 		return
 	}
 
 	// Delete the record from the database
-	err = app.DB.DeleteRecord(uint32(id))
+	err = app.DB.DeleteRecord(r.Context(), id)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		dbErrorResponse(w, r, err)
 		return
 	}
 
 	// Respond with no content status
 	w.WriteHeader(http.StatusNoContent)
 }
+
+// parseID validates an ID taken from the URL against the configured ID strategy
+func (app *application) parseID(idStr string) (repository.ID, error) {
+	ids := app.IDs
+	if ids == nil {
+		ids = idgen.Default()
+	}
+	return ids.ParseID(idStr)
+}
+
+// decodeRecord reads the request body as a single JSON object. Numbers are
+// kept exact instead of being rounded to float64
+func decodeRecord(r *http.Request) (map[string]interface{}, error) {
+	var record map[string]interface{}
+	decoder := json.NewDecoder(r.Body)
+	decoder.UseNumber()
+	if err := decoder.Decode(&record); err != nil {
+		return nil, err
+	}
+
+	// A literal null decodes without error but leaves no object to store
+	if record == nil {
+		return nil, errors.New("body is not a JSON object")
+	}
+	if _, err := decoder.Token(); err != io.EOF {
+		return nil, errors.New("unexpected data after JSON object")
+	}
+
+	return record, nil
+}
+
+// writeJSON sends v as JSON
+func writeJSON(w http.ResponseWriter, r *http.Request, code int, v interface{}) {
+	response, err := json.Marshal(v)
+	if err != nil {
+		writeProblem(w, r, http.StatusInternalServerError, codeInternal, "Error encoding response JSON")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	w.Write(response)
+}
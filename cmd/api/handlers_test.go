@@ -7,6 +7,7 @@ import (
 	"net/http/httptest"
 	"testing"
 	"zabbixhw/pkg/helpers"
+	"zabbixhw/pkg/repository/idgen"
 	"zabbixhw/pkg/repository/testdb"
 )
 
@@ -40,6 +41,17 @@ func Test_postRecordHandler(t *testing.T) {
 			expectedBody: `{"id":1,"name":"John","address":{"street":"123 Main St","city":"Anytown"}}`,
 			errExpected:  false,
 		},
+		{
+			name: "Large integers and high-precision decimals",
+			input: `{
+				"big": 12345678901234567890123,
+				"maxUint64": 18446744073709551615,
+				"pi": 3.14159265358979323846264338327950288
+			}`,
+			expectedCode: http.StatusOK,
+			expectedBody: `{"id":1,"big":12345678901234567890123,"maxUint64":18446744073709551615,"pi":3.14159265358979323846264338327950288}`,
+			errExpected:  false,
+		},
 		{
 			name: "JSON with id",
 			input: `{
@@ -47,14 +59,28 @@ func Test_postRecordHandler(t *testing.T) {
 				"name": "John"
 			}`,
 			expectedCode: http.StatusBadRequest,
-			expectedBody: "Field 'id' is not allowed\n",
+			expectedBody: codeIDNotAllowed,
 			errExpected:  true,
 		},
 		{
 			name:         "No JSON given",
 			input:        ``,
 			expectedCode: http.StatusBadRequest,
-			expectedBody: "Error decoding JSON\n",
+			expectedBody: codeInvalidJSON,
+			errExpected:  true,
+		},
+		{
+			name:         "JSON null",
+			input:        `null`,
+			expectedCode: http.StatusBadRequest,
+			expectedBody: codeInvalidJSON,
+			errExpected:  true,
+		},
+		{
+			name:         "Trailing data after object",
+			input:        `{"name": "John"} {"name": "Jane"}`,
+			expectedCode: http.StatusBadRequest,
+			expectedBody: codeInvalidJSON,
 			errExpected:  true,
 		},
 		{
@@ -64,7 +90,7 @@ func Test_postRecordHandler(t *testing.T) {
 				"name
 			}`,
 			expectedCode: http.StatusBadRequest,
-			expectedBody: "Error decoding JSON\n",
+			expectedBody: codeInvalidJSON,
 			errExpected:  true,
 		},
 	}
@@ -99,7 +125,9 @@ func Test_postRecordHandler(t *testing.T) {
 			if !tt.errExpected {
 				var actualBodyMap map[string]interface{}
 
-				err := json.Unmarshal(rr.Body.Bytes(), &actualBodyMap)
+				decoder := json.NewDecoder(rr.Body)
+				decoder.UseNumber()
+				err := decoder.Decode(&actualBodyMap)
 				if err != nil {
 					t.Fatalf("error unmarshaling actual body: %v", err)
 				}
@@ -115,9 +143,7 @@ func Test_postRecordHandler(t *testing.T) {
 
 			} else {
 				// Check the response body
-				if rr.Body.String() != tt.expectedBody {
-					t.Errorf("expected body %q, got %q", tt.expectedBody, rr.Body.String())
-				}
+				checkResponseBody(t, rr, tt.expectedBody)
 			}
 
 		})
@@ -142,13 +168,13 @@ func Test_getRecordHandler(t *testing.T) {
 			name:         "Invalid ID",
 			path:         "/records/abc",
 			expectedCode: http.StatusBadRequest,
-			expectedBody: "Invalid ID\n",
+			expectedBody: codeInvalidID,
 		},
 		{
 			name:         "Record Not Found",
 			path:         "/records/999",
-			expectedCode: http.StatusBadRequest,
-			expectedBody: "record not found\n",
+			expectedCode: http.StatusNotFound,
+			expectedBody: codeNotFound,
 		},
 	}
 
@@ -173,9 +199,7 @@ func Test_getRecordHandler(t *testing.T) {
 			}
 
 			// Check the response body
-			if rr.Body.String() != tt.expectedBody {
-				t.Errorf("expected body %q, got %q", tt.expectedBody, rr.Body.String())
-			}
+			checkResponseBody(t, rr, tt.expectedBody)
 		})
 	}
 }
@@ -198,13 +222,13 @@ func Test_deleteRecordHandler(t *testing.T) {
 			name:         "Invalid ID",
 			path:         "/records/abc",
 			expectedCode: http.StatusBadRequest,
-			expectedBody: "Invalid ID\n",
+			expectedBody: codeInvalidID,
 		},
 		{
 			name:         "Record Not Found",
 			path:         "/records/999",
-			expectedCode: http.StatusBadRequest,
-			expectedBody: "record not found\n",
+			expectedCode: http.StatusNotFound,
+			expectedBody: codeNotFound,
 		},
 	}
 
@@ -229,9 +253,7 @@ func Test_deleteRecordHandler(t *testing.T) {
 			}
 
 			// Check the response body
-			if rr.Body.String() != tt.expectedBody {
-				t.Errorf("expected body %q, got %q", tt.expectedBody, rr.Body.String())
-			}
+			checkResponseBody(t, rr, tt.expectedBody)
 		})
 	}
 }
@@ -261,8 +283,8 @@ func Test_updateRecordHandler(t *testing.T) {
 				"name": "John",
 				"pet": "dog"
 			}`,
-			expectedCode: http.StatusBadRequest,
-			expectedBody: "record not found\n",
+			expectedCode: http.StatusNotFound,
+			expectedBody: codeNotFound,
 		},
 		{
 			name: "Invalid Id",
@@ -272,7 +294,7 @@ func Test_updateRecordHandler(t *testing.T) {
 				"pet": "dog"
 			}`,
 			expectedCode: http.StatusBadRequest,
-			expectedBody: "Invalid ID\n",
+			expectedBody: codeInvalidID,
 		},
 		{
 			name: "Field Id in body",
@@ -283,7 +305,7 @@ func Test_updateRecordHandler(t *testing.T) {
 				"pet": "dog"
 			}`,
 			expectedCode: http.StatusBadRequest,
-			expectedBody: "Field 'id' is not allowed\n",
+			expectedBody: codeIDNotAllowed,
 		},
 	}
 
@@ -313,9 +335,178 @@ func Test_updateRecordHandler(t *testing.T) {
 			}
 
 			// Check the response body
-			if rr.Body.String() != tt.expectedBody {
-				t.Errorf("expected body %q, got %q", tt.expectedBody, rr.Body.String())
+			checkResponseBody(t, rr, tt.expectedBody)
+		})
+	}
+}
+
+func Test_getRecordHandlerWithULID(t *testing.T) {
+	tests := []struct {
+		name         string
+		path         string
+		expectedCode int
+		expectedBody string
+	}{
+		{
+			name:         "Valid ULID",
+			path:         "/records/01ARYZ6S41TSV4RRFFQ69G5FAV",
+			expectedCode: http.StatusOK,
+			expectedBody: `{"id":"01ARYZ6S41TSV4RRFFQ69G5FAV","name":"Record 1"}`,
+		},
+		{
+			name:         "Lowercase ULID",
+			path:         "/records/01aryz6s41tsv4rrffq69g5fav",
+			expectedCode: http.StatusOK,
+			expectedBody: `{"id":"01ARYZ6S41TSV4RRFFQ69G5FAV","name":"Record 1"}`,
+		},
+		{
+			name:         "Sequential ID",
+			path:         "/records/1",
+			expectedCode: http.StatusBadRequest,
+			expectedBody: codeInvalidID,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := &application{
+				DB: &testdb.TestDB{
+					Data: []map[string]interface{}{
+						{"id": "01ARYZ6S41TSV4RRFFQ69G5FAV", "name": "Record 1"},
+					},
+				},
+				IDs: idgen.NewULID(),
 			}
+			req := httptest.NewRequest("GET", tt.path, nil)
+			rr := httptest.NewRecorder()
+			mux := http.NewServeMux()
+			mux.HandleFunc("GET /records/{id}", app.getRecordHandler)
+			mux.ServeHTTP(rr, req)
+
+			// Check the status code
+			if rr.Code != tt.expectedCode {
+				t.Errorf("expected status code %d, got %d", tt.expectedCode, rr.Code)
+			}
+
+			// Check the response body
+			checkResponseBody(t, rr, tt.expectedBody)
 		})
 	}
 }
+
+// checkResponseBody compares a successful response body as is, and an error
+// response by the code in its problem details
+func checkResponseBody(t *testing.T, rr *httptest.ResponseRecorder, expected string) {
+	t.Helper()
+
+	if rr.Code < http.StatusBadRequest {
+		if rr.Body.String() != expected {
+			t.Errorf("expected body %q, got %q", expected, rr.Body.String())
+		}
+		return
+	}
+
+	if contentType := rr.Header().Get("Content-Type"); contentType != "application/problem+json" {
+		t.Errorf("expected content type application/problem+json, got %q", contentType)
+	}
+
+	var p problem
+	if err := json.Unmarshal(rr.Body.Bytes(), &p); err != nil {
+		t.Fatalf("error unmarshaling problem body %q: %v", rr.Body.String(), err)
+	}
+	if p.Code != expected {
+		t.Errorf("expected problem code %q, got %q", expected, p.Code)
+	}
+	if p.Status != rr.Code {
+		t.Errorf("expected problem status %d to match response status %d", p.Status, rr.Code)
+	}
+}
+
+// fuzzRecordBody sends body to a write handler and checks the response is
+// either a problem the client caused or the record echoed back exactly
+func fuzzRecordBody(t *testing.T, method, path string, handler func(*application) http.HandlerFunc, body []byte) {
+	app := &application{
+		DB: &testdb.TestDB{
+			Data: []map[string]interface{}{
+				{"id": uint32(1), "name": "Record 1"},
+			},
+		},
+	}
+
+	req := httptest.NewRequest(method, path, bytes.NewReader(body))
+	rr := httptest.NewRecorder()
+	mux := http.NewServeMux()
+	mux.HandleFunc(method+" /records/{id}", handler(app))
+	mux.HandleFunc(method+" /records", handler(app))
+	mux.ServeHTTP(rr, req)
+
+	switch rr.Code {
+	case http.StatusBadRequest:
+		var p problem
+		if err := json.Unmarshal(rr.Body.Bytes(), &p); err != nil {
+			t.Fatalf("expected problem details, got %q", rr.Body.String())
+		}
+		return
+	case http.StatusOK:
+	default:
+		t.Fatalf("unexpected status %d for body %q: %s", rr.Code, body, rr.Body.String())
+	}
+
+	// The response is the request object plus the ID, with numbers untouched
+	var sent map[string]interface{}
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.UseNumber()
+	if err := decoder.Decode(&sent); err != nil {
+		t.Fatalf("handler accepted a body that does not decode: %q", body)
+	}
+
+	var received map[string]interface{}
+	decoder = json.NewDecoder(rr.Body)
+	decoder.UseNumber()
+	if err := decoder.Decode(&received); err != nil {
+		t.Fatalf("response is not a JSON object: %v", err)
+	}
+	if _, ok := received["id"]; !ok {
+		t.Fatalf("response has no id: %v", received)
+	}
+	delete(received, "id")
+
+	ok, err := helpers.CompareMapsAsJSON(sent, received)
+	if err != nil {
+		t.Fatalf("error comparing bodies: %v", err)
+	}
+	if !ok {
+		t.Fatalf("expected %v to be echoed back, got %v", sent, received)
+	}
+}
+
+func recordBodySeeds(f *testing.F) {
+	f.Add([]byte(`{"name": "John"}`))
+	f.Add([]byte(`{"name": "John", "address": {"street": "123 Main St"}}`))
+	f.Add([]byte(`{"big": 12345678901234567890123, "pi": 3.14159265358979323846264338327950288}`))
+	f.Add([]byte(`{"id": 1}`))
+	f.Add([]byte(`{}`))
+	f.Add([]byte(`null`))
+	f.Add([]byte(`[1, 2]`))
+	f.Add([]byte(`{"name": "John"} trailing`))
+	f.Add([]byte(`{"name": "\ud800"}`))
+	f.Add([]byte(``))
+}
+
+func Fuzz_postRecordHandler(f *testing.F) {
+	recordBodySeeds(f)
+	f.Fuzz(func(t *testing.T, body []byte) {
+		fuzzRecordBody(t, "POST", "/records", func(app *application) http.HandlerFunc {
+			return app.postRecordHandler
+		}, body)
+	})
+}
+
+func Fuzz_putRecordHandler(f *testing.F) {
+	recordBodySeeds(f)
+	f.Fuzz(func(t *testing.T, body []byte) {
+		fuzzRecordBody(t, "PUT", "/records/1", func(app *application) http.HandlerFunc {
+			return app.putRecordHandler
+		}, body)
+	})
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+	"zabbixhw/pkg/linearizability"
+	"zabbixhw/pkg/repository"
+	"zabbixhw/pkg/repository/filedb"
+	"zabbixhw/pkg/repository/filedbv2"
+	"zabbixhw/pkg/repository/testdb"
+)
+
+// historyRecorder collects operations from concurrent clients
+type historyRecorder struct {
+	mu      sync.Mutex
+	start   time.Time
+	history []linearizability.Operation
+	ids     []string // IDs returned by completed creates
+}
+
+func (h *historyRecorder) now() int64 {
+	return int64(time.Since(h.start))
+}
+
+func (h *historyRecorder) add(op linearizability.Operation) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.history = append(h.history, op)
+	if in := op.Input.(linearizability.RegisterInput); in.Op == linearizability.OpCreate {
+		h.ids = append(h.ids, op.Key)
+	}
+}
+
+func (h *historyRecorder) pickID(rng *rand.Rand) (string, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if len(h.ids) == 0 {
+		return "", false
+	}
+	return h.ids[rng.Intn(len(h.ids))], true
+}
+
+func TestLinearizability(t *testing.T) {
+	engines := []struct {
+		name string
+		open func(t *testing.T) repository.DatabaseRepoV2
+	}{
+		{
+			name: "testdb",
+			open: func(t *testing.T) repository.DatabaseRepoV2 {
+				return &testdb.TestDB{}
+			},
+		},
+		{
+			name: "filedb",
+			open: func(t *testing.T) repository.DatabaseRepoV2 {
+				file, err := os.Create(filepath.Join(t.TempDir(), "db.json"))
+				if err != nil {
+					t.Fatalf("failed to create file: %v", err)
+				}
+				t.Cleanup(func() { file.Close() })
+
+				db, err := filedb.NewFileDB(file)
+				if err != nil {
+					t.Fatalf("failed to open filedb: %v", err)
+				}
+				return db
+			},
+		},
+		{
+			name: "filedbv2",
+			open: func(t *testing.T) repository.DatabaseRepoV2 {
+				db, err := filedbv2.NewFileDB(filepath.Join(t.TempDir(), "db.json"))
+				if err != nil {
+					t.Fatalf("failed to open filedbv2: %v", err)
+				}
+				t.Cleanup(func() {
+					if err := db.Close(); err != nil {
+						t.Errorf("failed to close filedbv2: %v", err)
+					}
+				})
+				return db
+			},
+		},
+	}
+
+	for _, engine := range engines {
+		t.Run(engine.name, func(t *testing.T) {
+			app := &application{DB: engine.open(t)}
+			server := httptest.NewServer(app.routes())
+			defer server.Close()
+
+			seed := time.Now().UnixNano()
+			history := runClients(t, server, seed, 8, 40)
+
+			result := linearizability.Check(linearizability.RegisterModel(), history)
+			if !result.Ok {
+				t.Fatalf("seed %d: %s", seed, result)
+			}
+		})
+	}
+}
+
+// runClients fires random operations from concurrent clients and returns
+// the recorded history
+func runClients(t *testing.T, server *httptest.Server, seed int64, clients, opsPerClient int) []linearizability.Operation {
+	t.Helper()
+
+	recorder := &historyRecorder{start: time.Now()}
+	var wg sync.WaitGroup
+	for c := 0; c < clients; c++ {
+		wg.Add(1)
+		go func(c int) {
+			defer wg.Done()
+			rng := rand.New(rand.NewSource(seed + int64(c)))
+			for i := 0; i < opsPerClient; i++ {
+				value := fmt.Sprintf("c%d-%d", c, i)
+				if err := randomOperation(server, recorder, rng, c, value); err != nil {
+					t.Errorf("client %d: %v", c, err)
+					return
+				}
+			}
+		}(c)
+	}
+	wg.Wait()
+
+	return recorder.history
+}
+
+// randomOperation performs one request and records it
+func randomOperation(server *httptest.Server, recorder *historyRecorder, rng *rand.Rand, client int, value string) error {
+	id, known := recorder.pickID(rng)
+	kind := linearizability.OpCreate
+	if known {
+		switch n := rng.Intn(20); {
+		case n < 5:
+			kind = linearizability.OpCreate
+		case n < 12:
+			kind = linearizability.OpRead
+		case n < 17:
+			kind = linearizability.OpUpdate
+		default:
+			kind = linearizability.OpDelete
+		}
+	}
+
+	var method, path string
+	var body []byte
+	switch kind {
+	case linearizability.OpCreate:
+		method, path = "POST", "/records"
+		body, _ = json.Marshal(map[string]string{"v": value})
+	case linearizability.OpRead:
+		method, path = "GET", "/records/"+id
+	case linearizability.OpUpdate:
+		method, path = "PUT", "/records/"+id
+		body, _ = json.Marshal(map[string]string{"v": value})
+	case linearizability.OpDelete:
+		method, path = "DELETE", "/records/"+id
+	}
+
+	req, err := http.NewRequest(method, server.URL+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+
+	call := recorder.now()
+	resp, err := server.Client().Do(req)
+	if err != nil {
+		return err
+	}
+	respBody, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	ret := recorder.now()
+	if err != nil {
+		return err
+	}
+
+	input := linearizability.RegisterInput{Op: kind}
+	if kind == linearizability.OpCreate || kind == linearizability.OpUpdate {
+		input.Value = value
+	}
+	output := linearizability.RegisterOutput{}
+
+	switch {
+	case resp.StatusCode == http.StatusNotFound && kind != linearizability.OpCreate:
+	case resp.StatusCode == http.StatusOK || resp.StatusCode == http.StatusNoContent:
+		output.Found = true
+		if kind == linearizability.OpCreate || kind == linearizability.OpRead {
+			var record map[string]interface{}
+			if err := json.Unmarshal(respBody, &record); err != nil {
+				return fmt.Errorf("%s %s: invalid response %q", method, path, respBody)
+			}
+			if kind == linearizability.OpCreate {
+				createdID, ok := repository.FormatID(record["id"])
+				if !ok {
+					return fmt.Errorf("create returned invalid ID %v", record["id"])
+				}
+				id = string(createdID)
+			}
+			output.Value, _ = record["v"].(string)
+		}
+	default:
+		return fmt.Errorf("%s %s: unexpected status %d: %s", method, path, resp.StatusCode, respBody)
+	}
+
+	recorder.add(linearizability.Operation{
+		Key:    id,
+		Call:   call,
+		Return: ret,
+		Input:  input,
+		Output: output,
+		Client: client,
+	})
+	return nil
+}
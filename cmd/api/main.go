@@ -1,40 +1,259 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
+	"time"
+	"zabbixhw/pkg/backup"
+	"zabbixhw/pkg/clock"
+	"zabbixhw/pkg/raft"
+	"zabbixhw/pkg/replication"
 	"zabbixhw/pkg/repository"
+	"zabbixhw/pkg/repository/dbfile"
+	"zabbixhw/pkg/repository/fieldcrypt"
 	"zabbixhw/pkg/repository/filedb"
+	"zabbixhw/pkg/repository/idgen"
+	"zabbixhw/pkg/revsync"
 )
 
 type application struct {
-	DB repository.DatabaseRepo
+	DB        repository.DatabaseRepoV2
+	IDs       idgen.Strategy                  // Validates IDs in request paths, sequential when nil
+	Timeout   time.Duration                   // Deadline for handling a single request, none when zero
+	Keys      func() (*dbfile.Keyring, error) // Reloads the encryption keys for a rekey, nil when the file is not encrypted
+	Tokens    [][]byte                        // Bearer tokens allowed to see sensitive fields in the clear
+	Backups   backup.Store                    // Where backups are written, nil disables them
+	Retention backup.Retention                // Backups kept after each new one
+	scrub     scrubJob                        // Background scrub started through the admin endpoint
+	backup    backupJob                       // Background backup started through the admin endpoint or on schedule
+
+	AdminToken string // Shared secret the admin endpoints require, none when empty
+
+	Replication      *replication.Node // Ships changes to followers or applies those of the leader, nil disables replication
+	ReplicationToken string            // Shared secret followers present, none when empty
+
+	Cluster      *raft.Node // Agrees on changes with the other members of a cluster, nil disables clustering
+	ClusterToken string     // Shared secret members present to each other, none when empty
+
+	Sync      *revsync.Node // Tracks revisions to sync with other instances, nil disables sync
+	SyncToken string        // Shared secret instances syncing together present, none when empty
+}
+
+// engine returns the storage engine under the repositories wrapping it
+func (app *application) engine() repository.DatabaseRepoV2 {
+	db := app.DB
+	for {
+		wrapper, ok := db.(interface {
+			Unwrap() repository.DatabaseRepoV2
+		})
+		if !ok {
+			return db
+		}
+		db = wrapper.Unwrap()
+	}
 }
 
 func main() {
 	// Define the flags with default values
 	filepath := flag.String("filepath", "./dbfile/db.json", "Path to the file")
 	port := flag.Int("port", 8080, "Port number")
+	idStrategy := flag.String("idstrategy", idgen.NameSequential, "ID strategy: sequential, uuidv7, ulid or snowflake")
+	node := flag.Int64("node", 0, "Node ID for snowflake IDs")
+	timeout := flag.Duration("timeout", 5*time.Second, "Deadline for handling a single request, 0 disables it")
+	readOnly := flag.Bool("readonly", false, "Serve reads only, sharing the file with other read-only servers")
+	tail := flag.Bool("tail", false, "Serve reads only from a file another server writes, reloading it as it changes, implies -readonly")
+	tailInterval := flag.Duration("tail-interval", filedb.DefaultTailInterval, "Interval between checks of the file for changes with -tail")
+	verify := flag.String("verify", string(dbfile.PolicyFail), "What to do about records failing their checksum or unreadable lines: fail, quarantine or warn")
+	format := flag.String("format", "", "File layout to write: snapshot, ndjson or msgpack, empty keeps the layout of the file")
+	compress := flag.String("compress", "", "File compression to write: none or gzip, empty keeps the compression of the file")
+	level := flag.Int("compress-level", dbfile.DefaultLevel, "Compression level from 1 (fastest) to 9 (smallest), 0 is the default")
+	sensitive := flag.String("sensitive", "", "Comma separated JSON paths of sensitive fields, such as password,snmp.community, encrypted with the keys and masked in responses")
+	tokenFile := flag.String("reveal-tokens", "", "File of bearer tokens, one per line, allowed to see sensitive fields in the clear")
+	backupTo := flag.String("backup-to", "", "Directory or s3://bucket/prefix URL to write backups to, empty disables backups")
+	backupInterval := flag.Duration("backup-interval", 0, "Interval of scheduled backups, 0 only backs up on request")
+	backupKeep := flag.Int("backup-keep", 7, "Number of backups kept, 0 keeps all")
+	backupMaxAge := flag.Duration("backup-max-age", 0, "Age beyond which backups are removed, 0 keeps them whatever their age")
+	replicate := flag.Bool("replicate", false, "Log changes for followers, and accept being made a follower or promoted")
+	follow := flag.String("follow", "", "URL of the leader to follow, such as http://db1:8080, implies -replicate")
+	replicaName := flag.String("replica-name", "", "Name reported to the leader, the host name and port when empty")
+	replicationLog := flag.Int("replication-log", replication.DefaultRetention, "Changes kept for followers catching up, those further behind copy the whole database")
+	replicationToken := flag.String("replication-token", "", "Shared secret between leader and followers, "+replicationTokenEnv+" is read when empty")
+	clusterID := flag.String("cluster-id", "", "ID of the server in a cluster, empty disables clustering")
+	clusterBootstrap := flag.String("cluster-bootstrap", "", "Members of a new cluster as id=URL pairs, such as db1=http://db1:8080,db2=http://db2:8080, on the server whose records the cluster starts with")
+	clusterDir := flag.String("cluster-dir", "", "Directory of the log and snapshots of the cluster, the database file path with a .raft suffix when empty")
+	syncEnabled := flag.Bool("sync", false, "Track revisions of records to sync with other instances")
+	syncWith := flag.String("sync-with", "", "URL of the instance to sync with on schedule, such as http://central:8080, implies -sync")
+	syncInterval := flag.Duration("sync-interval", time.Minute, "Interval of scheduled syncs with -sync-with")
+	syncPolicy := flag.String("sync-policy", string(revsync.PolicyManual), "What becomes of conflicts: manual keeps every revision until one is picked, newest keeps the one edited last")
+	syncToken := flag.String("sync-token", "", "Shared secret between instances syncing together, "+syncTokenEnv+" is read when empty")
+	clusterToken := flag.String("cluster-token", "", "Shared secret between the members of the cluster, "+clusterTokenEnv+" is read when empty")
+	adminToken := flag.String("admin-token", "", "Shared secret the admin endpoints require, "+adminTokenEnv+" is read when empty")
+	keyFile := flag.String("keyfile", "", "File of AES-256 keys to encrypt the file with, one per line and the first one current, "+dbfile.KeysEnv+" is read when empty")
 
 	// Parse the flags
 	flag.Parse()
 
-	file, err := os.OpenFile(*filepath, os.O_RDWR|os.O_CREATE, 0644)
+	ids, err := idgen.New(*idStrategy, *node)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	policy, err := dbfile.ParsePolicy(*verify)
 	if err != nil {
 		log.Fatal(err)
 	}
-	defer file.Close()
 
-	db, err := filedb.NewFileDB(file)
+	opts := []filedb.Option{filedb.WithIDStrategy(ids), filedb.WithVerifyPolicy(policy)}
+	switch {
+	case *tail:
+		// The writer keeps its lock, the file is followed without one
+		*readOnly = true
+		opts = append(opts, filedb.WithTail(*tailInterval))
+	case *readOnly:
+		opts = append(opts, filedb.WithReadOnly())
+	}
+	if *format != "" {
+		opts = append(opts, filedb.WithFormat(dbfile.Format(*format)))
+	}
+	opts = append(opts, filedb.WithCompression(dbfile.Compression(*compress), *level))
+	keys, err := dbfile.LoadKeys(*keyFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if keys != nil {
+		opts = append(opts, filedb.WithKeys(keys))
+	}
+	db, err := filedb.Open(*filepath, opts...)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer db.Close()
+
+	if report := db.Integrity(); !report.OK() {
+		log.Printf("database file failed verification: %s", report)
+	}
+	if quarantined := db.Quarantined(); len(quarantined) > 0 {
+		if *readOnly {
+			log.Printf("%d records left out, the file is unchanged", len(quarantined))
+		} else {
+			log.Printf("%d records moved to %s", len(quarantined), dbfile.QuarantinePath(*filepath))
+		}
+	}
+
+	paths, err := fieldcrypt.ParsePaths(*sensitive)
+	if err != nil {
+		log.Fatal(err)
+	}
+	tokens, err := loadTokens(*tokenFile)
 	if err != nil {
 		log.Fatal(err)
 	}
 
 	app := &application{
-		DB: db,
+		DB:      db,
+		IDs:     ids,
+		Timeout: *timeout,
+		Tokens:  tokens,
+	}
+	app.AdminToken = *adminToken
+	if app.AdminToken == "" {
+		app.AdminToken = os.Getenv(adminTokenEnv)
+	}
+	if *replicate || *follow != "" {
+		if *readOnly {
+			log.Fatal("replication needs a writable database file")
+		}
+		name := *replicaName
+		if name == "" {
+			host, _ := os.Hostname()
+			name = fmt.Sprintf("%s:%d", host, *port)
+		}
+		app.ReplicationToken = *replicationToken
+		if app.ReplicationToken == "" {
+			app.ReplicationToken = os.Getenv(replicationTokenEnv)
+		}
+		app.Replication = replication.NewNode(db,
+			replication.WithName(name),
+			replication.WithRetention(*replicationLog),
+			replication.WithToken(app.ReplicationToken),
+		)
+		defer app.Replication.Close()
+		if *follow != "" {
+			if err := app.Replication.Follow(context.Background(), *follow); err != nil {
+				log.Fatal(err)
+			}
+		}
+		app.DB = app.Replication
+	}
+	if *clusterID != "" {
+		if *readOnly || app.Replication != nil {
+			log.Fatal("clustering needs a writable database file and excludes -replicate and -follow")
+		}
+		app.ClusterToken = *clusterToken
+		if app.ClusterToken == "" {
+			app.ClusterToken = os.Getenv(clusterTokenEnv)
+		}
+		dir := *clusterDir
+		if dir == "" {
+			dir = *filepath + ".raft"
+		}
+		if app.Cluster, err = openCluster(db, ids, *clusterID, *clusterBootstrap, dir, app.ClusterToken, keys); err != nil {
+			log.Fatal(err)
+		}
+		defer app.Cluster.Close()
+		app.DB = app.Cluster
+	}
+	if *syncEnabled || *syncWith != "" {
+		if *readOnly || app.Replication != nil || app.Cluster != nil {
+			log.Fatal("sync needs a writable database file and excludes -replicate, -follow and -cluster-id")
+		}
+		conflictPolicy, err := revsync.ParsePolicy(*syncPolicy)
+		if err != nil {
+			log.Fatal(err)
+		}
+		app.SyncToken = *syncToken
+		if app.SyncToken == "" {
+			app.SyncToken = os.Getenv(syncTokenEnv)
+		}
+		syncOpts := []revsync.Option{revsync.WithPolicy(conflictPolicy), revsync.WithToken(app.SyncToken)}
+		if keys != nil {
+			syncOpts = append(syncOpts, revsync.WithKeys(keys))
+		}
+		if app.Sync, err = revsync.Open(db, *filepath+".sync", syncOpts...); err != nil {
+			log.Fatal(err)
+		}
+		app.DB = app.Sync
+		if *syncWith != "" {
+			if !validBaseURL(*syncWith) {
+				log.Fatal("-sync-with must be an http or https URL")
+			}
+			go app.scheduleSync(context.Background(), clock.Real{}, *syncWith, *syncInterval)
+		}
+	}
+	// Wrapping replication, the cluster or sync, sensitive fields are
+	// encrypted before they are logged or made into revisions, so other
+	// instances store them as they are here
+	if len(paths) > 0 {
+		if app.DB, err = fieldcrypt.New(app.DB, keys, paths); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if keys != nil {
+		app.Keys = func() (*dbfile.Keyring, error) { return dbfile.LoadKeys(*keyFile) }
+	}
+
+	if *backupTo != "" {
+		if app.Backups, err = backup.OpenStore(*backupTo); err != nil {
+			log.Fatal(err)
+		}
+		app.Retention = backup.Retention{Keep: *backupKeep, MaxAge: *backupMaxAge}
+		if *backupInterval > 0 {
+			go app.scheduleBackups(context.Background(), clock.Real{}, *backupInterval)
+		}
 	}
 
 	addr := fmt.Sprintf(":%d", *port)
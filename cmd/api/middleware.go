@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"zabbixhw/pkg/repository/fieldcrypt"
+)
+
+// minTokenLength keeps guessable reveal tokens out
+const minTokenLength = 16
+
+// adminTokenEnv holds the shared secret of the admin endpoints when the flag
+// is not set
+const adminTokenEnv = "ZHW_ADMIN_TOKEN"
+
+// adminTokenHeader carries the shared secret of the admin endpoints
+const adminTokenHeader = "X-Admin-Token"
+
+// withTimeout attaches the configured deadline to every request context, so
+// the database stops waiting for locks once the request has run out of time
+func (app *application) withTimeout(next http.Handler) http.Handler {
+	if app.Timeout <= 0 {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithTimeout(r.Context(), app.Timeout)
+		defer cancel()
+
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// withAdmin refuses requests to an admin endpoint that lack the admin
+// token, when one is configured
+func (app *application) withAdmin(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if app.AdminToken != "" {
+			token := r.Header.Get(adminTokenHeader)
+			if subtle.ConstantTimeCompare([]byte(token), []byte(app.AdminToken)) != 1 {
+				writeProblem(w, r, http.StatusUnauthorized, codeInvalidToken, "Missing or invalid admin token")
+				return
+			}
+		}
+		next(w, r)
+	}
+}
+
+// withReveal lets requests carrying one of the configured bearer tokens see
+// sensitive fields in the clear. Requests without a token see them masked,
+// requests with an unknown one are refused
+func (app *application) withReveal(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header := r.Header.Get("Authorization")
+		if header == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		token, ok := strings.CutPrefix(header, "Bearer ")
+		if !ok || !app.validToken([]byte(token)) {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeProblem(w, r, http.StatusUnauthorized, codeInvalidToken, "Invalid bearer token")
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(fieldcrypt.WithReveal(r.Context())))
+	})
+}
+
+// validToken reports whether token is one of the configured tokens, taking
+// the same time wherever it differs from them
+func (app *application) validToken(token []byte) bool {
+	valid := 0
+	for _, known := range app.Tokens {
+		valid |= subtle.ConstantTimeCompare(token, known)
+	}
+	return valid == 1
+}
+
+// loadTokens reads bearer tokens from path, one per line. Blank lines and
+// lines starting with # are skipped. It returns nil when path is empty
+func loadTokens(path string) ([][]byte, error) {
+	if path == "" {
+		return nil, nil
+	}
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading token file: %w", err)
+	}
+
+	var tokens [][]byte
+	for i, line := range bytes.Split(content, []byte("\n")) {
+		line = bytes.TrimSpace(line)
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+		if len(line) < minTokenLength {
+			return nil, fmt.Errorf("%s:%d: tokens need at least %d characters", path, i+1, minTokenLength)
+		}
+		tokens = append(tokens, line)
+	}
+	if len(tokens) == 0 {
+		return nil, errors.New(path + ": no tokens")
+	}
+	return tokens, nil
+}
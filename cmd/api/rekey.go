@@ -0,0 +1,47 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"zabbixhw/pkg/repository/dbfile"
+)
+
+// rekeyResponse names the key the file is encrypted with after a rekey
+type rekeyResponse struct {
+	KeyID string   `json:"keyId"`
+	Keys  []string `json:"keys"` // Every key the file can be read with, the current one first
+}
+
+// postRekeyHandler reloads the keys and re-encrypts the database file with
+// the first of them, while requests keep being served
+func (app *application) postRekeyHandler(w http.ResponseWriter, r *http.Request) {
+	db, ok := app.DB.(dbfile.Rekeyer)
+	if !ok || app.Keys == nil {
+		writeProblem(w, r, http.StatusNotImplemented, codeNotSupported, "The database file is not encrypted")
+		return
+	}
+
+	keys, err := app.Keys()
+	if err == nil && keys == nil {
+		err = dbfile.ErrNoKeys
+	}
+	if err != nil {
+		writeProblem(w, r, http.StatusInternalServerError, codeInvalidKeys, err.Error())
+		return
+	}
+	if err := db.Rekey(r.Context(), keys); err != nil {
+		dbErrorResponse(w, r, err)
+		return
+	}
+	log.Printf("database file encrypted with key %s", keys.Primary().ID)
+
+	response, err := json.Marshal(rekeyResponse{KeyID: keys.Primary().ID, Keys: keys.IDs()})
+	if err != nil {
+		writeProblem(w, r, http.StatusInternalServerError, codeInternal, "Error encoding response JSON")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(response)
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"zabbixhw/pkg/repository/dbfile"
+	"zabbixhw/pkg/repository/filedb"
+	"zabbixhw/pkg/repository/testdb"
+)
+
+// writeKeys writes a key file holding a key made of each of keyBytes
+func writeKeys(t *testing.T, path string, keyBytes ...byte) {
+	t.Helper()
+
+	var text bytes.Buffer
+	for _, b := range keyBytes {
+		text.WriteString(base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{b}, dbfile.KeySize)) + "\n")
+	}
+	if err := os.WriteFile(path, text.Bytes(), 0600); err != nil {
+		t.Fatalf("Failed to write key file: %v", err)
+	}
+}
+
+// rekeyRequest sends a rekey request and checks the status code
+func rekeyRequest(t *testing.T, handler http.Handler, expectedCode int) *httptest.ResponseRecorder {
+	t.Helper()
+
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest("POST", "/admin/rekey", nil))
+	if rr.Code != expectedCode {
+		t.Fatalf("expected status code %d, got %d: %s", expectedCode, rr.Code, rr.Body.String())
+	}
+	return rr
+}
+
+func Test_rekeyHandler(t *testing.T) {
+	dir := t.TempDir()
+	path, keyFile := filepath.Join(dir, "db.json"), filepath.Join(dir, "db.keys")
+	writeKeys(t, keyFile, 1)
+
+	keys, err := dbfile.LoadKeys(keyFile)
+	if err != nil {
+		t.Fatalf("LoadKeys failed: %v", err)
+	}
+	db, err := filedb.Open(path, filedb.WithKeys(keys))
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer db.Close()
+	if err := db.CreateRecord(context.Background(), map[string]interface{}{"name": "Alice"}); err != nil {
+		t.Fatalf("CreateRecord failed: %v", err)
+	}
+
+	app := &application{DB: db, Keys: func() (*dbfile.Keyring, error) { return dbfile.LoadKeys(keyFile) }}
+	handler := app.routes()
+
+	// A new current key goes first, the old one stays for reading backups
+	writeKeys(t, keyFile, 2, 1)
+	var response rekeyResponse
+	if err := json.Unmarshal(rekeyRequest(t, handler, http.StatusOK).Body.Bytes(), &response); err != nil {
+		t.Fatalf("error decoding response: %v", err)
+	}
+	newKeys, _ := dbfile.LoadKeys(keyFile)
+	if response.KeyID != newKeys.Primary().ID || len(response.Keys) != 2 {
+		t.Errorf("expected key %s of 2, got %+v", newKeys.Primary().ID, response)
+	}
+	content, _ := os.ReadFile(path)
+	if id := dbfile.EncryptionKeyID(content); id != newKeys.Primary().ID {
+		t.Errorf("expected the file to be encrypted with %s, got %q", newKeys.Primary().ID, id)
+	}
+
+	// A broken key file leaves the file alone
+	if err := os.WriteFile(keyFile, []byte("not a key\n"), 0600); err != nil {
+		t.Fatalf("Failed to write key file: %v", err)
+	}
+	checkResponseBody(t, rekeyRequest(t, handler, http.StatusInternalServerError), codeInvalidKeys)
+	if after, _ := os.ReadFile(path); !bytes.Equal(after, content) {
+		t.Error("a failed rekey changed the file")
+	}
+
+	if _, err := db.ReadRecord(context.Background(), "1"); err != nil {
+		t.Errorf("ReadRecord failed after rekey: %v", err)
+	}
+}
+
+func Test_rekeyHandlerNotSupported(t *testing.T) {
+	checkResponseBody(t, rekeyRequest(t, (&application{DB: &testdb.TestDB{}}).routes(), http.StatusNotImplemented), codeNotSupported)
+
+	db, err := filedb.Open(filepath.Join(t.TempDir(), "db.json"))
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer db.Close()
+	checkResponseBody(t, rekeyRequest(t, (&application{DB: db}).routes(), http.StatusNotImplemented), codeNotSupported)
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+	"zabbixhw/pkg/replication"
+)
+
+// replicationTokenEnv holds the shared secret of followers when the flag
+// is not set
+const replicationTokenEnv = "ZHW_REPLICATION_TOKEN"
+
+// maxPollWait bounds how long a follower may hold a log request open
+const maxPollWait = 30 * time.Second
+
+// followRequest is the body of POST /replication/follow
+type followRequest struct {
+	Leader string `json:"leader"` // Base URL of the leader, such as http://db1:8080
+}
+
+// replicationNode returns the replication node, writing a problem response
+// when replication is not enabled
+func (app *application) replicationNode(w http.ResponseWriter, r *http.Request) (*replication.Node, bool) {
+	if app.Replication == nil {
+		writeProblem(w, r, http.StatusNotImplemented, codeNotSupported, "Replication is not enabled")
+		return nil, false
+	}
+	return app.Replication, true
+}
+
+// followerAllowed checks the shared secret of a follower, when one is
+// configured
+func (app *application) followerAllowed(w http.ResponseWriter, r *http.Request) bool {
+	if app.ReplicationToken == "" {
+		return true
+	}
+	token := r.Header.Get(replication.TokenHeader)
+	if subtle.ConstantTimeCompare([]byte(token), []byte(app.ReplicationToken)) != 1 {
+		writeProblem(w, r, http.StatusUnauthorized, codeInvalidToken, "Missing or invalid replication token")
+		return false
+	}
+	return true
+}
+
+// replicationErrorResponse maps an error of the replication node to a
+// problem response
+func replicationErrorResponse(w http.ResponseWriter, r *http.Request, err error) {
+	if errors.Is(err, replication.ErrResync) {
+		writeProblem(w, r, http.StatusGone, codeResync, err.Error())
+		return
+	}
+	dbErrorResponse(w, r, err)
+}
+
+// replicationLogHandler sends followers the log entries following a
+// position, holding the request for up to wait while there are none
+func (app *application) replicationLogHandler(w http.ResponseWriter, r *http.Request) {
+	node, ok := app.replicationNode(w, r)
+	if !ok || !app.followerAllowed(w, r) {
+		return
+	}
+
+	query := r.URL.Query()
+	after, err := strconv.ParseUint(query.Get("after"), 10, 64)
+	if err != nil {
+		writeProblem(w, r, http.StatusBadRequest, codeValidation, "after must be a log index")
+		return
+	}
+	var wait time.Duration
+	if text := query.Get("wait"); text != "" {
+		if wait, err = time.ParseDuration(text); err != nil || wait < 0 {
+			writeProblem(w, r, http.StatusBadRequest, codeValidation, "wait must be a duration such as 2s")
+			return
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), min(wait, maxPollWait))
+	defer cancel()
+	batch, err := node.Entries(ctx, query.Get("log"), after, query.Get("follower"))
+	if err != nil {
+		replicationErrorResponse(w, r, err)
+		return
+	}
+	writeJSON(w, r, http.StatusOK, batch)
+}
+
+// replicationSnapshotHandler sends followers the whole content of the
+// database and the log position it is at
+func (app *application) replicationSnapshotHandler(w http.ResponseWriter, r *http.Request) {
+	node, ok := app.replicationNode(w, r)
+	if !ok || !app.followerAllowed(w, r) {
+		return
+	}
+
+	state, err := node.State(r.Context())
+	if err != nil {
+		replicationErrorResponse(w, r, err)
+		return
+	}
+	writeJSON(w, r, http.StatusOK, state)
+}
+
+// replicationStatusHandler reports the role of the server and its
+// replication lag
+func (app *application) replicationStatusHandler(w http.ResponseWriter, r *http.Request) {
+	node, ok := app.replicationNode(w, r)
+	if !ok {
+		return
+	}
+
+	writeJSON(w, r, http.StatusOK, node.Status())
+}
+
+// promoteHandler makes the server the leader of a new log
+func (app *application) promoteHandler(w http.ResponseWriter, r *http.Request) {
+	node, ok := app.replicationNode(w, r)
+	if !ok || !app.followerAllowed(w, r) {
+		return
+	}
+
+	if err := node.Promote(r.Context()); err != nil {
+		dbErrorResponse(w, r, err)
+		return
+	}
+	log.Printf("promoted to leader")
+	writeJSON(w, r, http.StatusOK, node.Status())
+}
+
+// followHandler makes the server a follower of the leader in the request
+func (app *application) followHandler(w http.ResponseWriter, r *http.Request) {
+	node, ok := app.replicationNode(w, r)
+	if !ok || !app.followerAllowed(w, r) {
+		return
+	}
+
+	var input followRequest
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		writeProblem(w, r, http.StatusBadRequest, codeInvalidJSON, "Invalid JSON in request body")
+		return
+	}
+	if !validBaseURL(input.Leader) {
+		writeProblem(w, r, http.StatusBadRequest, codeValidation, "leader must be an http or https URL")
+		return
+	}
+
+	if err := node.Follow(r.Context(), input.Leader); err != nil {
+		dbErrorResponse(w, r, err)
+		return
+	}
+	log.Printf("following %s", input.Leader)
+	writeJSON(w, r, http.StatusOK, node.Status())
+}
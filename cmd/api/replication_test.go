@@ -0,0 +1,235 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+	"zabbixhw/pkg/replication"
+	"zabbixhw/pkg/repository/filedb"
+	"zabbixhw/pkg/repository/testdb"
+)
+
+const replicationToken = "0123456789abcdef-replication"
+
+// replicaServer serves a fresh database with replication enabled on a
+// loopback port
+func replicaServer(t *testing.T, name string) (*application, *httptest.Server) {
+	t.Helper()
+
+	db, err := filedb.Open(filepath.Join(t.TempDir(), "db.json"))
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	node := replication.NewNode(db,
+		replication.WithName(name),
+		replication.WithToken(replicationToken),
+		replication.WithPollWait(100*time.Millisecond),
+		replication.WithRetryInterval(10*time.Millisecond),
+	)
+	app := &application{DB: node, Timeout: 5 * time.Second, Replication: node, ReplicationToken: replicationToken}
+	server := httptest.NewServer(app.routes())
+	t.Cleanup(func() {
+		server.Close()
+		node.Close()
+		db.Close()
+	})
+	return app, server
+}
+
+// replicaRequest sends a request to a server and decodes the JSON response
+// into v unless it is nil
+func replicaRequest(t *testing.T, method, url, body string, expectedCode int, v interface{}) {
+	t.Helper()
+	tokenRequest(t, "", "", method, url, body, expectedCode, v)
+}
+
+// tokenRequest sends a request carrying token in header, like replicaRequest
+func tokenRequest(t *testing.T, header, token, method, url, body string, expectedCode int, v interface{}) {
+	t.Helper()
+
+	req, _ := http.NewRequest(method, url, bytes.NewBufferString(body))
+	if header != "" {
+		req.Header.Set(header, token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("%s %s failed: %v", method, url, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != expectedCode {
+		t.Fatalf("%s %s: expected status code %d, got %d", method, url, expectedCode, resp.StatusCode)
+	}
+	if v != nil {
+		if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+			t.Fatalf("error decoding response: %v", err)
+		}
+	}
+}
+
+// follow makes the server at url a follower of leader
+func follow(t *testing.T, url, leader string) {
+	t.Helper()
+	tokenRequest(t, replication.TokenHeader, replicationToken, "POST", url+"/replication/follow", `{"leader":"`+leader+`"}`, http.StatusOK, nil)
+}
+
+// waitReplicated waits for the follower served at url to have applied the
+// log of its leader up to index
+func waitReplicated(t *testing.T, url string, index uint64) replication.Status {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		var status replication.Status
+		replicaRequest(t, "GET", url+"/replication/status", "", http.StatusOK, &status)
+		if status.LogID != "" && status.Index >= index {
+			return status
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%s did not reach index %d: %+v", url, index, status)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func Test_replication(t *testing.T) {
+	_, leader := replicaServer(t, "leader")
+	_, follower1 := replicaServer(t, "follower1")
+	_, follower2 := replicaServer(t, "follower2")
+
+	replicaRequest(t, "POST", leader.URL+"/records", `{"host":"db01"}`, http.StatusOK, nil)
+	for _, follower := range []*httptest.Server{follower1, follower2} {
+		follow(t, follower.URL, leader.URL)
+	}
+	replicaRequest(t, "POST", leader.URL+"/records", `{"host":"db02"}`, http.StatusOK, nil)
+	replicaRequest(t, "PUT", leader.URL+"/records/1", `{"host":"db01b"}`, http.StatusOK, nil)
+
+	for _, follower := range []*httptest.Server{follower1, follower2} {
+		status := waitReplicated(t, follower.URL, 3)
+		if status.Role != replication.RoleFollower || status.Lag != 0 || status.Leader != leader.URL {
+			t.Errorf("unexpected follower status %+v", status)
+		}
+
+		var record map[string]interface{}
+		replicaRequest(t, "GET", follower.URL+"/records/1", "", http.StatusOK, &record)
+		if record["host"] != "db01b" {
+			t.Errorf("expected the update replicated, got %v", record)
+		}
+		replicaRequest(t, "GET", follower.URL+"/records/2", "", http.StatusOK, &record)
+
+		var p problem
+		replicaRequest(t, "POST", follower.URL+"/records", `{"host":"db03"}`, http.StatusServiceUnavailable, &p)
+		if p.Code != codeNotLeader {
+			t.Errorf("expected %q, got %q", codeNotLeader, p.Code)
+		}
+		replicaRequest(t, "DELETE", follower.URL+"/records/1", "", http.StatusServiceUnavailable, &p)
+	}
+
+	var status replication.Status
+	replicaRequest(t, "GET", leader.URL+"/replication/status", "", http.StatusOK, &status)
+	if status.Role != replication.RoleLeader || status.Index != 3 || len(status.Followers) != 2 || status.Followers[0].Name != "follower1" {
+		t.Errorf("unexpected leader status %+v", status)
+	}
+
+	// The leader is lost: the first follower takes over and the second one
+	// follows it
+	leader.Close()
+	tokenRequest(t, replication.TokenHeader, replicationToken, "POST", follower1.URL+"/replication/promote", "", http.StatusOK, &status)
+	if status.Role != replication.RoleLeader {
+		t.Errorf("expected a leader, got %+v", status)
+	}
+	follow(t, follower2.URL, follower1.URL)
+
+	var created map[string]interface{}
+	replicaRequest(t, "POST", follower1.URL+"/records", `{"host":"db03"}`, http.StatusOK, &created)
+	if created["id"] != float64(3) {
+		t.Errorf("expected the promoted leader to go on from the sequence, got %v", created["id"])
+	}
+	waitReplicated(t, follower2.URL, 1)
+	replicaRequest(t, "GET", follower2.URL+"/records/3", "", http.StatusOK, &created)
+}
+
+func Test_replicationHandlers(t *testing.T) {
+	_, server := replicaServer(t, "leader")
+
+	var p problem
+	replicaRequest(t, "GET", server.URL+"/replication/log?after=0", "", http.StatusUnauthorized, &p)
+	replicaRequest(t, "GET", server.URL+"/replication/snapshot", "", http.StatusUnauthorized, &p)
+
+	get := func(path string, expectedCode int, v interface{}) {
+		t.Helper()
+		req, _ := http.NewRequest("GET", server.URL+path, nil)
+		req.Header.Set(replication.TokenHeader, replicationToken)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("GET %s failed: %v", path, err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != expectedCode {
+			t.Fatalf("GET %s: expected status code %d, got %d", path, expectedCode, resp.StatusCode)
+		}
+		json.NewDecoder(resp.Body).Decode(v)
+	}
+
+	var state replication.State
+	get("/replication/snapshot", http.StatusOK, &state)
+	if state.LogID == "" || state.IDStrategy != "sequential" || state.Records == nil {
+		t.Errorf("unexpected state %+v", state)
+	}
+	get("/replication/log?log="+state.LogID+"&after=5", http.StatusGone, &p)
+	if p.Code != codeResync {
+		t.Errorf("expected %q, got %q", codeResync, p.Code)
+	}
+	get("/replication/log?log="+state.LogID+"&after=x", http.StatusBadRequest, &p)
+	var batch replication.Batch
+	get("/replication/log?log="+state.LogID+"&after=0&wait=10ms", http.StatusOK, &batch)
+	if batch.LogID != state.LogID || len(batch.Entries) != 0 {
+		t.Errorf("expected an empty batch, got %+v", batch)
+	}
+
+	replicaRequest(t, "POST", server.URL+"/replication/follow", `{"leader":"http://db1:8080"}`, http.StatusUnauthorized, &p)
+	replicaRequest(t, "POST", server.URL+"/replication/promote", "", http.StatusUnauthorized, &p)
+	tokenRequest(t, replication.TokenHeader, replicationToken, "POST", server.URL+"/replication/follow", `{"leader":"db1:8080"}`, http.StatusBadRequest, &p)
+	tokenRequest(t, replication.TokenHeader, replicationToken, "POST", server.URL+"/replication/follow", `not json`, http.StatusBadRequest, &p)
+
+	// A follower with the wrong token reports why it cannot catch up
+	db, err := filedb.Open(filepath.Join(t.TempDir(), "db.json"))
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer db.Close()
+	follower := replication.NewNode(db, replication.WithToken("wrong"), replication.WithRetryInterval(10*time.Millisecond))
+	defer follower.Close()
+	if err := follower.Follow(context.Background(), server.URL); err != nil {
+		t.Fatalf("Follow failed: %v", err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for !strings.Contains(follower.Status().Error, codeInvalidToken) {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the follower to report %q, got %+v", codeInvalidToken, follower.Status())
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func Test_replicationNotEnabled(t *testing.T) {
+	handler := (&application{DB: &testdb.TestDB{}}).routes()
+	for _, route := range []struct{ method, path string }{
+		{"GET", "/replication/log?after=0"},
+		{"GET", "/replication/snapshot"},
+		{"GET", "/replication/status"},
+		{"POST", "/replication/promote"},
+		{"POST", "/replication/follow"},
+	} {
+		var p problem
+		backupRequest(t, handler, route.method, route.path, http.StatusNotImplemented, &p)
+		if p.Code != codeNotSupported {
+			t.Errorf("%s %s: expected %q, got %q", route.method, route.path, codeNotSupported, p.Code)
+		}
+	}
+}
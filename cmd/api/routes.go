@@ -1,6 +1,10 @@
 package main
 
-import "net/http"
+import (
+	"net/http"
+	"zabbixhw/pkg/raft"
+	"zabbixhw/pkg/revsync"
+)
 
 func (app *application) routes() http.Handler {
 	mux := http.NewServeMux()
@@ -10,5 +14,35 @@ func (app *application) routes() http.Handler {
 	mux.HandleFunc("PUT /records/{id}", app.putRecordHandler)
 	mux.HandleFunc("DELETE /records/{id}", app.deleteRecordHandler)
 
-	return mux
+	mux.HandleFunc("POST /admin/scrub", app.withAdmin(app.postScrubHandler))
+	mux.HandleFunc("GET /admin/scrub", app.withAdmin(app.getScrubHandler))
+	mux.HandleFunc("POST /admin/rekey", app.withAdmin(app.postRekeyHandler))
+	mux.HandleFunc("POST /admin/backup", app.withAdmin(app.postBackupHandler))
+	mux.HandleFunc("GET /admin/backup", app.withAdmin(app.getBackupHandler))
+	mux.HandleFunc("GET /admin/backups", app.withAdmin(app.listBackupsHandler))
+	mux.HandleFunc("GET /admin/tail", app.withAdmin(app.tailHandler))
+
+	mux.HandleFunc("GET /replication/log", app.replicationLogHandler)
+	mux.HandleFunc("GET /replication/snapshot", app.replicationSnapshotHandler)
+	mux.HandleFunc("GET /replication/status", app.replicationStatusHandler)
+	mux.HandleFunc("POST /replication/promote", app.promoteHandler)
+	mux.HandleFunc("POST /replication/follow", app.followHandler)
+
+	mux.HandleFunc("POST "+raft.VotePath, app.raftVoteHandler)
+	mux.HandleFunc("POST "+raft.AppendPath, app.raftAppendHandler)
+	mux.HandleFunc("POST "+raft.SnapshotPath, app.raftSnapshotHandler)
+	mux.HandleFunc("POST "+raft.ForwardPath, app.raftForwardHandler)
+	mux.HandleFunc("GET /cluster/status", app.clusterStatusHandler)
+	mux.HandleFunc("POST /cluster/members", app.addMemberHandler)
+	mux.HandleFunc("DELETE /cluster/members/{id}", app.removeMemberHandler)
+
+	mux.HandleFunc("GET "+revsync.ChangesPath, app.syncChangesHandler)
+	mux.HandleFunc("POST "+revsync.RevisionsPath, app.syncRevisionsHandler)
+	mux.HandleFunc("POST /sync/run", app.syncRunHandler)
+	mux.HandleFunc("GET /sync/status", app.syncStatusHandler)
+	mux.HandleFunc("GET /sync/conflicts", app.listConflictsHandler)
+	mux.HandleFunc("GET /records/{id}/conflicts", app.getConflictsHandler)
+	mux.HandleFunc("POST /records/{id}/resolve", app.resolveHandler)
+
+	return app.withTimeout(app.withReveal(mux))
 }
@@ -1,9 +1,13 @@
 package main
 
 import (
+	"context"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
+	"time"
+	"zabbixhw/pkg/repository"
 	"zabbixhw/pkg/repository/testdb"
 )
 
@@ -29,9 +33,109 @@ func TestRoutesExistence(t *testing.T) {
 			rr := httptest.NewRecorder()
 			handler.ServeHTTP(rr, req)
 
-			if rr.Code == http.StatusNotFound {
+			// Missing records are also 404, but those come as problem details
+			if rr.Code == http.StatusNotFound && rr.Header().Get("Content-Type") != "application/problem+json" {
 				t.Error("expected resource to exist, got 404")
 			}
 		})
 	}
 }
+
+// blockingDB waits on every call until the request context is done
+type blockingDB struct{}
+
+func (blockingDB) CreateRecord(ctx context.Context, data map[string]interface{}) error {
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+func (blockingDB) ReadRecord(ctx context.Context, id repository.ID) (map[string]interface{}, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func (blockingDB) UpdateRecord(ctx context.Context, id repository.ID, data map[string]interface{}) error {
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+func (blockingDB) DeleteRecord(ctx context.Context, id repository.ID) error {
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+func TestRequestTimeout(t *testing.T) {
+	app := &application{
+		DB:      blockingDB{},
+		Timeout: 20 * time.Millisecond,
+	}
+	handler := app.routes()
+
+	tests := []struct {
+		method string
+		path   string
+		body   string
+	}{
+		{"POST", "/records", `{"name": "John"}`},
+		{"GET", "/records/1", ""},
+		{"PUT", "/records/1", `{"name": "John"}`},
+		{"DELETE", "/records/1", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.method, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, tt.path, strings.NewReader(tt.body))
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, req)
+
+			if rr.Code != http.StatusServiceUnavailable {
+				t.Errorf("expected status code %d, got %d", http.StatusServiceUnavailable, rr.Code)
+			}
+		})
+	}
+}
+
+func Test_adminToken(t *testing.T) {
+	const adminToken = "admin-secret-0123"
+	paths := []struct {
+		method string
+		path   string
+	}{
+		{"POST", "/admin/scrub"},
+		{"GET", "/admin/scrub"},
+		{"POST", "/admin/rekey"},
+		{"POST", "/admin/backup"},
+		{"GET", "/admin/backup"},
+		{"GET", "/admin/backups"},
+		{"GET", "/admin/tail"},
+	}
+	tests := []struct {
+		name       string
+		configured string
+		token      string
+		refused    bool
+	}{
+		{"No token configured", "", "", false},
+		{"Missing token", adminToken, "", true},
+		{"Wrong token", adminToken, "admin-secret-0124", true},
+		{"Valid token", adminToken, adminToken, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handler := (&application{DB: &testdb.TestDB{}, AdminToken: tt.configured}).routes()
+			for _, p := range paths {
+				req := httptest.NewRequest(p.method, p.path, nil)
+				if tt.token != "" {
+					req.Header.Set(adminTokenHeader, tt.token)
+				}
+				rr := httptest.NewRecorder()
+				handler.ServeHTTP(rr, req)
+
+				if refused := rr.Code == http.StatusUnauthorized; refused != tt.refused {
+					t.Errorf("%s %s: expected refused %v, got status %d", p.method, p.path, tt.refused, rr.Code)
+				}
+			}
+		})
+	}
+}
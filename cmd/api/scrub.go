@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+	"zabbixhw/pkg/repository/dbfile"
+)
+
+// States of the scrub and backup jobs, reported by their admin endpoints
+const (
+	jobIdle    = "idle"
+	jobRunning = "running"
+	jobDone    = "done"
+	jobFailed  = "failed"
+)
+
+// scrubber is implemented by databases that can verify their file against
+// its checksums
+type scrubber interface {
+	Scrub(ctx context.Context) (dbfile.IntegrityReport, error)
+}
+
+// scrubStatus is the state of the last scrub, as sent to clients
+type scrubStatus struct {
+	State      string                  `json:"state"`
+	StartedAt  *time.Time              `json:"startedAt,omitempty"`
+	FinishedAt *time.Time              `json:"finishedAt,omitempty"`
+	Report     *dbfile.IntegrityReport `json:"report,omitempty"`
+	Error      string                  `json:"error,omitempty"`
+}
+
+// scrubJob runs at most one scrub at a time in the background
+type scrubJob struct {
+	mu     sync.Mutex
+	status scrubStatus
+	done   chan struct{} // Closed when the running scrub finishes
+}
+
+// start begins a scrub of db unless one is running already
+func (j *scrubJob) start(db scrubber) scrubStatus {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if j.status.State == jobRunning {
+		return j.status
+	}
+
+	started := time.Now()
+	j.status = scrubStatus{State: jobRunning, StartedAt: &started}
+	j.done = make(chan struct{})
+	go j.run(db, j.done)
+	return j.status
+}
+
+// run scrubs db and records the outcome. The scrub outlives the request that
+// started it, so it does not use the request context
+func (j *scrubJob) run(db scrubber, done chan struct{}) {
+	defer close(done)
+	report, err := db.Scrub(context.Background())
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	finished := time.Now()
+	j.status.FinishedAt = &finished
+	switch {
+	case err != nil:
+		j.status.State = jobFailed
+		j.status.Error = err.Error()
+		log.Printf("scrub failed: %v", err)
+	default:
+		j.status.State = jobDone
+		j.status.Report = &report
+		if !report.OK() {
+			log.Printf("scrub found damage: %s", report)
+		}
+	}
+}
+
+// current returns the state of the last scrub
+func (j *scrubJob) current() scrubStatus {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if j.status.State == "" {
+		return scrubStatus{State: jobIdle}
+	}
+	return j.status
+}
+
+// postScrubHandler starts a background scrub of the database file
+func (app *application) postScrubHandler(w http.ResponseWriter, r *http.Request) {
+	db, ok := app.engine().(scrubber)
+	if !ok {
+		writeProblem(w, r, http.StatusNotImplemented, codeNotSupported, "The database does not support scrubbing")
+		return
+	}
+
+	writeJSON(w, r, http.StatusAccepted, app.scrub.start(db))
+}
+
+// getScrubHandler reports the state of the last scrub
+func (app *application) getScrubHandler(w http.ResponseWriter, r *http.Request) {
+	if _, ok := app.engine().(scrubber); !ok {
+		writeProblem(w, r, http.StatusNotImplemented, codeNotSupported, "The database does not support scrubbing")
+		return
+	}
+
+	writeJSON(w, r, http.StatusOK, app.scrub.current())
+}
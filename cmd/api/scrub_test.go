@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+	"zabbixhw/pkg/repository/dbfile"
+	"zabbixhw/pkg/repository/filedb"
+	"zabbixhw/pkg/repository/testdb"
+)
+
+// scrubRequest sends a scrub request and decodes the status in the response
+func scrubRequest(t *testing.T, handler http.Handler, method string, expectedCode int) scrubStatus {
+	t.Helper()
+
+	req := httptest.NewRequest(method, "/admin/scrub", nil)
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+
+	if rr.Code != expectedCode {
+		t.Fatalf("expected status code %d, got %d: %s", expectedCode, rr.Code, rr.Body.String())
+	}
+	var status scrubStatus
+	if err := json.Unmarshal(rr.Body.Bytes(), &status); err != nil {
+		t.Fatalf("error decoding response: %v", err)
+	}
+	return status
+}
+
+// waitScrub waits for the running scrub of app to finish
+func waitScrub(t *testing.T, app *application) {
+	t.Helper()
+
+	app.scrub.mu.Lock()
+	done := app.scrub.done
+	app.scrub.mu.Unlock()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("scrub did not finish")
+	}
+}
+
+func Test_scrubHandlers(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "db.json")
+	db, err := filedb.Open(path)
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer db.Close()
+	for _, name := range []string{"Alice", "Bob"} {
+		if err := db.CreateRecord(context.Background(), map[string]interface{}{"name": name}); err != nil {
+			t.Fatalf("CreateRecord failed: %v", err)
+		}
+	}
+
+	app := &application{DB: db}
+	handler := app.routes()
+
+	if status := scrubRequest(t, handler, "GET", http.StatusOK); status.State != jobIdle {
+		t.Errorf("expected %s before the first scrub, got %s", jobIdle, status.State)
+	}
+
+	if status := scrubRequest(t, handler, "POST", http.StatusAccepted); status.State != jobRunning || status.StartedAt == nil {
+		t.Errorf("expected a running scrub, got %+v", status)
+	}
+	waitScrub(t, app)
+	status := scrubRequest(t, handler, "GET", http.StatusOK)
+	if status.State != jobDone || status.Report == nil || !status.Report.OK() || status.Report.Records != 2 {
+		t.Errorf("expected an intact file with 2 records, got %+v", status)
+	}
+
+	// Damage the second record on disk
+	content, _ := os.ReadFile(path)
+	if err := os.WriteFile(path, bytes.Replace(content, []byte(`"Bob"`), []byte(`"Bnb"`), 1), 0644); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+
+	scrubRequest(t, handler, "POST", http.StatusAccepted)
+	waitScrub(t, app)
+	status = scrubRequest(t, handler, "GET", http.StatusOK)
+	if status.State != jobDone || status.Report == nil || !reflect.DeepEqual(status.Report.BadRecords, []int{1}) {
+		t.Errorf("expected record 1 to be bad, got %+v", status)
+	}
+}
+
+// slowScrubber scrubs once release is closed
+type slowScrubber struct {
+	testdb.TestDB
+	calls   chan struct{}
+	release chan struct{}
+}
+
+func (s *slowScrubber) Scrub(ctx context.Context) (dbfile.IntegrityReport, error) {
+	s.calls <- struct{}{}
+	<-s.release
+	return dbfile.IntegrityReport{}, nil
+}
+
+func Test_scrubRunsOnce(t *testing.T) {
+	db := &slowScrubber{calls: make(chan struct{}, 2), release: make(chan struct{})}
+	app := &application{DB: db}
+	handler := app.routes()
+
+	first := scrubRequest(t, handler, "POST", http.StatusAccepted)
+	second := scrubRequest(t, handler, "POST", http.StatusAccepted)
+	if !first.StartedAt.Equal(*second.StartedAt) {
+		t.Errorf("expected the second request to join the running scrub, got %v and %v", first.StartedAt, second.StartedAt)
+	}
+
+	close(db.release)
+	waitScrub(t, app)
+	if len(db.calls) != 1 {
+		t.Errorf("expected 1 scrub, got %d", len(db.calls))
+	}
+}
+
+func Test_scrubNotSupported(t *testing.T) {
+	app := &application{DB: &testdb.TestDB{}}
+	handler := app.routes()
+
+	for _, method := range []string{"GET", "POST"} {
+		req := httptest.NewRequest(method, "/admin/scrub", nil)
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+
+		if rr.Code != http.StatusNotImplemented {
+			t.Errorf("%s: expected status code %d, got %d", method, http.StatusNotImplemented, rr.Code)
+		}
+		checkResponseBody(t, rr, codeNotSupported)
+	}
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"zabbixhw/pkg/repository/dbfile"
+	"zabbixhw/pkg/repository/fieldcrypt"
+	"zabbixhw/pkg/repository/filedb"
+)
+
+const revealToken = "0123456789abcdef-reveal"
+
+// sensitiveRequest sends a request, with token as bearer token unless it is
+// empty, and checks the status code
+func sensitiveRequest(t *testing.T, handler http.Handler, method, path, body, token string, expectedCode int) map[string]interface{} {
+	t.Helper()
+
+	req := httptest.NewRequest(method, path, bytes.NewBufferString(body))
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	if rr.Code != expectedCode {
+		t.Fatalf("%s %s: expected status code %d, got %d: %s", method, path, expectedCode, rr.Code, rr.Body.String())
+	}
+
+	var record map[string]interface{}
+	json.Unmarshal(rr.Body.Bytes(), &record)
+	return record
+}
+
+func Test_sensitiveFields(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "db.json")
+	keys, err := dbfile.NewKeyring(testKey(t))
+	if err != nil {
+		t.Fatalf("NewKeyring failed: %v", err)
+	}
+	db, err := filedb.Open(path, filedb.WithKeys(keys))
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer db.Close()
+	paths, _ := fieldcrypt.ParsePaths("password")
+	fields, err := fieldcrypt.New(db, keys, paths)
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+
+	app := &application{DB: fields, Tokens: [][]byte{[]byte(revealToken)}}
+	handler := app.routes()
+
+	created := sensitiveRequest(t, handler, "POST", "/records", `{"host":"db01","password":"s3cret"}`, "", http.StatusOK)
+	if created["password"] != fieldcrypt.Mask {
+		t.Errorf("expected the password masked in the response, got %v", created)
+	}
+	if got := sensitiveRequest(t, handler, "GET", "/records/1", "", "", http.StatusOK); got["password"] != fieldcrypt.Mask || got["host"] != "db01" {
+		t.Errorf("expected the password masked, got %v", got)
+	}
+	if got := sensitiveRequest(t, handler, "GET", "/records/1", "", revealToken, http.StatusOK); got["password"] != "s3cret" {
+		t.Errorf("expected the password in the clear, got %v", got)
+	}
+	sensitiveRequest(t, handler, "GET", "/records/1", "", "not-the-token-at-all", http.StatusUnauthorized)
+
+	// A masked record sent back keeps its password
+	sensitiveRequest(t, handler, "PUT", "/records/1", `{"host":"db02","password":"***"}`, "", http.StatusOK)
+	if got := sensitiveRequest(t, handler, "GET", "/records/1", "", revealToken, http.StatusOK); got["password"] != "s3cret" || got["host"] != "db02" {
+		t.Errorf("expected the password kept, got %v", got)
+	}
+
+	// Scrubbing still reaches the engine under the wrapper
+	scrubRequest(t, handler, "POST", http.StatusAccepted)
+	waitScrub(t, app)
+
+	if _, err := db.ReadRecord(context.Background(), "1"); err != nil {
+		t.Fatalf("ReadRecord failed: %v", err)
+	}
+	if stored, _ := db.ReadRecord(context.Background(), "1"); stored["password"] == "s3cret" {
+		t.Error("the engine holds the password in the clear")
+	}
+}
+
+func Test_loadTokens(t *testing.T) {
+	dir := t.TempDir()
+	write := func(content string) string {
+		path := filepath.Join(dir, "tokens")
+		if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatalf("Failed to write token file: %v", err)
+		}
+		return path
+	}
+
+	tokens, err := loadTokens(write("# ops\n" + revealToken + "\n\n"))
+	if err != nil || len(tokens) != 1 || string(tokens[0]) != revealToken {
+		t.Errorf("expected one token, got %q (%v)", tokens, err)
+	}
+	if tokens, err := loadTokens(""); tokens != nil || err != nil {
+		t.Errorf("expected no tokens, got %q (%v)", tokens, err)
+	}
+	for _, content := range []string{"short\n", "# none\n"} {
+		if _, err := loadTokens(write(content)); err == nil {
+			t.Errorf("%q: expected an error", content)
+		}
+	}
+}
+
+// testKey returns a fixed key for tests
+func testKey(t *testing.T) *dbfile.Key {
+	t.Helper()
+
+	key, err := dbfile.NewKey(bytes.Repeat([]byte{9}, dbfile.KeySize))
+	if err != nil {
+		t.Fatalf("NewKey failed: %v", err)
+	}
+	return key
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+	"zabbixhw/pkg/clock"
+	"zabbixhw/pkg/repository/fieldcrypt"
+	"zabbixhw/pkg/revsync"
+)
+
+// syncTokenEnv holds the shared secret of instances syncing together when
+// the flag is not set
+const syncTokenEnv = "ZHW_SYNC_TOKEN"
+
+// maxSyncBatch bounds how many records a remote instance gets at once
+const maxSyncBatch = 1000
+
+// syncRequest is the body of POST /sync/run
+type syncRequest struct {
+	Remote string `json:"remote"` // Base URL of the remote instance, such as http://central:8080
+}
+
+// resolveRequest is the body of POST /records/{id}/resolve
+type resolveRequest struct {
+	Rev string `json:"rev"` // Revision to keep
+}
+
+// syncNode returns the sync node, writing a problem response when sync is
+// not enabled
+func (app *application) syncNode(w http.ResponseWriter, r *http.Request) (*revsync.Node, bool) {
+	if app.Sync == nil {
+		writeProblem(w, r, http.StatusNotImplemented, codeNotSupported, "Sync is not enabled")
+		return nil, false
+	}
+	return app.Sync, true
+}
+
+// syncAllowed checks the shared secret of a remote instance, when one is
+// configured
+func (app *application) syncAllowed(w http.ResponseWriter, r *http.Request) bool {
+	if app.SyncToken == "" {
+		return true
+	}
+	token := r.Header.Get(revsync.TokenHeader)
+	if subtle.ConstantTimeCompare([]byte(token), []byte(app.SyncToken)) != 1 {
+		writeProblem(w, r, http.StatusUnauthorized, codeInvalidToken, "Missing or invalid sync token")
+		return false
+	}
+	return true
+}
+
+// syncChangesHandler sends a remote instance the records changed after an
+// update sequence
+func (app *application) syncChangesHandler(w http.ResponseWriter, r *http.Request) {
+	node, ok := app.syncNode(w, r)
+	if !ok || !app.syncAllowed(w, r) {
+		return
+	}
+
+	query := r.URL.Query()
+	since, err := strconv.ParseUint(query.Get("since"), 10, 64)
+	if err != nil {
+		writeProblem(w, r, http.StatusBadRequest, codeValidation, "since must be an update sequence")
+		return
+	}
+	limit := revsync.DefaultBatchSize
+	if text := query.Get("limit"); text != "" {
+		if limit, err = strconv.Atoi(text); err != nil || limit < 1 {
+			writeProblem(w, r, http.StatusBadRequest, codeValidation, "limit must be a positive number")
+			return
+		}
+	}
+
+	changes, err := node.Changes(r.Context(), since, min(limit, maxSyncBatch))
+	if err != nil {
+		dbErrorResponse(w, r, err)
+		return
+	}
+	writeJSON(w, r, http.StatusOK, changes)
+}
+
+// syncRevisionsHandler adds the revisions a remote instance pushed
+func (app *application) syncRevisionsHandler(w http.ResponseWriter, r *http.Request) {
+	node, ok := app.syncNode(w, r)
+	if !ok || !app.syncAllowed(w, r) {
+		return
+	}
+
+	var docs []revsync.Doc
+	decoder := json.NewDecoder(r.Body)
+	decoder.UseNumber()
+	if err := decoder.Decode(&docs); err != nil {
+		writeProblem(w, r, http.StatusBadRequest, codeInvalidJSON, "Invalid JSON in request body")
+		return
+	}
+
+	applied, err := node.ApplyRevisions(r.Context(), docs)
+	if err != nil {
+		dbErrorResponse(w, r, err)
+		return
+	}
+	writeJSON(w, r, http.StatusOK, applied)
+}
+
+// syncRunHandler syncs with the remote instance in the request and returns
+// the report
+func (app *application) syncRunHandler(w http.ResponseWriter, r *http.Request) {
+	node, ok := app.syncNode(w, r)
+	if !ok || !app.syncAllowed(w, r) {
+		return
+	}
+
+	var input syncRequest
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		writeProblem(w, r, http.StatusBadRequest, codeInvalidJSON, "Invalid JSON in request body")
+		return
+	}
+	if !validBaseURL(input.Remote) {
+		writeProblem(w, r, http.StatusBadRequest, codeValidation, "remote must be an http or https URL")
+		return
+	}
+
+	report, err := node.Sync(r.Context(), input.Remote)
+	if err != nil {
+		writeProblem(w, r, http.StatusBadGateway, codeSyncFailed, err.Error())
+		return
+	}
+	writeJSON(w, r, http.StatusOK, report)
+}
+
+// syncStatusHandler reports the update sequence, the conflicts and the
+// checkpoints of the server
+func (app *application) syncStatusHandler(w http.ResponseWriter, r *http.Request) {
+	node, ok := app.syncNode(w, r)
+	if !ok {
+		return
+	}
+
+	status, err := node.Status(r.Context())
+	if err != nil {
+		dbErrorResponse(w, r, err)
+		return
+	}
+	writeJSON(w, r, http.StatusOK, status)
+}
+
+// listConflictsHandler returns the IDs of the records with conflicts
+func (app *application) listConflictsHandler(w http.ResponseWriter, r *http.Request) {
+	node, ok := app.syncNode(w, r)
+	if !ok {
+		return
+	}
+
+	ids, err := node.ConflictIDs(r.Context())
+	if err != nil {
+		dbErrorResponse(w, r, err)
+		return
+	}
+	writeJSON(w, r, http.StatusOK, ids)
+}
+
+// getConflictsHandler returns the revisions of a record that are not
+// deleted, the current one first
+func (app *application) getConflictsHandler(w http.ResponseWriter, r *http.Request) {
+	node, ok := app.syncNode(w, r)
+	if !ok {
+		return
+	}
+	id, err := app.parseID(r.PathValue("id"))
+	if err != nil {
+		writeProblem(w, r, http.StatusBadRequest, codeInvalidID, "Invalid ID")
+		return
+	}
+
+	conflict, err := node.Conflicts(r.Context(), id)
+	if err == nil {
+		err = app.openConflict(r.Context(), conflict)
+	}
+	if err != nil {
+		dbErrorResponse(w, r, err)
+		return
+	}
+	writeJSON(w, r, http.StatusOK, conflict)
+}
+
+// resolveHandler keeps the revision of a record in the request and
+// deletes the others
+func (app *application) resolveHandler(w http.ResponseWriter, r *http.Request) {
+	node, ok := app.syncNode(w, r)
+	if !ok {
+		return
+	}
+	id, err := app.parseID(r.PathValue("id"))
+	if err != nil {
+		writeProblem(w, r, http.StatusBadRequest, codeInvalidID, "Invalid ID")
+		return
+	}
+	var input resolveRequest
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		writeProblem(w, r, http.StatusBadRequest, codeInvalidJSON, "Invalid JSON in request body")
+		return
+	}
+
+	if err := node.Resolve(r.Context(), id, input.Rev); err != nil {
+		dbErrorResponse(w, r, err)
+		return
+	}
+	conflict, err := node.Conflicts(r.Context(), id)
+	if err == nil {
+		err = app.openConflict(r.Context(), conflict)
+	}
+	if err != nil {
+		dbErrorResponse(w, r, err)
+		return
+	}
+	writeJSON(w, r, http.StatusOK, conflict)
+}
+
+// openConflict decrypts or masks the sensitive values of the revisions of a
+// conflict, which the sync node reads from below fieldcrypt
+func (app *application) openConflict(ctx context.Context, conflict *revsync.Conflict) error {
+	fields, ok := app.DB.(*fieldcrypt.Repo)
+	if !ok {
+		return nil
+	}
+	for i, revision := range conflict.Revisions {
+		record, err := fields.OpenRecord(ctx, revision.Record)
+		if err != nil {
+			return err
+		}
+		conflict.Revisions[i].Record = record
+	}
+	return nil
+}
+
+// scheduleSync syncs with remote every interval until ctx is done
+func (app *application) scheduleSync(ctx context.Context, c clock.Clock, remote string, interval time.Duration) {
+	ticker := c.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C():
+			report, err := app.Sync.Sync(ctx, remote)
+			if err != nil {
+				log.Printf("sync with %s failed: %v", remote, err)
+			} else if report.Pulled > 0 || report.Pushed > 0 || len(report.Conflicts) > 0 {
+				log.Printf("synced with %s: %d revisions pulled, %d pushed, %d records in conflict", remote, report.Pulled, report.Pushed, len(report.Conflicts))
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+	"zabbixhw/pkg/repository/dbfile"
+	"zabbixhw/pkg/repository/fieldcrypt"
+	"zabbixhw/pkg/repository/filedb"
+	"zabbixhw/pkg/repository/idgen"
+	"zabbixhw/pkg/repository/testdb"
+	"zabbixhw/pkg/revsync"
+)
+
+const syncToken = "0123456789abcdef-sync"
+
+// syncServer serves a fresh database that syncs with other instances
+func syncServer(t *testing.T) *httptest.Server {
+	t.Helper()
+
+	dir := t.TempDir()
+	ids := idgen.NewUUIDv7()
+	db, err := filedb.Open(filepath.Join(dir, "db.json"), filedb.WithIDStrategy(ids))
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	node, err := revsync.Open(db, filepath.Join(dir, "db.json.sync"), revsync.WithToken(syncToken))
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+
+	app := &application{DB: node, IDs: ids, Timeout: 5 * time.Second, Sync: node, SyncToken: syncToken}
+	server := httptest.NewServer(app.routes())
+	t.Cleanup(func() {
+		server.Close()
+		db.Close()
+	})
+	return server
+}
+
+// syncTokenRequest sends a request carrying the sync token, like replicaRequest
+func syncTokenRequest(t *testing.T, method, url, body string, expectedCode int, v interface{}) {
+	t.Helper()
+	tokenRequest(t, revsync.TokenHeader, syncToken, method, url, body, expectedCode, v)
+}
+
+func Test_sync(t *testing.T) {
+	site, central := syncServer(t), syncServer(t)
+	run := `{"remote":"` + central.URL + `"}`
+
+	var record map[string]interface{}
+	replicaRequest(t, "POST", site.URL+"/records", `{"name":"switch"}`, http.StatusOK, &record)
+	id := record["id"].(string)
+
+	var report revsync.Report
+	syncTokenRequest(t, "POST", site.URL+"/sync/run", run, http.StatusOK, &report)
+	if report.Pushed != 1 || report.Pulled != 0 || len(report.Conflicts) != 0 {
+		t.Errorf("unexpected report %+v", report)
+	}
+	replicaRequest(t, "GET", central.URL+"/records/"+id, "", http.StatusOK, &record)
+	if record["name"] != "switch" {
+		t.Errorf("expected the record on the central server, got %v", record)
+	}
+
+	// Both sides edit the record before the next sync
+	replicaRequest(t, "PUT", site.URL+"/records/"+id, `{"name":"site"}`, http.StatusOK, nil)
+	replicaRequest(t, "PUT", central.URL+"/records/"+id, `{"name":"central"}`, http.StatusOK, nil)
+	syncTokenRequest(t, "POST", site.URL+"/sync/run", run, http.StatusOK, &report)
+	if len(report.Conflicts) != 1 || string(report.Conflicts[0]) != id {
+		t.Errorf("expected a conflict on %s, got %+v", id, report)
+	}
+
+	var ids []string
+	replicaRequest(t, "GET", central.URL+"/sync/conflicts", "", http.StatusOK, &ids)
+	if !reflect.DeepEqual(ids, []string{id}) {
+		t.Errorf("expected conflicts %v, got %v", []string{id}, ids)
+	}
+	var conflict revsync.Conflict
+	replicaRequest(t, "GET", central.URL+"/records/"+id+"/conflicts", "", http.StatusOK, &conflict)
+	if len(conflict.Revisions) != 2 {
+		t.Fatalf("expected 2 revisions, got %+v", conflict)
+	}
+	var siteConflict revsync.Conflict
+	replicaRequest(t, "GET", site.URL+"/records/"+id+"/conflicts", "", http.StatusOK, &siteConflict)
+	if siteConflict.Rev != conflict.Rev {
+		t.Errorf("expected both instances to serve %s, got %s", conflict.Rev, siteConflict.Rev)
+	}
+
+	// The revision kept on the central server wins on the site after a sync
+	keep := conflict.Revisions[1]
+	replicaRequest(t, "POST", central.URL+"/records/"+id+"/resolve", `{"rev":"nope"}`, http.StatusNotFound, nil)
+	replicaRequest(t, "POST", central.URL+"/records/"+id+"/resolve", `{"rev":"`+keep.Rev+`"}`, http.StatusOK, &conflict)
+	if len(conflict.Revisions) != 1 {
+		t.Errorf("expected the conflict resolved, got %+v", conflict)
+	}
+	syncTokenRequest(t, "POST", site.URL+"/sync/run", run, http.StatusOK, &report)
+	replicaRequest(t, "GET", site.URL+"/records/"+id, "", http.StatusOK, &record)
+	if record["name"] != keep.Record["name"] {
+		t.Errorf("expected %v, got %v", keep.Record["name"], record["name"])
+	}
+
+	var status revsync.Status
+	replicaRequest(t, "GET", site.URL+"/sync/status", "", http.StatusOK, &status)
+	if status.Conflicts != 0 || status.LastSync == nil || status.LastSync.Remote != central.URL {
+		t.Errorf("unexpected status %+v", status)
+	}
+}
+
+func Test_syncHandlers(t *testing.T) {
+	server := syncServer(t)
+
+	for _, test := range []struct {
+		name         string
+		method       string
+		path         string
+		body         string
+		expectedCode int
+		expectedErr  string
+	}{
+		{"changes without token", "GET", revsync.ChangesPath + "?since=0", "", http.StatusUnauthorized, codeInvalidToken},
+		{"revisions without token", "POST", revsync.RevisionsPath, `[]`, http.StatusUnauthorized, codeInvalidToken},
+		{"run without token", "POST", "/sync/run", `{"remote":"http://127.0.0.1:1"}`, http.StatusUnauthorized, codeInvalidToken},
+		{"invalid ID", "GET", "/records/1/conflicts", "", http.StatusBadRequest, codeInvalidID},
+		{"unknown record", "GET", "/records/01890a5d-ac96-774b-bcce-b302099a8057/conflicts", "", http.StatusNotFound, codeNotFound},
+		{"invalid resolve", "POST", "/records/01890a5d-ac96-774b-bcce-b302099a8057/resolve", `not json`, http.StatusBadRequest, codeInvalidJSON},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			var p problem
+			replicaRequest(t, test.method, server.URL+test.path, test.body, test.expectedCode, &p)
+			if p.Code != test.expectedErr {
+				t.Errorf("expected %q, got %q", test.expectedErr, p.Code)
+			}
+		})
+	}
+
+	for _, test := range []struct {
+		name         string
+		body         string
+		expectedCode int
+		expectedErr  string
+	}{
+		{"invalid remote", `{"remote":"central:8080"}`, http.StatusBadRequest, codeValidation},
+		{"unreachable remote", `{"remote":"http://127.0.0.1:1"}`, http.StatusBadGateway, codeSyncFailed},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			var p problem
+			syncTokenRequest(t, "POST", server.URL+"/sync/run", test.body, test.expectedCode, &p)
+			if p.Code != test.expectedErr {
+				t.Errorf("expected %q, got %q", test.expectedErr, p.Code)
+			}
+		})
+	}
+}
+
+func Test_syncSensitiveFields(t *testing.T) {
+	dir := t.TempDir()
+	keys, err := dbfile.NewKeyring(testKey(t))
+	if err != nil {
+		t.Fatalf("NewKeyring failed: %v", err)
+	}
+	ids := idgen.NewUUIDv7()
+	db, err := filedb.Open(filepath.Join(dir, "db.json"), filedb.WithIDStrategy(ids), filedb.WithKeys(keys))
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer db.Close()
+	node, err := revsync.Open(db, filepath.Join(dir, "db.json.sync"))
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	paths, _ := fieldcrypt.ParsePaths("password")
+	fields, err := fieldcrypt.New(node, keys, paths)
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+
+	app := &application{DB: fields, IDs: ids, Sync: node, Tokens: [][]byte{[]byte(revealToken)}}
+	handler := app.routes()
+	created := sensitiveRequest(t, handler, "POST", "/records", `{"host":"db01","password":"s3cret"}`, "", http.StatusOK)
+
+	// Revisions are masked like reads
+	for token, expected := range map[string]string{"": fieldcrypt.Mask, revealToken: "s3cret"} {
+		conflict := sensitiveRequest(t, handler, "GET", "/records/"+created["id"].(string)+"/conflicts", "", token, http.StatusOK)
+		revisions, _ := conflict["revisions"].([]interface{})
+		if len(revisions) != 1 {
+			t.Fatalf("expected one revision, got %v", conflict)
+		}
+		if record := revisions[0].(map[string]interface{})["record"].(map[string]interface{}); record["password"] != expected {
+			t.Errorf("expected the password %q, got %v", expected, record)
+		}
+	}
+}
+
+func Test_syncNotEnabled(t *testing.T) {
+	handler := (&application{DB: &testdb.TestDB{}}).routes()
+	for _, route := range []struct{ method, path string }{
+		{"GET", revsync.ChangesPath + "?since=0"},
+		{"POST", revsync.RevisionsPath},
+		{"POST", "/sync/run"},
+		{"GET", "/sync/status"},
+		{"GET", "/sync/conflicts"},
+		{"GET", "/records/1/conflicts"},
+		{"POST", "/records/1/resolve"},
+	} {
+		var p problem
+		backupRequest(t, handler, route.method, route.path, http.StatusNotImplemented, &p)
+		if p.Code != codeNotSupported {
+			t.Errorf("%s %s: expected %q, got %q", route.method, route.path, codeNotSupported, p.Code)
+		}
+	}
+}
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"net/http"
+	"zabbixhw/pkg/repository/filedb"
+)
+
+// tailer is implemented by databases following a file another instance
+// writes
+type tailer interface {
+	TailStatus() (filedb.TailStatus, bool)
+}
+
+// tailHandler reports how the database file is followed: the version
+// served, the reloads and the last error
+func (app *application) tailHandler(w http.ResponseWriter, r *http.Request) {
+	db, ok := app.engine().(tailer)
+	if !ok {
+		writeProblem(w, r, http.StatusNotImplemented, codeNotSupported, "The database is not tailing a file")
+		return
+	}
+	status, ok := db.TailStatus()
+	if !ok {
+		writeProblem(w, r, http.StatusNotImplemented, codeNotSupported, "The database is not tailing a file")
+		return
+	}
+	writeJSON(w, r, http.StatusOK, status)
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+	"zabbixhw/pkg/repository/filedb"
+	"zabbixhw/pkg/repository/testdb"
+)
+
+func Test_tail(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "db.json")
+	writer, err := filedb.Open(path)
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer writer.Close()
+	db, err := filedb.Open(path, filedb.WithTail(time.Millisecond))
+	if err != nil {
+		t.Fatalf("Open with WithTail failed: %v", err)
+	}
+	defer db.Close()
+	server := httptest.NewServer((&application{DB: db}).routes())
+	defer server.Close()
+
+	var p problem
+	replicaRequest(t, "POST", server.URL+"/records", `{"name":"Alice"}`, http.StatusServiceUnavailable, &p)
+	if p.Code != codeReadOnly {
+		t.Errorf("expected %q, got %q", codeReadOnly, p.Code)
+	}
+
+	// Records the writer creates are served once the file is reloaded
+	if err := writer.CreateRecord(context.Background(), map[string]interface{}{"name": "Alice"}); err != nil {
+		t.Fatalf("CreateRecord failed: %v", err)
+	}
+	var status filedb.TailStatus
+	deadline := time.Now().Add(5 * time.Second)
+	for status.Reloads == 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("the change was not reloaded, status %+v", status)
+		}
+		time.Sleep(time.Millisecond)
+		replicaRequest(t, "GET", server.URL+"/admin/tail", "", http.StatusOK, &status)
+	}
+	if status.Path != path || status.Error != "" {
+		t.Errorf("unexpected status %+v", status)
+	}
+	var record map[string]interface{}
+	replicaRequest(t, "GET", server.URL+"/records/1", "", http.StatusOK, &record)
+	if record["name"] != "Alice" {
+		t.Errorf("expected Alice, got %v", record)
+	}
+}
+
+func Test_tailNotEnabled(t *testing.T) {
+	var p problem
+	backupRequest(t, (&application{DB: &testdb.TestDB{}}).routes(), "GET", "/admin/tail", http.StatusNotImplemented, &p)
+	if p.Code != codeNotSupported {
+		t.Errorf("expected %q, got %q", codeNotSupported, p.Code)
+	}
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"zabbixhw/pkg/repository"
+)
+
+// config is the parsed command line
+type config struct {
+	url         string
+	duration    time.Duration // Length of the run, none when zero
+	requests    int64         // Requests to send, unlimited when zero
+	concurrency int
+	mix         mix
+	shape       shape
+	preload     int // Records created before the measured run
+	seed        int64
+}
+
+func main() {
+	url := flag.String("url", "http://localhost:8080", "Base URL of the server")
+	duration := flag.Duration("duration", 10*time.Second, "Length of the run, 0 runs until -requests are sent")
+	requests := flag.Int64("requests", 0, "Requests to send, 0 runs for -duration")
+	concurrency := flag.Int("concurrency", 8, "Concurrent clients")
+	mixFlag := flag.String("mix", "create=2,read=6,update=1,delete=1", "Relative weights of create, read, update and delete")
+	fields := flag.Int("fields", 8, "Most fields in a payload object")
+	depth := flag.Int("depth", 1, "Most levels of nested objects and arrays in a payload")
+	strlen := flag.Int("strlen", 16, "Longest string value in a payload")
+	preload := flag.Int("preload", 100, "Records created before the measured run")
+	seed := flag.Int64("seed", 0, "Seed for operations and payloads, 0 picks one from the clock")
+	timeout := flag.Duration("timeout", 10*time.Second, "Timeout for a single request")
+
+	flag.Parse()
+
+	m, err := parseMix(*mixFlag)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *seed == 0 {
+		*seed = time.Now().UnixNano()
+	}
+
+	cfg := config{
+		url:         strings.TrimSuffix(*url, "/"),
+		duration:    *duration,
+		requests:    *requests,
+		concurrency: *concurrency,
+		mix:         m,
+		shape:       shape{fields: *fields, depth: *depth, strlen: *strlen},
+		preload:     *preload,
+		seed:        *seed,
+	}
+	if err := cfg.validate(); err != nil {
+		log.Fatal(err)
+	}
+
+	client := &http.Client{
+		Timeout:   *timeout,
+		Transport: &http.Transport{MaxIdleConnsPerHost: cfg.concurrency},
+	}
+	r, err := run(cfg, client)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(r); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func (cfg config) validate() error {
+	switch {
+	case cfg.duration <= 0 && cfg.requests <= 0:
+		return errors.New("set a positive -duration or -requests")
+	case cfg.concurrency < 1:
+		return errors.New("-concurrency must be at least 1")
+	case cfg.shape.fields < 1 || cfg.shape.strlen < 1 || cfg.shape.depth < 0:
+		return errors.New("-fields and -strlen must be at least 1, -depth at least 0")
+	case cfg.preload < 0:
+		return errors.New("-preload must not be negative")
+	}
+	return nil
+}
+
+// run preloads the server and then drives it until the duration has passed
+// or the requests are sent
+func run(cfg config, client *http.Client) (report, error) {
+	ids := &idPool{}
+	g := &generator{cfg: cfg, client: client, ids: ids}
+
+	rng := rand.New(rand.NewSource(cfg.seed))
+	for i := 0; i < cfg.preload; i++ {
+		if status := g.create(rng); status != http.StatusOK {
+			return report{}, fmt.Errorf("preloading record %d failed with status %d", i+1, status)
+		}
+	}
+
+	var deadline time.Time
+	if cfg.duration > 0 {
+		deadline = time.Now().Add(cfg.duration)
+	}
+
+	var (
+		sent    atomic.Int64
+		wg      sync.WaitGroup
+		results = make([]stats, cfg.concurrency)
+	)
+	start := time.Now()
+	for w := 0; w < cfg.concurrency; w++ {
+		results[w] = newStats()
+		wg.Add(1)
+		go func(s stats, rng *rand.Rand) {
+			defer wg.Done()
+			for {
+				if !deadline.IsZero() && time.Now().After(deadline) {
+					return
+				}
+				if cfg.requests > 0 && sent.Add(1) > cfg.requests {
+					return
+				}
+				g.do(s, rng)
+			}
+		}(results[w], rand.New(rand.NewSource(cfg.seed+int64(w)+1)))
+	}
+	wg.Wait()
+	elapsed := time.Since(start)
+
+	total := newStats()
+	for _, s := range results {
+		total.merge(s)
+	}
+	return buildReport(cfg, total, elapsed), nil
+}
+
+// generator sends requests to the server
+type generator struct {
+	cfg    config
+	client *http.Client
+	ids    *idPool
+}
+
+// do sends one request picked from the mix and records it. Reads, updates
+// and deletes turn into creates while no record is known
+func (g *generator) do(s stats, rng *rand.Rand) {
+	op := g.cfg.mix.pick(rng)
+
+	var id string
+	var ok bool
+	switch op {
+	case opRead, opUpdate:
+		id, ok = g.ids.random(rng)
+	case opDelete:
+		id, ok = g.ids.take(rng)
+	}
+	if op != opCreate && !ok {
+		op = opCreate
+	}
+
+	start := time.Now()
+	var status int
+	switch op {
+	case opCreate:
+		status = g.create(rng)
+	case opRead:
+		status = g.send(http.MethodGet, "/records/"+id, nil)
+	case opUpdate:
+		status = g.send(http.MethodPut, "/records/"+id, g.cfg.shape.payload(rng))
+	case opDelete:
+		status = g.send(http.MethodDelete, "/records/"+id, nil)
+	}
+	s.record(op, time.Since(start), status)
+}
+
+// create posts a random record and remembers its ID
+func (g *generator) create(rng *rand.Rand) int {
+	resp, err := g.request(http.MethodPost, "/records", g.cfg.shape.payload(rng))
+	if err != nil {
+		return 0
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusOK {
+		var record map[string]interface{}
+		dec := json.NewDecoder(resp.Body)
+		dec.UseNumber()
+		if err := dec.Decode(&record); err == nil {
+			if id, ok := repository.FormatID(record["id"]); ok {
+				g.ids.add(string(id))
+			}
+		}
+	}
+	io.Copy(io.Discard, resp.Body)
+	return resp.StatusCode
+}
+
+// send issues a request and returns its status, 0 when there was no response
+func (g *generator) send(method, path string, body map[string]interface{}) int {
+	resp, err := g.request(method, path, body)
+	if err != nil {
+		return 0
+	}
+	defer resp.Body.Close()
+
+	// Drain the body so the connection is reused
+	io.Copy(io.Discard, resp.Body)
+	return resp.StatusCode
+}
+
+func (g *generator) request(method, path string, body map[string]interface{}) (*http.Response, error) {
+	var reader io.Reader
+	if body != nil {
+		encoded, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		reader = bytes.NewReader(encoded)
+	}
+
+	req, err := http.NewRequest(method, g.cfg.url+path, reader)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	return g.client.Do(req)
+}
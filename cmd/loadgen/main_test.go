@@ -0,0 +1,131 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeServer is a minimal in-memory version of the API
+func fakeServer() http.Handler {
+	var (
+		mu      sync.Mutex
+		seq     int
+		records = make(map[string]map[string]interface{})
+	)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /records", func(w http.ResponseWriter, r *http.Request) {
+		var record map[string]interface{}
+		if err := json.NewDecoder(r.Body).Decode(&record); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		mu.Lock()
+		seq++
+		record["id"] = seq
+		records[strconv.Itoa(seq)] = record
+		mu.Unlock()
+		json.NewEncoder(w).Encode(record)
+	})
+	mux.HandleFunc("/records/{id}", func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		id := r.PathValue("id")
+		if _, ok := records[id]; !ok {
+			http.NotFound(w, r)
+			return
+		}
+		if r.Method == http.MethodDelete {
+			delete(records, id)
+		}
+		w.Write([]byte("{}"))
+	})
+	return mux
+}
+
+func Test_run(t *testing.T) {
+	server := httptest.NewServer(fakeServer())
+	defer server.Close()
+
+	cfg := config{
+		url:         server.URL,
+		requests:    400,
+		concurrency: 4,
+		mix:         mix{opCreate: 1, opRead: 6, opUpdate: 2, opDelete: 1},
+		shape:       shape{fields: 4, depth: 1, strlen: 8},
+		preload:     20,
+		seed:        1,
+	}
+	r, err := run(cfg, server.Client())
+	if err != nil {
+		t.Fatalf("run failed: %v", err)
+	}
+
+	if r.Requests != 400 {
+		t.Errorf("expected 400 requests, got %d", r.Requests)
+	}
+	for _, op := range operations {
+		if r.Operations[op].Requests == 0 {
+			t.Errorf("no %s requests were sent", op)
+		}
+	}
+	if r.LatencyMs.P99 < r.LatencyMs.P50 || r.LatencyMs.Max < r.LatencyMs.P99 {
+		t.Errorf("percentiles out of order: %+v", r.LatencyMs)
+	}
+
+	// The report must be plain JSON
+	if _, err := json.Marshal(r); err != nil {
+		t.Errorf("report does not encode: %v", err)
+	}
+}
+
+func Test_runDuration(t *testing.T) {
+	server := httptest.NewServer(fakeServer())
+	defer server.Close()
+
+	cfg := config{
+		url:         server.URL,
+		duration:    100 * time.Millisecond,
+		concurrency: 2,
+		mix:         mix{opRead: 1},
+		shape:       shape{fields: 1, strlen: 1},
+		preload:     1,
+		seed:        1,
+	}
+	start := time.Now()
+	r, err := run(cfg, server.Client())
+	if err != nil {
+		t.Fatalf("run failed: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("run took %v for a 100ms duration", elapsed)
+	}
+	if r.Requests == 0 || r.Errors != 0 {
+		t.Errorf("expected error-free requests, got %d requests and %d errors", r.Requests, r.Errors)
+	}
+}
+
+func Test_configValidate(t *testing.T) {
+	valid := config{duration: time.Second, concurrency: 1, shape: shape{fields: 1, strlen: 1}}
+	if err := valid.validate(); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	noBound := valid
+	noBound.duration = 0
+	if err := noBound.validate(); err == nil {
+		t.Error("expected an error without duration or requests")
+	}
+
+	noClients := valid
+	noClients.concurrency = 0
+	if err := noClients.validate(); err == nil {
+		t.Error("expected an error without clients")
+	}
+}
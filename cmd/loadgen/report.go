@@ -0,0 +1,147 @@
+package main
+
+import (
+	"math"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// statusTransport stands in for the status of requests that got no response
+const statusTransport = "transport-error"
+
+// opStats collects the results of one operation
+type opStats struct {
+	latencies []time.Duration
+	errors    int
+	statuses  map[string]int
+}
+
+// stats collects results per operation. Every worker has its own, merged
+// once the run is over
+type stats map[string]*opStats
+
+func newStats() stats {
+	s := make(stats)
+	for _, op := range operations {
+		s[op] = &opStats{statuses: make(map[string]int)}
+	}
+	return s
+}
+
+// record adds the result of a request, status 0 meaning it got no response
+func (s stats) record(op string, latency time.Duration, status int) {
+	o := s[op]
+	o.latencies = append(o.latencies, latency)
+
+	key := strconv.Itoa(status)
+	if status == 0 {
+		key = statusTransport
+	}
+	o.statuses[key]++
+	if status < 200 || status > 299 {
+		o.errors++
+	}
+}
+
+func (s stats) merge(other stats) {
+	for op, o := range other {
+		s[op].latencies = append(s[op].latencies, o.latencies...)
+		s[op].errors += o.errors
+		for status, n := range o.statuses {
+			s[op].statuses[status] += n
+		}
+	}
+}
+
+// latencyReport summarizes latencies in milliseconds
+type latencyReport struct {
+	Mean float64 `json:"mean"`
+	P50  float64 `json:"p50"`
+	P90  float64 `json:"p90"`
+	P99  float64 `json:"p99"`
+	Max  float64 `json:"max"`
+}
+
+type opReport struct {
+	Requests   int            `json:"requests"`
+	Errors     int            `json:"errors"`
+	Throughput float64        `json:"throughput"` // Requests per second
+	LatencyMs  latencyReport  `json:"latencyMs"`
+	Statuses   map[string]int `json:"statuses"`
+}
+
+// report is what loadgen prints when the run is over
+type report struct {
+	Target          string              `json:"target"`
+	Mix             string              `json:"mix"`
+	Concurrency     int                 `json:"concurrency"`
+	DurationSeconds float64             `json:"durationSeconds"`
+	Requests        int                 `json:"requests"`
+	Errors          int                 `json:"errors"`
+	Throughput      float64             `json:"throughput"` // Requests per second
+	LatencyMs       latencyReport       `json:"latencyMs"`
+	Operations      map[string]opReport `json:"operations"`
+}
+
+func buildReport(cfg config, s stats, elapsed time.Duration) report {
+	r := report{
+		Target:          cfg.url,
+		Mix:             cfg.mix.String(),
+		Concurrency:     cfg.concurrency,
+		DurationSeconds: elapsed.Seconds(),
+		Operations:      make(map[string]opReport),
+	}
+
+	var all []time.Duration
+	for _, op := range operations {
+		o := s[op]
+		if len(o.latencies) == 0 {
+			continue
+		}
+		r.Operations[op] = opReport{
+			Requests:   len(o.latencies),
+			Errors:     o.errors,
+			Throughput: float64(len(o.latencies)) / elapsed.Seconds(),
+			LatencyMs:  summarize(o.latencies),
+			Statuses:   o.statuses,
+		}
+		r.Requests += len(o.latencies)
+		r.Errors += o.errors
+		all = append(all, o.latencies...)
+	}
+	r.Throughput = float64(r.Requests) / elapsed.Seconds()
+	r.LatencyMs = summarize(all)
+	return r
+}
+
+// summarize computes the latency figures, sorting latencies in place
+func summarize(latencies []time.Duration) latencyReport {
+	if len(latencies) == 0 {
+		return latencyReport{}
+	}
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+
+	var total time.Duration
+	for _, l := range latencies {
+		total += l
+	}
+	return latencyReport{
+		Mean: ms(total / time.Duration(len(latencies))),
+		P50:  ms(percentile(latencies, 50)),
+		P90:  ms(percentile(latencies, 90)),
+		P99:  ms(percentile(latencies, 99)),
+		Max:  ms(latencies[len(latencies)-1]),
+	}
+}
+
+// percentile returns the nearest-rank percentile p of sorted latencies
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	rank := int(math.Ceil(p/100*float64(len(sorted)))) - 1
+	rank = max(0, min(rank, len(sorted)-1))
+	return sorted[rank]
+}
+
+func ms(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
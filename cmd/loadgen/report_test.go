@@ -0,0 +1,65 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func Test_percentile(t *testing.T) {
+	var sorted []time.Duration
+	for i := 1; i <= 100; i++ {
+		sorted = append(sorted, time.Duration(i)*time.Millisecond)
+	}
+
+	tests := []struct {
+		p        float64
+		expected time.Duration
+	}{
+		{p: 50, expected: 50 * time.Millisecond},
+		{p: 90, expected: 90 * time.Millisecond},
+		{p: 99, expected: 99 * time.Millisecond},
+		{p: 100, expected: 100 * time.Millisecond},
+		{p: 0, expected: time.Millisecond},
+	}
+	for _, tt := range tests {
+		if got := percentile(sorted, tt.p); got != tt.expected {
+			t.Errorf("percentile(%v) = %v, expected %v", tt.p, got, tt.expected)
+		}
+	}
+
+	if got := percentile([]time.Duration{time.Second}, 99); got != time.Second {
+		t.Errorf("percentile of a single value = %v, expected %v", got, time.Second)
+	}
+}
+
+func Test_buildReport(t *testing.T) {
+	s := newStats()
+	s.record(opCreate, 10*time.Millisecond, 200)
+	s.record(opCreate, 30*time.Millisecond, 200)
+	s.record(opRead, 20*time.Millisecond, 404)
+	s.record(opRead, 40*time.Millisecond, 0)
+
+	cfg := config{url: "http://test", concurrency: 2, mix: mix{opCreate: 1, opRead: 1}}
+	r := buildReport(cfg, s, 2*time.Second)
+
+	if r.Requests != 4 || r.Errors != 2 {
+		t.Errorf("expected 4 requests and 2 errors, got %d and %d", r.Requests, r.Errors)
+	}
+	if r.Throughput != 2 {
+		t.Errorf("expected a throughput of 2, got %v", r.Throughput)
+	}
+	if r.LatencyMs.Mean != 25 || r.LatencyMs.Max != 40 {
+		t.Errorf("expected mean 25 and max 40, got %+v", r.LatencyMs)
+	}
+	if _, ok := r.Operations[opUpdate]; ok {
+		t.Error("operations without requests should be left out")
+	}
+
+	read := r.Operations[opRead]
+	if read.Statuses["404"] != 1 || read.Statuses[statusTransport] != 1 {
+		t.Errorf("unexpected statuses %v", read.Statuses)
+	}
+	if r.Mix != "create=1,read=1" {
+		t.Errorf("unexpected mix %q", r.Mix)
+	}
+}
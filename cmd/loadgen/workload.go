@@ -0,0 +1,176 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Operations the load generator sends, in report order
+const (
+	opCreate = "create"
+	opRead   = "read"
+	opUpdate = "update"
+	opDelete = "delete"
+)
+
+var operations = []string{opCreate, opRead, opUpdate, opDelete}
+
+// mix holds the relative weight of every operation
+type mix map[string]int
+
+// parseMix parses a mix like "create=1,read=6,update=2,delete=1". Operations
+// left out get no weight
+func parseMix(s string) (mix, error) {
+	m := make(mix)
+	total := 0
+	for _, part := range strings.Split(s, ",") {
+		name, value, ok := strings.Cut(strings.TrimSpace(part), "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid mix entry %q, expected op=weight", part)
+		}
+		if !isOperation(name) {
+			return nil, fmt.Errorf("unknown operation %q in mix", name)
+		}
+		weight, err := strconv.Atoi(value)
+		if err != nil || weight < 0 {
+			return nil, fmt.Errorf("invalid weight %q for %s", value, name)
+		}
+		m[name] += weight
+		total += weight
+	}
+	if total == 0 {
+		return nil, fmt.Errorf("mix %q has no weight", s)
+	}
+	return m, nil
+}
+
+func isOperation(name string) bool {
+	for _, op := range operations {
+		if op == name {
+			return true
+		}
+	}
+	return false
+}
+
+// pick draws an operation according to the weights
+func (m mix) pick(rng *rand.Rand) string {
+	total := 0
+	for _, op := range operations {
+		total += m[op]
+	}
+	n := rng.Intn(total)
+	for _, op := range operations {
+		if n < m[op] {
+			return op
+		}
+		n -= m[op]
+	}
+	panic("unreachable")
+}
+
+// shape bounds the random payloads
+type shape struct {
+	fields int // Most fields in an object
+	depth  int // Most levels of nested objects and arrays
+	strlen int // Longest string value
+}
+
+// payload builds a random record of the given shape
+func (s shape) payload(rng *rand.Rand) map[string]interface{} {
+	return s.object(rng, s.depth)
+}
+
+func (s shape) object(rng *rand.Rand, depth int) map[string]interface{} {
+	n := rng.Intn(s.fields) + 1
+	obj := make(map[string]interface{}, n)
+	for i := 0; i < n; i++ {
+		obj["field"+strconv.Itoa(i)] = s.value(rng, depth)
+	}
+	return obj
+}
+
+func (s shape) value(rng *rand.Rand, depth int) interface{} {
+	kinds := 4
+	if depth > 0 {
+		kinds = 6
+	}
+	switch rng.Intn(kinds) {
+	case 0:
+		return s.str(rng)
+	case 1:
+		return rng.Int63n(1 << 53)
+	case 2:
+		return rng.Float64() * 1000
+	case 3:
+		return rng.Intn(2) == 0
+	case 4:
+		return s.object(rng, depth-1)
+	default:
+		arr := make([]interface{}, rng.Intn(s.fields)+1)
+		for i := range arr {
+			arr[i] = s.value(rng, depth-1)
+		}
+		return arr
+	}
+}
+
+func (s shape) str(rng *rand.Rand) string {
+	b := make([]byte, rng.Intn(s.strlen)+1)
+	for i := range b {
+		b[i] = byte('a' + rng.Intn(26))
+	}
+	return string(b)
+}
+
+// idPool tracks the IDs of records the generator created and has not deleted
+type idPool struct {
+	mu  sync.Mutex
+	ids []string
+}
+
+func (p *idPool) add(id string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.ids = append(p.ids, id)
+}
+
+// random returns a random ID, false when the pool is empty
+func (p *idPool) random(rng *rand.Rand) (string, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if len(p.ids) == 0 {
+		return "", false
+	}
+	return p.ids[rng.Intn(len(p.ids))], true
+}
+
+// take removes and returns a random ID, false when the pool is empty
+func (p *idPool) take(rng *rand.Rand) (string, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if len(p.ids) == 0 {
+		return "", false
+	}
+	i := rng.Intn(len(p.ids))
+	id := p.ids[i]
+	p.ids[i] = p.ids[len(p.ids)-1]
+	p.ids = p.ids[:len(p.ids)-1]
+	return id, true
+}
+
+// String lists the mix in a stable order, for the report
+func (m mix) String() string {
+	var parts []string
+	for _, op := range operations {
+		if m[op] > 0 {
+			parts = append(parts, op+"="+strconv.Itoa(m[op]))
+		}
+	}
+	return strings.Join(parts, ",")
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"math/rand"
+	"reflect"
+	"testing"
+)
+
+func Test_parseMix(t *testing.T) {
+	tests := []struct {
+		name     string
+		input    string
+		expected mix
+		wantErr  bool
+	}{
+		{name: "All operations", input: "create=1,read=6,update=2,delete=1", expected: mix{opCreate: 1, opRead: 6, opUpdate: 2, opDelete: 1}},
+		{name: "Spaces and a subset", input: " read=3 , create=1", expected: mix{opCreate: 1, opRead: 3}},
+		{name: "Unknown operation", input: "create=1,list=1", wantErr: true},
+		{name: "Missing weight", input: "create", wantErr: true},
+		{name: "Negative weight", input: "create=-1,read=1", wantErr: true},
+		{name: "No weight at all", input: "create=0,read=0", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseMix(tt.input)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseMix() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.expected) {
+				t.Errorf("parseMix() = %v, expected %v", got, tt.expected)
+			}
+		})
+	}
+}
+
+func Test_mixPick(t *testing.T) {
+	m := mix{opRead: 3, opDelete: 1}
+	rng := rand.New(rand.NewSource(1))
+
+	counts := make(map[string]int)
+	for i := 0; i < 4000; i++ {
+		counts[m.pick(rng)]++
+	}
+	if counts[opCreate] != 0 || counts[opUpdate] != 0 {
+		t.Errorf("operations without weight were picked: %v", counts)
+	}
+	if counts[opRead] < 2700 || counts[opRead] > 3300 {
+		t.Errorf("expected about 3000 reads, got %d", counts[opRead])
+	}
+}
+
+func Test_shapePayload(t *testing.T) {
+	s := shape{fields: 4, depth: 2, strlen: 8}
+	rng := rand.New(rand.NewSource(1))
+
+	var depthOf func(v interface{}) int
+	depthOf = func(v interface{}) int {
+		deepest := 0
+		switch v := v.(type) {
+		case map[string]interface{}:
+			if len(v) < 1 || len(v) > s.fields {
+				t.Errorf("object with %d fields", len(v))
+			}
+			for _, child := range v {
+				deepest = max(deepest, depthOf(child)+1)
+			}
+		case []interface{}:
+			for _, child := range v {
+				deepest = max(deepest, depthOf(child)+1)
+			}
+		case string:
+			if len(v) < 1 || len(v) > s.strlen {
+				t.Errorf("string of length %d", len(v))
+			}
+		}
+		return deepest
+	}
+
+	for i := 0; i < 200; i++ {
+		// The record itself is one level, each nested container another
+		if depth := depthOf(s.payload(rng)); depth > s.depth+1 {
+			t.Fatalf("payload nested %d levels deep, expected at most %d", depth, s.depth+1)
+		}
+	}
+}
+
+func Test_idPool(t *testing.T) {
+	p := &idPool{}
+	rng := rand.New(rand.NewSource(1))
+
+	if _, ok := p.random(rng); ok {
+		t.Error("random returned an ID from an empty pool")
+	}
+
+	p.add("1")
+	p.add("2")
+	taken := make(map[string]bool)
+	for i := 0; i < 2; i++ {
+		id, ok := p.take(rng)
+		if !ok || taken[id] {
+			t.Fatalf("take returned %q, %v", id, ok)
+		}
+		taken[id] = true
+	}
+	if _, ok := p.take(rng); ok {
+		t.Error("take returned an ID from an empty pool")
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"zabbixhw/pkg/backup"
+	"zabbixhw/pkg/filelock"
+	"zabbixhw/pkg/fsys"
+	"zabbixhw/pkg/repository/dbfile"
+)
+
+func backupsCommand(flags *flag.FlagSet, args []string, stdout io.Writer) error {
+	asJSON := flags.Bool("json", false, "Print the manifests as JSON")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		return fmt.Errorf("%w: expected exactly one backup location", errUsage)
+	}
+
+	store, err := backup.OpenStore(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	manifests, err := backup.List(context.Background(), store)
+	if err != nil {
+		return err
+	}
+
+	if *asJSON {
+		if manifests == nil {
+			manifests = []backup.Manifest{}
+		}
+		enc := json.NewEncoder(stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(manifests)
+	}
+
+	if len(manifests) == 0 {
+		fmt.Fprintf(stdout, "no backups in %s\n", store)
+		return nil
+	}
+	for _, m := range manifests {
+		encryption := "plaintext"
+		if m.KeyID != "" {
+			encryption = "key " + m.KeyID
+		}
+		fmt.Fprintf(stdout, "%s  %8d records  %10d bytes  %s, %s, %s\n", m.ID, m.Records, m.Bytes, m.Format, m.Compression, encryption)
+	}
+	return nil
+}
+
+func restoreCommand(flags *flag.FlagSet, args []string, stdout io.Writer) error {
+	from := flags.String("from", "", "Directory or s3://bucket/prefix URL holding the backups")
+	id := flags.String("id", "", "Backup to restore, empty restores the newest")
+	keyFile := keyFileFlag(flags)
+	path, err := parseFile(flags, args)
+	if err != nil {
+		return err
+	}
+	if *from == "" {
+		return fmt.Errorf("%w: -from is required", errUsage)
+	}
+
+	keys, err := dbfile.LoadKeys(*keyFile)
+	if err != nil {
+		return err
+	}
+	store, err := backup.OpenStore(*from)
+	if err != nil {
+		return err
+	}
+
+	lock, err := filelock.Acquire(path, false)
+	if err != nil {
+		if errors.Is(err, filelock.ErrLocked) {
+			return fmt.Errorf("%w, stop the server first", err)
+		}
+		return err
+	}
+	defer lock.Release()
+
+	data, manifest, err := backup.Fetch(context.Background(), store, *id)
+	if err != nil {
+		return err
+	}
+
+	// The checksum proves the backup is what was stored, loading it proves
+	// the server can open it
+	snap, err := dbfile.ReadWithKeys(bytes.NewReader(data), false, keys)
+	if err != nil {
+		return fmt.Errorf("backup %s cannot be loaded: %w", manifest.ID, err)
+	}
+	if report := dbfile.CheckIntegrity(snap); !report.OK() {
+		return fmt.Errorf("backup %s failed verification: %s", manifest.ID, report)
+	}
+
+	current, err := os.ReadFile(path)
+	switch {
+	case err == nil:
+		if err := os.WriteFile(path+".bak", current, 0600); err != nil {
+			return fmt.Errorf("error writing backup: %w", err)
+		}
+	case !errors.Is(err, fs.ErrNotExist):
+		return err
+	}
+
+	perm := os.FileMode(0644)
+	if manifest.KeyID != "" {
+		perm = 0600
+	}
+	if err := fsys.WriteFile(fsys.OS{}, path, data, perm); err != nil {
+		return err
+	}
+	fmt.Fprintf(stdout, "backup %s restored to %s: %d records, seq %d\n", manifest.ID, path, len(snap.Records), snap.Header.Seq)
+	if current != nil {
+		fmt.Fprintf(stdout, "previous file kept in %s.bak\n", path)
+	}
+	return nil
+}
@@ -0,0 +1,294 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"sort"
+	"zabbixhw/pkg/repository/dbfile"
+)
+
+// stats is the output of the stats command
+type stats struct {
+	File        string             `json:"file"`
+	Format      dbfile.Format      `json:"format"`
+	Compression dbfile.Compression `json:"compression"`
+	KeyID       string             `json:"keyId,omitempty"` // Key the file is encrypted with
+	Version     int                `json:"version"`
+	Bytes       int                `json:"bytes"`
+	Records     int                `json:"records"`
+	Seq         uint64             `json:"seq"`
+	IDStrategy  string             `json:"idStrategy"`
+	MaxID       uint64             `json:"maxID"`
+	Fields      map[string]int     `json:"fields"` // Records using each top-level field, id excluded
+	Meta        map[string]string  `json:"meta,omitempty"`
+}
+
+func statsCommand(flags *flag.FlagSet, args []string, stdout io.Writer) error {
+	asJSON := flags.Bool("json", false, "Print the stats as JSON")
+	keyFile := keyFileFlag(flags)
+	path, err := parseFile(flags, args)
+	if err != nil {
+		return err
+	}
+
+	db, err := openDB(path, false, *keyFile)
+	if err != nil {
+		return err
+	}
+	defer db.close()
+
+	snap, err := dbfile.Decode(db.content)
+	if errors.Is(err, dbfile.ErrNewerVersion) {
+		return err
+	}
+	if err != nil {
+		return fmt.Errorf("%w, run verify for details", err)
+	}
+
+	s := stats{
+		File:        path,
+		Format:      dbfile.DetectFormat(db.content),
+		Compression: snap.Compression,
+		KeyID:       db.keyID,
+		Version:     snap.Header.Version,
+		Bytes:       len(db.raw),
+		Records:     len(snap.Records),
+		Seq:         snap.Header.Seq,
+		IDStrategy:  snap.Header.IDStrategy,
+		MaxID:       dbfile.MaxID(snap.Records),
+		Fields:      make(map[string]int),
+		Meta:        snap.Header.Meta,
+	}
+	if s.IDStrategy == "" {
+		s.IDStrategy = "sequential (implicit)"
+	}
+	for _, record := range snap.Records {
+		for field := range record {
+			if field != "id" {
+				s.Fields[field]++
+			}
+		}
+	}
+
+	if *asJSON {
+		enc := json.NewEncoder(stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(s)
+	}
+
+	fmt.Fprintf(stdout, "file:        %s\n", s.File)
+	fmt.Fprintf(stdout, "format:      %s, version %d\n", s.Format, s.Version)
+	fmt.Fprintf(stdout, "compression: %s\n", s.Compression)
+	if s.KeyID != "" {
+		fmt.Fprintf(stdout, "encryption:  aes-256-gcm, key %s\n", s.KeyID)
+	} else {
+		fmt.Fprintln(stdout, "encryption:  none")
+	}
+	fmt.Fprintf(stdout, "size:        %d bytes\n", s.Bytes)
+	fmt.Fprintf(stdout, "records:     %d\n", s.Records)
+	fmt.Fprintf(stdout, "seq:         %d\n", s.Seq)
+	fmt.Fprintf(stdout, "idStrategy:  %s\n", s.IDStrategy)
+	fmt.Fprintf(stdout, "maxID:       %d\n", s.MaxID)
+	if len(s.Meta) > 0 {
+		fmt.Fprintln(stdout, "meta:")
+		keys := make([]string, 0, len(s.Meta))
+		for key := range s.Meta {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			fmt.Fprintf(stdout, "  %-20s %s\n", key, s.Meta[key])
+		}
+	}
+	fmt.Fprintln(stdout, "fields:")
+	for _, field := range sortedFields(s.Fields) {
+		fmt.Fprintf(stdout, "  %-20s %d\n", field, s.Fields[field])
+	}
+	return nil
+}
+
+// sortedFields orders fields by use, most used first, then by name
+func sortedFields(fields map[string]int) []string {
+	names := make([]string, 0, len(fields))
+	for name := range fields {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		if fields[names[i]] != fields[names[j]] {
+			return fields[names[i]] > fields[names[j]]
+		}
+		return names[i] < names[j]
+	})
+	return names
+}
+
+func verifyCommand(flags *flag.FlagSet, args []string, stdout io.Writer) error {
+	node := flags.Int64("node", 0, "Node ID for files using snowflake IDs")
+	keyFile := keyFileFlag(flags)
+	path, err := parseFile(flags, args)
+	if err != nil {
+		return err
+	}
+
+	db, err := openDB(path, false, *keyFile)
+	if err != nil {
+		return err
+	}
+	defer db.close()
+
+	raw, err := dbfile.DecodeRaw(db.content)
+	if err != nil {
+		return err
+	}
+	ids, err := raw.Strategy(*node)
+	if err != nil {
+		return err
+	}
+
+	problems := dbfile.Verify(raw, ids)
+	for _, p := range problems {
+		fmt.Fprintln(stdout, p)
+	}
+	if len(problems) > 0 {
+		fmt.Fprintf(stdout, "%d problems in %d records\n", len(problems), len(raw.Records))
+		return errProblems
+	}
+
+	fmt.Fprintf(stdout, "ok: %d records\n", len(raw.Records))
+	return nil
+}
+
+func repairCommand(flags *flag.FlagSet, args []string, stdout io.Writer) error {
+	mode := flags.String("mode", string(dbfile.RepairDrop), "What to do with records whose ID is unusable: drop or renumber")
+	out := flags.String("o", "", "Write the repaired file here instead of in place, where a .bak copy is kept")
+	dryRun := flags.Bool("dry-run", false, "Only list what would be fixed")
+	node := flags.Int64("node", 0, "Node ID for files using snowflake IDs")
+	keyFile := keyFileFlag(flags)
+	path, err := parseFile(flags, args)
+	if err != nil {
+		return err
+	}
+
+	db, err := openDB(path, true, *keyFile)
+	if err != nil {
+		return err
+	}
+	defer db.close()
+
+	raw, err := dbfile.DecodeRaw(db.content)
+	if err != nil {
+		return err
+	}
+	ids, err := raw.Strategy(*node)
+	if err != nil {
+		return err
+	}
+
+	snap, fixed, err := dbfile.Repair(raw, ids, dbfile.RepairMode(*mode))
+	if err != nil {
+		return fmt.Errorf("%w: %v", errUsage, err)
+	}
+	for _, p := range fixed {
+		fmt.Fprintln(stdout, p)
+	}
+	if len(fixed) == 0 {
+		fmt.Fprintln(stdout, "nothing to repair")
+		return nil
+	}
+	if *dryRun {
+		fmt.Fprintf(stdout, "%d problems would be fixed\n", len(fixed))
+		return nil
+	}
+
+	target := *out
+	if target == "" {
+		target = path
+	}
+	if _, err := db.write(target, snap, dbfile.Encoding{Format: raw.Format, Compression: raw.Compression, Key: db.key()}); err != nil {
+		return err
+	}
+	fmt.Fprintf(stdout, "%d problems fixed, %d records written to %s\n", len(fixed), len(snap.Records), target)
+	return nil
+}
+
+func compactCommand(flags *flag.FlagSet, args []string, stdout io.Writer) error {
+	out := flags.String("o", "", "Write the compacted file here instead of in place, where a .bak copy is kept")
+	keyFile := keyFileFlag(flags)
+	path, err := parseFile(flags, args)
+	if err != nil {
+		return err
+	}
+
+	return rewrite(path, *out, *keyFile, dbfile.Encoding{}, false, stdout)
+}
+
+func convertCommand(flags *flag.FlagSet, args []string, stdout io.Writer) error {
+	to := flags.String("to", string(dbfile.FormatSnapshot), "Target format: snapshot, ndjson, msgpack or legacy")
+	compress := flags.String("compress", "", "Target compression: none or gzip, empty keeps the compression of the file")
+	level := flags.Int("level", dbfile.DefaultLevel, "Compression level from 1 (fastest) to 9 (smallest), 0 is the default")
+	decrypt := flags.Bool("decrypt", false, "Write the file in plaintext, even with keys")
+	out := flags.String("o", "", "Write the converted file here instead of in place, where a .bak copy is kept")
+	keyFile := keyFileFlag(flags)
+	path, err := parseFile(flags, args)
+	if err != nil {
+		return err
+	}
+
+	if _, ok := dbfile.CodecFor(dbfile.Format(*to)); !ok {
+		return fmt.Errorf("%w: unknown format %q", errUsage, *to)
+	}
+	encoding := dbfile.Encoding{Format: dbfile.Format(*to), Compression: dbfile.Compression(*compress), Level: *level}
+	if err := dbfile.CheckCompression(encoding.Compression, encoding.Level); err != nil {
+		return fmt.Errorf("%w: %v", errUsage, err)
+	}
+	return rewrite(path, *out, *keyFile, encoding, *decrypt, stdout)
+}
+
+// rewrite loads the file the way the engines do and writes it back with
+// encoding, keeping the current format and compression where it is empty.
+// With keys the file is encrypted with the first one, unless decrypt is set
+func rewrite(path, out, keyFile string, encoding dbfile.Encoding, decrypt bool, stdout io.Writer) error {
+	db, err := openDB(path, true, keyFile)
+	if err != nil {
+		return err
+	}
+	defer db.close()
+
+	snap, err := dbfile.Decode(db.content)
+	if err != nil {
+		return fmt.Errorf("%w, run verify for details", err)
+	}
+
+	from := dbfile.DetectFormat(db.content)
+	if encoding.Format == "" {
+		encoding.Format = from
+	}
+	if encoding.Compression == "" {
+		encoding.Compression = snap.Compression
+	}
+	if !decrypt {
+		encoding.Key = db.key()
+	}
+	if out == "" {
+		out = path
+	}
+
+	written, err := db.write(out, snap, encoding)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(stdout, "%s (%s, %s, %d bytes) -> %s (%s, %s, %d bytes), %d records\n",
+		path, from, snap.Compression, len(db.raw), out, encoding.Format, encoding.Compression, written, len(snap.Records))
+	if encoding.Key != nil {
+		fmt.Fprintf(stdout, "encrypted with key %s\n", encoding.Key.ID)
+	} else if db.keyID != "" {
+		fmt.Fprintln(stdout, "note: the file is no longer encrypted")
+	}
+	if encoding.Format == dbfile.FormatLegacy && from != dbfile.FormatLegacy {
+		fmt.Fprintln(stdout, "note: legacy files have no header, the sequence falls back to the highest ID and the ID strategy is not recorded")
+	}
+	return nil
+}
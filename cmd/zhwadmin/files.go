@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"zabbixhw/pkg/filelock"
+	"zabbixhw/pkg/fsys"
+	"zabbixhw/pkg/repository/dbfile"
+)
+
+// errUsage marks mistakes on the command line
+var errUsage = errors.New("invalid usage")
+
+// parseFile parses the flags of a command and returns its single file argument
+func parseFile(flags *flag.FlagSet, args []string) (string, error) {
+	if err := flags.Parse(args); err != nil {
+		return "", err
+	}
+	if flags.NArg() != 1 {
+		return "", fmt.Errorf("%w: expected exactly one database file", errUsage)
+	}
+	return flags.Arg(0), nil
+}
+
+// keyFileFlag adds the flag naming the key file of encrypted databases
+func keyFileFlag(flags *flag.FlagSet) *string {
+	return flags.String("keyfile", "", "File of AES-256 keys for encrypted files, the first one encrypts what is written; "+dbfile.KeysEnv+" is read when empty")
+}
+
+// dbFile is a database file opened for maintenance
+type dbFile struct {
+	path    string
+	raw     []byte // Content of the file as it is on disk
+	content []byte // Content of the file, decrypted
+	keyID   string // Key the file is encrypted with, empty for plaintext
+	keys    *dbfile.Keyring
+	lock    *filelock.Lock
+}
+
+// openDB locks the database file, shared for reading and exclusive for
+// writing, and reads it, decrypting it with the keys of keyFile. Locking
+// fails while a server has the file open
+func openDB(path string, write bool, keyFile string) (*dbFile, error) {
+	keys, err := dbfile.LoadKeys(keyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	lock, err := filelock.Acquire(path, !write)
+	if err != nil {
+		if errors.Is(err, filelock.ErrLocked) {
+			return nil, fmt.Errorf("%w, stop the server first", err)
+		}
+		return nil, err
+	}
+
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		lock.Release()
+		return nil, err
+	}
+	content, keyID, err := dbfile.Decrypt(raw, keys)
+	if err != nil {
+		lock.Release()
+		return nil, err
+	}
+	return &dbFile{path: path, raw: raw, content: content, keyID: keyID, keys: keys, lock: lock}, nil
+}
+
+// key returns the key written files are encrypted with, nil without keys
+func (f *dbFile) key() *dbfile.Key {
+	if f.keys == nil {
+		return nil
+	}
+	return f.keys.Primary()
+}
+
+func (f *dbFile) close() {
+	f.lock.Release()
+}
+
+// write stores snap with encoding at out, replacing the file in one rename. When
+// out is the database file itself, its previous content is kept in a .bak
+// file first
+func (f *dbFile) write(out string, snap *dbfile.Snapshot, encoding dbfile.Encoding) (int, error) {
+	var buf bytes.Buffer
+	if err := encoding.Encode(&buf, snap); err != nil {
+		return 0, err
+	}
+
+	if out == f.path {
+		if err := os.WriteFile(f.path+".bak", f.raw, 0600); err != nil {
+			return 0, fmt.Errorf("error writing backup: %w", err)
+		}
+	}
+
+	perm := os.FileMode(0644)
+	if encoding.Key != nil {
+		perm = 0600
+	}
+	if err := fsys.WriteFile(fsys.OS{}, out, buf.Bytes(), perm); err != nil {
+		return 0, err
+	}
+	return buf.Len(), nil
+}
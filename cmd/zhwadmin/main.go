@@ -0,0 +1,82 @@
+// Command zhwadmin inspects and maintains database files while the server is
+// stopped
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+)
+
+// errProblems makes the command exit with status 1 after it has already
+// reported what is wrong
+var errProblems = errors.New("problems found")
+
+// command is a zhwadmin subcommand
+type command struct {
+	name    string
+	summary string
+	run     func(flags *flag.FlagSet, args []string, stdout io.Writer) error
+}
+
+var commands = []command{
+	{"stats", "print record count, sequence, ID strategy and field usage", statsCommand},
+	{"verify", "check for malformed records, missing, invalid, foreign or duplicate IDs", verifyCommand},
+	{"repair", "drop or renumber the records verify complains about", repairCommand},
+	{"compact", "rewrite the file without redundant whitespace", compactCommand},
+	{"convert", "rewrite the file in another on-disk format", convertCommand},
+	{"backups", "list the backups at a directory or s3://bucket/prefix", backupsCommand},
+	{"restore", "replace the file with a backup, after checking it", restoreCommand},
+}
+
+func main() {
+	os.Exit(run(os.Args[1:], os.Stdout, os.Stderr))
+}
+
+// run executes the subcommand named by args[0] and returns the exit status
+func run(args []string, stdout, stderr io.Writer) int {
+	if len(args) == 0 {
+		usage(stderr)
+		return 2
+	}
+
+	for _, cmd := range commands {
+		if cmd.name != args[0] {
+			continue
+		}
+
+		flags := flag.NewFlagSet("zhwadmin "+cmd.name, flag.ContinueOnError)
+		flags.SetOutput(stderr)
+		err := cmd.run(flags, args[1:], stdout)
+		switch {
+		case err == nil:
+			return 0
+		case errors.Is(err, flag.ErrHelp):
+			return 0
+		case errors.Is(err, errUsage):
+			fmt.Fprintf(stderr, "zhwadmin %s: %v\n", cmd.name, err)
+			flags.Usage()
+			return 2
+		case errors.Is(err, errProblems):
+			return 1
+		default:
+			fmt.Fprintf(stderr, "zhwadmin %s: %v\n", cmd.name, err)
+			return 1
+		}
+	}
+
+	fmt.Fprintf(stderr, "zhwadmin: unknown command %q\n", args[0])
+	usage(stderr)
+	return 2
+}
+
+func usage(w io.Writer) {
+	fmt.Fprintln(w, "Usage: zhwadmin <command> [flags] <file>")
+	fmt.Fprintln(w, "\nCommands:")
+	for _, cmd := range commands {
+		fmt.Fprintf(w, "  %-8s %s\n", cmd.name, cmd.summary)
+	}
+	fmt.Fprintln(w, "\nRun zhwadmin <command> -h for the flags of a command.")
+}
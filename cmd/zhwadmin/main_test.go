@@ -0,0 +1,376 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+	"zabbixhw/pkg/backup"
+	"zabbixhw/pkg/filelock"
+	"zabbixhw/pkg/repository/dbfile"
+	"zabbixhw/pkg/repository/filedb"
+)
+
+const (
+	cleanDB   = `{"header":{"seq":3,"idStrategy":"sequential"},"records":[{"id":1,"name":"Alice","age":30},{"id":3,"name":"Bob"}]}`
+	damagedDB = `{"header":{"seq":1},"records":[{"id":1,"name":"Alice"},"junk",{"id":1,"name":"Copy"},{"name":"No ID"},{"id":4}]}`
+)
+
+// writeDB writes content to a database file in a fresh directory
+func writeDB(t *testing.T, content string) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "db.json")
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+	return path
+}
+
+// runCommand runs zhwadmin and checks its exit status
+func runCommand(t *testing.T, expectedStatus int, args ...string) string {
+	t.Helper()
+
+	var stdout, stderr bytes.Buffer
+	if status := run(args, &stdout, &stderr); status != expectedStatus {
+		t.Fatalf("zhwadmin %v exited with %d, expected %d\nstdout: %s\nstderr: %s",
+			args, status, expectedStatus, stdout.String(), stderr.String())
+	}
+	return stdout.String() + stderr.String()
+}
+
+func readSnapshot(t *testing.T, path string) *dbfile.Snapshot {
+	t.Helper()
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Failed to read file: %v", err)
+	}
+	snap, err := dbfile.Decode(content)
+	if err != nil {
+		t.Fatalf("Failed to decode file: %v", err)
+	}
+	return snap
+}
+
+func Test_stats(t *testing.T) {
+	path := writeDB(t, cleanDB)
+
+	out := runCommand(t, 0, "stats", path)
+	for _, expected := range []string{"format:      snapshot, version 1", "records:     2", "seq:         3", "maxID:       3", "name                 2", "age                  1"} {
+		if !strings.Contains(out, expected) {
+			t.Errorf("expected %q in output:\n%s", expected, out)
+		}
+	}
+
+	var s stats
+	if err := json.Unmarshal([]byte(runCommand(t, 0, "stats", "-json", path)), &s); err != nil {
+		t.Fatalf("stats -json is not JSON: %v", err)
+	}
+	if s.Records != 2 || s.Fields["name"] != 2 || s.Format != dbfile.FormatSnapshot {
+		t.Errorf("unexpected stats %+v", s)
+	}
+}
+
+func Test_verify(t *testing.T) {
+	out := runCommand(t, 0, "verify", writeDB(t, cleanDB))
+	if !strings.Contains(out, "ok: 2 records") {
+		t.Errorf("unexpected output:\n%s", out)
+	}
+
+	out = runCommand(t, 1, "verify", writeDB(t, damagedDB))
+	for _, expected := range []string{"record 1: malformed", "record 2: duplicate-id", "record 3: missing-id", "header: seq-behind", "4 problems"} {
+		if !strings.Contains(out, expected) {
+			t.Errorf("expected %q in output:\n%s", expected, out)
+		}
+	}
+}
+
+func Test_repair(t *testing.T) {
+	t.Run("Drop in place", func(t *testing.T) {
+		path := writeDB(t, damagedDB)
+		runCommand(t, 0, "repair", path)
+
+		if snap := readSnapshot(t, path); len(snap.Records) != 2 || snap.Header.Seq != 4 {
+			t.Errorf("expected 2 records and seq 4, got %d and %d", len(snap.Records), snap.Header.Seq)
+		}
+		if backup, _ := os.ReadFile(path + ".bak"); string(backup) != damagedDB {
+			t.Errorf("expected the backup to hold the original, got %s", backup)
+		}
+		runCommand(t, 0, "verify", path)
+	})
+
+	t.Run("Renumber to another file", func(t *testing.T) {
+		path := writeDB(t, damagedDB)
+		out := filepath.Join(filepath.Dir(path), "fixed.json")
+		runCommand(t, 0, "repair", "-mode=renumber", "-o", out, path)
+
+		if snap := readSnapshot(t, out); len(snap.Records) != 4 || snap.Header.Seq != 6 {
+			t.Errorf("expected 4 records and seq 6, got %d and %d", len(snap.Records), snap.Header.Seq)
+		}
+		if original, _ := os.ReadFile(path); string(original) != damagedDB {
+			t.Error("the original file was changed")
+		}
+	})
+
+	t.Run("Dry run", func(t *testing.T) {
+		path := writeDB(t, damagedDB)
+		out := runCommand(t, 0, "repair", "-dry-run", path)
+		if !strings.Contains(out, "4 problems would be fixed") {
+			t.Errorf("unexpected output:\n%s", out)
+		}
+		if original, _ := os.ReadFile(path); string(original) != damagedDB {
+			t.Error("a dry run changed the file")
+		}
+	})
+
+	t.Run("Unknown mode", func(t *testing.T) {
+		runCommand(t, 2, "repair", "-mode=guess", writeDB(t, damagedDB))
+	})
+}
+
+func Test_compact(t *testing.T) {
+	pretty := "{\n  \"header\": {\"seq\": 1},\n  \"records\": [\n    {\"id\": 1, \"big\": 123456789012345678901234567890}\n  ]\n}\n"
+	path := writeDB(t, pretty)
+	runCommand(t, 0, "compact", path)
+
+	// Compacting drops the whitespace and seals the file with checksums
+	content, _ := os.ReadFile(path)
+	if strings.Count(string(content), "\n") != 1 || strings.Contains(string(content), ": ") {
+		t.Errorf("expected a single line without padding, got %s", content)
+	}
+	if !strings.Contains(string(content), `"checksums":{"algorithm":"crc32c"`) {
+		t.Errorf("expected checksums in %s", content)
+	}
+	if !strings.Contains(string(content), "123456789012345678901234567890") {
+		t.Errorf("large number was not kept exactly: %s", content)
+	}
+}
+
+func Test_convert(t *testing.T) {
+	path := writeDB(t, cleanDB)
+
+	runCommand(t, 0, "convert", "-to=legacy", path)
+	content, _ := os.ReadFile(path)
+	if dbfile.DetectFormat(content) != dbfile.FormatLegacy {
+		t.Fatalf("expected a legacy file, got %s", content)
+	}
+
+	runCommand(t, 0, "convert", "-to=ndjson", path)
+	content, _ = os.ReadFile(path)
+	if dbfile.DetectFormat(content) != dbfile.FormatNDJSON || strings.Count(string(content), "\n") != 4 {
+		t.Fatalf("expected an NDJSON file with 4 lines, got %s", content)
+	}
+
+	runCommand(t, 0, "convert", "-to=msgpack", path)
+	content, _ = os.ReadFile(path)
+	if dbfile.DetectFormat(content) != dbfile.FormatMsgpack {
+		t.Fatalf("expected a MessagePack file, got %q", content)
+	}
+	if out := runCommand(t, 0, "verify", path); !strings.Contains(out, "ok: 2 records") {
+		t.Errorf("unexpected output:\n%s", out)
+	}
+
+	runCommand(t, 0, "convert", "-to=snapshot", path)
+	if snap := readSnapshot(t, path); len(snap.Records) != 2 || snap.Header.Seq != 3 {
+		t.Errorf("expected 2 records and seq 3, got %d and %d", len(snap.Records), snap.Header.Seq)
+	}
+
+	runCommand(t, 2, "convert", "-to=xml", path)
+}
+
+func Test_convertCompression(t *testing.T) {
+	path := writeDB(t, cleanDB)
+	compression := func() dbfile.Compression {
+		content, _ := os.ReadFile(path)
+		return dbfile.DetectCompression(content)
+	}
+
+	runCommand(t, 0, "convert", "-to=msgpack", "-compress=gzip", "-level=9", path)
+	if compression() != dbfile.CompressionGzip {
+		t.Fatal("expected a gzip file")
+	}
+	if out := runCommand(t, 0, "verify", path); !strings.Contains(out, "ok: 2 records") {
+		t.Errorf("unexpected output:\n%s", out)
+	}
+	if out := runCommand(t, 0, "stats", path); !strings.Contains(out, "format:      msgpack") || !strings.Contains(out, "compression: gzip") {
+		t.Errorf("unexpected output:\n%s", out)
+	}
+
+	// Compacting and converting keep the compression unless told otherwise
+	runCommand(t, 0, "compact", path)
+	runCommand(t, 0, "convert", "-to=snapshot", path)
+	if compression() != dbfile.CompressionGzip {
+		t.Fatal("expected the file to stay compressed")
+	}
+	runCommand(t, 0, "convert", "-compress=none", path)
+	if snap := readSnapshot(t, path); compression() != dbfile.CompressionNone || len(snap.Records) != 2 {
+		t.Errorf("expected a plain file with 2 records, got %s and %d", compression(), len(snap.Records))
+	}
+
+	runCommand(t, 2, "convert", "-compress=zip", path)
+	runCommand(t, 2, "convert", "-compress=gzip", "-level=12", path)
+}
+
+// writeKeys writes a key file holding a key made of each of keyBytes and
+// returns its path and the ID of the first key
+func writeKeys(t *testing.T, keyBytes ...byte) (string, string) {
+	t.Helper()
+
+	var text strings.Builder
+	for _, b := range keyBytes {
+		text.WriteString(hex.EncodeToString(bytes.Repeat([]byte{b}, dbfile.KeySize)) + "\n")
+	}
+	path := filepath.Join(t.TempDir(), "db.keys")
+	if err := os.WriteFile(path, []byte(text.String()), 0600); err != nil {
+		t.Fatalf("Failed to write key file: %v", err)
+	}
+	keys, err := dbfile.LoadKeys(path)
+	if err != nil {
+		t.Fatalf("LoadKeys failed: %v", err)
+	}
+	return path, keys.Primary().ID
+}
+
+func Test_encryption(t *testing.T) {
+	path := writeDB(t, cleanDB)
+	oldKeys, oldID := writeKeys(t, 1)
+	newKeys, newID := writeKeys(t, 2, 1)
+	keyID := func() string {
+		content, _ := os.ReadFile(path)
+		return dbfile.EncryptionKeyID(content)
+	}
+
+	runCommand(t, 0, "compact", "-keyfile", oldKeys, path)
+	if keyID() != oldID {
+		t.Fatalf("expected the file to be encrypted with key %s, got %q", oldID, keyID())
+	}
+
+	if out := runCommand(t, 1, "stats", path); !strings.Contains(out, "file is encrypted") {
+		t.Errorf("unexpected output:\n%s", out)
+	}
+	wrongKeys, _ := writeKeys(t, 3)
+	if out := runCommand(t, 1, "verify", "-keyfile", wrongKeys, path); !strings.Contains(out, "wrong encryption key") || !strings.Contains(out, oldID) {
+		t.Errorf("unexpected output:\n%s", out)
+	}
+	if out := runCommand(t, 0, "stats", "-keyfile", oldKeys, path); !strings.Contains(out, "encryption:  aes-256-gcm, key "+oldID) {
+		t.Errorf("unexpected output:\n%s", out)
+	}
+
+	// Rotating the key rewrites the file with the new current key
+	runCommand(t, 0, "compact", "-keyfile", newKeys, path)
+	if keyID() != newID {
+		t.Fatalf("expected the file to be encrypted with key %s, got %q", newID, keyID())
+	}
+	content, _ := os.ReadFile(newKeys)
+	t.Setenv(dbfile.KeysEnv, strings.ReplaceAll(strings.TrimSpace(string(content)), "\n", ","))
+	if out := runCommand(t, 0, "verify", path); !strings.Contains(out, "ok: 2 records") {
+		t.Errorf("unexpected output:\n%s", out)
+	}
+
+	runCommand(t, 0, "convert", "-decrypt", path)
+	if snap := readSnapshot(t, path); keyID() != "" || len(snap.Records) != 2 {
+		t.Errorf("expected a plaintext file with 2 records, got key %q and %d records", keyID(), len(snap.Records))
+	}
+}
+
+func Test_restore(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	keyFile, keyID := writeKeys(t, 1)
+	keys, _ := dbfile.LoadKeys(keyFile)
+
+	// Two backups of a server, the newest one encrypted
+	db, err := filedb.Open(filepath.Join(dir, "server.json"))
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	db.CreateRecord(ctx, map[string]interface{}{"name": "Alice"})
+	first, err := backup.Create(ctx, db, backup.DirStore(dir+"/backups"), time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC))
+	if err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+	db.CreateRecord(ctx, map[string]interface{}{"name": "Bob"})
+	db.Rekey(ctx, keys)
+	if _, err := backup.Create(ctx, db, backup.DirStore(dir+"/backups"), time.Date(2024, 3, 2, 0, 0, 0, 0, time.UTC)); err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+	db.Close()
+
+	out := runCommand(t, 0, "backups", dir+"/backups")
+	if !strings.Contains(out, first.ID) || !strings.Contains(out, "key "+keyID) {
+		t.Errorf("unexpected output:\n%s", out)
+	}
+
+	// The newest backup needs the key
+	path := filepath.Join(dir, "db.json")
+	runCommand(t, 1, "restore", "-from", dir+"/backups", path)
+	runCommand(t, 0, "restore", "-from", dir+"/backups", "-keyfile", keyFile, path)
+	content, _ := os.ReadFile(path)
+	if dbfile.EncryptionKeyID(content) != keyID {
+		t.Errorf("expected the restored file encrypted with key %s", keyID)
+	}
+
+	out = runCommand(t, 0, "restore", "-from", dir+"/backups", "-id", first.ID, path)
+	if snap := readSnapshot(t, path); len(snap.Records) != 1 || !strings.Contains(out, "db.json.bak") {
+		t.Errorf("expected the first backup restored, got %d records\n%s", len(snap.Records), out)
+	}
+	if bak, _ := os.ReadFile(path + ".bak"); !bytes.Equal(bak, content) {
+		t.Error("expected the replaced file in the .bak file")
+	}
+
+	// A damaged backup is refused and the file left alone
+	object := filepath.Join(dir, "backups", first.Object)
+	data, _ := os.ReadFile(object)
+	os.WriteFile(object, bytes.Replace(data, []byte("Alice"), []byte("Alina"), 1), 0600)
+	before, _ := os.ReadFile(path)
+	out = runCommand(t, 1, "restore", "-from", dir+"/backups", "-id", first.ID, path)
+	if after, _ := os.ReadFile(path); !strings.Contains(out, "does not match its manifest") || !bytes.Equal(before, after) {
+		t.Errorf("expected the damaged backup refused, got\n%s", out)
+	}
+
+	runCommand(t, 2, "restore", path)
+	if out := runCommand(t, 0, "backups", filepath.Join(dir, "none")); !strings.Contains(out, "no backups") {
+		t.Errorf("unexpected output:\n%s", out)
+	}
+}
+
+func Test_lockedFile(t *testing.T) {
+	path := writeDB(t, cleanDB)
+
+	// A running server holds the exclusive lock
+	lock, err := filelock.Acquire(path, false)
+	if err != nil {
+		t.Fatalf("Acquire failed: %v", err)
+	}
+	defer lock.Release()
+
+	out := runCommand(t, 1, "repair", path)
+	if !strings.Contains(out, "stop the server first") {
+		t.Errorf("unexpected output:\n%s", out)
+	}
+	runCommand(t, 1, "stats", path)
+}
+
+func Test_newerVersion(t *testing.T) {
+	path := writeDB(t, `{"header":{"version":99,"seq":1},"pages":[]}`)
+
+	for _, command := range []string{"stats", "verify", "compact"} {
+		out := runCommand(t, 1, command, path)
+		if !strings.Contains(out, "newer version") {
+			t.Errorf("%s: unexpected output:\n%s", command, out)
+		}
+	}
+}
+
+func Test_usage(t *testing.T) {
+	runCommand(t, 2)
+	runCommand(t, 2, "frobnicate")
+	runCommand(t, 2, "stats")
+	runCommand(t, 0, "verify", "-h")
+}
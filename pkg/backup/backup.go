@@ -0,0 +1,208 @@
+package backup
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+	"zabbixhw/pkg/repository/dbfile"
+)
+
+// ErrChecksum is returned for backups whose content does not match their
+// manifest
+var ErrChecksum = errors.New("backup does not match its manifest")
+
+// Suffixes of the two objects making up a backup. The manifest is written
+// last, so a backup is only listed once its data is complete
+const (
+	dataSuffix     = ".db"
+	manifestSuffix = ".manifest.json"
+)
+
+// idLayout names backups after the time they were taken, so that names sort
+// in time order
+const idLayout = "20060102T150405.000Z"
+
+// Source is implemented by databases that can hand out a copy of their
+// content as of one point in time while they keep serving writes
+type Source interface {
+	Snapshot(ctx context.Context) (*dbfile.Snapshot, dbfile.Encoding, error)
+}
+
+// Manifest describes a backup and holds the checksum of its data
+type Manifest struct {
+	ID          string             `json:"id"`
+	Created     time.Time          `json:"created"`
+	Object      string             `json:"object"` // Name of the data object in the store
+	Bytes       int                `json:"bytes"`
+	SHA256      string             `json:"sha256"`
+	Format      dbfile.Format      `json:"format"`
+	Compression dbfile.Compression `json:"compression"`
+	KeyID       string             `json:"keyId,omitempty"` // Key the data is encrypted with
+	Records     int                `json:"records"`
+	Seq         uint64             `json:"seq"`
+	IDStrategy  string             `json:"idStrategy"`
+}
+
+// Retention decides which backups Prune keeps. The newest backup is always
+// kept, a zero field sets no limit
+type Retention struct {
+	Keep   int           // Number of backups kept
+	MaxAge time.Duration // Age beyond which backups are removed
+}
+
+// Create takes a backup of src and stores it, data first and manifest last.
+// The data is the database file as the engine would write it at that point,
+// in its layout, compression and encryption
+func Create(ctx context.Context, src Source, store Store, now time.Time) (*Manifest, error) {
+	snap, encoding, err := src.Snapshot(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("error taking snapshot: %w", err)
+	}
+	if encoding.Format == "" {
+		encoding.Format = dbfile.FormatSnapshot
+	}
+
+	var buf bytes.Buffer
+	if err := encoding.Encode(&buf, snap); err != nil {
+		return nil, fmt.Errorf("error encoding backup: %w", err)
+	}
+
+	now = now.UTC()
+	manifest := &Manifest{
+		ID:          now.Format(idLayout),
+		Created:     now,
+		Bytes:       buf.Len(),
+		SHA256:      hashHex(buf.Bytes()),
+		Format:      encoding.Format,
+		Compression: encoding.Compression,
+		Records:     len(snap.Records),
+		Seq:         snap.Header.Seq,
+		IDStrategy:  snap.Header.IDStrategy,
+	}
+	manifest.Object = manifest.ID + dataSuffix
+	if manifest.Compression == "" {
+		manifest.Compression = dbfile.CompressionNone
+	}
+	if encoding.Key != nil {
+		manifest.KeyID = encoding.Key.ID
+	}
+
+	if err := store.Put(ctx, manifest.Object, buf.Bytes()); err != nil {
+		return nil, fmt.Errorf("error storing backup: %w", err)
+	}
+	encoded, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	if err := store.Put(ctx, manifest.ID+manifestSuffix, encoded); err != nil {
+		store.Delete(ctx, manifest.Object)
+		return nil, fmt.Errorf("error storing manifest: %w", err)
+	}
+	return manifest, nil
+}
+
+// List returns the manifests of the backups in store, newest first. Data
+// objects without a manifest, left by interrupted backups, are not listed
+func List(ctx context.Context, store Store) ([]Manifest, error) {
+	names, err := store.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var manifests []Manifest
+	for _, name := range names {
+		if !strings.HasSuffix(name, manifestSuffix) {
+			continue
+		}
+		manifest, err := readManifest(ctx, store, name)
+		if err != nil {
+			return nil, err
+		}
+		manifests = append(manifests, *manifest)
+	}
+	sort.Slice(manifests, func(i, j int) bool {
+		return manifests[i].Created.After(manifests[j].Created)
+	})
+	return manifests, nil
+}
+
+// Prune removes the backups retention does not keep and returns their IDs.
+// The manifest goes first, so a backup removed halfway is no longer listed
+func Prune(ctx context.Context, store Store, retention Retention, now time.Time) ([]string, error) {
+	manifests, err := List(ctx, store)
+	if err != nil {
+		return nil, err
+	}
+
+	var removed []string
+	for i, manifest := range manifests {
+		if i == 0 {
+			continue
+		}
+		tooMany := retention.Keep > 0 && i >= retention.Keep
+		tooOld := retention.MaxAge > 0 && now.Sub(manifest.Created) > retention.MaxAge
+		if !tooMany && !tooOld {
+			continue
+		}
+		if err := store.Delete(ctx, manifest.ID+manifestSuffix); err != nil {
+			return removed, fmt.Errorf("error removing backup %s: %w", manifest.ID, err)
+		}
+		if err := store.Delete(ctx, manifest.Object); err != nil {
+			return removed, fmt.Errorf("error removing backup %s: %w", manifest.ID, err)
+		}
+		removed = append(removed, manifest.ID)
+	}
+	return removed, nil
+}
+
+// Fetch returns the data of the backup called id, the newest one when id is
+// empty, after checking it against its manifest
+func Fetch(ctx context.Context, store Store, id string) ([]byte, *Manifest, error) {
+	var manifest *Manifest
+	if id == "" {
+		manifests, err := List(ctx, store)
+		if err != nil {
+			return nil, nil, err
+		}
+		if len(manifests) == 0 {
+			return nil, nil, fmt.Errorf("%w: no backups in %s", ErrNotFound, store)
+		}
+		manifest = &manifests[0]
+	} else {
+		var err error
+		if manifest, err = readManifest(ctx, store, id+manifestSuffix); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	data, err := store.Get(ctx, manifest.Object)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(data) != manifest.Bytes || hashHex(data) != manifest.SHA256 {
+		return nil, nil, fmt.Errorf("%w: %s has %d bytes with SHA-256 %s, the manifest lists %d bytes with %s",
+			ErrChecksum, manifest.Object, len(data), hashHex(data), manifest.Bytes, manifest.SHA256)
+	}
+	return data, manifest, nil
+}
+
+// readManifest reads and decodes the manifest object called name
+func readManifest(ctx context.Context, store Store, name string) (*Manifest, error) {
+	data, err := store.Get(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	var manifest Manifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return nil, fmt.Errorf("invalid manifest %s: %w", name, err)
+	}
+	if manifest.ID+manifestSuffix != name || checkName(manifest.Object) != nil {
+		return nil, fmt.Errorf("invalid manifest %s: it describes backup %q", name, manifest.ID)
+	}
+	return &manifest, nil
+}
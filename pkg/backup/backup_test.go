@@ -0,0 +1,237 @@
+package backup
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+	"zabbixhw/pkg/repository/dbfile"
+	"zabbixhw/pkg/repository/filedb"
+)
+
+// testSource hands out a fixed snapshot
+type testSource struct {
+	snap     *dbfile.Snapshot
+	encoding dbfile.Encoding
+}
+
+func (s testSource) Snapshot(ctx context.Context) (*dbfile.Snapshot, dbfile.Encoding, error) {
+	return s.snap, s.encoding, nil
+}
+
+// testSnapshot returns a snapshot of n records
+func testSnapshot(n int) *dbfile.Snapshot {
+	snap := &dbfile.Snapshot{Header: dbfile.Header{Seq: uint64(n), IDStrategy: "sequential"}}
+	for i := 1; i <= n; i++ {
+		snap.Records = append(snap.Records, map[string]interface{}{"id": uint32(i), "host": fmt.Sprintf("server-%d", i)})
+	}
+	return snap
+}
+
+var testTime = time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+
+func Test_CreateFetch(t *testing.T) {
+	ctx := context.Background()
+	store := DirStore(filepath.Join(t.TempDir(), "backups"))
+	key, err := dbfile.NewKey(bytes.Repeat([]byte{1}, dbfile.KeySize))
+	if err != nil {
+		t.Fatalf("NewKey failed: %v", err)
+	}
+	keys, _ := dbfile.NewKeyring(key)
+
+	tests := []struct {
+		name     string
+		encoding dbfile.Encoding
+	}{
+		{name: "Engine default", encoding: dbfile.Encoding{}},
+		{name: "NDJSON gzip", encoding: dbfile.Encoding{Format: dbfile.FormatNDJSON, Compression: dbfile.CompressionGzip}},
+		{name: "Encrypted", encoding: dbfile.Encoding{Format: dbfile.FormatMsgpack, Key: key}},
+	}
+
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			now := testTime.Add(time.Duration(i) * time.Hour)
+			manifest, err := Create(ctx, testSource{testSnapshot(3), tt.encoding}, store, now)
+			if err != nil {
+				t.Fatalf("Create failed: %v", err)
+			}
+			keyID := ""
+			if tt.encoding.Key != nil {
+				keyID = tt.encoding.Key.ID
+			}
+			if manifest.ID != now.Format(idLayout) || manifest.Records != 3 || manifest.Seq != 3 || manifest.KeyID != keyID {
+				t.Errorf("unexpected manifest %+v", manifest)
+			}
+
+			data, fetched, err := Fetch(ctx, store, "")
+			if err != nil {
+				t.Fatalf("Fetch failed: %v", err)
+			}
+			if !reflect.DeepEqual(fetched, manifest) {
+				t.Errorf("expected the newest backup %+v, got %+v", manifest, fetched)
+			}
+			snap, err := dbfile.ReadWithKeys(bytes.NewReader(data), false, keys)
+			if err != nil {
+				t.Fatalf("backup does not read back: %v", err)
+			}
+			if len(snap.Records) != 3 || snap.Format != manifest.Format || snap.Compression != manifest.Compression || !dbfile.CheckIntegrity(snap).OK() {
+				t.Errorf("unexpected backup content %+v", snap)
+			}
+		})
+	}
+
+	manifests, err := List(ctx, store)
+	if err != nil || len(manifests) != len(tests) {
+		t.Fatalf("expected %d backups, got %d (%v)", len(tests), len(manifests), err)
+	}
+	if _, _, err := Fetch(ctx, DirStore(t.TempDir()), ""); !errors.Is(err, ErrNotFound) {
+		t.Errorf("expected %v from an empty store, got %v", ErrNotFound, err)
+	}
+}
+
+func Test_FetchDamaged(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	store := DirStore(dir)
+	manifest, err := Create(ctx, testSource{snap: testSnapshot(3)}, store, testTime)
+	if err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+
+	path := filepath.Join(dir, manifest.Object)
+	data, _ := os.ReadFile(path)
+	data[len(data)/2] ^= 1
+	os.WriteFile(path, data, 0600)
+	if _, _, err := Fetch(ctx, store, manifest.ID); !errors.Is(err, ErrChecksum) {
+		t.Errorf("expected %v, got %v", ErrChecksum, err)
+	}
+
+	os.Remove(path)
+	if _, _, err := Fetch(ctx, store, manifest.ID); !errors.Is(err, ErrNotFound) {
+		t.Errorf("expected %v, got %v", ErrNotFound, err)
+	}
+	if _, _, err := Fetch(ctx, store, "20240301T000000.000Z"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("expected %v, got %v", ErrNotFound, err)
+	}
+}
+
+func Test_ListIncomplete(t *testing.T) {
+	ctx := context.Background()
+	store := DirStore(t.TempDir())
+	if _, err := Create(ctx, testSource{snap: testSnapshot(1)}, store, testTime); err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+
+	// Data stored by a backup that never got to its manifest
+	store.Put(ctx, "20240302T000000.000Z"+dataSuffix, []byte("{}"))
+	manifests, err := List(ctx, store)
+	if err != nil || len(manifests) != 1 || manifests[0].ID != testTime.Format(idLayout) {
+		t.Errorf("expected only the complete backup, got %+v (%v)", manifests, err)
+	}
+
+	store.Put(ctx, "20240303T000000.000Z"+manifestSuffix, []byte("not json"))
+	if _, err := List(ctx, store); err == nil {
+		t.Error("expected a broken manifest to fail the listing")
+	}
+}
+
+func Test_Prune(t *testing.T) {
+	tests := []struct {
+		name      string
+		retention Retention
+		expected  []int // Hours after testTime of the backups left
+	}{
+		{name: "No limits", retention: Retention{}, expected: []int{4, 3, 2, 1, 0}},
+		{name: "Keep", retention: Retention{Keep: 2}, expected: []int{4, 3}},
+		{name: "Max age", retention: Retention{MaxAge: 150 * time.Minute}, expected: []int{4, 3}},
+		{name: "Both", retention: Retention{Keep: 4, MaxAge: 150 * time.Minute}, expected: []int{4, 3}},
+		{name: "Newest is kept", retention: Retention{MaxAge: time.Minute}, expected: []int{4}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			store := DirStore(t.TempDir())
+			for i := 0; i < 5; i++ {
+				if _, err := Create(ctx, testSource{snap: testSnapshot(1)}, store, testTime.Add(time.Duration(i)*time.Hour)); err != nil {
+					t.Fatalf("Create failed: %v", err)
+				}
+			}
+
+			removed, err := Prune(ctx, store, tt.retention, testTime.Add(5*time.Hour))
+			if err != nil {
+				t.Fatalf("Prune failed: %v", err)
+			}
+			if len(removed) != 5-len(tt.expected) {
+				t.Errorf("expected %d backups removed, got %v", 5-len(tt.expected), removed)
+			}
+			manifests, _ := List(ctx, store)
+			var left []int
+			for _, manifest := range manifests {
+				left = append(left, int(manifest.Created.Sub(testTime)/time.Hour))
+			}
+			if !reflect.DeepEqual(left, tt.expected) {
+				t.Errorf("expected backups %v left, got %v", tt.expected, left)
+			}
+			if names, _ := store.List(ctx); len(names) != 2*len(tt.expected) {
+				t.Errorf("expected the data of removed backups gone too, got %v", names)
+			}
+		})
+	}
+}
+
+func Test_HotBackup(t *testing.T) {
+	ctx := context.Background()
+	db, err := filedb.Open(filepath.Join(t.TempDir(), "db.json"))
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer db.Close()
+	store := DirStore(t.TempDir())
+
+	// Backups taken while records are being created hold every record up to
+	// the sequence they were taken at, and no other
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			if err := db.CreateRecord(ctx, map[string]interface{}{"host": "db"}); err != nil {
+				t.Errorf("CreateRecord failed: %v", err)
+				return
+			}
+		}
+	}()
+
+	for i := 0; i < 10; i++ {
+		manifest, err := Create(ctx, db, store, testTime.Add(time.Duration(i)*time.Second))
+		if err != nil {
+			t.Fatalf("Create failed: %v", err)
+		}
+		data, _, err := Fetch(ctx, store, manifest.ID)
+		if err != nil {
+			t.Fatalf("Fetch failed: %v", err)
+		}
+		snap, err := dbfile.Decode(data)
+		if err != nil {
+			t.Fatalf("Decode failed: %v", err)
+		}
+		if uint64(len(snap.Records)) != snap.Header.Seq || dbfile.MaxID(snap.Records) != snap.Header.Seq || !dbfile.CheckIntegrity(snap).OK() {
+			t.Errorf("backup %s is inconsistent: %d records, seq %d", manifest.ID, len(snap.Records), snap.Header.Seq)
+		}
+	}
+	close(stop)
+	wg.Wait()
+}
@@ -0,0 +1,303 @@
+package backup
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Environment variables S3ConfigFromEnv reads
+const (
+	EndpointEnv  = "ZHW_S3_ENDPOINT"
+	RegionEnv    = "AWS_REGION"
+	AccessKeyEnv = "AWS_ACCESS_KEY_ID"
+	SecretKeyEnv = "AWS_SECRET_ACCESS_KEY"
+)
+
+// S3Config locates a bucket of an S3-compatible object store. Objects are
+// addressed path-style, endpoint/bucket/prefix+name, which every
+// S3-compatible store accepts
+type S3Config struct {
+	Endpoint  string // Base URL, such as https://s3.eu-west-1.amazonaws.com
+	Region    string
+	Bucket    string
+	Prefix    string // Prepended to object names, such as "zabbixhw/"
+	AccessKey string
+	SecretKey string
+	Client    *http.Client // http.DefaultClient when nil
+}
+
+// S3ConfigFromEnv reads the endpoint, region and credentials from the
+// environment. The region defaults to us-east-1 and the endpoint to that of
+// AWS for the region
+func S3ConfigFromEnv() (S3Config, error) {
+	config := S3Config{
+		Endpoint:  os.Getenv(EndpointEnv),
+		Region:    os.Getenv(RegionEnv),
+		AccessKey: os.Getenv(AccessKeyEnv),
+		SecretKey: os.Getenv(SecretKeyEnv),
+	}
+	if config.Region == "" {
+		config.Region = "us-east-1"
+	}
+	if config.Endpoint == "" {
+		config.Endpoint = "https://s3." + config.Region + ".amazonaws.com"
+	}
+	if config.AccessKey == "" || config.SecretKey == "" {
+		return S3Config{}, fmt.Errorf("S3 backups need %s and %s", AccessKeyEnv, SecretKeyEnv)
+	}
+	return config, nil
+}
+
+// S3Store is a Store in a bucket of an S3-compatible object store, signing
+// its requests with AWS Signature Version 4
+type S3Store struct {
+	config   S3Config
+	endpoint *url.URL
+	now      func() time.Time // Dates the signatures
+}
+
+// NewS3Store returns the store described by config
+func NewS3Store(config S3Config) (*S3Store, error) {
+	endpoint, err := url.Parse(strings.TrimSuffix(config.Endpoint, "/"))
+	if err != nil || endpoint.Host == "" || (endpoint.Scheme != "http" && endpoint.Scheme != "https") {
+		return nil, fmt.Errorf("invalid S3 endpoint %q", config.Endpoint)
+	}
+	if config.Bucket == "" {
+		return nil, errors.New("no S3 bucket")
+	}
+	if config.Client == nil {
+		config.Client = http.DefaultClient
+	}
+	return &S3Store{config: config, endpoint: endpoint, now: time.Now}, nil
+}
+
+func (s *S3Store) Put(ctx context.Context, name string, data []byte) error {
+	if err := checkName(name); err != nil {
+		return err
+	}
+	resp, err := s.do(ctx, http.MethodPut, s.config.Prefix+name, nil, data)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (s *S3Store) Get(ctx context.Context, name string) ([]byte, error) {
+	if err := checkName(name); err != nil {
+		return nil, err
+	}
+	resp, err := s.do(ctx, http.MethodGet, s.config.Prefix+name, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("error reading %s: %w", name, err)
+	}
+	return data, nil
+}
+
+// listResult is the part of a ListObjectsV2 response the store uses
+type listResult struct {
+	Contents []struct {
+		Key string
+	}
+	IsTruncated           bool
+	NextContinuationToken string
+}
+
+// List returns the names of the objects under the prefix, following
+// continuation tokens through every page
+func (s *S3Store) List(ctx context.Context) ([]string, error) {
+	var names []string
+	query := url.Values{"list-type": {"2"}, "prefix": {s.config.Prefix}}
+	for {
+		resp, err := s.do(ctx, http.MethodGet, "", query, nil)
+		if err != nil {
+			return nil, err
+		}
+		var result listResult
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("error decoding object list: %w", err)
+		}
+
+		for _, object := range result.Contents {
+			name := strings.TrimPrefix(object.Key, s.config.Prefix)
+			// Objects in "directories" below the prefix are not ours
+			if !strings.Contains(name, "/") {
+				names = append(names, name)
+			}
+		}
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			break
+		}
+		query.Set("continuation-token", result.NextContinuationToken)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func (s *S3Store) Delete(ctx context.Context, name string) error {
+	if err := checkName(name); err != nil {
+		return err
+	}
+	resp, err := s.do(ctx, http.MethodDelete, s.config.Prefix+name, nil, nil)
+	if errors.Is(err, ErrNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (s *S3Store) String() string {
+	return "s3://" + s.config.Bucket + "/" + s.config.Prefix
+}
+
+// s3Error is the error document S3 answers failed requests with
+type s3Error struct {
+	Code    string
+	Message string
+}
+
+// do sends a signed request for key, the bucket itself when key is empty,
+// and returns the response if it succeeded. Missing objects fail with
+// ErrNotFound
+func (s *S3Store) do(ctx context.Context, method, key string, query url.Values, body []byte) (*http.Response, error) {
+	target := *s.endpoint
+	target.Path += "/" + s.config.Bucket
+	if key != "" {
+		target.Path += "/" + key
+	}
+	target.RawQuery = canonicalQuery(query)
+
+	req, err := http.NewRequestWithContext(ctx, method, target.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.ContentLength = int64(len(body))
+	signRequest(req, body, s.config, s.now())
+
+	resp, err := s.config.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 == 2 {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+
+	var problem s3Error
+	xml.NewDecoder(io.LimitReader(resp.Body, 64<<10)).Decode(&problem)
+	if resp.StatusCode == http.StatusNotFound && problem.Code != "NoSuchBucket" {
+		return nil, fmt.Errorf("%w: %s", ErrNotFound, key)
+	}
+	if problem.Code == "" {
+		problem.Code = resp.Status
+	}
+	return nil, fmt.Errorf("S3 %s %s: %s %s", method, target.Path, problem.Code, problem.Message)
+}
+
+// signRequest adds the AWS Signature Version 4 headers to req. Every header
+// already set is signed, along with the host
+func signRequest(req *http.Request, body []byte, config S3Config, now time.Time) {
+	now = now.UTC()
+	date := now.Format("20060102")
+	payloadHash := hashHex(body)
+	req.Header.Set("X-Amz-Date", now.Format("20060102T150405Z"))
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(strings.Join(values, ","))
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	scope := date + "/" + config.Region + "/s3/aws4_request"
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		now.Format("20060102T150405Z"),
+		scope,
+		hashHex([]byte(canonicalRequest)),
+	}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+config.SecretKey), date)
+	key = hmacSHA256(key, config.Region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		config.AccessKey, scope, signedHeaders, signature))
+}
+
+// canonicalQuery encodes query sorted by name, with the strict escaping
+// signatures are computed over
+func canonicalQuery(query url.Values) string {
+	names := make([]string, 0, len(query))
+	for name := range query {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var parts []string
+	for _, name := range names {
+		for _, value := range query[name] {
+			parts = append(parts, uriEncode(name)+"="+uriEncode(value))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+// uriEncode escapes everything but unreserved characters, as SigV4 requires
+func uriEncode(s string) string {
+	return strings.ReplaceAll(url.QueryEscape(s), "+", "%20")
+}
+
+func hashHex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
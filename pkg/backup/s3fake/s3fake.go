@@ -0,0 +1,182 @@
+// Package s3fake is an in-memory stand-in for an S3-compatible object store,
+// serving the few path-style requests backups make, for tests
+package s3fake
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Server holds the objects of its buckets in memory. Requests must carry an
+// AWS Signature Version 4 Authorization header for AccessKey and the
+// SHA-256 of their payload; the signature itself is not checked
+type Server struct {
+	AccessKey string
+	MaxKeys   int // Objects per page of a listing, 1000 when zero
+
+	mu      sync.Mutex
+	buckets map[string]map[string][]byte
+}
+
+// New returns a server with the given empty buckets
+func New(accessKey string, buckets ...string) *Server {
+	s := &Server{AccessKey: accessKey, buckets: make(map[string]map[string][]byte)}
+	for _, bucket := range buckets {
+		s.buckets[bucket] = make(map[string][]byte)
+	}
+	return s
+}
+
+// Object returns the content of an object
+func (s *Server) Object(bucket, key string) ([]byte, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	data, ok := s.buckets[bucket][key]
+	return data, ok
+}
+
+// SetObject replaces the content of an object, to simulate damage
+func (s *Server) SetObject(bucket, key string, data []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if objects, ok := s.buckets[bucket]; ok {
+		objects[key] = data
+	}
+}
+
+// Keys lists the keys of a bucket, sorted
+func (s *Server) Keys(bucket string) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return sortedKeys(s.buckets[bucket], "")
+}
+
+type listResult struct {
+	XMLName               xml.Name `xml:"ListBucketResult"`
+	Name                  string
+	Prefix                string
+	KeyCount              int
+	IsTruncated           bool
+	NextContinuationToken string `xml:",omitempty"`
+	Contents              []listEntry
+}
+
+type listEntry struct {
+	Key  string
+	Size int
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "IncompleteBody", err.Error())
+		return
+	}
+	if !strings.Contains(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential="+s.AccessKey+"/") {
+		writeError(w, http.StatusForbidden, "InvalidAccessKeyId", "The access key does not exist")
+		return
+	}
+	sum := sha256.Sum256(body)
+	if r.Header.Get("X-Amz-Content-Sha256") != hex.EncodeToString(sum[:]) {
+		writeError(w, http.StatusBadRequest, "XAmzContentSHA256Mismatch", "The payload hash does not match")
+		return
+	}
+
+	bucket, key, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	objects, ok := s.buckets[bucket]
+	if !ok {
+		writeError(w, http.StatusNotFound, "NoSuchBucket", "The bucket does not exist")
+		return
+	}
+
+	switch {
+	case key == "" && r.Method == http.MethodGet:
+		s.list(w, r, bucket, objects)
+	case key == "":
+		writeError(w, http.StatusMethodNotAllowed, "MethodNotAllowed", "")
+	case r.Method == http.MethodPut:
+		objects[key] = body
+	case r.Method == http.MethodGet:
+		data, ok := objects[key]
+		if !ok {
+			writeError(w, http.StatusNotFound, "NoSuchKey", "The key does not exist")
+			return
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		w.Write(data)
+	case r.Method == http.MethodDelete:
+		delete(objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "MethodNotAllowed", "")
+	}
+}
+
+// list answers ListObjectsV2, the continuation token being the last key of
+// the previous page
+func (s *Server) list(w http.ResponseWriter, r *http.Request, bucket string, objects map[string][]byte) {
+	query := r.URL.Query()
+	if query.Get("list-type") != "2" {
+		writeError(w, http.StatusNotImplemented, "NotImplemented", "Only ListObjectsV2 is supported")
+		return
+	}
+	maxKeys := s.MaxKeys
+	if maxKeys == 0 {
+		maxKeys = 1000
+	}
+
+	result := listResult{Name: bucket, Prefix: query.Get("prefix")}
+	after := query.Get("continuation-token")
+	for _, key := range sortedKeys(objects, result.Prefix) {
+		if key <= after {
+			continue
+		}
+		if len(result.Contents) == maxKeys {
+			result.IsTruncated = true
+			result.NextContinuationToken = result.Contents[maxKeys-1].Key
+			break
+		}
+		result.Contents = append(result.Contents, listEntry{Key: key, Size: len(objects[key])})
+	}
+	result.KeyCount = len(result.Contents)
+
+	w.Header().Set("Content-Type", "application/xml")
+	io.WriteString(w, xml.Header)
+	xml.NewEncoder(w).Encode(result)
+}
+
+func sortedKeys(objects map[string][]byte, prefix string) []string {
+	var keys []string
+	for key := range objects {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func writeError(w http.ResponseWriter, status int, code, message string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	io.WriteString(w, xml.Header)
+	xml.NewEncoder(w).Encode(struct {
+		XMLName xml.Name `xml:"Error"`
+		Code    string
+		Message string
+	}{Code: code, Message: message})
+}
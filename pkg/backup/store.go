@@ -0,0 +1,122 @@
+package backup
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"zabbixhw/pkg/fsys"
+)
+
+// ErrNotFound is returned by stores for objects they do not hold
+var ErrNotFound = errors.New("backup object not found")
+
+// Store holds backup objects under flat names
+type Store interface {
+	Put(ctx context.Context, name string, data []byte) error
+	Get(ctx context.Context, name string) ([]byte, error)
+	List(ctx context.Context) ([]string, error) // Names of every object, sorted
+	Delete(ctx context.Context, name string) error
+	String() string // Location of the store, for messages
+}
+
+// OpenStore returns the store at location, a directory or an S3 URL such as
+// s3://bucket/prefix. S3 stores are configured from the environment, see
+// S3ConfigFromEnv
+func OpenStore(location string) (Store, error) {
+	if location == "" {
+		return nil, errors.New("no backup location")
+	}
+	rest, ok := strings.CutPrefix(location, "s3://")
+	if !ok {
+		return DirStore(location), nil
+	}
+
+	bucket, prefix, _ := strings.Cut(rest, "/")
+	if bucket == "" {
+		return nil, fmt.Errorf("invalid backup location %q: no bucket", location)
+	}
+	config, err := S3ConfigFromEnv()
+	if err != nil {
+		return nil, err
+	}
+	config.Bucket = bucket
+	config.Prefix = prefix
+	return NewS3Store(config)
+}
+
+// DirStore is a Store keeping objects as files in a directory, which is
+// created on the first Put
+type DirStore string
+
+// Put writes data to a temporary file, syncs it and renames it into place, so
+// a backup interrupted halfway never shows up under its name
+func (d DirStore) Put(ctx context.Context, name string, data []byte) error {
+	if err := checkName(name); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(string(d), 0700); err != nil {
+		return err
+	}
+
+	return fsys.WriteFile(fsys.OS{}, filepath.Join(string(d), name), data, 0600)
+}
+
+func (d DirStore) Get(ctx context.Context, name string) ([]byte, error) {
+	if err := checkName(name); err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(filepath.Join(string(d), name))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("%w: %s", ErrNotFound, name)
+	}
+	return data, err
+}
+
+// List returns the names of the files in the directory, leaving out
+// temporary files of unfinished writes. A missing directory holds nothing
+func (d DirStore) List(ctx context.Context) ([]string, error) {
+	entries, err := os.ReadDir(string(d))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for _, entry := range entries {
+		if entry.Type().IsRegular() && !strings.HasSuffix(entry.Name(), ".tmp") {
+			names = append(names, entry.Name())
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func (d DirStore) Delete(ctx context.Context, name string) error {
+	if err := checkName(name); err != nil {
+		return err
+	}
+	err := os.Remove(filepath.Join(string(d), name))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+func (d DirStore) String() string {
+	return string(d)
+}
+
+// checkName keeps object names inside their store
+func checkName(name string) error {
+	if name == "" || name == "." || name == ".." || strings.ContainsAny(name, `/\`) {
+		return fmt.Errorf("invalid backup object name %q", name)
+	}
+	return nil
+}
@@ -0,0 +1,45 @@
+// Package clock abstracts time so that code driven by timers can be tested
+// with virtual time
+package clock
+
+import "time"
+
+// Clock tells the time and creates tickers
+type Clock interface {
+	Now() time.Time
+	NewTicker(d time.Duration) Ticker
+}
+
+// Ticker delivers ticks at a fixed interval, like time.Ticker
+type Ticker interface {
+	C() <-chan time.Time
+	Reset(d time.Duration)
+	Stop()
+}
+
+// Real is the Clock backed by the time package
+type Real struct{}
+
+func (Real) Now() time.Time {
+	return time.Now()
+}
+
+func (Real) NewTicker(d time.Duration) Ticker {
+	return realTicker{time.NewTicker(d)}
+}
+
+type realTicker struct {
+	t *time.Ticker
+}
+
+func (r realTicker) C() <-chan time.Time {
+	return r.t.C
+}
+
+func (r realTicker) Reset(d time.Duration) {
+	r.t.Reset(d)
+}
+
+func (r realTicker) Stop() {
+	r.t.Stop()
+}
@@ -0,0 +1,95 @@
+package clock
+
+import (
+	"testing"
+	"time"
+)
+
+var start = time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+func expectTick(t *testing.T, ticker Ticker, expected time.Time) {
+	t.Helper()
+
+	select {
+	case tick := <-ticker.C():
+		if !tick.Equal(expected) {
+			t.Errorf("expected tick at %v, got %v", expected, tick)
+		}
+	default:
+		t.Fatalf("expected a tick at %v", expected)
+	}
+}
+
+func expectNoTick(t *testing.T, ticker Ticker) {
+	t.Helper()
+
+	select {
+	case tick := <-ticker.C():
+		t.Fatalf("unexpected tick at %v", tick)
+	default:
+	}
+}
+
+func Test_FakeTicker(t *testing.T) {
+	f := NewFake(start)
+	ticker := f.NewTicker(5 * time.Second)
+
+	f.Advance(5*time.Second - time.Nanosecond)
+	expectNoTick(t, ticker)
+
+	f.Advance(time.Nanosecond)
+	expectTick(t, ticker, start.Add(5*time.Second))
+
+	// Ticks not received are dropped, only one stays buffered
+	f.Advance(20 * time.Second)
+	expectTick(t, ticker, start.Add(10*time.Second))
+	expectNoTick(t, ticker)
+
+	if !f.Now().Equal(start.Add(25 * time.Second)) {
+		t.Errorf("expected clock at %v, got %v", start.Add(25*time.Second), f.Now())
+	}
+}
+
+func Test_FakeTickerReset(t *testing.T) {
+	f := NewFake(start)
+	ticker := f.NewTicker(5 * time.Second)
+
+	f.Advance(3 * time.Second)
+	ticker.Reset(time.Second)
+
+	f.Advance(time.Second)
+	expectTick(t, ticker, start.Add(4*time.Second))
+}
+
+func Test_FakeTickerStop(t *testing.T) {
+	f := NewFake(start)
+	ticker := f.NewTicker(time.Second)
+	if f.Tickers() != 1 {
+		t.Fatalf("expected 1 ticker, got %d", f.Tickers())
+	}
+
+	ticker.Stop()
+	f.Advance(time.Minute)
+	expectNoTick(t, ticker)
+
+	if f.Tickers() != 0 {
+		t.Fatalf("expected no tickers, got %d", f.Tickers())
+	}
+}
+
+func Test_BlockUntil(t *testing.T) {
+	f := NewFake(start)
+
+	done := make(chan struct{})
+	go func() {
+		f.BlockUntil(1)
+		close(done)
+	}()
+
+	f.NewTicker(time.Second)
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("BlockUntil did not return after the ticker was created")
+	}
+}
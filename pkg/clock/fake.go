@@ -0,0 +1,148 @@
+package clock
+
+import (
+	"sync"
+	"time"
+)
+
+// Fake is a Clock that only moves when Advance is called. Tickers fire
+// synchronously from Advance, in deadline order
+type Fake struct {
+	mu      sync.Mutex
+	now     time.Time
+	tickers []*fakeTicker
+	changed chan struct{} // Closed and replaced whenever a ticker is added or stopped
+}
+
+// NewFake creates a fake clock set to start
+func NewFake(start time.Time) *Fake {
+	return &Fake{now: start, changed: make(chan struct{})}
+}
+
+func (f *Fake) Now() time.Time {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.now
+}
+
+func (f *Fake) NewTicker(d time.Duration) Ticker {
+	if d <= 0 {
+		panic("clock: non-positive interval for NewTicker")
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	t := &fakeTicker{
+		clock:    f,
+		c:        make(chan time.Time, 1),
+		interval: d,
+		next:     f.now.Add(d),
+	}
+	f.tickers = append(f.tickers, t)
+	f.notify()
+	return t
+}
+
+// Advance moves the clock forward by d and fires every tick due on the way.
+// Like time.Ticker, a tick is dropped if the previous one was not received
+func (f *Fake) Advance(d time.Duration) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	end := f.now.Add(d)
+	for {
+		// Find the earliest ticker due before end
+		var due *fakeTicker
+		for _, t := range f.tickers {
+			if !t.next.After(end) && (due == nil || t.next.Before(due.next)) {
+				due = t
+			}
+		}
+		if due == nil {
+			break
+		}
+
+		f.now = due.next
+		select {
+		case due.c <- f.now:
+		default:
+		}
+		due.next = due.next.Add(due.interval)
+	}
+	f.now = end
+}
+
+// Tickers returns the number of active tickers
+func (f *Fake) Tickers() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.tickers)
+}
+
+// BlockUntil waits until exactly n tickers are active, so a test can be sure
+// the code under test has set up its ticker before advancing the clock
+func (f *Fake) BlockUntil(n int) {
+	for {
+		f.mu.Lock()
+		count := len(f.tickers)
+		changed := f.changed
+		f.mu.Unlock()
+
+		if count == n {
+			return
+		}
+		<-changed
+	}
+}
+
+// notify wakes BlockUntil callers, f.mu must be held
+func (f *Fake) notify() {
+	close(f.changed)
+	f.changed = make(chan struct{})
+}
+
+type fakeTicker struct {
+	clock    *Fake
+	c        chan time.Time
+	interval time.Duration
+	next     time.Time
+}
+
+func (t *fakeTicker) C() <-chan time.Time {
+	return t.c
+}
+
+func (t *fakeTicker) Reset(d time.Duration) {
+	if d <= 0 {
+		panic("clock: non-positive interval for Ticker.Reset")
+	}
+
+	t.clock.mu.Lock()
+	defer t.clock.mu.Unlock()
+
+	t.interval = d
+	t.next = t.clock.now.Add(d)
+
+	// A stopped ticker starts again, as with time.Ticker
+	for _, other := range t.clock.tickers {
+		if other == t {
+			return
+		}
+	}
+	t.clock.tickers = append(t.clock.tickers, t)
+	t.clock.notify()
+}
+
+func (t *fakeTicker) Stop() {
+	t.clock.mu.Lock()
+	defer t.clock.mu.Unlock()
+
+	for i, other := range t.clock.tickers {
+		if other == t {
+			t.clock.tickers = append(t.clock.tickers[:i], t.clock.tickers[i+1:]...)
+			t.clock.notify()
+			return
+		}
+	}
+}
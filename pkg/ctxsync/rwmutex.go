@@ -0,0 +1,134 @@
+package ctxsync
+
+import (
+	"container/list"
+	"context"
+	"sync"
+)
+
+// RWMutex is a reader/writer lock whose lock methods give up when the
+// context is done. Waiters are served in arrival order, so a waiting
+// writer is not starved by a stream of new readers
+type RWMutex struct {
+	mu      sync.Mutex
+	readers int       // Number of readers holding the lock
+	writer  bool      // Whether a writer holds the lock
+	waiters list.List // Queue of *waiter
+}
+
+type waiter struct {
+	write bool
+	ready chan struct{} // Closed once the lock is handed over
+}
+
+// Lock acquires the lock for writing, or returns the context error if the
+// context is done first
+func (m *RWMutex) Lock(ctx context.Context) error {
+	return m.acquire(ctx, true)
+}
+
+// RLock acquires the lock for reading, or returns the context error if the
+// context is done first
+func (m *RWMutex) RLock(ctx context.Context) error {
+	return m.acquire(ctx, false)
+}
+
+// Unlock releases a write lock
+func (m *RWMutex) Unlock() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if !m.writer {
+		panic("ctxsync: Unlock of unlocked RWMutex")
+	}
+	m.writer = false
+	m.grant()
+}
+
+// RUnlock releases a read lock
+func (m *RWMutex) RUnlock() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.readers == 0 {
+		panic("ctxsync: RUnlock of unlocked RWMutex")
+	}
+	m.readers--
+	m.grant()
+}
+
+func (m *RWMutex) acquire(ctx context.Context, write bool) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	if m.waiters.Len() == 0 && m.available(write) {
+		m.take(write)
+		m.mu.Unlock()
+		return nil
+	}
+
+	w := &waiter{write: write, ready: make(chan struct{})}
+	elem := m.waiters.PushBack(w)
+	m.mu.Unlock()
+
+	select {
+	case <-w.ready:
+		return nil
+	case <-ctx.Done():
+		m.mu.Lock()
+		defer m.mu.Unlock()
+
+		select {
+		case <-w.ready:
+			// The lock was handed over while we were giving up, pass it on
+			if write {
+				m.writer = false
+			} else {
+				m.readers--
+			}
+		default:
+			m.waiters.Remove(elem)
+		}
+
+		// Leaving the queue may unblock the waiters behind us
+		m.grant()
+		return ctx.Err()
+	}
+}
+
+// available reports whether the lock can be taken in the given mode right now
+func (m *RWMutex) available(write bool) bool {
+	if write {
+		return !m.writer && m.readers == 0
+	}
+	return !m.writer
+}
+
+func (m *RWMutex) take(write bool) {
+	if write {
+		m.writer = true
+	} else {
+		m.readers++
+	}
+}
+
+// grant hands the lock to queued waiters in order for as long as possible
+func (m *RWMutex) grant() {
+	for {
+		front := m.waiters.Front()
+		if front == nil {
+			return
+		}
+
+		w := front.Value.(*waiter)
+		if !m.available(w.write) {
+			return
+		}
+
+		m.take(w.write)
+		m.waiters.Remove(front)
+		close(w.ready)
+	}
+}
@@ -0,0 +1,148 @@
+package ctxsync
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+func Test_ReadersShareLock(t *testing.T) {
+	var m RWMutex
+	ctx := context.Background()
+
+	if err := m.RLock(ctx); err != nil {
+		t.Fatalf("RLock failed: %v", err)
+	}
+	if err := m.RLock(ctx); err != nil {
+		t.Fatalf("second RLock failed: %v", err)
+	}
+
+	m.RUnlock()
+	m.RUnlock()
+
+	if err := m.Lock(ctx); err != nil {
+		t.Fatalf("Lock after readers left failed: %v", err)
+	}
+	m.Unlock()
+}
+
+func Test_LockHonorsDeadline(t *testing.T) {
+	var m RWMutex
+	if err := m.Lock(context.Background()); err != nil {
+		t.Fatalf("Lock failed: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+
+	if err := m.Lock(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected %v, got %v", context.DeadlineExceeded, err)
+	}
+	if err := m.RLock(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected %v, got %v", context.DeadlineExceeded, err)
+	}
+
+	// The abandoned waiters must not hold on to the lock
+	m.Unlock()
+	if err := m.Lock(context.Background()); err != nil {
+		t.Fatalf("Lock after cancelled waiters failed: %v", err)
+	}
+	m.Unlock()
+}
+
+func Test_CancelledContext(t *testing.T) {
+	var m RWMutex
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if err := m.Lock(ctx); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected %v, got %v", context.Canceled, err)
+	}
+}
+
+func Test_CancelledWriterUnblocksReaders(t *testing.T) {
+	var m RWMutex
+	if err := m.RLock(context.Background()); err != nil {
+		t.Fatalf("RLock failed: %v", err)
+	}
+
+	// A writer queues behind the reader and new readers queue behind it
+	writerCtx, cancelWriter := context.WithCancel(context.Background())
+	writerDone := make(chan error)
+	go func() {
+		writerDone <- m.Lock(writerCtx)
+	}()
+	waitForWaiters(t, &m, 1)
+
+	readerDone := make(chan error)
+	go func() {
+		readerDone <- m.RLock(context.Background())
+	}()
+	waitForWaiters(t, &m, 2)
+
+	cancelWriter()
+	if err := <-writerDone; !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected %v, got %v", context.Canceled, err)
+	}
+
+	select {
+	case err := <-readerDone:
+		if err != nil {
+			t.Fatalf("RLock failed: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("reader still blocked after the writer ahead of it gave up")
+	}
+}
+
+func Test_Exclusion(t *testing.T) {
+	var m RWMutex
+	var wg sync.WaitGroup
+	counter := 0
+
+	for i := 0; i < 50; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			if err := m.Lock(context.Background()); err != nil {
+				t.Errorf("Lock failed: %v", err)
+				return
+			}
+			counter++
+			m.Unlock()
+		}()
+		go func() {
+			defer wg.Done()
+			if err := m.RLock(context.Background()); err != nil {
+				t.Errorf("RLock failed: %v", err)
+				return
+			}
+			_ = counter
+			m.RUnlock()
+		}()
+	}
+	wg.Wait()
+
+	if counter != 50 {
+		t.Errorf("expected 50 increments, got %d", counter)
+	}
+}
+
+// waitForWaiters blocks until n goroutines are queued on the lock
+func waitForWaiters(t *testing.T, m *RWMutex, n int) {
+	t.Helper()
+
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		m.mu.Lock()
+		queued := m.waiters.Len()
+		m.mu.Unlock()
+		if queued == n {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatalf("expected %d waiters", n)
+}
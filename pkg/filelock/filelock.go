@@ -0,0 +1,107 @@
+// Package filelock keeps two processes from opening the same database file.
+// It takes an advisory flock on a sidecar lock file where the platform has
+// one, and falls back to a lock file holding the owner's PID elsewhere
+package filelock
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// ErrLocked is returned when another process holds a conflicting lock
+var ErrLocked = errors.New("database file is locked by another process")
+
+// Lock is a lock held on a database file
+type Lock struct {
+	release func() error
+}
+
+// Acquire locks the database file at path without waiting. A shared lock
+// can be held by any number of readers and excludes an exclusive one
+func Acquire(path string, shared bool) (*Lock, error) {
+	return acquire(path, shared)
+}
+
+// Release gives up the lock
+func (l *Lock) Release() error {
+	return l.release()
+}
+
+// lockPath is the sidecar file carrying the lock for path. The database file
+// itself cannot carry it, as it may be replaced by a rename
+func lockPath(path string) string {
+	return path + ".lock"
+}
+
+// lockedError reports that path is locked, naming the owner when it is known
+func lockedError(path string, pid int) error {
+	if pid > 0 {
+		return fmt.Errorf("%w: %s (pid %d)", ErrLocked, path, pid)
+	}
+	return fmt.Errorf("%w: %s", ErrLocked, path)
+}
+
+// writePID records the current process as the owner of a lock file
+func writePID(file *os.File) error {
+	if err := file.Truncate(0); err != nil {
+		return err
+	}
+	_, err := file.WriteAt([]byte(strconv.Itoa(os.Getpid())+"\n"), 0)
+	return err
+}
+
+// readPID returns the owner recorded in a lock file, 0 when there is none
+func readPID(name string) int {
+	content, err := os.ReadFile(name)
+	if err != nil {
+		return 0
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(content)))
+	if err != nil || pid <= 0 {
+		return 0
+	}
+	return pid
+}
+
+// acquirePIDFile locks path by creating a lock file holding the current PID.
+// A lock file left by a process that no longer runs is taken over. Shared
+// locks only check that no live process holds the exclusive one, so an
+// exclusive lock cannot see its readers
+func acquirePIDFile(path string, shared bool) (*Lock, error) {
+	name := lockPath(path)
+
+	// One retry after removing a stale lock file
+	for attempt := 0; attempt < 2; attempt++ {
+		if shared {
+			if pid := readPID(name); pid > 0 && processAlive(pid) {
+				return nil, lockedError(path, pid)
+			}
+			return &Lock{release: func() error { return nil }}, nil
+		}
+
+		file, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0644)
+		if err == nil {
+			err = writePID(file)
+			file.Close()
+			if err != nil {
+				os.Remove(name)
+				return nil, fmt.Errorf("error writing lock file: %w", err)
+			}
+			return &Lock{release: func() error { return os.Remove(name) }}, nil
+		}
+		if !errors.Is(err, os.ErrExist) {
+			return nil, fmt.Errorf("error creating lock file: %w", err)
+		}
+
+		if pid := readPID(name); pid > 0 && processAlive(pid) {
+			return nil, lockedError(path, pid)
+		}
+		if err := os.Remove(name); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return nil, fmt.Errorf("error removing stale lock file: %w", err)
+		}
+	}
+	return nil, lockedError(path, 0)
+}
@@ -0,0 +1,103 @@
+package filelock
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// lockFuncs are the implementations under test, the fallback runs on every
+// platform
+var lockFuncs = []struct {
+	name    string
+	acquire func(path string, shared bool) (*Lock, error)
+}{
+	{name: "Platform", acquire: Acquire},
+	{name: "PIDFile", acquire: acquirePIDFile},
+}
+
+func mustAcquire(t *testing.T, acquire func(string, bool) (*Lock, error), path string, shared bool) *Lock {
+	t.Helper()
+
+	lock, err := acquire(path, shared)
+	if err != nil {
+		t.Fatalf("Acquire failed: %v", err)
+	}
+	return lock
+}
+
+func Test_Exclusive(t *testing.T) {
+	for _, impl := range lockFuncs {
+		t.Run(impl.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "db.json")
+			lock := mustAcquire(t, impl.acquire, path, false)
+
+			_, err := impl.acquire(path, false)
+			if !errors.Is(err, ErrLocked) {
+				t.Fatalf("expected %v, got %v", ErrLocked, err)
+			}
+			if !strings.Contains(err.Error(), fmt.Sprintf("pid %d", os.Getpid())) {
+				t.Errorf("expected the error to name the owner, got %v", err)
+			}
+			if _, err := impl.acquire(path, true); !errors.Is(err, ErrLocked) {
+				t.Errorf("expected %v for a shared lock, got %v", ErrLocked, err)
+			}
+
+			if err := lock.Release(); err != nil {
+				t.Fatalf("Release failed: %v", err)
+			}
+			mustAcquire(t, impl.acquire, path, false).Release()
+		})
+	}
+}
+
+func Test_Shared(t *testing.T) {
+	for _, impl := range lockFuncs {
+		t.Run(impl.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "db.json")
+			first := mustAcquire(t, impl.acquire, path, true)
+			second := mustAcquire(t, impl.acquire, path, true)
+
+			first.Release()
+			second.Release()
+			mustAcquire(t, impl.acquire, path, false).Release()
+		})
+	}
+}
+
+func Test_SharedBlocksExclusive(t *testing.T) {
+	// The PID fallback cannot see readers, only flock can
+	path := filepath.Join(t.TempDir(), "db.json")
+	lock := mustAcquire(t, Acquire, path, true)
+	defer lock.Release()
+
+	if _, err := Acquire(path, false); !errors.Is(err, ErrLocked) {
+		t.Errorf("expected %v, got %v", ErrLocked, err)
+	}
+}
+
+func Test_StalePIDFile(t *testing.T) {
+	// A process that has exited leaves a PID nobody owns
+	cmd := exec.Command(os.Args[0], "-test.run=^$")
+	if err := cmd.Run(); err != nil {
+		t.Fatalf("failed to run helper process: %v", err)
+	}
+	dead := cmd.Process.Pid
+
+	path := filepath.Join(t.TempDir(), "db.json")
+	if err := os.WriteFile(lockPath(path), []byte(strconv.Itoa(dead)), 0644); err != nil {
+		t.Fatalf("failed to write lock file: %v", err)
+	}
+
+	lock := mustAcquire(t, acquirePIDFile, path, false)
+	defer lock.Release()
+
+	if pid := readPID(lockPath(path)); pid != os.Getpid() {
+		t.Errorf("expected the lock file to hold pid %d, got %d", os.Getpid(), pid)
+	}
+}
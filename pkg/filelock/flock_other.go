@@ -0,0 +1,20 @@
+//go:build !unix
+
+package filelock
+
+import "os"
+
+// acquire falls back to a PID lock file where flock is not available
+func acquire(path string, shared bool) (*Lock, error) {
+	return acquirePIDFile(path, shared)
+}
+
+// processAlive reports whether a process with the given PID exists
+func processAlive(pid int) bool {
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	p.Release()
+	return true
+}
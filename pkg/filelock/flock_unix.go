@@ -0,0 +1,55 @@
+//go:build unix
+
+package filelock
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// acquire takes a flock on the lock file. The kernel drops it when the
+// process dies, so a crash never leaves a stale lock behind
+func acquire(path string, shared bool) (*Lock, error) {
+	name := lockPath(path)
+	file, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("error opening lock file: %w", err)
+	}
+
+	how := syscall.LOCK_EX
+	if shared {
+		how = syscall.LOCK_SH
+	}
+	if err := syscall.Flock(int(file.Fd()), how|syscall.LOCK_NB); err != nil {
+		file.Close()
+		if errors.Is(err, syscall.EWOULDBLOCK) {
+			pid := readPID(name)
+			if pid > 0 && !processAlive(pid) {
+				pid = 0
+			}
+			return nil, lockedError(path, pid)
+		}
+		return nil, fmt.Errorf("error locking file: %w", err)
+	}
+
+	// The PID only tells others who to look for, the flock is the lock
+	if !shared {
+		if err := writePID(file); err != nil {
+			file.Close()
+			return nil, fmt.Errorf("error writing lock file: %w", err)
+		}
+	}
+
+	return &Lock{release: func() error {
+		// Closing the file drops the flock as well
+		return file.Close()
+	}}, nil
+}
+
+// processAlive reports whether a process with the given PID exists
+func processAlive(pid int) bool {
+	err := syscall.Kill(pid, 0)
+	return err == nil || errors.Is(err, syscall.EPERM)
+}
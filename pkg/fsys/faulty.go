@@ -0,0 +1,206 @@
+package fsys
+
+import (
+	"errors"
+	"io/fs"
+	"sync"
+)
+
+// ErrInjected is returned by a Fault that has no error of its own
+var ErrInjected = errors.New("injected fault")
+
+// Op names a filesystem call a Fault can target
+type Op string
+
+const (
+	OpOpen     Op = "open"
+	OpRename   Op = "rename"
+	OpRemove   Op = "remove"
+	OpStat     Op = "stat"
+	OpChmod    Op = "chmod"
+	OpLock     Op = "lock"
+	OpRead     Op = "read"
+	OpWrite    Op = "write"
+	OpSeek     Op = "seek"
+	OpTruncate Op = "truncate"
+	OpSync     Op = "sync"
+	OpClose    Op = "close"
+)
+
+// Fault makes matching calls fail
+type Fault struct {
+	Op    Op     // Call to fail
+	Path  string // Only calls on this path, empty matches any path
+	Err   error  // Error returned, ErrInjected if nil
+	Skip  int    // Matching calls that succeed before the fault fires
+	Times int    // Times the fault fires, 0 means once and negative means forever
+	Short int    // For writes, bytes written before the error is returned
+}
+
+// Faulty wraps an FS and fails calls matching the injected faults
+type Faulty struct {
+	FS FS
+
+	mu     sync.Mutex
+	faults []*Fault
+}
+
+// NewFaulty wraps fsys without any faults
+func NewFaulty(fsys FS) *Faulty {
+	return &Faulty{FS: fsys}
+}
+
+// Inject adds a fault
+func (f *Faulty) Inject(fault Fault) {
+	if fault.Err == nil {
+		fault.Err = ErrInjected
+	}
+	if fault.Times == 0 {
+		fault.Times = 1
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.faults = append(f.faults, &fault)
+}
+
+// Clear removes all faults
+func (f *Faulty) Clear() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.faults = nil
+}
+
+// fire returns the fault hit by a call, if any, and uses it up
+func (f *Faulty) fire(op Op, path string) *Fault {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for i, fault := range f.faults {
+		if fault.Op != op || (fault.Path != "" && fault.Path != path) {
+			continue
+		}
+		if fault.Skip > 0 {
+			fault.Skip--
+			continue
+		}
+
+		hit := *fault
+		if fault.Times > 0 {
+			fault.Times--
+			if fault.Times == 0 {
+				f.faults = append(f.faults[:i], f.faults[i+1:]...)
+			}
+		}
+		return &hit
+	}
+	return nil
+}
+
+func (f *Faulty) OpenFile(name string, flag int, perm fs.FileMode) (File, error) {
+	if fault := f.fire(OpOpen, name); fault != nil {
+		return nil, &fs.PathError{Op: string(OpOpen), Path: name, Err: fault.Err}
+	}
+
+	file, err := f.FS.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return &faultyFile{File: file, name: name, faults: f}, nil
+}
+
+func (f *Faulty) Rename(oldpath, newpath string) error {
+	if fault := f.fire(OpRename, oldpath); fault != nil {
+		return &fs.PathError{Op: string(OpRename), Path: oldpath, Err: fault.Err}
+	}
+	return f.FS.Rename(oldpath, newpath)
+}
+
+func (f *Faulty) Remove(name string) error {
+	if fault := f.fire(OpRemove, name); fault != nil {
+		return &fs.PathError{Op: string(OpRemove), Path: name, Err: fault.Err}
+	}
+	return f.FS.Remove(name)
+}
+
+func (f *Faulty) Stat(name string) (fs.FileInfo, error) {
+	if fault := f.fire(OpStat, name); fault != nil {
+		return nil, &fs.PathError{Op: string(OpStat), Path: name, Err: fault.Err}
+	}
+	return f.FS.Stat(name)
+}
+
+func (f *Faulty) Chmod(name string, mode fs.FileMode) error {
+	if fault := f.fire(OpChmod, name); fault != nil {
+		return &fs.PathError{Op: string(OpChmod), Path: name, Err: fault.Err}
+	}
+	return f.FS.Chmod(name, mode)
+}
+
+func (f *Faulty) Lock(name string, shared bool) (func() error, error) {
+	if fault := f.fire(OpLock, name); fault != nil {
+		return nil, &fs.PathError{Op: string(OpLock), Path: name, Err: fault.Err}
+	}
+	return f.FS.Lock(name, shared)
+}
+
+// faultyFile checks every call against the faults of the FS it came from
+type faultyFile struct {
+	File
+	name   string
+	faults *Faulty
+}
+
+func (f *faultyFile) err(op Op, fault *Fault) error {
+	return &fs.PathError{Op: string(op), Path: f.name, Err: fault.Err}
+}
+
+func (f *faultyFile) Read(p []byte) (int, error) {
+	if fault := f.faults.fire(OpRead, f.name); fault != nil {
+		return 0, f.err(OpRead, fault)
+	}
+	return f.File.Read(p)
+}
+
+func (f *faultyFile) Write(p []byte) (int, error) {
+	if fault := f.faults.fire(OpWrite, f.name); fault != nil {
+		n := 0
+		if fault.Short > 0 {
+			// Part of the data reaches the file before the failure
+			short := min(fault.Short, len(p))
+			n, _ = f.File.Write(p[:short])
+		}
+		return n, f.err(OpWrite, fault)
+	}
+	return f.File.Write(p)
+}
+
+func (f *faultyFile) Seek(offset int64, whence int) (int64, error) {
+	if fault := f.faults.fire(OpSeek, f.name); fault != nil {
+		return 0, f.err(OpSeek, fault)
+	}
+	return f.File.Seek(offset, whence)
+}
+
+func (f *faultyFile) Truncate(size int64) error {
+	if fault := f.faults.fire(OpTruncate, f.name); fault != nil {
+		return f.err(OpTruncate, fault)
+	}
+	return f.File.Truncate(size)
+}
+
+func (f *faultyFile) Sync() error {
+	if fault := f.faults.fire(OpSync, f.name); fault != nil {
+		return f.err(OpSync, fault)
+	}
+	return f.File.Sync()
+}
+
+func (f *faultyFile) Close() error {
+	if fault := f.faults.fire(OpClose, f.name); fault != nil {
+		// The handle is released anyway, as close(2) does on error
+		f.File.Close()
+		return f.err(OpClose, fault)
+	}
+	return f.File.Close()
+}
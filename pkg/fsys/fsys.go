@@ -0,0 +1,125 @@
+// Package fsys is the small filesystem surface the storage engines use, so
+// they can run on disk, in memory or over a wrapper that injects faults
+package fsys
+
+import (
+	"io"
+	"io/fs"
+	"os"
+	"zabbixhw/pkg/filelock"
+)
+
+// File is an open file. *os.File implements it
+type File interface {
+	io.Reader
+	io.Writer
+	io.Seeker
+	io.Closer
+	Truncate(size int64) error
+	Sync() error
+}
+
+// FS opens, renames, removes, stats and locks files
+type FS interface {
+	OpenFile(name string, flag int, perm fs.FileMode) (File, error)
+	Rename(oldpath, newpath string) error
+	Remove(name string) error
+	Stat(name string) (fs.FileInfo, error)
+	Chmod(name string, mode fs.FileMode) error
+	// Lock takes an advisory lock on name without waiting, failing with
+	// filelock.ErrLocked if a conflicting lock is held. Any number of shared
+	// locks can be held at once
+	Lock(name string, shared bool) (unlock func() error, err error)
+}
+
+// OS is the FS backed by the operating system
+type OS struct{}
+
+func (OS) OpenFile(name string, flag int, perm fs.FileMode) (File, error) {
+	file, err := os.OpenFile(name, flag, perm)
+	if err != nil {
+		// Avoid returning a non-nil File holding a nil *os.File
+		return nil, err
+	}
+	return file, nil
+}
+
+func (OS) Rename(oldpath, newpath string) error {
+	return os.Rename(oldpath, newpath)
+}
+
+func (OS) Remove(name string) error {
+	return os.Remove(name)
+}
+
+func (OS) Stat(name string) (fs.FileInfo, error) {
+	return os.Stat(name)
+}
+
+func (OS) Chmod(name string, mode fs.FileMode) error {
+	return os.Chmod(name, mode)
+}
+
+func (OS) Lock(name string, shared bool) (func() error, error) {
+	lock, err := filelock.Acquire(name, shared)
+	if err != nil {
+		return nil, err
+	}
+	return lock.Release, nil
+}
+
+// WriteFile writes data to a temporary file next to name, syncs it and
+// renames it over name, so name holds either its old or its new content
+func WriteFile(files FS, name string, data []byte, perm fs.FileMode) error {
+	tmp := name + ".tmp"
+	file, err := files.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		files.Remove(tmp)
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		files.Remove(tmp)
+		return err
+	}
+	if err := file.Close(); err != nil {
+		files.Remove(tmp)
+		return err
+	}
+	if err := files.Rename(tmp, name); err != nil {
+		files.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+// WriteAt cuts name off at offset, creating it if needed, writes data there
+// and syncs it. What a failed write left past offset is dropped by the next
+// call
+func WriteAt(files FS, name string, offset int64, data []byte, perm fs.FileMode) error {
+	file, err := files.OpenFile(name, os.O_WRONLY|os.O_CREATE, perm)
+	if err != nil {
+		return err
+	}
+	if err := file.Truncate(offset); err != nil {
+		file.Close()
+		return err
+	}
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		file.Close()
+		return err
+	}
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
@@ -0,0 +1,262 @@
+package fsys
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"zabbixhw/pkg/filelock"
+)
+
+// Test_FileOps runs the same sequence of calls on both implementations
+func Test_FileOps(t *testing.T) {
+	tests := []struct {
+		name string
+		fsys FS
+		dir  string
+	}{
+		{name: "OS", fsys: OS{}, dir: t.TempDir()},
+		{name: "Mem", fsys: NewMemFS(), dir: "mem"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(tt.dir, "a")
+
+			if _, err := tt.fsys.OpenFile(path, os.O_RDWR, 0644); !errors.Is(err, fs.ErrNotExist) {
+				t.Fatalf("expected %v, got %v", fs.ErrNotExist, err)
+			}
+
+			file, err := tt.fsys.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+			if err != nil {
+				t.Fatalf("OpenFile failed: %v", err)
+			}
+			if _, err := io.WriteString(file, "hello world"); err != nil {
+				t.Fatalf("Write failed: %v", err)
+			}
+			if err := file.Truncate(5); err != nil {
+				t.Fatalf("Truncate failed: %v", err)
+			}
+			if _, err := file.Seek(0, io.SeekStart); err != nil {
+				t.Fatalf("Seek failed: %v", err)
+			}
+			content, err := io.ReadAll(file)
+			if err != nil {
+				t.Fatalf("Read failed: %v", err)
+			}
+			if string(content) != "hello" {
+				t.Errorf("expected %q, got %q", "hello", content)
+			}
+			if err := file.Sync(); err != nil {
+				t.Errorf("Sync failed: %v", err)
+			}
+			if err := file.Close(); err != nil {
+				t.Errorf("Close failed: %v", err)
+			}
+			info, err := tt.fsys.Stat(path)
+			if err != nil {
+				t.Fatalf("Stat failed: %v", err)
+			}
+			if info.Name() != "a" || info.Size() != 5 || info.ModTime().IsZero() {
+				t.Errorf("unexpected file info %q, %d bytes, modified %v", info.Name(), info.Size(), info.ModTime())
+			}
+			if err := tt.fsys.Chmod(path, 0600); err != nil {
+				t.Fatalf("Chmod failed: %v", err)
+			}
+			if info, _ := tt.fsys.Stat(path); info.Mode().Perm() != 0600 {
+				t.Errorf("expected mode %v, got %v", fs.FileMode(0600), info.Mode().Perm())
+			}
+
+			if _, err := tt.fsys.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0644); !errors.Is(err, fs.ErrExist) {
+				t.Errorf("expected %v, got %v", fs.ErrExist, err)
+			}
+
+			renamed := filepath.Join(tt.dir, "b")
+			if err := tt.fsys.Rename(path, renamed); err != nil {
+				t.Fatalf("Rename failed: %v", err)
+			}
+			if _, err := tt.fsys.OpenFile(path, os.O_RDONLY, 0); !errors.Is(err, fs.ErrNotExist) {
+				t.Errorf("expected %v after rename, got %v", fs.ErrNotExist, err)
+			}
+			if err := tt.fsys.Remove(renamed); err != nil {
+				t.Errorf("Remove failed: %v", err)
+			}
+			if err := tt.fsys.Remove(renamed); !errors.Is(err, fs.ErrNotExist) {
+				t.Errorf("expected %v, got %v", fs.ErrNotExist, err)
+			}
+		})
+	}
+}
+
+func Test_WriteFile(t *testing.T) {
+	mem := NewMemFS()
+	faulty := NewFaulty(mem)
+
+	if err := WriteFile(faulty, "a", []byte("old"), 0600); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+	if info, _ := mem.Stat("a"); info.Mode().Perm() != 0600 {
+		t.Errorf("expected mode %v, got %v", fs.FileMode(0600), info.Mode().Perm())
+	}
+
+	faulty.Inject(Fault{Op: OpSync, Err: syscall.EIO})
+	if err := WriteFile(faulty, "a", []byte("new"), 0600); !errors.Is(err, syscall.EIO) {
+		t.Errorf("expected %v, got %v", syscall.EIO, err)
+	}
+	if content, _ := mem.ReadFile("a"); string(content) != "old" {
+		t.Errorf("expected the old content after a failed write, got %q", content)
+	}
+	if _, err := mem.Stat("a.tmp"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("expected the temporary file to be removed, got %v", err)
+	}
+}
+
+func Test_WriteAt(t *testing.T) {
+	mem := NewMemFS()
+	faulty := NewFaulty(mem)
+
+	if err := WriteAt(faulty, "a", 0, []byte("hello"), 0600); err != nil {
+		t.Fatalf("WriteAt failed: %v", err)
+	}
+	faulty.Inject(Fault{Op: OpWrite, Err: syscall.ENOSPC, Short: 2})
+	if err := WriteAt(faulty, "a", 5, []byte(" world"), 0600); !errors.Is(err, syscall.ENOSPC) {
+		t.Errorf("expected %v, got %v", syscall.ENOSPC, err)
+	}
+	if err := WriteAt(faulty, "a", 3, []byte("p!"), 0600); err != nil {
+		t.Fatalf("WriteAt failed: %v", err)
+	}
+	if content, _ := mem.ReadFile("a"); string(content) != "help!" {
+		t.Errorf("expected %q, got %q", "help!", content)
+	}
+}
+
+func Test_MemFSSharedContent(t *testing.T) {
+	mem := NewMemFS()
+
+	writer, _ := mem.OpenFile("a", os.O_WRONLY|os.O_CREATE, 0644)
+	reader, _ := mem.OpenFile("a", os.O_RDONLY, 0)
+
+	io.WriteString(writer, "data")
+	content, _ := io.ReadAll(reader)
+	if string(content) != "data" {
+		t.Errorf("expected %q, got %q", "data", content)
+	}
+
+	if _, err := reader.Write([]byte("x")); !errors.Is(err, fs.ErrPermission) {
+		t.Errorf("expected %v writing a read-only handle, got %v", fs.ErrPermission, err)
+	}
+
+	writer.Close()
+	if _, err := writer.Write([]byte("x")); !errors.Is(err, fs.ErrClosed) {
+		t.Errorf("expected %v writing a closed handle, got %v", fs.ErrClosed, err)
+	}
+}
+
+func Test_Faulty(t *testing.T) {
+	t.Run("Fault fires once after skipped calls", func(t *testing.T) {
+		faulty := NewFaulty(NewMemFS())
+		faulty.Inject(Fault{Op: OpSync, Err: syscall.EIO, Skip: 1})
+
+		file, _ := faulty.OpenFile("a", os.O_RDWR|os.O_CREATE, 0644)
+		if err := file.Sync(); err != nil {
+			t.Errorf("first Sync should be skipped, got %v", err)
+		}
+		if err := file.Sync(); !errors.Is(err, syscall.EIO) {
+			t.Errorf("expected %v, got %v", syscall.EIO, err)
+		}
+		if err := file.Sync(); err != nil {
+			t.Errorf("fault should be used up, got %v", err)
+		}
+	})
+
+	t.Run("Fault limited to a path", func(t *testing.T) {
+		faulty := NewFaulty(NewMemFS())
+		faulty.Inject(Fault{Op: OpOpen, Path: "b"})
+
+		if _, err := faulty.OpenFile("a", os.O_RDWR|os.O_CREATE, 0644); err != nil {
+			t.Errorf("unexpected error opening a: %v", err)
+		}
+		if _, err := faulty.OpenFile("b", os.O_RDWR|os.O_CREATE, 0644); !errors.Is(err, ErrInjected) {
+			t.Errorf("expected %v, got %v", ErrInjected, err)
+		}
+	})
+
+	t.Run("Short write", func(t *testing.T) {
+		mem := NewMemFS()
+		faulty := NewFaulty(mem)
+		faulty.Inject(Fault{Op: OpWrite, Err: syscall.ENOSPC, Short: 3})
+
+		file, _ := faulty.OpenFile("a", os.O_RDWR|os.O_CREATE, 0644)
+		n, err := io.WriteString(file, "hello")
+		if n != 3 || !errors.Is(err, syscall.ENOSPC) {
+			t.Errorf("expected 3 bytes and %v, got %d and %v", syscall.ENOSPC, n, err)
+		}
+		if content, _ := mem.ReadFile("a"); string(content) != "hel" {
+			t.Errorf("expected %q on disk, got %q", "hel", content)
+		}
+	})
+
+	t.Run("Permanent fault until cleared", func(t *testing.T) {
+		faulty := NewFaulty(NewMemFS())
+		faulty.Inject(Fault{Op: OpRead, Times: -1})
+
+		file, _ := faulty.OpenFile("a", os.O_RDWR|os.O_CREATE, 0644)
+		for i := 0; i < 3; i++ {
+			if _, err := file.Read(make([]byte, 1)); !errors.Is(err, ErrInjected) {
+				t.Fatalf("expected %v, got %v", ErrInjected, err)
+			}
+		}
+
+		faulty.Clear()
+		if _, err := file.Read(make([]byte, 1)); err != io.EOF {
+			t.Errorf("expected %v after Clear, got %v", io.EOF, err)
+		}
+	})
+}
+
+func Test_Lock(t *testing.T) {
+	tests := []struct {
+		name string
+		fsys FS
+		path string
+	}{
+		{name: "OS", fsys: OS{}, path: filepath.Join(t.TempDir(), "db.json")},
+		{name: "Mem", fsys: NewMemFS(), path: "db.json"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			unlock, err := tt.fsys.Lock(tt.path, false)
+			if err != nil {
+				t.Fatalf("Lock failed: %v", err)
+			}
+			if _, err := tt.fsys.Lock(tt.path, true); !errors.Is(err, filelock.ErrLocked) {
+				t.Errorf("expected %v, got %v", filelock.ErrLocked, err)
+			}
+			unlock()
+
+			first, err := tt.fsys.Lock(tt.path, true)
+			if err != nil {
+				t.Fatalf("shared Lock failed: %v", err)
+			}
+			second, err := tt.fsys.Lock(tt.path, true)
+			if err != nil {
+				t.Fatalf("second shared Lock failed: %v", err)
+			}
+			if _, err := tt.fsys.Lock(tt.path, false); !errors.Is(err, filelock.ErrLocked) {
+				t.Errorf("expected %v, got %v", filelock.ErrLocked, err)
+			}
+
+			first()
+			second()
+			unlock, err = tt.fsys.Lock(tt.path, false)
+			if err != nil {
+				t.Fatalf("Lock after release failed: %v", err)
+			}
+			unlock()
+		})
+	}
+}
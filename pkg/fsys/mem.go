@@ -0,0 +1,303 @@
+package fsys
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+	"zabbixhw/pkg/filelock"
+)
+
+// MemFS is an FS kept in memory. Files are flat, names are not split into
+// directories
+type MemFS struct {
+	mu    sync.Mutex
+	files map[string]*memNode
+	locks map[string]int // Shared holders per name, -1 when held exclusively
+}
+
+// memNode holds the content of a file, shared by all handles open on it
+type memNode struct {
+	mu      sync.Mutex
+	data    []byte
+	mode    fs.FileMode
+	modTime time.Time // Last change of data
+}
+
+// NewMemFS creates an empty in-memory filesystem
+func NewMemFS() *MemFS {
+	return &MemFS{files: make(map[string]*memNode), locks: make(map[string]int)}
+}
+
+func (m *MemFS) OpenFile(name string, flag int, perm fs.FileMode) (File, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	node, ok := m.files[name]
+	switch {
+	case ok && flag&os.O_CREATE != 0 && flag&os.O_EXCL != 0:
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrExist}
+	case !ok && flag&os.O_CREATE == 0:
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	case !ok:
+		node = &memNode{mode: perm, modTime: time.Now()}
+		m.files[name] = node
+	}
+
+	if flag&os.O_TRUNC != 0 {
+		node.mu.Lock()
+		node.data = nil
+		node.modTime = time.Now()
+		node.mu.Unlock()
+	}
+
+	return &memFile{
+		name:   name,
+		node:   node,
+		read:   flag&(os.O_WRONLY|os.O_RDWR) != os.O_WRONLY,
+		write:  flag&(os.O_WRONLY|os.O_RDWR) != 0,
+		append: flag&os.O_APPEND != 0,
+	}, nil
+}
+
+func (m *MemFS) Rename(oldpath, newpath string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	node, ok := m.files[oldpath]
+	if !ok {
+		return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: fs.ErrNotExist}
+	}
+	delete(m.files, oldpath)
+	m.files[newpath] = node
+	return nil
+}
+
+func (m *MemFS) Remove(name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.files[name]; !ok {
+		return &fs.PathError{Op: "remove", Path: name, Err: fs.ErrNotExist}
+	}
+	delete(m.files, name)
+	return nil
+}
+
+func (m *MemFS) Stat(name string) (fs.FileInfo, error) {
+	m.mu.Lock()
+	node, ok := m.files[name]
+	m.mu.Unlock()
+	if !ok {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: fs.ErrNotExist}
+	}
+
+	node.mu.Lock()
+	defer node.mu.Unlock()
+	return memFileInfo{name: filepath.Base(name), size: int64(len(node.data)), mode: node.mode, modTime: node.modTime}, nil
+}
+
+func (m *MemFS) Chmod(name string, mode fs.FileMode) error {
+	m.mu.Lock()
+	node, ok := m.files[name]
+	m.mu.Unlock()
+	if !ok {
+		return &fs.PathError{Op: "chmod", Path: name, Err: fs.ErrNotExist}
+	}
+
+	node.mu.Lock()
+	defer node.mu.Unlock()
+	node.mode = mode
+	return nil
+}
+
+func (m *MemFS) Lock(name string, shared bool) (func() error, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	holders := m.locks[name]
+	if holders < 0 || (holders > 0 && !shared) {
+		return nil, fmt.Errorf("%w: %s", filelock.ErrLocked, name)
+	}
+	if shared {
+		m.locks[name]++
+	} else {
+		m.locks[name] = -1
+	}
+
+	var once sync.Once
+	return func() error {
+		once.Do(func() {
+			m.mu.Lock()
+			defer m.mu.Unlock()
+
+			if m.locks[name] > 1 {
+				m.locks[name]--
+			} else {
+				delete(m.locks, name)
+			}
+		})
+		return nil
+	}, nil
+}
+
+// ReadFile returns a copy of the content of a file
+func (m *MemFS) ReadFile(name string) ([]byte, error) {
+	m.mu.Lock()
+	node, ok := m.files[name]
+	m.mu.Unlock()
+	if !ok {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+
+	node.mu.Lock()
+	defer node.mu.Unlock()
+	return append([]byte(nil), node.data...), nil
+}
+
+// WriteFile replaces the content of a file, creating it if needed
+func (m *MemFS) WriteFile(name string, data []byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.files[name] = &memNode{data: append([]byte(nil), data...), mode: 0644, modTime: time.Now()}
+	return nil
+}
+
+// memFile is an open handle on a memNode
+type memFile struct {
+	name   string
+	node   *memNode
+	offset int64
+	read   bool
+	write  bool
+	append bool
+	closed bool
+}
+
+func (f *memFile) check(op string, allowed bool) error {
+	if f.closed {
+		return &fs.PathError{Op: op, Path: f.name, Err: fs.ErrClosed}
+	}
+	if !allowed {
+		return &fs.PathError{Op: op, Path: f.name, Err: fs.ErrPermission}
+	}
+	return nil
+}
+
+func (f *memFile) Read(p []byte) (int, error) {
+	if err := f.check("read", f.read); err != nil {
+		return 0, err
+	}
+
+	f.node.mu.Lock()
+	defer f.node.mu.Unlock()
+
+	if f.offset >= int64(len(f.node.data)) {
+		return 0, io.EOF
+	}
+	n := copy(p, f.node.data[f.offset:])
+	f.offset += int64(n)
+	return n, nil
+}
+
+func (f *memFile) Write(p []byte) (int, error) {
+	if err := f.check("write", f.write); err != nil {
+		return 0, err
+	}
+
+	f.node.mu.Lock()
+	defer f.node.mu.Unlock()
+
+	if f.append {
+		f.offset = int64(len(f.node.data))
+	}
+	end := f.offset + int64(len(p))
+	if end > int64(len(f.node.data)) {
+		// Grow the file, zero-filling any gap left by a seek past the end
+		grown := make([]byte, end)
+		copy(grown, f.node.data)
+		f.node.data = grown
+	}
+	copy(f.node.data[f.offset:], p)
+	f.node.modTime = time.Now()
+	f.offset = end
+	return len(p), nil
+}
+
+func (f *memFile) Seek(offset int64, whence int) (int64, error) {
+	if err := f.check("seek", true); err != nil {
+		return 0, err
+	}
+
+	f.node.mu.Lock()
+	defer f.node.mu.Unlock()
+
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += f.offset
+	case io.SeekEnd:
+		offset += int64(len(f.node.data))
+	default:
+		return 0, &fs.PathError{Op: "seek", Path: f.name, Err: fs.ErrInvalid}
+	}
+	if offset < 0 {
+		return 0, &fs.PathError{Op: "seek", Path: f.name, Err: errors.New("negative offset")}
+	}
+	f.offset = offset
+	return offset, nil
+}
+
+func (f *memFile) Truncate(size int64) error {
+	if err := f.check("truncate", f.write); err != nil {
+		return err
+	}
+	if size < 0 {
+		return &fs.PathError{Op: "truncate", Path: f.name, Err: fs.ErrInvalid}
+	}
+
+	f.node.mu.Lock()
+	defer f.node.mu.Unlock()
+
+	if size <= int64(len(f.node.data)) {
+		f.node.data = f.node.data[:size]
+	} else {
+		grown := make([]byte, size)
+		copy(grown, f.node.data)
+		f.node.data = grown
+	}
+	f.node.modTime = time.Now()
+	return nil
+}
+
+func (f *memFile) Sync() error {
+	return f.check("sync", true)
+}
+
+func (f *memFile) Close() error {
+	if err := f.check("close", true); err != nil {
+		return err
+	}
+	f.closed = true
+	return nil
+}
+
+// memFileInfo describes a file of a MemFS
+type memFileInfo struct {
+	name    string
+	size    int64
+	mode    fs.FileMode
+	modTime time.Time
+}
+
+func (i memFileInfo) Name() string       { return i.name }
+func (i memFileInfo) Size() int64        { return i.size }
+func (i memFileInfo) Mode() fs.FileMode  { return i.mode }
+func (i memFileInfo) ModTime() time.Time { return i.modTime }
+func (i memFileInfo) IsDir() bool        { return false }
+func (i memFileInfo) Sys() interface{}   { return nil }
@@ -1,33 +1,34 @@
 package helpers
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
+	"math/big"
 	"reflect"
 )
 
 // CompareJSONWithMap compares map and string as json
 func CompareJSONWithMap(jsonStr string, m map[string]interface{}) (bool, error) {
 	// Unmarshal the JSON string into a map
-	var jsonMap map[string]interface{}
-	err := json.Unmarshal([]byte(jsonStr), &jsonMap)
+	jsonMap, err := decodeExact([]byte(jsonStr))
 	if err != nil {
 		return false, fmt.Errorf("error unmarshalling JSON string: %v", err)
 	}
 
-	// Marshal both maps into JSON to normalize them
-	jsonMapBytes, err1 := json.Marshal(jsonMap)
-	if err1 != nil {
-		return false, fmt.Errorf("error marshalling jsonMap to JSON: %v", err1)
+	// Round-trip the map through JSON so both sides hold the same types
+	mBytes, err := json.Marshal(m)
+	if err != nil {
+		return false, fmt.Errorf("error marshalling map to JSON: %v", err)
 	}
 
-	mBytes, err2 := json.Marshal(m)
-	if err2 != nil {
-		return false, fmt.Errorf("error marshalling map to JSON: %v", err2)
+	mMap, err := decodeExact(mBytes)
+	if err != nil {
+		return false, fmt.Errorf("error unmarshalling map JSON: %v", err)
 	}
 
-	// Compare the JSON byte slices
-	areEqual := reflect.DeepEqual(jsonMapBytes, mBytes)
+	// Compare the normalized values
+	areEqual := reflect.DeepEqual(jsonMap, mMap)
 	return areEqual, nil
 }
 
@@ -45,22 +46,19 @@ func CompareMapsAsJSON(map1, map2 map[string]interface{}) (bool, error) {
 		return false, fmt.Errorf("error marshalling map2 to JSON: %v", err2)
 	}
 
-	// Compare the JSON byte slices
-	areEqual := reflect.DeepEqual(json1, json2)
-	return areEqual, nil
+	// Compare the normalized values
+	return CompareJSONStrings(string(json1), string(json2))
 }
 
 func CompareJSONStrings(jsonStr1, jsonStr2 string) (bool, error) {
 	// Unmarshal the first JSON string into a map
-	var map1 map[string]interface{}
-	err1 := json.Unmarshal([]byte(jsonStr1), &map1)
+	map1, err1 := decodeExact([]byte(jsonStr1))
 	if err1 != nil {
 		return false, fmt.Errorf("error unmarshalling jsonStr1: %v", err1)
 	}
 
 	// Unmarshal the second JSON string into a map
-	var map2 map[string]interface{}
-	err2 := json.Unmarshal([]byte(jsonStr2), &map2)
+	map2, err2 := decodeExact([]byte(jsonStr2))
 	if err2 != nil {
 		return false, fmt.Errorf("error unmarshalling jsonStr2: %v", err2)
 	}
@@ -69,3 +67,39 @@ func CompareJSONStrings(jsonStr1, jsonStr2 string) (bool, error) {
 	areEqual := reflect.DeepEqual(map1, map2)
 	return areEqual, nil
 }
+
+// decodeExact unmarshals a JSON object without rounding numbers, so large
+// integers and long decimals are compared digit by digit
+func decodeExact(data []byte) (map[string]interface{}, error) {
+	var m map[string]interface{}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	if err := decoder.Decode(&m); err != nil {
+		return nil, err
+	}
+	return canonicalize(m).(map[string]interface{}), nil
+}
+
+// canonicalize rewrites every number into one spelling per value, so that
+// 30, 30.0 and 3e1 compare equal
+func canonicalize(v interface{}) interface{} {
+	switch value := v.(type) {
+	case map[string]interface{}:
+		for key, item := range value {
+			value[key] = canonicalize(item)
+		}
+		return value
+	case []interface{}:
+		for i, item := range value {
+			value[i] = canonicalize(item)
+		}
+		return value
+	case json.Number:
+		if n, ok := new(big.Rat).SetString(string(value)); ok {
+			return json.Number(n.RatString())
+		}
+		return value
+	default:
+		return v
+	}
+}
@@ -250,6 +250,27 @@ func Test_CompareJSONStrings(t *testing.T) {
 			expected: false,
 			wantErr:  false,
 		},
+		{
+			name:     "Same number spelled differently",
+			jsonStr1: `{"age": 30}`,
+			jsonStr2: `{"age": 3.0e1}`,
+			expected: true,
+			wantErr:  false,
+		},
+		{
+			name:     "Large integers differing beyond float64 precision",
+			jsonStr1: `{"big": 9007199254740993}`,
+			jsonStr2: `{"big": 9007199254740992}`,
+			expected: false,
+			wantErr:  false,
+		},
+		{
+			name:     "High-precision decimals differing in the last digit",
+			jsonStr1: `{"dec": 0.10000000000000000000000001}`,
+			jsonStr2: `{"dec": 0.10000000000000000000000002}`,
+			expected: false,
+			wantErr:  false,
+		},
 	}
 
 	for _, tt := range tests {
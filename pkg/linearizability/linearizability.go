@@ -0,0 +1,145 @@
+// Package linearizability checks recorded histories of concurrent operations
+// against a sequential model
+package linearizability
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Operation is one completed call in a history
+type Operation struct {
+	Key    string      // Operations on different keys are checked independently
+	Call   int64       // Time the call was made
+	Return int64       // Time the response arrived
+	Input  interface{} // What was asked, interpreted by the model
+	Output interface{} // What was answered, interpreted by the model
+	Client int         // Client that made the call, only used in reports
+}
+
+// Model describes the sequential behavior of a single key. States are
+// strings so that visited configurations can be memoized
+type Model struct {
+	Init func() string
+	// Step applies input to state and reports whether output is a valid
+	// result of doing so, along with the resulting state
+	Step func(state string, input, output interface{}) (bool, string)
+	// Describe renders an operation for failure reports, optional
+	Describe func(input, output interface{}) string
+}
+
+// Result reports the outcome of a check
+type Result struct {
+	Ok         bool
+	Key        string      // First key whose history is not linearizable
+	Operations []Operation // That key's history, sorted by call time
+}
+
+func (r Result) String() string {
+	if r.Ok {
+		return "linearizable"
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "history of key %q is not linearizable:", r.Key)
+	for _, op := range r.Operations {
+		fmt.Fprintf(&b, "\n  client %d [%d, %d] %v -> %v", op.Client, op.Call, op.Return, op.Input, op.Output)
+	}
+	return b.String()
+}
+
+// Check partitions the history by key and verifies each partition has a
+// linearization consistent with the model
+func Check(model Model, history []Operation) Result {
+	byKey := make(map[string][]Operation)
+	for _, op := range history {
+		byKey[op.Key] = append(byKey[op.Key], op)
+	}
+
+	keys := make([]string, 0, len(byKey))
+	for key := range byKey {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		ops := byKey[key]
+		sort.SliceStable(ops, func(i, j int) bool { return ops[i].Call < ops[j].Call })
+		if !checkPartition(model, ops) {
+			if model.Describe != nil {
+				described := make([]Operation, len(ops))
+				for i, op := range ops {
+					described[i] = op
+					described[i].Input = model.Describe(op.Input, op.Output)
+					described[i].Output = ""
+				}
+				ops = described
+			}
+			return Result{Key: key, Operations: ops}
+		}
+	}
+
+	return Result{Ok: true}
+}
+
+// checkPartition searches for a valid order of ops. An operation can come
+// next only if it was called before every pending operation returned;
+// configurations already explored are cached by the set of linearized
+// operations and the model state
+func checkPartition(model Model, ops []Operation) bool {
+	done := make([]bool, len(ops))
+	visited := make(map[string]bool)
+
+	var search func(state string, remaining int) bool
+	search = func(state string, remaining int) bool {
+		if remaining == 0 {
+			return true
+		}
+
+		key := configKey(done, state)
+		if visited[key] {
+			return false
+		}
+		visited[key] = true
+
+		// The earliest return among pending operations bounds the candidates
+		minReturn := int64(0)
+		first := true
+		for i, op := range ops {
+			if !done[i] && (first || op.Return < minReturn) {
+				minReturn = op.Return
+				first = false
+			}
+		}
+
+		for i, op := range ops {
+			if done[i] || op.Call > minReturn {
+				continue
+			}
+			ok, next := model.Step(state, op.Input, op.Output)
+			if !ok {
+				continue
+			}
+			done[i] = true
+			if search(next, remaining-1) {
+				return true
+			}
+			done[i] = false
+		}
+		return false
+	}
+
+	return search(model.Init(), len(ops))
+}
+
+// configKey encodes the linearized set and state as a cache key
+func configKey(done []bool, state string) string {
+	bits := make([]byte, (len(done)+7)/8)
+	for i, d := range done {
+		if d {
+			bits[i/8] |= 1 << (i % 8)
+		}
+	}
+	return string(bits) + "|" + state
+}
@@ -0,0 +1,134 @@
+package linearizability
+
+import (
+	"strings"
+	"testing"
+)
+
+func op(call, ret int64, kind, value string, found bool, readValue string) Operation {
+	return Operation{
+		Key:    "1",
+		Call:   call,
+		Return: ret,
+		Input:  RegisterInput{Op: kind, Value: value},
+		Output: RegisterOutput{Found: found, Value: readValue},
+	}
+}
+
+func Test_Check(t *testing.T) {
+	tests := []struct {
+		name     string
+		history  []Operation
+		expected bool
+	}{
+		{
+			name: "Sequential history",
+			history: []Operation{
+				op(0, 1, OpCreate, "a", true, ""),
+				op(2, 3, OpRead, "", true, "a"),
+				op(4, 5, OpUpdate, "b", true, ""),
+				op(6, 7, OpRead, "", true, "b"),
+				op(8, 9, OpDelete, "", true, ""),
+				op(10, 11, OpRead, "", false, ""),
+			},
+			expected: true,
+		},
+		{
+			name: "Read overlapping an update may see either value",
+			history: []Operation{
+				op(0, 1, OpCreate, "a", true, ""),
+				op(2, 6, OpUpdate, "b", true, ""),
+				op(3, 4, OpRead, "", true, "a"),
+				op(3, 5, OpRead, "", true, "b"),
+			},
+			expected: true,
+		},
+		{
+			name: "Read overlapping the create may miss the record",
+			history: []Operation{
+				op(0, 5, OpCreate, "a", true, ""),
+				op(1, 2, OpRead, "", false, ""),
+				op(3, 4, OpRead, "", true, "a"),
+			},
+			expected: true,
+		},
+		{
+			name: "Stale read after the update returned",
+			history: []Operation{
+				op(0, 1, OpCreate, "a", true, ""),
+				op(2, 3, OpUpdate, "b", true, ""),
+				op(4, 5, OpRead, "", true, "a"),
+			},
+			expected: false,
+		},
+		{
+			name: "Record found after delete returned",
+			history: []Operation{
+				op(0, 1, OpCreate, "a", true, ""),
+				op(2, 3, OpDelete, "", true, ""),
+				op(4, 5, OpRead, "", true, "a"),
+			},
+			expected: false,
+		},
+		{
+			name: "Two concurrent deletes cannot both succeed",
+			history: []Operation{
+				op(0, 1, OpCreate, "a", true, ""),
+				op(2, 5, OpDelete, "", true, ""),
+				op(3, 4, OpDelete, "", true, ""),
+			},
+			expected: false,
+		},
+		{
+			name: "Read going back to an older value",
+			history: []Operation{
+				op(0, 1, OpCreate, "a", true, ""),
+				op(2, 10, OpUpdate, "b", true, ""),
+				op(3, 4, OpRead, "", true, "b"),
+				op(5, 6, OpRead, "", true, "a"),
+			},
+			expected: false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result := Check(RegisterModel(), tt.history)
+			if result.Ok != tt.expected {
+				t.Errorf("expected linearizable %v, got %v\n%s", tt.expected, result.Ok, result)
+			}
+		})
+	}
+}
+
+func Test_CheckPartitionsByKey(t *testing.T) {
+	history := []Operation{
+		op(0, 1, OpCreate, "a", true, ""),
+		op(2, 3, OpRead, "", true, "a"),
+	}
+
+	// The same reads against another key that was never created are invalid
+	other := op(2, 3, OpRead, "", true, "a")
+	other.Key = "2"
+	history = append(history, other)
+
+	result := Check(RegisterModel(), history)
+	if result.Ok || result.Key != "2" {
+		t.Fatalf("expected key 2 to fail, got %v", result)
+	}
+	if !strings.Contains(result.String(), `read -> "a"`) {
+		t.Errorf("expected report to describe the failing read, got %s", result)
+	}
+}
+
+func Test_CheckManyConcurrentOperations(t *testing.T) {
+	// Many overlapping reads of one value must stay fast thanks to memoization
+	history := []Operation{op(0, 1, OpCreate, "a", true, "")}
+	for i := int64(0); i < 60; i++ {
+		history = append(history, op(2, 100, OpRead, "", true, "a"))
+	}
+
+	if result := Check(RegisterModel(), history); !result.Ok {
+		t.Fatalf("expected history to be linearizable, got %s", result)
+	}
+}
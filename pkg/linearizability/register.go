@@ -0,0 +1,76 @@
+package linearizability
+
+import "fmt"
+
+// Kinds of operations on a record register
+const (
+	OpCreate = "create"
+	OpRead   = "read"
+	OpUpdate = "update"
+	OpDelete = "delete"
+)
+
+// RegisterInput is the input of an operation on a record register
+type RegisterInput struct {
+	Op    string
+	Value string // Value written by create and update
+}
+
+// RegisterOutput is what the server answered
+type RegisterOutput struct {
+	Found bool   // False when the server reported the record missing
+	Value string // Value returned by read
+}
+
+// RegisterModel models one record as a register that is absent until it is
+// created. Updates and deletes of an absent record must report it missing
+func RegisterModel() Model {
+	const absent = ""
+
+	return Model{
+		Init: func() string { return absent },
+		Step: func(state string, input, output interface{}) (bool, string) {
+			in := input.(RegisterInput)
+			out := output.(RegisterOutput)
+			present := state != absent
+
+			switch in.Op {
+			case OpCreate:
+				// IDs are fresh, so the register cannot exist yet
+				return !present, "=" + in.Value
+			case OpRead:
+				if !present {
+					return !out.Found, state
+				}
+				return out.Found && "="+out.Value == state, state
+			case OpUpdate:
+				if !present {
+					return !out.Found, state
+				}
+				return out.Found, "=" + in.Value
+			case OpDelete:
+				if !present {
+					return !out.Found, state
+				}
+				return out.Found, absent
+			default:
+				return false, state
+			}
+		},
+		Describe: func(input, output interface{}) string {
+			in := input.(RegisterInput)
+			out := output.(RegisterOutput)
+			result := "not found"
+			if out.Found {
+				result = "ok"
+				if in.Op == OpRead {
+					result = fmt.Sprintf("%q", out.Value)
+				}
+			}
+			if in.Op == OpCreate || in.Op == OpUpdate {
+				return fmt.Sprintf("%s(%q) -> %s", in.Op, in.Value, result)
+			}
+			return fmt.Sprintf("%s -> %s", in.Op, result)
+		},
+	}
+}
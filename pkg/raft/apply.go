@@ -0,0 +1,373 @@
+package raft
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+	"zabbixhw/pkg/repository"
+	"zabbixhw/pkg/repository/dberr"
+)
+
+// applyLoop applies committed entries to the engine, in order
+func (n *Node) applyLoop() {
+	defer n.wg.Done()
+
+	for {
+		n.mu.Lock()
+		changed, pending := n.changed, n.lastApplied < n.commitIndex
+		n.mu.Unlock()
+		if !pending {
+			select {
+			case <-changed:
+				continue
+			case <-n.done:
+				return
+			}
+		}
+
+		n.applyMu.Lock()
+		n.mu.Lock()
+		var entries []Entry
+		if n.lastApplied < n.commitIndex {
+			entries = n.entriesFrom(n.lastApplied+1, int(n.commitIndex-n.lastApplied))
+		}
+		n.mu.Unlock()
+
+		for _, entry := range entries {
+			result, ok := n.apply(entry)
+			if !ok {
+				// Closed while the engine was failing
+				n.applyMu.Unlock()
+				return
+			}
+
+			n.mu.Lock()
+			n.lastApplied = entry.Index
+			if entry.Type == EntryChange && entry.Change.Op == repository.OpCreate && result.Code == "" {
+				n.appliedSeq++
+			}
+			if w, ok := n.waiters[entry.Index]; ok {
+				delete(n.waiters, entry.Index)
+				if w.term != entry.Term {
+					// Another leader overwrote the entry of the change
+					result = &Result{Index: entry.Index, Code: codeUnknown, Error: ErrOutcomeUnknown.Error()}
+				}
+				w.result <- result
+			}
+			n.notify()
+			n.mu.Unlock()
+		}
+
+		n.maybeSnapshot()
+		n.applyMu.Unlock()
+	}
+}
+
+// apply applies a committed entry to the engine. The outcome of a change
+// is the same on every node, unless the engine fails to store it: the
+// change is then retried until it succeeds, so that the engines do not
+// diverge. It returns false if the node is closed meanwhile
+func (n *Node) apply(entry Entry) (*Result, bool) {
+	result := &Result{Index: entry.Index}
+	if entry.Type != EntryChange {
+		return result, true
+	}
+
+	change := entry.Change
+	result.ID = change.ID
+	for {
+		var err error
+		ctx := context.Background()
+		switch change.Op {
+		case repository.OpCreate:
+			err = n.engine.ApplyChanges(ctx, []repository.Change{{Op: change.Op, ID: change.ID, Record: copyRecord(change.Record)}})
+		case repository.OpUpdate:
+			err = n.engine.UpdateRecord(ctx, change.ID, copyRecord(change.Record))
+		case repository.OpDelete:
+			err = n.engine.DeleteRecord(ctx, change.ID)
+		default:
+			err = dberr.Validation("unknown change %q", change.Op)
+		}
+		if err == nil || deterministic(err) {
+			if err != nil {
+				result.Code, result.Error = errorCode(err), err.Error()
+			}
+			return result, true
+		}
+
+		log.Printf("raft %s: error applying entry %d, retrying: %v", n.id, entry.Index, err)
+		select {
+		case <-time.After(applyRetry):
+		case <-n.done:
+			return nil, false
+		}
+	}
+}
+
+// deterministic reports whether err is the outcome of a change on every
+// node, rather than a failure of the local engine
+func deterministic(err error) bool {
+	return errors.Is(err, dberr.ErrNotFound) ||
+		errors.Is(err, dberr.ErrConflict) ||
+		errors.Is(err, dberr.ErrValidation) ||
+		errors.Is(err, dberr.ErrInvalidIDType)
+}
+
+// maybeSnapshot replaces the applied entries of the log with a snapshot of
+// the engine once there are enough of them, n.applyMu must be held
+func (n *Node) maybeSnapshot() {
+	n.mu.Lock()
+	if n.lastApplied-n.snap.Index < n.snapshotThreshold {
+		n.mu.Unlock()
+		return
+	}
+	index := n.lastApplied
+	term, _ := n.termAt(index)
+	members := copyMembers(n.configAt(index))
+	n.mu.Unlock()
+
+	// The engine is as of index while n.applyMu is held
+	current, _, err := n.engine.Snapshot(context.Background())
+	if err != nil {
+		log.Printf("raft %s: error taking snapshot: %v", n.id, err)
+		return
+	}
+	data, err := json.Marshal(State{Seq: current.Header.Seq, IDStrategy: current.Header.IDStrategy, Records: nonNil(current.Records)})
+	if err != nil {
+		log.Printf("raft %s: error encoding snapshot: %v", n.id, err)
+		return
+	}
+	snap := &Snapshot{Index: index, Term: term, Members: members, Data: data}
+	if err := n.storage.SaveSnapshot(snap); err != nil {
+		log.Printf("raft %s: error saving snapshot: %v", n.id, err)
+		return
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.log = n.entriesFrom(index+1, len(n.log))
+	n.snap = snap
+	n.persist()
+}
+
+// failWaiters fails the changes waiting for entries up to index, n.mu must
+// be held
+func (n *Node) failWaiters(index uint64) {
+	for i, w := range n.waiters {
+		if i <= index {
+			delete(n.waiters, i)
+			w.result <- &Result{Index: i, Code: codeUnknown, Error: ErrOutcomeUnknown.Error()}
+		}
+	}
+}
+
+// propose appends the change of req to the log of the leader and waits
+// for it to be applied
+func (n *Node) propose(ctx context.Context, req *Request) (*Result, error) {
+	n.mu.Lock()
+	if n.closed || n.role != RoleLeader {
+		leader := n.leader
+		n.mu.Unlock()
+		return nil, notLeader(leader)
+	}
+
+	entry := Entry{Index: n.lastIndex() + 1, Term: n.term}
+	var members map[string]string
+	switch {
+	case req.Change != nil:
+		change, err := n.prepareChange(*req.Change)
+		if err != nil {
+			n.mu.Unlock()
+			return nil, err
+		}
+		entry.Type, entry.Change = EntryChange, &change
+	case req.AddMember != nil || req.RemoveMember != "":
+		var err error
+		if members, err = n.prepareConfig(req); err != nil {
+			n.mu.Unlock()
+			return nil, err
+		}
+		entry.Type, entry.Members = EntryConfig, members
+	default:
+		n.mu.Unlock()
+		return nil, dberr.Validation("empty request")
+	}
+
+	n.log = append(n.log, entry)
+	if err := n.persist(); err != nil {
+		n.log = n.log[:len(n.log)-1]
+		n.mu.Unlock()
+		return nil, err
+	}
+	if members != nil {
+		n.members = members
+		n.syncPeers()
+	}
+	result := make(chan *Result, 1)
+	n.waiters[entry.Index] = waiter{term: entry.Term, result: result}
+	n.triggerPeers()
+	n.advanceCommit()
+	n.mu.Unlock()
+
+	select {
+	case r := <-result:
+		return r, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// prepareChange gives the record of a change its ID, issued by the leader
+// from the sequence the engine will be at when the entry is applied, n.mu
+// must be held
+func (n *Node) prepareChange(change repository.Change) (repository.Change, error) {
+	if change.Record != nil {
+		change.Record = copyRecord(change.Record)
+	}
+	if change.Op != repository.OpCreate {
+		return change, nil
+	}
+
+	seq := n.appliedSeq
+	for _, entry := range n.log {
+		if entry.Index > n.lastApplied && entry.Type == EntryChange && entry.Change.Op == repository.OpCreate {
+			seq++
+		}
+	}
+	newID, err := n.ids.NewID(seq + 1)
+	if err != nil {
+		return change, err
+	}
+	id, ok := repository.FormatID(newID)
+	if !ok {
+		return change, dberr.ErrInvalidIDType
+	}
+	change.ID = id
+	change.Record["id"] = newID
+	return change, nil
+}
+
+// prepareConfig returns the members following the membership change of
+// req. Members are added or removed one at a time, once the leader has
+// committed an entry of its term, n.mu must be held
+func (n *Node) prepareConfig(req *Request) (map[string]string, error) {
+	if term, _ := n.termAt(n.commitIndex); term != n.term {
+		return nil, ErrMembershipChange
+	}
+	for _, entry := range n.log {
+		if entry.Index > n.commitIndex && entry.Type == EntryConfig {
+			return nil, ErrMembershipChange
+		}
+	}
+
+	members := copyMembers(n.members)
+	if add := req.AddMember; add != nil {
+		if add.ID == "" || add.Address == "" {
+			return nil, dberr.Validation("a member needs an ID and an address")
+		}
+		if _, ok := members[add.ID]; ok {
+			return nil, dberr.Conflict("%s is a member already", add.ID)
+		}
+		members[add.ID] = add.Address
+		return members, nil
+	}
+	if _, ok := members[req.RemoveMember]; !ok {
+		return nil, fmt.Errorf("%w: %s is not a member", dberr.ErrNotFound, req.RemoveMember)
+	}
+	if len(members) == 1 {
+		return nil, dberr.Validation("the last member cannot be removed")
+	}
+	delete(members, req.RemoveMember)
+	return members, nil
+}
+
+// HandleForward makes the change a follower forwarded
+func (n *Node) HandleForward(ctx context.Context, req *Request) *Result {
+	result, err := n.propose(ctx, req)
+	if err != nil {
+		return &Result{Code: errorCode(err), Error: err.Error()}
+	}
+	return result
+}
+
+// submit makes the change of req on the leader, forwarding it when the
+// node is a follower, and waits for the node to have applied it
+func (n *Node) submit(ctx context.Context, req *Request) (*Result, error) {
+	role, leader, address := n.waitLeader(ctx)
+
+	var result *Result
+	var err error
+	switch {
+	case role == RoleLeader:
+		result, err = n.propose(ctx, req)
+	case leader == "" || address == "":
+		return nil, notLeader("")
+	default:
+		if result, err = n.transport.Forward(ctx, address, req); err != nil {
+			return nil, notLeader(leader, err)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := resultError(result); err != nil {
+		return nil, err
+	}
+	return result, n.waitApplied(ctx, result.Index)
+}
+
+// waitLeader returns the role of the node, and the leader it follows with
+// its address. While an election is going on, it waits up to two election
+// timeouts for it to be over
+func (n *Node) waitLeader(ctx context.Context) (role, leader, address string) {
+	deadline := time.Now().Add(2 * n.electionTimeout)
+	for {
+		n.mu.Lock()
+		role, leader = n.role, n.leader
+		address = n.members[leader]
+		closed := n.closed
+		n.mu.Unlock()
+		if closed || role == RoleLeader || address != "" || time.Now().After(deadline) {
+			return role, leader, address
+		}
+
+		select {
+		case <-time.After(n.heartbeat):
+		case <-ctx.Done():
+			return role, leader, address
+		}
+	}
+}
+
+// waitApplied waits for the node to have applied the entry at index
+func (n *Node) waitApplied(ctx context.Context, index uint64) error {
+	for {
+		n.mu.Lock()
+		applied, changed := n.lastApplied >= index, n.changed
+		n.mu.Unlock()
+		if applied {
+			return nil
+		}
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// notLeader returns the error for changes the node cannot make, naming the
+// leader if it knows it
+func notLeader(leader string, cause ...error) error {
+	switch {
+	case leader == "":
+		return fmt.Errorf("%w, no leader is elected", dberr.ErrNotLeader)
+	case len(cause) > 0:
+		return fmt.Errorf("%w, the leader %s cannot be reached: %w", dberr.ErrNotLeader, leader, cause[0])
+	default:
+		return fmt.Errorf("%w, the leader is %s", dberr.ErrNotLeader, leader)
+	}
+}
@@ -0,0 +1,99 @@
+package raft
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// TokenHeader carries the shared secret of the members of a cluster
+const TokenHeader = "X-Cluster-Token"
+
+// Paths the members of a cluster serve each other on
+const (
+	VotePath     = "/raft/vote"
+	AppendPath   = "/raft/append"
+	SnapshotPath = "/raft/snapshot"
+	ForwardPath  = "/raft/forward"
+)
+
+// HTTPTransport sends messages as JSON over HTTP. Addresses are the base
+// URLs of the servers of the members
+type HTTPTransport struct {
+	client *http.Client
+	token  string
+}
+
+// NewHTTPTransport sends messages with client, presenting token to the
+// other members
+func NewHTTPTransport(client *http.Client, token string) *HTTPTransport {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return &HTTPTransport{client: client, token: token}
+}
+
+func (t *HTTPTransport) RequestVote(ctx context.Context, address string, req *VoteRequest) (*VoteResponse, error) {
+	var resp VoteResponse
+	return &resp, t.post(ctx, address+VotePath, req, &resp)
+}
+
+func (t *HTTPTransport) AppendEntries(ctx context.Context, address string, req *AppendRequest) (*AppendResponse, error) {
+	var resp AppendResponse
+	return &resp, t.post(ctx, address+AppendPath, req, &resp)
+}
+
+func (t *HTTPTransport) InstallSnapshot(ctx context.Context, address string, req *SnapshotRequest) (*SnapshotResponse, error) {
+	var resp SnapshotResponse
+	return &resp, t.post(ctx, address+SnapshotPath, req, &resp)
+}
+
+func (t *HTTPTransport) Forward(ctx context.Context, address string, req *Request) (*Result, error) {
+	var resp Result
+	return &resp, t.post(ctx, address+ForwardPath, req, &resp)
+}
+
+// post sends v to target and decodes the response into resp. Numbers are
+// kept as json.Number, like the engines read them
+func (t *HTTPTransport) post(ctx context.Context, target string, v, resp interface{}) error {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, target, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if t.token != "" {
+		req.Header.Set(TokenHeader, t.token)
+	}
+	r, err := t.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrUnreachable, err)
+	}
+	defer r.Body.Close()
+
+	if r.StatusCode != http.StatusOK {
+		// Problem details explain the failure best, fall back to the body
+		data, _ := io.ReadAll(io.LimitReader(r.Body, 4096))
+		var problem struct {
+			Code   string `json:"code"`
+			Detail string `json:"detail"`
+		}
+		if json.Unmarshal(data, &problem) == nil && problem.Code != "" {
+			return fmt.Errorf("member answered %s: %s %s", r.Status, problem.Code, problem.Detail)
+		}
+		return fmt.Errorf("member answered %s: %s", r.Status, strings.TrimSpace(string(data)))
+	}
+	decoder := json.NewDecoder(r.Body)
+	decoder.UseNumber()
+	if err := decoder.Decode(resp); err != nil {
+		return fmt.Errorf("error decoding response of the member: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,131 @@
+package raft
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"sync"
+)
+
+// network connects the nodes of a test in memory. Messages go through JSON
+// like over HTTP, and are lost between nodes that are partitioned apart
+type network struct {
+	mu     sync.Mutex
+	nodes  map[string]*Node
+	groups map[string]int
+}
+
+func newNetwork() *network {
+	return &network{nodes: map[string]*Node{}}
+}
+
+// add connects node, reachable at its ID
+func (net *network) add(node *Node) {
+	net.mu.Lock()
+	defer net.mu.Unlock()
+	net.nodes[node.id] = node
+}
+
+// remove disconnects the node id, as if its server stopped
+func (net *network) remove(id string) {
+	net.mu.Lock()
+	defer net.mu.Unlock()
+	delete(net.nodes, id)
+}
+
+// partition splits the nodes into groups that cannot reach each other.
+// Nodes left out form a group of their own
+func (net *network) partition(groups ...[]string) {
+	net.mu.Lock()
+	defer net.mu.Unlock()
+	net.groups = map[string]int{}
+	for i, group := range groups {
+		for _, id := range group {
+			net.groups[id] = i + 1
+		}
+	}
+}
+
+// heal lets every node reach every other one again
+func (net *network) heal() {
+	net.mu.Lock()
+	defer net.mu.Unlock()
+	net.groups = nil
+}
+
+// reach returns the node to if from can reach it, nil otherwise
+func (net *network) reach(from, to string) *Node {
+	net.mu.Lock()
+	defer net.mu.Unlock()
+	if net.groups[from] != net.groups[to] {
+		return nil
+	}
+	return net.nodes[to]
+}
+
+// transport returns the transport of the node from
+func (net *network) transport(from string) Transport {
+	return &netTransport{net: net, from: from}
+}
+
+type netTransport struct {
+	net  *network
+	from string
+}
+
+func (t *netTransport) RequestVote(ctx context.Context, address string, req *VoteRequest) (*VoteResponse, error) {
+	var resp VoteResponse
+	return &resp, t.call(address, req, &resp, func(node *Node, req interface{}) interface{} {
+		return node.HandleVote(req.(*VoteRequest))
+	}, new(VoteRequest))
+}
+
+func (t *netTransport) AppendEntries(ctx context.Context, address string, req *AppendRequest) (*AppendResponse, error) {
+	var resp AppendResponse
+	return &resp, t.call(address, req, &resp, func(node *Node, req interface{}) interface{} {
+		return node.HandleAppend(req.(*AppendRequest))
+	}, new(AppendRequest))
+}
+
+func (t *netTransport) InstallSnapshot(ctx context.Context, address string, req *SnapshotRequest) (*SnapshotResponse, error) {
+	var resp SnapshotResponse
+	return &resp, t.call(address, req, &resp, func(node *Node, req interface{}) interface{} {
+		return node.HandleSnapshot(req.(*SnapshotRequest))
+	}, new(SnapshotRequest))
+}
+
+func (t *netTransport) Forward(ctx context.Context, address string, req *Request) (*Result, error) {
+	var resp Result
+	return &resp, t.call(address, req, &resp, func(node *Node, req interface{}) interface{} {
+		return node.HandleForward(ctx, req.(*Request))
+	}, new(Request))
+}
+
+// call delivers a copy of req to the node at address through handle, and
+// decodes its response into resp. The response is lost if the network is
+// partitioned meanwhile
+func (t *netTransport) call(address string, req, resp interface{}, handle func(*Node, interface{}) interface{}, received interface{}) error {
+	node := t.net.reach(t.from, address)
+	if node == nil {
+		return ErrUnreachable
+	}
+	if err := roundTrip(req, received); err != nil {
+		return err
+	}
+	answer := handle(node, received)
+	if t.net.reach(t.from, address) == nil {
+		return ErrUnreachable
+	}
+	return roundTrip(answer, resp)
+}
+
+// roundTrip copies v into dst through JSON
+func roundTrip(v, dst interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	return decoder.Decode(dst)
+}
@@ -0,0 +1,840 @@
+// Package raft runs the engines of several servers as one database. Changes
+// are agreed on through the Raft consensus algorithm: a leader elected by
+// a majority of the nodes appends them to a replicated log, and every node
+// applies the log to its engine once a majority has stored it
+package raft
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+	"zabbixhw/pkg/replication"
+	"zabbixhw/pkg/repository"
+	"zabbixhw/pkg/repository/idgen"
+)
+
+// Defaults of the options
+const (
+	DefaultElectionTimeout   = time.Second
+	DefaultHeartbeat         = 100 * time.Millisecond
+	DefaultSnapshotThreshold = 1000
+	maxEntries               = 500 // Entries sent in one AppendRequest
+	applyRetry               = 100 * time.Millisecond
+)
+
+// Transport carries the messages of a node to the node at an address
+type Transport interface {
+	RequestVote(ctx context.Context, address string, req *VoteRequest) (*VoteResponse, error)
+	AppendEntries(ctx context.Context, address string, req *AppendRequest) (*AppendResponse, error)
+	InstallSnapshot(ctx context.Context, address string, req *SnapshotRequest) (*SnapshotResponse, error)
+	Forward(ctx context.Context, address string, req *Request) (*Result, error)
+}
+
+// Option configures a Node
+type Option func(*Node)
+
+// WithStorage sets where the node keeps its log, MemoryStorage by default
+func WithStorage(storage Storage) Option {
+	return func(n *Node) {
+		n.storage = storage
+	}
+}
+
+// WithBootstrap makes the node start a new cluster of members, with the
+// content of its engine as the initial state. It is ignored by nodes that
+// have state already. Other nodes of a new cluster start empty and get the
+// state from the leader
+func WithBootstrap(members map[string]string) Option {
+	return func(n *Node) {
+		n.bootstrap = members
+	}
+}
+
+// WithElectionTimeout sets how long a follower waits for the leader before
+// it stands for election. The actual wait is random, up to twice as long
+func WithElectionTimeout(timeout time.Duration) Option {
+	return func(n *Node) {
+		n.electionTimeout = timeout
+	}
+}
+
+// WithHeartbeat sets how often the leader contacts idle followers
+func WithHeartbeat(interval time.Duration) Option {
+	return func(n *Node) {
+		n.heartbeat = interval
+	}
+}
+
+// WithSnapshotThreshold sets how many applied entries are kept in the log
+// before they are replaced with a snapshot of the engine
+func WithSnapshotThreshold(entries uint64) Option {
+	return func(n *Node) {
+		if entries > 0 {
+			n.snapshotThreshold = entries
+		}
+	}
+}
+
+// WithIDStrategy sets the strategy the leader issues record IDs with. It
+// must be the strategy of the engine
+func WithIDStrategy(ids idgen.Strategy) Option {
+	return func(n *Node) {
+		n.ids = ids
+	}
+}
+
+// Node is a member of a cluster, and the repository of its server. Changes
+// sent to a follower are forwarded to the leader and return once the
+// follower applied them too. Reads are served by the local engine, so a
+// follower may not have the changes committed through other nodes yet
+type Node struct {
+	id                string
+	engine            replication.Replica
+	transport         Transport
+	storage           Storage
+	ids               idgen.Strategy
+	bootstrap         map[string]string
+	electionTimeout   time.Duration
+	heartbeat         time.Duration
+	snapshotThreshold uint64
+
+	applyMu sync.Mutex // Orders changes to the engine, taken before mu
+
+	mu                sync.Mutex
+	role              string
+	term              uint64
+	votedFor          string
+	leader            string
+	log               []Entry   // Entries following the snapshot
+	snap              *Snapshot // Never nil, index 0 before the first one
+	commitIndex       uint64
+	lastApplied       uint64
+	appliedSeq        uint64            // Sequence of the engine as of lastApplied
+	members           map[string]string // Latest configuration in the log
+	electionDeadline  time.Time
+	lastLeaderContact time.Time
+	peers             map[string]*peer // Leader only
+	waiters           map[uint64]waiter
+	changed           chan struct{} // Closed when commitIndex or lastApplied move
+	closed            bool
+
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+// peer is the replication state of a follower, kept by the leader
+type peer struct {
+	id         string
+	address    string
+	nextIndex  uint64
+	matchIndex uint64
+	lastAck    time.Time
+	trigger    chan struct{}
+	stop       chan struct{}
+}
+
+// waiter is a change the leader appended, waiting to be applied
+type waiter struct {
+	term   uint64
+	result chan *Result
+}
+
+// NewNode starts the node id of a cluster, restoring its engine from the
+// state in its storage
+func NewNode(id string, engine replication.Replica, transport Transport, opts ...Option) (*Node, error) {
+	n := &Node{
+		id:                id,
+		engine:            engine,
+		transport:         transport,
+		storage:           &MemoryStorage{},
+		ids:               idgen.Default(),
+		electionTimeout:   DefaultElectionTimeout,
+		heartbeat:         DefaultHeartbeat,
+		snapshotThreshold: DefaultSnapshotThreshold,
+		role:              RoleFollower,
+		waiters:           map[uint64]waiter{},
+		changed:           make(chan struct{}),
+		done:              make(chan struct{}),
+	}
+	for _, opt := range opts {
+		opt(n)
+	}
+
+	if err := n.restore(); err != nil {
+		return nil, err
+	}
+	n.resetElectionDeadline()
+
+	n.wg.Add(2)
+	go n.run()
+	go n.applyLoop()
+	return n, nil
+}
+
+// restore loads the state of the node and puts the engine in the state of
+// its snapshot. Entries following it are applied again once the node knows
+// they are committed
+func (n *Node) restore() error {
+	current, _, err := n.engine.Snapshot(context.Background())
+	if err != nil {
+		return err
+	}
+	if current.Header.IDStrategy != n.ids.Name() {
+		return fmt.Errorf("the database issues %s IDs, the cluster %s", current.Header.IDStrategy, n.ids.Name())
+	}
+
+	hard, entries, snap, err := n.storage.Load()
+	if err != nil {
+		return fmt.Errorf("error loading the cluster state: %w", err)
+	}
+	fresh := snap == nil && len(entries) == 0 && hard.Term == 0
+
+	switch {
+	case fresh && n.bootstrap != nil:
+		// The initial state is a snapshot at index 1, so that nodes joining
+		// with an empty log are sent it
+		data, err := json.Marshal(State{Seq: current.Header.Seq, IDStrategy: current.Header.IDStrategy, Records: nonNil(current.Records)})
+		if err != nil {
+			return err
+		}
+		snap = &Snapshot{Index: 1, Term: 1, Members: copyMembers(n.bootstrap), Data: data}
+		hard = HardState{Term: 1}
+		if err := n.storage.SaveSnapshot(snap); err != nil {
+			return err
+		}
+		if err := n.storage.Save(hard, nil); err != nil {
+			return err
+		}
+		n.appliedSeq = current.Header.Seq
+	case fresh && len(current.Records) > 0:
+		return errors.New("the database has records but the node has no cluster state, bootstrap the cluster from it or start from an empty file")
+	case snap == nil:
+		if err := n.engine.Replace(context.Background(), nil, 0); err != nil {
+			return err
+		}
+	default:
+		state, err := decodeState(snap.Data)
+		if err != nil {
+			return err
+		}
+		if err := n.engine.Replace(context.Background(), state.Records, state.Seq); err != nil {
+			return err
+		}
+		n.appliedSeq = state.Seq
+	}
+
+	if snap == nil {
+		snap = &Snapshot{Members: map[string]string{}}
+	}
+	n.term, n.votedFor = hard.Term, hard.VotedFor
+	n.log = entries
+	n.snap = snap
+	n.commitIndex, n.lastApplied = snap.Index, snap.Index
+	n.members = n.configAt(n.lastIndex())
+	return nil
+}
+
+// decodeState decodes the engine state of a snapshot
+func decodeState(data []byte) (*State, error) {
+	var state State
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	if err := decoder.Decode(&state); err != nil {
+		return nil, fmt.Errorf("error decoding snapshot: %w", err)
+	}
+	return &state, nil
+}
+
+// nonNil returns records, or an empty slice if it is nil
+func nonNil(records []map[string]interface{}) []map[string]interface{} {
+	if records == nil {
+		return []map[string]interface{}{}
+	}
+	return records
+}
+
+// Close stops the node. Changes waiting to be committed fail with
+// ErrOutcomeUnknown. The engine is left open
+func (n *Node) Close() error {
+	n.mu.Lock()
+	if n.closed {
+		n.mu.Unlock()
+		return nil
+	}
+	n.closed = true
+	n.stopPeers()
+	n.failWaiters(^uint64(0))
+	n.notify()
+	n.mu.Unlock()
+
+	close(n.done)
+	n.wg.Wait()
+	return nil
+}
+
+// lastIndex returns the index of the last entry of the log, n.mu must be
+// held
+func (n *Node) lastIndex() uint64 {
+	return n.snap.Index + uint64(len(n.log))
+}
+
+// lastTerm returns the term of the last entry of the log, n.mu must be held
+func (n *Node) lastTerm() uint64 {
+	if len(n.log) == 0 {
+		return n.snap.Term
+	}
+	return n.log[len(n.log)-1].Term
+}
+
+// termAt returns the term of the entry at index, false if the log does not
+// have it, n.mu must be held
+func (n *Node) termAt(index uint64) (uint64, bool) {
+	switch {
+	case index == n.snap.Index:
+		return n.snap.Term, true
+	case index < n.snap.Index || index > n.lastIndex():
+		return 0, false
+	default:
+		return n.log[index-n.snap.Index-1].Term, true
+	}
+}
+
+// entriesFrom returns a copy of up to max entries starting at index, n.mu
+// must be held
+func (n *Node) entriesFrom(index uint64, max int) []Entry {
+	start := index - n.snap.Index - 1
+	end := min(uint64(len(n.log)), start+uint64(max))
+	return append([]Entry(nil), n.log[start:end]...)
+}
+
+// configAt returns the members as of index, n.mu must be held
+func (n *Node) configAt(index uint64) map[string]string {
+	for i := len(n.log) - 1; i >= 0; i-- {
+		if n.log[i].Index <= index && n.log[i].Type == EntryConfig {
+			return n.log[i].Members
+		}
+	}
+	return n.snap.Members
+}
+
+// quorum returns how many members make a majority
+func quorum(members map[string]string) int {
+	return len(members)/2 + 1
+}
+
+// persist saves the hard state and the log, n.mu must be held
+func (n *Node) persist() error {
+	err := n.storage.Save(HardState{Term: n.term, VotedFor: n.votedFor}, n.log)
+	if err != nil {
+		log.Printf("raft %s: error saving state: %v", n.id, err)
+	}
+	return err
+}
+
+// notify wakes everything waiting for commitIndex or lastApplied to move,
+// n.mu must be held
+func (n *Node) notify() {
+	close(n.changed)
+	n.changed = make(chan struct{})
+}
+
+// resetElectionDeadline puts off the next election by a random time
+// between one and two election timeouts, n.mu must be held
+func (n *Node) resetElectionDeadline() {
+	n.electionDeadline = time.Now().Add(n.electionTimeout + time.Duration(rand.Int63n(int64(n.electionTimeout))))
+}
+
+// run starts elections when the leader goes silent, and makes a leader
+// that lost touch with the majority step down
+func (n *Node) run() {
+	defer n.wg.Done()
+	ticker := time.NewTicker(min(n.heartbeat, n.electionTimeout/10))
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-n.done:
+			return
+		}
+
+		n.mu.Lock()
+		now := time.Now()
+		switch {
+		case n.role == RoleLeader:
+			if !n.hasQuorum(now) {
+				log.Printf("raft %s: lost touch with the majority in term %d, stepping down", n.id, n.term)
+				n.becomeFollower(n.term, "")
+			}
+		case now.After(n.electionDeadline):
+			if _, ok := n.members[n.id]; ok {
+				n.campaign()
+			}
+		}
+		n.mu.Unlock()
+	}
+}
+
+// hasQuorum reports whether a majority of the members acknowledged the
+// leader within an election timeout, n.mu must be held
+func (n *Node) hasQuorum(now time.Time) bool {
+	count := 0
+	for id := range n.members {
+		if id == n.id {
+			count++
+		} else if p, ok := n.peers[id]; ok && now.Sub(p.lastAck) < n.electionTimeout {
+			count++
+		}
+	}
+	return count >= quorum(n.members)
+}
+
+// campaign stands for election in a new term, n.mu must be held
+func (n *Node) campaign() {
+	n.term++
+	n.role = RoleCandidate
+	n.votedFor = n.id
+	n.leader = ""
+	n.resetElectionDeadline()
+	if n.persist() != nil {
+		return
+	}
+
+	term := n.term
+	votes := 1
+	if votes >= quorum(n.members) {
+		n.becomeLeader()
+		return
+	}
+	req := &VoteRequest{Term: term, Candidate: n.id, LastLogIndex: n.lastIndex(), LastLogTerm: n.lastTerm()}
+	for id, address := range n.members {
+		if id == n.id {
+			continue
+		}
+		go func(address string) {
+			ctx, cancel := context.WithTimeout(context.Background(), n.electionTimeout)
+			defer cancel()
+			resp, err := n.transport.RequestVote(ctx, address, req)
+			if err != nil {
+				return
+			}
+
+			n.mu.Lock()
+			defer n.mu.Unlock()
+			if resp.Term > n.term {
+				n.becomeFollower(resp.Term, "")
+				return
+			}
+			if n.role != RoleCandidate || n.term != term || !resp.Granted {
+				return
+			}
+			votes++
+			if votes == quorum(n.members) {
+				n.becomeLeader()
+			}
+		}(address)
+	}
+}
+
+// becomeFollower follows the leader of term, empty if it is not known yet,
+// n.mu must be held
+func (n *Node) becomeFollower(term uint64, leader string) {
+	if term > n.term {
+		n.term = term
+		n.votedFor = ""
+		n.persist()
+	}
+	if n.role == RoleLeader {
+		n.stopPeers()
+	}
+	n.role = RoleFollower
+	n.leader = leader
+}
+
+// becomeLeader takes the lead and appends an entry of its term, which
+// commits the entries of previous terms once it is, n.mu must be held
+func (n *Node) becomeLeader() {
+	n.role = RoleLeader
+	n.leader = n.id
+	n.peers = map[string]*peer{}
+	log.Printf("raft %s: leader of term %d", n.id, n.term)
+
+	n.log = append(n.log, Entry{Index: n.lastIndex() + 1, Term: n.term, Type: EntryNoop})
+	if n.persist() != nil {
+		n.log = n.log[:len(n.log)-1]
+		n.becomeFollower(n.term, "")
+		return
+	}
+	n.syncPeers()
+	n.advanceCommit()
+}
+
+// syncPeers replicates to the members of the latest configuration, and
+// stops replicating to former members, n.mu must be held
+func (n *Node) syncPeers() {
+	for id, address := range n.members {
+		if _, ok := n.peers[id]; ok || id == n.id {
+			continue
+		}
+		p := &peer{
+			id:        id,
+			address:   address,
+			nextIndex: n.lastIndex() + 1,
+			lastAck:   time.Now(),
+			trigger:   make(chan struct{}, 1),
+			stop:      make(chan struct{}),
+		}
+		n.peers[id] = p
+		n.wg.Add(1)
+		go n.replicate(p)
+	}
+	for id, p := range n.peers {
+		if _, ok := n.members[id]; !ok {
+			close(p.stop)
+			delete(n.peers, id)
+		}
+	}
+}
+
+// stopPeers stops replicating, n.mu must be held
+func (n *Node) stopPeers() {
+	for _, p := range n.peers {
+		close(p.stop)
+	}
+	n.peers = nil
+}
+
+// triggerPeers has the new entries sent to every follower at once, n.mu
+// must be held
+func (n *Node) triggerPeers() {
+	for _, p := range n.peers {
+		select {
+		case p.trigger <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// replicate keeps a follower up to date with the log, sending heartbeats
+// while there is nothing new
+func (n *Node) replicate(p *peer) {
+	defer n.wg.Done()
+	ticker := time.NewTicker(n.heartbeat)
+	defer ticker.Stop()
+
+	for {
+		for n.sendTo(p) {
+		}
+		select {
+		case <-p.trigger:
+		case <-ticker.C:
+		case <-p.stop:
+			return
+		}
+	}
+}
+
+// sendTo sends a follower the entries it lacks, or a snapshot when the log
+// no longer has them. It returns true when there is more to send right away
+func (n *Node) sendTo(p *peer) bool {
+	n.mu.Lock()
+	select {
+	case <-p.stop:
+		n.mu.Unlock()
+		return false
+	default:
+	}
+	term := n.term
+
+	if p.nextIndex <= n.snap.Index {
+		req := &SnapshotRequest{Term: term, Leader: n.id, Snapshot: *n.snap}
+		n.mu.Unlock()
+
+		ctx, cancel := context.WithTimeout(context.Background(), n.electionTimeout)
+		defer cancel()
+		resp, err := n.transport.InstallSnapshot(ctx, p.address, req)
+		if err != nil {
+			return false
+		}
+
+		n.mu.Lock()
+		defer n.mu.Unlock()
+		if !n.acknowledged(p, term, resp.Term) {
+			return false
+		}
+		p.matchIndex = max(p.matchIndex, req.Snapshot.Index)
+		p.nextIndex = p.matchIndex + 1
+		n.advanceCommit()
+		return p.nextIndex <= n.lastIndex()
+	}
+
+	prev := p.nextIndex - 1
+	prevTerm, _ := n.termAt(prev)
+	req := &AppendRequest{
+		Term:         term,
+		Leader:       n.id,
+		PrevLogIndex: prev,
+		PrevLogTerm:  prevTerm,
+		Entries:      n.entriesFrom(p.nextIndex, maxEntries),
+		LeaderCommit: n.commitIndex,
+	}
+	n.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), n.electionTimeout)
+	defer cancel()
+	resp, err := n.transport.AppendEntries(ctx, p.address, req)
+	if err != nil {
+		return false
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if !n.acknowledged(p, term, resp.Term) {
+		return false
+	}
+	if !resp.Success {
+		p.nextIndex = max(1, min(p.nextIndex-1, resp.LastLogIndex+1))
+		return true
+	}
+	p.matchIndex = max(p.matchIndex, prev+uint64(len(req.Entries)))
+	p.nextIndex = p.matchIndex + 1
+	n.advanceCommit()
+	return p.nextIndex <= n.lastIndex()
+}
+
+// acknowledged handles the term of a follower's response to a request sent
+// in term, and reports whether the node is still the leader of that term,
+// n.mu must be held
+func (n *Node) acknowledged(p *peer, term, respTerm uint64) bool {
+	if respTerm > n.term {
+		n.becomeFollower(respTerm, "")
+		return false
+	}
+	if n.role != RoleLeader || n.term != term {
+		return false
+	}
+	p.lastAck = time.Now()
+	return true
+}
+
+// advanceCommit commits the entries of the current term stored by a
+// majority, and those before them, n.mu must be held
+func (n *Node) advanceCommit() {
+	for index := n.lastIndex(); index > n.commitIndex; index-- {
+		if term, _ := n.termAt(index); term != n.term {
+			// Entries of earlier terms are only committed along with one of
+			// the current term
+			return
+		}
+		count := 0
+		for id := range n.members {
+			if id == n.id {
+				count++
+			} else if p, ok := n.peers[id]; ok && p.matchIndex >= index {
+				count++
+			}
+		}
+		if count < quorum(n.members) {
+			continue
+		}
+
+		n.commitIndex = index
+		n.notify()
+		if _, ok := n.configAt(index)[n.id]; !ok {
+			log.Printf("raft %s: removed from the cluster, stepping down", n.id)
+			n.becomeFollower(n.term, "")
+		}
+		return
+	}
+}
+
+// HandleVote answers a candidate asking for the node's vote
+func (n *Node) HandleVote(req *VoteRequest) *VoteResponse {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	// While the leader is heard from, candidates are ignored: they are
+	// nodes cut off from it, or removed from the cluster
+	if req.Term > n.term && (n.role == RoleLeader || (n.leader != "" && time.Since(n.lastLeaderContact) < n.electionTimeout)) {
+		return &VoteResponse{Term: n.term}
+	}
+	if req.Term > n.term {
+		n.becomeFollower(req.Term, "")
+	}
+
+	resp := &VoteResponse{Term: n.term}
+	if req.Term < n.term || (n.votedFor != "" && n.votedFor != req.Candidate) {
+		return resp
+	}
+	// Only candidates with a log at least as complete as the node's
+	if req.LastLogTerm < n.lastTerm() || (req.LastLogTerm == n.lastTerm() && req.LastLogIndex < n.lastIndex()) {
+		return resp
+	}
+	n.votedFor = req.Candidate
+	if n.persist() != nil {
+		n.votedFor = ""
+		return resp
+	}
+	n.resetElectionDeadline()
+	resp.Granted = true
+	return resp
+}
+
+// HandleAppend stores the entries sent by the leader
+func (n *Node) HandleAppend(req *AppendRequest) *AppendResponse {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if req.Term < n.term {
+		return &AppendResponse{Term: n.term, LastLogIndex: n.lastIndex()}
+	}
+	n.heardFrom(req.Term, req.Leader)
+	resp := &AppendResponse{Term: n.term}
+
+	prev, entries := req.PrevLogIndex, req.Entries
+	switch term, ok := n.termAt(prev); {
+	case prev < n.snap.Index:
+		// The snapshot holds committed entries, skip them
+		skip := min(n.snap.Index-prev, uint64(len(entries)))
+		prev, entries = prev+skip, entries[skip:]
+		if prev < n.snap.Index {
+			resp.Success, resp.LastLogIndex = true, n.lastIndex()
+			return resp
+		}
+	case !ok:
+		resp.LastLogIndex = n.lastIndex()
+		return resp
+	case term != req.PrevLogTerm:
+		resp.LastLogIndex = prev - 1
+		return resp
+	}
+
+	for i, entry := range entries {
+		if term, ok := n.termAt(entry.Index); ok {
+			if term == entry.Term {
+				continue
+			}
+			// The log diverges from the leader's from here on
+			n.log = n.log[:entry.Index-n.snap.Index-1]
+		}
+		n.log = append(n.log, entries[i:]...)
+		n.members = n.configAt(n.lastIndex())
+		if n.persist() != nil {
+			resp.LastLogIndex = prev
+			return resp
+		}
+		break
+	}
+
+	if last := prev + uint64(len(entries)); req.LeaderCommit > n.commitIndex && last > n.commitIndex {
+		n.commitIndex = min(req.LeaderCommit, last)
+		n.notify()
+	}
+	resp.Success, resp.LastLogIndex = true, n.lastIndex()
+	return resp
+}
+
+// heardFrom follows the leader of a request at least as recent as the
+// node's term, n.mu must be held
+func (n *Node) heardFrom(term uint64, leader string) {
+	if term > n.term || n.role != RoleFollower || n.leader != leader {
+		n.becomeFollower(term, leader)
+	}
+	n.lastLeaderContact = time.Now()
+	n.resetElectionDeadline()
+}
+
+// HandleSnapshot replaces the state of a follower too far behind the
+// leader's log with a snapshot
+func (n *Node) HandleSnapshot(req *SnapshotRequest) *SnapshotResponse {
+	n.mu.Lock()
+	if req.Term < n.term {
+		defer n.mu.Unlock()
+		return &SnapshotResponse{Term: n.term}
+	}
+	n.heardFrom(req.Term, req.Leader)
+	resp := &SnapshotResponse{Term: n.term}
+	n.mu.Unlock()
+
+	// The engine is replaced in between applied entries
+	n.applyMu.Lock()
+	defer n.applyMu.Unlock()
+	snap := req.Snapshot
+	n.mu.Lock()
+	stale := snap.Index <= n.lastApplied
+	n.mu.Unlock()
+	if stale {
+		return resp
+	}
+
+	state, err := decodeState(snap.Data)
+	if err == nil {
+		err = n.engine.Replace(context.Background(), state.Records, state.Seq)
+	}
+	if err == nil {
+		err = n.storage.SaveSnapshot(&snap)
+	}
+	if err != nil {
+		log.Printf("raft %s: error installing snapshot %d: %v", n.id, snap.Index, err)
+		return resp
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if term, ok := n.termAt(snap.Index); ok && term == snap.Term {
+		n.log = n.entriesFrom(snap.Index+1, len(n.log))
+	} else {
+		n.log = nil
+	}
+	n.snap = &snap
+	n.persist()
+	n.commitIndex = max(n.commitIndex, snap.Index)
+	n.lastApplied = snap.Index
+	n.appliedSeq = state.Seq
+	n.members = n.configAt(n.lastIndex())
+	n.failWaiters(snap.Index)
+	n.notify()
+	log.Printf("raft %s: installed snapshot of %d records at %d", n.id, len(state.Records), snap.Index)
+	return resp
+}
+
+// Status reports the role of the node, its log and the members it knows
+func (n *Node) Status() Status {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	status := Status{
+		ID:            n.id,
+		Role:          n.role,
+		Term:          n.term,
+		Leader:        n.leader,
+		LastLogIndex:  n.lastIndex(),
+		CommitIndex:   n.commitIndex,
+		LastApplied:   n.lastApplied,
+		SnapshotIndex: n.snap.Index,
+		Members:       []MemberStatus{},
+	}
+	for id, address := range n.members {
+		member := MemberStatus{Member: Member{ID: id, Address: address}}
+		if p, ok := n.peers[id]; ok {
+			member.MatchIndex = p.matchIndex
+		} else if id == n.id && n.role == RoleLeader {
+			member.MatchIndex = n.lastIndex()
+		}
+		status.Members = append(status.Members, member)
+	}
+	sort.Slice(status.Members, func(i, j int) bool { return status.Members[i].ID < status.Members[j].ID })
+	return status
+}
+
+// Unwrap returns the engine of the node
+func (n *Node) Unwrap() repository.DatabaseRepoV2 {
+	return n.engine
+}
@@ -0,0 +1,584 @@
+package raft
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+	"zabbixhw/pkg/repository"
+	"zabbixhw/pkg/repository/dberr"
+	"zabbixhw/pkg/repository/dbfile"
+	"zabbixhw/pkg/repository/filedb"
+	"zabbixhw/pkg/repository/repotest"
+)
+
+// cluster runs nodes of a test on the same network, each with its own
+// database file and state directory
+type cluster struct {
+	t       *testing.T
+	net     *network
+	dir     string
+	members map[string]string
+	nodes   map[string]*Node
+	dbs     map[string]*filedb.FileDB
+	opts    []Option
+}
+
+// newCluster starts a cluster of the nodes ids, bootstrapped by the first
+// one
+func newCluster(t *testing.T, ids []string, opts ...Option) *cluster {
+	t.Helper()
+
+	c := &cluster{
+		t:       t,
+		net:     newNetwork(),
+		dir:     t.TempDir(),
+		members: map[string]string{},
+		nodes:   map[string]*Node{},
+		dbs:     map[string]*filedb.FileDB{},
+		opts:    opts,
+	}
+	for _, id := range ids {
+		c.members[id] = id
+	}
+	for i, id := range ids {
+		if i == 0 {
+			c.start(id, WithBootstrap(c.members))
+		} else {
+			c.start(id)
+		}
+	}
+	t.Cleanup(func() {
+		for id := range c.nodes {
+			c.stop(id)
+		}
+	})
+	return c
+}
+
+// start starts the node id, with the state it had when it was stopped
+func (c *cluster) start(id string, opts ...Option) *Node {
+	c.t.Helper()
+
+	dir := filepath.Join(c.dir, id)
+	storage, err := NewFileStorage(filepath.Join(dir, "raft"))
+	if err != nil {
+		c.t.Fatalf("NewFileStorage failed: %v", err)
+	}
+	db, err := filedb.Open(filepath.Join(dir, "db.json"))
+	if err != nil {
+		c.t.Fatalf("Open failed: %v", err)
+	}
+	opts = append([]Option{WithStorage(storage), WithElectionTimeout(100 * time.Millisecond), WithHeartbeat(10 * time.Millisecond)}, append(c.opts, opts...)...)
+	node, err := NewNode(id, db, c.net.transport(id), opts...)
+	if err != nil {
+		db.Close()
+		c.t.Fatalf("NewNode failed: %v", err)
+	}
+	c.nodes[id], c.dbs[id] = node, db
+	c.net.add(node)
+	return node
+}
+
+// stop stops the node id, as if its server went down
+func (c *cluster) stop(id string) {
+	c.net.remove(id)
+	c.nodes[id].Close()
+	c.dbs[id].Close()
+	delete(c.nodes, id)
+	delete(c.dbs, id)
+}
+
+// leader waits for one of the nodes ids, every running node if there are
+// none, to lead the cluster
+func (c *cluster) leader(ids ...string) *Node {
+	c.t.Helper()
+
+	if len(ids) == 0 {
+		for id := range c.nodes {
+			ids = append(ids, id)
+		}
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		for _, id := range ids {
+			if status := c.nodes[id].Status(); status.Role == RoleLeader && status.CommitIndex == status.LastLogIndex {
+				return c.nodes[id]
+			}
+		}
+		if time.Now().After(deadline) {
+			c.t.Fatalf("no leader elected among %v", ids)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// follower returns a running node other than leader
+func (c *cluster) follower(leader *Node) *Node {
+	var ids []string
+	for id := range c.nodes {
+		if id != leader.id {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+	return c.nodes[ids[0]]
+}
+
+// waitApplied waits for every running node to have applied the log of
+// leader
+func (c *cluster) waitApplied(leader *Node) {
+	c.t.Helper()
+
+	index := leader.Status().CommitIndex
+	deadline := time.Now().Add(5 * time.Second)
+	for _, node := range c.nodes {
+		for node.Status().LastApplied < index {
+			if time.Now().After(deadline) {
+				c.t.Fatalf("%s did not apply the log up to %d: %+v", node.id, index, node.Status())
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+}
+
+// expectRecords checks that every running node has the records named
+// names, in order
+func (c *cluster) expectRecords(names ...string) {
+	c.t.Helper()
+
+	for id, db := range c.dbs {
+		snap, _, err := db.Snapshot(context.Background())
+		if err != nil {
+			c.t.Fatalf("Snapshot failed: %v", err)
+		}
+		got := []string{}
+		for _, record := range snap.Records {
+			got = append(got, record["name"].(string))
+		}
+		if !reflect.DeepEqual(got, names) {
+			c.t.Errorf("expected %v on %s, got %v", names, id, got)
+		}
+	}
+}
+
+// create creates a record named name through n and returns its ID
+func create(t *testing.T, n *Node, name string) repository.ID {
+	t.Helper()
+
+	record := map[string]interface{}{"name": name}
+	if err := n.CreateRecord(context.Background(), record); err != nil {
+		t.Fatalf("CreateRecord on %s failed: %v", n.id, err)
+	}
+	id, _ := repository.FormatID(record["id"])
+	return id
+}
+
+func Test_Replication(t *testing.T) {
+	ctx := context.Background()
+	c := newCluster(t, []string{"a", "b", "c"})
+	leader := c.leader()
+	follower := c.follower(leader)
+
+	if id := create(t, leader, "db01"); id != "1" {
+		t.Errorf("expected ID 1, got %s", id)
+	}
+	// Changes sent to a follower are forwarded, and it has them once they
+	// return
+	if id := create(t, follower, "db02"); id != "2" {
+		t.Errorf("expected ID 2, got %s", id)
+	}
+	if record, err := follower.ReadRecord(ctx, "2"); err != nil || record["name"] != "db02" {
+		t.Errorf("expected the record on the follower, got %v (%v)", record, err)
+	}
+	record := map[string]interface{}{"name": "db01b"}
+	if err := follower.UpdateRecord(ctx, "1", record); err != nil || record["id"] == nil {
+		t.Fatalf("UpdateRecord failed: %v, %v", err, record)
+	}
+	create(t, follower, "db03")
+	if err := follower.DeleteRecord(ctx, "2"); err != nil {
+		t.Fatalf("DeleteRecord failed: %v", err)
+	}
+
+	// Errors of the leader come back as the same errors
+	if err := follower.DeleteRecord(ctx, "2"); !errors.Is(err, dberr.ErrNotFound) {
+		t.Errorf("expected ErrNotFound, got %v", err)
+	}
+	if err := follower.UpdateRecord(ctx, "9", map[string]interface{}{"name": "x"}); !errors.Is(err, dberr.ErrNotFound) {
+		t.Errorf("expected ErrNotFound, got %v", err)
+	}
+
+	c.waitApplied(leader)
+	c.expectRecords("db01b", "db03")
+	for _, node := range c.nodes {
+		if status := node.Status(); len(status.Members) != 3 || status.Leader != leader.id {
+			t.Errorf("unexpected status %+v", status)
+		}
+	}
+}
+
+func Test_Partition(t *testing.T) {
+	ctx := context.Background()
+	c := newCluster(t, []string{"a", "b", "c", "d", "e"})
+	old := c.leader()
+	create(t, old, "before")
+
+	// The leader is cut off with one follower, the three others elect a
+	// new leader
+	var minority, majority []string
+	minority = append(minority, old.id)
+	for _, id := range []string{"a", "b", "c", "d", "e"} {
+		if id == old.id {
+			continue
+		}
+		if len(minority) < 2 {
+			minority = append(minority, id)
+		} else {
+			majority = append(majority, id)
+		}
+	}
+	c.net.partition(minority, majority)
+
+	lost, cancel := context.WithTimeout(ctx, 300*time.Millisecond)
+	defer cancel()
+	if err := old.CreateRecord(lost, map[string]interface{}{"name": "lost"}); err == nil {
+		t.Errorf("expected the change to fail without a majority")
+	}
+	if err := c.nodes[minority[1]].CreateRecord(ctx, map[string]interface{}{"name": "lost"}); !errors.Is(err, dberr.ErrNotLeader) {
+		t.Errorf("expected ErrNotLeader on the minority, got %v", err)
+	}
+
+	leader := c.leader(majority...)
+	create(t, c.nodes[majority[0]], "during")
+	if status := old.Status(); status.Role == RoleLeader {
+		t.Errorf("expected the old leader to step down, got %+v", status)
+	}
+
+	// Once healed, the minority drops the change it could not commit
+	c.net.heal()
+	create(t, old, "after")
+	c.waitApplied(leader)
+	c.expectRecords("before", "during", "after")
+}
+
+func Test_Snapshot(t *testing.T) {
+	ctx := context.Background()
+	c := newCluster(t, []string{"a", "b", "c"}, WithSnapshotThreshold(5))
+	leader := c.leader()
+	for i := 0; i < 12; i++ {
+		create(t, leader, "db")
+	}
+	c.waitApplied(leader)
+	if status := leader.Status(); status.SnapshotIndex < 5 || status.LastLogIndex-status.SnapshotIndex > 5 {
+		t.Errorf("expected the log replaced with a snapshot, got %+v", status)
+	}
+
+	// A new member is sent the snapshot and the entries following it
+	c.start("d")
+	if err := leader.AddMember(ctx, "d", "d"); err != nil {
+		t.Fatalf("AddMember failed: %v", err)
+	}
+	create(t, c.nodes["d"], "db")
+	c.waitApplied(leader)
+	names := make([]string, 13)
+	for i := range names {
+		names[i] = "db"
+	}
+	c.expectRecords(names...)
+	if status := leader.Status(); len(status.Members) != 4 {
+		t.Errorf("expected 4 members, got %+v", status.Members)
+	}
+}
+
+func Test_Membership(t *testing.T) {
+	ctx := context.Background()
+	c := newCluster(t, []string{"a", "b", "c"})
+	leader := c.leader()
+
+	for _, test := range []struct {
+		name     string
+		change   func() error
+		expected error
+	}{
+		{"add without address", func() error { return leader.AddMember(ctx, "x", "") }, dberr.ErrValidation},
+		{"add member", func() error { return leader.AddMember(ctx, leader.id, leader.id) }, dberr.ErrConflict},
+		{"remove non-member", func() error { return leader.RemoveMember(ctx, "x") }, dberr.ErrNotFound},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			if err := test.change(); !errors.Is(err, test.expected) {
+				t.Errorf("expected %v, got %v", test.expected, err)
+			}
+		})
+	}
+
+	// Members are added through followers too
+	c.start("d")
+	if err := c.follower(leader).AddMember(ctx, "d", "d"); err != nil {
+		t.Fatalf("AddMember failed: %v", err)
+	}
+	create(t, leader, "db01")
+
+	// The leader removes itself and steps down, the others elect a new one
+	removed := leader.id
+	if err := leader.RemoveMember(ctx, removed); err != nil {
+		t.Fatalf("RemoveMember failed: %v", err)
+	}
+	c.stop(removed)
+	leader = c.leader()
+	if status := leader.Status(); len(status.Members) != 3 {
+		t.Errorf("expected 3 members, got %+v", status.Members)
+	}
+	create(t, c.follower(leader), "db02")
+	c.waitApplied(leader)
+	c.expectRecords("db01", "db02")
+}
+
+func Test_Restart(t *testing.T) {
+	c := newCluster(t, []string{"a", "b", "c"})
+	leader := c.leader()
+	create(t, leader, "db01")
+	create(t, c.follower(leader), "db02")
+
+	// Every node restarts from its state directory and database file
+	for _, id := range []string{"a", "b", "c"} {
+		c.stop(id)
+	}
+	for _, id := range []string{"a", "b", "c"} {
+		c.start(id)
+	}
+	leader = c.leader()
+	if id := create(t, leader, "db03"); id != "3" {
+		t.Errorf("expected the sequence to go on, got %s", id)
+	}
+	c.waitApplied(leader)
+	c.expectRecords("db01", "db02", "db03")
+}
+
+func Test_NewNode(t *testing.T) {
+	db, err := filedb.Open(filepath.Join(t.TempDir(), "db.json"))
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer db.Close()
+	if err := db.CreateRecord(context.Background(), map[string]interface{}{"name": "db01"}); err != nil {
+		t.Fatalf("CreateRecord failed: %v", err)
+	}
+
+	// A database with records can only start a new cluster
+	if _, err := NewNode("a", db, newNetwork().transport("a")); err == nil {
+		t.Errorf("expected NewNode to fail")
+	}
+	node, err := NewNode("a", db, newNetwork().transport("a"), WithBootstrap(map[string]string{"a": "a"}), WithElectionTimeout(10*time.Millisecond))
+	if err != nil {
+		t.Fatalf("NewNode failed: %v", err)
+	}
+	defer node.Close()
+
+	// A single node is a majority of its own
+	deadline := time.Now().Add(5 * time.Second)
+	for node.Status().Role != RoleLeader {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the node to lead, got %+v", node.Status())
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if id := create(t, node, "db02"); id != "2" {
+		t.Errorf("expected ID 2, got %s", id)
+	}
+}
+
+func Test_FileStorage(t *testing.T) {
+	dir := t.TempDir()
+	storage, err := NewFileStorage(dir)
+	if err != nil {
+		t.Fatalf("NewFileStorage failed: %v", err)
+	}
+	if state, entries, snap, err := storage.Load(); err != nil || state.Term != 0 || entries != nil || snap != nil {
+		t.Fatalf("expected an empty state, got %+v %v %v (%v)", state, entries, snap, err)
+	}
+
+	entries := []Entry{
+		{Index: 3, Term: 2, Type: EntryNoop},
+		{Index: 4, Term: 2, Type: EntryChange, Change: &repository.Change{Op: repository.OpDelete, ID: "1"}},
+		{Index: 5, Term: 2, Type: EntryConfig, Members: map[string]string{"a": "http://a"}},
+	}
+	snap := &Snapshot{Index: 2, Term: 1, Members: map[string]string{"a": "http://a"}, Data: []byte(`{"seq":1,"idStrategy":"sequential","records":[]}`)}
+	if err := storage.Save(HardState{Term: 2, VotedFor: "a"}, entries); err != nil {
+		t.Fatalf("Save failed: %v", err)
+	}
+	if err := storage.SaveSnapshot(snap); err != nil {
+		t.Fatalf("SaveSnapshot failed: %v", err)
+	}
+
+	storage, _ = NewFileStorage(dir)
+	state, loaded, loadedSnap, err := storage.Load()
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	if state != (HardState{Term: 2, VotedFor: "a"}) || !reflect.DeepEqual(loaded, entries) || !reflect.DeepEqual(loadedSnap, snap) {
+		t.Errorf("unexpected state %+v %+v %+v", state, loaded, loadedSnap)
+	}
+}
+
+func Test_FileStorageLog(t *testing.T) {
+	dir := t.TempDir()
+	logPath := filepath.Join(dir, logFile)
+	keys := repotest.Keyring(t, 1)
+	storage, err := NewFileStorage(dir, WithStorageKeys(keys))
+	if err != nil {
+		t.Fatalf("NewFileStorage failed: %v", err)
+	}
+	entries := []Entry{
+		{Index: 3, Term: 2, Type: EntryNoop},
+		{Index: 4, Term: 2, Type: EntryChange, Change: &repository.Change{Op: repository.OpDelete, ID: "1"}},
+		{Index: 5, Term: 2, Type: EntryConfig, Members: map[string]string{"a": "http://a"}},
+	}
+	state := HardState{Term: 2, VotedFor: "a"}
+	expectLoad := func(t *testing.T, state HardState, entries []Entry) {
+		t.Helper()
+		storage, _ := NewFileStorage(dir, WithStorageKeys(keys))
+		loaded, loadedEntries, _, err := storage.Load()
+		if err != nil {
+			t.Fatalf("Load failed: %v", err)
+		}
+		if loaded != state || !reflect.DeepEqual(loadedEntries, entries) {
+			t.Errorf("expected %+v %+v, got %+v %+v", state, entries, loaded, loadedEntries)
+		}
+	}
+
+	if err := storage.Save(state, entries[:2]); err != nil {
+		t.Fatalf("Save failed: %v", err)
+	}
+	before, _ := os.ReadFile(logPath)
+
+	// Entries are appended and a vote leaves the log alone, the entries
+	// being encrypted each with their own nonce
+	if err := storage.Save(state, entries); err != nil {
+		t.Fatalf("Save failed: %v", err)
+	}
+	after, _ := os.ReadFile(logPath)
+	if len(after) <= len(before) || !bytes.Equal(after[:len(before)], before) {
+		t.Errorf("expected the entry to be appended to the log")
+	}
+	state = HardState{Term: 3, VotedFor: "b"}
+	if err := storage.Save(state, entries); err != nil {
+		t.Fatalf("Save failed: %v", err)
+	}
+	if content, _ := os.ReadFile(logPath); !bytes.Equal(content, after) {
+		t.Errorf("expected a vote not to write the log")
+	}
+	expectLoad(t, state, entries)
+
+	// Conflicting entries are cut off
+	entries = append(entries[:2:2], Entry{Index: 5, Term: 3, Type: EntryNoop})
+	if err := storage.Save(state, entries); err != nil {
+		t.Fatalf("Save failed: %v", err)
+	}
+	expectLoad(t, state, entries)
+
+	// An entry cut off by a crash is left out and overwritten
+	file, _ := os.OpenFile(logPath, os.O_WRONLY|os.O_APPEND, 0)
+	file.Write([]byte{0, 0, 1, 0, 'x'})
+	file.Close()
+	expectLoad(t, state, entries)
+	storage, _ = NewFileStorage(dir, WithStorageKeys(keys))
+	storage.Load()
+	entries = append(entries, Entry{Index: 6, Term: 3, Type: EntryNoop})
+	if err := storage.Save(state, entries); err != nil {
+		t.Fatalf("Save failed: %v", err)
+	}
+	expectLoad(t, state, entries)
+
+	// Entries a snapshot covers are dropped, on Load if the log was not
+	// saved after it
+	if err := storage.SaveSnapshot(&Snapshot{Index: 4, Term: 2, Members: map[string]string{"a": "http://a"}}); err != nil {
+		t.Fatalf("SaveSnapshot failed: %v", err)
+	}
+	expectLoad(t, state, entries[2:])
+	if err := storage.Save(state, entries[2:]); err != nil {
+		t.Fatalf("Save failed: %v", err)
+	}
+	expectLoad(t, state, entries[2:])
+
+	// A damaged entry followed by others fails to load
+	content, _ := os.ReadFile(logPath)
+	content[8] ^= 1 // Past the header of the first entry
+	os.WriteFile(logPath, content, 0600)
+	storage, _ = NewFileStorage(dir, WithStorageKeys(keys))
+	if _, _, _, err := storage.Load(); err == nil {
+		t.Errorf("expected a damaged log to fail")
+	}
+}
+
+func Test_FileStorageKeys(t *testing.T) {
+	dir := t.TempDir()
+	keys := repotest.Keyring(t, 1)
+	entries := []Entry{{Index: 2, Term: 1, Type: EntryConfig, Members: map[string]string{"a": "http://a"}}}
+	snap := &Snapshot{Index: 1, Term: 1, Members: map[string]string{"a": "http://a"}, Data: []byte(`{}`)}
+
+	// Files written before the keys were set are encrypted on Load
+	storage, _ := NewFileStorage(dir)
+	if err := storage.Save(HardState{Term: 1, VotedFor: "a"}, entries); err != nil {
+		t.Fatalf("Save failed: %v", err)
+	}
+	if err := storage.SaveSnapshot(snap); err != nil {
+		t.Fatalf("SaveSnapshot failed: %v", err)
+	}
+	storage, _ = NewFileStorage(dir, WithStorageKeys(keys))
+	if _, _, _, err := storage.Load(); err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	for _, name := range []string{stateFile, logFile, snapshotFile} {
+		content, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatalf("ReadFile failed: %v", err)
+		}
+		if bytes.Contains(content, []byte(`"a"`)) || bytes.Contains(content, []byte("http://a")) {
+			t.Errorf("expected %s to be encrypted, got %q", name, content)
+		}
+	}
+
+	storage, _ = NewFileStorage(dir, WithStorageKeys(keys))
+	state, loaded, loadedSnap, err := storage.Load()
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	if state != (HardState{Term: 1, VotedFor: "a"}) || !reflect.DeepEqual(loaded, entries) || !reflect.DeepEqual(loadedSnap, snap) {
+		t.Errorf("unexpected state %+v %+v %+v", state, loaded, loadedSnap)
+	}
+
+	storage, _ = NewFileStorage(dir)
+	if _, _, _, err := storage.Load(); !errors.Is(err, dbfile.ErrEncrypted) {
+		t.Errorf("expected %v without the keys, got %v", dbfile.ErrEncrypted, err)
+	}
+
+	// After a rekey the files are read without the previous key
+	storage, _ = NewFileStorage(dir, WithStorageKeys(keys))
+	rekeyed := repotest.Keyring(t, 2)
+	if err := storage.Rekey(context.Background(), rekeyed); err != nil {
+		t.Fatalf("Rekey failed: %v", err)
+	}
+	for _, name := range []string{stateFile, snapshotFile} {
+		content, _ := os.ReadFile(filepath.Join(dir, name))
+		if id := dbfile.EncryptionKeyID(content); id != rekeyed.Primary().ID {
+			t.Errorf("expected %s to be encrypted with %s, got %q", name, rekeyed.Primary().ID, id)
+		}
+	}
+	storage, _ = NewFileStorage(dir, WithStorageKeys(rekeyed))
+	state, loaded, loadedSnap, err = storage.Load()
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	if state != (HardState{Term: 1, VotedFor: "a"}) || !reflect.DeepEqual(loaded, entries) || !reflect.DeepEqual(loadedSnap, snap) {
+		t.Errorf("unexpected state %+v %+v %+v", state, loaded, loadedSnap)
+	}
+	storage, _ = NewFileStorage(dir, WithStorageKeys(keys))
+	if _, _, _, err := storage.Load(); err == nil {
+		t.Errorf("expected the previous key not to read the files")
+	}
+}
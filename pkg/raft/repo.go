@@ -0,0 +1,82 @@
+package raft
+
+import (
+	"context"
+	"fmt"
+	"zabbixhw/pkg/repository"
+	"zabbixhw/pkg/repository/dberr"
+	"zabbixhw/pkg/repository/dbfile"
+)
+
+// CreateRecord creates the record through the leader. The ID is issued by
+// the leader and set in data once the node applied the change
+func (n *Node) CreateRecord(ctx context.Context, data map[string]interface{}) error {
+	result, err := n.submit(ctx, &Request{Change: &repository.Change{Op: repository.OpCreate, Record: data}})
+	if err != nil {
+		return err
+	}
+	n.storedID(ctx, result.ID, data)
+	return nil
+}
+
+// ReadRecord reads from the engine of the node
+func (n *Node) ReadRecord(ctx context.Context, id repository.ID) (map[string]interface{}, error) {
+	return n.engine.ReadRecord(ctx, id)
+}
+
+// UpdateRecord updates the record through the leader
+func (n *Node) UpdateRecord(ctx context.Context, id repository.ID, data map[string]interface{}) error {
+	if _, err := n.submit(ctx, &Request{Change: &repository.Change{Op: repository.OpUpdate, ID: id, Record: data}}); err != nil {
+		return err
+	}
+	n.storedID(ctx, id, data)
+	return nil
+}
+
+// DeleteRecord deletes the record through the leader
+func (n *Node) DeleteRecord(ctx context.Context, id repository.ID) error {
+	_, err := n.submit(ctx, &Request{Change: &repository.Change{Op: repository.OpDelete, ID: id}})
+	return err
+}
+
+// storedID sets the ID of data as the engine of the node stores it, like
+// the engines do for their callers
+func (n *Node) storedID(ctx context.Context, id repository.ID, data map[string]interface{}) {
+	if record, err := n.engine.ReadRecord(ctx, id); err == nil {
+		data["id"] = record["id"]
+	} else {
+		// Deleted through another node meanwhile
+		data["id"] = id
+	}
+}
+
+// AddMember adds a node to the cluster. It is sent a snapshot of the
+// database and the log by the leader, and counts towards the majority
+// once the change is committed
+func (n *Node) AddMember(ctx context.Context, id, address string) error {
+	_, err := n.submit(ctx, &Request{AddMember: &Member{ID: id, Address: address}})
+	return err
+}
+
+// RemoveMember removes a node from the cluster. A leader removing itself
+// steps down once the change is committed
+func (n *Node) RemoveMember(ctx context.Context, id string) error {
+	_, err := n.submit(ctx, &Request{RemoveMember: id})
+	return err
+}
+
+// Rekey passes a new keyring to the engine of the node, then to its storage
+// if it keeps files. Each server of the cluster encrypts its own files
+func (n *Node) Rekey(ctx context.Context, keys *dbfile.Keyring) error {
+	engine, ok := n.engine.(dbfile.Rekeyer)
+	if !ok {
+		return fmt.Errorf("%w: the engine cannot be rekeyed", dberr.ErrValidation)
+	}
+	if err := engine.Rekey(ctx, keys); err != nil {
+		return err
+	}
+	if storage, ok := n.storage.(dbfile.Rekeyer); ok {
+		return storage.Rekey(ctx, keys)
+	}
+	return nil
+}
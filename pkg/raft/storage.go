@@ -0,0 +1,369 @@
+package raft
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+	"zabbixhw/pkg/fsys"
+	"zabbixhw/pkg/repository/dbfile"
+)
+
+// Storage keeps the state of a node across restarts. Save is called with
+// the whole log following the snapshot whenever it or the hard state
+// changes, and must not return before both are durable. It is up to the
+// storage to only write what changed
+type Storage interface {
+	Load() (HardState, []Entry, *Snapshot, error)
+	Save(state HardState, entries []Entry) error
+	SaveSnapshot(snap *Snapshot) error
+}
+
+// MemoryStorage keeps the state in memory, for tests and nodes that rejoin
+// their cluster from scratch after a restart
+type MemoryStorage struct {
+	mu      sync.Mutex
+	state   HardState
+	entries []Entry
+	snap    *Snapshot
+}
+
+func (s *MemoryStorage) Load() (HardState, []Entry, *Snapshot, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.state, append([]Entry(nil), s.entries...), s.snap, nil
+}
+
+func (s *MemoryStorage) Save(state HardState, entries []Entry) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.state = state
+	s.entries = append([]Entry(nil), entries...)
+	return nil
+}
+
+func (s *MemoryStorage) SaveSnapshot(snap *Snapshot) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.snap = snap
+	return nil
+}
+
+// Names of the files of a FileStorage
+const (
+	stateFile    = "state.json"
+	logFile      = "log"
+	snapshotFile = "snapshot.json"
+)
+
+// FileStorage keeps the state in a directory: a state file holding the hard
+// state, a log file the entries are appended to and a snapshot file. The
+// log file is only rewritten when a snapshot replaces its first entries,
+// the other files are replaced atomically. Each file, or each entry of the
+// log, is encrypted when keys are given
+type FileStorage struct {
+	dir  string
+	fsys fsys.FS
+	keys *dbfile.Keyring
+
+	mu     sync.Mutex
+	loaded bool
+	state  HardState    // Hard state in the state file
+	saved  []savedEntry // Entries in the log file
+}
+
+// savedEntry is an entry of the log file
+type savedEntry struct {
+	index uint64
+	term  uint64
+	end   int64 // Offset of the end of its frame
+}
+
+// StorageOption configures a FileStorage
+type StorageOption func(*FileStorage)
+
+// WithStorageKeys encrypts the files with the primary key of keys. Files
+// written in plaintext or with another key are encrypted again on Load
+func WithStorageKeys(keys *dbfile.Keyring) StorageOption {
+	return func(s *FileStorage) {
+		s.keys = keys
+	}
+}
+
+// NewFileStorage keeps the state in dir, creating it if needed
+func NewFileStorage(dir string, opts ...StorageOption) (*FileStorage, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("error creating the state directory: %w", err)
+	}
+	s := &FileStorage{dir: dir, fsys: fsys.OS{}}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s, nil
+}
+
+// Load returns the saved state. Entries the snapshot covers, left when the
+// node stopped between saving a snapshot and its log, are dropped
+func (s *FileStorage) Load() (HardState, []Entry, *Snapshot, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entries, err := s.load()
+	if err != nil {
+		return HardState{}, nil, nil, err
+	}
+	var snap *Snapshot
+	stale, err := s.read(snapshotFile, &snap)
+	if err != nil {
+		return HardState{}, nil, nil, err
+	}
+	if stale {
+		if err := s.write(snapshotFile, snap); err != nil {
+			return HardState{}, nil, nil, err
+		}
+	}
+
+	if snap != nil {
+		for len(entries) > 0 && entries[0].Index <= snap.Index {
+			entries = entries[1:]
+		}
+	}
+	return s.state, entries, snap, nil
+}
+
+// Save writes the hard state when it changed, and the entries that are not
+// in the log file yet. The entries of the file that conflict with entries
+// are cut off first
+func (s *FileStorage) Save(state HardState, entries []Entry) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.loaded {
+		if _, err := s.load(); err != nil {
+			return err
+		}
+	}
+
+	if len(s.saved) > 0 && len(entries) > 0 && entries[0].Index != s.saved[0].index {
+		if err := s.rewriteLog(entries); err != nil {
+			return err
+		}
+	} else {
+		kept := 0
+		for kept < len(s.saved) && kept < len(entries) && s.saved[kept].term == entries[kept].Term {
+			kept++
+		}
+		if kept < len(s.saved) || kept < len(entries) {
+			if err := s.appendLog(kept, entries[kept:]); err != nil {
+				return err
+			}
+		}
+	}
+
+	if state != s.state {
+		if err := s.write(stateFile, state); err != nil {
+			return err
+		}
+		s.state = state
+	}
+	return nil
+}
+
+func (s *FileStorage) SaveSnapshot(snap *Snapshot) error {
+	return s.write(snapshotFile, snap)
+}
+
+// Rekey encrypts the files again with the primary key of keys, which from
+// then on are the keys the files are read with. The files are read with the
+// previous keys first, so keys need not hold them
+func (s *FileStorage) Rekey(ctx context.Context, keys *dbfile.Keyring) error {
+	if keys == nil {
+		return dbfile.ErrNoKeys
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entries, err := s.load()
+	if err != nil {
+		return err
+	}
+	var snap *Snapshot
+	if _, err := s.read(snapshotFile, &snap); err != nil {
+		return err
+	}
+
+	s.keys = keys
+	if err := s.write(stateFile, s.state); err != nil {
+		return err
+	}
+	if snap != nil {
+		if err := s.write(snapshotFile, snap); err != nil {
+			return err
+		}
+	}
+	return s.rewriteLog(entries)
+}
+
+// load reads the state and log files, encrypting them again when they are
+// not encrypted with the primary key. An entry cut off at the end of the
+// log file is left out and overwritten by the next Save. s.mu must be held
+func (s *FileStorage) load() ([]Entry, error) {
+	var state HardState
+	staleState, err := s.read(stateFile, &state)
+	if err != nil {
+		return nil, err
+	}
+
+	content, err := s.readFile(logFile)
+	if err != nil {
+		return nil, err
+	}
+	frames, err := dbfile.ReadFrames(content)
+	if err != nil {
+		return nil, fmt.Errorf("error decoding %s: %w", logFile, err)
+	}
+	var entries []Entry
+	var saved []savedEntry
+	staleLog := false
+	for _, frame := range frames {
+		var entry Entry
+		stale, err := s.decode(frame.Content, &entry)
+		if err != nil {
+			return nil, fmt.Errorf("error decoding %s: %w", logFile, err)
+		}
+		staleLog = staleLog || stale
+		entries = append(entries, entry)
+		saved = append(saved, savedEntry{index: entry.Index, term: entry.Term, end: frame.End})
+	}
+
+	s.state, s.saved, s.loaded = state, saved, true
+	if staleState {
+		if err := s.write(stateFile, state); err != nil {
+			return nil, err
+		}
+	}
+	if staleLog {
+		if err := s.rewriteLog(entries); err != nil {
+			return nil, err
+		}
+	}
+	return entries, nil
+}
+
+// appendLog keeps the first kept entries of the log file and appends
+// entries after them. s.mu must be held
+func (s *FileStorage) appendLog(kept int, entries []Entry) error {
+	offset := int64(0)
+	if kept > 0 {
+		offset = s.saved[kept-1].end
+	}
+	data, saved, err := s.encodeLog(offset, entries)
+	if err != nil {
+		return err
+	}
+
+	if err := fsys.WriteAt(s.fsys, filepath.Join(s.dir, logFile), offset, data, 0600); err != nil {
+		return err
+	}
+	s.saved = append(s.saved[:kept], saved...)
+	return nil
+}
+
+// rewriteLog replaces the log file with entries. s.mu must be held
+func (s *FileStorage) rewriteLog(entries []Entry) error {
+	data, saved, err := s.encodeLog(0, entries)
+	if err != nil {
+		return err
+	}
+	if err := fsys.WriteFile(s.fsys, filepath.Join(s.dir, logFile), data, 0600); err != nil {
+		return err
+	}
+	s.saved = saved
+	return nil
+}
+
+// encodeLog encodes entries as frames of the log file starting at offset
+func (s *FileStorage) encodeLog(offset int64, entries []Entry) ([]byte, []savedEntry, error) {
+	var data []byte
+	saved := make([]savedEntry, 0, len(entries))
+	for _, entry := range entries {
+		frame, err := s.encode(entry)
+		if err != nil {
+			return nil, nil, err
+		}
+		data = dbfile.AppendFrame(data, frame)
+		saved = append(saved, savedEntry{index: entry.Index, term: entry.Term, end: offset + int64(len(data))})
+	}
+	return data, saved, nil
+}
+
+// read decodes the file name into v, leaving v alone when there is no such
+// file. stale reports whether the file should be encrypted again
+func (s *FileStorage) read(name string, v interface{}) (stale bool, err error) {
+	content, err := s.readFile(name)
+	if err != nil || content == nil {
+		return false, err
+	}
+	stale, err = s.decode(content, v)
+	if err != nil {
+		return false, fmt.Errorf("error decoding %s: %w", name, err)
+	}
+	return stale, nil
+}
+
+// readFile returns the content of the file name, nil when there is no such
+// file
+func (s *FileStorage) readFile(name string) ([]byte, error) {
+	file, err := s.fsys.OpenFile(filepath.Join(s.dir, name), os.O_RDONLY, 0)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return io.ReadAll(file)
+}
+
+// write replaces the file name with v, through a synced temporary file
+func (s *FileStorage) write(name string, v interface{}) error {
+	data, err := s.encode(v)
+	if err != nil {
+		return err
+	}
+	return fsys.WriteFile(s.fsys, filepath.Join(s.dir, name), data, 0600)
+}
+
+// encode returns v in JSON, encrypted with the primary key if there are keys
+func (s *FileStorage) encode(v interface{}) ([]byte, error) {
+	data, err := json.Marshal(v)
+	if err != nil || s.keys == nil {
+		return data, err
+	}
+	return dbfile.Encrypt(data, s.keys.Primary())
+}
+
+// decode decrypts content and decodes it into v. Numbers are kept as
+// json.Number, like the engines read them. stale reports whether content
+// is not encrypted with the primary key while there are keys
+func (s *FileStorage) decode(content []byte, v interface{}) (stale bool, err error) {
+	plain, id, err := dbfile.Decrypt(content, s.keys)
+	if err != nil {
+		return false, err
+	}
+	decoder := json.NewDecoder(bytes.NewReader(plain))
+	decoder.UseNumber()
+	if err := decoder.Decode(v); err != nil {
+		return false, err
+	}
+	return s.keys != nil && id != s.keys.Primary().ID, nil
+}
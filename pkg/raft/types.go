@@ -0,0 +1,239 @@
+package raft
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"zabbixhw/pkg/repository"
+	"zabbixhw/pkg/repository/dberr"
+)
+
+// Roles a node can have
+const (
+	RoleFollower  = "follower"
+	RoleCandidate = "candidate"
+	RoleLeader    = "leader"
+)
+
+// Errors returned to callers of a node
+var (
+	// ErrUnreachable is returned by transports for nodes that cannot be
+	// reached
+	ErrUnreachable = errors.New("node unreachable")
+	// ErrOutcomeUnknown is returned for changes that were sent to the log of
+	// a leader that lost its leadership before they were committed. They may
+	// or may not be applied in the end
+	ErrOutcomeUnknown = errors.New("leadership lost, the change may or may not be applied")
+	// ErrMembershipChange is returned while a previous membership change is
+	// not committed, or before the leader committed an entry of its term
+	ErrMembershipChange = errors.New("a membership change is in progress")
+)
+
+// EntryType tells what an entry of the log holds
+type EntryType string
+
+// Kinds of entries
+const (
+	EntryNoop   EntryType = "noop"   // Appended by new leaders to commit the entries of their predecessors
+	EntryChange EntryType = "change" // A change of a record
+	EntryConfig EntryType = "config" // The members of the cluster from then on
+)
+
+// Entry is an entry of the replicated log
+type Entry struct {
+	Index   uint64             `json:"index"`
+	Term    uint64             `json:"term"`
+	Type    EntryType          `json:"type"`
+	Change  *repository.Change `json:"change,omitempty"`
+	Members map[string]string  `json:"members,omitempty"` // Node ID to address, for config entries
+}
+
+// HardState is the state a node must keep across restarts besides its log
+type HardState struct {
+	Term     uint64 `json:"term"`
+	VotedFor string `json:"votedFor,omitempty"`
+}
+
+// Snapshot stands for every entry of the log up to Index
+type Snapshot struct {
+	Index   uint64            `json:"index"`
+	Term    uint64            `json:"term"`
+	Members map[string]string `json:"members"`
+	Data    json.RawMessage   `json:"data"` // A State in JSON
+}
+
+// State is the content of the engine in a snapshot
+type State struct {
+	Seq        uint64                   `json:"seq"`
+	IDStrategy string                   `json:"idStrategy"`
+	Records    []map[string]interface{} `json:"records"`
+}
+
+// VoteRequest asks a node for its vote in an election
+type VoteRequest struct {
+	Term         uint64 `json:"term"`
+	Candidate    string `json:"candidate"`
+	LastLogIndex uint64 `json:"lastLogIndex"`
+	LastLogTerm  uint64 `json:"lastLogTerm"`
+}
+
+// VoteResponse answers a VoteRequest
+type VoteResponse struct {
+	Term    uint64 `json:"term"`
+	Granted bool   `json:"granted"`
+}
+
+// AppendRequest sends a follower the entries following PrevLogIndex, none
+// for a heartbeat
+type AppendRequest struct {
+	Term         uint64  `json:"term"`
+	Leader       string  `json:"leader"`
+	PrevLogIndex uint64  `json:"prevLogIndex"`
+	PrevLogTerm  uint64  `json:"prevLogTerm"`
+	Entries      []Entry `json:"entries,omitempty"`
+	LeaderCommit uint64  `json:"leaderCommit"`
+}
+
+// AppendResponse answers an AppendRequest. LastLogIndex helps the leader
+// find where the logs diverge
+type AppendResponse struct {
+	Term         uint64 `json:"term"`
+	Success      bool   `json:"success"`
+	LastLogIndex uint64 `json:"lastLogIndex"`
+}
+
+// SnapshotRequest sends a follower a snapshot replacing its log
+type SnapshotRequest struct {
+	Term     uint64   `json:"term"`
+	Leader   string   `json:"leader"`
+	Snapshot Snapshot `json:"snapshot"`
+}
+
+// SnapshotResponse answers a SnapshotRequest
+type SnapshotResponse struct {
+	Term uint64 `json:"term"`
+}
+
+// Request is a change a follower forwards to its leader
+type Request struct {
+	Change       *repository.Change `json:"change,omitempty"`
+	AddMember    *Member            `json:"addMember,omitempty"`
+	RemoveMember string             `json:"removeMember,omitempty"`
+}
+
+// Result is the outcome of a forwarded Request. Index is the entry the
+// change was committed as, for the follower to wait for it
+type Result struct {
+	Index uint64        `json:"index"`
+	ID    repository.ID `json:"id,omitempty"`
+	Code  string        `json:"code,omitempty"`
+	Error string        `json:"error,omitempty"`
+}
+
+// Member is a node of the cluster
+type Member struct {
+	ID      string `json:"id"`
+	Address string `json:"address"`
+}
+
+// Status describes a node and, on the leader, how far each member is
+type Status struct {
+	ID            string         `json:"id"`
+	Role          string         `json:"role"`
+	Term          uint64         `json:"term"`
+	Leader        string         `json:"leader,omitempty"`
+	LastLogIndex  uint64         `json:"lastLogIndex"`
+	CommitIndex   uint64         `json:"commitIndex"`
+	LastApplied   uint64         `json:"lastApplied"`
+	SnapshotIndex uint64         `json:"snapshotIndex"`
+	Members       []MemberStatus `json:"members"`
+}
+
+// MemberStatus is a member of the cluster as seen by a node. MatchIndex is
+// only known to the leader
+type MemberStatus struct {
+	Member
+	MatchIndex uint64 `json:"matchIndex,omitempty"`
+}
+
+// Error codes carried by a Result
+const (
+	codeNotFound   = "not-found"
+	codeConflict   = "conflict"
+	codeValidation = "validation-failed"
+	codeNotLeader  = "not-leader"
+	codeMembership = "membership-change"
+	codeUnknown    = "outcome-unknown"
+	codeInternal   = "internal-error"
+)
+
+// errorCode returns the code of err in a Result
+func errorCode(err error) string {
+	switch {
+	case errors.Is(err, dberr.ErrNotFound):
+		return codeNotFound
+	case errors.Is(err, dberr.ErrConflict):
+		return codeConflict
+	case errors.Is(err, dberr.ErrValidation):
+		return codeValidation
+	case errors.Is(err, dberr.ErrNotLeader):
+		return codeNotLeader
+	case errors.Is(err, ErrMembershipChange):
+		return codeMembership
+	case errors.Is(err, ErrOutcomeUnknown):
+		return codeUnknown
+	default:
+		return codeInternal
+	}
+}
+
+// resultError turns the error of a Result back into one callers can match
+func resultError(result *Result) error {
+	if result.Code == "" {
+		return nil
+	}
+	sentinel := map[string]error{
+		codeNotFound:   dberr.ErrNotFound,
+		codeConflict:   dberr.ErrConflict,
+		codeValidation: dberr.ErrValidation,
+		codeNotLeader:  dberr.ErrNotLeader,
+		codeMembership: ErrMembershipChange,
+		codeUnknown:    ErrOutcomeUnknown,
+	}[result.Code]
+	if sentinel == nil {
+		return fmt.Errorf("leader failed the change: %s", result.Error)
+	}
+	return &remoteError{message: result.Error, sentinel: sentinel}
+}
+
+// remoteError is an error of the leader, as it reported it
+type remoteError struct {
+	message  string
+	sentinel error
+}
+
+func (e *remoteError) Error() string {
+	return e.message
+}
+
+func (e *remoteError) Unwrap() error {
+	return e.sentinel
+}
+
+// copyMembers returns a copy of members
+func copyMembers(members map[string]string) map[string]string {
+	c := make(map[string]string, len(members))
+	for id, address := range members {
+		c[id] = address
+	}
+	return c
+}
+
+// copyRecord returns a shallow copy of record
+func copyRecord(record map[string]interface{}) map[string]interface{} {
+	c := make(map[string]interface{}, len(record))
+	for k, v := range record {
+		c[k] = v
+	}
+	return c
+}
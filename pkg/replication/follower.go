@@ -0,0 +1,197 @@
+package replication
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+	"zabbixhw/pkg/repository"
+)
+
+// TokenHeader carries the shared secret of followers
+const TokenHeader = "X-Replication-Token"
+
+// Paths a leader serves followers on
+const (
+	LogPath      = "/replication/log"
+	SnapshotPath = "/replication/snapshot"
+)
+
+// follow catches up with the leader and keeps up with it until stop is
+// closed
+func (n *Node) follow(leader string, stop, stopped chan struct{}) {
+	defer close(stopped)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-stop:
+			cancel()
+		case <-stopped:
+		}
+	}()
+
+	for {
+		err := n.pull(ctx, leader)
+		if ctx.Err() != nil {
+			return
+		}
+		if err == nil {
+			continue
+		}
+
+		n.mu.Lock()
+		n.lastErr = err.Error()
+		n.mu.Unlock()
+		log.Printf("replication from %s: %v", leader, err)
+		select {
+		case <-time.After(n.retry):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// pull applies the next batch of entries of the leader, or its whole
+// content when the node has no position in its log
+func (n *Node) pull(ctx context.Context, leader string) error {
+	n.mu.Lock()
+	logID, after := n.logID, n.index
+	n.mu.Unlock()
+	if logID == "" {
+		return n.resync(ctx, leader)
+	}
+
+	query := url.Values{
+		"log":      {logID},
+		"after":    {strconv.FormatUint(after, 10)},
+		"wait":     {n.pollWait.String()},
+		"follower": {n.name},
+	}
+	var batch Batch
+	err := n.get(ctx, leader+LogPath+"?"+query.Encode(), &batch)
+	if errors.Is(err, ErrResync) {
+		n.mu.Lock()
+		n.logID = ""
+		n.mu.Unlock()
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if batch.LogID != logID || (len(batch.Entries) > 0 && batch.Entries[0].Index != after+1) {
+		return fmt.Errorf("leader answered out of place: log %s after %d", batch.LogID, after)
+	}
+
+	changes := make([]repository.Change, len(batch.Entries))
+	for i, entry := range batch.Entries {
+		changes[i] = entry.Change
+	}
+
+	if err := n.writeMu.Lock(ctx); err != nil {
+		return err
+	}
+	defer n.writeMu.Unlock()
+	if len(changes) > 0 {
+		if err := n.engine.ApplyChanges(ctx, changes); err != nil {
+			// The engine no longer matches the leader, start over
+			n.mu.Lock()
+			n.logID = ""
+			n.mu.Unlock()
+			return fmt.Errorf("error applying entries after %d: %w", after, err)
+		}
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if len(batch.Entries) > 0 {
+		last := batch.Entries[len(batch.Entries)-1]
+		n.index, n.indexTime = last.Index, last.Time
+	}
+	n.head, n.headTime = batch.Head, batch.HeadTime
+	n.lastContact = time.Now()
+	n.lastErr = ""
+	return nil
+}
+
+// resync replaces the content of the engine with that of the leader and
+// takes its log position
+func (n *Node) resync(ctx context.Context, leader string) error {
+	var state State
+	if err := n.get(ctx, leader+SnapshotPath, &state); err != nil {
+		return err
+	}
+
+	snap, _, err := n.engine.Snapshot(ctx)
+	if err != nil {
+		return err
+	}
+	if snap.Header.IDStrategy != state.IDStrategy {
+		return fmt.Errorf("leader issues %s IDs, this node %s", state.IDStrategy, snap.Header.IDStrategy)
+	}
+
+	if err := n.writeMu.Lock(ctx); err != nil {
+		return err
+	}
+	defer n.writeMu.Unlock()
+	if err := n.engine.Replace(ctx, state.Records, state.Seq); err != nil {
+		return err
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.logID = state.LogID
+	n.index, n.indexTime = state.Index, state.Time
+	n.head, n.headTime = state.Index, state.Time
+	n.lastContact = time.Now()
+	n.lastErr = ""
+	log.Printf("replication from %s: resynced %d records at %s/%d", leader, len(state.Records), state.LogID, state.Index)
+	return nil
+}
+
+// get requests target from the leader and decodes the JSON response into
+// v. Numbers are kept as json.Number, like the engines read them from files
+func (n *Node) get(ctx context.Context, target string, v interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target, nil)
+	if err != nil {
+		return err
+	}
+	if n.token != "" {
+		req.Header.Set(TokenHeader, n.token)
+	}
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		decoder := json.NewDecoder(resp.Body)
+		decoder.UseNumber()
+		if err := decoder.Decode(v); err != nil {
+			return fmt.Errorf("error decoding response of the leader: %w", err)
+		}
+		return nil
+	case http.StatusGone:
+		return ErrResync
+	default:
+		// Problem details explain the failure best, fall back to the body
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		var problem struct {
+			Code   string `json:"code"`
+			Detail string `json:"detail"`
+		}
+		if json.Unmarshal(body, &problem) == nil && problem.Code != "" {
+			return fmt.Errorf("leader answered %s: %s %s", resp.Status, problem.Code, problem.Detail)
+		}
+		return fmt.Errorf("leader answered %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+}
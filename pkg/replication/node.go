@@ -0,0 +1,493 @@
+package replication
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"zabbixhw/pkg/ctxsync"
+	"zabbixhw/pkg/repository"
+	"zabbixhw/pkg/repository/dberr"
+	"zabbixhw/pkg/repository/dbfile"
+)
+
+// Roles a node can have
+const (
+	RoleLeader   = "leader"
+	RoleFollower = "follower"
+)
+
+// ErrResync is returned to followers asking for a log position the leader
+// no longer has, or never had. They start over from a snapshot
+var ErrResync = errors.New("log position unavailable, resync from a snapshot")
+
+// Defaults of the options
+const (
+	DefaultRetention     = 10000
+	DefaultPollWait      = 2 * time.Second
+	DefaultRetryInterval = time.Second
+	maxBatch             = 1000
+)
+
+// Replica is implemented by engines that can replay the changes made on
+// another instance and hand out a copy of their content
+type Replica interface {
+	repository.DatabaseRepoV2
+	Snapshot(ctx context.Context) (*dbfile.Snapshot, dbfile.Encoding, error)
+	ApplyChanges(ctx context.Context, changes []repository.Change) error
+	Replace(ctx context.Context, records []map[string]interface{}, seq uint64) error
+}
+
+// Entry is a change in the log of a leader
+type Entry struct {
+	Index uint64    `json:"index"`
+	Time  time.Time `json:"time"`
+	repository.Change
+}
+
+// Batch holds the entries of a leader's log following a position
+type Batch struct {
+	LogID    string    `json:"logId"`
+	Head     uint64    `json:"head"`     // Index of the last entry of the log
+	HeadTime time.Time `json:"headTime"` // When it was appended, zero for an empty log
+	Entries  []Entry   `json:"entries"`
+}
+
+// State is the content of a leader as of a position of its log
+type State struct {
+	LogID      string                   `json:"logId"`
+	Index      uint64                   `json:"index"`
+	Time       time.Time                `json:"time"`
+	Seq        uint64                   `json:"seq"`
+	IDStrategy string                   `json:"idStrategy"`
+	Records    []map[string]interface{} `json:"records"`
+}
+
+// Status describes a node and how far behind its leader it is
+type Status struct {
+	Role        string           `json:"role"`
+	LogID       string           `json:"logId,omitempty"`
+	Index       uint64           `json:"index"`            // Last entry appended, or applied by a follower
+	Leader      string           `json:"leader,omitempty"` // URL of the leader of a follower
+	LeaderIndex uint64           `json:"leaderIndex"`      // Last entry of the leader when it was last heard of
+	Lag         uint64           `json:"lag"`              // Entries the follower is behind
+	LagSeconds  float64          `json:"lagSeconds"`       // Age of the last applied entry relative to the leader's newest
+	LastContact *time.Time       `json:"lastContact,omitempty"`
+	Error       string           `json:"error,omitempty"` // Why the follower last failed to catch up
+	Followers   []FollowerStatus `json:"followers,omitempty"`
+}
+
+// FollowerStatus is the position of a follower as seen by its leader
+type FollowerStatus struct {
+	Name     string    `json:"name"`
+	Index    uint64    `json:"index"`
+	Lag      uint64    `json:"lag"`
+	LastSeen time.Time `json:"lastSeen"`
+}
+
+// Option configures a Node
+type Option func(*Node)
+
+// WithName sets the name a follower reports to its leader
+func WithName(name string) Option {
+	return func(n *Node) {
+		n.name = name
+	}
+}
+
+// WithRetention sets how many entries a leader keeps for followers catching
+// up. Followers further behind resync from a snapshot
+func WithRetention(entries int) Option {
+	return func(n *Node) {
+		if entries > 0 {
+			n.retention = entries
+		}
+	}
+}
+
+// WithToken sets the shared secret a follower presents to its leader
+func WithToken(token string) Option {
+	return func(n *Node) {
+		n.token = token
+	}
+}
+
+// WithClient sets the HTTP client a follower reaches its leader with
+func WithClient(client *http.Client) Option {
+	return func(n *Node) {
+		n.client = client
+	}
+}
+
+// WithPollWait sets how long a follower asks its leader to hold a request
+// while there are no new entries
+func WithPollWait(wait time.Duration) Option {
+	return func(n *Node) {
+		n.pollWait = wait
+	}
+}
+
+// WithRetryInterval sets how long a follower waits after failing to reach
+// its leader
+func WithRetryInterval(interval time.Duration) Option {
+	return func(n *Node) {
+		n.retry = interval
+	}
+}
+
+// Node is a repository whose changes are shipped from a leader to its
+// followers. The leader records every change in an in-memory log, followers
+// pull the log over HTTP, apply it to their own engine and serve reads.
+// Changes sent to a follower fail with dberr.ErrNotLeader
+type Node struct {
+	engine    Replica
+	name      string
+	retention int
+	token     string
+	client    *http.Client
+	pollWait  time.Duration
+	retry     time.Duration
+
+	admin   sync.Mutex      // Orders role changes
+	writeMu ctxsync.RWMutex // Orders changes with their entries, and with role changes
+
+	mu        sync.Mutex
+	role      string
+	logID     string // Empty while a follower has to resync
+	entries   []Entry
+	index     uint64
+	indexTime time.Time
+	appended  chan struct{} // Closed when an entry is appended
+	followers map[string]FollowerStatus
+
+	leader      string // Followers only
+	head        uint64
+	headTime    time.Time
+	lastContact time.Time
+	lastErr     string
+	stop        chan struct{} // Closed to stop following
+	stopped     chan struct{} // Closed once the follower loop is gone
+}
+
+// NewNode makes engine a leader. Call Follow to make it a follower
+func NewNode(engine Replica, opts ...Option) *Node {
+	n := &Node{
+		engine:    engine,
+		retention: DefaultRetention,
+		client:    http.DefaultClient,
+		pollWait:  DefaultPollWait,
+		retry:     DefaultRetryInterval,
+		role:      RoleLeader,
+		logID:     newLogID(),
+		appended:  make(chan struct{}),
+		followers: map[string]FollowerStatus{},
+	}
+	for _, opt := range opts {
+		opt(n)
+	}
+	return n
+}
+
+// newLogID returns a random name for a new log. Positions are only
+// meaningful within the log they come from
+func newLogID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// Unwrap returns the engine of the node
+func (n *Node) Unwrap() repository.DatabaseRepoV2 {
+	return n.engine
+}
+
+// Rekey passes a new keyring to the engine, on leaders and followers alike
+func (n *Node) Rekey(ctx context.Context, keys *dbfile.Keyring) error {
+	engine, ok := n.engine.(dbfile.Rekeyer)
+	if !ok {
+		return fmt.Errorf("%w: the engine cannot be rekeyed", dberr.ErrValidation)
+	}
+	return engine.Rekey(ctx, keys)
+}
+
+// CreateRecord creates the record on a leader and logs it
+func (n *Node) CreateRecord(ctx context.Context, data map[string]interface{}) error {
+	return n.change(ctx, func() (repository.Change, error) {
+		if err := n.engine.CreateRecord(ctx, data); err != nil {
+			return repository.Change{}, err
+		}
+		id, ok := repository.FormatID(data["id"])
+		if !ok {
+			return repository.Change{}, dberr.ErrInvalidIDType
+		}
+		return repository.Change{Op: repository.OpCreate, ID: id, Record: copyRecord(data)}, nil
+	})
+}
+
+// ReadRecord reads from the engine. Followers may return a record as it was
+// a moment ago on the leader
+func (n *Node) ReadRecord(ctx context.Context, id repository.ID) (map[string]interface{}, error) {
+	return n.engine.ReadRecord(ctx, id)
+}
+
+// UpdateRecord updates the record on a leader and logs it
+func (n *Node) UpdateRecord(ctx context.Context, id repository.ID, data map[string]interface{}) error {
+	return n.change(ctx, func() (repository.Change, error) {
+		if err := n.engine.UpdateRecord(ctx, id, data); err != nil {
+			return repository.Change{}, err
+		}
+		return repository.Change{Op: repository.OpUpdate, ID: id, Record: copyRecord(data)}, nil
+	})
+}
+
+// DeleteRecord deletes the record on a leader and logs it
+func (n *Node) DeleteRecord(ctx context.Context, id repository.ID) error {
+	return n.change(ctx, func() (repository.Change, error) {
+		if err := n.engine.DeleteRecord(ctx, id); err != nil {
+			return repository.Change{}, err
+		}
+		return repository.Change{Op: repository.OpDelete, ID: id}, nil
+	})
+}
+
+// change makes a change through fn and logs it. Changes are made one at a
+// time, so the log holds them in the order the engine saw them
+func (n *Node) change(ctx context.Context, fn func() (repository.Change, error)) error {
+	if err := n.writeMu.Lock(ctx); err != nil {
+		return err
+	}
+	defer n.writeMu.Unlock()
+
+	n.mu.Lock()
+	role, leader := n.role, n.leader
+	n.mu.Unlock()
+	if role != RoleLeader {
+		return fmt.Errorf("%w, send changes to %s", dberr.ErrNotLeader, leader)
+	}
+
+	change, err := fn()
+	if err != nil {
+		return err
+	}
+	n.append(change)
+	return nil
+}
+
+// append adds change to the log and wakes the followers waiting for it
+func (n *Node) append(change repository.Change) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	n.index++
+	n.indexTime = time.Now()
+	n.entries = append(n.entries, Entry{Index: n.index, Time: n.indexTime, Change: change})
+	if drop := len(n.entries) - n.retention; drop > 0 {
+		n.entries = append([]Entry(nil), n.entries[drop:]...)
+	}
+	close(n.appended)
+	n.appended = make(chan struct{})
+}
+
+// copyRecord returns a shallow copy of record, so the log does not change
+// with the caller's map
+func copyRecord(record map[string]interface{}) map[string]interface{} {
+	c := make(map[string]interface{}, len(record))
+	for k, v := range record {
+		c[k] = v
+	}
+	return c
+}
+
+// Entries returns the entries of the log following after, waiting until ctx
+// is done for one to be appended when there are none. follower names the
+// caller in the status of the leader, empty leaves it out. It fails with
+// ErrResync when logID is not the current log or after is out of its range
+func (n *Node) Entries(ctx context.Context, logID string, after uint64, follower string) (Batch, error) {
+	for {
+		n.mu.Lock()
+		if n.role != RoleLeader {
+			leader := n.leader
+			n.mu.Unlock()
+			return Batch{}, fmt.Errorf("%w, the leader is %s", dberr.ErrNotLeader, leader)
+		}
+		if follower != "" {
+			n.followers[follower] = FollowerStatus{Name: follower, Index: after, LastSeen: time.Now()}
+		}
+
+		first := n.index + 1
+		if len(n.entries) > 0 {
+			first = n.entries[0].Index
+		}
+		if logID != n.logID || after > n.index || after+1 < first {
+			n.mu.Unlock()
+			return Batch{}, ErrResync
+		}
+
+		batch := Batch{LogID: n.logID, Head: n.index, HeadTime: n.indexTime}
+		if after < n.index {
+			start := after + 1 - first
+			end := min(uint64(len(n.entries)), start+maxBatch)
+			batch.Entries = append([]Entry(nil), n.entries[start:end]...)
+			n.mu.Unlock()
+			return batch, nil
+		}
+		appended := n.appended
+		n.mu.Unlock()
+
+		select {
+		case <-appended:
+		case <-ctx.Done():
+			batch.Entries = []Entry{}
+			return batch, nil
+		}
+	}
+}
+
+// State returns the content of a leader along with the log position it is
+// at, for followers to start from
+func (n *Node) State(ctx context.Context) (*State, error) {
+	if err := n.writeMu.Lock(ctx); err != nil {
+		return nil, err
+	}
+	defer n.writeMu.Unlock()
+
+	n.mu.Lock()
+	role, leader := n.role, n.leader
+	state := &State{LogID: n.logID, Index: n.index, Time: n.indexTime}
+	n.mu.Unlock()
+	if role != RoleLeader {
+		return nil, fmt.Errorf("%w, the leader is %s", dberr.ErrNotLeader, leader)
+	}
+
+	snap, _, err := n.engine.Snapshot(ctx)
+	if err != nil {
+		return nil, err
+	}
+	state.Seq = snap.Header.Seq
+	state.IDStrategy = snap.Header.IDStrategy
+	state.Records = snap.Records
+	if state.Records == nil {
+		state.Records = []map[string]interface{}{}
+	}
+	return state, nil
+}
+
+// Status reports the role of the node and its replication lag
+func (n *Node) Status() Status {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	status := Status{Role: n.role, LogID: n.logID, Index: n.index}
+	if n.role == RoleLeader {
+		status.LeaderIndex = n.index
+		for _, follower := range n.followers {
+			follower.Lag = n.index - min(follower.Index, n.index)
+			status.Followers = append(status.Followers, follower)
+		}
+		sort.Slice(status.Followers, func(i, j int) bool { return status.Followers[i].Name < status.Followers[j].Name })
+		return status
+	}
+
+	status.Leader = n.leader
+	status.LeaderIndex = n.head
+	status.Error = n.lastErr
+	if !n.lastContact.IsZero() {
+		lastContact := n.lastContact
+		status.LastContact = &lastContact
+	}
+	if n.logID == "" {
+		// Nothing is known of the position until the resync is done
+		status.Lag = n.head
+		return status
+	}
+	if n.head > n.index {
+		status.Lag = n.head - n.index
+		status.LagSeconds = max(n.headTime.Sub(n.indexTime).Seconds(), 0)
+	}
+	return status
+}
+
+// Promote makes a follower the leader of a new log. Its former leader's
+// followers have to be pointed at it with Follow
+func (n *Node) Promote(ctx context.Context) error {
+	n.admin.Lock()
+	defer n.admin.Unlock()
+
+	n.stopFollowing()
+	if err := n.writeMu.Lock(ctx); err != nil {
+		return err
+	}
+	defer n.writeMu.Unlock()
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.role == RoleLeader {
+		return nil
+	}
+	n.role = RoleLeader
+	n.logID = newLogID()
+	n.entries = nil
+	n.index = 0
+	n.indexTime = time.Time{}
+	n.followers = map[string]FollowerStatus{}
+	n.leader, n.head, n.headTime, n.lastContact, n.lastErr = "", 0, time.Time{}, time.Time{}, ""
+	return nil
+}
+
+// Follow makes the node a follower of the leader at the given URL. It first copies
+// the leader's content over its own, then applies the leader's changes as
+// they are made, until Promote, another Follow or Close
+func (n *Node) Follow(ctx context.Context, leader string) error {
+	n.admin.Lock()
+	defer n.admin.Unlock()
+
+	n.stopFollowing()
+	if err := n.writeMu.Lock(ctx); err != nil {
+		return err
+	}
+	defer n.writeMu.Unlock()
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.role = RoleFollower
+	n.leader = strings.TrimSuffix(leader, "/")
+	n.logID = ""
+	n.entries = nil
+	n.followers = map[string]FollowerStatus{}
+	n.head, n.headTime, n.lastContact, n.lastErr = 0, time.Time{}, time.Time{}, ""
+	n.stop = make(chan struct{})
+	n.stopped = make(chan struct{})
+	go n.follow(n.leader, n.stop, n.stopped)
+	return nil
+}
+
+// Close stops following the leader. The engine is left open
+func (n *Node) Close() error {
+	n.admin.Lock()
+	defer n.admin.Unlock()
+
+	n.stopFollowing()
+	return nil
+}
+
+// stopFollowing stops the follower loop and waits for it to be gone,
+// n.admin must be held
+func (n *Node) stopFollowing() {
+	n.mu.Lock()
+	stop, stopped := n.stop, n.stopped
+	n.stop, n.stopped = nil, nil
+	n.mu.Unlock()
+
+	if stop != nil {
+		close(stop)
+		<-stopped
+	}
+}
@@ -0,0 +1,270 @@
+package replication
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+	"zabbixhw/pkg/repository"
+	"zabbixhw/pkg/repository/dberr"
+	"zabbixhw/pkg/repository/filedb"
+)
+
+// newTestNode opens a fresh engine and wraps it in a node
+func newTestNode(t *testing.T, opts ...Option) *Node {
+	t.Helper()
+
+	db, err := filedb.Open(filepath.Join(t.TempDir(), "db.json"))
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	n := NewNode(db, append([]Option{WithPollWait(100 * time.Millisecond), WithRetryInterval(10 * time.Millisecond)}, opts...)...)
+	t.Cleanup(func() {
+		n.Close()
+		db.Close()
+	})
+	return n
+}
+
+// serve answers followers of n like the API server does
+func serve(t *testing.T, n *Node) *httptest.Server {
+	t.Helper()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET "+LogPath, func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		after, _ := strconv.ParseUint(query.Get("after"), 10, 64)
+		wait, _ := time.ParseDuration(query.Get("wait"))
+		ctx, cancel := context.WithTimeout(r.Context(), wait)
+		defer cancel()
+		batch, err := n.Entries(ctx, query.Get("log"), after, query.Get("follower"))
+		respond(w, batch, err)
+	})
+	mux.HandleFunc("GET "+SnapshotPath, func(w http.ResponseWriter, r *http.Request) {
+		state, err := n.State(r.Context())
+		respond(w, state, err)
+	})
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	return server
+}
+
+func respond(w http.ResponseWriter, v interface{}, err error) {
+	switch {
+	case errors.Is(err, ErrResync):
+		w.WriteHeader(http.StatusGone)
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+	default:
+		json.NewEncoder(w).Encode(v)
+	}
+}
+
+// waitCaughtUp waits for follower to have applied the whole log of leader
+func waitCaughtUp(t *testing.T, follower, leader *Node) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		expected, status := leader.Status(), follower.Status()
+		if status.LogID == expected.LogID && status.Index == expected.Index {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("follower did not catch up: %+v, leader %+v", status, expected)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// create creates a record named name through n and returns its ID
+func create(t *testing.T, n *Node, name string) repository.ID {
+	t.Helper()
+
+	record := map[string]interface{}{"name": name}
+	if err := n.CreateRecord(context.Background(), record); err != nil {
+		t.Fatalf("CreateRecord failed: %v", err)
+	}
+	id, _ := repository.FormatID(record["id"])
+	return id
+}
+
+// expectName checks the name of the record with the given ID on n
+func expectName(t *testing.T, n *Node, id repository.ID, expected string) {
+	t.Helper()
+
+	record, err := n.ReadRecord(context.Background(), id)
+	if err != nil || record["name"] != expected {
+		t.Errorf("expected %s as %s, got %v (%v)", expected, id, record, err)
+	}
+}
+
+func Test_Entries(t *testing.T) {
+	ctx := context.Background()
+	leader := newTestNode(t, WithRetention(3))
+	logID := leader.Status().LogID
+	for _, name := range []string{"a", "b", "c"} {
+		create(t, leader, name)
+	}
+
+	batch, err := leader.Entries(ctx, logID, 1, "replica")
+	if err != nil || len(batch.Entries) != 2 || batch.Head != 3 || batch.Entries[0].Index != 2 || batch.Entries[0].Op != repository.OpCreate {
+		t.Fatalf("unexpected batch %+v (%v)", batch, err)
+	}
+	if followers := leader.Status().Followers; len(followers) != 1 || followers[0].Name != "replica" || followers[0].Lag != 2 {
+		t.Errorf("expected the follower 2 entries behind, got %+v", followers)
+	}
+
+	// With nothing new the request waits for the next entry
+	appended := make(chan Batch)
+	go func() {
+		ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+		defer cancel()
+		batch, _ := leader.Entries(ctx, logID, 3, "")
+		appended <- batch
+	}()
+	time.Sleep(10 * time.Millisecond)
+	if err := leader.UpdateRecord(ctx, "1", map[string]interface{}{"name": "A"}); err != nil {
+		t.Fatalf("UpdateRecord failed: %v", err)
+	}
+	if batch := <-appended; len(batch.Entries) != 1 || batch.Entries[0].Op != repository.OpUpdate || batch.Entries[0].Record["name"] != "A" {
+		t.Errorf("expected the update, got %+v", batch)
+	}
+
+	timeout, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	if batch, err := leader.Entries(timeout, logID, 4, ""); err != nil || len(batch.Entries) != 0 {
+		t.Errorf("expected no entries once the wait is over, got %+v (%v)", batch, err)
+	}
+
+	// Only the last 3 entries are kept
+	for _, position := range []struct {
+		logID string
+		after uint64
+	}{{logID, 0}, {logID, 5}, {"other", 4}} {
+		if _, err := leader.Entries(ctx, position.logID, position.after, ""); !errors.Is(err, ErrResync) {
+			t.Errorf("%s/%d: expected %v, got %v", position.logID, position.after, ErrResync, err)
+		}
+	}
+	if _, err := leader.Entries(ctx, logID, 1, ""); err != nil {
+		t.Errorf("expected the retained entries, got %v", err)
+	}
+}
+
+func Test_Replication(t *testing.T) {
+	ctx := context.Background()
+	leader := newTestNode(t)
+	leaderServer := serve(t, leader)
+	create(t, leader, "before")
+
+	followers := []*Node{newTestNode(t, WithName("f1")), newTestNode(t, WithName("f2"))}
+	for _, follower := range followers {
+		if err := follower.Follow(ctx, leaderServer.URL+"/"); err != nil {
+			t.Fatalf("Follow failed: %v", err)
+		}
+	}
+
+	id := create(t, leader, "after")
+	if err := leader.UpdateRecord(ctx, "1", map[string]interface{}{"name": "updated"}); err != nil {
+		t.Fatalf("UpdateRecord failed: %v", err)
+	}
+	for _, follower := range followers {
+		waitCaughtUp(t, follower, leader)
+		expectName(t, follower, "1", "updated")
+		expectName(t, follower, id, "after")
+
+		status := follower.Status()
+		if status.Role != RoleFollower || status.Leader != leaderServer.URL || status.Lag != 0 || status.LastContact == nil {
+			t.Errorf("unexpected follower status %+v", status)
+		}
+		if err := follower.CreateRecord(ctx, map[string]interface{}{"name": "rejected"}); !errors.Is(err, dberr.ErrNotLeader) {
+			t.Errorf("expected %v, got %v", dberr.ErrNotLeader, err)
+		}
+		if _, err := follower.Entries(ctx, status.LogID, 0, ""); !errors.Is(err, dberr.ErrNotLeader) {
+			t.Errorf("expected %v, got %v", dberr.ErrNotLeader, err)
+		}
+	}
+
+	// The first follower takes over, the second one follows it from there on
+	if err := followers[0].Promote(ctx); err != nil {
+		t.Fatalf("Promote failed: %v", err)
+	}
+	if err := followers[1].Follow(ctx, serve(t, followers[0]).URL); err != nil {
+		t.Fatalf("Follow failed: %v", err)
+	}
+	id = create(t, followers[0], "promoted")
+	if id != "3" {
+		t.Errorf("expected the promoted leader to go on from the sequence, got %s", id)
+	}
+	waitCaughtUp(t, followers[1], followers[0])
+	expectName(t, followers[1], id, "promoted")
+	if status := followers[0].Status(); status.Role != RoleLeader || status.LogID == leader.Status().LogID {
+		t.Errorf("expected the promoted node to lead a new log, got %+v", status)
+	}
+}
+
+func Test_ReplicationResync(t *testing.T) {
+	ctx := context.Background()
+	leader := newTestNode(t, WithRetention(2))
+	server := serve(t, leader)
+	follower := newTestNode(t)
+	create(t, follower, "local")
+
+	// The follower's own records are replaced with the leader's
+	if err := follower.Follow(ctx, server.URL); err != nil {
+		t.Fatalf("Follow failed: %v", err)
+	}
+	waitCaughtUp(t, follower, leader)
+	if _, err := follower.ReadRecord(ctx, "1"); !errors.Is(err, dberr.ErrNotFound) {
+		t.Errorf("expected the local record gone, got %v", err)
+	}
+
+	// Once stopped, the follower falls behind the entries the leader keeps
+	follower.Close()
+	for _, name := range []string{"a", "b", "c", "d"} {
+		create(t, leader, name)
+	}
+	if status := follower.Status(); status.Index != 0 {
+		t.Fatalf("expected the stopped follower left behind, got %+v", status)
+	}
+	if err := follower.Follow(ctx, server.URL); err != nil {
+		t.Fatalf("Follow failed: %v", err)
+	}
+	waitCaughtUp(t, follower, leader)
+	expectName(t, follower, "4", "d")
+	expectName(t, follower, "1", "a")
+}
+
+func Test_ReplicationLag(t *testing.T) {
+	ctx := context.Background()
+	leader := newTestNode(t)
+	follower := newTestNode(t)
+
+	// Without a leader to reach, the follower reports why
+	if err := follower.Follow(ctx, "http://127.0.0.1:1"); err != nil {
+		t.Fatalf("Follow failed: %v", err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for follower.Status().Error == "" {
+		if time.Now().After(deadline) {
+			t.Fatal("expected the follower to report the error")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// A follower knows how far behind it is from the head of each batch
+	follower.Close()
+	follower.mu.Lock()
+	follower.logID = leader.Status().LogID
+	follower.index, follower.indexTime = 2, time.Unix(100, 0)
+	follower.head, follower.headTime = 5, time.Unix(130, 0)
+	follower.mu.Unlock()
+	if status := follower.Status(); status.Lag != 3 || status.LagSeconds != 30 || status.LeaderIndex != 5 {
+		t.Errorf("expected 3 entries and 30s behind, got %+v", status)
+	}
+}
@@ -0,0 +1,33 @@
+package dberr
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Error kinds shared by every storage engine. Engines return these directly or
+// wrap them with more detail, callers test for them with errors.Is
+var (
+	ErrNotFound           = errors.New("record not found")
+	ErrConflict           = errors.New("conflict")
+	ErrValidation         = errors.New("validation failed")
+	ErrInvalidIDType      = errors.New("invalid ID type in record")
+	ErrStorageUnavailable = errors.New("storage unavailable")
+	ErrReadOnly           = errors.New("database is read-only")
+	ErrNotLeader          = errors.New("not the leader")
+)
+
+// Conflict returns an ErrConflict carrying a description of the conflict
+func Conflict(format string, args ...interface{}) error {
+	return fmt.Errorf("%w: %s", ErrConflict, fmt.Sprintf(format, args...))
+}
+
+// Validation returns an ErrValidation carrying a description of the problem
+func Validation(format string, args ...interface{}) error {
+	return fmt.Errorf("%w: %s", ErrValidation, fmt.Sprintf(format, args...))
+}
+
+// Unavailable marks err as a storage failure while keeping it in the chain
+func Unavailable(err error) error {
+	return fmt.Errorf("%w: %w", ErrStorageUnavailable, err)
+}
@@ -0,0 +1,51 @@
+package dberr
+
+import (
+	"errors"
+	"io"
+	"testing"
+)
+
+func Test_Helpers(t *testing.T) {
+	tests := []struct {
+		name     string
+		err      error
+		kind     error
+		expected string
+	}{
+		{
+			name:     "Conflict",
+			err:      Conflict("record %s changed", "5"),
+			kind:     ErrConflict,
+			expected: "conflict: record 5 changed",
+		},
+		{
+			name:     "Validation",
+			err:      Validation("field %q is not allowed", "id"),
+			kind:     ErrValidation,
+			expected: `validation failed: field "id" is not allowed`,
+		},
+		{
+			name:     "Unavailable",
+			err:      Unavailable(io.ErrShortWrite),
+			kind:     ErrStorageUnavailable,
+			expected: "storage unavailable: short write",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if !errors.Is(tt.err, tt.kind) {
+				t.Errorf("expected error to be %v", tt.kind)
+			}
+			if tt.err.Error() != tt.expected {
+				t.Errorf("expected %q, got %q", tt.expected, tt.err.Error())
+			}
+		})
+	}
+
+	// The underlying cause stays reachable
+	if !errors.Is(Unavailable(io.ErrShortWrite), io.ErrShortWrite) {
+		t.Error("expected wrapped cause to be preserved")
+	}
+}
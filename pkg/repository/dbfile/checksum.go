@@ -0,0 +1,399 @@
+package dbfile
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	iofs "io/fs"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+	"zabbixhw/pkg/fsys"
+)
+
+// ChecksumCRC32C is the only checksum algorithm written so far
+const ChecksumCRC32C = "crc32c"
+
+var (
+	ErrChecksum      = errors.New("checksum mismatch")
+	ErrUnknownPolicy = errors.New("unknown verify policy")
+)
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// Checksums seal the records of a file. Record checksums cover the JSON
+// encoding of each record, the file checksum covers the header and the
+// record checksums in order, so dropped or reordered records show up too
+type Checksums struct {
+	Algorithm string   `json:"algorithm"`
+	File      string   `json:"file"`
+	Records   []string `json:"records"`
+}
+
+// recordChecksum returns the checksum of an encoded record
+func recordChecksum(encoded []byte) string {
+	return fmt.Sprintf("%08x", crc32.Checksum(encoded, castagnoli))
+}
+
+// marshalRecord returns the JSON encoding of a record, the bytes json.Marshal
+// returns. Records made of the generic values a decoded file holds take a
+// fast path, anything else is left to json.Marshal
+func marshalRecord(record map[string]interface{}) ([]byte, error) {
+	if encoded, ok := appendJSON(make([]byte, 0, 256), record); ok {
+		return encoded, nil
+	}
+	return json.Marshal(record)
+}
+
+// appendJSON appends the JSON encoding of v to buf. It reports false for
+// values it does not know to encode exactly like json.Marshal, such as
+// strings that need escaping
+func appendJSON(buf []byte, v interface{}) ([]byte, bool) {
+	switch v := v.(type) {
+	case nil:
+		return append(buf, "null"...), true
+	case bool:
+		return strconv.AppendBool(buf, v), true
+	case string:
+		if !plainString(v) {
+			return buf, false
+		}
+		buf = append(buf, '"')
+		buf = append(buf, v...)
+		return append(buf, '"'), true
+	case json.Number:
+		if !validNumber(string(v)) {
+			return buf, false
+		}
+		return append(buf, v...), true
+	case map[string]interface{}:
+		if v == nil {
+			return append(buf, "null"...), true
+		}
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		slices.Sort(keys)
+		buf = append(buf, '{')
+		for i, key := range keys {
+			if i > 0 {
+				buf = append(buf, ',')
+			}
+			var ok bool
+			if buf, ok = appendJSON(buf, key); !ok {
+				return buf, false
+			}
+			buf = append(buf, ':')
+			if buf, ok = appendJSON(buf, v[key]); !ok {
+				return buf, false
+			}
+		}
+		return append(buf, '}'), true
+	case []interface{}:
+		if v == nil {
+			return append(buf, "null"...), true
+		}
+		buf = append(buf, '[')
+		for i, elem := range v {
+			if i > 0 {
+				buf = append(buf, ',')
+			}
+			var ok bool
+			if buf, ok = appendJSON(buf, elem); !ok {
+				return buf, false
+			}
+		}
+		return append(buf, ']'), true
+	}
+	return buf, false
+}
+
+// plainString reports whether s is written to JSON as it is: valid UTF-8
+// without quotes, backslashes, control characters or the characters
+// json.Marshal escapes for HTML and JavaScript
+func plainString(s string) bool {
+	ascii := true
+	for i := 0; i < len(s); i++ {
+		switch b := s[i]; {
+		case b >= utf8.RuneSelf:
+			ascii = false
+		case b < 0x20, b == '"', b == '\\', b == '<', b == '>', b == '&':
+			return false
+		}
+	}
+	return ascii || utf8.ValidString(s) && !strings.ContainsAny(s, "\u2028\u2029")
+}
+
+// validNumber reports whether s is a JSON number literal
+func validNumber(s string) bool {
+	s = strings.TrimPrefix(s, "-")
+	switch {
+	case s == "":
+		return false
+	case s[0] == '0':
+		s = s[1:]
+	case s[0] >= '1' && s[0] <= '9':
+		s = skipDigits(s[1:])
+	default:
+		return false
+	}
+	if len(s) >= 2 && s[0] == '.' && isDigit(s[1]) {
+		s = skipDigits(s[2:])
+	}
+	if len(s) >= 2 && (s[0] == 'e' || s[0] == 'E') {
+		s = s[1:]
+		if s[0] == '+' || s[0] == '-' {
+			s = s[1:]
+		}
+		if s == "" || !isDigit(s[0]) {
+			return false
+		}
+		s = skipDigits(s)
+	}
+	return s == ""
+}
+
+// skipDigits returns s without its leading digits
+func skipDigits(s string) string {
+	for len(s) > 0 && isDigit(s[0]) {
+		s = s[1:]
+	}
+	return s
+}
+
+func isDigit(b byte) bool {
+	return b >= '0' && b <= '9'
+}
+
+// fileChecksum returns the checksum over the header and record checksums
+func fileChecksum(header Header, records []string) string {
+	h := crc32.New(castagnoli)
+	var seq [8]byte
+	binary.BigEndian.PutUint64(seq[:], header.Seq)
+	h.Write(seq[:])
+	h.Write([]byte(header.IDStrategy))
+	for _, sum := range records {
+		b, _ := hex.DecodeString(sum)
+		h.Write(b)
+	}
+	return fmt.Sprintf("%08x", h.Sum32())
+}
+
+// seal encodes every record and computes the checksums of the snapshot
+func seal(snap *Snapshot) ([]json.RawMessage, *Checksums, error) {
+	encoded := make([]json.RawMessage, len(snap.Records))
+	sums := &Checksums{Algorithm: ChecksumCRC32C, Records: make([]string, len(snap.Records))}
+	for i, record := range snap.Records {
+		b, err := marshalRecord(record)
+		if err != nil {
+			return nil, nil, fmt.Errorf("error encoding record %d: %w", i, err)
+		}
+		encoded[i] = b
+		sums.Records[i] = recordChecksum(b)
+	}
+	sums.File = fileChecksum(snap.Header, sums.Records)
+	return encoded, sums, nil
+}
+
+// IntegrityReport is the outcome of checking a snapshot against its checksums
+type IntegrityReport struct {
+	Checked      bool  `json:"checked"` // False when the file carries no checksums
+	Records      int   `json:"records"`
+	BadRecords   []int `json:"badRecords,omitempty"` // Positions of records whose content does not match
+	BadLines     []int `json:"badLines,omitempty"`   // NDJSON lines that could not be decoded
+	FileMismatch bool  `json:"fileMismatch"`         // Header or record list does not match
+}
+
+// OK reports whether nothing failed verification
+func (r IntegrityReport) OK() bool {
+	return len(r.BadRecords) == 0 && len(r.BadLines) == 0 && !r.FileMismatch
+}
+
+func (r IntegrityReport) String() string {
+	switch {
+	case len(r.BadLines) > 0 && !r.Checked:
+		return fmt.Sprintf("%d records, bad lines %v, no checksums", r.Records, r.BadLines)
+	case len(r.BadLines) > 0:
+		return fmt.Sprintf("%d records, bad lines %v, bad records %v, file checksum mismatch %t", r.Records, r.BadLines, r.BadRecords, r.FileMismatch)
+	case !r.Checked:
+		return fmt.Sprintf("%d records, no checksums", r.Records)
+	case r.OK():
+		return fmt.Sprintf("%d records, checksums ok", r.Records)
+	default:
+		return fmt.Sprintf("%d records, bad records %v, file checksum mismatch %t", r.Records, r.BadRecords, r.FileMismatch)
+	}
+}
+
+// CheckIntegrity compares the records of a decoded snapshot with the
+// checksums stored alongside them. Lines Read skipped are reported too
+func CheckIntegrity(snap *Snapshot) IntegrityReport {
+	report := IntegrityReport{Records: len(snap.Records)}
+	for _, skipped := range snap.Skipped {
+		report.BadLines = append(report.BadLines, skipped.Line)
+	}
+	sums := snap.Checksums
+	if sums == nil {
+		return report
+	}
+	report.Checked = true
+
+	if sums.Algorithm != ChecksumCRC32C || len(sums.Records) != len(snap.Records) {
+		report.FileMismatch = true
+	}
+	for i, record := range snap.Records {
+		b, err := marshalRecord(record)
+		if err != nil || i >= len(sums.Records) || recordChecksum(b) != sums.Records[i] {
+			report.BadRecords = append(report.BadRecords, i)
+		}
+	}
+	if !report.FileMismatch && fileChecksum(snap.Header, sums.Records) != sums.File {
+		report.FileMismatch = true
+	}
+	return report
+}
+
+// Policy decides what opening a database does about checksum failures
+type Policy string
+
+const (
+	PolicyFail       Policy = "fail"       // Refuse to open
+	PolicyQuarantine Policy = "quarantine" // Set bad records aside and open with the rest
+	PolicyWarn       Policy = "warn"       // Open with every record, the caller reports the failure
+)
+
+// ParsePolicy validates a policy name
+func ParsePolicy(name string) (Policy, error) {
+	switch p := Policy(name); p {
+	case PolicyFail, PolicyQuarantine, PolicyWarn:
+		return p, nil
+	}
+	return "", fmt.Errorf("%w %q", ErrUnknownPolicy, name)
+}
+
+// Quarantined is a record set aside because its checksum did not match, or
+// an NDJSON line that could not be decoded at all
+type Quarantined struct {
+	Index  int                    `json:"index"`
+	Line   int                    `json:"line,omitempty"`
+	Record map[string]interface{} `json:"record,omitempty"`
+	Raw    string                 `json:"raw,omitempty"`   // Content of an undecodable line
+	Error  string                 `json:"error,omitempty"` // Why the line could not be decoded
+}
+
+// Enforce checks the snapshot and applies policy. With PolicyQuarantine the
+// bad records are removed from snap and returned. A file checksum mismatch
+// with intact records cannot be narrowed down, so only PolicyFail refuses it.
+// Lines Read skipped cannot be served under any policy, they are returned
+// unless the policy is PolicyFail
+func Enforce(snap *Snapshot, policy Policy) (IntegrityReport, []Quarantined, error) {
+	report := CheckIntegrity(snap)
+	if report.OK() {
+		return report, nil, nil
+	}
+
+	var quarantined []Quarantined
+	for _, skipped := range snap.Skipped {
+		quarantined = append(quarantined, Quarantined{Index: -1, Line: skipped.Line, Raw: skipped.Raw, Error: skipped.Err.Error()})
+	}
+
+	switch policy {
+	case PolicyFail:
+		return report, nil, fmt.Errorf("%w: %s", ErrChecksum, report)
+	case PolicyWarn:
+		return report, quarantined, nil
+	case PolicyQuarantine:
+		bad := make(map[int]bool, len(report.BadRecords))
+		for _, i := range report.BadRecords {
+			bad[i] = true
+		}
+		kept := make([]map[string]interface{}, 0, len(snap.Records)-len(bad))
+		for i, record := range snap.Records {
+			if bad[i] {
+				quarantined = append(quarantined, Quarantined{Index: i, Record: record})
+			} else {
+				kept = append(kept, record)
+			}
+		}
+		snap.Records = kept
+		return report, quarantined, nil
+	default:
+		return report, nil, fmt.Errorf("%w %q", ErrUnknownPolicy, policy)
+	}
+}
+
+// QuarantinePath returns the path of the file that quarantined records of the
+// database at path are kept in
+func QuarantinePath(path string) string {
+	return path + ".quarantine"
+}
+
+// SaveQuarantine appends quarantined records to the quarantine file of the
+// database at path, one JSON object per line. With keys the file is
+// encrypted with the primary key, and rewritten as a whole to append
+func SaveQuarantine(fs fsys.FS, path string, quarantined []Quarantined, keys *Keyring) error {
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	for _, q := range quarantined {
+		if err := encoder.Encode(q); err != nil {
+			return fmt.Errorf("error writing quarantine file: %w", err)
+		}
+	}
+
+	if keys != nil {
+		return saveQuarantineEncrypted(fs, QuarantinePath(path), buf.Bytes(), keys)
+	}
+
+	file, err := fs.OpenFile(QuarantinePath(path), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return fmt.Errorf("error opening quarantine file: %w", err)
+	}
+	if _, err := file.Write(buf.Bytes()); err != nil {
+		file.Close()
+		return fmt.Errorf("error writing quarantine file: %w", err)
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return fmt.Errorf("error syncing quarantine file: %w", err)
+	}
+	return file.Close()
+}
+
+// saveQuarantineEncrypted appends lines to the encrypted quarantine file at
+// path. A plaintext file left from before keys were set is encrypted too
+func saveQuarantineEncrypted(fs fsys.FS, path string, lines []byte, keys *Keyring) error {
+	content, err := readAll(fs, path)
+	if err != nil && !errors.Is(err, iofs.ErrNotExist) {
+		return fmt.Errorf("error reading quarantine file: %w", err)
+	}
+	content, _, err = Decrypt(content, keys)
+	if err != nil {
+		return fmt.Errorf("error reading quarantine file: %w", err)
+	}
+
+	sealed, err := Encrypt(append(content, lines...), keys.Primary())
+	if err != nil {
+		return err
+	}
+	if err := fsys.WriteFile(fs, path, sealed, 0600); err != nil {
+		return fmt.Errorf("error writing quarantine file: %w", err)
+	}
+	return nil
+}
+
+// readAll returns the content of the file at path
+func readAll(fs fsys.FS, path string) ([]byte, error) {
+	file, err := fs.OpenFile(path, os.O_RDONLY, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return io.ReadAll(file)
+}
@@ -0,0 +1,244 @@
+package dbfile
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	iofs "io/fs"
+	"reflect"
+	"strings"
+	"testing"
+	"zabbixhw/pkg/fsys"
+	"zabbixhw/pkg/repository/idgen"
+)
+
+// sealed encodes three records and returns the file content
+func sealed(t *testing.T) string {
+	t.Helper()
+
+	snap := &Snapshot{
+		Header: Header{Seq: 3, IDStrategy: idgen.NameSequential},
+		Records: []map[string]interface{}{
+			{"id": json.Number("1"), "name": "Alice"},
+			{"id": json.Number("2"), "name": "Bob"},
+			{"id": json.Number("3"), "name": "Carol", "big": json.Number("123456789012345678901234567890")},
+		},
+	}
+	var buf bytes.Buffer
+	if err := Encode(&buf, snap); err != nil {
+		t.Fatalf("Encode failed: %v", err)
+	}
+	return buf.String()
+}
+
+func decode(t *testing.T, content string) *Snapshot {
+	t.Helper()
+
+	snap, err := Decode([]byte(content))
+	if err != nil {
+		t.Fatalf("Decode failed: %v", err)
+	}
+	return snap
+}
+
+func Test_CheckIntegrity(t *testing.T) {
+	content := sealed(t)
+
+	tests := []struct {
+		name     string
+		content  string
+		expected IntegrityReport
+	}{
+		{
+			name:     "Intact",
+			content:  content,
+			expected: IntegrityReport{Checked: true, Records: 3},
+		},
+		{
+			name:     "Bit flip in a value",
+			content:  strings.Replace(content, `"Bob"`, `"Bnb"`, 1),
+			expected: IntegrityReport{Checked: true, Records: 3, BadRecords: []int{1}},
+		},
+		{
+			name:     "Header changed",
+			content:  strings.Replace(content, `"seq":3`, `"seq":4`, 1),
+			expected: IntegrityReport{Checked: true, Records: 3, FileMismatch: true},
+		},
+		{
+			name:     "Formatting changed",
+			content:  strings.ReplaceAll(content, `,"`, `, "`),
+			expected: IntegrityReport{Checked: true, Records: 3},
+		},
+		{
+			name:     "No checksums",
+			content:  `{"header":{"seq":1},"records":[{"id":1}]}`,
+			expected: IntegrityReport{Records: 1},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := CheckIntegrity(decode(t, tt.content)); !reflect.DeepEqual(got, tt.expected) {
+				t.Errorf("expected %+v, got %+v", tt.expected, got)
+			}
+		})
+	}
+
+	t.Run("Record dropped with its checksum", func(t *testing.T) {
+		snap := decode(t, content)
+		snap.Records = snap.Records[1:]
+		snap.Checksums.Records = snap.Checksums.Records[1:]
+		if report := CheckIntegrity(snap); !report.FileMismatch || len(report.BadRecords) != 0 {
+			t.Errorf("expected only a file mismatch, got %+v", report)
+		}
+	})
+}
+
+func Test_Enforce(t *testing.T) {
+	corrupt := strings.Replace(sealed(t), `"Bob"`, `"Bnb"`, 1)
+
+	t.Run("Fail", func(t *testing.T) {
+		if _, _, err := Enforce(decode(t, corrupt), PolicyFail); !errors.Is(err, ErrChecksum) {
+			t.Errorf("expected %v, got %v", ErrChecksum, err)
+		}
+	})
+
+	t.Run("Quarantine", func(t *testing.T) {
+		snap := decode(t, corrupt)
+		report, quarantined, err := Enforce(snap, PolicyQuarantine)
+		if err != nil {
+			t.Fatalf("Enforce failed: %v", err)
+		}
+		if report.OK() || len(snap.Records) != 2 {
+			t.Errorf("expected 2 records left and a failed report, got %d and %+v", len(snap.Records), report)
+		}
+		if len(quarantined) != 1 || quarantined[0].Index != 1 || quarantined[0].Record["name"] != "Bnb" {
+			t.Errorf("unexpected quarantine %+v", quarantined)
+		}
+	})
+
+	t.Run("Warn", func(t *testing.T) {
+		snap := decode(t, corrupt)
+		report, quarantined, err := Enforce(snap, PolicyWarn)
+		if err != nil || report.OK() || quarantined != nil || len(snap.Records) != 3 {
+			t.Errorf("expected every record kept with a failed report, got %+v, %v, %v", report, quarantined, err)
+		}
+	})
+
+	t.Run("Intact file passes any policy", func(t *testing.T) {
+		if _, _, err := Enforce(decode(t, sealed(t)), PolicyFail); err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+	})
+
+	if _, err := ParsePolicy("ignore"); !errors.Is(err, ErrUnknownPolicy) {
+		t.Errorf("expected %v, got %v", ErrUnknownPolicy, err)
+	}
+}
+
+func Test_VerifyChecksums(t *testing.T) {
+	corrupt := strings.Replace(sealed(t), `"seq":3`, `"seq":4`, 1)
+	corrupt = strings.Replace(corrupt, `"Bob"`, `"Bnb"`, 1)
+
+	raw, err := DecodeRaw([]byte(corrupt))
+	if err != nil {
+		t.Fatalf("DecodeRaw failed: %v", err)
+	}
+	var kinds []ProblemKind
+	for _, p := range Verify(raw, idgen.Sequential{}) {
+		kinds = append(kinds, p.Kind)
+	}
+	if expected := []ProblemKind{ProblemFileSum, ProblemChecksum}; !reflect.DeepEqual(kinds, expected) {
+		t.Errorf("expected %v, got %v", expected, kinds)
+	}
+
+	// Both modes drop the corrupt record and reseal the file
+	for _, mode := range []RepairMode{RepairDrop, RepairRenumber} {
+		snap, _, err := Repair(raw, idgen.Sequential{}, mode)
+		if err != nil {
+			t.Fatalf("Repair failed: %v", err)
+		}
+		if len(snap.Records) != 2 {
+			t.Errorf("%s: expected 2 records, got %d", mode, len(snap.Records))
+		}
+	}
+}
+
+func Test_SaveQuarantine(t *testing.T) {
+	fs := fsys.NewMemFS()
+	batches := [][]Quarantined{
+		{{Index: 1, Record: map[string]interface{}{"id": json.Number("2")}}},
+		{{Index: 0, Record: map[string]interface{}{"id": json.Number("5")}}},
+	}
+	for _, batch := range batches {
+		if err := SaveQuarantine(fs, "db.json", batch, nil); err != nil {
+			t.Fatalf("SaveQuarantine failed: %v", err)
+		}
+	}
+
+	content, err := fs.ReadFile(QuarantinePath("db.json"))
+	if err != nil {
+		t.Fatalf("ReadFile failed: %v", err)
+	}
+	expected := "{\"index\":1,\"record\":{\"id\":2}}\n{\"index\":0,\"record\":{\"id\":5}}\n"
+	if string(content) != expected {
+		t.Errorf("expected %q, got %q", expected, content)
+	}
+	if info, _ := fs.Stat(QuarantinePath("db.json")); info.Mode().Perm() != 0600 {
+		t.Errorf("expected mode %v, got %v", iofs.FileMode(0600), info.Mode().Perm())
+	}
+
+	// With keys the plaintext lines are encrypted along with the new ones
+	keys := testKeyring(t, testKey(t, 1))
+	if err := SaveQuarantine(fs, "db.json", batches[0], keys); err != nil {
+		t.Fatalf("SaveQuarantine with keys failed: %v", err)
+	}
+	content, _ = fs.ReadFile(QuarantinePath("db.json"))
+	if EncryptionKeyID(content) != keys.Primary().ID {
+		t.Fatalf("expected the file to be encrypted, got %q", content)
+	}
+	plain, _, err := Decrypt(content, keys)
+	if err != nil {
+		t.Fatalf("Decrypt failed: %v", err)
+	}
+	if expected += "{\"index\":1,\"record\":{\"id\":2}}\n"; string(plain) != expected {
+		t.Errorf("expected %q, got %q", expected, plain)
+	}
+}
+
+func Test_marshalRecord(t *testing.T) {
+	tests := []struct {
+		name   string
+		record map[string]interface{}
+	}{
+		{name: "Generic values", record: map[string]interface{}{"id": json.Number("1"), "b": true, "n": nil, "list": []interface{}{json.Number("-1.5e3"), "x"}, "map": map[string]interface{}{}}},
+		{name: "Nil containers", record: map[string]interface{}{"list": []interface{}(nil), "map": map[string]interface{}(nil)}},
+		{name: "Unicode", record: map[string]interface{}{"name": "Zoë 日本", "ключ": "значение"}},
+		{name: "Escaped characters", record: map[string]interface{}{"q": `say "hi"\`, "html": "<a&b>", "ctl": "tab\there", "sep": "a b"}},
+		{name: "Invalid UTF-8", record: map[string]interface{}{"bad": "a\xffb"}},
+		{name: "Escaped key", record: map[string]interface{}{"<key>": json.Number("1")}},
+		{name: "Go values", record: map[string]interface{}{"f": 1.5, "i": 7, "s": []string{"a"}}},
+		{name: "Empty number", record: map[string]interface{}{"n": json.Number("")}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			expected, expectedErr := json.Marshal(tt.record)
+			got, err := marshalRecord(tt.record)
+			if !bytes.Equal(got, expected) || (err == nil) != (expectedErr == nil) {
+				t.Errorf("expected %s (%v), got %s (%v)", expected, expectedErr, got, err)
+			}
+		})
+	}
+
+	for _, literal := range []string{"0", "-0", "10", "1.5", "1e9", "1E+9", "-2.5e-3"} {
+		if !validNumber(literal) {
+			t.Errorf("expected %q to be a number", literal)
+		}
+	}
+	for _, literal := range []string{"", "-", "01", "1.", ".5", "1e", "1e+", "+1", "0x1", "NaN"} {
+		if validNumber(literal) {
+			t.Errorf("expected %q not to be a number", literal)
+		}
+	}
+}
@@ -0,0 +1,263 @@
+package dbfile
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// Format is an on-disk layout of the database file
+type Format string
+
+const (
+	FormatSnapshot Format = "snapshot" // Header and records in one JSON document, written by the engines
+	FormatNDJSON   Format = "ndjson"   // Header line, one line per record and a checksums line
+	FormatMsgpack  Format = "msgpack"  // Snapshot document in MessagePack behind a magic prefix
+	FormatLegacy   Format = "legacy"   // Bare array of records, no header
+)
+
+// DetectSize is how much of the start of a file codecs get to detect their
+// layout
+const DetectSize = 512
+
+// Codec reads and writes database files in one layout
+type Codec interface {
+	// Format names the layout
+	Format() Format
+	// Detect reports whether a file starting with prefix is in the layout.
+	// prefix holds the first DetectSize bytes, or the whole file if shorter
+	Detect(prefix []byte) bool
+	// Encode writes the snapshot in the current format version
+	Encode(w io.Writer, snap *Snapshot) error
+	// Decode reads a whole file. With skipBad, records that cannot be decoded
+	// are left out and listed in Snapshot.Skipped where the layout allows it
+	Decode(r io.Reader, skipBad bool) (*Snapshot, error)
+}
+
+var (
+	codecsMu sync.RWMutex
+	// codecs in the order they detect files. The snapshot codec comes last, it
+	// takes whatever no other codec claims
+	codecs = []Codec{msgpackCodec{}, ndjsonCodec{}, legacyCodec{}, snapshotCodec{}}
+)
+
+// Register adds a codec for another layout. Registered codecs detect files
+// before the built-in ones. It panics if the format is already taken
+func Register(codec Codec) {
+	codecsMu.Lock()
+	defer codecsMu.Unlock()
+
+	for _, c := range codecs {
+		if c.Format() == codec.Format() {
+			panic(fmt.Sprintf("dbfile: codec for format %q registered twice", codec.Format()))
+		}
+	}
+	codecs = append([]Codec{codec}, codecs...)
+}
+
+// CodecFor returns the codec of a layout
+func CodecFor(format Format) (Codec, bool) {
+	codecsMu.RLock()
+	defer codecsMu.RUnlock()
+
+	for _, c := range codecs {
+		if c.Format() == format {
+			return c, true
+		}
+	}
+	return nil, false
+}
+
+// detect returns the codec of the file starting with prefix
+func detect(prefix []byte) Codec {
+	codecsMu.RLock()
+	defer codecsMu.RUnlock()
+
+	for _, c := range codecs {
+		if c.Detect(prefix) {
+			return c
+		}
+	}
+	return snapshotCodec{}
+}
+
+// CheckFormat makes sure the engines can write format, empty keeps the
+// format of the file
+func CheckFormat(format Format) error {
+	if format == "" {
+		return nil
+	}
+	// Legacy files have no header to keep the sequence and ID strategy in
+	if _, ok := CodecFor(format); !ok || format == FormatLegacy {
+		return fmt.Errorf("unsupported file format %q", format)
+	}
+	return nil
+}
+
+// WriteFormat returns the layout a file read in format is written back in,
+// legacy files become snapshots
+func WriteFormat(format Format) Format {
+	if format == FormatLegacy {
+		return FormatSnapshot
+	}
+	return format
+}
+
+// DetectFormat tells which layout content uses. Empty content counts as the
+// snapshot format
+func DetectFormat(content []byte) Format {
+	if DetectCompression(content) != CompressionNone {
+		if br, _, err := decompress(bufio.NewReader(bytes.NewReader(content))); err == nil {
+			content, _ = br.Peek(DetectSize)
+		}
+	}
+	if len(content) > DetectSize {
+		content = content[:DetectSize]
+	}
+	return detect(content).Format()
+}
+
+// EncodeFormat writes the snapshot in the given layout. The legacy layout
+// drops the header, so the sequence falls back to the highest ID on the next
+// load
+func EncodeFormat(w io.Writer, snap *Snapshot, format Format) error {
+	codec, ok := CodecFor(format)
+	if !ok {
+		return fmt.Errorf("unknown file format %q", format)
+	}
+	return codec.Encode(w, snap)
+}
+
+// Read decodes a database file of any layout from r, with the codec that
+// detects it. NDJSON and MessagePack files are decoded as they are read, so
+// the file is never held in memory as a whole. With skipBad, NDJSON record
+// lines that cannot be decoded are left out and listed in Snapshot.Skipped,
+// otherwise the first one fails the read with a *LineError. Compressed files
+// are decompressed on the fly, encrypted files fail with ErrEncrypted
+func Read(r io.Reader, skipBad bool) (*Snapshot, error) {
+	return ReadWithKeys(r, skipBad, nil)
+}
+
+// ReadWithKeys is Read for files that may be encrypted with one of keys.
+// Encrypted files are read whole to be authenticated before they are decoded
+func ReadWithKeys(r io.Reader, skipBad bool, keys *Keyring) (*Snapshot, error) {
+	br := bufio.NewReader(r)
+	keyID := ""
+	magic, err := br.Peek(len(encryptMagic))
+	if err != nil && err != io.EOF {
+		return nil, fmt.Errorf("error reading file: %w", err)
+	}
+	if string(magic) == encryptMagic {
+		content, err := io.ReadAll(br)
+		if err != nil {
+			return nil, fmt.Errorf("error reading file: %w", err)
+		}
+		plain, id, err := Decrypt(content, keys)
+		if err != nil {
+			return nil, err
+		}
+		br, keyID = bufio.NewReader(bytes.NewReader(plain)), id
+	}
+
+	br, compression, err := decompress(br)
+	if err != nil {
+		return nil, err
+	}
+	prefix, err := br.Peek(DetectSize)
+	if err != nil && err != io.EOF {
+		return nil, fmt.Errorf("error reading file: %w", err)
+	}
+
+	snap, err := detect(prefix).Decode(br, skipBad)
+	if err != nil {
+		return nil, err
+	}
+	// Reading to the end verifies the checksum of compressed streams
+	if _, err := io.Copy(io.Discard, br); err != nil {
+		return nil, fmt.Errorf("error reading file: %w", err)
+	}
+	snap.Compression = compression
+	snap.KeyID = keyID
+	return snap, nil
+}
+
+// snapshotCodec is the JSON document written by Encode
+type snapshotCodec struct{}
+
+func (snapshotCodec) Format() Format { return FormatSnapshot }
+
+func (snapshotCodec) Detect(prefix []byte) bool {
+	prefix = bytes.TrimLeft(prefix, " \t\r\n")
+	return len(prefix) == 0 || prefix[0] == '{'
+}
+
+func (snapshotCodec) Encode(w io.Writer, snap *Snapshot) error {
+	return Encode(w, snap)
+}
+
+func (snapshotCodec) Decode(r io.Reader, skipBad bool) (*Snapshot, error) {
+	return readDocument(r)
+}
+
+// legacyCodec is a bare JSON array of records
+type legacyCodec struct{}
+
+func (legacyCodec) Format() Format { return FormatLegacy }
+
+func (legacyCodec) Detect(prefix []byte) bool {
+	prefix = bytes.TrimLeft(prefix, " \t\r\n")
+	return len(prefix) > 0 && prefix[0] == '['
+}
+
+func (legacyCodec) Encode(w io.Writer, snap *Snapshot) error {
+	records := snap.Records
+	if records == nil {
+		records = []map[string]interface{}{}
+	}
+	if err := json.NewEncoder(w).Encode(records); err != nil {
+		return fmt.Errorf("error encoding JSON data: %w", err)
+	}
+	return nil
+}
+
+func (legacyCodec) Decode(r io.Reader, skipBad bool) (*Snapshot, error) {
+	return readDocument(r)
+}
+
+// ndjsonCodec is JSON Lines, see EncodeNDJSON
+type ndjsonCodec struct{}
+
+func (ndjsonCodec) Format() Format { return FormatNDJSON }
+
+func (ndjsonCodec) Detect(prefix []byte) bool {
+	return bytes.HasPrefix(bytes.TrimLeft(prefix, " \t\r\n"), []byte(ndjsonPrefix))
+}
+
+func (ndjsonCodec) Encode(w io.Writer, snap *Snapshot) error {
+	return EncodeNDJSON(w, snap)
+}
+
+func (ndjsonCodec) Decode(r io.Reader, skipBad bool) (*Snapshot, error) {
+	br := bufio.NewReader(r)
+	ndjson, blank, err := peekNDJSON(br)
+	if err != nil {
+		return nil, fmt.Errorf("error reading file: %w", err)
+	}
+	if !ndjson {
+		return nil, errors.New("not an NDJSON file")
+	}
+	return readNDJSON(br, skipBad, blank)
+}
+
+// readDocument reads a whole JSON file and decodes it
+func readDocument(r io.Reader) (*Snapshot, error) {
+	content, err := io.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("error reading file: %w", err)
+	}
+	return decodeDocument(content)
+}
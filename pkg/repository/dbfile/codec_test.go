@@ -0,0 +1,140 @@
+package dbfile
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// upperCodec is a test layout: the snapshot format in upper case behind a tag
+type upperCodec struct{}
+
+func (upperCodec) Format() Format { return "upper" }
+
+func (upperCodec) Detect(prefix []byte) bool { return bytes.HasPrefix(prefix, []byte("UPPER ")) }
+
+func (upperCodec) Encode(w io.Writer, snap *Snapshot) error {
+	var buf bytes.Buffer
+	if err := Encode(&buf, snap); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "UPPER "+strings.ToUpper(buf.String()))
+	return err
+}
+
+func (upperCodec) Decode(r io.Reader, skipBad bool) (*Snapshot, error) {
+	content, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	lower := strings.ToLower(strings.TrimPrefix(string(content), "UPPER "))
+	return decodeDocument([]byte(lower))
+}
+
+func Test_DetectFormat(t *testing.T) {
+	tests := []struct {
+		content  string
+		expected Format
+	}{
+		{content: "", expected: FormatSnapshot},
+		{content: `  {"header": {}}`, expected: FormatSnapshot},
+		{content: "\n[]", expected: FormatLegacy},
+		{content: "\n" + `{"format":"ndjson","header":{}}`, expected: FormatNDJSON},
+		{content: msgpackMagic + "\x80", expected: FormatMsgpack},
+		{content: "garbage", expected: FormatSnapshot},
+	}
+
+	for _, tt := range tests {
+		if format := DetectFormat([]byte(tt.content)); format != tt.expected {
+			t.Errorf("%q: expected %s, got %s", tt.content, tt.expected, format)
+		}
+	}
+}
+
+func Test_Register(t *testing.T) {
+	saved := codecs
+	t.Cleanup(func() { codecs = saved })
+
+	Register(upperCodec{})
+	codec, ok := CodecFor("upper")
+	if !ok {
+		t.Fatal("registered codec not found")
+	}
+
+	var buf bytes.Buffer
+	snap := &Snapshot{Header: Header{Seq: 2}, Records: []map[string]interface{}{{"id": json.Number("2"), "name": "alice"}}}
+	if err := EncodeFormat(&buf, snap, codec.Format()); err != nil {
+		t.Fatalf("EncodeFormat failed: %v", err)
+	}
+	decoded, err := Read(&buf, false)
+	if err != nil || len(decoded.Records) != 1 || decoded.Records[0]["name"] != "alice" {
+		t.Fatalf("expected the record back, got %v (%v)", decoded, err)
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Error("expected registering a format twice to panic")
+		}
+	}()
+	Register(msgpackCodec{})
+}
+
+// benchSnapshot builds size records mixing strings, integers, floats and
+// nested values
+func benchSnapshot(size int) *Snapshot {
+	snap := &Snapshot{Header: Header{Seq: uint64(size)}, Records: make([]map[string]interface{}, size)}
+	for i := range snap.Records {
+		snap.Records[i] = map[string]interface{}{
+			"id":       json.Number(strconv.Itoa(i + 1)),
+			"hostname": fmt.Sprintf("server-%05d.example.com", i),
+			"cpus":     json.Number(strconv.Itoa(i%64 + 1)),
+			"load":     json.Number(strconv.FormatFloat(float64(i%100)/7, 'f', -1, 64)),
+			"serial":   json.Number("123456789012345678901234567890"),
+			"active":   i%2 == 0,
+			"disks":    []interface{}{map[string]interface{}{"name": "sda", "size": json.Number("512.0")}, map[string]interface{}{"name": "sdb", "size": json.Number("2048")}},
+		}
+	}
+	return snap
+}
+
+// Benchmark_Codecs compares the flush (Encode) and load (Decode) time and the
+// file size of every layout the engines write
+func Benchmark_Codecs(b *testing.B) {
+	formats := []Format{FormatSnapshot, FormatNDJSON, FormatMsgpack}
+
+	for _, size := range []int{1000, 10000} {
+		snap := benchSnapshot(size)
+		for _, format := range formats {
+			var file bytes.Buffer
+			if err := EncodeFormat(&file, snap, format); err != nil {
+				b.Fatalf("EncodeFormat failed: %v", err)
+			}
+
+			b.Run(fmt.Sprintf("Encode/records=%d/format=%s", size, format), func(b *testing.B) {
+				var buf bytes.Buffer
+				b.ReportAllocs()
+				for i := 0; i < b.N; i++ {
+					buf.Reset()
+					if err := EncodeFormat(&buf, snap, format); err != nil {
+						b.Fatalf("EncodeFormat failed: %v", err)
+					}
+				}
+				b.ReportMetric(float64(file.Len()), "bytes/file")
+			})
+
+			b.Run(fmt.Sprintf("Decode/records=%d/format=%s", size, format), func(b *testing.B) {
+				b.ReportAllocs()
+				for i := 0; i < b.N; i++ {
+					if _, err := Read(bytes.NewReader(file.Bytes()), false); err != nil {
+						b.Fatalf("Read failed: %v", err)
+					}
+				}
+				b.ReportMetric(float64(file.Len()), "bytes/file")
+			})
+		}
+	}
+}
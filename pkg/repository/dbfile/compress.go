@@ -0,0 +1,178 @@
+package dbfile
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"zabbixhw/pkg/fsys"
+)
+
+// Compression is how a database file is compressed as a whole. Compressed
+// files are recognised by their magic bytes, so every file loads whatever
+// compression is configured
+type Compression string
+
+const (
+	CompressionNone Compression = "none"
+	CompressionGzip Compression = "gzip"
+)
+
+// Compression levels run from BestSpeed to BestCompression, DefaultLevel
+// picks the compromise of the compressor
+const (
+	DefaultLevel    = 0
+	BestSpeed       = gzip.BestSpeed
+	BestCompression = gzip.BestCompression
+)
+
+var ErrUnknownCompression = errors.New("unknown compression")
+
+// gzipMagic starts every gzip stream
+var gzipMagic = []byte{0x1f, 0x8b}
+
+// Encoding is how a database file is written: its layout, compression and
+// encryption
+type Encoding struct {
+	Format      Format
+	Compression Compression // Empty is the same as CompressionNone
+	Level       int         // Compression level, DefaultLevel or BestSpeed to BestCompression
+	Key         *Key        // Key the file is encrypted with, nil leaves it in plaintext
+}
+
+// Encode writes the snapshot with the encoding
+func (e Encoding) Encode(w io.Writer, snap *Snapshot) error {
+	if e.Key == nil {
+		return e.encode(w, snap)
+	}
+
+	// GCM authenticates the file as a whole, so it is sealed in one piece
+	var buf bytes.Buffer
+	if err := e.encode(&buf, snap); err != nil {
+		return err
+	}
+	sealed, err := Encrypt(buf.Bytes(), e.Key)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(sealed)
+	return err
+}
+
+// Rewrite truncates file, writes the snapshot to it with the encoding and
+// syncs it to stable storage
+func (e Encoding) Rewrite(file fsys.File, snap *Snapshot) error {
+	if err := file.Truncate(0); err != nil {
+		return fmt.Errorf("error truncating file: %w", err)
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return fmt.Errorf("error seeking file: %w", err)
+	}
+	if err := e.Encode(file, snap); err != nil {
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		return fmt.Errorf("error syncing file: %w", err)
+	}
+	return nil
+}
+
+// encode writes the snapshot compressed and in plaintext
+func (e Encoding) encode(w io.Writer, snap *Snapshot) error {
+	cw, err := Compress(w, e.Compression, e.Level)
+	if err != nil {
+		return err
+	}
+	if err := EncodeFormat(cw, snap, e.Format); err != nil {
+		return err
+	}
+	if err := cw.Close(); err != nil {
+		return fmt.Errorf("error compressing file: %w", err)
+	}
+	return nil
+}
+
+// ParseCompression returns the compression called name, empty is none
+func ParseCompression(name string) (Compression, error) {
+	switch Compression(name) {
+	case "", CompressionNone:
+		return CompressionNone, nil
+	case CompressionGzip:
+		return CompressionGzip, nil
+	}
+	return "", fmt.Errorf("%w %q", ErrUnknownCompression, name)
+}
+
+// CheckCompression makes sure compression is known and level valid for it
+func CheckCompression(compression Compression, level int) error {
+	if _, err := ParseCompression(string(compression)); err != nil {
+		return err
+	}
+	if level != DefaultLevel && (level < BestSpeed || level > BestCompression) {
+		return fmt.Errorf("invalid compression level %d, expected %d to %d", level, BestSpeed, BestCompression)
+	}
+	return nil
+}
+
+// DetectCompression tells how content is compressed
+func DetectCompression(content []byte) Compression {
+	if bytes.HasPrefix(content, gzipMagic) {
+		return CompressionGzip
+	}
+	return CompressionNone
+}
+
+// Compress returns a writer compressing what is written to it into w. Close
+// ends the compressed stream, it does not close w
+func Compress(w io.Writer, compression Compression, level int) (io.WriteCloser, error) {
+	if err := CheckCompression(compression, level); err != nil {
+		return nil, err
+	}
+	if compression != CompressionGzip {
+		return nopCloser{w}, nil
+	}
+	if level == DefaultLevel {
+		level = gzip.DefaultCompression
+	}
+	return gzip.NewWriterLevel(w, level)
+}
+
+// nopCloser is a writer whose Close does nothing
+type nopCloser struct {
+	io.Writer
+}
+
+func (nopCloser) Close() error { return nil }
+
+// decompress returns a reader of the uncompressed content of br and the
+// compression it found
+func decompress(br *bufio.Reader) (*bufio.Reader, Compression, error) {
+	magic, err := br.Peek(len(gzipMagic))
+	if err != nil && err != io.EOF {
+		return nil, "", err
+	}
+	if !bytes.Equal(magic, gzipMagic) {
+		return br, CompressionNone, nil
+	}
+
+	gz, err := gzip.NewReader(br)
+	if err != nil {
+		return nil, "", fmt.Errorf("error decompressing file: %w", err)
+	}
+	return bufio.NewReader(gz), CompressionGzip, nil
+}
+
+// decompressAll returns the uncompressed content and its compression
+func decompressAll(content []byte) ([]byte, Compression, error) {
+	br, compression, err := decompress(bufio.NewReader(bytes.NewReader(content)))
+	if err != nil || compression == CompressionNone {
+		return content, compression, err
+	}
+	plain, err := io.ReadAll(br)
+	if err != nil {
+		return nil, "", fmt.Errorf("error decompressing file: %w", err)
+	}
+	return plain, compression, nil
+}
@@ -0,0 +1,227 @@
+package dbfile
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// compressed encodes the benchmark records with encoding
+func compressed(t testing.TB, snap *Snapshot, encoding Encoding) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	if err := encoding.Encode(&buf, snap); err != nil {
+		t.Fatalf("Encode failed: %v", err)
+	}
+	return buf.Bytes()
+}
+
+func Test_Compression(t *testing.T) {
+	snap := benchSnapshot(200)
+	plain := compressed(t, snap, Encoding{Format: FormatSnapshot})
+
+	for _, format := range []Format{FormatSnapshot, FormatNDJSON, FormatMsgpack} {
+		t.Run(string(format), func(t *testing.T) {
+			content := compressed(t, snap, Encoding{Format: format, Compression: CompressionGzip, Level: BestCompression})
+			if DetectCompression(content) != CompressionGzip || DetectFormat(content) != format {
+				t.Errorf("expected gzip and %s, got %s and %s", format, DetectCompression(content), DetectFormat(content))
+			}
+			if len(content) >= len(plain)/4 {
+				t.Errorf("expected less than %d bytes, got %d", len(plain)/4, len(content))
+			}
+
+			decoded, err := Decode(content)
+			if err != nil {
+				t.Fatalf("Decode failed: %v", err)
+			}
+			if decoded.Compression != CompressionGzip || decoded.Format != format || len(decoded.Records) != 200 {
+				t.Errorf("unexpected snapshot: %s, %s, %d records", decoded.Compression, decoded.Format, len(decoded.Records))
+			}
+			if report := CheckIntegrity(decoded); !report.Checked || !report.OK() {
+				t.Errorf("expected intact checksums, got %s", report)
+			}
+
+			raw, err := DecodeRaw(content)
+			if err != nil || raw.Compression != CompressionGzip || len(raw.Records) != 200 {
+				t.Fatalf("unexpected raw snapshot (%v)", err)
+			}
+		})
+	}
+
+	if decoded, err := Decode(plain); err != nil || decoded.Compression != CompressionNone {
+		t.Errorf("expected an uncompressed snapshot, got %v", err)
+	}
+}
+
+func Test_CompressionErrors(t *testing.T) {
+	content := compressed(t, benchSnapshot(50), Encoding{Format: FormatSnapshot, Compression: CompressionGzip})
+	flipped := bytes.Clone(content)
+	flipped[len(flipped)/2] ^= 0xff
+
+	tests := []struct {
+		name    string
+		content []byte
+	}{
+		{name: "Truncated", content: content[:len(content)-10]},
+		{name: "Corrupted", content: flipped},
+		{name: "Trailing data", content: append(bytes.Clone(content), "junk"...)},
+		{name: "Broken header", content: []byte{0x1f, 0x8b, 0x00}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := Decode(tt.content); err == nil {
+				t.Error("expected an error, got none")
+			}
+		})
+	}
+}
+
+func Test_CheckCompression(t *testing.T) {
+	tests := []struct {
+		compression Compression
+		level       int
+		wantErr     bool
+	}{
+		{compression: CompressionGzip, level: DefaultLevel},
+		{compression: CompressionGzip, level: BestSpeed},
+		{compression: CompressionGzip, level: BestCompression},
+		{compression: "", level: DefaultLevel},
+		{compression: CompressionGzip, level: 10, wantErr: true},
+		{compression: CompressionGzip, level: -1, wantErr: true},
+		{compression: "zip", level: DefaultLevel, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		err := CheckCompression(tt.compression, tt.level)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%q level %d: unexpected error %v", tt.compression, tt.level, err)
+		}
+	}
+	if _, err := ParseCompression("zip"); !errors.Is(err, ErrUnknownCompression) {
+		t.Errorf("expected %v, got %v", ErrUnknownCompression, err)
+	}
+	if got, _ := Decode(nil); !reflect.DeepEqual(got.Compression, CompressionNone) {
+		t.Errorf("expected an empty file to be uncompressed, got %q", got.Compression)
+	}
+}
+
+// Benchmark_Compression compares the flush and load time and the file size
+// of compressed files against plain ones
+func Benchmark_Compression(b *testing.B) {
+	snap := benchSnapshot(10000)
+	levels := []struct {
+		name        string
+		compression Compression
+		level       int
+	}{
+		{"none", CompressionNone, DefaultLevel},
+		{"gzip-1", CompressionGzip, BestSpeed},
+		{"gzip-default", CompressionGzip, DefaultLevel},
+		{"gzip-9", CompressionGzip, BestCompression},
+	}
+
+	for _, format := range []Format{FormatSnapshot, FormatMsgpack} {
+		for _, level := range levels {
+			encoding := Encoding{Format: format, Compression: level.compression, Level: level.level}
+			file := compressed(b, snap, encoding)
+
+			b.Run(fmt.Sprintf("Encode/format=%s/compression=%s", format, level.name), func(b *testing.B) {
+				var buf bytes.Buffer
+				b.ReportAllocs()
+				for i := 0; i < b.N; i++ {
+					buf.Reset()
+					if err := encoding.Encode(&buf, snap); err != nil {
+						b.Fatalf("Encode failed: %v", err)
+					}
+				}
+				b.ReportMetric(float64(len(file)), "bytes/file")
+			})
+
+			b.Run(fmt.Sprintf("Decode/format=%s/compression=%s", format, level.name), func(b *testing.B) {
+				b.ReportAllocs()
+				for i := 0; i < b.N; i++ {
+					if _, err := Read(bytes.NewReader(file), false); err != nil {
+						b.Fatalf("Read failed: %v", err)
+					}
+				}
+				b.ReportMetric(float64(len(file)), "bytes/file")
+			})
+		}
+	}
+}
+
+// Fuzz_Rewrite checks that whatever loads is rewritten unchanged in every
+// layout
+func Fuzz_Rewrite(f *testing.F) {
+	f.Add([]byte(``))
+	f.Add([]byte(`[]`))
+	f.Add([]byte(`[{"id": 1, "name": "Alice", "age": 30}, {"id": 2, "name": "Bob"}]`))
+	f.Add([]byte(`{"header": {"seq": 7}, "records": [{"id": 3, "nested": {"a": [1, 2.5, null]}}]}`))
+	f.Add([]byte(`{"header": {"seq": 1, "idStrategy": "ulid"}, "records": [{"id": "01ARYZ6S41TSV4RRFFQ69G5FAV"}]}`))
+	f.Add([]byte(`[{"id": 18446744073709551616, "big": 123456789012345678901234567890}]`))
+	f.Add([]byte(`{"id": 1, "name": "Alice"}`))
+	f.Add([]byte(`[{"id": 1`))
+	f.Add([]byte("{\"format\":\"ndjson\",\"header\":{\"version\":2,\"seq\":2}}\n{\"id\":1}\n{\"id\":2,\"n\":1e400}\n"))
+	var packed bytes.Buffer
+	EncodeMsgpack(&packed, &Snapshot{Records: []map[string]interface{}{
+		{"id": json.Number("1"), "f": json.Number("1.0"), "n": json.Number("1e400"), "list": []interface{}{nil, "x"}},
+	}})
+	f.Add(packed.Bytes())
+	var zipped bytes.Buffer
+	Encoding{Format: FormatSnapshot, Compression: CompressionGzip}.Encode(&zipped, &Snapshot{Records: []map[string]interface{}{{"id": json.Number("1")}}})
+	f.Add(zipped.Bytes())
+
+	f.Fuzz(func(t *testing.T, content []byte) {
+		path := filepath.Join(t.TempDir(), "db.json")
+		if err := os.WriteFile(path, content, 0644); err != nil {
+			t.Fatalf("Failed to write file: %v", err)
+		}
+		file, err := os.OpenFile(path, os.O_RDWR, 0644)
+		if err != nil {
+			t.Fatalf("Failed to open file: %v", err)
+		}
+		defer file.Close()
+
+		snap, err := ReadWithKeys(file, false, nil)
+		if err != nil {
+			return
+		}
+
+		if maxID := MaxID(snap.Records); snap.Header.Seq < maxID {
+			t.Fatalf("sequence %d behind highest ID %d", snap.Header.Seq, maxID)
+		}
+
+		// Whatever loads must survive a rewrite in any layout unchanged
+		for _, format := range []Format{FormatSnapshot, FormatNDJSON, FormatMsgpack} {
+			if err := (Encoding{Format: format}).Rewrite(file, snap); err != nil {
+				t.Fatalf("Failed to rewrite file as %s: %v", format, err)
+			}
+			if _, err := file.Seek(0, 0); err != nil {
+				t.Fatalf("Failed to seek file: %v", err)
+			}
+			reread, err := ReadWithKeys(file, false, nil)
+			if err != nil {
+				t.Fatalf("Failed to read rewritten %s file: %v", format, err)
+			}
+
+			// Rewriting upgrades the file to the current version
+			expected := snap.Header
+			expected.Version = CurrentVersion
+			if !reflect.DeepEqual(reread.Header, expected) {
+				t.Fatalf("%s: header changed from %+v to %+v", format, expected, reread.Header)
+			}
+			before, _ := json.Marshal(snap.Records)
+			after, _ := json.Marshal(reread.Records)
+			if string(before) != string(after) {
+				t.Fatalf("%s: records changed from %s to %s", format, before, after)
+			}
+		}
+	})
+}
@@ -0,0 +1,190 @@
+package dbfile
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"zabbixhw/pkg/repository"
+	"zabbixhw/pkg/repository/idgen"
+)
+
+var (
+	ErrIDStrategyMismatch = errors.New("database was created with a different ID strategy")
+	ErrNewerVersion       = errors.New("database file was written by a newer version")
+)
+
+// Format versions. Legacy files are a bare array of records, the first header
+// carried no version and checksums came with the current one
+const (
+	VersionLegacy  = 0
+	VersionHeader  = 1
+	CurrentVersion = 2
+)
+
+// Header holds the database metadata persisted in front of the records
+type Header struct {
+	Version    int               `json:"version"`              // Format version the file was written in
+	Seq        uint64            `json:"seq"`                  // Highest ID ever issued, never decreases
+	IDStrategy string            `json:"idStrategy,omitempty"` // ID strategy of the collection, empty means sequential
+	Meta       map[string]string `json:"meta,omitempty"`       // Free-form metadata, kept across writes
+}
+
+// Snapshot is the complete persisted state of a database
+type Snapshot struct {
+	Header      Header                   `json:"header"`
+	Records     []map[string]interface{} `json:"records"`
+	Checksums   *Checksums               `json:"checksums,omitempty"` // As read from the file, Encode writes fresh ones
+	Skipped     []LineError              `json:"-"`                   // Lines left out by Read
+	Format      Format                   `json:"-"`                   // Layout the snapshot was read from
+	Compression Compression              `json:"-"`                   // Compression of the file it was read from
+	KeyID       string                   `json:"-"`                   // Key the file was encrypted with, empty when it was not
+}
+
+// Decode parses file content into a snapshot. Every format version up to
+// CurrentVersion is accepted, Header.Version tells which one was read. Files
+// of a newer version fail with ErrNewerVersion. Any bad line fails NDJSON
+// content, use Read to skip them
+func Decode(content []byte) (*Snapshot, error) {
+	return Read(bytes.NewReader(content), false)
+}
+
+// decodeDocument decodes a snapshot or legacy JSON document
+func decodeDocument(content []byte) (*Snapshot, error) {
+	content = bytes.TrimSpace(content)
+	if len(content) == 0 {
+		return &Snapshot{Header: Header{Version: CurrentVersion}, Records: []map[string]interface{}{}, Format: FormatSnapshot}, nil
+	}
+
+	snap := &Snapshot{Format: FormatSnapshot}
+	if content[0] == '[' {
+		snap.Format = FormatLegacy
+		// Legacy files hold nothing but the records array
+		if err := unmarshal(content, &snap.Records); err != nil {
+			return nil, fmt.Errorf("error unmarshalling JSON data: %w", err)
+		}
+	} else {
+		if err := checkVersion(content); err != nil {
+			return nil, err
+		}
+		if err := unmarshal(content, snap); err != nil {
+			return nil, fmt.Errorf("error unmarshalling JSON data: %w", err)
+		}
+		if snap.Header.Version == VersionLegacy {
+			snap.Header.Version = VersionHeader
+		}
+		if len(snap.Header.Meta) == 0 {
+			snap.Header.Meta = nil
+		}
+	}
+
+	if snap.Records == nil {
+		snap.Records = []map[string]interface{}{}
+	}
+
+	// The sequence can never be behind the IDs already present, which also
+	// seeds it for legacy files that have no header at all
+	if maxID := MaxID(snap.Records); maxID > snap.Header.Seq {
+		snap.Header.Seq = maxID
+	}
+
+	return snap, nil
+}
+
+// Encode writes the snapshot in the current file format, sealed with fresh
+// checksums, whatever version snap was read in
+func Encode(w io.Writer, snap *Snapshot) error {
+	records, sums, err := seal(snap)
+	if err != nil {
+		return err
+	}
+
+	header := snap.Header
+	header.Version = CurrentVersion
+	encoder := json.NewEncoder(w)
+	doc := struct {
+		Header    Header            `json:"header"`
+		Records   []json.RawMessage `json:"records"`
+		Checksums *Checksums        `json:"checksums"`
+	}{header, records, sums}
+	if err := encoder.Encode(doc); err != nil {
+		return fmt.Errorf("error encoding JSON data: %w", err)
+	}
+
+	return nil
+}
+
+// checkVersion refuses files of a newer format version before they are
+// decoded, as their layout may have changed in any way
+func checkVersion(content []byte) error {
+	var probe struct {
+		Header struct {
+			Version int `json:"version"`
+		} `json:"header"`
+	}
+	// A broken document is reported by the full decode
+	if json.Unmarshal(content, &probe) != nil {
+		return nil
+	}
+	return checkVersionNumber(probe.Header.Version)
+}
+
+// checkVersionNumber refuses format versions newer than CurrentVersion
+func checkVersionNumber(version int) error {
+	if version > CurrentVersion {
+		return fmt.Errorf("%w: format version %d, this build reads up to %d", ErrNewerVersion, version, CurrentVersion)
+	}
+	return nil
+}
+
+// CheckIDStrategy makes sure a collection keeps the ID strategy it was
+// created with. Databases that already issued IDs without recording a
+// strategy are sequential
+func CheckIDStrategy(header Header, name string) error {
+	stored := header.IDStrategy
+	if stored == "" && header.Seq > 0 {
+		stored = idgen.NameSequential
+	}
+	if stored != "" && stored != name {
+		return fmt.Errorf("%w: %s, configured %s", ErrIDStrategyMismatch, stored, name)
+	}
+	return nil
+}
+
+// MaxID returns the highest numeric ID among the records, ignoring records
+// whose ID is missing or not a number
+func MaxID(records []map[string]interface{}) uint64 {
+	var maxID uint64
+	for _, record := range records {
+		switch record["id"].(type) {
+		case json.Number, float64:
+		default:
+			continue
+		}
+		formatted, ok := repository.FormatID(record["id"])
+		if !ok {
+			continue
+		}
+		if id, err := strconv.ParseUint(string(formatted), 10, 64); err == nil && id > maxID {
+			maxID = id
+		}
+	}
+	return maxID
+}
+
+// unmarshal decodes a complete JSON document keeping numbers as json.Number,
+// so integers beyond 2^53 and long decimals survive a load unchanged
+func unmarshal(content []byte, v interface{}) error {
+	decoder := json.NewDecoder(bytes.NewReader(content))
+	decoder.UseNumber()
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(v); err != nil {
+		return err
+	}
+	if _, err := decoder.Token(); err != io.EOF {
+		return errors.New("unexpected data after JSON document")
+	}
+	return nil
+}
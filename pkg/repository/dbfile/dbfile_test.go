@@ -0,0 +1,145 @@
+package dbfile
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func Test_Decode(t *testing.T) {
+	tests := []struct {
+		name            string
+		content         string
+		expectedSeq     uint64
+		expectedLen     int
+		expectedVersion int
+		wantErr         bool
+		expectedErr     error
+	}{
+		{
+			name:            "Empty file",
+			content:         "",
+			expectedSeq:     0,
+			expectedLen:     0,
+			expectedVersion: CurrentVersion,
+		},
+		{
+			name:            "Legacy bare array",
+			content:         `[{"id": 1, "name": "Alice"}, {"id": 4, "name": "Bob"}]`,
+			expectedSeq:     4,
+			expectedLen:     2,
+			expectedVersion: VersionLegacy,
+		},
+		{
+			name:            "Header with sequence ahead of records",
+			content:         `{"header": {"seq": 10}, "records": [{"id": 2}]}`,
+			expectedSeq:     10,
+			expectedLen:     1,
+			expectedVersion: VersionHeader,
+		},
+		{
+			name:            "Current version with metadata",
+			content:         `{"header": {"version": 2, "seq": 1, "meta": {"owner": "ops"}}, "records": [{"id": 1}]}`,
+			expectedSeq:     1,
+			expectedLen:     1,
+			expectedVersion: CurrentVersion,
+		},
+		{
+			name:        "Newer version with unknown fields",
+			content:     `{"header": {"version": 3, "seq": 1, "shards": 4}, "segments": []}`,
+			wantErr:     true,
+			expectedErr: ErrNewerVersion,
+		},
+		{
+			name:            "Header behind records",
+			content:         `{"header": {"seq": 1}, "records": [{"id": 7}]}`,
+			expectedSeq:     7,
+			expectedLen:     1,
+			expectedVersion: VersionHeader,
+		},
+		{
+			name:        "Non-numeric IDs are ignored",
+			content:     `[{"id": "abc"}, {"id": 3}]`,
+			expectedSeq: 3,
+			expectedLen: 2,
+		},
+		{
+			name:        "IDs beyond float64 precision",
+			content:     `[{"id": 9007199254740993}, {"id": 9007199254740992}]`,
+			expectedSeq: 9007199254740993,
+			expectedLen: 2,
+		},
+		{
+			name:    "Trailing data",
+			content: `[{"id": 1}] [{"id": 2}]`,
+			wantErr: true,
+		},
+		{
+			name:    "Single record object",
+			content: `{"id": 1, "name": "Alice"}`,
+			wantErr: true,
+		},
+		{
+			name:    "Invalid JSON",
+			content: `[{"id": 1`,
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			snap, err := Decode([]byte(tt.content))
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("expected an error, got none")
+				}
+				if tt.expectedErr != nil && !errors.Is(err, tt.expectedErr) {
+					t.Fatalf("expected %v, got %v", tt.expectedErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if snap.Header.Seq != tt.expectedSeq {
+				t.Errorf("expected seq %d, got %d", tt.expectedSeq, snap.Header.Seq)
+			}
+			if snap.Header.Version != tt.expectedVersion {
+				t.Errorf("expected version %d, got %d", tt.expectedVersion, snap.Header.Version)
+			}
+			if len(snap.Records) != tt.expectedLen {
+				t.Errorf("expected %d records, got %d", tt.expectedLen, len(snap.Records))
+			}
+		})
+	}
+}
+
+func Test_EncodeDecode(t *testing.T) {
+	snap := &Snapshot{
+		Header: Header{Version: VersionHeader, Seq: 5, Meta: map[string]string{"owner": "ops"}},
+		Records: []map[string]interface{}{
+			{"id": float64(2), "name": "Alice"},
+		},
+	}
+
+	var buf bytes.Buffer
+	if err := Encode(&buf, snap); err != nil {
+		t.Fatalf("Encode failed: %v", err)
+	}
+
+	decoded, err := Decode(buf.Bytes())
+	if err != nil {
+		t.Fatalf("Decode failed: %v", err)
+	}
+
+	if decoded.Header.Seq != 5 {
+		t.Errorf("expected seq 5, got %d", decoded.Header.Seq)
+	}
+	if decoded.Header.Version != CurrentVersion || decoded.Header.Meta["owner"] != "ops" {
+		t.Errorf("expected the current version with metadata, got %+v", decoded.Header)
+	}
+	if len(decoded.Records) != 1 || decoded.Records[0]["name"] != "Alice" {
+		t.Errorf("unexpected records %v", decoded.Records)
+	}
+}
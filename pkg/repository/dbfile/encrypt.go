@@ -0,0 +1,260 @@
+package dbfile
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"strings"
+)
+
+// KeySize is the length of AES-256 keys
+const KeySize = 32
+
+// KeysEnv is the environment variable keys are read from when no key file
+// is given
+const KeysEnv = "ZHW_DB_KEYS"
+
+var (
+	ErrEncrypted = errors.New("file is encrypted")
+	ErrWrongKey  = errors.New("wrong encryption key")
+	ErrNoKeys    = errors.New("no encryption keys")
+)
+
+// encryptMagic starts every encrypted file. Like msgpackMagic it cannot start
+// a JSON document, a MessagePack document or a gzip stream
+const encryptMagic = "\xc1ZHE"
+
+// Key is an AES-256 key. Its ID is derived from the key itself, so the ID
+// written to a file always names the key that encrypted it
+type Key struct {
+	ID     string
+	secret []byte
+}
+
+// NewKey returns the key for secret, which must be KeySize bytes long
+func NewKey(secret []byte) (*Key, error) {
+	if len(secret) != KeySize {
+		return nil, fmt.Errorf("invalid key: expected %d bytes, got %d", KeySize, len(secret))
+	}
+	sum := sha256.Sum256(secret)
+	return &Key{ID: hex.EncodeToString(sum[:8]), secret: bytes.Clone(secret)}, nil
+}
+
+// Keyring holds the keys files may be encrypted with. The first key is the
+// primary key new content is encrypted with, the others only decrypt
+type Keyring struct {
+	keys []*Key
+}
+
+// NewKeyring returns a keyring whose primary key is the first of keys
+func NewKeyring(keys ...*Key) (*Keyring, error) {
+	if len(keys) == 0 {
+		return nil, ErrNoKeys
+	}
+	return &Keyring{keys: keys}, nil
+}
+
+// ParseKeys reads a keyring from text holding one key per line, base64 or
+// hex encoded. Blank lines and lines starting with # are skipped, commas
+// separate keys as well so a keyring fits in one environment variable
+func ParseKeys(text string) (*Keyring, error) {
+	var keys []*Key
+	fields := strings.FieldsFunc(text, func(r rune) bool { return r == '\n' || r == ',' })
+	for i, field := range fields {
+		field = strings.TrimSpace(field)
+		if field == "" || strings.HasPrefix(field, "#") {
+			continue
+		}
+		secret, err := decodeSecret(field)
+		if err != nil {
+			return nil, fmt.Errorf("key %d: %w", i+1, err)
+		}
+		key, err := NewKey(secret)
+		if err != nil {
+			return nil, fmt.Errorf("key %d: %w", i+1, err)
+		}
+		keys = append(keys, key)
+	}
+	return NewKeyring(keys...)
+}
+
+// decodeSecret decodes a key written as 64 hex digits or in base64
+func decodeSecret(text string) ([]byte, error) {
+	if len(text) == hex.EncodedLen(KeySize) {
+		if secret, err := hex.DecodeString(text); err == nil {
+			return secret, nil
+		}
+	}
+	secret, err := base64.StdEncoding.DecodeString(text)
+	if err != nil {
+		return nil, errors.New("invalid key: expected hex or base64")
+	}
+	return secret, nil
+}
+
+// LoadKeys reads the keyring from path, or from the KeysEnv environment
+// variable when path is empty. It returns nil when neither is set
+func LoadKeys(path string) (*Keyring, error) {
+	if path == "" {
+		text := os.Getenv(KeysEnv)
+		if text == "" {
+			return nil, nil
+		}
+		keys, err := ParseKeys(text)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", KeysEnv, err)
+		}
+		return keys, nil
+	}
+
+	text, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading key file: %w", err)
+	}
+	keys, err := ParseKeys(string(text))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return keys, nil
+}
+
+// Primary returns the key new content is encrypted with
+func (k *Keyring) Primary() *Key {
+	return k.keys[0]
+}
+
+// Lookup returns the key called id
+func (k *Keyring) Lookup(id string) (*Key, bool) {
+	for _, key := range k.keys {
+		if key.ID == id {
+			return key, true
+		}
+	}
+	return nil, false
+}
+
+// IDs lists the IDs of the keys, the primary key first
+func (k *Keyring) IDs() []string {
+	ids := make([]string, len(k.keys))
+	for i, key := range k.keys {
+		ids[i] = key.ID
+	}
+	return ids
+}
+
+// Rekeyer is implemented by databases and the layers wrapping them that can
+// re-encrypt their files with the primary key of keys
+type Rekeyer interface {
+	Rekey(ctx context.Context, keys *Keyring) error
+}
+
+// FileMode is the permission of new database files, encrypted ones are kept
+// private to their owner
+func FileMode(keys *Keyring) fs.FileMode {
+	if keys != nil {
+		return 0600
+	}
+	return 0644
+}
+
+// EncryptionKeyID returns the ID of the key content is encrypted with, empty
+// when content is not encrypted
+func EncryptionKeyID(content []byte) string {
+	id, _, _, err := splitEncrypted(content)
+	if err != nil {
+		return ""
+	}
+	return id
+}
+
+// Encrypt seals content with AES-256-GCM under key. The result starts with
+// encryptMagic, the length and the ID of the key and the nonce, all of them
+// authenticated along with content
+func Encrypt(content []byte, key *Key) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	header := make([]byte, 0, len(encryptMagic)+1+len(key.ID)+gcm.NonceSize())
+	header = append(header, encryptMagic...)
+	header = append(header, byte(len(key.ID)))
+	header = append(header, key.ID...)
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("error generating nonce: %w", err)
+	}
+	header = append(header, nonce...)
+
+	return gcm.Seal(header, nonce, content, header), nil
+}
+
+// Decrypt returns the content of an encrypted file and the ID of its key.
+// Content that is not encrypted is returned as it is with an empty ID
+func Decrypt(content []byte, keys *Keyring) ([]byte, string, error) {
+	if !bytes.HasPrefix(content, []byte(encryptMagic)) {
+		return content, "", nil
+	}
+	id, header, sealed, err := splitEncrypted(content)
+	if err != nil {
+		return nil, "", err
+	}
+	if keys == nil {
+		return nil, id, fmt.Errorf("%w with key %s, no key was given", ErrEncrypted, id)
+	}
+	key, ok := keys.Lookup(id)
+	if !ok {
+		return nil, id, fmt.Errorf("%w: the file is encrypted with key %s, the keyring has %s",
+			ErrWrongKey, id, strings.Join(keys.IDs(), ", "))
+	}
+
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, id, err
+	}
+	nonce := header[len(header)-gcm.NonceSize():]
+	plain, err := gcm.Open(nil, nonce, sealed, header)
+	if err != nil {
+		return nil, id, fmt.Errorf("error decrypting file with key %s: it is damaged or was tampered with", id)
+	}
+	return plain, id, nil
+}
+
+// splitEncrypted splits an encrypted file into the ID of its key, the
+// authenticated header and the sealed content
+func splitEncrypted(content []byte) (string, []byte, []byte, error) {
+	if !bytes.HasPrefix(content, []byte(encryptMagic)) {
+		return "", nil, nil, errors.New("file is not encrypted")
+	}
+	rest := content[len(encryptMagic):]
+	if len(rest) == 0 || len(rest) < 1+int(rest[0]) {
+		return "", nil, nil, errors.New("error decrypting file: truncated header")
+	}
+	id := string(rest[1 : 1+rest[0]])
+
+	headerSize := len(encryptMagic) + 1 + len(id) + gcmNonceSize
+	if len(content) < headerSize {
+		return "", nil, nil, errors.New("error decrypting file: truncated header")
+	}
+	return id, content[:headerSize], content[headerSize:], nil
+}
+
+// gcmNonceSize is the standard GCM nonce length used by newGCM
+const gcmNonceSize = 12
+
+func newGCM(key *Key) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key.secret)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
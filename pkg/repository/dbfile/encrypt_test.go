@@ -0,0 +1,182 @@
+package dbfile
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// testKey returns a key whose bytes are all b
+func testKey(t testing.TB, b byte) *Key {
+	t.Helper()
+
+	key, err := NewKey(bytes.Repeat([]byte{b}, KeySize))
+	if err != nil {
+		t.Fatalf("NewKey failed: %v", err)
+	}
+	return key
+}
+
+// testKeyring returns a keyring of keys
+func testKeyring(t testing.TB, keys ...*Key) *Keyring {
+	t.Helper()
+
+	keyring, err := NewKeyring(keys...)
+	if err != nil {
+		t.Fatalf("NewKeyring failed: %v", err)
+	}
+	return keyring
+}
+
+func Test_Encryption(t *testing.T) {
+	key := testKey(t, 1)
+	snap := benchSnapshot(100)
+
+	for _, encoding := range []Encoding{
+		{Format: FormatSnapshot, Key: key},
+		{Format: FormatNDJSON, Key: key},
+		{Format: FormatMsgpack, Compression: CompressionGzip, Key: key},
+	} {
+		t.Run(string(encoding.Format), func(t *testing.T) {
+			content := compressed(t, snap, encoding)
+			if EncryptionKeyID(content) != key.ID {
+				t.Errorf("expected key %s in the header, got %q", key.ID, EncryptionKeyID(content))
+			}
+			if bytes.Contains(content, []byte("server-00001")) {
+				t.Error("plaintext found in the encrypted file")
+			}
+
+			decoded, err := ReadWithKeys(bytes.NewReader(content), false, testKeyring(t, key))
+			if err != nil {
+				t.Fatalf("ReadWithKeys failed: %v", err)
+			}
+			if decoded.KeyID != key.ID || decoded.Format != encoding.Format || len(decoded.Records) != 100 {
+				t.Errorf("unexpected snapshot: key %q, %s, %d records", decoded.KeyID, decoded.Format, len(decoded.Records))
+			}
+			if gzipped := encoding.Compression == CompressionGzip; gzipped != (decoded.Compression == CompressionGzip) {
+				t.Errorf("expected %s compression, got %s", encoding.Compression, decoded.Compression)
+			}
+		})
+	}
+
+	// Every write uses a fresh nonce
+	first := compressed(t, snap, Encoding{Format: FormatSnapshot, Key: key})
+	second := compressed(t, snap, Encoding{Format: FormatSnapshot, Key: key})
+	if bytes.Equal(first, second) {
+		t.Error("expected two encryptions of the same snapshot to differ")
+	}
+}
+
+func Test_DecryptErrors(t *testing.T) {
+	oldKey, newKey := testKey(t, 1), testKey(t, 2)
+	content := compressed(t, benchSnapshot(10), Encoding{Format: FormatSnapshot, Key: oldKey})
+
+	t.Run("Old key in the keyring", func(t *testing.T) {
+		decoded, err := ReadWithKeys(bytes.NewReader(content), false, testKeyring(t, newKey, oldKey))
+		if err != nil || decoded.KeyID != oldKey.ID {
+			t.Errorf("expected the old key to decrypt, got %v", err)
+		}
+	})
+
+	t.Run("Wrong key", func(t *testing.T) {
+		_, err := ReadWithKeys(bytes.NewReader(content), false, testKeyring(t, newKey))
+		if !errors.Is(err, ErrWrongKey) {
+			t.Fatalf("expected %v, got %v", ErrWrongKey, err)
+		}
+		if !strings.Contains(err.Error(), oldKey.ID) || !strings.Contains(err.Error(), newKey.ID) {
+			t.Errorf("expected both key IDs in %q", err)
+		}
+	})
+
+	t.Run("No key", func(t *testing.T) {
+		if _, err := Decode(content); !errors.Is(err, ErrEncrypted) {
+			t.Errorf("expected %v, got %v", ErrEncrypted, err)
+		}
+		if _, err := DecodeRaw(content); !errors.Is(err, ErrEncrypted) {
+			t.Errorf("expected %v, got %v", ErrEncrypted, err)
+		}
+	})
+
+	tests := []struct {
+		name    string
+		content []byte
+	}{
+		{name: "Tampered content", content: append(bytes.Clone(content[:len(content)-1]), content[len(content)-1]^1)},
+		{name: "Tampered nonce", content: append(append(bytes.Clone(content[:30]), content[30]^1), content[31:]...)},
+		{name: "Truncated", content: content[:len(content)-5]},
+		{name: "Truncated header", content: content[:10]},
+		{name: "Magic only", content: []byte(encryptMagic)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := ReadWithKeys(bytes.NewReader(tt.content), false, testKeyring(t, oldKey)); err == nil {
+				t.Error("expected an error, got none")
+			}
+		})
+	}
+}
+
+func Test_ParseKeys(t *testing.T) {
+	secret := bytes.Repeat([]byte{7}, KeySize)
+	key, _ := NewKey(secret)
+	b64 := base64.StdEncoding.EncodeToString(secret)
+	hx := hex.EncodeToString(secret)
+
+	tests := []struct {
+		name     string
+		text     string
+		expected []string
+		wantErr  bool
+	}{
+		{name: "Base64", text: b64, expected: []string{key.ID}},
+		{name: "Hex", text: hx + "\n", expected: []string{key.ID}},
+		{name: "Comments and rotation", text: "# current\n" + hx + "\n\n# retired\n" + base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{8}, KeySize)), expected: []string{key.ID, testKey(t, 8).ID}},
+		{name: "Commas", text: b64 + "," + hx, expected: []string{key.ID, key.ID}},
+		{name: "Short key", text: base64.StdEncoding.EncodeToString(secret[:16]), wantErr: true},
+		{name: "Garbage", text: "not a key", wantErr: true},
+		{name: "Empty", text: "# nothing\n", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			keys, err := ParseKeys(tt.text)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("unexpected error %v", err)
+			}
+			if err == nil && strings.Join(keys.IDs(), ",") != strings.Join(tt.expected, ",") {
+				t.Errorf("expected %v, got %v", tt.expected, keys.IDs())
+			}
+		})
+	}
+}
+
+func Test_LoadKeys(t *testing.T) {
+	key := testKey(t, 3)
+	text := base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{3}, KeySize))
+
+	t.Setenv(KeysEnv, "")
+	if keys, err := LoadKeys(""); keys != nil || err != nil {
+		t.Errorf("expected no keys, got %v (%v)", keys, err)
+	}
+
+	t.Setenv(KeysEnv, text)
+	if keys, err := LoadKeys(""); err != nil || keys.Primary().ID != key.ID {
+		t.Errorf("expected key %s from the environment, got %v", key.ID, err)
+	}
+
+	path := filepath.Join(t.TempDir(), "db.keys")
+	if err := os.WriteFile(path, []byte("# primary\n"+text+"\n"), 0600); err != nil {
+		t.Fatalf("Failed to write key file: %v", err)
+	}
+	if keys, err := LoadKeys(path); err != nil || keys.Primary().ID != key.ID {
+		t.Errorf("expected key %s from the file, got %v", key.ID, err)
+	}
+	if _, err := LoadKeys(path + ".missing"); err == nil {
+		t.Error("expected a missing key file to fail")
+	}
+}
@@ -0,0 +1,64 @@
+package dbfile
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+)
+
+// frameHeader is the size of the header of a frame: the length of its
+// content and the CRC-32C of the content
+const frameHeader = 8
+
+// Frame is a piece of content appended to a file on its own, such as an
+// entry of a log. End is the offset of the end of the frame in the file
+type Frame struct {
+	Content []byte
+	End     int64
+}
+
+// AppendFrame appends content to buf as a frame
+func AppendFrame(buf, content []byte) []byte {
+	buf = binary.BigEndian.AppendUint32(buf, uint32(len(content)))
+	buf = binary.BigEndian.AppendUint32(buf, crc32.Checksum(content, castagnoli))
+	return append(buf, content...)
+}
+
+// ReadFrames splits content into frames. A frame cut off or damaged at the
+// end, by a crash while appending it, is left out. A damaged frame followed
+// by others fails
+func ReadFrames(content []byte) ([]Frame, error) {
+	var frames []Frame
+	for offset := int64(0); offset < int64(len(content)); {
+		frame, end, ok := readFrame(content, offset)
+		if !ok {
+			if end < int64(len(content)) {
+				return nil, fmt.Errorf("%w: damaged frame at offset %d", ErrChecksum, offset)
+			}
+			break
+		}
+		frames = append(frames, Frame{Content: frame, End: end})
+		offset = end
+	}
+	return frames, nil
+}
+
+// readFrame returns the content of the frame at offset and its end. ok is
+// false when the frame is cut off or damaged, end is then where its length
+// says it ends
+func readFrame(content []byte, offset int64) (frame []byte, end int64, ok bool) {
+	rest := content[offset:]
+	if len(rest) < frameHeader {
+		return nil, int64(len(content)), false
+	}
+	size := int64(binary.BigEndian.Uint32(rest))
+	end = offset + frameHeader + size
+	if end > int64(len(content)) {
+		return nil, end, false
+	}
+	frame = rest[frameHeader : frameHeader+size]
+	if crc32.Checksum(frame, castagnoli) != binary.BigEndian.Uint32(rest[4:]) {
+		return nil, end, false
+	}
+	return frame, end, true
+}
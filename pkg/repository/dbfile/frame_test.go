@@ -0,0 +1,53 @@
+package dbfile
+
+import (
+	"errors"
+	"testing"
+)
+
+func Test_ReadFrames(t *testing.T) {
+	content := AppendFrame(nil, []byte("first"))
+	content = AppendFrame(content, []byte{})
+	content = AppendFrame(content, []byte("third"))
+	whole := []Frame{
+		{Content: []byte("first"), End: 13},
+		{Content: []byte{}, End: 21},
+		{Content: []byte("third"), End: 34},
+	}
+
+	damaged := append([]byte(nil), content...)
+	damaged[frameHeader] ^= 1
+	damagedLast := append([]byte(nil), content...)
+	damagedLast[len(content)-1] ^= 1
+
+	tests := []struct {
+		name    string
+		content []byte
+		want    []Frame
+		wantErr error
+	}{
+		{name: "Empty", content: nil, want: nil},
+		{name: "Whole", content: content, want: whole},
+		{name: "Cut off header", content: content[:len(content)-len("third")-3], want: whole[:2]},
+		{name: "Cut off content", content: content[:len(content)-1], want: whole[:2]},
+		{name: "Damaged last frame", content: damagedLast, want: whole[:2]},
+		{name: "Damaged frame followed by others", content: damaged, wantErr: ErrChecksum},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			frames, err := ReadFrames(tt.content)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("expected %v, got %v", tt.wantErr, err)
+			}
+			if len(frames) != len(tt.want) {
+				t.Fatalf("expected %d frames, got %+v", len(tt.want), frames)
+			}
+			for i := range frames {
+				if string(frames[i].Content) != string(tt.want[i].Content) || frames[i].End != tt.want[i].End {
+					t.Errorf("frame %d: expected %+v, got %+v", i, tt.want[i], frames[i])
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,678 @@
+package dbfile
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// msgpackMagic starts every MessagePack file. MessagePack never uses 0xc1 and
+// JSON cannot start with it, so no other file is mistaken for one
+const msgpackMagic = "\xc1ZHW"
+
+// extNumber is the MessagePack extension type of a JSON number literal that
+// has no exact native encoding, such as integers beyond 64 bits
+const extNumber = 1
+
+// maxDepth bounds the nesting of decoded values, like encoding/json does
+const maxDepth = 10000
+
+// msgpackCodec is the snapshot document in MessagePack, see EncodeMsgpack
+type msgpackCodec struct{}
+
+func (msgpackCodec) Format() Format { return FormatMsgpack }
+
+func (msgpackCodec) Detect(prefix []byte) bool {
+	return bytes.HasPrefix(prefix, []byte(msgpackMagic))
+}
+
+func (msgpackCodec) Encode(w io.Writer, snap *Snapshot) error {
+	return EncodeMsgpack(w, snap)
+}
+
+// Decode reads a MessagePack file. A record that is not a map always fails
+// it, as records carry no line to report, skipBad is ignored
+func (msgpackCodec) Decode(r io.Reader, skipBad bool) (*Snapshot, error) {
+	doc, err := readMsgpackDocument(r)
+	if err != nil {
+		return nil, err
+	}
+
+	snap := &Snapshot{
+		Header:    doc.header,
+		Records:   make([]map[string]interface{}, len(doc.records)),
+		Checksums: doc.checksums,
+		Format:    FormatMsgpack,
+	}
+	for i, value := range doc.records {
+		record, ok := value.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("record %d is not a map", i)
+		}
+		snap.Records[i] = record
+	}
+	if len(snap.Header.Meta) == 0 {
+		snap.Header.Meta = nil
+	}
+	if maxID := MaxID(snap.Records); maxID > snap.Header.Seq {
+		snap.Header.Seq = maxID
+	}
+	return snap, nil
+}
+
+// EncodeMsgpack writes the snapshot as the snapshot document in MessagePack,
+// behind a magic prefix, in the current format version. Numbers keep the JSON
+// literal they had: integers and floats are written natively when that is
+// exact, other literals as an extension holding the literal. Checksums cover
+// the JSON encoding of the records, so they survive converting the file
+func EncodeMsgpack(w io.Writer, snap *Snapshot) error {
+	header := snap.Header
+	header.Version = CurrentVersion
+	headerValue, err := toValue(header)
+	if err != nil {
+		return err
+	}
+
+	e := &msgpackEncoder{w: bufio.NewWriter(w)}
+	e.w.WriteString(msgpackMagic)
+	e.mapHeader(3)
+	e.string("header")
+	e.value(headerValue, 0)
+	e.string("records")
+	e.arrayHeader(len(snap.Records))
+
+	sums := &Checksums{Algorithm: ChecksumCRC32C, Records: make([]string, len(snap.Records))}
+	for i, record := range snap.Records {
+		encoded, err := e.record(record)
+		if err != nil {
+			return fmt.Errorf("error encoding record %d: %w", i, err)
+		}
+		sums.Records[i] = recordChecksum(encoded)
+	}
+	sums.File = fileChecksum(snap.Header, sums.Records)
+
+	sumsValue, err := toValue(sums)
+	if err != nil {
+		return err
+	}
+	e.string("checksums")
+	e.value(sumsValue, 0)
+	if err := e.w.Flush(); err != nil {
+		return fmt.Errorf("error writing MessagePack data: %w", err)
+	}
+	return nil
+}
+
+// msgpackDocument is a MessagePack file with its records left as decoded
+type msgpackDocument struct {
+	header    Header
+	records   []interface{}
+	checksums *Checksums
+}
+
+// readMsgpackDocument decodes a whole MessagePack file. Files of a newer
+// format version fail with ErrNewerVersion before anything else is checked
+func readMsgpackDocument(r io.Reader) (*msgpackDocument, error) {
+	d := &msgpackDecoder{r: bufio.NewReader(r)}
+	magic := make([]byte, len(msgpackMagic))
+	if _, err := io.ReadFull(d.r, magic); err != nil || string(magic) != msgpackMagic {
+		return nil, errors.New("not a MessagePack database file")
+	}
+
+	value, err := d.value(0)
+	if err != nil {
+		return nil, fmt.Errorf("error decoding MessagePack data: %w", err)
+	}
+	if _, err := d.r.ReadByte(); err != io.EOF {
+		return nil, errors.New("unexpected data after MessagePack document")
+	}
+	top, ok := value.(map[string]interface{})
+	if !ok {
+		return nil, errors.New("MessagePack document is not a map")
+	}
+
+	doc := &msgpackDocument{}
+	if header, ok := top["header"].(map[string]interface{}); ok {
+		// A version that is not a number is reported by the full decode
+		if version, err := strconv.Atoi(fmt.Sprint(header["version"])); err == nil {
+			if err := checkVersionNumber(version); err != nil {
+				return nil, err
+			}
+		}
+	}
+	for key, value := range top {
+		var err error
+		switch key {
+		case "header":
+			err = fromValue(value, &doc.header)
+		case "records":
+			var ok bool
+			if doc.records, ok = value.([]interface{}); !ok && value != nil {
+				err = errors.New("records are not an array")
+			}
+		case "checksums":
+			if value != nil {
+				doc.checksums = &Checksums{}
+				err = fromValue(value, doc.checksums)
+			}
+		default:
+			err = fmt.Errorf("unknown field %q", key)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("error decoding MessagePack data: %w", err)
+		}
+	}
+	if doc.header.Version == VersionLegacy {
+		doc.header.Version = VersionHeader
+	}
+	return doc, nil
+}
+
+// decodeRawMsgpack fills raw from MessagePack content, with every record
+// converted to JSON for Verify
+func decodeRawMsgpack(raw *RawSnapshot, content []byte) (*RawSnapshot, error) {
+	doc, err := readMsgpackDocument(bytes.NewReader(content))
+	if err != nil {
+		return nil, err
+	}
+	raw.Header, raw.Checksums = doc.header, doc.checksums
+	raw.Records = make([]json.RawMessage, len(doc.records))
+	for i, value := range doc.records {
+		if raw.Records[i], err = json.Marshal(value); err != nil {
+			return nil, fmt.Errorf("error encoding record %d: %w", i, err)
+		}
+	}
+	return raw, nil
+}
+
+// toValue converts v to the generic values records are made of, through its
+// JSON encoding, so struct tags apply as they do in JSON files
+func toValue(v interface{}) (interface{}, error) {
+	encoded, err := json.Marshal(v)
+	if err != nil {
+		return nil, fmt.Errorf("error encoding JSON data: %w", err)
+	}
+	var value interface{}
+	decoder := json.NewDecoder(bytes.NewReader(encoded))
+	decoder.UseNumber()
+	if err := decoder.Decode(&value); err != nil {
+		return nil, fmt.Errorf("error decoding JSON data: %w", err)
+	}
+	return value, nil
+}
+
+// fromValue is the reverse of toValue, unknown fields are refused
+func fromValue(value interface{}, v interface{}) error {
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	return unmarshal(encoded, v)
+}
+
+// msgpackEncoder writes values in MessagePack. Write errors stick to the
+// buffered writer and show up when it is flushed
+type msgpackEncoder struct {
+	w       *bufio.Writer
+	scratch [9]byte
+	float   [32]byte // Room to format floats without allocating
+	json    []byte   // JSON encoding of the record being written, see record
+	jsonOK  bool     // Whether json is being built and still exact
+}
+
+// record writes a record and returns its JSON encoding for the checksum,
+// built along the way the same as appendJSON does. The result is only valid
+// until the next call
+func (e *msgpackEncoder) record(record map[string]interface{}) ([]byte, error) {
+	e.json, e.jsonOK = e.json[:0], true
+	defer func() { e.jsonOK = false }()
+
+	if err := e.value(record, 0); err != nil {
+		return nil, err
+	}
+	if !e.jsonOK {
+		return json.Marshal(record)
+	}
+	return e.json, nil
+}
+
+func (e *msgpackEncoder) value(v interface{}, depth int) error {
+	if depth > maxDepth {
+		return errors.New("value nested too deeply")
+	}
+
+	switch v := v.(type) {
+	case nil:
+		e.w.WriteByte(0xc0)
+		e.appendJSON("null")
+	case bool:
+		if v {
+			e.w.WriteByte(0xc3)
+			e.appendJSON("true")
+		} else {
+			e.w.WriteByte(0xc2)
+			e.appendJSON("false")
+		}
+	case string:
+		e.string(v)
+		e.appendJSONString(v)
+	case json.Number:
+		e.number(string(v))
+		if e.jsonOK && validNumber(string(v)) {
+			e.json = append(e.json, v...)
+		} else {
+			e.jsonOK = false
+		}
+	case int:
+		e.int(int64(v))
+		if e.jsonOK {
+			e.json = strconv.AppendInt(e.json, int64(v), 10)
+		}
+	case int64:
+		e.int(v)
+		if e.jsonOK {
+			e.json = strconv.AppendInt(e.json, v, 10)
+		}
+	case map[string]interface{}:
+		if v == nil {
+			e.w.WriteByte(0xc0)
+			e.appendJSON("null")
+			break
+		}
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		slices.Sort(keys)
+		e.mapHeader(len(keys))
+		e.appendJSON("{")
+		for i, key := range keys {
+			if i > 0 {
+				e.appendJSON(",")
+			}
+			e.string(key)
+			e.appendJSONString(key)
+			e.appendJSON(":")
+			if err := e.value(v[key], depth+1); err != nil {
+				return err
+			}
+		}
+		e.appendJSON("}")
+	case []interface{}:
+		if v == nil {
+			e.w.WriteByte(0xc0)
+			e.appendJSON("null")
+			break
+		}
+		e.arrayHeader(len(v))
+		e.appendJSON("[")
+		for i, elem := range v {
+			if i > 0 {
+				e.appendJSON(",")
+			}
+			if err := e.value(elem, depth+1); err != nil {
+				return err
+			}
+		}
+		e.appendJSON("]")
+	default:
+		// Anything else is written as its JSON encoding would be, which also
+		// gives floats the literal they have in JSON files. The JSON of the
+		// record is left to json.Marshal, struct fields are not sorted
+		e.jsonOK = false
+		value, err := toValue(v)
+		if err != nil {
+			return err
+		}
+		return e.value(value, depth)
+	}
+	return nil
+}
+
+// appendJSON adds JSON text to the encoding of the current record
+func (e *msgpackEncoder) appendJSON(text string) {
+	if e.jsonOK {
+		e.json = append(e.json, text...)
+	}
+}
+
+// appendJSONString adds a string to the encoding of the current record, or
+// leaves the record to json.Marshal if the string needs escaping
+func (e *msgpackEncoder) appendJSONString(s string) {
+	if !e.jsonOK {
+		return
+	}
+	if !plainString(s) {
+		e.jsonOK = false
+		return
+	}
+	e.json = append(e.json, '"')
+	e.json = append(e.json, s...)
+	e.json = append(e.json, '"')
+}
+
+// number writes a JSON number literal natively if it decodes back to the
+// same literal, and as an extension otherwise
+func (e *msgpackEncoder) number(literal string) {
+	// Longer integers overflow 64 bits, parsing them would only allocate errors
+	if canonicalInt(literal) && len(literal) <= 20 {
+		if i, err := strconv.ParseInt(literal, 10, 64); err == nil {
+			e.int(i)
+			return
+		}
+		if u, err := strconv.ParseUint(literal, 10, 64); err == nil {
+			e.fixed(0xcf, u, 8)
+			return
+		}
+	} else if f, err := strconv.ParseFloat(literal, 64); err == nil && string(appendFloat(e.float[:0], f)) == literal {
+		e.fixed(0xcb, math.Float64bits(f), 8)
+		return
+	}
+	e.ext(extNumber, literal)
+}
+
+func (e *msgpackEncoder) int(i int64) {
+	switch {
+	case i >= 0 && i <= 0x7f:
+		e.w.WriteByte(byte(i))
+	case i < 0 && i >= -32:
+		e.w.WriteByte(byte(i))
+	case i >= math.MinInt8 && i <= math.MaxInt8:
+		e.fixed(0xd0, uint64(i), 1)
+	case i >= math.MinInt16 && i <= math.MaxInt16:
+		e.fixed(0xd1, uint64(i), 2)
+	case i >= math.MinInt32 && i <= math.MaxInt32:
+		e.fixed(0xd2, uint64(i), 4)
+	default:
+		e.fixed(0xd3, uint64(i), 8)
+	}
+}
+
+func (e *msgpackEncoder) string(s string) {
+	switch n := len(s); {
+	case n <= 31:
+		e.w.WriteByte(0xa0 | byte(n))
+	case n <= math.MaxUint8:
+		e.fixed(0xd9, uint64(n), 1)
+	case n <= math.MaxUint16:
+		e.fixed(0xda, uint64(n), 2)
+	default:
+		e.fixed(0xdb, uint64(n), 4)
+	}
+	e.w.WriteString(s)
+}
+
+func (e *msgpackEncoder) ext(kind byte, data string) {
+	switch n := len(data); {
+	case n <= math.MaxUint8:
+		e.fixed(0xc7, uint64(n), 1)
+	case n <= math.MaxUint16:
+		e.fixed(0xc8, uint64(n), 2)
+	default:
+		e.fixed(0xc9, uint64(n), 4)
+	}
+	e.w.WriteByte(kind)
+	e.w.WriteString(data)
+}
+
+func (e *msgpackEncoder) arrayHeader(n int) {
+	switch {
+	case n <= 15:
+		e.w.WriteByte(0x90 | byte(n))
+	case n <= math.MaxUint16:
+		e.fixed(0xdc, uint64(n), 2)
+	default:
+		e.fixed(0xdd, uint64(n), 4)
+	}
+}
+
+func (e *msgpackEncoder) mapHeader(n int) {
+	switch {
+	case n <= 15:
+		e.w.WriteByte(0x80 | byte(n))
+	case n <= math.MaxUint16:
+		e.fixed(0xde, uint64(n), 2)
+	default:
+		e.fixed(0xdf, uint64(n), 4)
+	}
+}
+
+// fixed writes a type byte followed by the low size bytes of v, big endian
+func (e *msgpackEncoder) fixed(kind byte, v uint64, size int) {
+	e.scratch[0] = kind
+	binary.BigEndian.PutUint64(e.scratch[1:], v<<(64-8*size))
+	e.w.Write(e.scratch[:1+size])
+}
+
+// msgpackDecoder reads values written by msgpackEncoder, and any other
+// MessagePack data except binary strings and foreign extensions. Numbers
+// become json.Number, as they do when JSON files are loaded
+type msgpackDecoder struct {
+	r *bufio.Reader
+}
+
+func (d *msgpackDecoder) value(depth int) (interface{}, error) {
+	if depth > maxDepth {
+		return nil, errors.New("value nested too deeply")
+	}
+	b, err := d.r.ReadByte()
+	if err != nil {
+		return nil, unexpectedEOF(err)
+	}
+
+	switch {
+	case b <= 0x7f:
+		return json.Number(strconv.Itoa(int(b))), nil
+	case b >= 0xe0:
+		return json.Number(strconv.Itoa(int(int8(b)))), nil
+	case b >= 0x80 && b <= 0x8f:
+		return d.mapValue(int(b&0x0f), depth)
+	case b >= 0x90 && b <= 0x9f:
+		return d.arrayValue(int(b&0x0f), depth)
+	case b >= 0xa0 && b <= 0xbf:
+		return d.stringValue(uint64(b & 0x1f))
+	}
+
+	switch b {
+	case 0xc0:
+		return nil, nil
+	case 0xc2:
+		return false, nil
+	case 0xc3:
+		return true, nil
+	case 0xca:
+		bits, err := d.uint(4)
+		if err != nil {
+			return nil, err
+		}
+		return floatValue(float64(math.Float32frombits(uint32(bits))))
+	case 0xcb:
+		bits, err := d.uint(8)
+		if err != nil {
+			return nil, err
+		}
+		return floatValue(math.Float64frombits(bits))
+	case 0xcc, 0xcd, 0xce, 0xcf:
+		u, err := d.uint(1 << (b - 0xcc))
+		if err != nil {
+			return nil, err
+		}
+		return json.Number(strconv.FormatUint(u, 10)), nil
+	case 0xd0, 0xd1, 0xd2, 0xd3:
+		size := 1 << (b - 0xd0)
+		u, err := d.uint(size)
+		if err != nil {
+			return nil, err
+		}
+		// Sign extend from size bytes
+		shift := 64 - 8*size
+		return json.Number(strconv.FormatInt(int64(u<<shift)>>shift, 10)), nil
+	case 0xd9, 0xda, 0xdb:
+		n, err := d.uint(1 << (b - 0xd9))
+		if err != nil {
+			return nil, err
+		}
+		return d.stringValue(n)
+	case 0xdc, 0xdd:
+		n, err := d.uint(2 << (b - 0xdc))
+		if err != nil {
+			return nil, err
+		}
+		return d.arrayValue(int(n), depth)
+	case 0xde, 0xdf:
+		n, err := d.uint(2 << (b - 0xde))
+		if err != nil {
+			return nil, err
+		}
+		return d.mapValue(int(n), depth)
+	case 0xd4, 0xd5, 0xd6, 0xd7, 0xd8:
+		return d.extValue(1 << (b - 0xd4))
+	case 0xc7, 0xc8, 0xc9:
+		n, err := d.uint(1 << (b - 0xc7))
+		if err != nil {
+			return nil, err
+		}
+		return d.extValue(n)
+	}
+	return nil, fmt.Errorf("unsupported type byte 0x%02x", b)
+}
+
+func (d *msgpackDecoder) mapValue(n int, depth int) (interface{}, error) {
+	m := make(map[string]interface{}, min(n, 1024))
+	for i := 0; i < n; i++ {
+		key, err := d.value(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		s, ok := key.(string)
+		if !ok {
+			return nil, errors.New("map key is not a string")
+		}
+		if m[s], err = d.value(depth + 1); err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+func (d *msgpackDecoder) arrayValue(n int, depth int) (interface{}, error) {
+	a := make([]interface{}, 0, min(n, 1024))
+	for i := 0; i < n; i++ {
+		elem, err := d.value(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		a = append(a, elem)
+	}
+	return a, nil
+}
+
+func (d *msgpackDecoder) stringValue(n uint64) (interface{}, error) {
+	b, err := d.bytes(n)
+	return string(b), err
+}
+
+// extValue decodes an extension of n bytes, only number literals are known
+func (d *msgpackDecoder) extValue(n uint64) (interface{}, error) {
+	kind, err := d.r.ReadByte()
+	if err != nil {
+		return nil, unexpectedEOF(err)
+	}
+	data, err := d.bytes(n)
+	if err != nil {
+		return nil, err
+	}
+	if kind != extNumber {
+		return nil, fmt.Errorf("unsupported extension type %d", int8(kind))
+	}
+	if !validNumber(string(data)) {
+		return nil, fmt.Errorf("invalid number literal %q", data)
+	}
+	return json.Number(data), nil
+}
+
+// bytes reads n bytes, without trusting n for the allocation
+func (d *msgpackDecoder) bytes(n uint64) ([]byte, error) {
+	if n <= 4096 {
+		b := make([]byte, n)
+		_, err := io.ReadFull(d.r, b)
+		return b, unexpectedEOF(err)
+	}
+	b, err := io.ReadAll(io.LimitReader(d.r, int64(n)))
+	if err == nil && uint64(len(b)) < n {
+		err = io.ErrUnexpectedEOF
+	}
+	return b, err
+}
+
+// uint reads a big endian unsigned integer of size bytes
+func (d *msgpackDecoder) uint(size int) (uint64, error) {
+	var buf [8]byte
+	if _, err := io.ReadFull(d.r, buf[8-size:]); err != nil {
+		return 0, unexpectedEOF(err)
+	}
+	return binary.BigEndian.Uint64(buf[:]), nil
+}
+
+// floatValue returns a decoded float as a number, JSON has no literal for
+// NaN and infinities
+func floatValue(f float64) (interface{}, error) {
+	if math.IsNaN(f) || math.IsInf(f, 0) {
+		return nil, fmt.Errorf("unsupported float %v", f)
+	}
+	return json.Number(formatFloat(f)), nil
+}
+
+// unexpectedEOF turns the end of the file inside a value into an error
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// formatFloat formats a float the way encoding/json does, with ".0" added to
+// integral values so they stay floats
+func formatFloat(f float64) string {
+	return string(appendFloat(nil, f))
+}
+
+// appendFloat appends the formatted float to buf, see formatFloat
+func appendFloat(buf []byte, f float64) []byte {
+	format := byte('f')
+	if abs := math.Abs(f); abs != 0 && (abs < 1e-6 || abs >= 1e21) {
+		format = 'e'
+	}
+	start := len(buf)
+	buf = strconv.AppendFloat(buf, f, format, -1, 64)
+	if format == 'e' {
+		// Clean up e-09 to e-9, as encoding/json does
+		if n := len(buf); n-start >= 4 && buf[n-4] == 'e' && buf[n-3] == '-' && buf[n-2] == '0' {
+			buf[n-2] = buf[n-1]
+			buf = buf[:n-1]
+		}
+	}
+	if !bytes.ContainsAny(buf[start:], ".e") {
+		buf = append(buf, '.', '0')
+	}
+	return buf
+}
+
+// canonicalInt reports whether s is an integer literal in the form
+// strconv.FormatInt writes
+func canonicalInt(s string) bool {
+	negative := strings.HasPrefix(s, "-")
+	s = strings.TrimPrefix(s, "-")
+	if s == "" || s[0] == '0' && (len(s) > 1 || negative) {
+		return false
+	}
+	return skipDigits(s) == ""
+}
@@ -0,0 +1,164 @@
+package dbfile
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+	"zabbixhw/pkg/repository/idgen"
+)
+
+// msgpackFile encodes a snapshot with every kind of value as MessagePack
+func msgpackFile(t *testing.T) ([]byte, *Snapshot) {
+	t.Helper()
+
+	snap := &Snapshot{
+		Header: Header{Seq: 3, IDStrategy: idgen.NameSequential, Meta: map[string]string{"owner": "ops"}},
+		Records: []map[string]interface{}{
+			{"id": json.Number("1"), "name": "Alice", "age": json.Number("30"), "score": json.Number("1.0")},
+			{"id": json.Number("2"), "tags": []interface{}{"a", nil, true, json.Number("-7")}, "nested": map[string]interface{}{"deep": []interface{}{}}},
+			{"id": json.Number("3"), "long": strings.Repeat("x", 70000), "native": float64(2), "int": 5},
+		},
+	}
+	var buf bytes.Buffer
+	if err := EncodeMsgpack(&buf, snap); err != nil {
+		t.Fatalf("EncodeMsgpack failed: %v", err)
+	}
+	return buf.Bytes(), snap
+}
+
+// encodeValues writes raw MessagePack values behind the magic prefix
+func encodeValues(values ...interface{}) []byte {
+	var buf bytes.Buffer
+	e := &msgpackEncoder{w: bufio.NewWriter(&buf)}
+	e.w.WriteString(msgpackMagic)
+	for _, v := range values {
+		e.value(v, 0)
+	}
+	e.w.Flush()
+	return buf.Bytes()
+}
+
+func Test_MsgpackRoundTrip(t *testing.T) {
+	content, original := msgpackFile(t)
+	if format := DetectFormat(content); format != FormatMsgpack {
+		t.Fatalf("expected %s, got %s", FormatMsgpack, format)
+	}
+
+	snap, err := Decode(content)
+	if err != nil {
+		t.Fatalf("Decode failed: %v", err)
+	}
+	expectedHeader := Header{Version: CurrentVersion, Seq: 3, IDStrategy: idgen.NameSequential, Meta: map[string]string{"owner": "ops"}}
+	if !reflect.DeepEqual(snap.Header, expectedHeader) || snap.Format != FormatMsgpack {
+		t.Errorf("expected header %+v, got %+v in %s", expectedHeader, snap.Header, snap.Format)
+	}
+
+	// Records read back encode to the same JSON, so the checksums hold
+	for i, record := range snap.Records {
+		got, _ := json.Marshal(record)
+		expected, _ := json.Marshal(original.Records[i])
+		if !bytes.Equal(got, expected) {
+			t.Errorf("record %d: expected %s, got %s", i, expected, got)
+		}
+	}
+	if report := CheckIntegrity(snap); !report.Checked || !report.OK() {
+		t.Errorf("expected intact checksums, got %s", report)
+	}
+
+	// Converting keeps the checksums, they cover the JSON encoding
+	var buf bytes.Buffer
+	if err := Encode(&buf, snap); err != nil {
+		t.Fatalf("Encode failed: %v", err)
+	}
+	converted, _ := Decode(buf.Bytes())
+	if !reflect.DeepEqual(converted.Checksums, snap.Checksums) {
+		t.Errorf("expected checksums %+v, got %+v", snap.Checksums, converted.Checksums)
+	}
+
+	raw, err := DecodeRaw(content)
+	if err != nil || len(raw.Records) != 3 || raw.Format != FormatMsgpack {
+		t.Fatalf("unexpected raw snapshot %+v (%v)", raw, err)
+	}
+	if problems := Verify(raw, idgen.Sequential{}); len(problems) != 0 {
+		t.Errorf("unexpected problems %v", problems)
+	}
+}
+
+func Test_MsgpackNumbers(t *testing.T) {
+	tests := []struct {
+		name     string
+		value    interface{}
+		expected json.Number
+		native   bool // Written as a MessagePack number rather than a literal
+	}{
+		{name: "Small integer", value: json.Number("7"), expected: "7", native: true},
+		{name: "Negative integer", value: json.Number("-300"), expected: "-300", native: true},
+		{name: "Largest uint64", value: json.Number("18446744073709551615"), expected: "18446744073709551615", native: true},
+		{name: "Integral float", value: json.Number("1.0"), expected: "1.0", native: true},
+		{name: "Fraction", value: json.Number("0.25"), expected: "0.25", native: true},
+		{name: "Negative zero", value: json.Number("-0.0"), expected: "-0.0", native: true},
+		{name: "Small exponent", value: json.Number("1e-7"), expected: "1e-7", native: true},
+		{name: "Beyond 64 bits", value: json.Number("123456789012345678901234567890"), expected: "123456789012345678901234567890"},
+		{name: "Uncommon spelling", value: json.Number("1E3"), expected: "1E3"},
+		{name: "Trailing zero", value: json.Number("1.50"), expected: "1.50"},
+		{name: "Go float", value: float64(2), expected: "2", native: true},
+		{name: "Go int", value: int64(-1) << 40, expected: "-1099511627776", native: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			content := encodeValues(tt.value)
+			if native := content[len(msgpackMagic)] != 0xc7; native != tt.native {
+				t.Errorf("expected native %v, got % x", tt.native, content)
+			}
+
+			d := &msgpackDecoder{r: bufio.NewReader(bytes.NewReader(content[len(msgpackMagic):]))}
+			got, err := d.value(0)
+			if err != nil {
+				t.Fatalf("decode failed: %v", err)
+			}
+			if got != tt.expected {
+				t.Errorf("expected %q, got %#v", tt.expected, got)
+			}
+		})
+	}
+}
+
+func Test_MsgpackErrors(t *testing.T) {
+	content, _ := msgpackFile(t)
+	header := map[string]interface{}{"version": json.Number("2"), "seq": json.Number("1")}
+
+	tests := []struct {
+		name        string
+		content     []byte
+		expectedErr error
+	}{
+		{name: "Truncated", content: content[:len(content)/2], expectedErr: io.ErrUnexpectedEOF},
+		{name: "Trailing data", content: append(content[:len(content):len(content)], 0xc0)},
+		{name: "Newer version", content: encodeValues(map[string]interface{}{"header": map[string]interface{}{"version": json.Number("9")}, "pages": []interface{}{}}), expectedErr: ErrNewerVersion},
+		{name: "Unknown field", content: encodeValues(map[string]interface{}{"header": header, "extra": true})},
+		{name: "Record not a map", content: encodeValues(map[string]interface{}{"header": header, "records": []interface{}{"junk"}})},
+		{name: "Not a number", content: append(encodeValues(), 0xd4, extNumber, 'x')},
+		{name: "Unknown extension", content: append(encodeValues(), 0xd4, 7, '1')},
+		{name: "Binary data", content: append(encodeValues(), 0xc4, 1, 0)},
+		{name: "NaN", content: append(encodeValues(), 0xcb, 0x7f, 0xf8, 0, 0, 0, 0, 0, 1)},
+		{name: "Huge string length", content: append(encodeValues(), 0xdb, 0xff, 0xff, 0xff, 0xff, 'a')},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Decode(tt.content)
+			if err == nil {
+				t.Fatal("expected an error, got none")
+			}
+			if tt.expectedErr != nil && !errors.Is(err, tt.expectedErr) {
+				t.Errorf("expected %v, got %v", tt.expectedErr, err)
+			}
+		})
+	}
+}
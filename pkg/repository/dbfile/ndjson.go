@@ -0,0 +1,259 @@
+package dbfile
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// ndjsonPrefix starts every NDJSON file, so the layout is known before
+// anything else is read
+const ndjsonPrefix = `{"format":"ndjson"`
+
+// ndjsonHead is the first line of an NDJSON file
+type ndjsonHead struct {
+	Format Format `json:"format"`
+	Header Header `json:"header"`
+}
+
+// ndjsonTrailer is the last line of an NDJSON file, it holds the checksums of
+// the record lines
+type ndjsonTrailer struct {
+	Checksums *Checksums `json:"checksums"`
+}
+
+// LineError is a line of an NDJSON file that could not be decoded
+type LineError struct {
+	Line int    // Line number, starting at 1
+	Raw  string // Content of the line
+	Err  error
+}
+
+func (e *LineError) Error() string {
+	return fmt.Sprintf("line %d: %v", e.Line, e.Err)
+}
+
+func (e *LineError) Unwrap() error {
+	return e.Err
+}
+
+// EncodeNDJSON writes the snapshot as JSON Lines: a header line, one line per
+// record and a line with the checksums, in the current format version
+func EncodeNDJSON(w io.Writer, snap *Snapshot) error {
+	bw := bufio.NewWriter(w)
+	encoder := json.NewEncoder(bw)
+
+	header := snap.Header
+	header.Version = CurrentVersion
+	if err := encoder.Encode(ndjsonHead{Format: FormatNDJSON, Header: header}); err != nil {
+		return fmt.Errorf("error encoding JSON data: %w", err)
+	}
+
+	sums := &Checksums{Algorithm: ChecksumCRC32C, Records: make([]string, len(snap.Records))}
+	for i, record := range snap.Records {
+		encoded, err := marshalRecord(record)
+		if err != nil {
+			return fmt.Errorf("error encoding record %d: %w", i, err)
+		}
+		sums.Records[i] = recordChecksum(encoded)
+		bw.Write(encoded)
+		bw.WriteByte('\n')
+	}
+	sums.File = fileChecksum(snap.Header, sums.Records)
+
+	if err := encoder.Encode(ndjsonTrailer{Checksums: sums}); err != nil {
+		return fmt.Errorf("error encoding JSON data: %w", err)
+	}
+	return bw.Flush()
+}
+
+// peekNDJSON skips leading whitespace and tells whether an NDJSON file
+// follows. It also returns the number of lines skipped
+func peekNDJSON(br *bufio.Reader) (bool, int, error) {
+	lines := 0
+	for {
+		b, err := br.Peek(1)
+		if err == io.EOF {
+			return false, lines, nil
+		}
+		if err != nil {
+			return false, lines, err
+		}
+		if !isSpace(b[0]) {
+			break
+		}
+		if b[0] == '\n' {
+			lines++
+		}
+		br.ReadByte()
+	}
+
+	prefix, err := br.Peek(len(ndjsonPrefix))
+	if err != nil && err != io.EOF {
+		return false, lines, err
+	}
+	return string(prefix) == ndjsonPrefix, lines, nil
+}
+
+// readNDJSON decodes an NDJSON file whose header line follows after line
+// lines. A broken header line always fails the read, as nothing can be loaded
+// without it
+func readNDJSON(br *bufio.Reader, skipBad bool, line int) (*Snapshot, error) {
+	snap := &Snapshot{Records: []map[string]interface{}{}, Format: FormatNDJSON}
+	var skipped map[int]bool // Positions of skipped records, for the checksums
+	var sums *Checksums
+
+	head := false
+	position := 0
+	for {
+		content, readErr := br.ReadBytes('\n')
+		if readErr != nil && readErr != io.EOF {
+			return nil, fmt.Errorf("error reading file: %w", readErr)
+		}
+		content = bytes.TrimSpace(content)
+		line++
+
+		switch {
+		case len(content) == 0:
+			// Blank lines carry nothing, not even at the end of the file
+		case !head:
+			if err := decodeHead(content, &snap.Header); err != nil {
+				return nil, &LineError{Line: line, Raw: string(content), Err: err}
+			}
+			head = true
+		default:
+			record, trailer, err := decodeLine(content, sums != nil)
+			switch {
+			case err != nil && !skipBad:
+				return nil, &LineError{Line: line, Raw: string(content), Err: err}
+			case err != nil:
+				snap.Skipped = append(snap.Skipped, LineError{Line: line, Raw: string(content), Err: err})
+				if skipped == nil {
+					skipped = make(map[int]bool)
+				}
+				skipped[position] = true
+				position++
+			case trailer != nil:
+				sums = trailer
+			default:
+				snap.Records = append(snap.Records, record)
+				position++
+			}
+		}
+
+		if readErr == io.EOF {
+			break
+		}
+	}
+	// Drop the checksums of skipped records, so the rest still line up
+	if sums != nil && len(skipped) > 0 {
+		kept := make([]string, 0, len(sums.Records))
+		for i, sum := range sums.Records {
+			if !skipped[i] {
+				kept = append(kept, sum)
+			}
+		}
+		sums.Records = kept
+	}
+	snap.Checksums = sums
+
+	if maxID := MaxID(snap.Records); maxID > snap.Header.Seq {
+		snap.Header.Seq = maxID
+	}
+	return snap, nil
+}
+
+// decodeHead decodes the header line of an NDJSON file
+func decodeHead(content []byte, header *Header) error {
+	if err := checkVersion(content); err != nil {
+		return err
+	}
+
+	var head ndjsonHead
+	if err := unmarshal(content, &head); err != nil {
+		return fmt.Errorf("error unmarshalling header: %w", err)
+	}
+	if head.Format != FormatNDJSON {
+		return fmt.Errorf("unexpected format %q", head.Format)
+	}
+	if head.Header.Version == VersionLegacy {
+		head.Header.Version = VersionHeader
+	}
+	if len(head.Header.Meta) == 0 {
+		head.Header.Meta = nil
+	}
+	*header = head.Header
+	return nil
+}
+
+// decodeLine decodes a line after the header. It returns either a record or,
+// for the checksums line, the checksums. Records always have an ID, so an
+// object holding nothing but checksums is the trailer
+func decodeLine(content []byte, afterTrailer bool) (map[string]interface{}, *Checksums, error) {
+	if afterTrailer {
+		return nil, nil, errors.New("data after the checksums line")
+	}
+
+	var record map[string]interface{}
+	if err := unmarshal(content, &record); err != nil {
+		return nil, nil, err
+	}
+	if record == nil {
+		return nil, nil, errors.New("line is not a JSON object")
+	}
+
+	if _, ok := record["checksums"]; ok && len(record) == 1 {
+		var trailer ndjsonTrailer
+		if err := unmarshal(content, &trailer); err != nil {
+			return nil, nil, fmt.Errorf("malformed checksums line: %w", err)
+		}
+		if trailer.Checksums == nil {
+			return nil, nil, errors.New("empty checksums line")
+		}
+		return nil, trailer.Checksums, nil
+	}
+	return record, nil, nil
+}
+
+// decodeRawNDJSON fills raw from NDJSON content, keeping the line of every
+// record. Lines that are not JSON objects stay in raw.Records for Verify
+func decodeRawNDJSON(raw *RawSnapshot, content []byte) (*RawSnapshot, error) {
+	lines, numbers := splitLines(content)
+	for i, line := range lines {
+		if i == 0 {
+			if err := decodeHead(line, &raw.Header); err != nil {
+				return nil, &LineError{Line: numbers[i], Raw: string(line), Err: err}
+			}
+			continue
+		}
+
+		// A broken checksums line is reported as a malformed record
+		if _, sums, err := decodeLine(line, false); err == nil && sums != nil && i == len(lines)-1 {
+			raw.Checksums = sums
+			continue
+		}
+		raw.Records = append(raw.Records, json.RawMessage(line))
+		raw.Lines = append(raw.Lines, numbers[i])
+	}
+	return raw, nil
+}
+
+// splitLines splits NDJSON content into its non-blank lines with their line
+// numbers
+func splitLines(content []byte) (lines [][]byte, numbers []int) {
+	for i, line := range bytes.Split(content, []byte("\n")) {
+		if line = bytes.TrimSpace(line); len(line) > 0 {
+			lines = append(lines, line)
+			numbers = append(numbers, i+1)
+		}
+	}
+	return lines, numbers
+}
+
+// isSpace reports whether b is JSON whitespace
+func isSpace(b byte) bool {
+	return b == ' ' || b == '\t' || b == '\n' || b == '\r'
+}
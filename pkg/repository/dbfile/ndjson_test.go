@@ -0,0 +1,161 @@
+package dbfile
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"zabbixhw/pkg/repository/idgen"
+)
+
+// ndjsonFile encodes three records as NDJSON
+func ndjsonFile(t *testing.T) string {
+	t.Helper()
+
+	snap := &Snapshot{
+		Header: Header{Seq: 3, IDStrategy: idgen.NameSequential, Meta: map[string]string{"owner": "ops"}},
+		Records: []map[string]interface{}{
+			{"id": json.Number("1"), "name": "Alice", "note": "two\nlines"},
+			{"id": json.Number("2"), "checksums": "not a trailer"},
+			{"id": json.Number("3"), "big": json.Number("123456789012345678901234567890")},
+		},
+	}
+	var buf bytes.Buffer
+	if err := EncodeNDJSON(&buf, snap); err != nil {
+		t.Fatalf("EncodeNDJSON failed: %v", err)
+	}
+	return buf.String()
+}
+
+// replaceLine replaces line n, starting at 1, of content
+func replaceLine(content string, n int, line string) string {
+	lines := strings.Split(content, "\n")
+	lines[n-1] = line
+	return strings.Join(lines, "\n")
+}
+
+func Test_NDJSONRoundTrip(t *testing.T) {
+	content := ndjsonFile(t)
+	if lines := strings.Count(content, "\n"); lines != 5 {
+		t.Fatalf("expected 5 lines, got %d:\n%s", lines, content)
+	}
+	if format := DetectFormat([]byte(content)); format != FormatNDJSON {
+		t.Errorf("expected %s, got %s", FormatNDJSON, format)
+	}
+
+	snap, err := Read(strings.NewReader(content), false)
+	if err != nil {
+		t.Fatalf("Read failed: %v", err)
+	}
+	expectedHeader := Header{Version: CurrentVersion, Seq: 3, IDStrategy: idgen.NameSequential, Meta: map[string]string{"owner": "ops"}}
+	if !reflect.DeepEqual(snap.Header, expectedHeader) {
+		t.Errorf("expected header %+v, got %+v", expectedHeader, snap.Header)
+	}
+	if len(snap.Records) != 3 || snap.Records[0]["note"] != "two\nlines" || snap.Records[2]["big"] != json.Number("123456789012345678901234567890") {
+		t.Errorf("unexpected records %v", snap.Records)
+	}
+	if report := CheckIntegrity(snap); !report.Checked || !report.OK() {
+		t.Errorf("expected intact checksums, got %s", report)
+	}
+
+	// Decode takes the same path for whole content
+	decoded, err := Decode([]byte(content))
+	if err != nil || !reflect.DeepEqual(decoded.Records, snap.Records) {
+		t.Errorf("expected Decode to match Read, got %v (%v)", decoded, err)
+	}
+}
+
+func Test_NDJSONBadLines(t *testing.T) {
+	damaged := replaceLine(ndjsonFile(t), 3, `{"id": 2, "checks`)
+
+	var lineErr *LineError
+	if _, err := Read(strings.NewReader(damaged), false); !errors.As(err, &lineErr) || lineErr.Line != 3 {
+		t.Fatalf("expected an error for line 3, got %v", err)
+	}
+
+	snap, err := Read(strings.NewReader(damaged), true)
+	if err != nil {
+		t.Fatalf("Read failed: %v", err)
+	}
+	if len(snap.Records) != 2 || len(snap.Skipped) != 1 || snap.Skipped[0].Line != 3 {
+		t.Fatalf("expected line 3 skipped and 2 records, got %d records and %v", len(snap.Records), snap.Skipped)
+	}
+
+	// The remaining records still match their checksums
+	expected := IntegrityReport{Checked: true, Records: 2, BadLines: []int{3}, FileMismatch: true}
+	if report := CheckIntegrity(snap); !reflect.DeepEqual(report, expected) {
+		t.Errorf("expected %+v, got %+v", expected, report)
+	}
+
+	for _, policy := range []Policy{PolicyQuarantine, PolicyWarn} {
+		snap, _ := Read(strings.NewReader(damaged), true)
+		_, quarantined, err := Enforce(snap, policy)
+		if err != nil {
+			t.Fatalf("%s: Enforce failed: %v", policy, err)
+		}
+		if len(quarantined) != 1 || quarantined[0].Line != 3 || quarantined[0].Raw != `{"id": 2, "checks` {
+			t.Errorf("%s: unexpected quarantine %+v", policy, quarantined)
+		}
+	}
+}
+
+func Test_NDJSONRead(t *testing.T) {
+	content := ndjsonFile(t)
+
+	tests := []struct {
+		name        string
+		content     string
+		expectedErr error
+		badLine     int
+	}{
+		{name: "Leading blank lines", content: "\n\n" + replaceLine(content, 2, "[]"), badLine: 4},
+		{name: "Broken header", content: replaceLine(content, 1, `{"format":"ndjson","header":{"seq":`), badLine: 1},
+		{name: "Newer version", content: replaceLine(content, 1, `{"format":"ndjson","header":{"version":9},"shards":2}`), expectedErr: ErrNewerVersion},
+		{name: "Data after checksums", content: content + `{"id":9}` + "\n", badLine: 6},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// The header cannot be skipped, every other line can
+			_, strictErr := Read(strings.NewReader(tt.content), false)
+			_, skipErr := Read(strings.NewReader(tt.content), true)
+
+			if tt.expectedErr != nil {
+				if !errors.Is(strictErr, tt.expectedErr) {
+					t.Errorf("expected %v, got %v", tt.expectedErr, strictErr)
+				}
+				return
+			}
+			var lineErr *LineError
+			if !errors.As(strictErr, &lineErr) || lineErr.Line != tt.badLine {
+				t.Errorf("expected an error for line %d, got %v", tt.badLine, strictErr)
+			}
+			if (skipErr != nil) != (tt.badLine == 1) {
+				t.Errorf("unexpected error skipping bad lines: %v", skipErr)
+			}
+		})
+	}
+}
+
+func Test_NDJSONVerify(t *testing.T) {
+	damaged := replaceLine(ndjsonFile(t), 2, `"junk"`)
+	damaged = strings.Replace(damaged, `"not a trailer"`, `"not a trailex"`, 1)
+
+	raw, err := DecodeRaw([]byte(damaged))
+	if err != nil {
+		t.Fatalf("DecodeRaw failed: %v", err)
+	}
+	var got []string
+	for _, p := range Verify(raw, idgen.Sequential{}) {
+		got = append(got, p.String())
+	}
+	expected := []string{
+		"line 2 (record 0): malformed: entry is not a JSON object",
+		"line 3 (record 1): checksum: content does not match its checksum",
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected %q, got %q", expected, got)
+	}
+}
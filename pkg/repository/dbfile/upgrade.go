@@ -0,0 +1,56 @@
+package dbfile
+
+import (
+	"fmt"
+	"strconv"
+	"zabbixhw/pkg/fsys"
+)
+
+// MetaUpgradedFrom is the metadata key recording the version a file was last
+// upgraded from
+const MetaUpgradedFrom = "upgradedFrom"
+
+// BackupPath returns where the database file at path is kept before it is
+// upgraded from version
+func BackupPath(path string, version int) string {
+	return fmt.Sprintf("%s.v%d.bak", path, version)
+}
+
+// NeedsUpgrade reports whether a file was written in an older format version
+func NeedsUpgrade(header Header) bool {
+	return header.Version < CurrentVersion
+}
+
+// Upgrade copies the database file at path to its backup and records the
+// upgrade in header. The caller then rewrites the file, which Encode does in
+// the current version. With keys a plaintext file is encrypted with the
+// primary key in the backup. It returns the path of the backup
+func Upgrade(fs fsys.FS, path string, header *Header, keys *Keyring) (string, error) {
+	backup := BackupPath(path, header.Version)
+	if err := copyFile(fs, path, backup, keys); err != nil {
+		return "", fmt.Errorf("error backing up database file: %w", err)
+	}
+
+	meta := make(map[string]string, len(header.Meta)+1)
+	for k, v := range header.Meta {
+		meta[k] = v
+	}
+	meta[MetaUpgradedFrom] = strconv.Itoa(header.Version)
+	header.Meta = meta
+	return backup, nil
+}
+
+// copyFile copies src to dst, readable by the owner only, encrypting it with
+// the primary key of keys unless it already is
+func copyFile(fs fsys.FS, src, dst string, keys *Keyring) error {
+	content, err := readAll(fs, src)
+	if err != nil {
+		return err
+	}
+	if keys != nil && EncryptionKeyID(content) == "" {
+		if content, err = Encrypt(content, keys.Primary()); err != nil {
+			return err
+		}
+	}
+	return fsys.WriteFile(fs, dst, content, 0600)
+}
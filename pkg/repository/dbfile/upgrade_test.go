@@ -0,0 +1,53 @@
+package dbfile
+
+import (
+	iofs "io/fs"
+	"testing"
+	"zabbixhw/pkg/fsys"
+)
+
+func Test_Upgrade(t *testing.T) {
+	const legacy = `[{"id":1,"name":"Alice"}]`
+	fs := fsys.NewMemFS()
+	fs.WriteFile("db.json", []byte(legacy))
+
+	snap, err := Decode([]byte(legacy))
+	if err != nil {
+		t.Fatalf("Decode failed: %v", err)
+	}
+	if !NeedsUpgrade(snap.Header) {
+		t.Fatalf("expected version %d to need an upgrade", snap.Header.Version)
+	}
+
+	backup, err := Upgrade(fs, "db.json", &snap.Header, nil)
+	if err != nil {
+		t.Fatalf("Upgrade failed: %v", err)
+	}
+	if backup != "db.json.v0.bak" {
+		t.Errorf("expected backup db.json.v0.bak, got %s", backup)
+	}
+	if content, err := fs.ReadFile(backup); err != nil || string(content) != legacy {
+		t.Errorf("expected the backup to hold %s, got %s (%v)", legacy, content, err)
+	}
+	if snap.Header.Meta[MetaUpgradedFrom] != "0" {
+		t.Errorf("expected the upgrade in the metadata, got %v", snap.Header.Meta)
+	}
+
+	if info, _ := fs.Stat(backup); info.Mode().Perm() != 0600 {
+		t.Errorf("expected mode %v, got %v", iofs.FileMode(0600), info.Mode().Perm())
+	}
+
+	// With keys a plaintext file is encrypted in its backup
+	keys := testKeyring(t, testKey(t, 1))
+	if _, err := Upgrade(fs, "db.json", &Header{Version: 1}, keys); err != nil {
+		t.Fatalf("Upgrade with keys failed: %v", err)
+	}
+	content, _ := fs.ReadFile("db.json.v1.bak")
+	if plain, id, err := Decrypt(content, keys); err != nil || id != keys.Primary().ID || string(plain) != legacy {
+		t.Errorf("expected the backup to hold %s encrypted, got %s with key %q (%v)", legacy, plain, id, err)
+	}
+
+	if _, err := Upgrade(fs, "missing.json", &Header{}, nil); err == nil {
+		t.Error("expected an error for a missing file")
+	}
+}
@@ -0,0 +1,277 @@
+package dbfile
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"zabbixhw/pkg/repository"
+	"zabbixhw/pkg/repository/idgen"
+)
+
+// RawSnapshot is a database file with its records left undecoded, so that
+// tools can look at every entry on its own
+type RawSnapshot struct {
+	Format      Format
+	Header      Header // As stored, the sequence is not adjusted
+	Records     []json.RawMessage
+	Lines       []int // Line of each record in NDJSON files
+	Checksums   *Checksums
+	Compression Compression
+}
+
+// DecodeRaw parses the layout of file content without decoding the records
+func DecodeRaw(content []byte) (*RawSnapshot, error) {
+	// Encrypted files have to be decrypted by the caller
+	content, _, err := Decrypt(content, nil)
+	if err != nil {
+		return nil, err
+	}
+	content, compression, err := decompressAll(content)
+	if err != nil {
+		return nil, err
+	}
+	raw := &RawSnapshot{Format: DetectFormat(content), Compression: compression}
+	switch raw.Format {
+	case FormatNDJSON:
+		// Untrimmed, so line numbers match the file
+		return decodeRawNDJSON(raw, content)
+	case FormatMsgpack:
+		return decodeRawMsgpack(raw, content)
+	}
+	content = bytes.TrimSpace(content)
+	if len(content) == 0 {
+		return raw, nil
+	}
+
+	switch raw.Format {
+	case FormatLegacy:
+		err = unmarshal(content, &raw.Records)
+	default:
+		if err := checkVersion(content); err != nil {
+			return nil, err
+		}
+		doc := struct {
+			Header    Header            `json:"header"`
+			Records   []json.RawMessage `json:"records"`
+			Checksums *Checksums        `json:"checksums"`
+		}{}
+		err = unmarshal(content, &doc)
+		raw.Header, raw.Records, raw.Checksums = doc.Header, doc.Records, doc.Checksums
+		if raw.Header.Version == VersionLegacy {
+			raw.Header.Version = VersionHeader
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error unmarshalling JSON data: %w", err)
+	}
+
+	return raw, nil
+}
+
+// ProblemKind classifies what is wrong with an entry
+type ProblemKind string
+
+const (
+	ProblemMalformed   ProblemKind = "malformed"     // Entry is not a JSON object
+	ProblemChecksum    ProblemKind = "checksum"      // Record does not match its checksum
+	ProblemFileSum     ProblemKind = "file-checksum" // Header or record list does not match the file checksum
+	ProblemMissingID   ProblemKind = "missing-id"    // Record has no ID
+	ProblemInvalidID   ProblemKind = "invalid-id"    // ID of a type the engines reject with ErrInvalidIDType
+	ProblemForeignID   ProblemKind = "foreign-id"    // ID the strategy of the file cannot produce, unreachable through the API
+	ProblemDuplicateID ProblemKind = "duplicate-id"  // ID already used by an earlier record
+	ProblemSeqBehind   ProblemKind = "seq-behind"    // Header sequence is lower than an existing ID
+)
+
+// Problem is an integrity issue found by Verify
+type Problem struct {
+	Index  int // Position of the entry, -1 for the header
+	Line   int // Line of the entry in NDJSON files, 0 otherwise
+	Kind   ProblemKind
+	Detail string
+}
+
+func (p Problem) String() string {
+	switch {
+	case p.Index < 0:
+		return fmt.Sprintf("header: %s: %s", p.Kind, p.Detail)
+	case p.Line > 0:
+		return fmt.Sprintf("line %d (record %d): %s: %s", p.Line, p.Index, p.Kind, p.Detail)
+	}
+	return fmt.Sprintf("record %d: %s: %s", p.Index, p.Kind, p.Detail)
+}
+
+// Strategy returns the ID strategy the file was created with. Files without
+// one are sequential
+func (raw *RawSnapshot) Strategy(node int64) (idgen.Strategy, error) {
+	name := raw.Header.IDStrategy
+	if name == "" {
+		name = idgen.NameSequential
+	}
+	return idgen.New(name, node)
+}
+
+// Verify lists every integrity problem of the file, in file order. ids is the
+// strategy of the file and decides which IDs are foreign
+func Verify(raw *RawSnapshot, ids idgen.Strategy) []Problem {
+	var problems []Problem
+	seen := make(map[repository.ID]int)
+	records := make([]map[string]interface{}, 0, len(raw.Records))
+
+	if problem := raw.checkFileSum(); problem != nil {
+		problems = append(problems, *problem)
+	}
+	for i, entry := range raw.Records {
+		record, problem := raw.checkRecord(i, entry, ids, seen)
+		if problem != nil {
+			problems = append(problems, *problem)
+		}
+		if record != nil {
+			records = append(records, record)
+		}
+	}
+
+	// Legacy files have no sequence to fall behind
+	if raw.Format != FormatLegacy {
+		if maxID := MaxID(records); maxID > raw.Header.Seq {
+			problems = append(problems, Problem{
+				Index:  -1,
+				Kind:   ProblemSeqBehind,
+				Detail: fmt.Sprintf("sequence %d is lower than ID %d", raw.Header.Seq, maxID),
+			})
+		}
+	}
+
+	return problems
+}
+
+// RepairMode decides what Repair does with records whose ID is unusable
+type RepairMode string
+
+const (
+	RepairDrop     RepairMode = "drop"     // Remove the record
+	RepairRenumber RepairMode = "renumber" // Give the record a new ID from the strategy
+)
+
+// Repair builds a snapshot free of the problems Verify reports. Malformed
+// entries and records failing their checksum are always dropped, records with
+// an unusable ID are dropped or renumbered according to mode. The result is
+// sealed with fresh checksums when encoded. It returns the problems it fixed
+func Repair(raw *RawSnapshot, ids idgen.Strategy, mode RepairMode) (*Snapshot, []Problem, error) {
+	if mode != RepairDrop && mode != RepairRenumber {
+		return nil, nil, fmt.Errorf("unknown repair mode %q", mode)
+	}
+
+	snap := &Snapshot{
+		Header:  Header{Seq: raw.Header.Seq, IDStrategy: ids.Name(), Meta: raw.Header.Meta},
+		Records: make([]map[string]interface{}, 0, len(raw.Records)),
+	}
+	var fixed []Problem
+	var renumber []map[string]interface{}
+	seen := make(map[repository.ID]int)
+
+	if problem := raw.checkFileSum(); problem != nil {
+		fixed = append(fixed, *problem)
+	}
+	for i, entry := range raw.Records {
+		record, problem := raw.checkRecord(i, entry, ids, seen)
+		if problem == nil {
+			snap.Records = append(snap.Records, record)
+			continue
+		}
+
+		fixed = append(fixed, *problem)
+		if record != nil && problem.Kind != ProblemChecksum && mode == RepairRenumber {
+			renumber = append(renumber, record)
+		}
+	}
+
+	// New IDs must come after every kept one, so the sequence catches up first
+	if maxID := MaxID(snap.Records); maxID > snap.Header.Seq {
+		snap.Header.Seq = maxID
+	}
+	if raw.Format != FormatLegacy && MaxID(snap.Records) > raw.Header.Seq {
+		fixed = append(fixed, Problem{Index: -1, Kind: ProblemSeqBehind, Detail: "sequence raised to the highest ID"})
+	}
+
+	for _, record := range renumber {
+		id, err := ids.NewID(snap.Header.Seq + 1)
+		if err != nil {
+			return nil, nil, fmt.Errorf("error generating ID: %w", err)
+		}
+		snap.Header.Seq++
+		record["id"] = id
+		snap.Records = append(snap.Records, record)
+	}
+
+	return snap, fixed, nil
+}
+
+// checkFileSum compares the header and record checksums with the file
+// checksum, if the file has checksums
+func (raw *RawSnapshot) checkFileSum() *Problem {
+	sums := raw.Checksums
+	switch {
+	case sums == nil:
+		return nil
+	case sums.Algorithm != ChecksumCRC32C:
+		return &Problem{Index: -1, Kind: ProblemFileSum, Detail: fmt.Sprintf("unknown algorithm %q", sums.Algorithm)}
+	case len(sums.Records) != len(raw.Records):
+		return &Problem{Index: -1, Kind: ProblemFileSum, Detail: fmt.Sprintf("%d record checksums for %d records", len(sums.Records), len(raw.Records))}
+	case fileChecksum(raw.Header, sums.Records) != sums.File:
+		return &Problem{Index: -1, Kind: ProblemFileSum, Detail: "header or record list changed"}
+	}
+	return nil
+}
+
+// checkRecord decodes entry and checks its checksum and ID. It returns the
+// decoded record, nil if the entry is not an object, and the problem found,
+// if any. IDs of records without a problem are added to seen
+func (raw *RawSnapshot) checkRecord(i int, entry json.RawMessage, ids idgen.Strategy, seen map[repository.ID]int) (map[string]interface{}, *Problem) {
+	record, problem := raw.checkEntry(i, entry, ids, seen)
+	if problem != nil && i < len(raw.Lines) {
+		problem.Line = raw.Lines[i]
+	}
+	return record, problem
+}
+
+// checkEntry does the checks of checkRecord
+func (raw *RawSnapshot) checkEntry(i int, entry json.RawMessage, ids idgen.Strategy, seen map[repository.ID]int) (map[string]interface{}, *Problem) {
+	var record map[string]interface{}
+	if err := unmarshal(entry, &record); err != nil || record == nil {
+		return nil, &Problem{Index: i, Kind: ProblemMalformed, Detail: "entry is not a JSON object"}
+	}
+
+	if raw.Checksums != nil && i < len(raw.Checksums.Records) {
+		encoded, err := marshalRecord(record)
+		if err != nil || recordChecksum(encoded) != raw.Checksums.Records[i] {
+			return record, &Problem{Index: i, Kind: ProblemChecksum, Detail: "content does not match its checksum"}
+		}
+	}
+
+	value, ok := record["id"]
+	if !ok {
+		return record, &Problem{Index: i, Kind: ProblemMissingID, Detail: "record has no id field"}
+	}
+	id, ok := repository.FormatID(value)
+	if !ok {
+		return record, &Problem{Index: i, Kind: ProblemInvalidID, Detail: fmt.Sprintf("id %s has an unsupported type", compact(value))}
+	}
+	if parsed, err := ids.ParseID(string(id)); err != nil || parsed != id {
+		return record, &Problem{Index: i, Kind: ProblemForeignID, Detail: fmt.Sprintf("id %s is not a valid %s ID", compact(value), ids.Name())}
+	}
+	if first, ok := seen[id]; ok {
+		return record, &Problem{Index: i, Kind: ProblemDuplicateID, Detail: fmt.Sprintf("id %s is already used by record %d", id, first)}
+	}
+
+	seen[id] = i
+	return record, nil
+}
+
+// compact renders a value as JSON for problem details
+func compact(v interface{}) string {
+	encoded, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Sprint(v)
+	}
+	return string(encoded)
+}
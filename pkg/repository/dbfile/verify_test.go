@@ -0,0 +1,120 @@
+package dbfile
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"testing"
+	"zabbixhw/pkg/repository/idgen"
+)
+
+const damaged = `{"header":{"seq":2},"records":[
+	{"id":1,"name":"Alice"},
+	"not a record",
+	{"name":"no id"},
+	{"id":true},
+	{"id":"abc"},
+	{"id":1,"name":"Alice again"},
+	{"id":5,"name":"Eve"}
+]}`
+
+func Test_Verify(t *testing.T) {
+	raw, err := DecodeRaw([]byte(damaged))
+	if err != nil {
+		t.Fatalf("DecodeRaw failed: %v", err)
+	}
+
+	var kinds []ProblemKind
+	for _, p := range Verify(raw, idgen.Sequential{}) {
+		kinds = append(kinds, p.Kind)
+	}
+	expected := []ProblemKind{ProblemMalformed, ProblemMissingID, ProblemInvalidID, ProblemForeignID, ProblemDuplicateID, ProblemSeqBehind}
+	if !reflect.DeepEqual(kinds, expected) {
+		t.Errorf("expected problems %v, got %v", expected, kinds)
+	}
+
+	clean, _ := DecodeRaw([]byte(`{"header":{"seq":3},"records":[{"id":1},{"id":3}]}`))
+	if problems := Verify(clean, idgen.Sequential{}); len(problems) != 0 {
+		t.Errorf("expected no problems, got %v", problems)
+	}
+}
+
+func Test_Repair(t *testing.T) {
+	tests := []struct {
+		name        string
+		mode        RepairMode
+		expectedIDs []string
+		expectedSeq uint64
+	}{
+		// Malformed entries go either way, the other four bad records differ
+		{name: "Drop", mode: RepairDrop, expectedIDs: []string{"1", "5"}, expectedSeq: 5},
+		{name: "Renumber", mode: RepairRenumber, expectedIDs: []string{"1", "5", "6", "7", "8", "9"}, expectedSeq: 9},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			raw, _ := DecodeRaw([]byte(damaged))
+			snap, fixed, err := Repair(raw, idgen.Sequential{}, tt.mode)
+			if err != nil {
+				t.Fatalf("Repair failed: %v", err)
+			}
+			if len(fixed) != 6 {
+				t.Errorf("expected 6 fixed problems, got %v", fixed)
+			}
+
+			var ids []string
+			for _, record := range snap.Records {
+				ids = append(ids, string(record["id"].(json.Number)))
+			}
+			if !reflect.DeepEqual(ids, tt.expectedIDs) {
+				t.Errorf("expected IDs %v, got %v", tt.expectedIDs, ids)
+			}
+			if snap.Header.Seq != tt.expectedSeq {
+				t.Errorf("expected seq %d, got %d", tt.expectedSeq, snap.Header.Seq)
+			}
+
+			// The result must verify clean after a round trip
+			var buf bytes.Buffer
+			if err := Encode(&buf, snap); err != nil {
+				t.Fatalf("Encode failed: %v", err)
+			}
+			again, err := DecodeRaw(buf.Bytes())
+			if err != nil {
+				t.Fatalf("DecodeRaw failed: %v", err)
+			}
+			if problems := Verify(again, idgen.Sequential{}); len(problems) != 0 {
+				t.Errorf("repaired file still has problems: %v", problems)
+			}
+		})
+	}
+
+	if _, _, err := Repair(&RawSnapshot{}, idgen.Sequential{}, "fix"); err == nil {
+		t.Error("expected an error for an unknown mode")
+	}
+}
+
+func Test_EncodeFormat(t *testing.T) {
+	snap := &Snapshot{Header: Header{Seq: 4}, Records: []map[string]interface{}{{"id": json.Number("2")}}}
+
+	for _, format := range []Format{FormatSnapshot, FormatLegacy} {
+		var buf bytes.Buffer
+		if err := EncodeFormat(&buf, snap, format); err != nil {
+			t.Fatalf("EncodeFormat(%s) failed: %v", format, err)
+		}
+		if got := DetectFormat(buf.Bytes()); got != format {
+			t.Errorf("expected %s, detected %s", format, got)
+		}
+
+		decoded, err := Decode(buf.Bytes())
+		if err != nil {
+			t.Fatalf("Decode failed: %v", err)
+		}
+		if len(decoded.Records) != 1 {
+			t.Errorf("expected 1 record, got %d", len(decoded.Records))
+		}
+	}
+
+	if err := EncodeFormat(&bytes.Buffer{}, snap, "xml"); err == nil {
+		t.Error("expected an error for an unknown format")
+	}
+}
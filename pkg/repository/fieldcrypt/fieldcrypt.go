@@ -0,0 +1,354 @@
+package fieldcrypt
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"zabbixhw/pkg/repository"
+	"zabbixhw/pkg/repository/dberr"
+	"zabbixhw/pkg/repository/dbfile"
+)
+
+// Mask replaces sensitive values for callers that may not see them
+const Mask = "***"
+
+// encryptedKey is the only member of the object an encrypted value is stored
+// as, holding the base64 of the value's JSON encoding sealed by dbfile.Encrypt
+const encryptedKey = "$encrypted"
+
+// Path leads to a sensitive value through the names of the nested objects
+// holding it
+type Path []string
+
+func (p Path) String() string {
+	return strings.Join(p, ".")
+}
+
+// ParsePaths parses a comma separated list of dotted paths, such as
+// "password,snmp.community"
+func ParsePaths(text string) ([]Path, error) {
+	var paths []Path
+	for _, field := range strings.Split(text, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		path := Path(strings.Split(field, "."))
+		for _, name := range path {
+			if name == "" {
+				return nil, fmt.Errorf("invalid sensitive path %q", field)
+			}
+		}
+		if len(path) == 1 && path[0] == "id" {
+			return nil, fmt.Errorf("the record ID cannot be sensitive")
+		}
+		paths = append(paths, path)
+	}
+	return paths, nil
+}
+
+type revealKey struct{}
+
+// WithReveal returns a context allowed to see sensitive values in the clear
+func WithReveal(ctx context.Context) context.Context {
+	return context.WithValue(ctx, revealKey{}, true)
+}
+
+// CanReveal reports whether ctx may see sensitive values in the clear
+func CanReveal(ctx context.Context) bool {
+	reveal, _ := ctx.Value(revealKey{}).(bool)
+	return reveal
+}
+
+// Repo encrypts the sensitive values of records before they reach the
+// wrapped repository. Records read through it carry the values decrypted for
+// contexts made with WithReveal and masked for any other
+type Repo struct {
+	repo  repository.DatabaseRepoV2
+	paths []Path
+	mu    sync.RWMutex // Guards keys
+	keys  *dbfile.Keyring
+}
+
+// New wraps repo, encrypting the values at paths with the primary key of keys
+func New(repo repository.DatabaseRepoV2, keys *dbfile.Keyring, paths []Path) (*Repo, error) {
+	if keys == nil {
+		return nil, fmt.Errorf("sensitive fields: %w", dbfile.ErrNoKeys)
+	}
+	return &Repo{repo: repo, paths: paths, keys: keys}, nil
+}
+
+// Unwrap returns the wrapped repository
+func (r *Repo) Unwrap() repository.DatabaseRepoV2 {
+	return r.repo
+}
+
+// Rekey re-encrypts the wrapped repository if it supports it, and encrypts
+// the values written from then on with the primary key of keys. Stored values
+// are re-encrypted when their record is next written, so older keys have to
+// stay in the keyring until then
+func (r *Repo) Rekey(ctx context.Context, keys *dbfile.Keyring) error {
+	if keys == nil {
+		return dbfile.ErrNoKeys
+	}
+	if repo, ok := r.repo.(dbfile.Rekeyer); ok {
+		if err := repo.Rekey(ctx, keys); err != nil {
+			return err
+		}
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.keys = keys
+	return nil
+}
+
+// CreateRecord stores data with its sensitive values encrypted. Like the
+// engines it sets the ID in data, whose sensitive values are then masked
+// unless ctx may see them
+func (r *Repo) CreateRecord(ctx context.Context, data map[string]interface{}) error {
+	stored, err := r.seal(data, nil)
+	if err != nil {
+		return err
+	}
+	if err := r.repo.CreateRecord(ctx, stored); err != nil {
+		return err
+	}
+
+	data["id"] = stored["id"]
+	r.hide(ctx, data)
+	return nil
+}
+
+// ReadRecord returns a copy of the record with its sensitive values decrypted
+// or masked
+func (r *Repo) ReadRecord(ctx context.Context, id repository.ID) (map[string]interface{}, error) {
+	record, err := r.repo.ReadRecord(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	return r.open(ctx, record)
+}
+
+// UpdateRecord replaces the record with data, its sensitive values encrypted.
+// A value sent back as Mask keeps the stored one, so records read without
+// the permission to see them can be written back unchanged
+func (r *Repo) UpdateRecord(ctx context.Context, id repository.ID, data map[string]interface{}) error {
+	var current map[string]interface{}
+	if r.masked(data) {
+		var err error
+		if current, err = r.repo.ReadRecord(ctx, id); err != nil {
+			return err
+		}
+	}
+
+	stored, err := r.seal(data, current)
+	if err != nil {
+		return err
+	}
+	if err := r.repo.UpdateRecord(ctx, id, stored); err != nil {
+		return err
+	}
+
+	data["id"] = stored["id"]
+	r.hide(ctx, data)
+	return nil
+}
+
+// OpenRecord returns a copy of a record read from below the wrapper, such as
+// a revision of a synced record, decrypted or masked like ReadRecord does
+func (r *Repo) OpenRecord(ctx context.Context, record map[string]interface{}) (map[string]interface{}, error) {
+	return r.open(ctx, record)
+}
+
+// DeleteRecord removes the record with the specified ID
+func (r *Repo) DeleteRecord(ctx context.Context, id repository.ID) error {
+	return r.repo.DeleteRecord(ctx, id)
+}
+
+// seal returns a copy of data with its sensitive values encrypted. Values
+// equal to Mask take the value stored in current
+func (r *Repo) seal(data, current map[string]interface{}) (map[string]interface{}, error) {
+	r.mu.RLock()
+	key := r.keys.Primary()
+	r.mu.RUnlock()
+
+	var err error
+	for _, path := range r.paths {
+		data, err = replace(data, path, func(value interface{}) (interface{}, error) {
+			if value == Mask {
+				stored, ok := lookup(current, path)
+				if !ok {
+					return nil, dberr.Validation("%s is masked but has no stored value", path)
+				}
+				if isEncrypted(stored) {
+					return stored, nil
+				}
+				value = stored
+			}
+			return encrypt(value, key)
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return data, nil
+}
+
+// open returns a copy of record with its sensitive values decrypted when ctx
+// may see them, masked otherwise
+func (r *Repo) open(ctx context.Context, record map[string]interface{}) (map[string]interface{}, error) {
+	if !CanReveal(ctx) {
+		return r.mask(record), nil
+	}
+
+	r.mu.RLock()
+	keys := r.keys
+	r.mu.RUnlock()
+
+	var err error
+	for _, path := range r.paths {
+		record, err = replace(record, path, func(value interface{}) (interface{}, error) {
+			plain, err := decrypt(value, keys)
+			if err != nil {
+				return nil, fmt.Errorf("error decrypting %s: %w", path, err)
+			}
+			return plain, nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return record, nil
+}
+
+// hide masks the sensitive values of data in place unless ctx may see them
+func (r *Repo) hide(ctx context.Context, data map[string]interface{}) {
+	if CanReveal(ctx) {
+		return
+	}
+	for key, value := range r.mask(data) {
+		data[key] = value
+	}
+}
+
+// mask returns a copy of record with its sensitive values replaced by Mask
+func (r *Repo) mask(record map[string]interface{}) map[string]interface{} {
+	for _, path := range r.paths {
+		record, _ = replace(record, path, func(interface{}) (interface{}, error) {
+			return Mask, nil
+		})
+	}
+	return record
+}
+
+// masked reports whether data holds Mask at a sensitive path
+func (r *Repo) masked(data map[string]interface{}) bool {
+	for _, path := range r.paths {
+		if value, ok := lookup(data, path); ok && value == Mask {
+			return true
+		}
+	}
+	return false
+}
+
+// replace returns record with the value at path replaced by what fn makes of
+// it. The objects along path are copied, record itself is left unchanged.
+// Records without a value at path are returned as they are
+func replace(record map[string]interface{}, path Path, fn func(interface{}) (interface{}, error)) (map[string]interface{}, error) {
+	value, ok := record[path[0]]
+	if !ok {
+		return record, nil
+	}
+
+	if len(path) > 1 {
+		child, ok := value.(map[string]interface{})
+		if !ok {
+			return record, nil
+		}
+		newChild, err := replace(child, path[1:], fn)
+		if err != nil {
+			return nil, err
+		}
+		value = newChild
+	} else {
+		var err error
+		if value, err = fn(value); err != nil {
+			return nil, err
+		}
+	}
+
+	copied := make(map[string]interface{}, len(record))
+	for k, v := range record {
+		copied[k] = v
+	}
+	copied[path[0]] = value
+	return copied, nil
+}
+
+// lookup returns the value at path in record
+func lookup(record map[string]interface{}, path Path) (interface{}, bool) {
+	var value interface{} = record
+	for _, name := range path {
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		if value, ok = object[name]; !ok {
+			return nil, false
+		}
+	}
+	return value, true
+}
+
+// isEncrypted reports whether value is an encrypted value
+func isEncrypted(value interface{}) bool {
+	object, ok := value.(map[string]interface{})
+	if !ok || len(object) != 1 {
+		return false
+	}
+	_, ok = object[encryptedKey].(string)
+	return ok
+}
+
+// encrypt seals the JSON encoding of value with key
+func encrypt(value interface{}, key *dbfile.Key) (interface{}, error) {
+	plain, err := json.Marshal(value)
+	if err != nil {
+		return nil, dberr.Validation("error encoding sensitive value: %v", err)
+	}
+	sealed, err := dbfile.Encrypt(plain, key)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{encryptedKey: base64.StdEncoding.EncodeToString(sealed)}, nil
+}
+
+// decrypt returns the value sealed by encrypt. Values stored before their
+// path was marked sensitive are not encrypted and returned as they are
+func decrypt(value interface{}, keys *dbfile.Keyring) (interface{}, error) {
+	if !isEncrypted(value) {
+		return value, nil
+	}
+	sealed, err := base64.StdEncoding.DecodeString(value.(map[string]interface{})[encryptedKey].(string))
+	if err != nil || dbfile.EncryptionKeyID(sealed) == "" {
+		return nil, errors.New("malformed encrypted value")
+	}
+	plain, _, err := dbfile.Decrypt(sealed, keys)
+	if err != nil {
+		return nil, err
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(plain))
+	decoder.UseNumber()
+	var decoded interface{}
+	if err := decoder.Decode(&decoded); err != nil {
+		return nil, err
+	}
+	return decoded, nil
+}
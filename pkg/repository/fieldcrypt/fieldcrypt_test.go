@@ -0,0 +1,224 @@
+package fieldcrypt
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"testing"
+	"zabbixhw/pkg/repository"
+	"zabbixhw/pkg/repository/dberr"
+	"zabbixhw/pkg/repository/dbfile"
+	"zabbixhw/pkg/repository/testdb"
+)
+
+// testKeyring returns a keyring of keys whose bytes are all one of keyBytes
+func testKeyring(t *testing.T, keyBytes ...byte) *dbfile.Keyring {
+	t.Helper()
+
+	keys := make([]*dbfile.Key, len(keyBytes))
+	for i, b := range keyBytes {
+		key, err := dbfile.NewKey(bytes.Repeat([]byte{b}, dbfile.KeySize))
+		if err != nil {
+			t.Fatalf("NewKey failed: %v", err)
+		}
+		keys[i] = key
+	}
+	keyring, err := dbfile.NewKeyring(keys...)
+	if err != nil {
+		t.Fatalf("NewKeyring failed: %v", err)
+	}
+	return keyring
+}
+
+// newTestRepo wraps an in-memory repository, with password and snmp.community
+// sensitive
+func newTestRepo(t *testing.T, keys *dbfile.Keyring) (*Repo, *testdb.TestDB) {
+	t.Helper()
+
+	paths, err := ParsePaths("password, snmp.community")
+	if err != nil {
+		t.Fatalf("ParsePaths failed: %v", err)
+	}
+	inner := &testdb.TestDB{}
+	repo, err := New(inner, keys, paths)
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	return repo, inner
+}
+
+// hostRecord is a record with both sensitive values and a number among them
+func hostRecord() map[string]interface{} {
+	return map[string]interface{}{
+		"host":     "db01",
+		"password": "s3cret",
+		"snmp":     map[string]interface{}{"community": json.Number("161"), "version": "2c"},
+	}
+}
+
+func Test_ParsePaths(t *testing.T) {
+	tests := []struct {
+		text     string
+		expected []Path
+		wantErr  bool
+	}{
+		{text: "", expected: nil},
+		{text: "password", expected: []Path{{"password"}}},
+		{text: " password , snmp.community,", expected: []Path{{"password"}, {"snmp", "community"}}},
+		{text: "snmp..community", wantErr: true},
+		{text: ".password", wantErr: true},
+		{text: "id", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		paths, err := ParsePaths(tt.text)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%q: unexpected error %v", tt.text, err)
+			continue
+		}
+		if !tt.wantErr && !reflect.DeepEqual(paths, tt.expected) {
+			t.Errorf("%q: expected %v, got %v", tt.text, tt.expected, paths)
+		}
+	}
+}
+
+func Test_Repo(t *testing.T) {
+	repo, inner := newTestRepo(t, testKeyring(t, 1))
+	ctx, reveal := context.Background(), WithReveal(context.Background())
+
+	// The caller gets the ID and, without the permission, masked values back
+	record := hostRecord()
+	if err := repo.CreateRecord(ctx, record); err != nil {
+		t.Fatalf("CreateRecord failed: %v", err)
+	}
+	if record["id"] == nil || record["password"] != Mask || record["snmp"].(map[string]interface{})["community"] != Mask {
+		t.Errorf("expected an ID and masked values, got %v", record)
+	}
+
+	// The storage only ever sees encrypted values
+	stored, _ := json.Marshal(inner.Data)
+	if bytes.Contains(stored, []byte("s3cret")) || bytes.Contains(stored, []byte("161")) || !bytes.Contains(stored, []byte(`"version":"2c"`)) {
+		t.Errorf("unexpected stored record %s", stored)
+	}
+
+	masked, err := repo.ReadRecord(ctx, "1")
+	if err != nil {
+		t.Fatalf("ReadRecord failed: %v", err)
+	}
+	if masked["password"] != Mask || masked["host"] != "db01" {
+		t.Errorf("expected masked values, got %v", masked)
+	}
+
+	revealed, err := repo.ReadRecord(reveal, "1")
+	if err != nil {
+		t.Fatalf("ReadRecord failed: %v", err)
+	}
+	expected := hostRecord()
+	expected["id"] = revealed["id"]
+	if !reflect.DeepEqual(revealed, expected) {
+		t.Errorf("expected %v, got %v", expected, revealed)
+	}
+
+	// Writing a masked record back keeps the stored values
+	masked["host"] = "db02"
+	if err := repo.UpdateRecord(ctx, "1", masked); err != nil {
+		t.Fatalf("UpdateRecord failed: %v", err)
+	}
+	if got, _ := repo.ReadRecord(reveal, "1"); got["password"] != "s3cret" || got["host"] != "db02" {
+		t.Errorf("expected the password kept and the host changed, got %v", got)
+	}
+
+	update := map[string]interface{}{"host": "db02", "password": "n3w"}
+	if err := repo.UpdateRecord(reveal, "1", update); err != nil {
+		t.Fatalf("UpdateRecord failed: %v", err)
+	}
+	if update["password"] != "n3w" {
+		t.Errorf("expected the revealed update back, got %v", update)
+	}
+	if got, _ := repo.ReadRecord(reveal, "1"); got["password"] != "n3w" || got["snmp"] != nil {
+		t.Errorf("expected the new password, got %v", got)
+	}
+
+	// A masked value with nothing stored behind it is refused
+	err = repo.UpdateRecord(ctx, "1", map[string]interface{}{"snmp": map[string]interface{}{"community": Mask}})
+	if !errors.Is(err, dberr.ErrValidation) {
+		t.Errorf("expected %v, got %v", dberr.ErrValidation, err)
+	}
+}
+
+func Test_RepoRekey(t *testing.T) {
+	repo, inner := newTestRepo(t, testKeyring(t, 1))
+	reveal := WithReveal(context.Background())
+	for i := 0; i < 2; i++ {
+		if err := repo.CreateRecord(reveal, hostRecord()); err != nil {
+			t.Fatalf("CreateRecord failed: %v", err)
+		}
+	}
+
+	newKeys := testKeyring(t, 2, 1)
+	if err := repo.Rekey(context.Background(), newKeys); err != nil {
+		t.Fatalf("Rekey failed: %v", err)
+	}
+	if err := repo.UpdateRecord(reveal, "2", hostRecord()); err != nil {
+		t.Fatalf("UpdateRecord failed: %v", err)
+	}
+	keyID := func(index int) string {
+		sealed := inner.Data[index]["password"].(map[string]interface{})[encryptedKey].(string)
+		record, _ := base64.StdEncoding.DecodeString(sealed)
+		return dbfile.EncryptionKeyID(record)
+	}
+	if keyID(0) != testKeyring(t, 1).Primary().ID || keyID(1) != newKeys.Primary().ID {
+		t.Errorf("expected the untouched record on the old key and the updated one on the new, got %s and %s", keyID(0), keyID(1))
+	}
+	for _, id := range []string{"1", "2"} {
+		if got, err := repo.ReadRecord(reveal, repository.ID(id)); err != nil || got["password"] != "s3cret" {
+			t.Errorf("record %s: expected the password, got %v (%v)", id, got, err)
+		}
+	}
+
+	// Without the old key, values it encrypted cannot be revealed, but can
+	// still be masked
+	if err := repo.Rekey(context.Background(), testKeyring(t, 2)); err != nil {
+		t.Fatalf("Rekey failed: %v", err)
+	}
+	if _, err := repo.ReadRecord(reveal, "1"); !errors.Is(err, dbfile.ErrWrongKey) {
+		t.Errorf("expected %v, got %v", dbfile.ErrWrongKey, err)
+	}
+	if got, err := repo.ReadRecord(context.Background(), "1"); err != nil || got["password"] != Mask {
+		t.Errorf("expected a masked password, got %v (%v)", got, err)
+	}
+}
+
+func Test_RepoPlaintextValues(t *testing.T) {
+	repo, inner := newTestRepo(t, testKeyring(t, 1))
+
+	// Values stored before their path was marked sensitive still read back,
+	// and are encrypted when the record is written
+	inner.Data = []map[string]interface{}{{"id": uint32(1), "password": "legacy"}}
+	inner.Seq = 1
+	reveal := WithReveal(context.Background())
+	got, err := repo.ReadRecord(reveal, "1")
+	if err != nil || got["password"] != "legacy" {
+		t.Fatalf("expected the plaintext password, got %v (%v)", got, err)
+	}
+	if got, _ := repo.ReadRecord(context.Background(), "1"); got["password"] != Mask {
+		t.Errorf("expected a masked password, got %v", got)
+	}
+
+	if err := repo.UpdateRecord(context.Background(), "1", map[string]interface{}{"password": Mask}); err != nil {
+		t.Fatalf("UpdateRecord failed: %v", err)
+	}
+	if !isEncrypted(inner.Data[0]["password"]) {
+		t.Errorf("expected the password encrypted, got %v", inner.Data[0]["password"])
+	}
+	if got, _ := repo.ReadRecord(reveal, "1"); got["password"] != "legacy" {
+		t.Errorf("expected the password kept, got %v", got)
+	}
+
+	if _, err := New(inner, nil, nil); !errors.Is(err, dbfile.ErrNoKeys) {
+		t.Errorf("expected %v, got %v", dbfile.ErrNoKeys, err)
+	}
+}
@@ -1,86 +1,423 @@
 package filedb
 
 import (
-	"encoding/json"
-	"errors"
+	"context"
 	"fmt"
-	"io"
 	"os"
-	"sync"
+	"time"
+	"zabbixhw/pkg/ctxsync"
+	"zabbixhw/pkg/fsys"
+	"zabbixhw/pkg/repository"
+	"zabbixhw/pkg/repository/dberr"
+	"zabbixhw/pkg/repository/dbfile"
+	"zabbixhw/pkg/repository/idgen"
 )
 
-// Custom error messages for the package
+// Package errors, shared with the other engines through dberr
 var (
-	ErrRecordNotFound = errors.New("record not found")
-	ErrInvalidIDType  = errors.New("invalid ID type in record")
+	ErrRecordNotFound = dberr.ErrNotFound
+	ErrInvalidIDType  = dberr.ErrInvalidIDType
+	ErrReadOnly       = dberr.ErrReadOnly
 )
 
 // FileDB struct that represents the file-based database
 type FileDB struct {
 	data      []map[string]interface{} // In-memory data storage
-	file      *os.File                 // File handler for the database file
-	fileMutex *sync.RWMutex            // Mutex for handling concurrent access to the file
+	seq       uint64                   // Highest ID ever issued, persisted in the file header
+	meta      map[string]string        // Metadata of the file header, written back unchanged
+	ids       idgen.Strategy           // Generates IDs for new records
+	file      fsys.File                // File handler for the database file
+	path      string                   // Path of the file opened by Open, empty with NewFileDB
+	fileMutex *ctxsync.RWMutex         // Mutex for handling concurrent access to the file
+	fs        fsys.FS                  // Filesystem used by Open
+	readOnly  bool                     // Refuse changes, Open takes a shared lock
+	release   func() error             // Closes the file and drops the lock taken by Open
+	policy    dbfile.Policy            // What loading does about checksum failures and bad lines
+	encoding  dbfile.Encoding          // Layout and compression the file is written in, empty fields keep those of the file
+	keys      *dbfile.Keyring          // Keys the file may be encrypted with, nil for plaintext
+	integrity dbfile.IntegrityReport   // Checksum verification of the loaded file
+	bad       []dbfile.Quarantined     // Records set aside while loading
+	tail      *tailer                  // Reloads the file another instance writes, nil unless WithTail
 }
 
-// NewFileDB initializes a new FileDB instance and loads data from the provided file
-func NewFileDB(file *os.File) (*FileDB, error) {
-	fileMutex := &sync.RWMutex{}
-	fileMutex.Lock()
-	defer fileMutex.Unlock()
+// Option configures optional FileDB settings
+type Option func(*FileDB)
 
-	// Read initial data from the JSON file
-	data, err := readJSONFile(file)
+// WithIDStrategy sets the strategy used to generate record IDs
+func WithIDStrategy(ids idgen.Strategy) Option {
+	return func(db *FileDB) {
+		db.ids = ids
+	}
+}
+
+// WithFS sets the filesystem Open uses
+func WithFS(fs fsys.FS) Option {
+	return func(db *FileDB) {
+		db.fs = fs
+	}
+}
+
+// WithReadOnly makes every change fail with ErrReadOnly. Open then takes a
+// shared lock, so any number of read-only instances can share the file
+func WithReadOnly() Option {
+	return func(db *FileDB) {
+		db.readOnly = true
+	}
+}
+
+// WithTail makes the database a read-only follower of a file another
+// instance writes: Open takes no lock and the file is checked every
+// interval, DefaultTailInterval when not positive, and reloaded once the
+// writer finished changing it
+func WithTail(interval time.Duration) Option {
+	return func(db *FileDB) {
+		if interval <= 0 {
+			interval = DefaultTailInterval
+		}
+		db.readOnly = true
+		db.tail = &tailer{interval: interval}
+	}
+}
+
+// WithFormat sets the layout the file is written in: dbfile.FormatSnapshot,
+// dbfile.FormatNDJSON, dbfile.FormatMsgpack or that of a registered codec.
+// Files are read in any layout, by default the layout
+// of the file is kept and new or legacy files become snapshots
+func WithFormat(format dbfile.Format) Option {
+	return func(db *FileDB) {
+		db.encoding.Format = format
+	}
+}
+
+// WithCompression sets how the file is compressed and at what level,
+// dbfile.DefaultLevel or dbfile.BestSpeed to dbfile.BestCompression. Plain
+// and compressed files are both read, an empty compression keeps that of
+// the file and new files are not compressed
+func WithCompression(compression dbfile.Compression, level int) Option {
+	return func(db *FileDB) {
+		db.encoding.Compression = compression
+		db.encoding.Level = level
+	}
+}
+
+// WithKeys encrypts the file with the primary key of keys. Files encrypted
+// with any of the keys are read, plaintext files and files encrypted with
+// another key of the ring are re-encrypted with the primary key on load
+func WithKeys(keys *dbfile.Keyring) Option {
+	return func(db *FileDB) {
+		db.keys = keys
+	}
+}
+
+// WithVerifyPolicy sets what loading does about records whose checksum does
+// not match, the default is dbfile.PolicyFail
+func WithVerifyPolicy(policy dbfile.Policy) Option {
+	return func(db *FileDB) {
+		db.policy = policy
+	}
+}
+
+// NewFileDB initializes a new FileDB instance and loads data from the provided file.
+// The file is not locked, use Open to keep other processes away from it
+func NewFileDB(file fsys.File, opts ...Option) (*FileDB, error) {
+	db := newFileDB(opts)
+	if err := db.load(file, ""); err != nil {
+		return nil, err
+	}
+	return db, nil
+}
+
+// Open locks the database file at path, opening it, and loads its data. It
+// fails with filelock.ErrLocked if another instance holds a conflicting lock.
+// Close releases the file and the lock. With WithTail the file is not
+// locked, and must exist
+func Open(path string, opts ...Option) (*FileDB, error) {
+	db := newFileDB(opts)
+	db.path = path
+	if db.tail != nil {
+		if err := db.openTail(path); err != nil {
+			return nil, err
+		}
+		return db, nil
+	}
+
+	unlock, err := db.fs.Lock(path, db.readOnly)
 	if err != nil {
-		return nil, fmt.Errorf("error reading JSON file: %w", err)
+		return nil, err
 	}
 
-	// Create a new FileDB instance
-	db := &FileDB{
-		data:      data,
-		file:      file,
-		fileMutex: fileMutex,
+	flag := os.O_RDWR | os.O_CREATE
+	if db.readOnly {
+		flag = os.O_RDONLY
+	}
+	file, err := db.fs.OpenFile(path, flag, dbfile.FileMode(db.keys))
+	if err != nil {
+		unlock()
+		return nil, err
+	}
+
+	// OpenFile only sets the mode of a new file, an existing one is about
+	// to be encrypted and may be readable by anyone
+	if db.keys != nil && !db.readOnly {
+		if err := db.fs.Chmod(path, dbfile.FileMode(db.keys)); err != nil {
+			file.Close()
+			unlock()
+			return nil, err
+		}
+	}
+
+	if err := db.load(file, path); err != nil {
+		file.Close()
+		unlock()
+		return nil, err
+	}
+
+	db.release = func() error {
+		err := file.Close()
+		if unlockErr := unlock(); err == nil {
+			err = unlockErr
+		}
+		return err
 	}
 	return db, nil
 }
 
-// CreateRecord adds a new record to the database
-func (db *FileDB) CreateRecord(data map[string]interface{}) error {
-	db.fileMutex.Lock()
+// newFileDB creates an empty FileDB with the given options applied
+func newFileDB(opts []Option) *FileDB {
+	db := &FileDB{
+		ids:       idgen.Default(),
+		fileMutex: &ctxsync.RWMutex{},
+		fs:        fsys.OS{},
+		policy:    dbfile.PolicyFail,
+	}
+	for _, opt := range opts {
+		opt(db)
+	}
+	return db
+}
+
+// load reads the initial data from file and verifies its checksums. Unless
+// the database is read-only or path is unknown, quarantined records are saved
+// next to path and the file is rewritten without them, files of an older
+// format version are backed up and rewritten in the current one, and files
+// not encrypted with the primary key are re-encrypted
+func (db *FileDB) load(file fsys.File, path string) error {
+	db.fileMutex.Lock(context.Background())
 	defer db.fileMutex.Unlock()
 
-	// Determine the ID for the new record
-	var newID float64 = 1 // Default ID if the database is empty
+	if err := dbfile.CheckFormat(db.encoding.Format); err != nil {
+		return err
+	}
+	if err := dbfile.CheckCompression(db.encoding.Compression, db.encoding.Level); err != nil {
+		return err
+	}
 
-	if len(db.data) > 0 {
-		lastRecord := db.data[len(db.data)-1]
-		if id, ok := lastRecord["id"].(float64); ok {
-			newID = float64(id + 1)
-		} else {
-			return ErrInvalidIDType
+	// Read initial data from the file, bad NDJSON lines only fail the
+	// load under PolicyFail
+	snap, err := dbfile.ReadWithKeys(file, db.policy != dbfile.PolicyFail, db.keys)
+	if err != nil {
+		return fmt.Errorf("error reading file: %w", err)
+	}
+
+	if err := dbfile.CheckIDStrategy(snap.Header, db.ids.Name()); err != nil {
+		return err
+	}
+
+	report, bad, err := dbfile.Enforce(snap, db.policy)
+	if err != nil {
+		return err
+	}
+
+	db.integrity = report
+	db.bad = bad
+
+	rewrite := false
+	if path != "" && !db.readOnly {
+		if dbfile.NeedsUpgrade(snap.Header) {
+			if _, err := dbfile.Upgrade(db.fs, path, &snap.Header, db.keys); err != nil {
+				return err
+			}
+			rewrite = true
+		}
+		if len(bad) > 0 {
+			if err := dbfile.SaveQuarantine(db.fs, path, bad, db.keys); err != nil {
+				return err
+			}
+			rewrite = true
 		}
 	}
 
-	// Set the new record's ID and add it to the database
-	data["id"] = newID
-	db.data = append(db.data, data)
+	db.data = snap.Records
+	db.seq = snap.Header.Seq
+	db.meta = snap.Header.Meta
+	db.file = file
+	if db.encoding.Format == "" {
+		db.encoding.Format = dbfile.WriteFormat(snap.Format)
+	}
+	if db.encoding.Compression == "" {
+		db.encoding.Compression = snap.Compression
+	}
+	if db.keys != nil {
+		db.encoding.Key = db.keys.Primary()
+		rewrite = rewrite || (!db.readOnly && snap.KeyID != db.encoding.Key.ID)
+	}
+
+	if rewrite {
+		if err := db.flush(db.data, db.seq); err != nil {
+			return fmt.Errorf("error writing to file: %w", err)
+		}
+	}
+	return nil
+}
 
-	// Write updated data back to the file
-	if err := rewriteJSONFile(db.file, db.data); err != nil {
-		return fmt.Errorf("error writing to file: %w", err)
+// Rekey re-encrypts the file with the primary key of keys, which from then on
+// are the keys the file is read with
+func (db *FileDB) Rekey(ctx context.Context, keys *dbfile.Keyring) error {
+	if db.readOnly {
+		return ErrReadOnly
+	}
+	if keys == nil {
+		return dbfile.ErrNoKeys
 	}
+	if err := db.fileMutex.Lock(ctx); err != nil {
+		return err
+	}
+	defer db.fileMutex.Unlock()
 
+	previous := db.encoding.Key
+	db.encoding.Key = keys.Primary()
+	if err := db.flush(db.data, db.seq); err != nil {
+		db.encoding.Key = previous
+		db.flush(db.data, db.seq)
+		return dberr.Unavailable(fmt.Errorf("error writing to file: %w", err))
+	}
+	db.keys = keys
 	return nil
 }
 
+// Integrity returns the checksum verification of the file as it was loaded
+func (db *FileDB) Integrity() dbfile.IntegrityReport {
+	return db.integrity
+}
+
+// Quarantined returns the records set aside while loading
+func (db *FileDB) Quarantined() []dbfile.Quarantined {
+	return db.bad
+}
+
+// Scrub reads the file back and verifies it against its checksums
+func (db *FileDB) Scrub(ctx context.Context) (dbfile.IntegrityReport, error) {
+	if db.path == "" {
+		return db.scrubShared(ctx)
+	}
+
+	// Writers rewrite the file in place, hold them off until it has been
+	// read through a handle of its own
+	if err := db.fileMutex.RLock(ctx); err != nil {
+		return dbfile.IntegrityReport{}, err
+	}
+	defer db.fileMutex.RUnlock()
+
+	file, err := db.fs.OpenFile(db.path, os.O_RDONLY, 0)
+	if err != nil {
+		return dbfile.IntegrityReport{}, err
+	}
+	defer file.Close()
+
+	snap, err := dbfile.ReadWithKeys(file, true, db.keys)
+	if err != nil {
+		return dbfile.IntegrityReport{}, fmt.Errorf("error reading file: %w", err)
+	}
+	return dbfile.CheckIntegrity(snap), nil
+}
+
+// scrubShared reads back the file handed to NewFileDB, whose path is unknown
+func (db *FileDB) scrubShared(ctx context.Context) (dbfile.IntegrityReport, error) {
+	// Reading moves the file offset, so keep writers and other scrubs out
+	if err := db.fileMutex.Lock(ctx); err != nil {
+		return dbfile.IntegrityReport{}, err
+	}
+	defer db.fileMutex.Unlock()
+
+	if _, err := db.file.Seek(0, 0); err != nil {
+		return dbfile.IntegrityReport{}, fmt.Errorf("error seeking file: %w", err)
+	}
+	snap, err := dbfile.ReadWithKeys(db.file, true, db.keys)
+	if err != nil {
+		return dbfile.IntegrityReport{}, fmt.Errorf("error reading file: %w", err)
+	}
+	return dbfile.CheckIntegrity(snap), nil
+}
+
+// Snapshot returns a copy of the database as of one point in time and the
+// encoding its file is written in, for backups taken while it serves writes.
+// The records themselves are shared and must not be modified
+func (db *FileDB) Snapshot(ctx context.Context) (*dbfile.Snapshot, dbfile.Encoding, error) {
+	if err := db.fileMutex.RLock(ctx); err != nil {
+		return nil, dbfile.Encoding{}, err
+	}
+	defer db.fileMutex.RUnlock()
+
+	return &dbfile.Snapshot{
+		Header:  dbfile.Header{Seq: db.seq, IDStrategy: db.ids.Name(), Meta: db.meta},
+		Records: append([]map[string]interface{}(nil), db.data...),
+	}, db.encoding, nil
+}
+
+// Close releases the file and the lock taken by Open. A FileDB created with
+// NewFileDB leaves its file to the caller, so Close does nothing
+func (db *FileDB) Close() error {
+	if db.tail != nil {
+		// The reload loop takes the mutex too
+		db.tail.stopLoop()
+	}
+	if err := db.fileMutex.Lock(context.Background()); err != nil {
+		return err
+	}
+	defer db.fileMutex.Unlock()
+
+	if db.release == nil {
+		return nil
+	}
+	err := db.release()
+	db.release = nil
+	return err
+}
+
+// CreateRecord adds a new record to the database
+func (db *FileDB) CreateRecord(ctx context.Context, data map[string]interface{}) error {
+	if db.readOnly {
+		return ErrReadOnly
+	}
+	if err := db.fileMutex.Lock(ctx); err != nil {
+		return err
+	}
+	defer db.fileMutex.Unlock()
+
+	// IDs come from the sequence rather than the last record, so an ID freed
+	// by a delete is never handed out again
+	newID, err := db.ids.NewID(db.seq + 1)
+	if err != nil {
+		return fmt.Errorf("error generating ID: %w", err)
+	}
+	data["id"] = newID
+
+	// Append to a copy, so a failed write leaves db.data untouched
+	records := append(db.data[:len(db.data):len(db.data)], data)
+	return db.commit(records, db.seq+1)
+}
+
 // ReadRecord retrieves a record by its ID
-func (db *FileDB) ReadRecord(id uint32) (map[string]interface{}, error) {
-	db.fileMutex.RLock()
+func (db *FileDB) ReadRecord(ctx context.Context, id repository.ID) (map[string]interface{}, error) {
+	if err := db.fileMutex.RLock(ctx); err != nil {
+		return nil, err
+	}
 	defer db.fileMutex.RUnlock()
 
 	// Search for the record with the specified ID
 	for _, record := range db.data {
-		if recordID, ok := record["id"].(float64); ok {
-			if recordID == float64(id) {
+		if recordID, ok := repository.FormatID(record["id"]); ok {
+			if recordID == id {
 				return record, nil
 			}
 		} else {
@@ -93,25 +430,24 @@ func (db *FileDB) ReadRecord(id uint32) (map[string]interface{}, error) {
 }
 
 // UpdateRecord updates a record with the specified ID
-func (db *FileDB) UpdateRecord(id uint32, data map[string]interface{}) error {
-	db.fileMutex.Lock()
+func (db *FileDB) UpdateRecord(ctx context.Context, id repository.ID, data map[string]interface{}) error {
+	if db.readOnly {
+		return ErrReadOnly
+	}
+	if err := db.fileMutex.Lock(ctx); err != nil {
+		return err
+	}
 	defer db.fileMutex.Unlock()
 
-	// Ensure the data has the ID field
-	data["id"] = float64(id)
-
 	// Search for the record with the specified ID and update it
 	for i, record := range db.data {
-		if recordID, ok := record["id"].(float64); ok {
-			if recordID == float64(id) {
-				// Replace the old record with the new data
-				db.data[i] = data
-
-				// Write updated data back to the file
-				if err := rewriteJSONFile(db.file, db.data); err != nil {
-					return fmt.Errorf("error writing to file: %w", err)
-				}
-				return nil
+		if recordID, ok := repository.FormatID(record["id"]); ok {
+			if recordID == id {
+				// Replace the old record with the new data, keeping its stored ID
+				data["id"] = record["id"]
+				records := append([]map[string]interface{}(nil), db.data...)
+				records[i] = data
+				return db.commit(records, db.seq)
 			}
 		} else {
 			return ErrInvalidIDType
@@ -123,21 +459,23 @@ func (db *FileDB) UpdateRecord(id uint32, data map[string]interface{}) error {
 }
 
 // DeleteRecord removes a record with the specified ID
-func (db *FileDB) DeleteRecord(id uint32) error {
-	db.fileMutex.Lock()
+func (db *FileDB) DeleteRecord(ctx context.Context, id repository.ID) error {
+	if db.readOnly {
+		return ErrReadOnly
+	}
+	if err := db.fileMutex.Lock(ctx); err != nil {
+		return err
+	}
 	defer db.fileMutex.Unlock()
 
 	// Search for the record with the specified ID and delete it
 	for i, record := range db.data {
-		if recordID, ok := record["id"].(float64); ok {
-			if recordID == float64(id) {
-				db.data = append(db.data[:i], db.data[i+1:]...)
-
-				// Write updated data back to the file
-				if err := rewriteJSONFile(db.file, db.data); err != nil {
-					return fmt.Errorf("error writing to file: %w", err)
-				}
-				return nil
+		if recordID, ok := repository.FormatID(record["id"]); ok {
+			if recordID == id {
+				records := make([]map[string]interface{}, 0, len(db.data)-1)
+				records = append(records, db.data[:i]...)
+				records = append(records, db.data[i+1:]...)
+				return db.commit(records, db.seq)
 			}
 		} else {
 			return ErrInvalidIDType
@@ -148,39 +486,56 @@ func (db *FileDB) DeleteRecord(id uint32) error {
 	return ErrRecordNotFound
 }
 
-// rewriteJSONFile truncates the file and writes the provided data to it
-func rewriteJSONFile(file *os.File, data []map[string]interface{}) error {
-	if err := file.Truncate(0); err != nil {
-		return fmt.Errorf("error truncating file: %w", err)
+// ApplyChanges replays changes made on another instance, in order, and
+// writes them to the file at once. Nothing is applied if one of them fails
+func (db *FileDB) ApplyChanges(ctx context.Context, changes []repository.Change) error {
+	if db.readOnly {
+		return ErrReadOnly
 	}
-
-	if _, err := file.Seek(0, 0); err != nil {
-		return fmt.Errorf("error seeking file: %w", err)
+	if err := db.fileMutex.Lock(ctx); err != nil {
+		return err
 	}
+	defer db.fileMutex.Unlock()
 
-	encoder := json.NewEncoder(file)
-	if err := encoder.Encode(data); err != nil {
-		return fmt.Errorf("error encoding JSON data: %w", err)
+	records, seq, err := repository.ApplyChanges(db.data, db.seq, changes)
+	if err != nil {
+		return err
 	}
-
-	return nil
+	return db.commit(records, seq)
 }
 
-// readJSONFile reads JSON data from the file and returns it as a slice of maps
-func readJSONFile(file *os.File) ([]map[string]interface{}, error) {
-	fileContent, err := io.ReadAll(file)
-	if err != nil {
-		return nil, fmt.Errorf("error reading file: %w", err)
+// Replace makes records and seq the whole content of the database, for an
+// instance catching up with another one from a snapshot
+func (db *FileDB) Replace(ctx context.Context, records []map[string]interface{}, seq uint64) error {
+	if db.readOnly {
+		return ErrReadOnly
 	}
-
-	if len(fileContent) == 0 {
-		return []map[string]interface{}{}, nil
+	if err := db.fileMutex.Lock(ctx); err != nil {
+		return err
 	}
+	defer db.fileMutex.Unlock()
 
-	var data []map[string]interface{}
-	if err := json.Unmarshal(fileContent, &data); err != nil {
-		return nil, fmt.Errorf("error unmarshalling JSON data: %w", err)
+	return db.commit(append([]map[string]interface{}(nil), records...), seq)
+}
+
+// commit writes records and seq to the file and only then makes them the
+// in-memory state. If the write fails the previous state is written back, on
+// a best-effort basis, and stays in memory
+func (db *FileDB) commit(records []map[string]interface{}, seq uint64) error {
+	if err := db.flush(records, seq); err != nil {
+		db.flush(db.data, db.seq)
+		return dberr.Unavailable(fmt.Errorf("error writing to file: %w", err))
 	}
 
-	return data, nil
+	db.data = records
+	db.seq = seq
+	return nil
+}
+
+// flush persists records together with the ID sequence
+func (db *FileDB) flush(records []map[string]interface{}, seq uint64) error {
+	return db.encoding.Rewrite(db.file, &dbfile.Snapshot{
+		Header:  dbfile.Header{Seq: seq, IDStrategy: db.ids.Name(), Meta: db.meta},
+		Records: records,
+	})
 }
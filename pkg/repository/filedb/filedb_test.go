@@ -1,12 +1,25 @@
 package filedb
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"os"
+	"path/filepath"
+	"strconv"
 	"sync"
+	"syscall"
 	"testing"
+	"time"
+	"zabbixhw/pkg/filelock"
+	"zabbixhw/pkg/fsys"
 	"zabbixhw/pkg/helpers"
+	"zabbixhw/pkg/repository"
+	"zabbixhw/pkg/repository/dberr"
+	"zabbixhw/pkg/repository/dbfile"
+	"zabbixhw/pkg/repository/idgen"
+	"zabbixhw/pkg/repository/repotest"
 )
 
 func Test_NewFileDB(t *testing.T) {
@@ -37,8 +50,8 @@ func Test_NewFileDB(t *testing.T) {
 
 		// Check if the data was read correctly
 		expectedData := []map[string]interface{}{
-			{"id": float64(1), "name": "Alice", "age": float64(30)}, // JSON unmarshals numbers as float64
-			{"id": float64(2), "name": "Bob", "age": float64(25)},
+			{"id": json.Number("1"), "name": "Alice", "age": json.Number("30")}, // Numbers are kept exact as json.Number
+			{"id": json.Number("2"), "name": "Bob", "age": json.Number("25")},
 		}
 
 		if len(db.data) != len(expectedData) {
@@ -128,14 +141,14 @@ func Test_ReadRecord(t *testing.T) {
 	tests := []struct {
 		name         string
 		initialData  string
-		recordID     uint32
+		recordID     repository.ID
 		expectedData map[string]interface{}
 		expectedErr  error
 	}{
 		{
 			name:        "Read existing record",
 			initialData: `[{"id": 1, "name": "John Doe"}, {"id": 2, "name": "Jane Doe"}]`,
-			recordID:    1,
+			recordID:    "1",
 			expectedData: map[string]interface{}{
 				"id":   float64(1),
 				"name": "John Doe",
@@ -145,14 +158,14 @@ func Test_ReadRecord(t *testing.T) {
 		{
 			name:         "Read non-existing record",
 			initialData:  `[{"id": 1, "name": "John Doe"}, {"id": 2, "name": "Jane Doe"}]`,
-			recordID:     3,
+			recordID:     "3",
 			expectedData: nil,
 			expectedErr:  ErrRecordNotFound,
 		},
 		{
 			name:         "Read from empty file",
 			initialData:  `[]`,
-			recordID:     1,
+			recordID:     "1",
 			expectedData: nil,
 			expectedErr:  ErrRecordNotFound,
 		},
@@ -183,7 +196,7 @@ func Test_ReadRecord(t *testing.T) {
 			}
 
 			// Test reading a record
-			record, err := db.ReadRecord(tt.recordID)
+			record, err := db.ReadRecord(context.Background(), tt.recordID)
 			if err != tt.expectedErr {
 				t.Fatalf("Expected error %v, got %v", tt.expectedErr, err)
 			}
@@ -230,18 +243,19 @@ func Test_CreateRecord(t *testing.T) {
 		"name": "Jane Doe",
 	}
 
-	err = db.CreateRecord(newRecord)
+	err = db.CreateRecord(context.Background(), newRecord)
 	if err != nil {
 		t.Fatalf("Failed to create record: %v", err)
 	}
 
 	// Reopen the temporary file to check its contents
 	tempFile.Seek(0, 0)
-	var records []map[string]interface{}
-	err = json.NewDecoder(tempFile).Decode(&records)
+	var snap dbfile.Snapshot
+	err = json.NewDecoder(tempFile).Decode(&snap)
 	if err != nil {
 		t.Fatalf("Failed to decode records from temporary file: %v", err)
 	}
+	records := snap.Records
 
 	// Verify the new record was added correctly
 	if len(records) != 2 {
@@ -292,18 +306,19 @@ func Test_UpdateRecord(t *testing.T) {
 		"name": "John Smith",
 	}
 
-	err = db.UpdateRecord(1, updatedRecord)
+	err = db.UpdateRecord(context.Background(), "1", updatedRecord)
 	if err != nil {
 		t.Fatalf("Failed to update record: %v", err)
 	}
 
 	// Reopen the temporary file to check its contents
 	tempFile.Seek(0, 0)
-	var records []map[string]interface{}
-	err = json.NewDecoder(tempFile).Decode(&records)
+	var snap dbfile.Snapshot
+	err = json.NewDecoder(tempFile).Decode(&snap)
 	if err != nil {
 		t.Fatalf("Failed to decode records from temporary file: %v", err)
 	}
+	records := snap.Records
 
 	// Verify the record was updated correctly
 	expectedRecord := map[string]interface{}{
@@ -325,7 +340,7 @@ func Test_UpdateRecord(t *testing.T) {
 		"name": "Non Existent",
 	}
 
-	err = db.UpdateRecord(3, nonExistentRecord)
+	err = db.UpdateRecord(context.Background(), "3", nonExistentRecord)
 	if err == nil || err != ErrRecordNotFound {
 		t.Fatalf("Expected error %v, got %v", ErrRecordNotFound, err)
 	}
@@ -356,18 +371,19 @@ func Test_DeleteRecord(t *testing.T) {
 	}
 
 	// Delete an existing record
-	err = db.DeleteRecord(1)
+	err = db.DeleteRecord(context.Background(), "1")
 	if err != nil {
 		t.Fatalf("Failed to delete record: %v", err)
 	}
 
 	// Reopen the temporary file to check its contents
 	tempFile.Seek(0, 0)
-	var records []map[string]interface{}
-	err = json.NewDecoder(tempFile).Decode(&records)
+	var snap dbfile.Snapshot
+	err = json.NewDecoder(tempFile).Decode(&snap)
 	if err != nil {
 		t.Fatalf("Failed to decode records from temporary file: %v", err)
 	}
+	records := snap.Records
 
 	// Verify the record was deleted correctly
 	if len(records) != 1 {
@@ -389,12 +405,195 @@ func Test_DeleteRecord(t *testing.T) {
 	}
 
 	// Test deleting a non-existing record
-	err = db.DeleteRecord(3)
+	err = db.DeleteRecord(context.Background(), "3")
 	if err == nil || err != ErrRecordNotFound {
 		t.Fatalf("Expected error %v, got %v", ErrRecordNotFound, err)
 	}
 }
 
+func Test_IDsNotReused(t *testing.T) {
+	// Create a temporary file
+	tempFile, err := os.CreateTemp("", "testdb*.json")
+	if err != nil {
+		t.Fatalf("Failed to create temporary file: %v", err)
+	}
+	defer os.Remove(tempFile.Name()) // Clean up the file afterwards
+
+	// Start from a legacy bare-array file
+	initialData := `[{"id": 1, "name": "John Doe"}, {"id": 2, "name": "Jane Doe"}]`
+	if _, err := tempFile.WriteString(initialData); err != nil {
+		t.Fatalf("Failed to write initial data to temporary file: %v", err)
+	}
+	if _, err := tempFile.Seek(0, 0); err != nil {
+		t.Fatalf("Failed to seek to beginning of temporary file: %v", err)
+	}
+
+	db, err := NewFileDB(tempFile)
+	if err != nil {
+		t.Fatalf("Failed to initialize FileDB: %v", err)
+	}
+
+	// Delete the newest record and create another one
+	if err := db.DeleteRecord(context.Background(), "2"); err != nil {
+		t.Fatalf("Failed to delete record: %v", err)
+	}
+	record := map[string]interface{}{"name": "New"}
+	if err := db.CreateRecord(context.Background(), record); err != nil {
+		t.Fatalf("Failed to create record: %v", err)
+	}
+	if record["id"] != json.Number("3") {
+		t.Fatalf("Expected id 3, got %v", record["id"])
+	}
+
+	// Delete it again and reopen the file, the sequence must survive
+	if err := db.DeleteRecord(context.Background(), "3"); err != nil {
+		t.Fatalf("Failed to delete record: %v", err)
+	}
+	if _, err := tempFile.Seek(0, 0); err != nil {
+		t.Fatalf("Failed to seek to beginning of temporary file: %v", err)
+	}
+	db, err = NewFileDB(tempFile)
+	if err != nil {
+		t.Fatalf("Failed to reopen FileDB: %v", err)
+	}
+
+	record = map[string]interface{}{"name": "Newer"}
+	if err := db.CreateRecord(context.Background(), record); err != nil {
+		t.Fatalf("Failed to create record: %v", err)
+	}
+	if record["id"] != json.Number("4") {
+		t.Fatalf("Expected id 4, got %v", record["id"])
+	}
+}
+
+func Test_ExactNumbers(t *testing.T) {
+	// Create a temporary empty file
+	tempFile, err := os.CreateTemp("", "testdb*.json")
+	if err != nil {
+		t.Fatalf("Failed to create temporary file: %v", err)
+	}
+	defer os.Remove(tempFile.Name()) // Clean up the file afterwards
+
+	db, err := NewFileDB(tempFile)
+	if err != nil {
+		t.Fatalf("Failed to initialize FileDB: %v", err)
+	}
+
+	// Values a float64 cannot hold exactly
+	record := map[string]interface{}{
+		"big":    json.Number("9007199254740993"),
+		"huge":   json.Number("123456789012345678901234567890"),
+		"dec":    json.Number("0.1000000000000000000000000001"),
+		"nested": map[string]interface{}{"n": json.Number("18446744073709551615")},
+	}
+	if err := db.CreateRecord(context.Background(), record); err != nil {
+		t.Fatalf("Failed to create record: %v", err)
+	}
+
+	// Reopen the file so the values come back from disk
+	if _, err := tempFile.Seek(0, 0); err != nil {
+		t.Fatalf("Failed to seek to beginning of temporary file: %v", err)
+	}
+	db, err = NewFileDB(tempFile)
+	if err != nil {
+		t.Fatalf("Failed to reopen FileDB: %v", err)
+	}
+
+	stored, err := db.ReadRecord(context.Background(), "1")
+	if err != nil {
+		t.Fatalf("Failed to read record: %v", err)
+	}
+
+	for key, expected := range map[string]json.Number{
+		"big":  "9007199254740993",
+		"huge": "123456789012345678901234567890",
+		"dec":  "0.1000000000000000000000000001",
+	} {
+		if stored[key] != expected {
+			t.Errorf("Expected %s for key %s, got %v", expected, key, stored[key])
+		}
+	}
+
+	nested, ok := stored["nested"].(map[string]interface{})
+	if !ok || nested["n"] != json.Number("18446744073709551615") {
+		t.Errorf("Expected nested value to be kept exact, got %v", stored["nested"])
+	}
+}
+
+func Test_IDStrategy(t *testing.T) {
+	// Create a temporary empty file
+	tempFile, err := os.CreateTemp("", "testdb*.json")
+	if err != nil {
+		t.Fatalf("Failed to create temporary file: %v", err)
+	}
+	defer os.Remove(tempFile.Name()) // Clean up the file afterwards
+
+	db, err := NewFileDB(tempFile, WithIDStrategy(idgen.NewULID()))
+	if err != nil {
+		t.Fatalf("Failed to initialize FileDB: %v", err)
+	}
+
+	record := map[string]interface{}{"name": "John Doe"}
+	if err := db.CreateRecord(context.Background(), record); err != nil {
+		t.Fatalf("Failed to create record: %v", err)
+	}
+
+	id, ok := record["id"].(string)
+	if !ok || len(id) != 26 {
+		t.Fatalf("Expected a ULID, got %v", record["id"])
+	}
+
+	if _, err := db.ReadRecord(context.Background(), repository.ID(id)); err != nil {
+		t.Fatalf("Failed to read record by ULID: %v", err)
+	}
+
+	// The collection must keep the strategy it was created with
+	if _, err := tempFile.Seek(0, 0); err != nil {
+		t.Fatalf("Failed to seek to beginning of temporary file: %v", err)
+	}
+	_, err = NewFileDB(tempFile)
+	if !errors.Is(err, dbfile.ErrIDStrategyMismatch) {
+		t.Fatalf("Expected error %v, got %v", dbfile.ErrIDStrategyMismatch, err)
+	}
+}
+
+func Test_ContextCancellation(t *testing.T) {
+	// Create a temporary file
+	tempFile, err := os.CreateTemp("", "testdb*.json")
+	if err != nil {
+		t.Fatalf("Failed to create temporary file: %v", err)
+	}
+	defer os.Remove(tempFile.Name()) // Clean up the file afterwards
+
+	db, err := NewFileDB(tempFile)
+	if err != nil {
+		t.Fatalf("Failed to initialize FileDB: %v", err)
+	}
+
+	// Hold the lock as a long-running write would
+	if err := db.fileMutex.Lock(context.Background()); err != nil {
+		t.Fatalf("Failed to lock: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+
+	err = db.CreateRecord(ctx, map[string]interface{}{"name": "John Doe"})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Expected error %v, got %v", context.DeadlineExceeded, err)
+	}
+	if _, err := db.ReadRecord(ctx, "1"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Expected error %v, got %v", context.DeadlineExceeded, err)
+	}
+
+	db.fileMutex.Unlock()
+
+	// The abandoned create must not have left anything behind
+	if _, err := db.ReadRecord(context.Background(), "1"); err != ErrRecordNotFound {
+		t.Fatalf("Expected error %v, got %v", ErrRecordNotFound, err)
+	}
+}
+
 func Test_ConcurrentOperations(t *testing.T) {
 	// Create a temporary file
 	tempFile, err := os.CreateTemp("", "testdb*.json")
@@ -434,21 +633,21 @@ func Test_ConcurrentOperations(t *testing.T) {
 			newRecord := map[string]interface{}{
 				"name": fmt.Sprintf("User %d", i),
 			}
-			if err := db.CreateRecord(newRecord); err != nil {
+			if err := db.CreateRecord(context.Background(), newRecord); err != nil {
 				t.Errorf("Failed to create record: %v", err)
 			}
 		}(i)
 
 		go func(i int) {
 			defer wg.Done()
-			if _, err := db.ReadRecord(uint32(i + 1)); err != nil && err != ErrRecordNotFound {
+			if _, err := db.ReadRecord(context.Background(), repository.ID(strconv.Itoa(i+1))); err != nil && err != ErrRecordNotFound {
 				t.Errorf("Failed to read record: %v", err)
 			}
 		}(i)
 
 		go func(i int) {
 			defer wg.Done()
-			if _, err := db.ReadRecord(uint32(i + 1)); err != nil && err != ErrRecordNotFound {
+			if _, err := db.ReadRecord(context.Background(), repository.ID(strconv.Itoa(i+1))); err != nil && err != ErrRecordNotFound {
 				t.Errorf("Failed to read record: %v", err)
 			}
 		}(i)
@@ -458,14 +657,14 @@ func Test_ConcurrentOperations(t *testing.T) {
 			updatedRecord := map[string]interface{}{
 				"name": fmt.Sprintf("Updated User %d", i),
 			}
-			if err := db.UpdateRecord(uint32(i+1), updatedRecord); err != nil && err != ErrRecordNotFound {
+			if err := db.UpdateRecord(context.Background(), repository.ID(strconv.Itoa(i+1)), updatedRecord); err != nil && err != ErrRecordNotFound {
 				t.Errorf("Failed to update record: %v", err)
 			}
 		}(i)
 
 		go func(i int) {
 			defer wg.Done()
-			if err := db.DeleteRecord(uint32(i + 1)); err != nil && err != ErrRecordNotFound {
+			if err := db.DeleteRecord(context.Background(), repository.ID(strconv.Itoa(i+1))); err != nil && err != ErrRecordNotFound {
 				t.Errorf("Failed to delete record: %v", err)
 			}
 		}(i)
@@ -474,3 +673,337 @@ func Test_ConcurrentOperations(t *testing.T) {
 	// Wait for all goroutines to finish
 	wg.Wait()
 }
+
+func Test_StorageFaults(t *testing.T) {
+	const initial = `{"header":{"version":2,"seq":2,"idStrategy":"sequential"},"records":[{"id":1,"name":"Alice"},{"id":2,"name":"Bob"}],"checksums":{"algorithm":"crc32c","file":"756f4fc0","records":["e1d45fc3","d67ac1e1"]}}`
+
+	faults := []struct {
+		name  string
+		fault fsys.Fault
+		cause error
+	}{
+		{name: "Disk full", fault: fsys.Fault{Op: fsys.OpWrite, Err: syscall.ENOSPC}, cause: syscall.ENOSPC},
+		{name: "Short write", fault: fsys.Fault{Op: fsys.OpWrite, Err: syscall.ENOSPC, Short: 10}, cause: syscall.ENOSPC},
+		{name: "Failed fsync", fault: fsys.Fault{Op: fsys.OpSync, Err: syscall.EIO}, cause: syscall.EIO},
+		{name: "Failed truncate", fault: fsys.Fault{Op: fsys.OpTruncate, Err: syscall.EIO}, cause: syscall.EIO},
+	}
+	ops := []struct {
+		name string
+		run  func(db *FileDB) error
+	}{
+		{name: "Create", run: func(db *FileDB) error {
+			return db.CreateRecord(context.Background(), map[string]interface{}{"name": "Charlie"})
+		}},
+		{name: "Update", run: func(db *FileDB) error {
+			return db.UpdateRecord(context.Background(), "1", map[string]interface{}{"name": "Alice Updated"})
+		}},
+		{name: "Delete", run: func(db *FileDB) error {
+			return db.DeleteRecord(context.Background(), "1")
+		}},
+	}
+
+	for _, tt := range faults {
+		for _, op := range ops {
+			t.Run(tt.name+"/"+op.name, func(t *testing.T) {
+				mem := fsys.NewMemFS()
+				mem.WriteFile("db.json", []byte(initial))
+				faulty := fsys.NewFaulty(mem)
+
+				file, err := faulty.OpenFile("db.json", os.O_RDWR, 0644)
+				if err != nil {
+					t.Fatalf("OpenFile failed: %v", err)
+				}
+				db, err := NewFileDB(file)
+				if err != nil {
+					t.Fatalf("NewFileDB failed: %v", err)
+				}
+
+				faulty.Inject(tt.fault)
+				err = op.run(db)
+				if !errors.Is(err, dberr.ErrStorageUnavailable) || !errors.Is(err, tt.cause) {
+					t.Fatalf("expected %v caused by %v, got %v", dberr.ErrStorageUnavailable, tt.cause, err)
+				}
+
+				// Neither memory nor disk may show the failed change
+				for id, name := range map[repository.ID]string{"1": "Alice", "2": "Bob"} {
+					record, err := db.ReadRecord(context.Background(), id)
+					if err != nil || record["name"] != name {
+						t.Errorf("expected record %s to be %s, got %v (%v)", id, name, record, err)
+					}
+				}
+				if _, err := db.ReadRecord(context.Background(), "3"); !errors.Is(err, ErrRecordNotFound) {
+					t.Errorf("expected %v for the failed create, got %v", ErrRecordNotFound, err)
+				}
+
+				content, _ := mem.ReadFile("db.json")
+				if equal, err := helpers.CompareJSONStrings(string(content), initial); err != nil || !equal {
+					t.Errorf("expected the file to hold %s, got %s (%v)", initial, content, err)
+				}
+
+				// Once the fault is gone the same change goes through
+				if err := op.run(db); err != nil {
+					t.Errorf("retry failed: %v", err)
+				}
+			})
+		}
+	}
+
+	t.Run("Failed read", func(t *testing.T) {
+		mem := fsys.NewMemFS()
+		mem.WriteFile("db.json", []byte(initial))
+		faulty := fsys.NewFaulty(mem)
+		faulty.Inject(fsys.Fault{Op: fsys.OpRead, Err: syscall.EIO})
+
+		file, _ := faulty.OpenFile("db.json", os.O_RDWR, 0644)
+		if _, err := NewFileDB(file); !errors.Is(err, syscall.EIO) {
+			t.Errorf("expected %v, got %v", syscall.EIO, err)
+		}
+	})
+}
+
+func Test_Snapshot(t *testing.T) {
+	db, err := Open(filepath.Join(t.TempDir(), "db.json"), WithFormat(dbfile.FormatNDJSON))
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer db.Close()
+	for _, name := range []string{"Alice", "Bob"} {
+		if err := db.CreateRecord(context.Background(), map[string]interface{}{"name": name}); err != nil {
+			t.Fatalf("CreateRecord failed: %v", err)
+		}
+	}
+
+	snap, encoding, err := db.Snapshot(context.Background())
+	if err != nil {
+		t.Fatalf("Snapshot failed: %v", err)
+	}
+	if err := db.DeleteRecord(context.Background(), "1"); err != nil {
+		t.Fatalf("DeleteRecord failed: %v", err)
+	}
+	if len(snap.Records) != 2 || snap.Header.Seq != 2 || encoding.Format != dbfile.FormatNDJSON {
+		t.Errorf("unexpected snapshot: %d records, seq %d, %s", len(snap.Records), snap.Header.Seq, encoding.Format)
+	}
+}
+
+func Test_ApplyChanges(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "db.json")
+	db, err := Open(path)
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	for _, name := range []string{"Alice", "Bob"} {
+		if err := db.CreateRecord(ctx, map[string]interface{}{"name": name}); err != nil {
+			t.Fatalf("CreateRecord failed: %v", err)
+		}
+	}
+
+	changes := []repository.Change{
+		{Op: repository.OpCreate, ID: "3", Record: map[string]interface{}{"id": json.Number("3"), "name": "Carol"}},
+		{Op: repository.OpUpdate, ID: "1", Record: map[string]interface{}{"id": json.Number("1"), "name": "Alicia"}},
+		{Op: repository.OpDelete, ID: "2"},
+	}
+	if err := db.ApplyChanges(ctx, changes); err != nil {
+		t.Fatalf("ApplyChanges failed: %v", err)
+	}
+	// A failing batch is not applied at all
+	if err := db.ApplyChanges(ctx, []repository.Change{{Op: repository.OpDelete, ID: "1"}, {Op: repository.OpDelete, ID: "2"}}); !errors.Is(err, dberr.ErrNotFound) {
+		t.Errorf("expected %v, got %v", dberr.ErrNotFound, err)
+	}
+	// The sequence moved with the replayed create
+	if err := db.CreateRecord(ctx, map[string]interface{}{"name": "Dave"}); err != nil {
+		t.Fatalf("CreateRecord failed: %v", err)
+	}
+	if record, err := db.ReadRecord(ctx, "4"); err != nil || record["name"] != "Dave" {
+		t.Errorf("expected Dave as 4, got %v (%v)", record, err)
+	}
+	if record, err := db.ReadRecord(ctx, "1"); err != nil || record["name"] != "Alicia" {
+		t.Errorf("expected the replayed update, got %v (%v)", record, err)
+	}
+	if _, err := db.ReadRecord(ctx, "2"); !errors.Is(err, dberr.ErrNotFound) {
+		t.Errorf("expected the replayed delete, got %v", err)
+	}
+
+	if err := db.Replace(ctx, []map[string]interface{}{{"id": json.Number("7"), "name": "Erin"}}, 7); err != nil {
+		t.Fatalf("Replace failed: %v", err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	db, err = Open(path)
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer db.Close()
+	snap, _, err := db.Snapshot(ctx)
+	if err != nil {
+		t.Fatalf("Snapshot failed: %v", err)
+	}
+	if len(snap.Records) != 1 || snap.Records[0]["name"] != "Erin" || snap.Header.Seq != 7 {
+		t.Errorf("expected the replaced content on disk, got %v at seq %d", snap.Records, snap.Header.Seq)
+	}
+}
+
+func Test_Locking(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "db.json")
+
+	db, err := Open(path)
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	if err := db.CreateRecord(context.Background(), map[string]interface{}{"name": "Alice"}); err != nil {
+		t.Fatalf("CreateRecord failed: %v", err)
+	}
+
+	// A second writer or reader must not get in while the file is open
+	if _, err := Open(path); !errors.Is(err, filelock.ErrLocked) {
+		t.Fatalf("expected %v, got %v", filelock.ErrLocked, err)
+	}
+	if _, err := Open(path, WithReadOnly()); !errors.Is(err, filelock.ErrLocked) {
+		t.Fatalf("expected %v for a reader, got %v", filelock.ErrLocked, err)
+	}
+
+	if err := db.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	// Readers share the file and keep writers out
+	first, err := Open(path, WithReadOnly())
+	if err != nil {
+		t.Fatalf("Open read-only failed: %v", err)
+	}
+	defer first.Close()
+	second, err := Open(path, WithReadOnly())
+	if err != nil {
+		t.Fatalf("second Open read-only failed: %v", err)
+	}
+	defer second.Close()
+
+	if _, err := Open(path); !errors.Is(err, filelock.ErrLocked) {
+		t.Errorf("expected %v while readers hold the file, got %v", filelock.ErrLocked, err)
+	}
+
+	if record, err := second.ReadRecord(context.Background(), "1"); err != nil || record["name"] != "Alice" {
+		t.Errorf("expected Alice, got %v (%v)", record, err)
+	}
+	if err := second.CreateRecord(context.Background(), map[string]interface{}{"name": "Bob"}); !errors.Is(err, ErrReadOnly) {
+		t.Errorf("expected %v, got %v", ErrReadOnly, err)
+	}
+	if err := second.UpdateRecord(context.Background(), "1", map[string]interface{}{"name": "Bob"}); !errors.Is(err, ErrReadOnly) {
+		t.Errorf("expected %v, got %v", ErrReadOnly, err)
+	}
+	if err := second.DeleteRecord(context.Background(), "1"); !errors.Is(err, ErrReadOnly) {
+		t.Errorf("expected %v, got %v", ErrReadOnly, err)
+	}
+}
+
+func Test_Conformance(t *testing.T) {
+	repotest.Run(t, newTestStore)
+}
+
+func Test_Model(t *testing.T) {
+	repotest.RunModel(t, newTestStore, repotest.ModelOptions{ReopenEvery: 25})
+}
+
+func Test_FileConformance(t *testing.T) {
+	repotest.RunFile(t, openFileEngine)
+}
+
+// Test_ScrubSharedLock checks that reads go on while the file is read back
+func Test_ScrubSharedLock(t *testing.T) {
+	db, err := Open(filepath.Join(t.TempDir(), "db.json"))
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer db.Close()
+
+	db.fileMutex.RLock(context.Background())
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	report, err := db.Scrub(ctx)
+	cancel()
+	db.fileMutex.RUnlock()
+	if err != nil || !report.OK() {
+		t.Fatalf("expected Scrub to share the lock with readers, got %v (%v)", report, err)
+	}
+}
+
+func Test_ConformanceNDJSON(t *testing.T) {
+	repotest.Run(t, func(t *testing.T) repotest.Opener {
+		return newTestStoreWith(t, WithFormat(dbfile.FormatNDJSON))
+	})
+}
+
+func Test_ConformanceMsgpack(t *testing.T) {
+	repotest.Run(t, func(t *testing.T) repotest.Opener {
+		return newTestStoreWith(t, WithFormat(dbfile.FormatMsgpack))
+	})
+}
+
+func Benchmark_Repository(b *testing.B) {
+	repotest.Bench(b, openBenchStore)
+}
+
+// newTestStore is the repotest factory for this engine
+func newTestStore(t *testing.T) repotest.Opener {
+	return newTestStoreWith(t)
+}
+
+// newTestStoreWith is newTestStore for a FileDB with options
+func newTestStoreWith(t *testing.T, opts ...Option) repotest.Opener {
+	path := filepath.Join(t.TempDir(), "db.json")
+	return func(t *testing.T) (repository.DatabaseRepoV2, func()) {
+		file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+		if err != nil {
+			t.Fatalf("Failed to open file: %v", err)
+		}
+		db, err := NewFileDB(file, opts...)
+		if err != nil {
+			file.Close()
+			t.Fatalf("Failed to initialize FileDB: %v", err)
+		}
+		return db, func() { file.Close() }
+	}
+}
+
+// openFileEngine is the repotest file suite opener for this engine
+func openFileEngine(path string, opts repotest.FileOptions) (repotest.FileEngine, error) {
+	options := []Option{WithFS(opts.FS)}
+	if opts.ReadOnly {
+		options = append(options, WithReadOnly())
+	}
+	if opts.Policy != "" {
+		options = append(options, WithVerifyPolicy(opts.Policy))
+	}
+	if opts.Format != "" {
+		options = append(options, WithFormat(opts.Format))
+	}
+	if opts.Compression != "" {
+		options = append(options, WithCompression(opts.Compression, opts.Level))
+	}
+	if opts.Keys != nil {
+		options = append(options, WithKeys(opts.Keys))
+	}
+
+	db, err := Open(path, options...)
+	if err != nil {
+		return nil, err
+	}
+	return db, nil
+}
+
+// openBenchStore is the repotest bench opener for this engine
+func openBenchStore(b *testing.B, records []map[string]interface{}) (repository.DatabaseRepoV2, func()) {
+	path := filepath.Join(b.TempDir(), "db.json")
+	repotest.SeedFile(b, path, records)
+
+	file, err := os.OpenFile(path, os.O_RDWR, 0644)
+	if err != nil {
+		b.Fatalf("Failed to open file: %v", err)
+	}
+	db, err := NewFileDB(file)
+	if err != nil {
+		b.Fatalf("Failed to initialize FileDB: %v", err)
+	}
+	return db, func() { file.Close() }
+}
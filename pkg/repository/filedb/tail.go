@@ -0,0 +1,251 @@
+package filedb
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"sync"
+	"time"
+	"zabbixhw/pkg/repository/dbfile"
+)
+
+// DefaultTailInterval is how often a tailed file is checked for changes
+const DefaultTailInterval = time.Second
+
+// tailOpenAttempts bounds how many times Open reads a tailed file that keeps
+// changing under it
+const tailOpenAttempts = 5
+
+// mtimeGranularity is the coarsest modification time resolution of the file
+// systems a tailed file may be on. A rewrite within it of the version served
+// can leave the size and the modification time as they were
+const mtimeGranularity = 2 * time.Second
+
+// errFileChanged reports a tailed file written to while it was read. The
+// next check reads it again
+var errFileChanged = errors.New("file changed while it was read")
+
+// TailStatus reports how a tailed file is followed
+type TailStatus struct {
+	Path     string    `json:"path"`
+	Interval string    `json:"interval"`
+	Modified time.Time `json:"modified"` // Modification time of the version served
+	Reloads  int       `json:"reloads"`  // New versions loaded since Open
+	Checked  time.Time `json:"checked"`  // Last check for changes
+	Error    string    `json:"error,omitempty"`
+}
+
+// stamp tells versions of a file apart without reading it, unless they were
+// written within mtimeGranularity of each other
+type stamp struct {
+	size    int64
+	modTime time.Time
+}
+
+func stampOf(info fs.FileInfo) stamp {
+	return stamp{size: info.Size(), modTime: info.ModTime()}
+}
+
+// tailer follows a file another instance writes
+type tailer struct {
+	interval time.Duration
+	path     string
+
+	// Version served and when it was read, only used by the reload loop
+	// once Open returned
+	loaded stamp
+	digest [sha256.Size]byte
+	readAt time.Time
+
+	mu     sync.Mutex // Guards status
+	status TailStatus
+
+	done    chan struct{} // Closed to stop the reload loop
+	stopped chan struct{} // Closed once the reload loop exited
+	stop    sync.Once
+}
+
+// openTail loads the file at path without locking it and starts checking
+// it for changes. The writer may be rewriting it, so a read that fails or
+// overlaps a change is tried again a few times
+func (db *FileDB) openTail(path string) error {
+	t := db.tail
+	t.path = path
+	t.status = TailStatus{Path: path, Interval: t.interval.String()}
+
+	for attempt := 1; ; attempt++ {
+		err := db.reload()
+		if err == nil {
+			break
+		}
+		if attempt == tailOpenAttempts || errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		time.Sleep(t.interval)
+	}
+
+	db.release = func() error { return db.file.Close() }
+	t.done = make(chan struct{})
+	t.stopped = make(chan struct{})
+	go db.tailLoop()
+	return nil
+}
+
+// tailLoop checks the file every interval until Close
+func (db *FileDB) tailLoop() {
+	t := db.tail
+	ticker := time.NewTicker(t.interval)
+	defer ticker.Stop()
+	defer close(t.stopped)
+
+	for {
+		select {
+		case <-ticker.C:
+			err := db.reload()
+			if errors.Is(err, errFileChanged) {
+				continue
+			}
+			t.mu.Lock()
+			t.status.Checked = time.Now().UTC()
+			t.status.Error = ""
+			if err != nil {
+				t.status.Error = err.Error()
+			}
+			t.mu.Unlock()
+		case <-t.done:
+			return
+		}
+	}
+}
+
+// stopLoop stops the reload loop, if it runs, and waits for it to exit
+func (t *tailer) stopLoop() {
+	t.stop.Do(func() {
+		if t.done != nil {
+			close(t.done)
+			<-t.stopped
+		}
+	})
+}
+
+// reload loads the tailed file if it changed since it was last loaded. The
+// writer rewrites the file in place, so a version is only served once it
+// decodes, passes its checksums and did not change while it was read. Until
+// then the previous version is served. While the version served was read
+// within mtimeGranularity of its modification time, a rewrite may keep its
+// stamp, so the file is read again and its content compared
+func (db *FileDB) reload() error {
+	t := db.tail
+	checked := time.Now()
+	info, err := db.fs.Stat(t.path)
+	if err != nil {
+		return err
+	}
+	current := stampOf(info)
+	if db.file != nil && current.size == 0 {
+		// Truncated by a flush that is not written yet
+		return nil
+	}
+	if db.file != nil && current == t.loaded && t.readAt.Sub(t.loaded.modTime) >= mtimeGranularity {
+		return nil
+	}
+
+	file, err := db.fs.OpenFile(t.path, os.O_RDONLY, 0)
+	if err != nil {
+		return err
+	}
+	hash := sha256.New()
+	content := io.TeeReader(file, hash)
+	snap, report, bad, err := db.readTail(content)
+	if err == nil {
+		_, err = io.Copy(io.Discard, content)
+	}
+	if err == nil {
+		if info, err = db.fs.Stat(t.path); err == nil && stampOf(info) != current {
+			err = errFileChanged
+		}
+	}
+	if err != nil {
+		file.Close()
+		return err
+	}
+	var digest [sha256.Size]byte
+	hash.Sum(digest[:0])
+	if db.file != nil && digest == t.digest {
+		// Same content, the version served stays
+		file.Close()
+		t.loaded = current
+		t.readAt = checked
+		return nil
+	}
+
+	// Swap the whole state at once, reads see either version
+	db.fileMutex.Lock(context.Background())
+	previous := db.file
+	db.data = snap.Records
+	db.seq = snap.Header.Seq
+	db.meta = snap.Header.Meta
+	db.file = file
+	db.integrity = report
+	db.bad = bad
+	if db.encoding.Format == "" {
+		db.encoding.Format = dbfile.WriteFormat(snap.Format)
+	}
+	if db.encoding.Compression == "" {
+		db.encoding.Compression = snap.Compression
+	}
+	if db.keys != nil {
+		db.encoding.Key = db.keys.Primary()
+	}
+	db.fileMutex.Unlock()
+
+	if previous != nil {
+		previous.Close()
+	}
+	t.loaded = current
+	t.digest = digest
+	t.readAt = checked
+	t.mu.Lock()
+	if previous != nil {
+		t.status.Reloads++
+	}
+	t.status.Modified = current.modTime.UTC()
+	t.mu.Unlock()
+	return nil
+}
+
+// readTail decodes a version of the tailed file. Lines cut short and a
+// file checksum that does not match are what a read overlapping a flush
+// sees, so they fail whatever the verify policy
+func (db *FileDB) readTail(file io.Reader) (*dbfile.Snapshot, dbfile.IntegrityReport, []dbfile.Quarantined, error) {
+	snap, err := dbfile.ReadWithKeys(file, false, db.keys)
+	if err != nil {
+		return nil, dbfile.IntegrityReport{}, nil, fmt.Errorf("error reading file: %w", err)
+	}
+	if err := dbfile.CheckIDStrategy(snap.Header, db.ids.Name()); err != nil {
+		return nil, dbfile.IntegrityReport{}, nil, err
+	}
+	report, bad, err := dbfile.Enforce(snap, db.policy)
+	if err != nil {
+		return nil, report, nil, err
+	}
+	if report.FileMismatch {
+		return nil, report, nil, fmt.Errorf("%w: %s", dbfile.ErrChecksum, report)
+	}
+	return snap, report, bad, nil
+}
+
+// TailStatus reports how the file is followed, and false if the database
+// was not opened with WithTail
+func (db *FileDB) TailStatus() (TailStatus, bool) {
+	if db.tail == nil {
+		return TailStatus{}, false
+	}
+	db.tail.mu.Lock()
+	defer db.tail.mu.Unlock()
+	return db.tail.status, true
+}
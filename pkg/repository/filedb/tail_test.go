@@ -0,0 +1,165 @@
+package filedb
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+	"zabbixhw/pkg/repository"
+)
+
+// expectName reads the record id from db and checks its name
+func expectName(t *testing.T, db *FileDB, id, name string) {
+	t.Helper()
+
+	record, err := db.ReadRecord(context.Background(), repository.ID(id))
+	if err != nil || record["name"] != name {
+		t.Errorf("expected %s to be %s, got %v (%v)", id, name, record, err)
+	}
+}
+
+func Test_Tail(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "db.json")
+
+	writer, err := Open(path)
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer func() { writer.Close() }()
+	if err := writer.CreateRecord(ctx, map[string]interface{}{"name": "Alice"}); err != nil {
+		t.Fatalf("CreateRecord failed: %v", err)
+	}
+
+	// The tailed file stays locked by its writer
+	tail, err := Open(path, WithTail(time.Hour))
+	if err != nil {
+		t.Fatalf("Open with WithTail failed: %v", err)
+	}
+	defer tail.Close()
+	expectName(t, tail, "1", "Alice")
+
+	if err := tail.CreateRecord(ctx, map[string]interface{}{"name": "Bob"}); !errors.Is(err, ErrReadOnly) {
+		t.Errorf("expected %v, got %v", ErrReadOnly, err)
+	}
+	if err := tail.UpdateRecord(ctx, "1", map[string]interface{}{"name": "Bob"}); !errors.Is(err, ErrReadOnly) {
+		t.Errorf("expected %v, got %v", ErrReadOnly, err)
+	}
+	if err := tail.DeleteRecord(ctx, "1"); !errors.Is(err, ErrReadOnly) {
+		t.Errorf("expected %v, got %v", ErrReadOnly, err)
+	}
+
+	// Changes are served once reloaded
+	if err := writer.UpdateRecord(ctx, "1", map[string]interface{}{"name": "Alicia"}); err != nil {
+		t.Fatalf("UpdateRecord failed: %v", err)
+	}
+	expectName(t, tail, "1", "Alice")
+	if err := tail.reload(); err != nil {
+		t.Fatalf("reload failed: %v", err)
+	}
+	expectName(t, tail, "1", "Alicia")
+	if status, ok := tail.TailStatus(); !ok || status.Reloads != 1 || status.Path != path {
+		t.Errorf("unexpected status %+v", status)
+	}
+
+	// A rewrite keeping the size and the modification time is read again
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("Stat failed: %v", err)
+	}
+	if err := writer.UpdateRecord(ctx, "1", map[string]interface{}{"name": "Alicio"}); err != nil {
+		t.Fatalf("UpdateRecord failed: %v", err)
+	}
+	if err := os.Chtimes(path, info.ModTime(), info.ModTime()); err != nil {
+		t.Fatalf("Chtimes failed: %v", err)
+	}
+	if err := tail.reload(); err != nil {
+		t.Fatalf("reload failed: %v", err)
+	}
+	expectName(t, tail, "1", "Alicio")
+	if err := tail.reload(); err != nil {
+		t.Fatalf("reload failed: %v", err)
+	}
+	if status, _ := tail.TailStatus(); status.Reloads != 2 {
+		t.Errorf("expected an unchanged file not to be loaded again, got %+v", status)
+	}
+
+	// A flush caught halfway is not loaded
+	content, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("ReadFile failed: %v", err)
+	}
+	for _, partial := range [][]byte{{}, content[:len(content)/2]} {
+		if err := os.WriteFile(path, partial, 0644); err != nil {
+			t.Fatalf("WriteFile failed: %v", err)
+		}
+		if err := tail.reload(); len(partial) > 0 && err == nil {
+			t.Errorf("expected a partial file to fail")
+		}
+		expectName(t, tail, "1", "Alicio")
+	}
+
+	if err := os.WriteFile(path, content, 0644); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+
+	// A writer started after the tail is not kept out
+	writer.Close()
+	if writer, err = Open(path); err != nil {
+		t.Fatalf("Open after the tail failed: %v", err)
+	}
+	if err := writer.CreateRecord(ctx, map[string]interface{}{"name": "Bob"}); err != nil {
+		t.Fatalf("CreateRecord failed: %v", err)
+	}
+	if err := tail.reload(); err != nil {
+		t.Fatalf("reload failed: %v", err)
+	}
+	expectName(t, tail, "2", "Bob")
+	if status, _ := tail.TailStatus(); status.Reloads != 3 {
+		t.Errorf("expected 3 reloads, got %+v", status)
+	}
+}
+
+func Test_TailLoop(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "db.json")
+
+	if _, err := Open(path, WithTail(time.Millisecond)); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("expected %v for a missing file, got %v", fs.ErrNotExist, err)
+	}
+
+	writer, err := Open(path)
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer writer.Close()
+	tail, err := Open(path, WithTail(time.Millisecond))
+	if err != nil {
+		t.Fatalf("Open with WithTail failed: %v", err)
+	}
+
+	if err := writer.CreateRecord(ctx, map[string]interface{}{"name": "Alice"}); err != nil {
+		t.Fatalf("CreateRecord failed: %v", err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, err := tail.ReadRecord(ctx, "1"); err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			status, _ := tail.TailStatus()
+			t.Fatalf("the change was not reloaded, status %+v", status)
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	if err := tail.Close(); err != nil {
+		t.Errorf("Close failed: %v", err)
+	}
+	if err := tail.Close(); err != nil {
+		t.Errorf("second Close failed: %v", err)
+	}
+}
@@ -1,21 +1,31 @@
 package filedbv2
 
 import (
-	"encoding/json"
+	"context"
 	"errors"
 	"fmt"
-	"io"
 	"os"
 	"sync"
 	"time"
+	"zabbixhw/pkg/clock"
+	"zabbixhw/pkg/ctxsync"
+	"zabbixhw/pkg/fsys"
+	"zabbixhw/pkg/repository"
+	"zabbixhw/pkg/repository/dberr"
+	"zabbixhw/pkg/repository/dbfile"
+	"zabbixhw/pkg/repository/idgen"
 )
 
-// Custom error messages for the package
+// Package errors, shared with the other engines through dberr
 var (
-	ErrRecordNotFound = errors.New("record not found")
-	ErrInvalidIDType  = errors.New("invalid ID type in record")
+	ErrRecordNotFound = dberr.ErrNotFound
+	ErrInvalidIDType  = dberr.ErrInvalidIDType
+	ErrReadOnly       = dberr.ErrReadOnly
+	ErrClosed         = errors.New("database is closed")
 )
 
+// Defaults for the sync loop, override them with WithMaxCachedUpdates and
+// WithSyncInterval
 const (
 	MaxCachedUpdates = 5
 	SyncInterval     = 5 * time.Second
@@ -24,128 +34,524 @@ const (
 // FileDB struct that represents the file-based database
 type FileDB struct {
 	data          []map[string]interface{} // In-memory data storage
-	file          *os.File                 // File handler for the database file
-	fileMutex     *sync.RWMutex            // Mutex for handling concurrent access to the file
-	dataMutex     *sync.RWMutex            // Mutex for handling concurrent access to in-memory data
+	seq           uint64                   // Highest ID ever issued, persisted in the file header
+	meta          map[string]string        // Metadata of the file header, written back unchanged
+	ids           idgen.Strategy           // Generates IDs for new records
+	fs            fsys.FS                  // Filesystem holding the database file
+	path          string                   // Path of the database file
+	file          fsys.File                // File handler for the database file
+	fileMutex     *ctxsync.RWMutex         // Mutex for handling concurrent access to the file
+	dataMutex     *ctxsync.RWMutex         // Mutex for handling concurrent access to in-memory data
 	cachedUpdates uint
+	maxCached     uint          // Pending updates that trigger an immediate sync, guarded by dataMutex
+	syncInterval  time.Duration // Interval of the periodic sync
+	clock         clock.Clock   // Drives the periodic sync
+	afterSync     func(error)   // Called after every sync attempt, used by tests
+	ticker        clock.Ticker  // Drives the periodic sync, nil once the sync loop has exited
+	tickerMutex   sync.Mutex    // Guards ticker
 	updateChan    chan bool
 	doneChan      chan bool
+	closeErr      error                  // Result of the final sync, set before doneChan is closed
+	readOnly      bool                   // Refuse changes and take a shared lock
+	unlock        func() error           // Drops the lock on the database file
+	policy        dbfile.Policy          // What opening does about checksum failures and bad lines
+	encoding      dbfile.Encoding        // Layout and compression the file is written in, empty fields keep those of the file
+	keys          *dbfile.Keyring        // Keys the file may be encrypted with, nil for plaintext
+	integrity     dbfile.IntegrityReport // Checksum verification of the opened file
+	bad           []dbfile.Quarantined   // Records set aside while opening
 }
 
-// NewFileDB initializes a new FileDB instance and loads data from the provided file
-func NewFileDB(filePath string) (*FileDB, error) {
-	fileMutex := &sync.RWMutex{}
-	fileMutex.Lock()
-	defer fileMutex.Unlock()
+// Option configures optional FileDB settings
+type Option func(*FileDB)
 
-	file, err := os.OpenFile(filePath, os.O_RDWR|os.O_CREATE, 0644)
-	if err != nil {
-		return nil, err
+// WithIDStrategy sets the strategy used to generate record IDs
+func WithIDStrategy(ids idgen.Strategy) Option {
+	return func(db *FileDB) {
+		db.ids = ids
 	}
+}
 
-	// Read initial data from the JSON file
-	data, err := readJSONFile(file)
-	if err != nil {
-		return nil, fmt.Errorf("error reading JSON file: %w", err)
+// WithFS sets the filesystem holding the database file
+func WithFS(fs fsys.FS) Option {
+	return func(db *FileDB) {
+		db.fs = fs
+	}
+}
+
+// WithReadOnly makes every change fail with ErrReadOnly and takes a shared
+// lock, so any number of read-only instances can share the file
+func WithReadOnly() Option {
+	return func(db *FileDB) {
+		db.readOnly = true
+	}
+}
+
+// WithClock sets the clock driving the periodic sync
+func WithClock(c clock.Clock) Option {
+	return func(db *FileDB) {
+		db.clock = c
 	}
+}
+
+// WithSyncInterval sets how often cached changes are written to the file
+func WithSyncInterval(d time.Duration) Option {
+	return func(db *FileDB) {
+		db.syncInterval = d
+	}
+}
+
+// WithMaxCachedUpdates sets how many changes may be cached before they are
+// written to the file without waiting for the sync interval
+func WithMaxCachedUpdates(n uint) Option {
+	return func(db *FileDB) {
+		db.maxCached = n
+	}
+}
+
+// WithFormat sets the layout the file is written in: dbfile.FormatSnapshot,
+// dbfile.FormatNDJSON, dbfile.FormatMsgpack or that of a registered codec.
+// Files are read in any layout, by default the layout
+// of the file is kept and new or legacy files become snapshots
+func WithFormat(format dbfile.Format) Option {
+	return func(db *FileDB) {
+		db.encoding.Format = format
+	}
+}
+
+// WithCompression sets how the file is compressed and at what level,
+// dbfile.DefaultLevel or dbfile.BestSpeed to dbfile.BestCompression. Plain
+// and compressed files are both read, an empty compression keeps that of
+// the file and new files are not compressed
+func WithCompression(compression dbfile.Compression, level int) Option {
+	return func(db *FileDB) {
+		db.encoding.Compression = compression
+		db.encoding.Level = level
+	}
+}
 
+// WithKeys encrypts the file with the primary key of keys. Files encrypted
+// with any of the keys are read, plaintext files and files encrypted with
+// another key of the ring are re-encrypted with the primary key on open
+func WithKeys(keys *dbfile.Keyring) Option {
+	return func(db *FileDB) {
+		db.keys = keys
+	}
+}
+
+// WithVerifyPolicy sets what opening does about records whose checksum does
+// not match, the default is dbfile.PolicyFail
+func WithVerifyPolicy(policy dbfile.Policy) Option {
+	return func(db *FileDB) {
+		db.policy = policy
+	}
+}
+
+// NewFileDB initializes a new FileDB instance and loads data from the provided file.
+// It locks the file and fails with filelock.ErrLocked if another instance
+// holds a conflicting lock. Close releases the lock
+func NewFileDB(filePath string, opts ...Option) (*FileDB, error) {
 	// Create a new FileDB instance
 	db := &FileDB{
-		data:          data,
-		file:          file,
-		fileMutex:     fileMutex,
-		dataMutex:     &sync.RWMutex{},
+		ids:           idgen.Default(),
+		fs:            fsys.OS{},
+		path:          filePath,
+		fileMutex:     &ctxsync.RWMutex{},
+		dataMutex:     &ctxsync.RWMutex{},
 		updateChan:    make(chan bool, 1), // Buffered channel to prevent blocking
 		doneChan:      make(chan bool),
 		cachedUpdates: 0,
+		maxCached:     MaxCachedUpdates,
+		syncInterval:  SyncInterval,
+		clock:         clock.Real{},
+		policy:        dbfile.PolicyFail,
+	}
+	for _, opt := range opts {
+		opt(db)
+	}
+
+	if db.syncInterval <= 0 {
+		return nil, fmt.Errorf("invalid sync interval %v", db.syncInterval)
+	}
+	if err := dbfile.CheckFormat(db.encoding.Format); err != nil {
+		return nil, err
+	}
+	if err := dbfile.CheckCompression(db.encoding.Compression, db.encoding.Level); err != nil {
+		return nil, err
 	}
 
-	go db.syncLoop()
+	unlock, err := db.fs.Lock(filePath, db.readOnly)
+	if err != nil {
+		return nil, err
+	}
+
+	flag := os.O_RDWR | os.O_CREATE
+	if db.readOnly {
+		flag = os.O_RDONLY
+	}
+	file, err := db.fs.OpenFile(filePath, flag, dbfile.FileMode(db.keys))
+	if err != nil {
+		unlock()
+		return nil, err
+	}
+
+	// Read initial data from the file, bad NDJSON lines only fail the
+	// open under PolicyFail
+	snap, err := dbfile.ReadWithKeys(file, db.policy != dbfile.PolicyFail, db.keys)
+	if err != nil {
+		file.Close()
+		unlock()
+		return nil, fmt.Errorf("error reading file: %w", err)
+	}
+
+	if err := dbfile.CheckIDStrategy(snap.Header, db.ids.Name()); err != nil {
+		file.Close()
+		unlock()
+		return nil, err
+	}
+
+	report, bad, err := dbfile.Enforce(snap, db.policy)
+	if err != nil {
+		file.Close()
+		unlock()
+		return nil, err
+	}
+
+	db.file = file
+	db.unlock = unlock
+	db.integrity = report
+	db.bad = bad
+	if db.encoding.Format == "" {
+		db.encoding.Format = dbfile.WriteFormat(snap.Format)
+	}
+	if db.encoding.Compression == "" {
+		db.encoding.Compression = snap.Compression
+	}
+	if db.keys != nil {
+		db.encoding.Key = db.keys.Primary()
+	}
+
+	// Upgrade older files and drop quarantined records from the file right
+	// away, so the next open does not quarantine them a second time
+	if !db.readOnly {
+		if err := db.rewriteOnOpen(snap); err != nil {
+			db.file.Close()
+			unlock()
+			return nil, err
+		}
+	}
+
+	db.data = snap.Records
+	db.seq = snap.Header.Seq
+	db.meta = snap.Header.Meta
+
+	db.ticker = db.clock.NewTicker(db.syncInterval)
+	go db.syncLoop(db.ticker)
 
 	return db, nil
 }
 
-func (db *FileDB) syncLoop() {
+// rewriteOnOpen backs up a file of an older format version and saves
+// quarantined records, then rewrites the file if either happened or the
+// file is not encrypted with the primary key
+func (db *FileDB) rewriteOnOpen(snap *dbfile.Snapshot) error {
+	rewrite := db.encoding.Key != nil && snap.KeyID != db.encoding.Key.ID
+	if dbfile.NeedsUpgrade(snap.Header) {
+		if _, err := dbfile.Upgrade(db.fs, db.path, &snap.Header, db.keys); err != nil {
+			return err
+		}
+		rewrite = true
+	}
+	if len(db.bad) > 0 {
+		if err := dbfile.SaveQuarantine(db.fs, db.path, db.bad, db.keys); err != nil {
+			return err
+		}
+		rewrite = true
+	}
+
+	if !rewrite {
+		return nil
+	}
+	snap.Header.IDStrategy = db.ids.Name()
+	if err := db.replaceFile(snap); err != nil {
+		return fmt.Errorf("error writing to file: %w", err)
+	}
+	return nil
+}
+
+// Integrity returns the checksum verification of the file as it was opened
+func (db *FileDB) Integrity() dbfile.IntegrityReport {
+	return db.integrity
+}
+
+// Quarantined returns the records set aside while opening
+func (db *FileDB) Quarantined() []dbfile.Quarantined {
+	return db.bad
+}
+
+// Scrub reads the file back and verifies it against its checksums. Changes
+// that are still cached are not part of the file yet and are not checked
+func (db *FileDB) Scrub(ctx context.Context) (dbfile.IntegrityReport, error) {
+	// Syncs replace the file, hold them off until it has been read
+	if err := db.fileMutex.RLock(ctx); err != nil {
+		return dbfile.IntegrityReport{}, err
+	}
+	defer db.fileMutex.RUnlock()
+
+	file, err := db.fs.OpenFile(db.path, os.O_RDONLY, 0)
+	if err != nil {
+		return dbfile.IntegrityReport{}, err
+	}
+	defer file.Close()
+
+	snap, err := dbfile.ReadWithKeys(file, true, db.keys)
+	if err != nil {
+		return dbfile.IntegrityReport{}, fmt.Errorf("error reading file: %w", err)
+	}
+	return dbfile.CheckIntegrity(snap), nil
+}
+
+// Rekey re-encrypts the file with the primary key of keys, which from then on
+// are the keys the file is read with. Cached changes are written along
+func (db *FileDB) Rekey(ctx context.Context, keys *dbfile.Keyring) error {
+	if db.readOnly {
+		return ErrReadOnly
+	}
+	if keys == nil {
+		return dbfile.ErrNoKeys
+	}
+	if err := db.fileMutex.Lock(ctx); err != nil {
+		return err
+	}
+	defer db.fileMutex.Unlock()
+	// Writing the cache resets cachedUpdates, which the sync loop reads
+	if err := db.dataMutex.Lock(ctx); err != nil {
+		return err
+	}
+	defer db.dataMutex.Unlock()
+
+	// The file is replaced in one rename, a failed write leaves it encrypted
+	// with the previous key
+	previous := db.encoding.Key
+	db.encoding.Key = keys.Primary()
+	snap := &dbfile.Snapshot{
+		Header:  dbfile.Header{Seq: db.seq, IDStrategy: db.ids.Name(), Meta: db.meta},
+		Records: db.data,
+	}
+	if err := db.replaceFile(snap); err != nil {
+		db.encoding.Key = previous
+		return dberr.Unavailable(fmt.Errorf("error writing to file: %w", err))
+	}
+	db.keys = keys
+	db.cachedUpdates = 0
+	return nil
+}
+
+// Snapshot returns a copy of the database as of one point in time, cached
+// changes included, and the encoding its file is written in, for backups
+// taken while it serves writes. The records themselves are shared and must
+// not be modified
+func (db *FileDB) Snapshot(ctx context.Context) (*dbfile.Snapshot, dbfile.Encoding, error) {
+	// Rekey changes the encoding under fileMutex
+	if err := db.fileMutex.RLock(ctx); err != nil {
+		return nil, dbfile.Encoding{}, err
+	}
+	defer db.fileMutex.RUnlock()
+	if err := db.dataMutex.RLock(ctx); err != nil {
+		return nil, dbfile.Encoding{}, err
+	}
+	defer db.dataMutex.RUnlock()
+
+	return &dbfile.Snapshot{
+		Header:  dbfile.Header{Seq: db.seq, IDStrategy: db.ids.Name(), Meta: db.meta},
+		Records: append([]map[string]interface{}(nil), db.data...),
+	}, db.encoding, nil
+}
+
+func (db *FileDB) syncLoop(ticker clock.Ticker) {
 	for {
 		select {
 		case <-db.updateChan:
-			db.syncDBWithCache()
-		case <-time.After(SyncInterval):
-			db.syncDBWithCache()
+			db.sync()
+		case <-ticker.C():
+			db.sync()
 		case <-db.doneChan:
-			db.syncDBWithCache()
+			db.closeErr = db.sync()
+			db.stopTicker()
 			close(db.doneChan)
 			return
 		}
 	}
 }
 
-func (db *FileDB) Close() {
-	close(db.updateChan)
+// sync writes cached changes to the file, if there are any. A failed sync
+// leaves the changes cached, so the next one retries them
+func (db *FileDB) sync() error {
+	db.dataMutex.RLock(context.Background())
+	pending := db.cachedUpdates
+	db.dataMutex.RUnlock()
+
+	var err error
+	if pending > 0 {
+		err = db.syncDBWithCache()
+	}
+	if db.afterSync != nil {
+		db.afterSync(err)
+	}
+	return err
+}
+
+// stopTicker stops the periodic sync for good
+func (db *FileDB) stopTicker() {
+	db.tickerMutex.Lock()
+	defer db.tickerMutex.Unlock()
+
+	db.ticker.Stop()
+	db.ticker = nil
+}
+
+// SetSyncInterval changes the interval of the periodic sync, the next sync
+// happens one full interval after the call
+func (db *FileDB) SetSyncInterval(d time.Duration) error {
+	if d <= 0 {
+		return fmt.Errorf("invalid sync interval %v", d)
+	}
+
+	db.tickerMutex.Lock()
+	defer db.tickerMutex.Unlock()
+
+	if db.ticker == nil {
+		return ErrClosed
+	}
+	db.ticker.Reset(d)
+	return nil
+}
+
+// SetMaxCachedUpdates changes how many changes may be cached before they are
+// written to the file without waiting for the sync interval
+func (db *FileDB) SetMaxCachedUpdates(n uint) {
+	db.dataMutex.Lock(context.Background())
+	defer db.dataMutex.Unlock()
+
+	db.maxCached = n
+	db.notifyUpdate()
+}
+
+// Close writes the cached changes, closes the file and releases its lock. It
+// reports an error if the changes could not be written
+func (db *FileDB) Close() error {
 	// Send close command
 	db.doneChan <- true
 	// Wait until changes are in sync and than close the file
 	<-db.doneChan
-	db.file.Close()
+	err := db.closeErr
+	if closeErr := db.file.Close(); err == nil {
+		err = closeErr
+	}
+	if unlockErr := db.unlock(); err == nil {
+		err = unlockErr
+	}
+	return err
 }
 
 func (db *FileDB) syncDBWithCache() error {
-	db.fileMutex.Lock()
+	db.fileMutex.Lock(context.Background())
 	defer db.fileMutex.Unlock()
 
-	db.dataMutex.RLock()
+	db.dataMutex.RLock(context.Background())
 	defer db.dataMutex.RUnlock()
 
 	// Write updated data back to the file
-	if err := rewriteJSONFile(db.file, db.data); err != nil {
-		return fmt.Errorf("error writing to file: %w", err)
+	snap := &dbfile.Snapshot{
+		Header:  dbfile.Header{Seq: db.seq, IDStrategy: db.ids.Name(), Meta: db.meta},
+		Records: db.data,
+	}
+	if err := db.replaceFile(snap); err != nil {
+		return dberr.Unavailable(fmt.Errorf("error writing to file: %w", err))
 	}
 
 	db.cachedUpdates = 0
 	return nil
 }
 
-// CreateRecord adds a new record to the database
-func (db *FileDB) CreateRecord(data map[string]interface{}) error {
-	db.dataMutex.Lock()
-	defer db.dataMutex.Unlock()
-
-	// Determine the ID for the new record
-	var newID float64 = 1 // Default ID if the database is empty
+// replaceFile writes the snapshot to a temporary file and renames it over the
+// database file, so a failed write never damages the previous content
+func (db *FileDB) replaceFile(snap *dbfile.Snapshot) error {
+	tmpPath := db.path + ".tmp"
+	file, err := db.fs.OpenFile(tmpPath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, dbfile.FileMode(db.keys))
+	if err != nil {
+		return err
+	}
 
-	if len(db.data) > 0 {
-		lastRecord := db.data[len(db.data)-1]
-		if id, ok := lastRecord["id"].(float64); ok {
-			newID = float64(id + 1)
-		} else {
-			return ErrInvalidIDType
-		}
+	if err := db.encoding.Rewrite(file, snap); err != nil {
+		file.Close()
+		db.fs.Remove(tmpPath)
+		return err
+	}
+	if err := db.fs.Rename(tmpPath, db.path); err != nil {
+		file.Close()
+		db.fs.Remove(tmpPath)
+		return fmt.Errorf("error replacing file: %w", err)
 	}
 
-	// Set the new record's ID and add it to the database
-	data["id"] = newID
-	db.data = append(db.data, data)
+	// The handle on the old file now points at a removed inode
+	db.file.Close()
+	db.file = file
+	return nil
+}
 
+// noteUpdate counts a cached change, db.dataMutex must be held
+func (db *FileDB) noteUpdate() {
 	db.cachedUpdates++
-	if db.cachedUpdates > MaxCachedUpdates {
+	db.notifyUpdate()
+}
+
+// notifyUpdate wakes the sync loop once too many changes are cached,
+// db.dataMutex must be held
+func (db *FileDB) notifyUpdate() {
+	if db.cachedUpdates > db.maxCached {
 		select {
 		case db.updateChan <- true:
 		default:
 		}
 	}
+}
+
+// CreateRecord adds a new record to the database
+func (db *FileDB) CreateRecord(ctx context.Context, data map[string]interface{}) error {
+	if db.readOnly {
+		return ErrReadOnly
+	}
+	if err := db.dataMutex.Lock(ctx); err != nil {
+		return err
+	}
+	defer db.dataMutex.Unlock()
+
+	// IDs come from the sequence rather than the last record, so an ID freed
+	// by a delete is never handed out again
+	newID, err := db.ids.NewID(db.seq + 1)
+	if err != nil {
+		return fmt.Errorf("error generating ID: %w", err)
+	}
+	db.seq++
+	data["id"] = newID
+	db.data = append(db.data, data)
+
+	db.noteUpdate()
 
 	return nil
 }
 
 // ReadRecord retrieves a record by its ID
-func (db *FileDB) ReadRecord(id uint32) (map[string]interface{}, error) {
-	db.dataMutex.RLock()
+func (db *FileDB) ReadRecord(ctx context.Context, id repository.ID) (map[string]interface{}, error) {
+	if err := db.dataMutex.RLock(ctx); err != nil {
+		return nil, err
+	}
 	defer db.dataMutex.RUnlock()
 
 	// Search for the record with the specified ID
 	for _, record := range db.data {
-		if recordID, ok := record["id"].(float64); ok {
-			if recordID == float64(id) {
+		if recordID, ok := repository.FormatID(record["id"]); ok {
+			if recordID == id {
 				return record, nil
 			}
 		} else {
@@ -158,26 +564,23 @@ func (db *FileDB) ReadRecord(id uint32) (map[string]interface{}, error) {
 }
 
 // UpdateRecord updates a record with the specified ID
-func (db *FileDB) UpdateRecord(id uint32, data map[string]interface{}) error {
-	db.dataMutex.Lock()
+func (db *FileDB) UpdateRecord(ctx context.Context, id repository.ID, data map[string]interface{}) error {
+	if db.readOnly {
+		return ErrReadOnly
+	}
+	if err := db.dataMutex.Lock(ctx); err != nil {
+		return err
+	}
 	defer db.dataMutex.Unlock()
 
-	// Ensure the data has the ID field
-	data["id"] = float64(id)
-
 	// Search for the record with the specified ID and update it
 	for i, record := range db.data {
-		if recordID, ok := record["id"].(float64); ok {
-			if recordID == float64(id) {
-				// Replace the old record with the new data
+		if recordID, ok := repository.FormatID(record["id"]); ok {
+			if recordID == id {
+				// Replace the old record with the new data, keeping its stored ID
+				data["id"] = record["id"]
 				db.data[i] = data
-				db.cachedUpdates++
-				if db.cachedUpdates > MaxCachedUpdates {
-					select {
-					case db.updateChan <- true:
-					default:
-					}
-				}
+				db.noteUpdate()
 				return nil
 			}
 		} else {
@@ -190,22 +593,21 @@ func (db *FileDB) UpdateRecord(id uint32, data map[string]interface{}) error {
 }
 
 // DeleteRecord removes a record with the specified ID
-func (db *FileDB) DeleteRecord(id uint32) error {
-	db.dataMutex.Lock()
+func (db *FileDB) DeleteRecord(ctx context.Context, id repository.ID) error {
+	if db.readOnly {
+		return ErrReadOnly
+	}
+	if err := db.dataMutex.Lock(ctx); err != nil {
+		return err
+	}
 	defer db.dataMutex.Unlock()
 
 	// Search for the record with the specified ID and delete it
 	for i, record := range db.data {
-		if recordID, ok := record["id"].(float64); ok {
-			if recordID == float64(id) {
+		if recordID, ok := repository.FormatID(record["id"]); ok {
+			if recordID == id {
 				db.data = append(db.data[:i], db.data[i+1:]...)
-				db.cachedUpdates++
-				if db.cachedUpdates > MaxCachedUpdates {
-					select {
-					case db.updateChan <- true:
-					default:
-					}
-				}
+				db.noteUpdate()
 				return nil
 			}
 		} else {
@@ -217,39 +619,41 @@ func (db *FileDB) DeleteRecord(id uint32) error {
 	return ErrRecordNotFound
 }
 
-// rewriteJSONFile truncates the file and writes the provided data to it
-func rewriteJSONFile(file *os.File, data []map[string]interface{}) error {
-	if err := file.Truncate(0); err != nil {
-		return fmt.Errorf("error truncating file: %w", err)
+// ApplyChanges replays changes made on another instance, in order. Nothing
+// is applied if one of them fails
+func (db *FileDB) ApplyChanges(ctx context.Context, changes []repository.Change) error {
+	if db.readOnly {
+		return ErrReadOnly
 	}
-
-	if _, err := file.Seek(0, 0); err != nil {
-		return fmt.Errorf("error seeking file: %w", err)
+	if err := db.dataMutex.Lock(ctx); err != nil {
+		return err
 	}
+	defer db.dataMutex.Unlock()
 
-	encoder := json.NewEncoder(file)
-	if err := encoder.Encode(data); err != nil {
-		return fmt.Errorf("error encoding JSON data: %w", err)
+	records, seq, err := repository.ApplyChanges(db.data, db.seq, changes)
+	if err != nil {
+		return err
 	}
-
+	db.data = records
+	db.seq = seq
+	db.cachedUpdates += uint(len(changes))
+	db.notifyUpdate()
 	return nil
 }
 
-// readJSONFile reads JSON data from the file and returns it as a slice of maps
-func readJSONFile(file *os.File) ([]map[string]interface{}, error) {
-	fileContent, err := io.ReadAll(file)
-	if err != nil {
-		return nil, fmt.Errorf("error reading file: %w", err)
+// Replace makes records and seq the whole content of the database, for an
+// instance catching up with another one from a snapshot
+func (db *FileDB) Replace(ctx context.Context, records []map[string]interface{}, seq uint64) error {
+	if db.readOnly {
+		return ErrReadOnly
 	}
-
-	if len(fileContent) == 0 {
-		return []map[string]interface{}{}, nil
-	}
-
-	var data []map[string]interface{}
-	if err := json.Unmarshal(fileContent, &data); err != nil {
-		return nil, fmt.Errorf("error unmarshalling JSON data: %w", err)
+	if err := db.dataMutex.Lock(ctx); err != nil {
+		return err
 	}
+	defer db.dataMutex.Unlock()
 
-	return data, nil
+	db.data = append([]map[string]interface{}(nil), records...)
+	db.seq = seq
+	db.noteUpdate()
+	return nil
 }
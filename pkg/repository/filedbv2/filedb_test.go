@@ -1 +1,586 @@
 package filedbv2
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+	"zabbixhw/pkg/clock"
+	"zabbixhw/pkg/filelock"
+	"zabbixhw/pkg/fsys"
+	"zabbixhw/pkg/repository"
+	"zabbixhw/pkg/repository/dberr"
+	"zabbixhw/pkg/repository/dbfile"
+	"zabbixhw/pkg/repository/repotest"
+)
+
+func Test_IDsNotReused(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "db.json")
+
+	// Start from a legacy bare-array file
+	initialData := `[{"id": 1, "name": "John Doe"}, {"id": 2, "name": "Jane Doe"}]`
+	if err := os.WriteFile(path, []byte(initialData), 0644); err != nil {
+		t.Fatalf("Failed to write initial data: %v", err)
+	}
+
+	db, err := NewFileDB(path)
+	if err != nil {
+		t.Fatalf("Failed to initialize FileDB: %v", err)
+	}
+
+	// Delete the newest record and create another one
+	if err := db.DeleteRecord(context.Background(), "2"); err != nil {
+		t.Fatalf("Failed to delete record: %v", err)
+	}
+	record := map[string]interface{}{"name": "New"}
+	if err := db.CreateRecord(context.Background(), record); err != nil {
+		t.Fatalf("Failed to create record: %v", err)
+	}
+	if record["id"] != json.Number("3") {
+		t.Fatalf("Expected id 3, got %v", record["id"])
+	}
+
+	// Delete it again and reopen, the sequence must survive
+	if err := db.DeleteRecord(context.Background(), "3"); err != nil {
+		t.Fatalf("Failed to delete record: %v", err)
+	}
+	db.Close()
+
+	db, err = NewFileDB(path)
+	if err != nil {
+		t.Fatalf("Failed to reopen FileDB: %v", err)
+	}
+	defer db.Close()
+
+	record = map[string]interface{}{"name": "Newer"}
+	if err := db.CreateRecord(context.Background(), record); err != nil {
+		t.Fatalf("Failed to create record: %v", err)
+	}
+	if record["id"] != json.Number("4") {
+		t.Fatalf("Expected id 4, got %v", record["id"])
+	}
+}
+
+func Test_ContextCancellation(t *testing.T) {
+	db, err := NewFileDB(filepath.Join(t.TempDir(), "db.json"))
+	if err != nil {
+		t.Fatalf("Failed to initialize FileDB: %v", err)
+	}
+	defer db.Close()
+
+	// Hold the data lock as a flush in progress would
+	if err := db.dataMutex.Lock(context.Background()); err != nil {
+		t.Fatalf("Failed to lock: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+
+	err = db.CreateRecord(ctx, map[string]interface{}{"name": "John Doe"})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Expected error %v, got %v", context.DeadlineExceeded, err)
+	}
+
+	db.dataMutex.Unlock()
+
+	if _, err := db.ReadRecord(context.Background(), "1"); err != ErrRecordNotFound {
+		t.Fatalf("Expected error %v, got %v", ErrRecordNotFound, err)
+	}
+}
+
+func Test_Conformance(t *testing.T) {
+	repotest.Run(t, newTestStore)
+}
+
+func Test_Model(t *testing.T) {
+	repotest.RunModel(t, newTestStore, repotest.ModelOptions{ReopenEvery: 25})
+}
+
+func Test_FileConformance(t *testing.T) {
+	repotest.RunFile(t, openFileEngine)
+}
+
+func Test_ConformanceNDJSON(t *testing.T) {
+	repotest.Run(t, func(t *testing.T) repotest.Opener {
+		return newTestStoreWith(t, WithFormat(dbfile.FormatNDJSON))
+	})
+}
+
+func Test_ConformanceMsgpack(t *testing.T) {
+	repotest.Run(t, func(t *testing.T) repotest.Opener {
+		return newTestStoreWith(t, WithFormat(dbfile.FormatMsgpack))
+	})
+}
+
+func Benchmark_Repository(b *testing.B) {
+	repotest.Bench(b, openBenchStore)
+}
+
+// newTestStore is the repotest factory for this engine
+func newTestStore(t *testing.T) repotest.Opener {
+	return newTestStoreWith(t)
+}
+
+// newTestStoreWith is newTestStore for a FileDB with options
+func newTestStoreWith(t *testing.T, opts ...Option) repotest.Opener {
+	path := filepath.Join(t.TempDir(), "db.json")
+	return func(t *testing.T) (repository.DatabaseRepoV2, func()) {
+		db, err := NewFileDB(path, opts...)
+		if err != nil {
+			t.Fatalf("Failed to initialize FileDB: %v", err)
+		}
+		return db, func() {
+			if err := db.Close(); err != nil {
+				t.Errorf("Close failed: %v", err)
+			}
+		}
+	}
+}
+
+// openFileEngine is the repotest file suite opener for this engine
+func openFileEngine(path string, opts repotest.FileOptions) (repotest.FileEngine, error) {
+	options := []Option{WithFS(opts.FS)}
+	if opts.ReadOnly {
+		options = append(options, WithReadOnly())
+	}
+	if opts.Policy != "" {
+		options = append(options, WithVerifyPolicy(opts.Policy))
+	}
+	if opts.Format != "" {
+		options = append(options, WithFormat(opts.Format))
+	}
+	if opts.Compression != "" {
+		options = append(options, WithCompression(opts.Compression, opts.Level))
+	}
+	if opts.Keys != nil {
+		options = append(options, WithKeys(opts.Keys))
+	}
+
+	db, err := NewFileDB(path, options...)
+	if err != nil {
+		return nil, err
+	}
+	return db, nil
+}
+
+// openBenchStore is the repotest bench opener for this engine
+func openBenchStore(b *testing.B, records []map[string]interface{}) (repository.DatabaseRepoV2, func()) {
+	path := filepath.Join(b.TempDir(), "db.json")
+	repotest.SeedFile(b, path, records)
+
+	db, err := NewFileDB(path)
+	if err != nil {
+		b.Fatalf("Failed to initialize FileDB: %v", err)
+	}
+	return db, func() {
+		if err := db.Close(); err != nil {
+			b.Errorf("Close failed: %v", err)
+		}
+	}
+}
+
+// syncedStore opens a FileDB on a fake clock and reports the result of every
+// sync attempt on the returned channel
+func syncedStore(t *testing.T, opts ...Option) (*FileDB, *clock.Fake, <-chan error, string) {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "db.json")
+	fake := clock.NewFake(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	synced := make(chan error, 1)
+
+	opts = append([]Option{
+		WithClock(fake),
+		func(db *FileDB) {
+			db.afterSync = func(err error) { synced <- err }
+		},
+	}, opts...)
+	db, err := NewFileDB(path, opts...)
+	if err != nil {
+		t.Fatalf("NewFileDB failed: %v", err)
+	}
+	return db, fake, synced, path
+}
+
+// expectOnDisk checks how many records the file holds
+func expectOnDisk(t *testing.T, path string, expected int) {
+	t.Helper()
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Failed to read file: %v", err)
+	}
+	expectRecords(t, content, expected)
+}
+
+// expectRecords checks how many records the file content holds
+func expectRecords(t *testing.T, content []byte, expected int) {
+	t.Helper()
+
+	snap, err := dbfile.Decode(content)
+	if err != nil {
+		t.Fatalf("Failed to decode file: %v", err)
+	}
+	if len(snap.Records) != expected {
+		t.Errorf("expected %d records on disk, got %d", expected, len(snap.Records))
+	}
+}
+
+// waitSync waits for a sync attempt that must succeed
+func waitSync(t *testing.T, synced <-chan error) {
+	t.Helper()
+
+	if err := waitSyncErr(t, synced); err != nil {
+		t.Fatalf("sync failed: %v", err)
+	}
+}
+
+// waitSyncErr waits for a sync attempt and returns its result
+func waitSyncErr(t *testing.T, synced <-chan error) error {
+	t.Helper()
+
+	select {
+	case err := <-synced:
+		return err
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for a sync")
+		return nil
+	}
+}
+
+func createRecords(t *testing.T, db *FileDB, n int) {
+	t.Helper()
+
+	for i := 0; i < n; i++ {
+		if err := db.CreateRecord(context.Background(), map[string]interface{}{"n": i}); err != nil {
+			t.Fatalf("CreateRecord failed: %v", err)
+		}
+	}
+}
+
+func Test_SyncInterval(t *testing.T) {
+	db, fake, synced, path := syncedStore(t, WithSyncInterval(10*time.Second), WithMaxCachedUpdates(100))
+	defer db.Close()
+
+	createRecords(t, db, 1)
+
+	// Nothing reaches the disk before the interval has fully passed
+	fake.Advance(10*time.Second - time.Nanosecond)
+	expectOnDisk(t, path, 0)
+
+	fake.Advance(time.Nanosecond)
+	waitSync(t, synced)
+	expectOnDisk(t, path, 1)
+
+	// Shortening the interval restarts it from now
+	if err := db.SetSyncInterval(time.Second); err != nil {
+		t.Fatalf("SetSyncInterval failed: %v", err)
+	}
+	createRecords(t, db, 1)
+
+	fake.Advance(time.Second - time.Nanosecond)
+	expectOnDisk(t, path, 1)
+
+	fake.Advance(time.Nanosecond)
+	waitSync(t, synced)
+	expectOnDisk(t, path, 2)
+
+	if err := db.SetSyncInterval(0); err == nil {
+		t.Error("expected an error for a zero interval")
+	}
+}
+
+func Test_MaxCachedUpdates(t *testing.T) {
+	db, _, synced, path := syncedStore(t, WithMaxCachedUpdates(2))
+	defer db.Close()
+
+	// The third pending change triggers a sync without the clock moving
+	createRecords(t, db, 2)
+	expectOnDisk(t, path, 0)
+
+	createRecords(t, db, 1)
+	waitSync(t, synced)
+	expectOnDisk(t, path, 3)
+
+	// Lowering the limit flushes what is already pending
+	createRecords(t, db, 1)
+	db.SetMaxCachedUpdates(0)
+	waitSync(t, synced)
+	expectOnDisk(t, path, 4)
+}
+
+func Test_Close(t *testing.T) {
+	db, _, synced, path := syncedStore(t)
+
+	createRecords(t, db, 1)
+	db.Close()
+	waitSync(t, synced)
+	expectOnDisk(t, path, 1)
+
+	if err := db.SetSyncInterval(time.Second); !errors.Is(err, ErrClosed) {
+		t.Errorf("expected %v, got %v", ErrClosed, err)
+	}
+}
+
+func Test_InvalidSyncInterval(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "db.json")
+	if _, err := NewFileDB(path, WithSyncInterval(0)); err == nil {
+		t.Error("expected an error for a zero interval")
+	}
+}
+
+func Test_StorageFaults(t *testing.T) {
+	const initial = `{"header":{"version":2,"seq":2,"idStrategy":"sequential"},"records":[{"id":1,"name":"Alice"},{"id":2,"name":"Bob"}],"checksums":{"algorithm":"crc32c","file":"756f4fc0","records":["e1d45fc3","d67ac1e1"]}}`
+
+	tests := []struct {
+		name  string
+		fault fsys.Fault
+		cause error
+	}{
+		{name: "Disk full", fault: fsys.Fault{Op: fsys.OpWrite, Err: syscall.ENOSPC}, cause: syscall.ENOSPC},
+		{name: "Short write", fault: fsys.Fault{Op: fsys.OpWrite, Err: syscall.ENOSPC, Short: 10}, cause: syscall.ENOSPC},
+		{name: "Failed fsync", fault: fsys.Fault{Op: fsys.OpSync, Err: syscall.EIO}, cause: syscall.EIO},
+		{name: "Failed rename", fault: fsys.Fault{Op: fsys.OpRename, Err: syscall.EIO}, cause: syscall.EIO},
+		{name: "Failed open", fault: fsys.Fault{Op: fsys.OpOpen, Err: syscall.EACCES}, cause: syscall.EACCES},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mem := fsys.NewMemFS()
+			mem.WriteFile("db.json", []byte(initial))
+			faulty := fsys.NewFaulty(mem)
+
+			fake := clock.NewFake(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+			synced := make(chan error, 1)
+			db, err := NewFileDB("db.json", WithFS(faulty), WithClock(fake), func(db *FileDB) {
+				db.afterSync = func(err error) { synced <- err }
+			})
+			if err != nil {
+				t.Fatalf("NewFileDB failed: %v", err)
+			}
+			defer db.Close()
+
+			if err := db.CreateRecord(context.Background(), map[string]interface{}{"name": "Charlie"}); err != nil {
+				t.Fatalf("CreateRecord failed: %v", err)
+			}
+
+			faulty.Inject(tt.fault)
+			fake.Advance(SyncInterval)
+			err = waitSyncErr(t, synced)
+			if !errors.Is(err, dberr.ErrStorageUnavailable) || !errors.Is(err, tt.cause) {
+				t.Fatalf("expected %v caused by %v, got %v", dberr.ErrStorageUnavailable, tt.cause, err)
+			}
+
+			// The file keeps its previous content and the change stays cached
+			content, _ := mem.ReadFile("db.json")
+			if string(content) != initial {
+				t.Errorf("expected the file to hold %s, got %s", initial, content)
+			}
+			if _, err := mem.ReadFile("db.json.tmp"); err == nil {
+				t.Error("temporary file left behind")
+			}
+			if _, err := db.ReadRecord(context.Background(), "3"); err != nil {
+				t.Errorf("ReadRecord failed: %v", err)
+			}
+
+			// The next sync retries the change
+			fake.Advance(SyncInterval)
+			waitSync(t, synced)
+			content, _ = mem.ReadFile("db.json")
+			expectRecords(t, content, 3)
+		})
+	}
+
+	t.Run("Close reports a failed final sync", func(t *testing.T) {
+		faulty := fsys.NewFaulty(fsys.NewMemFS())
+		db, err := NewFileDB("db.json", WithFS(faulty))
+		if err != nil {
+			t.Fatalf("NewFileDB failed: %v", err)
+		}
+
+		if err := db.CreateRecord(context.Background(), map[string]interface{}{"name": "Alice"}); err != nil {
+			t.Fatalf("CreateRecord failed: %v", err)
+		}
+		faulty.Inject(fsys.Fault{Op: fsys.OpWrite, Err: syscall.ENOSPC, Times: -1})
+		if err := db.Close(); !errors.Is(err, syscall.ENOSPC) {
+			t.Errorf("expected %v, got %v", syscall.ENOSPC, err)
+		}
+	})
+
+	t.Run("Failed read", func(t *testing.T) {
+		mem := fsys.NewMemFS()
+		mem.WriteFile("db.json", []byte(initial))
+		faulty := fsys.NewFaulty(mem)
+		faulty.Inject(fsys.Fault{Op: fsys.OpRead, Err: syscall.EIO})
+
+		if _, err := NewFileDB("db.json", WithFS(faulty)); !errors.Is(err, syscall.EIO) {
+			t.Errorf("expected %v, got %v", syscall.EIO, err)
+		}
+	})
+}
+
+func Test_Snapshot(t *testing.T) {
+	db, _, _, path := syncedStore(t, WithMaxCachedUpdates(100), WithCompression(dbfile.CompressionGzip, dbfile.BestSpeed))
+	defer db.Close()
+	createRecords(t, db, 3)
+
+	// Cached changes are part of the snapshot before they reach the file
+	snap, encoding, err := db.Snapshot(context.Background())
+	if err != nil {
+		t.Fatalf("Snapshot failed: %v", err)
+	}
+	expectOnDisk(t, path, 0)
+	if len(snap.Records) != 3 || snap.Header.Seq != 3 || encoding.Compression != dbfile.CompressionGzip {
+		t.Errorf("unexpected snapshot: %d records, seq %d, %s", len(snap.Records), snap.Header.Seq, encoding.Compression)
+	}
+
+	// Later changes, made in place, do not reach it
+	if err := db.UpdateRecord(context.Background(), "1", map[string]interface{}{"n": 10}); err != nil {
+		t.Fatalf("UpdateRecord failed: %v", err)
+	}
+	if err := db.DeleteRecord(context.Background(), "2"); err != nil {
+		t.Fatalf("DeleteRecord failed: %v", err)
+	}
+	if id, _ := repository.FormatID(snap.Records[1]["id"]); len(snap.Records) != 3 || snap.Records[0]["n"] != 0 || id != "2" {
+		t.Errorf("the snapshot changed: %v", snap.Records)
+	}
+}
+
+func Test_ApplyChanges(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "db.json")
+	db, err := NewFileDB(path)
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	for _, name := range []string{"Alice", "Bob"} {
+		if err := db.CreateRecord(ctx, map[string]interface{}{"name": name}); err != nil {
+			t.Fatalf("CreateRecord failed: %v", err)
+		}
+	}
+
+	changes := []repository.Change{
+		{Op: repository.OpCreate, ID: "3", Record: map[string]interface{}{"id": json.Number("3"), "name": "Carol"}},
+		{Op: repository.OpUpdate, ID: "1", Record: map[string]interface{}{"id": json.Number("1"), "name": "Alicia"}},
+		{Op: repository.OpDelete, ID: "2"},
+	}
+	if err := db.ApplyChanges(ctx, changes); err != nil {
+		t.Fatalf("ApplyChanges failed: %v", err)
+	}
+	// A failing batch is not applied at all
+	if err := db.ApplyChanges(ctx, []repository.Change{{Op: repository.OpDelete, ID: "1"}, {Op: repository.OpDelete, ID: "2"}}); !errors.Is(err, dberr.ErrNotFound) {
+		t.Errorf("expected %v, got %v", dberr.ErrNotFound, err)
+	}
+	// The sequence moved with the replayed create
+	if err := db.CreateRecord(ctx, map[string]interface{}{"name": "Dave"}); err != nil {
+		t.Fatalf("CreateRecord failed: %v", err)
+	}
+	if record, err := db.ReadRecord(ctx, "4"); err != nil || record["name"] != "Dave" {
+		t.Errorf("expected Dave as 4, got %v (%v)", record, err)
+	}
+	if record, err := db.ReadRecord(ctx, "1"); err != nil || record["name"] != "Alicia" {
+		t.Errorf("expected the replayed update, got %v (%v)", record, err)
+	}
+	if _, err := db.ReadRecord(ctx, "2"); !errors.Is(err, dberr.ErrNotFound) {
+		t.Errorf("expected the replayed delete, got %v", err)
+	}
+
+	if err := db.Replace(ctx, []map[string]interface{}{{"id": json.Number("7"), "name": "Erin"}}, 7); err != nil {
+		t.Fatalf("Replace failed: %v", err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	db, err = NewFileDB(path)
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer db.Close()
+	snap, _, err := db.Snapshot(ctx)
+	if err != nil {
+		t.Fatalf("Snapshot failed: %v", err)
+	}
+	if len(snap.Records) != 1 || snap.Records[0]["name"] != "Erin" || snap.Header.Seq != 7 {
+		t.Errorf("expected the replaced content on disk, got %v at seq %d", snap.Records, snap.Header.Seq)
+	}
+}
+
+func Test_Locking(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "db.json")
+
+	db, err := NewFileDB(path)
+	if err != nil {
+		t.Fatalf("NewFileDB failed: %v", err)
+	}
+	if err := db.CreateRecord(context.Background(), map[string]interface{}{"name": "Alice"}); err != nil {
+		t.Fatalf("CreateRecord failed: %v", err)
+	}
+
+	if _, err := NewFileDB(path); !errors.Is(err, filelock.ErrLocked) {
+		t.Fatalf("expected %v, got %v", filelock.ErrLocked, err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	// Readers share the file, see the data written before and keep writers out
+	reader, err := NewFileDB(path, WithReadOnly())
+	if err != nil {
+		t.Fatalf("NewFileDB read-only failed: %v", err)
+	}
+	defer reader.Close()
+	other, err := NewFileDB(path, WithReadOnly())
+	if err != nil {
+		t.Fatalf("second NewFileDB read-only failed: %v", err)
+	}
+	defer other.Close()
+
+	if _, err := NewFileDB(path); !errors.Is(err, filelock.ErrLocked) {
+		t.Errorf("expected %v while readers hold the file, got %v", filelock.ErrLocked, err)
+	}
+	if record, err := reader.ReadRecord(context.Background(), "1"); err != nil || record["name"] != "Alice" {
+		t.Errorf("expected Alice, got %v (%v)", record, err)
+	}
+	if err := reader.CreateRecord(context.Background(), map[string]interface{}{"name": "Bob"}); !errors.Is(err, ErrReadOnly) {
+		t.Errorf("expected %v, got %v", ErrReadOnly, err)
+	}
+	if err := reader.DeleteRecord(context.Background(), "1"); !errors.Is(err, ErrReadOnly) {
+		t.Errorf("expected %v, got %v", ErrReadOnly, err)
+	}
+}
+
+func Test_RekeyWhileSyncing(t *testing.T) {
+	oldKeys, newKeys := repotest.Keyring(t, 1), repotest.Keyring(t, 2, 1)
+	mem := fsys.NewMemFS()
+	db, err := NewFileDB("db.json", WithFS(mem), WithKeys(oldKeys), WithSyncInterval(time.Millisecond))
+	if err != nil {
+		t.Fatalf("NewFileDB failed: %v", err)
+	}
+	defer db.Close()
+
+	// Run with -race: the sync loop reads the count of cached changes that
+	// Rekey resets
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 200; i++ {
+			db.CreateRecord(context.Background(), map[string]interface{}{"name": "Alice"})
+		}
+	}()
+	for i := 0; i < 200; i++ {
+		keys := oldKeys
+		if i%2 == 0 {
+			keys = newKeys
+		}
+		if err := db.Rekey(context.Background(), keys); err != nil {
+			t.Fatalf("Rekey failed: %v", err)
+		}
+	}
+	wg.Wait()
+}
@@ -0,0 +1,74 @@
+package idgen
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+	"zabbixhw/pkg/repository"
+)
+
+// Names of the available strategies
+const (
+	NameSequential = "sequential"
+	NameUUIDv7     = "uuidv7"
+	NameULID       = "ulid"
+	NameSnowflake  = "snowflake"
+)
+
+var ErrInvalidID = errors.New("invalid ID")
+
+// Strategy generates and validates record IDs for a collection
+type Strategy interface {
+	// Name returns the strategy name persisted alongside the collection
+	Name() string
+	// NewID returns the value stored in the "id" field of a new record.
+	// seq is the collection's sequence number for that record
+	NewID(seq uint64) (interface{}, error)
+	// ParseID validates an ID received from a client and returns its canonical form
+	ParseID(s string) (repository.ID, error)
+}
+
+// New returns the strategy with the given name. node is only used by snowflake
+func New(name string, node int64) (Strategy, error) {
+	switch name {
+	case "", NameSequential:
+		return Sequential{}, nil
+	case NameUUIDv7:
+		return NewUUIDv7(), nil
+	case NameULID:
+		return NewULID(), nil
+	case NameSnowflake:
+		return NewSnowflake(node)
+	default:
+		return nil, fmt.Errorf("unknown ID strategy %q", name)
+	}
+}
+
+// Default returns the strategy used when none is configured
+func Default() Strategy {
+	return Sequential{}
+}
+
+// Sequential issues auto-incrementing numeric IDs taken from the collection sequence
+type Sequential struct{}
+
+func (Sequential) Name() string {
+	return NameSequential
+}
+
+func (Sequential) NewID(seq uint64) (interface{}, error) {
+	return json.Number(strconv.FormatUint(seq, 10)), nil
+}
+
+func (Sequential) ParseID(s string) (repository.ID, error) {
+	id, err := strconv.ParseUint(s, 10, 64)
+	if err != nil || id == 0 {
+		return "", ErrInvalidID
+	}
+	return repository.ID(strconv.FormatUint(id, 10)), nil
+}
+
+// clock returns the current time, replaced in tests
+type clock func() time.Time
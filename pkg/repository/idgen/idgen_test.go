@@ -0,0 +1,169 @@
+package idgen
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"testing"
+	"time"
+)
+
+func fixedClock(t time.Time) clock {
+	return func() time.Time { return t }
+}
+
+func Test_New(t *testing.T) {
+	tests := []struct {
+		name     string
+		node     int64
+		expected string
+		wantErr  bool
+	}{
+		{name: "", expected: NameSequential},
+		{name: NameSequential, expected: NameSequential},
+		{name: NameUUIDv7, expected: NameUUIDv7},
+		{name: NameULID, expected: NameULID},
+		{name: NameSnowflake, node: 3, expected: NameSnowflake},
+		{name: NameSnowflake, node: MaxSnowflakeNode + 1, wantErr: true},
+		{name: "random", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := New(tt.name, tt.node)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("expected an error, got none")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if s.Name() != tt.expected {
+				t.Errorf("expected %s, got %s", tt.expected, s.Name())
+			}
+		})
+	}
+}
+
+func Test_Sequential(t *testing.T) {
+	s := Sequential{}
+
+	id, err := s.NewID(42)
+	if err != nil || id != json.Number("42") {
+		t.Fatalf("expected 42, got %v (%v)", id, err)
+	}
+
+	parsed, err := s.ParseID("0007")
+	if err != nil || parsed != "7" {
+		t.Errorf("expected canonical 7, got %q (%v)", parsed, err)
+	}
+
+	for _, invalid := range []string{"abc", "-1", "0", "1.5", ""} {
+		if _, err := s.ParseID(invalid); err == nil {
+			t.Errorf("expected %q to be rejected", invalid)
+		}
+	}
+}
+
+// checkMonotonic generates IDs under a frozen clock and checks they are unique,
+// sorted, and accepted by ParseID
+func checkMonotonic(t *testing.T, s Strategy, n int) {
+	t.Helper()
+
+	ids := make([]string, 0, n)
+	seen := make(map[string]bool)
+	for i := 0; i < n; i++ {
+		v, err := s.NewID(uint64(i + 1))
+		if err != nil {
+			t.Fatalf("NewID failed: %v", err)
+		}
+		id := v.(string)
+		if seen[id] {
+			t.Fatalf("duplicate ID %s", id)
+		}
+		seen[id] = true
+		ids = append(ids, id)
+
+		parsed, err := s.ParseID(id)
+		if err != nil {
+			t.Fatalf("ParseID(%s) failed: %v", id, err)
+		}
+		if string(parsed) != id {
+			t.Fatalf("expected canonical %s, got %s", id, parsed)
+		}
+	}
+
+	if !sort.StringsAreSorted(ids) {
+		t.Error("expected IDs to be generated in sorted order")
+	}
+}
+
+func Test_UUIDv7(t *testing.T) {
+	g := NewUUIDv7()
+	g.now = fixedClock(time.UnixMilli(1700000000000))
+
+	v, _ := g.NewID(0)
+	id := v.(string)
+	if id[14] != '7' {
+		t.Errorf("expected version 7, got %s", id)
+	}
+	if prefix := fmt.Sprintf("%012x", 1700000000000); id[:8]+id[9:13] != prefix {
+		t.Errorf("expected timestamp prefix %s, got %s", prefix, id)
+	}
+
+	for _, invalid := range []string{"abc", "018bcfe5-6800-4000-8000-000000000000", "018bcfe568007000800000000000000000xx"} {
+		if _, err := g.ParseID(invalid); err == nil {
+			t.Errorf("expected %q to be rejected", invalid)
+		}
+	}
+}
+
+func Test_ULID(t *testing.T) {
+	// Timestamp 1469918176385 is 01ARYZ6S41 in the reference implementation
+	if got := encodeULID([16]byte{0x01, 0x56, 0x3d, 0xf3, 0x64, 0x81}); got[:10] != "01ARYZ6S41" {
+		t.Errorf("expected timestamp 01ARYZ6S41, got %s", got[:10])
+	}
+
+	g := NewULID()
+	g.now = fixedClock(time.UnixMilli(1469918176385))
+	checkMonotonic(t, g, 5000)
+
+	parsed, err := g.ParseID("01arz3ndektsv4rrffq69g5fav")
+	if err != nil || parsed != "01ARZ3NDEKTSV4RRFFQ69G5FAV" {
+		t.Errorf("expected uppercase canonical form, got %q (%v)", parsed, err)
+	}
+
+	for _, invalid := range []string{"abc", "81ARZ3NDEKTSV4RRFFQ69G5FAV", "01ARZ3NDEKTSV4RRFFQ69G5FAU"} {
+		if _, err := g.ParseID(invalid); err == nil {
+			t.Errorf("expected %q to be rejected", invalid)
+		}
+	}
+}
+
+func Test_Snowflake(t *testing.T) {
+	g, err := NewSnowflake(5)
+	if err != nil {
+		t.Fatalf("NewSnowflake failed: %v", err)
+	}
+	g.now = fixedClock(snowflakeEpoch.Add(time.Hour))
+
+	// Decimal strings only sort like numbers when they have the same length
+	checkMonotonic(t, g, 5000)
+
+	v, _ := g.NewID(0)
+	var id int64
+	for _, c := range v.(string) {
+		id = id*10 + int64(c-'0')
+	}
+	if node := id >> snowflakeSeqBits & MaxSnowflakeNode; node != 5 {
+		t.Errorf("expected node 5 encoded in ID, got %d", node)
+	}
+
+	for _, invalid := range []string{"abc", "-5", "0"} {
+		if _, err := g.ParseID(invalid); err == nil {
+			t.Errorf("expected %q to be rejected", invalid)
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package idgen
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+	"zabbixhw/pkg/repository"
+)
+
+const (
+	snowflakeNodeBits = 10
+	snowflakeSeqBits  = 12
+	MaxSnowflakeNode  = 1<<snowflakeNodeBits - 1
+)
+
+// snowflakeEpoch is the start of the 41-bit millisecond timestamp
+var snowflakeEpoch = time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// Snowflake issues 63-bit IDs made of a timestamp, a node ID and a per-millisecond
+// sequence, so several servers can create IDs without coordination. IDs are
+// stored as decimal strings because they do not fit in a JSON float
+type Snowflake struct {
+	mu     sync.Mutex
+	now    clock
+	node   int64
+	lastMs int64
+	seq    int64
+}
+
+// NewSnowflake creates a snowflake strategy for the given node ID
+func NewSnowflake(node int64) (*Snowflake, error) {
+	if node < 0 || node > MaxSnowflakeNode {
+		return nil, fmt.Errorf("snowflake node ID must be between 0 and %d", MaxSnowflakeNode)
+	}
+	return &Snowflake{now: time.Now, node: node}, nil
+}
+
+func (g *Snowflake) Name() string {
+	return NameSnowflake
+}
+
+func (g *Snowflake) NewID(seq uint64) (interface{}, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	ms := g.now().Sub(snowflakeEpoch).Milliseconds()
+	if ms <= g.lastMs {
+		ms = g.lastMs
+		g.seq = (g.seq + 1) & (1<<snowflakeSeqBits - 1)
+		if g.seq == 0 {
+			// Sequence exhausted for this millisecond, move on to the next one
+			ms++
+		}
+	} else {
+		g.seq = 0
+	}
+	g.lastMs = ms
+
+	id := ms<<(snowflakeNodeBits+snowflakeSeqBits) | g.node<<snowflakeSeqBits | g.seq
+	return strconv.FormatInt(id, 10), nil
+}
+
+func (g *Snowflake) ParseID(s string) (repository.ID, error) {
+	id, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || id <= 0 {
+		return "", ErrInvalidID
+	}
+	return repository.ID(strconv.FormatInt(id, 10)), nil
+}
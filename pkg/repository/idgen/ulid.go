@@ -0,0 +1,105 @@
+package idgen
+
+import (
+	"crypto/rand"
+	"strings"
+	"sync"
+	"time"
+	"zabbixhw/pkg/repository"
+)
+
+// crockford is the Crockford base32 alphabet used by ULIDs
+const crockford = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+// ULID issues lexicographically sortable identifiers. Within one millisecond
+// the random part is incremented so IDs stay monotonic
+type ULID struct {
+	mu      sync.Mutex
+	now     clock
+	lastMs  int64
+	lastRnd [10]byte
+}
+
+// NewULID creates a ULID strategy
+func NewULID() *ULID {
+	return &ULID{now: time.Now}
+}
+
+func (g *ULID) Name() string {
+	return NameULID
+}
+
+func (g *ULID) NewID(seq uint64) (interface{}, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	ms := g.now().UnixMilli()
+	if ms <= g.lastMs {
+		ms = g.lastMs
+		if !increment(g.lastRnd[:]) {
+			// Random part overflowed, borrow the next millisecond
+			ms++
+		}
+	} else if _, err := rand.Read(g.lastRnd[:]); err != nil {
+		return nil, err
+	}
+	g.lastMs = ms
+
+	var b [16]byte
+	b[0] = byte(ms >> 40)
+	b[1] = byte(ms >> 32)
+	b[2] = byte(ms >> 24)
+	b[3] = byte(ms >> 16)
+	b[4] = byte(ms >> 8)
+	b[5] = byte(ms)
+	copy(b[6:], g.lastRnd[:])
+
+	return encodeULID(b), nil
+}
+
+func (g *ULID) ParseID(s string) (repository.ID, error) {
+	s = strings.ToUpper(s)
+	if len(s) != 26 || s[0] > '7' {
+		return "", ErrInvalidID
+	}
+	for i := 0; i < len(s); i++ {
+		if strings.IndexByte(crockford, s[i]) < 0 {
+			return "", ErrInvalidID
+		}
+	}
+	return repository.ID(s), nil
+}
+
+// increment adds one to the big-endian number in b and reports false on overflow
+func increment(b []byte) bool {
+	for i := len(b) - 1; i >= 0; i-- {
+		b[i]++
+		if b[i] != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// encodeULID encodes 128 bits as 26 Crockford base32 characters
+func encodeULID(b [16]byte) string {
+	var out [26]byte
+	// 130 bits of output, the two leading bits are always zero
+	var acc uint
+	var bits uint
+	pos := 25
+	for i := 15; i >= 0; i-- {
+		acc |= uint(b[i]) << bits
+		bits += 8
+		for bits >= 5 && pos >= 0 {
+			out[pos] = crockford[acc&0x1f]
+			acc >>= 5
+			bits -= 5
+			pos--
+		}
+	}
+	if pos >= 0 {
+		out[pos] = crockford[acc&0x1f]
+	}
+	return string(out[:])
+}
@@ -0,0 +1,96 @@
+package idgen
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"strings"
+	"sync"
+	"time"
+	"zabbixhw/pkg/repository"
+)
+
+// UUIDv7 issues time-ordered UUIDs as described in RFC 9562. The 12-bit
+// rand_a field holds a counter so IDs created in the same millisecond
+// still sort in creation order
+type UUIDv7 struct {
+	mu     sync.Mutex
+	now    clock
+	lastMs int64
+	seq    uint16
+}
+
+// NewUUIDv7 creates a UUIDv7 strategy
+func NewUUIDv7() *UUIDv7 {
+	return &UUIDv7{now: time.Now}
+}
+
+func (g *UUIDv7) Name() string {
+	return NameUUIDv7
+}
+
+func (g *UUIDv7) NewID(seq uint64) (interface{}, error) {
+	var b [16]byte
+	if _, err := rand.Read(b[6:]); err != nil {
+		return nil, err
+	}
+
+	g.mu.Lock()
+	ms := g.now().UnixMilli()
+	if ms <= g.lastMs {
+		// Same millisecond or clock went backwards, keep counting from the last one
+		ms = g.lastMs
+		g.seq++
+		if g.seq > 0xfff {
+			ms++
+			g.seq = 0
+		}
+	} else {
+		g.seq = uint16(b[6]&0x07)<<8 | uint16(b[7])
+	}
+	g.lastMs = ms
+	counter := g.seq
+	g.mu.Unlock()
+
+	b[0] = byte(ms >> 40)
+	b[1] = byte(ms >> 32)
+	b[2] = byte(ms >> 24)
+	b[3] = byte(ms >> 16)
+	b[4] = byte(ms >> 8)
+	b[5] = byte(ms)
+	b[6] = 0x70 | byte(counter>>8)
+	b[7] = byte(counter)
+	b[8] = b[8]&0x3f | 0x80
+
+	return formatUUID(b), nil
+}
+
+func (g *UUIDv7) ParseID(s string) (repository.ID, error) {
+	if len(s) != 36 || s[8] != '-' || s[13] != '-' || s[18] != '-' || s[23] != '-' {
+		return "", ErrInvalidID
+	}
+
+	var b [16]byte
+	if _, err := hex.Decode(b[:], []byte(strings.ReplaceAll(s, "-", ""))); err != nil {
+		return "", ErrInvalidID
+	}
+	if b[6]>>4 != 7 || b[8]>>6 != 2 {
+		return "", ErrInvalidID
+	}
+
+	return repository.ID(formatUUID(b)), nil
+}
+
+// formatUUID returns the canonical lowercase text form of a UUID
+func formatUUID(b [16]byte) string {
+	var buf [36]byte
+	hex.Encode(buf[0:8], b[0:4])
+	buf[8] = '-'
+	hex.Encode(buf[9:13], b[4:6])
+	buf[13] = '-'
+	hex.Encode(buf[14:18], b[6:8])
+	buf[18] = '-'
+	hex.Encode(buf[19:23], b[8:10])
+	buf[23] = '-'
+	hex.Encode(buf[24:], b[10:])
+	return string(buf[:])
+}
@@ -1,8 +1,193 @@
 package repository
 
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"math/big"
+	"strconv"
+	"zabbixhw/pkg/repository/dberr"
+)
+
+// ID identifies a record. Sequential IDs use their decimal form
+type ID string
+
 type DatabaseRepo interface {
 	CreateRecord(data map[string]interface{}) error
-	ReadRecord(id uint32) (map[string]interface{}, error)
-	UpdateRecord(id uint32, data map[string]interface{}) error
-	DeleteRecord(id uint32) error
+	ReadRecord(id ID) (map[string]interface{}, error)
+	UpdateRecord(id ID, data map[string]interface{}) error
+	DeleteRecord(id ID) error
+}
+
+// DatabaseRepoV2 is DatabaseRepo with a context on every call. Implementations
+// stop waiting for locks or flushes and return the context error once the
+// context is done
+type DatabaseRepoV2 interface {
+	CreateRecord(ctx context.Context, data map[string]interface{}) error
+	ReadRecord(ctx context.Context, id ID) (map[string]interface{}, error)
+	UpdateRecord(ctx context.Context, id ID, data map[string]interface{}) error
+	DeleteRecord(ctx context.Context, id ID) error
+}
+
+// ChangeOp names the kind of a Change
+type ChangeOp string
+
+// Kinds of changes
+const (
+	OpCreate ChangeOp = "create"
+	OpUpdate ChangeOp = "update"
+	OpDelete ChangeOp = "delete"
+)
+
+// Change is a mutation made on one instance, to be replayed on another.
+// Record holds the stored record, ID included, for creates and updates
+type Change struct {
+	Op     ChangeOp               `json:"op"`
+	ID     ID                     `json:"id"`
+	Record map[string]interface{} `json:"record,omitempty"`
+}
+
+// WithContext adapts a DatabaseRepo to DatabaseRepoV2. The wrapped repository
+// cannot be interrupted, so the context is only checked before each call
+func WithContext(repo DatabaseRepo) DatabaseRepoV2 {
+	return contextAdapter{repo: repo}
+}
+
+// WithoutContext adapts a DatabaseRepoV2 for callers of the old interface.
+// Every call runs with context.Background
+func WithoutContext(repo DatabaseRepoV2) DatabaseRepo {
+	return backgroundAdapter{repo: repo}
+}
+
+type contextAdapter struct {
+	repo DatabaseRepo
+}
+
+func (a contextAdapter) CreateRecord(ctx context.Context, data map[string]interface{}) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return a.repo.CreateRecord(data)
+}
+
+func (a contextAdapter) ReadRecord(ctx context.Context, id ID) (map[string]interface{}, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return a.repo.ReadRecord(id)
+}
+
+func (a contextAdapter) UpdateRecord(ctx context.Context, id ID, data map[string]interface{}) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return a.repo.UpdateRecord(id, data)
+}
+
+func (a contextAdapter) DeleteRecord(ctx context.Context, id ID) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return a.repo.DeleteRecord(id)
+}
+
+type backgroundAdapter struct {
+	repo DatabaseRepoV2
+}
+
+func (a backgroundAdapter) CreateRecord(data map[string]interface{}) error {
+	return a.repo.CreateRecord(context.Background(), data)
+}
+
+func (a backgroundAdapter) ReadRecord(id ID) (map[string]interface{}, error) {
+	return a.repo.ReadRecord(context.Background(), id)
+}
+
+func (a backgroundAdapter) UpdateRecord(id ID, data map[string]interface{}) error {
+	return a.repo.UpdateRecord(context.Background(), id, data)
+}
+
+func (a backgroundAdapter) DeleteRecord(id ID) error {
+	return a.repo.DeleteRecord(context.Background(), id)
+}
+
+// FormatID converts the value stored in a record's "id" field into an ID.
+// It reports false if the value cannot be an ID
+func FormatID(v interface{}) (ID, bool) {
+	switch id := v.(type) {
+	case string:
+		return ID(id), id != ""
+	case json.Number:
+		// Accept any exact integer spelling such as 5, 5.0 or 5e0
+		n, ok := new(big.Rat).SetString(string(id))
+		if !ok || !n.IsInt() || n.Sign() < 0 || !n.Num().IsUint64() {
+			return "", false
+		}
+		return ID(strconv.FormatUint(n.Num().Uint64(), 10)), true
+	case float64:
+		if id < 0 || id != math.Trunc(id) || id > math.MaxUint64 {
+			return "", false
+		}
+		return ID(strconv.FormatUint(uint64(id), 10)), true
+	case uint32:
+		return ID(strconv.FormatUint(uint64(id), 10)), true
+	case uint64:
+		return ID(strconv.FormatUint(id, 10)), true
+	case int:
+		if id < 0 {
+			return "", false
+		}
+		return ID(strconv.Itoa(id)), true
+	default:
+		return "", false
+	}
+}
+
+// ApplyChanges returns records and seq with changes replayed on them, in
+// order. Creates append their record and advance seq like a create on the
+// original instance did, so both go on issuing the same IDs. records is left
+// unchanged
+func ApplyChanges(records []map[string]interface{}, seq uint64, changes []Change) ([]map[string]interface{}, uint64, error) {
+	records = append([]map[string]interface{}(nil), records...)
+	for _, change := range changes {
+		if change.Op != OpDelete {
+			if id, ok := FormatID(change.Record["id"]); !ok || id != change.ID {
+				return nil, 0, dberr.Validation("%s of %s: the record has ID %v", change.Op, change.ID, change.Record["id"])
+			}
+		}
+
+		i := indexOf(records, change.ID)
+		switch change.Op {
+		case OpCreate:
+			if i >= 0 {
+				return nil, 0, dberr.Conflict("create of %s: the record exists", change.ID)
+			}
+			records = append(records, change.Record)
+			seq++
+		case OpUpdate, OpDelete:
+			if i < 0 {
+				return nil, 0, fmt.Errorf("%w: %s of %s", dberr.ErrNotFound, change.Op, change.ID)
+			}
+			if change.Op == OpUpdate {
+				records[i] = change.Record
+			} else {
+				records = append(records[:i], records[i+1:]...)
+			}
+		default:
+			return nil, 0, dberr.Validation("unknown change %q", change.Op)
+		}
+	}
+	return records, seq, nil
+}
+
+// indexOf returns the position of the record with the given ID, -1 if there
+// is none
+func indexOf(records []map[string]interface{}, id ID) int {
+	for i, record := range records {
+		if recordID, ok := FormatID(record["id"]); ok && recordID == id {
+			return i
+		}
+	}
+	return -1
 }
@@ -0,0 +1,183 @@
+package repository
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+	"zabbixhw/pkg/repository/dberr"
+)
+
+func Test_FormatID(t *testing.T) {
+	tests := []struct {
+		name     string
+		value    interface{}
+		expected ID
+		ok       bool
+	}{
+		{name: "Number", value: json.Number("12"), expected: "12", ok: true},
+		{name: "Large number", value: json.Number("18446744073709551615"), expected: "18446744073709551615", ok: true},
+		{name: "Number with exponent", value: json.Number("1.2e1"), expected: "12", ok: true},
+		{name: "Number beyond uint64", value: json.Number("18446744073709551616"), ok: false},
+		{name: "Fractional number", value: json.Number("12.5"), ok: false},
+		{name: "Negative number", value: json.Number("-3"), ok: false},
+		{name: "Float", value: float64(12), expected: "12", ok: true},
+		{name: "Fractional float", value: 1.5, ok: false},
+		{name: "Negative float", value: float64(-1), ok: false},
+		{name: "Uint32", value: uint32(7), expected: "7", ok: true},
+		{name: "Uint64", value: uint64(1) << 60, expected: "1152921504606846976", ok: true},
+		{name: "String", value: "01ARYZ6S41TSV4RRFFQ69G5FAV", expected: "01ARYZ6S41TSV4RRFFQ69G5FAV", ok: true},
+		{name: "Empty string", value: "", ok: false},
+		{name: "Missing", value: nil, ok: false},
+		{name: "Bool", value: true, ok: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			id, ok := FormatID(tt.value)
+			if ok != tt.ok {
+				t.Fatalf("expected ok %v, got %v", tt.ok, ok)
+			}
+			if id != tt.expected {
+				t.Errorf("expected %q, got %q", tt.expected, id)
+			}
+		})
+	}
+}
+
+// countingRepo is a minimal DatabaseRepo that counts the calls it receives
+type countingRepo struct {
+	calls int
+}
+
+func (r *countingRepo) CreateRecord(data map[string]interface{}) error {
+	r.calls++
+	return nil
+}
+
+func (r *countingRepo) ReadRecord(id ID) (map[string]interface{}, error) {
+	r.calls++
+	return map[string]interface{}{"id": string(id)}, nil
+}
+
+func (r *countingRepo) UpdateRecord(id ID, data map[string]interface{}) error {
+	r.calls++
+	return nil
+}
+
+func (r *countingRepo) DeleteRecord(id ID) error {
+	r.calls++
+	return nil
+}
+
+func Test_WithContext(t *testing.T) {
+	inner := &countingRepo{}
+	repo := WithContext(inner)
+
+	record, err := repo.ReadRecord(context.Background(), "7")
+	if err != nil || record["id"] != "7" {
+		t.Fatalf("expected record 7, got %v (%v)", record, err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if err := repo.CreateRecord(ctx, map[string]interface{}{}); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected %v, got %v", context.Canceled, err)
+	}
+	if _, err := repo.ReadRecord(ctx, "1"); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected %v, got %v", context.Canceled, err)
+	}
+	if err := repo.UpdateRecord(ctx, "1", map[string]interface{}{}); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected %v, got %v", context.Canceled, err)
+	}
+	if err := repo.DeleteRecord(ctx, "1"); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected %v, got %v", context.Canceled, err)
+	}
+
+	if inner.calls != 1 {
+		t.Errorf("expected the cancelled calls not to reach the repository, got %d calls", inner.calls)
+	}
+}
+
+func Test_WithoutContext(t *testing.T) {
+	inner := &countingRepo{}
+	repo := WithoutContext(WithContext(inner))
+
+	if err := repo.CreateRecord(map[string]interface{}{}); err != nil {
+		t.Fatalf("CreateRecord failed: %v", err)
+	}
+	if _, err := repo.ReadRecord("1"); err != nil {
+		t.Fatalf("ReadRecord failed: %v", err)
+	}
+	if err := repo.UpdateRecord("1", map[string]interface{}{}); err != nil {
+		t.Fatalf("UpdateRecord failed: %v", err)
+	}
+	if err := repo.DeleteRecord("1"); err != nil {
+		t.Fatalf("DeleteRecord failed: %v", err)
+	}
+
+	if inner.calls != 4 {
+		t.Errorf("expected 4 calls, got %d", inner.calls)
+	}
+}
+
+func Test_ApplyChanges(t *testing.T) {
+	records := []map[string]interface{}{
+		{"id": uint32(1), "host": "a"},
+		{"id": json.Number("2"), "host": "b"},
+	}
+
+	tests := []struct {
+		name     string
+		changes  []Change
+		expected []string // Hosts left, in order
+		seq      uint64
+		err      error
+	}{
+		{
+			name: "Replayed in order",
+			changes: []Change{
+				{Op: OpCreate, ID: "3", Record: map[string]interface{}{"id": json.Number("3"), "host": "c"}},
+				{Op: OpUpdate, ID: "1", Record: map[string]interface{}{"id": json.Number("1"), "host": "A"}},
+				{Op: OpDelete, ID: "2"},
+			},
+			expected: []string{"A", "c"},
+			seq:      3,
+		},
+		{name: "No changes", expected: []string{"a", "b"}, seq: 2},
+		{name: "Create of an existing record", changes: []Change{{Op: OpCreate, ID: "2", Record: map[string]interface{}{"id": "2"}}}, err: dberr.ErrConflict},
+		{name: "Update of a missing record", changes: []Change{{Op: OpUpdate, ID: "9", Record: map[string]interface{}{"id": "9"}}}, err: dberr.ErrNotFound},
+		{name: "Delete of a missing record", changes: []Change{{Op: OpDelete, ID: "9"}}, err: dberr.ErrNotFound},
+		{name: "Record of another ID", changes: []Change{{Op: OpUpdate, ID: "1", Record: map[string]interface{}{"id": "2"}}}, err: dberr.ErrValidation},
+		{name: "Unknown change", changes: []Change{{Op: "merge", ID: "1", Record: map[string]interface{}{"id": "1"}}}, err: dberr.ErrValidation},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, seq, err := ApplyChanges(records, 2, tt.changes)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("expected %v, got %v", tt.err, err)
+			}
+			if len(records) != 2 || records[0]["host"] != "a" {
+				t.Errorf("the records passed in changed: %v", records)
+			}
+			if err != nil {
+				return
+			}
+
+			var hosts []string
+			for _, record := range result {
+				hosts = append(hosts, record["host"].(string))
+			}
+			if len(hosts) != len(tt.expected) || seq != tt.seq {
+				t.Fatalf("expected %v at seq %d, got %v at seq %d", tt.expected, tt.seq, hosts, seq)
+			}
+			for i := range hosts {
+				if hosts[i] != tt.expected[i] {
+					t.Errorf("expected %v, got %v", tt.expected, hosts)
+				}
+			}
+		})
+	}
+}
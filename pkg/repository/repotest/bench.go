@@ -0,0 +1,190 @@
+package repotest
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"math/rand"
+	"os"
+	"strconv"
+	"testing"
+	"zabbixhw/pkg/repository"
+	"zabbixhw/pkg/repository/dbfile"
+	"zabbixhw/pkg/repository/idgen"
+)
+
+// BenchOpener opens a store holding exactly records, whose IDs run from 1 to
+// len(records) as json.Number, and returns a function releasing it
+type BenchOpener func(b *testing.B, records []map[string]interface{}) (repo repository.DatabaseRepoV2, release func())
+
+// benchSizes are the numbers of records a store holds when a benchmark starts
+var benchSizes = []int{100, 1000, 10000}
+
+// benchShape describes the records of a benchmark
+type benchShape struct {
+	name   string
+	fields int // Top-level string fields
+	strlen int // Length of every string value
+}
+
+var benchShapes = []benchShape{
+	{name: "small", fields: 4, strlen: 8},
+	{name: "large", fields: 32, strlen: 64},
+}
+
+// Bench benchmarks every method of the engine opened by open, for every
+// dataset size and record shape. Records are shallow copies of one template
+// per shape, so building them costs next to nothing
+func Bench(b *testing.B, open BenchOpener) {
+	methods := []struct {
+		name string
+		fn   func(b *testing.B, repo repository.DatabaseRepoV2, size int, template map[string]interface{})
+	}{
+		{"Create", benchCreate},
+		{"Read", benchRead},
+		{"Update", benchUpdate},
+		{"Delete", benchDelete},
+		{"ReadParallel", benchReadParallel},
+		{"MixedParallel", benchMixedParallel},
+	}
+
+	for _, method := range methods {
+		b.Run(method.name, func(b *testing.B) {
+			for _, size := range benchSizes {
+				for _, shape := range benchShapes {
+					b.Run(fmt.Sprintf("records=%d/shape=%s", size, shape.name), func(b *testing.B) {
+						template := benchTemplate(shape)
+						repo, release := open(b, benchRecords(size, template))
+						defer release()
+
+						b.ReportAllocs()
+						b.ResetTimer()
+						method.fn(b, repo, size, template)
+					})
+				}
+			}
+		})
+	}
+}
+
+// SeedFile writes records to path in the database file format, with the
+// sequence set to the number of records
+func SeedFile(tb testing.TB, path string, records []map[string]interface{}) {
+	tb.Helper()
+
+	var buf bytes.Buffer
+	snap := &dbfile.Snapshot{
+		Header:  dbfile.Header{Seq: uint64(len(records)), IDStrategy: idgen.NameSequential},
+		Records: records,
+	}
+	if err := dbfile.Encode(&buf, snap); err != nil {
+		tb.Fatalf("Failed to encode records: %v", err)
+	}
+	if err := os.WriteFile(path, buf.Bytes(), 0644); err != nil {
+		tb.Fatalf("Failed to write file: %v", err)
+	}
+}
+
+// benchTemplate builds the record every benchmark operation copies
+func benchTemplate(shape benchShape) map[string]interface{} {
+	rng := rand.New(rand.NewSource(1))
+	template := make(map[string]interface{}, shape.fields)
+	for i := 0; i < shape.fields; i++ {
+		value := make([]byte, shape.strlen)
+		for j := range value {
+			value[j] = byte('a' + rng.Intn(26))
+		}
+		template["field"+strconv.Itoa(i)] = string(value)
+	}
+	return template
+}
+
+// benchRecords builds the initial content of a store
+func benchRecords(size int, template map[string]interface{}) []map[string]interface{} {
+	records := make([]map[string]interface{}, size)
+	for i := range records {
+		records[i] = maps.Clone(template)
+		records[i]["id"] = json.Number(strconv.Itoa(i + 1))
+	}
+	return records
+}
+
+func benchCreate(b *testing.B, repo repository.DatabaseRepoV2, size int, template map[string]interface{}) {
+	for i := 0; i < b.N; i++ {
+		if err := repo.CreateRecord(context.Background(), maps.Clone(template)); err != nil {
+			b.Fatalf("CreateRecord failed: %v", err)
+		}
+	}
+}
+
+func benchRead(b *testing.B, repo repository.DatabaseRepoV2, size int, template map[string]interface{}) {
+	rng := rand.New(rand.NewSource(1))
+	for i := 0; i < b.N; i++ {
+		id := repository.ID(strconv.Itoa(rng.Intn(size) + 1))
+		if _, err := repo.ReadRecord(context.Background(), id); err != nil {
+			b.Fatalf("ReadRecord failed: %v", err)
+		}
+	}
+}
+
+func benchUpdate(b *testing.B, repo repository.DatabaseRepoV2, size int, template map[string]interface{}) {
+	rng := rand.New(rand.NewSource(1))
+	for i := 0; i < b.N; i++ {
+		id := repository.ID(strconv.Itoa(rng.Intn(size) + 1))
+		if err := repo.UpdateRecord(context.Background(), id, maps.Clone(template)); err != nil {
+			b.Fatalf("UpdateRecord failed: %v", err)
+		}
+	}
+}
+
+// benchDelete creates the record it deletes with the timer stopped, so the
+// store keeps its size
+func benchDelete(b *testing.B, repo repository.DatabaseRepoV2, size int, template map[string]interface{}) {
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		record := maps.Clone(template)
+		if err := repo.CreateRecord(context.Background(), record); err != nil {
+			b.Fatalf("CreateRecord failed: %v", err)
+		}
+		id, _ := repository.FormatID(record["id"])
+		b.StartTimer()
+
+		if err := repo.DeleteRecord(context.Background(), id); err != nil {
+			b.Fatalf("DeleteRecord failed: %v", err)
+		}
+	}
+}
+
+func benchReadParallel(b *testing.B, repo repository.DatabaseRepoV2, size int, template map[string]interface{}) {
+	b.RunParallel(func(pb *testing.PB) {
+		rng := rand.New(rand.NewSource(rand.Int63()))
+		for pb.Next() {
+			id := repository.ID(strconv.Itoa(rng.Intn(size) + 1))
+			if _, err := repo.ReadRecord(context.Background(), id); err != nil {
+				b.Errorf("ReadRecord failed: %v", err)
+				return
+			}
+		}
+	})
+}
+
+// benchMixedParallel runs four reads for every update
+func benchMixedParallel(b *testing.B, repo repository.DatabaseRepoV2, size int, template map[string]interface{}) {
+	b.RunParallel(func(pb *testing.PB) {
+		rng := rand.New(rand.NewSource(rand.Int63()))
+		for pb.Next() {
+			id := repository.ID(strconv.Itoa(rng.Intn(size) + 1))
+			if rng.Intn(5) == 0 {
+				if err := repo.UpdateRecord(context.Background(), id, maps.Clone(template)); err != nil {
+					b.Errorf("UpdateRecord failed: %v", err)
+					return
+				}
+			} else if _, err := repo.ReadRecord(context.Background(), id); err != nil {
+				b.Errorf("ReadRecord failed: %v", err)
+				return
+			}
+		}
+	})
+}
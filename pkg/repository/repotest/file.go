@@ -0,0 +1,633 @@
+package repotest
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"zabbixhw/pkg/fsys"
+	"zabbixhw/pkg/repository"
+	"zabbixhw/pkg/repository/dberr"
+	"zabbixhw/pkg/repository/dbfile"
+	"zabbixhw/pkg/repository/idgen"
+)
+
+// FileEngine is an engine keeping its records in a database file
+type FileEngine interface {
+	repository.DatabaseRepoV2
+	Integrity() dbfile.IntegrityReport
+	Quarantined() []dbfile.Quarantined
+	Scrub(ctx context.Context) (dbfile.IntegrityReport, error)
+	dbfile.Rekeyer
+	Close() error
+}
+
+// FileOptions are the settings the file suite opens a database with, zero
+// fields leave the default of the engine
+type FileOptions struct {
+	FS          fsys.FS
+	ReadOnly    bool
+	Policy      dbfile.Policy
+	Format      dbfile.Format
+	Compression dbfile.Compression
+	Level       int
+	Keys        *dbfile.Keyring
+}
+
+// FileOpener opens the database file at path with opts
+type FileOpener func(path string, opts FileOptions) (FileEngine, error)
+
+// RunFile executes the file suite against the engine opened by open:
+// checksums and verify policies, format upgrades, layouts, compression,
+// encryption and rekeying
+func RunFile(t *testing.T, open FileOpener) {
+	tests := []struct {
+		name string
+		fn   func(t *testing.T, open FileOpener)
+	}{
+		{"VerifyPolicy", testVerifyPolicy},
+		{"Scrub", testScrub},
+		{"FormatUpgrade", testFormatUpgrade},
+		{"NDJSON", testNDJSON},
+		{"NDJSONBadLines", testNDJSONBadLines},
+		{"Msgpack", testMsgpack},
+		{"Compression", testCompression},
+		{"Encryption", testEncryption},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.fn(t, open)
+		})
+	}
+}
+
+// sealedFile returns the content of a checksummed file with three records,
+// intact and with the second one damaged
+func sealedFile(t *testing.T) (intact, damaged []byte) {
+	t.Helper()
+
+	snap := &dbfile.Snapshot{
+		Header: dbfile.Header{Seq: 3, IDStrategy: idgen.NameSequential},
+		Records: []map[string]interface{}{
+			{"id": json.Number("1"), "name": "Alice"},
+			{"id": json.Number("2"), "name": "Bob"},
+			{"id": json.Number("3"), "name": "Carol"},
+		},
+	}
+	var buf bytes.Buffer
+	if err := dbfile.Encode(&buf, snap); err != nil {
+		t.Fatalf("Encode failed: %v", err)
+	}
+	return buf.Bytes(), bytes.Replace(buf.Bytes(), []byte(`"Bob"`), []byte(`"Bnb"`), 1)
+}
+
+func testVerifyPolicy(t *testing.T, open FileOpener) {
+	_, damaged := sealedFile(t)
+
+	t.Run("Fail", func(t *testing.T) {
+		mem := fsys.NewMemFS()
+		mem.WriteFile("db.json", damaged)
+		if _, err := open("db.json", FileOptions{FS: mem}); !errors.Is(err, dbfile.ErrChecksum) {
+			t.Fatalf("expected %v, got %v", dbfile.ErrChecksum, err)
+		}
+
+		// A refused file must not stay locked
+		db, err := open("db.json", FileOptions{FS: mem, Policy: dbfile.PolicyWarn})
+		if err != nil {
+			t.Fatalf("Open after a refused open failed: %v", err)
+		}
+		db.Close()
+	})
+
+	t.Run("Quarantine", func(t *testing.T) {
+		mem := fsys.NewMemFS()
+		mem.WriteFile("db.json", damaged)
+		db, err := open("db.json", FileOptions{FS: mem, Policy: dbfile.PolicyQuarantine})
+		if err != nil {
+			t.Fatalf("Open failed: %v", err)
+		}
+
+		if report := db.Integrity(); !reflect.DeepEqual(report.BadRecords, []int{1}) {
+			t.Errorf("expected record 1 to be bad, got %v", report)
+		}
+		if _, err := db.ReadRecord(context.Background(), "2"); !errors.Is(err, dberr.ErrNotFound) {
+			t.Errorf("expected %v for the quarantined record, got %v", dberr.ErrNotFound, err)
+		}
+		if q := db.Quarantined(); len(q) != 1 || q[0].Record["name"] != "Bnb" {
+			t.Errorf("unexpected quarantine %v", q)
+		}
+		if content, err := mem.ReadFile(dbfile.QuarantinePath("db.json")); err != nil || !bytes.Contains(content, []byte(`"Bnb"`)) {
+			t.Errorf("expected the record in the quarantine file, got %s (%v)", content, err)
+		}
+		if err := db.Close(); err != nil {
+			t.Fatalf("Close failed: %v", err)
+		}
+
+		// The file was rewritten without the record and opens cleanly
+		db, err = open("db.json", FileOptions{FS: mem})
+		if err != nil {
+			t.Fatalf("reopen failed: %v", err)
+		}
+		defer db.Close()
+		if report := db.Integrity(); !report.Checked || !report.OK() || report.Records != 2 {
+			t.Errorf("expected 2 intact records, got %v", report)
+		}
+	})
+
+	t.Run("Quarantine read-only", func(t *testing.T) {
+		mem := fsys.NewMemFS()
+		mem.WriteFile("db.json", damaged)
+		db, err := open("db.json", FileOptions{FS: mem, ReadOnly: true, Policy: dbfile.PolicyQuarantine})
+		if err != nil {
+			t.Fatalf("Open failed: %v", err)
+		}
+		defer db.Close()
+
+		if _, err := mem.ReadFile(dbfile.QuarantinePath("db.json")); err == nil {
+			t.Errorf("expected no quarantine file for a read-only database")
+		}
+		if content, _ := mem.ReadFile("db.json"); !bytes.Equal(content, damaged) {
+			t.Errorf("expected the file to stay untouched, got %s", content)
+		}
+	})
+
+	t.Run("Warn", func(t *testing.T) {
+		mem := fsys.NewMemFS()
+		mem.WriteFile("db.json", damaged)
+		db, err := open("db.json", FileOptions{FS: mem, Policy: dbfile.PolicyWarn})
+		if err != nil {
+			t.Fatalf("Open failed: %v", err)
+		}
+		defer db.Close()
+
+		if db.Integrity().OK() {
+			t.Errorf("expected a failed report, got %v", db.Integrity())
+		}
+		if record, err := db.ReadRecord(context.Background(), "2"); err != nil || record["name"] != "Bnb" {
+			t.Errorf("expected the damaged record to be served, got %v (%v)", record, err)
+		}
+	})
+}
+
+func testScrub(t *testing.T, open FileOpener) {
+	intact, damaged := sealedFile(t)
+	mem := fsys.NewMemFS()
+	mem.WriteFile("db.json", intact)
+
+	db, err := open("db.json", FileOptions{FS: mem})
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+
+	if report, err := db.Scrub(context.Background()); err != nil || !report.OK() || !report.Checked {
+		t.Fatalf("expected an intact file, got %v (%v)", report, err)
+	}
+
+	// Damage the file behind the database's back
+	file, _ := mem.OpenFile("db.json", os.O_RDWR, 0644)
+	file.Write(damaged)
+	file.Close()
+
+	report, err := db.Scrub(context.Background())
+	if err != nil {
+		t.Fatalf("Scrub failed: %v", err)
+	}
+	if !reflect.DeepEqual(report.BadRecords, []int{1}) {
+		t.Errorf("expected record 1 to be bad, got %v", report)
+	}
+
+	// Once written, the records held in memory are sealed again
+	if err := db.CreateRecord(context.Background(), map[string]interface{}{"name": "Dave"}); err != nil {
+		t.Fatalf("CreateRecord failed: %v", err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	db, err = open("db.json", FileOptions{FS: mem})
+	if err != nil {
+		t.Fatalf("reopen failed: %v", err)
+	}
+	defer db.Close()
+	if report, err := db.Scrub(context.Background()); err != nil || !report.OK() {
+		t.Errorf("expected an intact file after the write, got %v (%v)", report, err)
+	}
+}
+
+func testFormatUpgrade(t *testing.T, open FileOpener) {
+	tests := []struct {
+		name    string
+		content string
+		backup  string
+	}{
+		{name: "Legacy bare array", content: `[{"id":1,"name":"Alice"}]`, backup: "db.json.v0.bak"},
+		{name: "Header without version", content: `{"header":{"seq":3},"records":[{"id":1,"name":"Alice"}]}`, backup: "db.json.v1.bak"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mem := fsys.NewMemFS()
+			mem.WriteFile("db.json", []byte(tt.content))
+
+			db, err := open("db.json", FileOptions{FS: mem})
+			if err != nil {
+				t.Fatalf("Open failed: %v", err)
+			}
+			if err := db.Close(); err != nil {
+				t.Fatalf("Close failed: %v", err)
+			}
+
+			if content, err := mem.ReadFile(tt.backup); err != nil || string(content) != tt.content {
+				t.Errorf("expected the backup to hold %s, got %s (%v)", tt.content, content, err)
+			}
+			content, _ := mem.ReadFile("db.json")
+			snap, err := dbfile.Decode(content)
+			if err != nil {
+				t.Fatalf("Decode failed: %v", err)
+			}
+			if snap.Header.Version != dbfile.CurrentVersion || snap.Header.IDStrategy != idgen.NameSequential {
+				t.Errorf("expected a sequential file of version %d, got %+v", dbfile.CurrentVersion, snap.Header)
+			}
+			if snap.Header.Meta[dbfile.MetaUpgradedFrom] == "" || snap.Checksums == nil {
+				t.Errorf("expected a sealed file recording the upgrade, got %s", content)
+			}
+
+			// Metadata survives later writes
+			db, err = open("db.json", FileOptions{FS: mem})
+			if err != nil {
+				t.Fatalf("reopen failed: %v", err)
+			}
+			if err := db.CreateRecord(context.Background(), map[string]interface{}{"name": "Bob"}); err != nil {
+				t.Fatalf("CreateRecord failed: %v", err)
+			}
+			if err := db.Close(); err != nil {
+				t.Fatalf("Close failed: %v", err)
+			}
+			content, _ = mem.ReadFile("db.json")
+			if snap, _ := dbfile.Decode(content); snap == nil || snap.Header.Meta[dbfile.MetaUpgradedFrom] == "" || len(snap.Records) != 2 {
+				t.Errorf("expected 2 records and the metadata kept, got %s", content)
+			}
+		})
+	}
+
+	t.Run("Read-only", func(t *testing.T) {
+		const legacy = `[{"id":1,"name":"Alice"}]`
+		mem := fsys.NewMemFS()
+		mem.WriteFile("db.json", []byte(legacy))
+
+		db, err := open("db.json", FileOptions{FS: mem, ReadOnly: true})
+		if err != nil {
+			t.Fatalf("Open failed: %v", err)
+		}
+		defer db.Close()
+
+		if content, _ := mem.ReadFile("db.json"); string(content) != legacy {
+			t.Errorf("expected the file to stay untouched, got %s", content)
+		}
+		if _, err := mem.ReadFile("db.json.v0.bak"); err == nil {
+			t.Error("expected no backup for a read-only database")
+		}
+	})
+
+	t.Run("Newer version", func(t *testing.T) {
+		mem := fsys.NewMemFS()
+		mem.WriteFile("db.json", []byte(`{"header":{"version":99,"seq":1},"pages":[]}`))
+
+		if _, err := open("db.json", FileOptions{FS: mem}); !errors.Is(err, dbfile.ErrNewerVersion) {
+			t.Fatalf("expected %v, got %v", dbfile.ErrNewerVersion, err)
+		}
+		if content, _ := mem.ReadFile("db.json"); string(content) != `{"header":{"version":99,"seq":1},"pages":[]}` {
+			t.Errorf("expected the file to stay untouched, got %s", content)
+		}
+	})
+}
+
+// ndjsonLines returns the content of an NDJSON file with three records
+func ndjsonLines(t *testing.T) string {
+	t.Helper()
+
+	var buf bytes.Buffer
+	err := dbfile.EncodeNDJSON(&buf, &dbfile.Snapshot{
+		Header: dbfile.Header{Seq: 3, IDStrategy: idgen.NameSequential},
+		Records: []map[string]interface{}{
+			{"id": json.Number("1"), "name": "Alice"},
+			{"id": json.Number("2"), "name": "Bob"},
+			{"id": json.Number("3"), "name": "Carol"},
+		},
+	})
+	if err != nil {
+		t.Fatalf("EncodeNDJSON failed: %v", err)
+	}
+	return buf.String()
+}
+
+// expectFormat checks the layout of the file at path
+func expectFormat(t *testing.T, mem *fsys.MemFS, path string, expected dbfile.Format) {
+	t.Helper()
+
+	content, _ := mem.ReadFile(path)
+	if format := dbfile.DetectFormat(content); format != expected {
+		t.Errorf("expected a %s file, got %s", expected, content)
+	}
+}
+
+func testNDJSON(t *testing.T, open FileOpener) {
+	t.Run("Format is kept", func(t *testing.T) {
+		mem := fsys.NewMemFS()
+		mem.WriteFile("db.json", []byte(ndjsonLines(t)))
+
+		db, err := open("db.json", FileOptions{FS: mem})
+		if err != nil {
+			t.Fatalf("Open failed: %v", err)
+		}
+		if err := db.CreateRecord(context.Background(), map[string]interface{}{"name": "Dave"}); err != nil {
+			t.Fatalf("CreateRecord failed: %v", err)
+		}
+		if err := db.Close(); err != nil {
+			t.Fatalf("Close failed: %v", err)
+		}
+
+		expectFormat(t, mem, "db.json", dbfile.FormatNDJSON)
+		content, _ := mem.ReadFile("db.json")
+		if lines := bytes.Count(content, []byte("\n")); lines != 6 {
+			t.Errorf("expected 6 lines, got %d:\n%s", lines, content)
+		}
+	})
+
+	t.Run("Snapshot converted", func(t *testing.T) {
+		intact, _ := sealedFile(t)
+		mem := fsys.NewMemFS()
+		mem.WriteFile("db.json", intact)
+
+		db, err := open("db.json", FileOptions{FS: mem, Format: dbfile.FormatNDJSON})
+		if err != nil {
+			t.Fatalf("Open failed: %v", err)
+		}
+		if err := db.DeleteRecord(context.Background(), "3"); err != nil {
+			t.Fatalf("DeleteRecord failed: %v", err)
+		}
+		if err := db.Close(); err != nil {
+			t.Fatalf("Close failed: %v", err)
+		}
+		expectFormat(t, mem, "db.json", dbfile.FormatNDJSON)
+	})
+
+	t.Run("Unsupported format", func(t *testing.T) {
+		mem := fsys.NewMemFS()
+		if _, err := open("db.json", FileOptions{FS: mem, Format: dbfile.FormatLegacy}); err == nil {
+			t.Error("expected an error for the legacy format")
+		}
+	})
+}
+
+func testNDJSONBadLines(t *testing.T, open FileOpener) {
+	lines := strings.Split(ndjsonLines(t), "\n")
+	lines[2] = `{"id":2,"na`
+	damaged := strings.Join(lines, "\n")
+
+	t.Run("Fail", func(t *testing.T) {
+		mem := fsys.NewMemFS()
+		mem.WriteFile("db.json", []byte(damaged))
+
+		var lineErr *dbfile.LineError
+		if _, err := open("db.json", FileOptions{FS: mem}); !errors.As(err, &lineErr) || lineErr.Line != 3 {
+			t.Fatalf("expected an error for line 3, got %v", err)
+		}
+	})
+
+	for _, policy := range []dbfile.Policy{dbfile.PolicyQuarantine, dbfile.PolicyWarn} {
+		t.Run(string(policy), func(t *testing.T) {
+			mem := fsys.NewMemFS()
+			mem.WriteFile("db.json", []byte(damaged))
+
+			db, err := open("db.json", FileOptions{FS: mem, Policy: policy})
+			if err != nil {
+				t.Fatalf("Open failed: %v", err)
+			}
+			if report := db.Integrity(); !reflect.DeepEqual(report.BadLines, []int{3}) || len(report.BadRecords) != 0 {
+				t.Errorf("expected only line 3 to be bad, got %v", report)
+			}
+			for id, expected := range map[repository.ID]error{"1": nil, "2": dberr.ErrNotFound, "3": nil} {
+				if _, err := db.ReadRecord(context.Background(), id); !errors.Is(err, expected) {
+					t.Errorf("record %s: expected %v, got %v", id, expected, err)
+				}
+			}
+			if err := db.Close(); err != nil {
+				t.Fatalf("Close failed: %v", err)
+			}
+
+			// The line is kept aside and the rest is written back intact
+			if content, err := mem.ReadFile(dbfile.QuarantinePath("db.json")); err != nil || !bytes.Contains(content, []byte(`"line":3`)) {
+				t.Errorf("expected line 3 in the quarantine file, got %s (%v)", content, err)
+			}
+			expectFormat(t, mem, "db.json", dbfile.FormatNDJSON)
+			db, err = open("db.json", FileOptions{FS: mem})
+			if err != nil {
+				t.Fatalf("reopen failed: %v", err)
+			}
+			defer db.Close()
+			if report := db.Integrity(); !report.OK() || report.Records != 2 {
+				t.Errorf("expected 2 intact records, got %v", report)
+			}
+		})
+	}
+}
+
+func testMsgpack(t *testing.T, open FileOpener) {
+	mem := fsys.NewMemFS()
+	db, err := open("db.json", FileOptions{FS: mem, Format: dbfile.FormatMsgpack})
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	record := map[string]interface{}{
+		"int":   json.Number("2"),
+		"float": json.Number("2.0"),
+		"big":   json.Number("123456789012345678901234567890"),
+		"tags":  []interface{}{"a", nil, true},
+	}
+	if err := db.CreateRecord(context.Background(), record); err != nil {
+		t.Fatalf("CreateRecord failed: %v", err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	expectFormat(t, mem, "db.json", dbfile.FormatMsgpack)
+
+	// Reopened without the option, the file keeps its layout and numbers
+	// keep the literal they were stored with
+	db, err = open("db.json", FileOptions{FS: mem})
+	if err != nil {
+		t.Fatalf("reopen failed: %v", err)
+	}
+	defer db.Close()
+	if report := db.Integrity(); !report.Checked || !report.OK() {
+		t.Errorf("expected intact checksums, got %v", report)
+	}
+	got, err := db.ReadRecord(context.Background(), "1")
+	if err != nil {
+		t.Fatalf("ReadRecord failed: %v", err)
+	}
+	for field, expected := range map[string]json.Number{"int": "2", "float": "2.0", "big": "123456789012345678901234567890"} {
+		if got[field] != expected {
+			t.Errorf("%s: expected %q, got %#v", field, expected, got[field])
+		}
+	}
+	if err := db.DeleteRecord(context.Background(), "1"); err != nil {
+		t.Fatalf("DeleteRecord failed: %v", err)
+	}
+	expectFormat(t, mem, "db.json", dbfile.FormatMsgpack)
+}
+
+// expectCompression checks how the file at path is compressed
+func expectCompression(t *testing.T, mem *fsys.MemFS, path string, expected dbfile.Compression) {
+	t.Helper()
+
+	content, _ := mem.ReadFile(path)
+	if compression := dbfile.DetectCompression(content); compression != expected {
+		t.Errorf("expected a %s file, got %s", expected, compression)
+	}
+}
+
+func testCompression(t *testing.T, open FileOpener) {
+	mem := fsys.NewMemFS()
+	db, err := open("db.json", FileOptions{FS: mem, Compression: dbfile.CompressionGzip, Level: dbfile.BestCompression})
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	if err := db.CreateRecord(context.Background(), map[string]interface{}{"name": "Alice"}); err != nil {
+		t.Fatalf("CreateRecord failed: %v", err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	expectCompression(t, mem, "db.json", dbfile.CompressionGzip)
+
+	// Reopened without the option, the file stays compressed
+	db, err = open("db.json", FileOptions{FS: mem})
+	if err != nil {
+		t.Fatalf("reopen failed: %v", err)
+	}
+	if report := db.Integrity(); !report.Checked || !report.OK() {
+		t.Errorf("expected intact checksums, got %v", report)
+	}
+	if err := db.CreateRecord(context.Background(), map[string]interface{}{"name": "Bob"}); err != nil {
+		t.Fatalf("CreateRecord failed: %v", err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	expectCompression(t, mem, "db.json", dbfile.CompressionGzip)
+
+	// Asking for no compression writes a plain file again
+	db, err = open("db.json", FileOptions{FS: mem, Compression: dbfile.CompressionNone, Level: dbfile.DefaultLevel})
+	if err != nil {
+		t.Fatalf("reopen failed: %v", err)
+	}
+	if got, err := db.ReadRecord(context.Background(), "2"); err != nil || got["name"] != "Bob" {
+		t.Errorf("expected Bob, got %v (%v)", got, err)
+	}
+	if err := db.DeleteRecord(context.Background(), "1"); err != nil {
+		t.Fatalf("DeleteRecord failed: %v", err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	expectCompression(t, mem, "db.json", dbfile.CompressionNone)
+	expectFormat(t, mem, "db.json", dbfile.FormatSnapshot)
+
+	if _, err := open("db.json", FileOptions{FS: mem, Compression: dbfile.CompressionGzip, Level: 10}); err == nil {
+		t.Error("expected an invalid level to fail")
+	}
+}
+
+// Keyring returns a keyring of keys whose bytes are all one of keyBytes, the
+// first one primary
+func Keyring(t testing.TB, keyBytes ...byte) *dbfile.Keyring {
+	t.Helper()
+
+	keys := make([]*dbfile.Key, len(keyBytes))
+	for i, b := range keyBytes {
+		key, err := dbfile.NewKey(bytes.Repeat([]byte{b}, dbfile.KeySize))
+		if err != nil {
+			t.Fatalf("NewKey failed: %v", err)
+		}
+		keys[i] = key
+	}
+	keyring, err := dbfile.NewKeyring(keys...)
+	if err != nil {
+		t.Fatalf("NewKeyring failed: %v", err)
+	}
+	return keyring
+}
+
+// expectKey checks the ID of the key the file at path is encrypted with
+func expectKey(t *testing.T, mem *fsys.MemFS, path string, expected string) {
+	t.Helper()
+
+	content, _ := mem.ReadFile(path)
+	if id := dbfile.EncryptionKeyID(content); id != expected {
+		t.Errorf("expected the file to be encrypted with key %q, got %q", expected, id)
+	}
+	if bytes.Contains(content, []byte("Alice")) {
+		t.Error("plaintext found in the encrypted file")
+	}
+}
+
+func testEncryption(t *testing.T, open FileOpener) {
+	oldKeys, newKeys := Keyring(t, 1), Keyring(t, 2, 1)
+	mem := fsys.NewMemFS()
+	mem.WriteFile("db.json", []byte(`{"header":{"version":2,"seq":1},"records":[{"id":1,"name":"Alice"}]}`))
+
+	// A plaintext file is encrypted as soon as it is opened with a key
+	db, err := open("db.json", FileOptions{FS: mem, Keys: oldKeys})
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	expectKey(t, mem, "db.json", oldKeys.Primary().ID)
+	if info, _ := mem.Stat("db.json"); info.Mode().Perm() != 0600 {
+		t.Errorf("expected mode %v once encrypted, got %v", fs.FileMode(0600), info.Mode().Perm())
+	}
+	if err := db.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	if _, err := open("db.json", FileOptions{FS: mem}); !errors.Is(err, dbfile.ErrEncrypted) {
+		t.Errorf("expected %v without a key, got %v", dbfile.ErrEncrypted, err)
+	}
+	if _, err := open("db.json", FileOptions{FS: mem, Keys: Keyring(t, 2)}); !errors.Is(err, dbfile.ErrWrongKey) {
+		t.Errorf("expected %v with another key, got %v", dbfile.ErrWrongKey, err)
+	}
+
+	// Rekeying moves the open database to the new key
+	db, err = open("db.json", FileOptions{FS: mem, Keys: oldKeys})
+	if err != nil {
+		t.Fatalf("reopen failed: %v", err)
+	}
+	if err := db.CreateRecord(context.Background(), map[string]interface{}{"name": "Bob"}); err != nil {
+		t.Fatalf("CreateRecord failed: %v", err)
+	}
+	if err := db.Rekey(context.Background(), newKeys); err != nil {
+		t.Fatalf("Rekey failed: %v", err)
+	}
+	expectKey(t, mem, "db.json", newKeys.Primary().ID)
+	if report, err := db.Scrub(context.Background()); err != nil || !report.OK() {
+		t.Errorf("expected a clean scrub, got %v (%v)", report, err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	db, err = open("db.json", FileOptions{FS: mem, Keys: Keyring(t, 2)})
+	if err != nil {
+		t.Fatalf("reopen with the new key failed: %v", err)
+	}
+	defer db.Close()
+	if got, err := db.ReadRecord(context.Background(), "2"); err != nil || got["name"] != "Bob" {
+		t.Errorf("expected Bob, got %v (%v)", got, err)
+	}
+}
@@ -0,0 +1,283 @@
+package repotest
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"math/rand"
+	"sort"
+	"strings"
+	"testing"
+	"zabbixhw/pkg/helpers"
+	"zabbixhw/pkg/repository"
+	"zabbixhw/pkg/repository/dberr"
+)
+
+var seedFlag = flag.Int64("repotest.seed", 1, "Seed of the first sequence RunModel runs")
+
+// ModelOptions tunes RunModel
+type ModelOptions struct {
+	Sequences   int   // Independent random sequences to run, 5 when zero
+	Steps       int   // Operations per sequence, 200 when zero
+	ReopenEvery int   // Average operations between close and reopen, 0 never reopens
+	Seed        int64 // Seed of the first sequence, taken from -repotest.seed when zero
+}
+
+// model is the reference implementation the engine is compared against
+type model struct {
+	records map[repository.ID]string // Expected record without its ID, as JSON
+	issued  map[repository.ID]bool   // Every ID ever returned by CreateRecord
+	last    repository.ID            // Most recently issued ID
+}
+
+// RunModel applies random sequences of operations to the engine and to a
+// reference model and fails as soon as the two disagree. Every failure
+// reports the seed and the operations leading to it, so it can be replayed
+// with -repotest.seed
+func RunModel(t *testing.T, factory Factory, opts ModelOptions) {
+	if opts.Sequences == 0 {
+		opts.Sequences = 5
+	}
+	if opts.Steps == 0 {
+		opts.Steps = 200
+	}
+	if opts.Seed == 0 {
+		opts.Seed = *seedFlag
+	}
+
+	for i := 0; i < opts.Sequences; i++ {
+		seed := opts.Seed + int64(i)
+		t.Run(fmt.Sprintf("seed=%d", seed), func(t *testing.T) {
+			runSequence(t, factory(t), seed, opts)
+		})
+	}
+}
+
+func runSequence(t *testing.T, open Opener, seed int64, opts ModelOptions) {
+	rng := rand.New(rand.NewSource(seed))
+	m := &model{
+		records: make(map[repository.ID]string),
+		issued:  make(map[repository.ID]bool),
+	}
+
+	var history []string
+	fail := func(format string, args ...interface{}) {
+		t.Helper()
+		t.Fatalf("seed %d, step %d: %s\nhistory:\n  %s", seed, len(history), fmt.Sprintf(format, args...), strings.Join(history, "\n  "))
+	}
+
+	repo, release := openStore(t, open)
+	ctx := context.Background()
+
+	for step := 0; step < opts.Steps; step++ {
+		if opts.ReopenEvery > 0 && rng.Intn(opts.ReopenEvery) == 0 {
+			history = append(history, "reopen")
+			release()
+			repo, release = openStore(t, open)
+			m.verifyAll(t, repo, fail)
+			continue
+		}
+
+		switch op := rng.Intn(10); {
+		case op < 4:
+			payload := randomRecord(rng)
+			expected := mustJSON(payload)
+			history = append(history, "create "+expected)
+
+			if err := repo.CreateRecord(ctx, payload); err != nil {
+				fail("CreateRecord failed: %v", err)
+			}
+			id, ok := repository.FormatID(payload["id"])
+			if !ok {
+				fail("CreateRecord assigned invalid ID %v", payload["id"])
+			}
+			if m.issued[id] {
+				fail("CreateRecord reissued ID %s", id)
+			}
+			if m.last != "" && !isNewer(m.last, id) {
+				fail("CreateRecord issued %s after %s", id, m.last)
+			}
+			history[len(history)-1] += " -> " + string(id)
+			m.issued[id] = true
+			m.last = id
+			m.records[id] = expected
+
+		case op < 7:
+			id := m.pickID(rng)
+			history = append(history, "read "+string(id))
+
+			record, err := repo.ReadRecord(ctx, id)
+			m.checkRead(id, record, err, fail)
+
+		case op < 9:
+			id := m.pickID(rng)
+			payload := randomRecord(rng)
+			expected := mustJSON(payload)
+			history = append(history, "update "+string(id)+" "+expected)
+
+			err := repo.UpdateRecord(ctx, id, payload)
+			if _, exists := m.records[id]; exists {
+				if err != nil {
+					fail("UpdateRecord(%s) failed: %v", id, err)
+				}
+				m.records[id] = expected
+			} else if !errors.Is(err, dberr.ErrNotFound) {
+				fail("expected UpdateRecord(%s) error %v, got %v", id, dberr.ErrNotFound, err)
+			}
+
+		default:
+			id := m.pickID(rng)
+			history = append(history, "delete "+string(id))
+
+			err := repo.DeleteRecord(ctx, id)
+			if _, exists := m.records[id]; exists {
+				if err != nil {
+					fail("DeleteRecord(%s) failed: %v", id, err)
+				}
+				delete(m.records, id)
+			} else if !errors.Is(err, dberr.ErrNotFound) {
+				fail("expected DeleteRecord(%s) error %v, got %v", id, dberr.ErrNotFound, err)
+			}
+		}
+	}
+
+	// Finish with a reopen so the last writes have to survive too
+	history = append(history, "reopen")
+	release()
+	repo, _ = openStore(t, open)
+	m.verifyAll(t, repo, fail)
+}
+
+// pickID mostly returns live IDs, sometimes deleted or never issued ones
+func (m *model) pickID(rng *rand.Rand) repository.ID {
+	switch n := rng.Intn(10); {
+	case n < 7 && len(m.records) > 0:
+		return sortedIDs(m.records)[rng.Intn(len(m.records))]
+	case n < 9 && len(m.issued) > 0:
+		ids := make([]repository.ID, 0, len(m.issued))
+		for id := range m.issued {
+			ids = append(ids, id)
+		}
+		sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+		return ids[rng.Intn(len(ids))]
+	default:
+		ids := make([]repository.ID, 0, len(m.issued))
+		for id := range m.issued {
+			ids = append(ids, id)
+		}
+		return missingID(ids...)
+	}
+}
+
+// checkRead compares a read result with the model
+func (m *model) checkRead(id repository.ID, record map[string]interface{}, err error, fail func(string, ...interface{})) {
+	expected, exists := m.records[id]
+	if !exists {
+		if !errors.Is(err, dberr.ErrNotFound) {
+			fail("expected ReadRecord(%s) error %v, got %v", id, dberr.ErrNotFound, err)
+		}
+		return
+	}
+	if err != nil {
+		fail("ReadRecord(%s) failed: %v", id, err)
+	}
+
+	recordID, ok := repository.FormatID(record["id"])
+	if !ok || recordID != id {
+		fail("ReadRecord(%s) returned record with ID %v", id, record["id"])
+	}
+
+	withoutID := make(map[string]interface{}, len(record))
+	for key, value := range record {
+		if key != "id" {
+			withoutID[key] = value
+		}
+	}
+	equal, err := helpers.CompareJSONStrings(mustJSON(withoutID), expected)
+	if err != nil {
+		fail("error comparing records: %v", err)
+	}
+	if !equal {
+		fail("ReadRecord(%s) returned %s, expected %s", id, mustJSON(withoutID), expected)
+	}
+}
+
+// verifyAll reads every ID the model knows about
+func (m *model) verifyAll(t *testing.T, repo repository.DatabaseRepoV2, fail func(string, ...interface{})) {
+	t.Helper()
+
+	for id := range m.issued {
+		record, err := repo.ReadRecord(context.Background(), id)
+		m.checkRead(id, record, err, fail)
+	}
+}
+
+func sortedIDs(records map[repository.ID]string) []repository.ID {
+	ids := make([]repository.ID, 0, len(records))
+	for id := range records {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids
+}
+
+func mustJSON(v interface{}) string {
+	data, err := json.Marshal(v)
+	if err != nil {
+		panic(err)
+	}
+	return string(data)
+}
+
+// randomRecord builds a record payload of random shape. Numbers are
+// json.Number so values beyond float64 precision are exercised as well
+func randomRecord(rng *rand.Rand) map[string]interface{} {
+	record := make(map[string]interface{})
+	for i, n := 0, rng.Intn(5); i < n; i++ {
+		record[randomKey(rng)] = randomValue(rng, 2)
+	}
+	return record
+}
+
+func randomKey(rng *rand.Rand) string {
+	keys := []string{"name", "host", "port", "tags", "meta", "value", "ключ", "emoji 🚀", "a.b", ""}
+	return keys[rng.Intn(len(keys))]
+}
+
+func randomValue(rng *rand.Rand, depth int) interface{} {
+	kinds := 6
+	if depth > 0 {
+		kinds = 8
+	}
+
+	switch rng.Intn(kinds) {
+	case 0:
+		return nil
+	case 1:
+		return rng.Intn(2) == 0
+	case 2:
+		return json.Number(fmt.Sprint(rng.Int63n(1000) - 500))
+	case 3:
+		// Integers a float64 cannot represent exactly
+		return json.Number(fmt.Sprintf("%d%09d", rng.Int63n(1<<40)+1<<53, rng.Intn(1e9)))
+	case 4:
+		return json.Number(fmt.Sprintf("%d.%018d", rng.Intn(100), rng.Int63n(1e18)))
+	case 5:
+		strs := []string{"", "Alice", "line\nbreak", `quote"d`, "ünïcödé", "<html>"}
+		return strs[rng.Intn(len(strs))]
+	case 6:
+		list := make([]interface{}, rng.Intn(4))
+		for i := range list {
+			list[i] = randomValue(rng, depth-1)
+		}
+		return list
+	default:
+		obj := make(map[string]interface{})
+		for i, n := 0, rng.Intn(4); i < n; i++ {
+			obj[randomKey(rng)] = randomValue(rng, depth-1)
+		}
+		return obj
+	}
+}
@@ -0,0 +1,427 @@
+// Package repotest is a conformance suite for repository.DatabaseRepoV2
+// implementations. An engine's tests call Run with a factory and get the same
+// behavioral checks as every other engine. Engines keeping a database file
+// also call RunFile for the checks of the file itself
+package repotest
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"sync"
+	"testing"
+	"zabbixhw/pkg/helpers"
+	"zabbixhw/pkg/repository"
+	"zabbixhw/pkg/repository/dberr"
+)
+
+// Opener opens the store under test and returns a function releasing it.
+// Opening again after the previous instance was released must see every
+// change made before the release
+type Opener func(t *testing.T) (repo repository.DatabaseRepoV2, release func())
+
+// Factory prepares a new empty store and returns its opener
+type Factory func(t *testing.T) Opener
+
+// Run executes the whole suite against the engine built by factory
+func Run(t *testing.T, factory Factory) {
+	tests := []struct {
+		name string
+		fn   func(t *testing.T, open Opener)
+	}{
+		{"CreateAndRead", testCreateAndRead},
+		{"ReadMissing", testReadMissing},
+		{"Update", testUpdate},
+		{"UpdateMissing", testUpdateMissing},
+		{"Delete", testDelete},
+		{"IDsUnique", testIDsUnique},
+		{"IDsNotReusedAfterDelete", testIDsNotReusedAfterDelete},
+		{"CancelledContext", testCancelledContext},
+		{"ConcurrentCreates", testConcurrentCreates},
+		{"ConcurrentMixed", testConcurrentMixed},
+		{"PersistenceAcrossReopen", testPersistenceAcrossReopen},
+		{"IDsNotReusedAfterReopen", testIDsNotReusedAfterReopen},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.fn(t, factory(t))
+		})
+	}
+}
+
+// openStore opens the store and releases it when the test ends unless the
+// test released it earlier
+func openStore(t *testing.T, open Opener) (repository.DatabaseRepoV2, func()) {
+	t.Helper()
+
+	repo, release := open(t)
+	var once sync.Once
+	releaseOnce := func() { once.Do(release) }
+	t.Cleanup(releaseOnce)
+	return repo, releaseOnce
+}
+
+// create stores a record and returns the ID the engine assigned to it
+func create(t *testing.T, repo repository.DatabaseRepoV2, data map[string]interface{}) repository.ID {
+	t.Helper()
+
+	if err := repo.CreateRecord(context.Background(), data); err != nil {
+		t.Fatalf("CreateRecord failed: %v", err)
+	}
+	id, ok := repository.FormatID(data["id"])
+	if !ok {
+		t.Fatalf("CreateRecord assigned an invalid ID %v", data["id"])
+	}
+	return id
+}
+
+// expectRecord reads id and compares it with the expected fields
+func expectRecord(t *testing.T, repo repository.DatabaseRepoV2, id repository.ID, expected map[string]interface{}) {
+	t.Helper()
+
+	record, err := repo.ReadRecord(context.Background(), id)
+	if err != nil {
+		t.Fatalf("ReadRecord(%s) failed: %v", id, err)
+	}
+
+	recordID, ok := repository.FormatID(record["id"])
+	if !ok || recordID != id {
+		t.Errorf("expected record to carry ID %s, got %v", id, record["id"])
+	}
+
+	withoutID := make(map[string]interface{}, len(record))
+	for key, value := range record {
+		if key != "id" {
+			withoutID[key] = value
+		}
+	}
+	ok, err = helpers.CompareMapsAsJSON(withoutID, expected)
+	if err != nil {
+		t.Fatalf("error comparing records: %v", err)
+	}
+	if !ok {
+		t.Errorf("expected record %s to be %v, got %v", id, expected, withoutID)
+	}
+}
+
+// expectNotFound checks that id is reported missing with the shared error
+func expectNotFound(t *testing.T, repo repository.DatabaseRepoV2, id repository.ID) {
+	t.Helper()
+
+	_, err := repo.ReadRecord(context.Background(), id)
+	if !errors.Is(err, dberr.ErrNotFound) {
+		t.Fatalf("expected ReadRecord(%s) error %v, got %v", id, dberr.ErrNotFound, err)
+	}
+}
+
+// missingID returns an ID that no record can have, built from the known IDs
+func missingID(ids ...repository.ID) repository.ID {
+	for _, id := range ids {
+		if n, err := strconv.ParseUint(string(id), 10, 64); err == nil {
+			return repository.ID(strconv.FormatUint(n+1000, 10))
+		}
+	}
+	if len(ids) > 0 {
+		return ids[0] + "0"
+	}
+	return "999"
+}
+
+// isNewer reports whether id was issued after prev. Numeric IDs must grow,
+// other formats must at least differ
+func isNewer(prev, id repository.ID) bool {
+	p, errPrev := strconv.ParseUint(string(prev), 10, 64)
+	n, errID := strconv.ParseUint(string(id), 10, 64)
+	if errPrev == nil && errID == nil {
+		return n > p
+	}
+	return id != prev
+}
+
+func testCreateAndRead(t *testing.T, open Opener) {
+	repo, _ := openStore(t, open)
+
+	first := create(t, repo, map[string]interface{}{"name": "Alice", "age": 30})
+	second := create(t, repo, map[string]interface{}{
+		"name":    "Bob",
+		"address": map[string]interface{}{"city": "Anytown"},
+		"tags":    []interface{}{"a", "b"},
+	})
+
+	if first == second {
+		t.Fatalf("expected different IDs, both are %s", first)
+	}
+
+	expectRecord(t, repo, first, map[string]interface{}{"name": "Alice", "age": 30})
+	expectRecord(t, repo, second, map[string]interface{}{
+		"name":    "Bob",
+		"address": map[string]interface{}{"city": "Anytown"},
+		"tags":    []interface{}{"a", "b"},
+	})
+}
+
+func testReadMissing(t *testing.T, open Opener) {
+	repo, _ := openStore(t, open)
+
+	// Both on an empty store and next to existing records
+	expectNotFound(t, repo, missingID())
+	id := create(t, repo, map[string]interface{}{"name": "Alice"})
+	expectNotFound(t, repo, missingID(id))
+}
+
+func testUpdate(t *testing.T, open Opener) {
+	repo, _ := openStore(t, open)
+
+	id := create(t, repo, map[string]interface{}{"name": "Alice", "age": 30})
+	other := create(t, repo, map[string]interface{}{"name": "Bob"})
+
+	// An update replaces the whole record, dropping fields that are not sent
+	update := map[string]interface{}{"name": "Alice Smith", "pet": "dog"}
+	if err := repo.UpdateRecord(context.Background(), id, update); err != nil {
+		t.Fatalf("UpdateRecord failed: %v", err)
+	}
+
+	if updatedID, ok := repository.FormatID(update["id"]); !ok || updatedID != id {
+		t.Errorf("expected UpdateRecord to set ID %s on the data, got %v", id, update["id"])
+	}
+
+	expectRecord(t, repo, id, map[string]interface{}{"name": "Alice Smith", "pet": "dog"})
+	expectRecord(t, repo, other, map[string]interface{}{"name": "Bob"})
+}
+
+func testUpdateMissing(t *testing.T, open Opener) {
+	repo, _ := openStore(t, open)
+
+	id := create(t, repo, map[string]interface{}{"name": "Alice"})
+	missing := missingID(id)
+
+	err := repo.UpdateRecord(context.Background(), missing, map[string]interface{}{"name": "Ghost"})
+	if !errors.Is(err, dberr.ErrNotFound) {
+		t.Fatalf("expected error %v, got %v", dberr.ErrNotFound, err)
+	}
+
+	// A failed update must not create the record
+	expectNotFound(t, repo, missing)
+}
+
+func testDelete(t *testing.T, open Opener) {
+	repo, _ := openStore(t, open)
+
+	first := create(t, repo, map[string]interface{}{"name": "Alice"})
+	second := create(t, repo, map[string]interface{}{"name": "Bob"})
+	third := create(t, repo, map[string]interface{}{"name": "Charlie"})
+
+	// Delete from the middle so the remaining records have to shift
+	if err := repo.DeleteRecord(context.Background(), second); err != nil {
+		t.Fatalf("DeleteRecord failed: %v", err)
+	}
+
+	expectNotFound(t, repo, second)
+	expectRecord(t, repo, first, map[string]interface{}{"name": "Alice"})
+	expectRecord(t, repo, third, map[string]interface{}{"name": "Charlie"})
+
+	err := repo.DeleteRecord(context.Background(), second)
+	if !errors.Is(err, dberr.ErrNotFound) {
+		t.Fatalf("expected second delete to fail with %v, got %v", dberr.ErrNotFound, err)
+	}
+}
+
+func testIDsUnique(t *testing.T, open Opener) {
+	repo, _ := openStore(t, open)
+
+	seen := make(map[repository.ID]bool)
+	var prev repository.ID
+	for i := 0; i < 50; i++ {
+		id := create(t, repo, map[string]interface{}{"n": i})
+		if seen[id] {
+			t.Fatalf("ID %s issued twice", id)
+		}
+		if prev != "" && !isNewer(prev, id) {
+			t.Fatalf("expected ID after %s to be newer, got %s", prev, id)
+		}
+		seen[id] = true
+		prev = id
+	}
+}
+
+func testIDsNotReusedAfterDelete(t *testing.T, open Opener) {
+	repo, _ := openStore(t, open)
+
+	issued := make(map[repository.ID]bool)
+	var last repository.ID
+	for i := 0; i < 3; i++ {
+		last = create(t, repo, map[string]interface{}{"n": i})
+		issued[last] = true
+	}
+
+	// Deleting the newest record must not free its ID
+	for i := 0; i < 3; i++ {
+		if err := repo.DeleteRecord(context.Background(), last); err != nil {
+			t.Fatalf("DeleteRecord failed: %v", err)
+		}
+		id := create(t, repo, map[string]interface{}{"again": i})
+		if issued[id] || !isNewer(last, id) {
+			t.Fatalf("ID %s was issued after deleting %s", id, last)
+		}
+		issued[id] = true
+		last = id
+	}
+}
+
+func testCancelledContext(t *testing.T, open Opener) {
+	repo, _ := openStore(t, open)
+
+	id := create(t, repo, map[string]interface{}{"name": "Alice"})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if err := repo.CreateRecord(ctx, map[string]interface{}{"name": "Bob"}); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected CreateRecord error %v, got %v", context.Canceled, err)
+	}
+	if _, err := repo.ReadRecord(ctx, id); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected ReadRecord error %v, got %v", context.Canceled, err)
+	}
+	if err := repo.UpdateRecord(ctx, id, map[string]interface{}{"name": "Changed"}); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected UpdateRecord error %v, got %v", context.Canceled, err)
+	}
+	if err := repo.DeleteRecord(ctx, id); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected DeleteRecord error %v, got %v", context.Canceled, err)
+	}
+
+	// None of the cancelled calls may have had an effect
+	expectRecord(t, repo, id, map[string]interface{}{"name": "Alice"})
+	next := create(t, repo, map[string]interface{}{"name": "Charlie"})
+	if _, err := repo.ReadRecord(context.Background(), next); err != nil {
+		t.Fatalf("ReadRecord failed: %v", err)
+	}
+}
+
+func testConcurrentCreates(t *testing.T, open Opener) {
+	repo, _ := openStore(t, open)
+
+	const workers = 8
+	const perWorker = 25
+
+	var wg sync.WaitGroup
+	ids := make(chan repository.ID, workers*perWorker)
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < perWorker; i++ {
+				data := map[string]interface{}{"worker": w, "n": i}
+				if err := repo.CreateRecord(context.Background(), data); err != nil {
+					t.Errorf("CreateRecord failed: %v", err)
+					return
+				}
+				id, _ := repository.FormatID(data["id"])
+				ids <- id
+			}
+		}(w)
+	}
+	wg.Wait()
+	close(ids)
+
+	seen := make(map[repository.ID]bool)
+	for id := range ids {
+		if seen[id] {
+			t.Fatalf("ID %s issued twice under concurrency", id)
+		}
+		seen[id] = true
+		if _, err := repo.ReadRecord(context.Background(), id); err != nil {
+			t.Fatalf("ReadRecord(%s) failed: %v", id, err)
+		}
+	}
+	if len(seen) != workers*perWorker {
+		t.Errorf("expected %d records, got %d", workers*perWorker, len(seen))
+	}
+}
+
+func testConcurrentMixed(t *testing.T, open Opener) {
+	repo, _ := openStore(t, open)
+
+	ids := make([]repository.ID, 20)
+	for i := range ids {
+		ids[i] = create(t, repo, map[string]interface{}{"n": i})
+	}
+
+	var wg sync.WaitGroup
+	for i, id := range ids {
+		wg.Add(3)
+		go func(i int, id repository.ID) {
+			defer wg.Done()
+			if _, err := repo.ReadRecord(context.Background(), id); err != nil && !errors.Is(err, dberr.ErrNotFound) {
+				t.Errorf("ReadRecord failed: %v", err)
+			}
+		}(i, id)
+		go func(i int, id repository.ID) {
+			defer wg.Done()
+			data := map[string]interface{}{"n": i, "updated": true}
+			if err := repo.UpdateRecord(context.Background(), id, data); err != nil && !errors.Is(err, dberr.ErrNotFound) {
+				t.Errorf("UpdateRecord failed: %v", err)
+			}
+		}(i, id)
+		go func(i int, id repository.ID) {
+			defer wg.Done()
+			if i%2 == 0 {
+				if err := repo.DeleteRecord(context.Background(), id); err != nil && !errors.Is(err, dberr.ErrNotFound) {
+					t.Errorf("DeleteRecord failed: %v", err)
+				}
+			}
+		}(i, id)
+	}
+	wg.Wait()
+
+	// Odd records were never deleted and must carry their final update
+	for i, id := range ids {
+		if i%2 == 1 {
+			expectRecord(t, repo, id, map[string]interface{}{"n": i, "updated": true})
+		} else {
+			expectNotFound(t, repo, id)
+		}
+	}
+}
+
+func testPersistenceAcrossReopen(t *testing.T, open Opener) {
+	repo, release := openStore(t, open)
+
+	kept := create(t, repo, map[string]interface{}{"name": "Alice"})
+	updated := create(t, repo, map[string]interface{}{"name": "Bob"})
+	deleted := create(t, repo, map[string]interface{}{"name": "Charlie"})
+
+	if err := repo.UpdateRecord(context.Background(), updated, map[string]interface{}{"name": "Bobby"}); err != nil {
+		t.Fatalf("UpdateRecord failed: %v", err)
+	}
+	if err := repo.DeleteRecord(context.Background(), deleted); err != nil {
+		t.Fatalf("DeleteRecord failed: %v", err)
+	}
+	release()
+
+	repo, _ = openStore(t, open)
+	expectRecord(t, repo, kept, map[string]interface{}{"name": "Alice"})
+	expectRecord(t, repo, updated, map[string]interface{}{"name": "Bobby"})
+	expectNotFound(t, repo, deleted)
+}
+
+func testIDsNotReusedAfterReopen(t *testing.T, open Opener) {
+	repo, release := openStore(t, open)
+
+	issued := make(map[repository.ID]bool)
+	var last repository.ID
+	for i := 0; i < 3; i++ {
+		last = create(t, repo, map[string]interface{}{"n": i})
+		issued[last] = true
+	}
+	if err := repo.DeleteRecord(context.Background(), last); err != nil {
+		t.Fatalf("DeleteRecord failed: %v", err)
+	}
+	release()
+
+	repo, _ = openStore(t, open)
+	id := create(t, repo, map[string]interface{}{"name": "after reopen"})
+	if issued[id] || !isNewer(last, id) {
+		t.Fatalf("ID %s was issued again after reopening", id)
+	}
+}
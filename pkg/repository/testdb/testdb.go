@@ -1,28 +1,59 @@
 package testdb
 
-import "errors"
+import (
+	"context"
+	"fmt"
+	"sync"
+	"zabbixhw/pkg/repository"
+	"zabbixhw/pkg/repository/dberr"
+	"zabbixhw/pkg/repository/idgen"
+)
 
 type TestDB struct {
+	mu   sync.Mutex
 	Data []map[string]interface{}
+	Seq  uint32         // Highest ID ever issued, so deleted IDs are not reused
+	IDs  idgen.Strategy // Optional ID strategy, plain uint32 IDs are used when nil
 }
 
 // Adds id to record and writes it into db
-func (db *TestDB) CreateRecord(data map[string]interface{}) error {
+func (db *TestDB) CreateRecord(ctx context.Context, data map[string]interface{}) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
 	var newID uint32 = 1 // Default ID if the database is empty
 
 	// Check if the database is not empty
-	if len(db.Data) > 0 {
+	if db.IDs == nil && len(db.Data) > 0 {
 		// Get the ID of the last record
 		lastRecord := db.Data[len(db.Data)-1]
 		if id, ok := lastRecord["id"].(uint32); ok {
 			newID = id + 1
 		} else {
-			return errors.New("invalid ID type in last record")
+			return fmt.Errorf("%w: last record", dberr.ErrInvalidIDType)
 		}
 	}
 
+	// Never go back below an ID that was already issued
+	if db.Seq >= newID {
+		newID = db.Seq + 1
+	}
+	db.Seq = newID
+
 	// Set the new record's ID
-	data["id"] = newID
+	if db.IDs != nil {
+		id, err := db.IDs.NewID(uint64(newID))
+		if err != nil {
+			return err
+		}
+		data["id"] = id
+	} else {
+		data["id"] = newID
+	}
 
 	// Add the new record to the database
 	db.Data = append(db.Data, data)
@@ -31,56 +62,74 @@ func (db *TestDB) CreateRecord(data map[string]interface{}) error {
 }
 
 // ReadRecord retrieves a record by its ID
-func (db *TestDB) ReadRecord(id uint32) (map[string]interface{}, error) {
+func (db *TestDB) ReadRecord(ctx context.Context, id repository.ID) (map[string]interface{}, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
 	// Iterate through the records to find the matching ID
 	for _, record := range db.Data {
-		if recordID, ok := record["id"].(uint32); ok {
+		if recordID, ok := repository.FormatID(record["id"]); ok {
 			if recordID == id {
 				return record, nil
 			}
 		} else {
-			return nil, errors.New("invalid ID type in record")
+			return nil, dberr.ErrInvalidIDType
 		}
 	}
 	// If no matching record is found, return an error
-	return nil, errors.New("record not found")
+	return nil, dberr.ErrNotFound
 }
 
-func (db *TestDB) UpdateRecord(id uint32, data map[string]interface{}) error {
+func (db *TestDB) UpdateRecord(ctx context.Context, id repository.ID, data map[string]interface{}) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
 	// Iterate through the records to find the matching ID
-	data["id"] = id
 	for i, record := range db.Data {
-		if recordID, ok := record["id"].(uint32); ok {
+		if recordID, ok := repository.FormatID(record["id"]); ok {
 			if recordID == id {
-				// Update the record with new data, preserving the ID
-				for key, value := range data {
-					record[key] = value
-				}
-				db.Data[i] = record
+				// Replace the record with new data, preserving the ID
+				data["id"] = record["id"]
+				db.Data[i] = data
 				return nil
 			}
 		} else {
-			return errors.New("invalid ID type in record")
+			return dberr.ErrInvalidIDType
 		}
 	}
 	// If no matching record is found, return an error
-	return errors.New("record not found")
+	return dberr.ErrNotFound
 }
 
 // DeleteRecord deletes a record by its ID
-func (db *TestDB) DeleteRecord(id uint32) error {
+func (db *TestDB) DeleteRecord(ctx context.Context, id repository.ID) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
 	// Iterate through the records to find the matching ID
 	for i, record := range db.Data {
-		if recordID, ok := record["id"].(uint32); ok {
+		if recordID, ok := repository.FormatID(record["id"]); ok {
 			if recordID == id {
 				// Remove the record from the slice
 				db.Data = append(db.Data[:i], db.Data[i+1:]...)
 				return nil
 			}
 		} else {
-			return errors.New("invalid ID type in record")
+			return dberr.ErrInvalidIDType
 		}
 	}
 	// If no matching record is found, return an error
-	return errors.New("record not found")
+	return dberr.ErrNotFound
 }
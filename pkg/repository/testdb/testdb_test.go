@@ -1,8 +1,14 @@
 package testdb
 
 import (
+	"context"
+	"errors"
 	"reflect"
 	"testing"
+	"zabbixhw/pkg/repository"
+	"zabbixhw/pkg/repository/dberr"
+	"zabbixhw/pkg/repository/idgen"
+	"zabbixhw/pkg/repository/repotest"
 )
 
 // TestCreateRecord tests the CreateRecord function with various scenarios
@@ -14,7 +20,7 @@ func Test_CreateRecord(t *testing.T) {
 			"name": "Alice",
 			"age":  30,
 		}
-		if err := db.CreateRecord(record); err != nil {
+		if err := db.CreateRecord(context.Background(), record); err != nil {
 			t.Errorf("CreateRecord failed: %v", err)
 		}
 		if len(db.Data) != 1 {
@@ -49,7 +55,7 @@ func Test_CreateRecord(t *testing.T) {
 			"name": "Bob",
 			"age":  25,
 		}
-		if err := db.CreateRecord(record); err != nil {
+		if err := db.CreateRecord(context.Background(), record); err != nil {
 			t.Errorf("CreateRecord failed: %v", err)
 		}
 		if len(db.Data) != 2 {
@@ -73,7 +79,7 @@ func Test_CreateRecord(t *testing.T) {
 		db := &TestDB{
 			Data: []map[string]interface{}{
 				{
-					"id":   "invalid", // invalid ID type
+					"id":   true, // invalid ID type
 					"name": "Charlie",
 					"age":  40,
 				},
@@ -84,16 +90,39 @@ func Test_CreateRecord(t *testing.T) {
 			"name": "David",
 			"age":  35,
 		}
-		err := db.CreateRecord(record)
+		err := db.CreateRecord(context.Background(), record)
 		if err == nil {
 			t.Errorf("expected error, got nil")
 		}
-		if err.Error() != "invalid ID type in last record" {
-			t.Errorf("expected error 'invalid ID type in last record', got %v", err)
+		if !errors.Is(err, dberr.ErrInvalidIDType) {
+			t.Errorf("expected error %v, got %v", dberr.ErrInvalidIDType, err)
 		}
 	})
 }
 
+func Test_CreateRecordAfterDelete(t *testing.T) {
+	db := &TestDB{}
+
+	for _, name := range []string{"Alice", "Bob"} {
+		if err := db.CreateRecord(context.Background(), map[string]interface{}{"name": name}); err != nil {
+			t.Fatalf("CreateRecord failed: %v", err)
+		}
+	}
+
+	// Removing the newest record must not free its ID
+	if err := db.DeleteRecord(context.Background(), "2"); err != nil {
+		t.Fatalf("DeleteRecord failed: %v", err)
+	}
+
+	record := map[string]interface{}{"name": "Charlie"}
+	if err := db.CreateRecord(context.Background(), record); err != nil {
+		t.Fatalf("CreateRecord failed: %v", err)
+	}
+	if record["id"] != uint32(3) {
+		t.Errorf("expected id to be 3, got %v", record["id"])
+	}
+}
+
 func Test_ReadRecord(t *testing.T) {
 	t.Run("Read existing record", func(t *testing.T) {
 		db := &TestDB{
@@ -111,7 +140,7 @@ func Test_ReadRecord(t *testing.T) {
 			},
 		}
 
-		record, err := db.ReadRecord(1)
+		record, err := db.ReadRecord(context.Background(), "1")
 		if err != nil {
 			t.Errorf("ReadRecord failed: %v", err)
 		}
@@ -137,12 +166,12 @@ func Test_ReadRecord(t *testing.T) {
 			},
 		}
 
-		_, err := db.ReadRecord(2)
+		_, err := db.ReadRecord(context.Background(), "2")
 		if err == nil {
 			t.Errorf("expected error, got nil")
 		}
-		if err.Error() != "record not found" {
-			t.Errorf("expected error 'record not found', got %v", err)
+		if !errors.Is(err, dberr.ErrNotFound) {
+			t.Errorf("expected error %v, got %v", dberr.ErrNotFound, err)
 		}
 	})
 
@@ -150,19 +179,19 @@ func Test_ReadRecord(t *testing.T) {
 		db := &TestDB{
 			Data: []map[string]interface{}{
 				{
-					"id":   "invalid", // invalid ID type
+					"id":   true, // invalid ID type
 					"name": "Charlie",
 					"age":  40,
 				},
 			},
 		}
 
-		_, err := db.ReadRecord(1)
+		_, err := db.ReadRecord(context.Background(), "1")
 		if err == nil {
 			t.Errorf("expected error, got nil")
 		}
-		if err.Error() != "invalid ID type in record" {
-			t.Errorf("expected error 'invalid ID type in record', got %v", err)
+		if !errors.Is(err, dberr.ErrInvalidIDType) {
+			t.Errorf("expected error %v, got %v", dberr.ErrInvalidIDType, err)
 		}
 	})
 }
@@ -190,7 +219,7 @@ func Test_UpdateRecord(t *testing.T) {
 			"age":  31,
 		}
 
-		err := db.UpdateRecord(1, updatedData)
+		err := db.UpdateRecord(context.Background(), "1", updatedData)
 		if err != nil {
 			t.Errorf("UpdateRecord failed: %v", err)
 		}
@@ -221,12 +250,12 @@ func Test_UpdateRecord(t *testing.T) {
 			"age":  25,
 		}
 
-		err := db.UpdateRecord(2, updatedData)
+		err := db.UpdateRecord(context.Background(), "2", updatedData)
 		if err == nil {
 			t.Errorf("expected error, got nil")
 		}
-		if err.Error() != "record not found" {
-			t.Errorf("expected error 'record not found', got %v", err)
+		if !errors.Is(err, dberr.ErrNotFound) {
+			t.Errorf("expected error %v, got %v", dberr.ErrNotFound, err)
 		}
 	})
 
@@ -234,7 +263,7 @@ func Test_UpdateRecord(t *testing.T) {
 		db := &TestDB{
 			Data: []map[string]interface{}{
 				{
-					"id":   "invalid", // invalid ID type
+					"id":   true, // invalid ID type
 					"name": "Charlie",
 					"age":  40,
 				},
@@ -246,12 +275,12 @@ func Test_UpdateRecord(t *testing.T) {
 			"age":  41,
 		}
 
-		err := db.UpdateRecord(1, updatedData)
+		err := db.UpdateRecord(context.Background(), "1", updatedData)
 		if err == nil {
 			t.Errorf("expected error, got nil")
 		}
-		if err.Error() != "invalid ID type in record" {
-			t.Errorf("expected error 'invalid ID type in record', got %v", err)
+		if !errors.Is(err, dberr.ErrInvalidIDType) {
+			t.Errorf("expected error %v, got %v", dberr.ErrInvalidIDType, err)
 		}
 	})
 }
@@ -274,7 +303,7 @@ func TestDeleteRecord(t *testing.T) {
 			},
 		}
 
-		err := db.DeleteRecord(1)
+		err := db.DeleteRecord(context.Background(), "1")
 		if err != nil {
 			t.Errorf("DeleteRecord failed: %v", err)
 		}
@@ -299,12 +328,12 @@ func TestDeleteRecord(t *testing.T) {
 			},
 		}
 
-		err := db.DeleteRecord(2)
+		err := db.DeleteRecord(context.Background(), "2")
 		if err == nil {
 			t.Errorf("expected error, got nil")
 		}
-		if err.Error() != "record not found" {
-			t.Errorf("expected error 'record not found', got %v", err)
+		if !errors.Is(err, dberr.ErrNotFound) {
+			t.Errorf("expected error %v, got %v", dberr.ErrNotFound, err)
 		}
 	})
 
@@ -312,19 +341,46 @@ func TestDeleteRecord(t *testing.T) {
 		db := &TestDB{
 			Data: []map[string]interface{}{
 				{
-					"id":   "invalid", // invalid ID type
+					"id":   true, // invalid ID type
 					"name": "Charlie",
 					"age":  40,
 				},
 			},
 		}
 
-		err := db.DeleteRecord(1)
+		err := db.DeleteRecord(context.Background(), "1")
 		if err == nil {
 			t.Errorf("expected error, got nil")
 		}
-		if err.Error() != "invalid ID type in record" {
-			t.Errorf("expected error 'invalid ID type in record', got %v", err)
+		if !errors.Is(err, dberr.ErrInvalidIDType) {
+			t.Errorf("expected error %v, got %v", dberr.ErrInvalidIDType, err)
 		}
 	})
 }
+
+func Test_Conformance(t *testing.T) {
+	repotest.Run(t, newTestStore)
+}
+
+func Test_Model(t *testing.T) {
+	repotest.RunModel(t, newTestStore, repotest.ModelOptions{ReopenEvery: 25})
+}
+
+// newTestStore is the repotest factory for this engine
+func newTestStore(t *testing.T) repotest.Opener {
+	// The data lives in memory, so reopening hands back the same instance
+	db := &TestDB{}
+	return func(t *testing.T) (repository.DatabaseRepoV2, func()) {
+		return db, func() {}
+	}
+}
+
+func Benchmark_Repository(b *testing.B) {
+	repotest.Bench(b, openBenchStore)
+}
+
+// openBenchStore is the repotest bench opener for this engine
+func openBenchStore(b *testing.B, records []map[string]interface{}) (repository.DatabaseRepoV2, func()) {
+	db := &TestDB{Data: records, Seq: uint32(len(records)), IDs: idgen.Default()}
+	return db, func() {}
+}
@@ -0,0 +1,550 @@
+// Package revsync reconciles instances that take changes independently,
+// such as a field site working offline and the central server. Every
+// change of a record is a revision. Instances exchange the revisions made
+// since their last sync, and a record edited on both sides keeps both
+// revisions as a conflict, for an operator or a policy to resolve
+package revsync
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"zabbixhw/pkg/ctxsync"
+	"zabbixhw/pkg/fsys"
+	"zabbixhw/pkg/replication"
+	"zabbixhw/pkg/repository"
+	"zabbixhw/pkg/repository/dberr"
+	"zabbixhw/pkg/repository/dbfile"
+	"zabbixhw/pkg/repository/idgen"
+)
+
+// Policy decides what becomes of conflicts as they are found
+type Policy string
+
+// Available policies
+const (
+	PolicyManual Policy = "manual" // Keep every revision until one is picked through Resolve
+	PolicyNewest Policy = "newest" // Keep the revision edited last
+)
+
+// ParsePolicy returns the policy named name
+func ParsePolicy(name string) (Policy, error) {
+	switch policy := Policy(name); policy {
+	case PolicyManual, PolicyNewest:
+		return policy, nil
+	default:
+		return "", fmt.Errorf("unknown conflict policy %q, expected manual or newest", name)
+	}
+}
+
+// DefaultBatchSize is how many records are exchanged in one request
+const DefaultBatchSize = 500
+
+// Option configures a Node
+type Option func(*Node)
+
+// WithPolicy sets how conflicts are resolved, PolicyManual by default
+func WithPolicy(policy Policy) Option {
+	return func(n *Node) {
+		n.policy = policy
+	}
+}
+
+// WithToken sets the shared secret presented to remote instances
+func WithToken(token string) Option {
+	return func(n *Node) {
+		n.token = token
+	}
+}
+
+// WithClient sets the HTTP client remote instances are reached with
+func WithClient(client *http.Client) Option {
+	return func(n *Node) {
+		n.client = client
+	}
+}
+
+// WithBatchSize sets how many records are exchanged in one request
+func WithBatchSize(size int) Option {
+	return func(n *Node) {
+		if size > 0 {
+			n.batch = size
+		}
+	}
+}
+
+// WithFS sets the filesystem the state file is kept on
+func WithFS(fs fsys.FS) Option {
+	return func(n *Node) {
+		n.fs = fs
+	}
+}
+
+// WithKeys encrypts the state file with the primary key of keys. A state
+// file written in plaintext or with another key is encrypted again by Open
+func WithKeys(keys *dbfile.Keyring) Option {
+	return func(n *Node) {
+		n.keys = keys
+	}
+}
+
+// Node is a repository that tracks the revisions of its records and syncs
+// them with other instances. The revision trees are kept in a state file
+// next to the database file, the current revision of each record in the
+// engine
+type Node struct {
+	engine replication.Replica
+	path   string
+	fs     fsys.FS
+	keys   *dbfile.Keyring
+	policy Policy
+	token  string
+	client *http.Client
+	batch  int
+
+	mu    ctxsync.RWMutex // Orders changes to the engine with those to the state
+	state *state
+
+	syncMu   sync.Mutex // One sync at a time
+	statusMu sync.Mutex
+	last     *Report
+}
+
+// Open tracks the revisions of engine in the state file at path. Records
+// changed while the node was not running, such as before sync was enabled,
+// are given new revisions
+func Open(engine replication.Replica, path string, opts ...Option) (*Node, error) {
+	n := &Node{
+		engine: engine,
+		path:   path,
+		fs:     fsys.OS{},
+		policy: PolicyManual,
+		client: http.DefaultClient,
+		batch:  DefaultBatchSize,
+	}
+	for _, opt := range opts {
+		opt(n)
+	}
+
+	ctx := context.Background()
+	current, _, err := engine.Snapshot(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if current.Header.IDStrategy == idgen.NameSequential {
+		return nil, errors.New("sync needs IDs unique across instances, use the uuidv7 or ulid ID strategy")
+	}
+	if n.state, err = loadState(n.fs, path, n.keys); err != nil {
+		return nil, fmt.Errorf("error loading the sync state: %w", err)
+	}
+	if err := n.reconcile(ctx, current.Records); err != nil {
+		return nil, err
+	}
+	if err := n.save(); err != nil {
+		return nil, err
+	}
+	return n, nil
+}
+
+// reconcile gives new revisions to the records of the engine that differ
+// from their current revision
+func (n *Node) reconcile(ctx context.Context, records []map[string]interface{}) error {
+	seen := map[repository.ID]bool{}
+	for _, record := range records {
+		id, ok := repository.FormatID(record["id"])
+		if !ok {
+			return dberr.ErrInvalidIDType
+		}
+		seen[id] = true
+		if d := n.state.Docs[id]; d != nil {
+			if w := winner(d.Leaves); w >= 0 && d.Leaves[w].matches(record) {
+				continue
+			}
+		}
+		if err := n.edit(ctx, id, copyRecord(record), false); err != nil {
+			return err
+		}
+	}
+	for id, d := range n.state.Docs {
+		if w := winner(d.Leaves); w >= 0 && !d.Leaves[w].Deleted && !seen[id] {
+			if err := n.edit(ctx, id, nil, true); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// edit records a change the engine made to the current revision of a
+// record: record is its new content, unless it was deleted
+func (n *Node) edit(ctx context.Context, id repository.ID, record map[string]interface{}, deleted bool) error {
+	var leaves []Revision
+	var parent *Revision
+	if d := n.state.Docs[id]; d != nil {
+		leaves = append(leaves, d.Leaves...)
+		if w := winner(leaves); w >= 0 {
+			parent = &leaves[w]
+		}
+	}
+	rev := newRevision(parent, record, deleted)
+	if parent != nil {
+		*parent = rev
+	} else {
+		leaves = append(leaves, rev)
+	}
+
+	held := rev.Rev
+	if deleted {
+		held = ""
+	}
+	return n.setLeaves(ctx, id, leaves, held)
+}
+
+// setLeaves makes leaves the revisions of the record id, and puts the
+// winner in the engine. held is the revision the engine holds, empty if it
+// does not have the record
+func (n *Node) setLeaves(ctx context.Context, id repository.ID, leaves []Revision, held string) error {
+	w := winner(leaves)
+	target := &leaves[w]
+	if target.Rev != held {
+		// The revision leaving the engine keeps its content with it
+		for i := range leaves {
+			if held != "" && leaves[i].Rev == held && leaves[i].Record == nil {
+				record, err := n.engine.ReadRecord(ctx, id)
+				if err != nil {
+					return err
+				}
+				leaves[i].Record = record
+			}
+		}
+
+		var err error
+		switch {
+		case target.Deleted:
+			if held != "" {
+				err = n.engine.DeleteRecord(ctx, id)
+			}
+		case held != "":
+			err = n.engine.UpdateRecord(ctx, id, copyRecord(target.Record))
+		default:
+			record := copyRecord(target.Record)
+			if _, ok := record["id"]; !ok {
+				record["id"] = string(id)
+			}
+			err = n.engine.ApplyChanges(ctx, []repository.Change{{Op: repository.OpCreate, ID: id, Record: record}})
+		}
+		if err != nil {
+			return err
+		}
+	}
+	target.Record = nil
+
+	n.state.Seq++
+	n.state.setDoc(id, &doc{Seq: n.state.Seq, Leaves: leaves})
+	return nil
+}
+
+// save writes the state file
+func (n *Node) save() error {
+	if err := n.state.save(n.fs, n.path, n.keys); err != nil {
+		return fmt.Errorf("error saving the sync state: %w", err)
+	}
+	return nil
+}
+
+// Unwrap returns the engine of the node
+func (n *Node) Unwrap() repository.DatabaseRepoV2 {
+	return n.engine
+}
+
+// Rekey passes a new keyring to the engine, then rewrites the state file
+// with the primary key of keys
+func (n *Node) Rekey(ctx context.Context, keys *dbfile.Keyring) error {
+	engine, ok := n.engine.(dbfile.Rekeyer)
+	if !ok {
+		return fmt.Errorf("%w: the engine cannot be rekeyed", dberr.ErrValidation)
+	}
+	if keys == nil {
+		return dbfile.ErrNoKeys
+	}
+	if err := n.mu.Lock(ctx); err != nil {
+		return err
+	}
+	defer n.mu.Unlock()
+
+	if err := engine.Rekey(ctx, keys); err != nil {
+		return err
+	}
+	previous := n.keys
+	n.keys = keys
+	n.state.compact = true
+	if err := n.save(); err != nil {
+		n.keys = previous
+		return err
+	}
+	return nil
+}
+
+// CreateRecord creates the record as its first revision
+func (n *Node) CreateRecord(ctx context.Context, data map[string]interface{}) error {
+	if err := n.mu.Lock(ctx); err != nil {
+		return err
+	}
+	defer n.mu.Unlock()
+
+	if err := n.engine.CreateRecord(ctx, data); err != nil {
+		return err
+	}
+	id, ok := repository.FormatID(data["id"])
+	if !ok {
+		return dberr.ErrInvalidIDType
+	}
+	return n.commit(ctx, id, nil, copyRecord(data), false)
+}
+
+// ReadRecord reads the current revision of the record
+func (n *Node) ReadRecord(ctx context.Context, id repository.ID) (map[string]interface{}, error) {
+	return n.engine.ReadRecord(ctx, id)
+}
+
+// UpdateRecord makes a revision of the record following the current one.
+// Conflicting revisions are left as they are
+func (n *Node) UpdateRecord(ctx context.Context, id repository.ID, data map[string]interface{}) error {
+	if err := n.mu.Lock(ctx); err != nil {
+		return err
+	}
+	defer n.mu.Unlock()
+
+	before, err := n.engine.ReadRecord(ctx, id)
+	if err != nil {
+		return err
+	}
+	if err := n.engine.UpdateRecord(ctx, id, data); err != nil {
+		return err
+	}
+	return n.commit(ctx, id, before, copyRecord(data), false)
+}
+
+// DeleteRecord deletes the current revision of the record. If it had
+// conflicts, the winner among them becomes the current revision
+func (n *Node) DeleteRecord(ctx context.Context, id repository.ID) error {
+	if err := n.mu.Lock(ctx); err != nil {
+		return err
+	}
+	defer n.mu.Unlock()
+
+	before, err := n.engine.ReadRecord(ctx, id)
+	if err != nil {
+		return err
+	}
+	if err := n.engine.DeleteRecord(ctx, id); err != nil {
+		return err
+	}
+	return n.commit(ctx, id, before, nil, true)
+}
+
+// commit records a change the engine made to the record id, like edit, and
+// saves it. If either fails, the state and the engine are put back as they
+// were, so a change that returns an error is not made. before is the record
+// before the change, nil if it did not exist
+func (n *Node) commit(ctx context.Context, id repository.ID, before, record map[string]interface{}, deleted bool) error {
+	d, seq := n.state.Docs[id], n.state.Seq
+	err := n.edit(ctx, id, record, deleted)
+	if err == nil {
+		err = n.save()
+	}
+	if err == nil {
+		return nil
+	}
+
+	n.state.Seq = seq
+	n.state.setDoc(id, d)
+	if undoErr := n.undo(ctx, id, before); undoErr != nil {
+		return fmt.Errorf("%w, and undoing the change in the database failed: %v", err, undoErr)
+	}
+	return err
+}
+
+// undo puts the record id back in the engine as before, nil if it did not
+// exist
+func (n *Node) undo(ctx context.Context, id repository.ID, before map[string]interface{}) error {
+	_, err := n.engine.ReadRecord(ctx, id)
+	if err != nil && !errors.Is(err, dberr.ErrNotFound) {
+		return err
+	}
+	exists := err == nil
+
+	var change repository.Change
+	switch {
+	case before == nil && !exists:
+		return nil
+	case before == nil:
+		change = repository.Change{Op: repository.OpDelete, ID: id}
+	case exists:
+		change = repository.Change{Op: repository.OpUpdate, ID: id, Record: before}
+	default:
+		change = repository.Change{Op: repository.OpCreate, ID: id, Record: before}
+	}
+	return n.engine.ApplyChanges(ctx, []repository.Change{change})
+}
+
+// Conflict is a record with more than one revision that is not deleted
+type Conflict struct {
+	ID        repository.ID `json:"id"`
+	Rev       string        `json:"rev"`       // The current revision, served by reads
+	Revisions []Revision    `json:"revisions"` // Every revision that is not deleted, the current one first
+}
+
+// Conflicts returns the revisions of the record id. A record without
+// conflicts only has its current revision
+func (n *Node) Conflicts(ctx context.Context, id repository.ID) (*Conflict, error) {
+	if err := n.mu.RLock(ctx); err != nil {
+		return nil, err
+	}
+	defer n.mu.RUnlock()
+
+	d := n.state.Docs[id]
+	if d == nil {
+		return nil, fmt.Errorf("%w: no revisions of %s", dberr.ErrNotFound, id)
+	}
+	revisions, err := n.leaves(ctx, id, d)
+	if err != nil {
+		return nil, err
+	}
+	conflict := &Conflict{ID: id, Rev: revisions[0].Rev, Revisions: []Revision{}}
+	for _, rev := range revisions {
+		if !rev.Deleted {
+			conflict.Revisions = append(conflict.Revisions, rev)
+		}
+	}
+	return conflict, nil
+}
+
+// leaves returns copies of the revisions of a record, the winner first with
+// its content read from the engine
+func (n *Node) leaves(ctx context.Context, id repository.ID, d *doc) ([]Revision, error) {
+	w := winner(d.Leaves)
+	revisions := []Revision{d.Leaves[w]}
+	for i, leaf := range d.Leaves {
+		if i != w {
+			leaf.Record = copyRecord(leaf.Record)
+			revisions = append(revisions, leaf)
+		}
+	}
+	if !revisions[0].Deleted {
+		record, err := n.engine.ReadRecord(ctx, id)
+		if err != nil {
+			return nil, err
+		}
+		revisions[0].Record = record
+	}
+	return revisions, nil
+}
+
+// ConflictIDs returns the IDs of the records with conflicts
+func (n *Node) ConflictIDs(ctx context.Context) ([]repository.ID, error) {
+	if err := n.mu.RLock(ctx); err != nil {
+		return nil, err
+	}
+	defer n.mu.RUnlock()
+
+	ids := []repository.ID{}
+	for id, d := range n.state.Docs {
+		if live(d.Leaves) > 1 {
+			ids = append(ids, id)
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids, nil
+}
+
+// Resolve keeps the revision rev of the record id and deletes the others.
+// The deletions are synced like any change, so other instances drop the
+// same revisions
+func (n *Node) Resolve(ctx context.Context, id repository.ID, rev string) error {
+	if err := n.mu.Lock(ctx); err != nil {
+		return err
+	}
+	defer n.mu.Unlock()
+
+	d := n.state.Docs[id]
+	if d == nil {
+		return fmt.Errorf("%w: no revisions of %s", dberr.ErrNotFound, id)
+	}
+	keep := -1
+	for i, leaf := range d.Leaves {
+		if leaf.Rev == rev && !leaf.Deleted {
+			keep = i
+		}
+	}
+	if keep < 0 {
+		return fmt.Errorf("%w: %s is not a revision of %s", dberr.ErrNotFound, rev, id)
+	}
+	if live(d.Leaves) == 1 {
+		return nil
+	}
+
+	leaves := resolve(append([]Revision(nil), d.Leaves...), keep)
+	if err := n.setLeaves(ctx, id, leaves, n.held(d)); err != nil {
+		return err
+	}
+	return n.save()
+}
+
+// resolve deletes every revision of leaves but the one at keep
+func resolve(leaves []Revision, keep int) []Revision {
+	for i := range leaves {
+		if i != keep && !leaves[i].Deleted {
+			leaves[i] = newRevision(&leaves[i], nil, true)
+		}
+	}
+	return leaves
+}
+
+// held returns the revision of d the engine holds, empty if it does not
+// have the record
+func (n *Node) held(d *doc) string {
+	if d == nil {
+		return ""
+	}
+	if w := winner(d.Leaves); w >= 0 && !d.Leaves[w].Deleted {
+		return d.Leaves[w].Rev
+	}
+	return ""
+}
+
+// Status describes the node and its last sync
+type Status struct {
+	Instance    string                `json:"instance"`
+	Seq         uint64                `json:"seq"` // Update sequence, the number of changes the node made or received
+	Policy      Policy                `json:"policy"`
+	Conflicts   int                   `json:"conflicts"` // Records with conflicts
+	Checkpoints map[string]Checkpoint `json:"checkpoints"`
+	LastSync    *Report               `json:"lastSync,omitempty"`
+}
+
+// Status reports the update sequence of the node, its conflicts and how
+// far it synced with each remote instance
+func (n *Node) Status(ctx context.Context) (*Status, error) {
+	if err := n.mu.RLock(ctx); err != nil {
+		return nil, err
+	}
+	status := &Status{Instance: n.state.Instance, Seq: n.state.Seq, Policy: n.policy, Checkpoints: map[string]Checkpoint{}}
+	for _, d := range n.state.Docs {
+		if live(d.Leaves) > 1 {
+			status.Conflicts++
+		}
+	}
+	for key, checkpoint := range n.state.Checkpoints {
+		status.Checkpoints[key] = checkpoint
+	}
+	n.mu.RUnlock()
+
+	n.statusMu.Lock()
+	defer n.statusMu.Unlock()
+	status.LastSync = n.last
+	return status, nil
+}
@@ -0,0 +1,507 @@
+package revsync
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+	"zabbixhw/pkg/fsys"
+	"zabbixhw/pkg/repository"
+	"zabbixhw/pkg/repository/dberr"
+	"zabbixhw/pkg/repository/dbfile"
+	"zabbixhw/pkg/repository/filedb"
+	"zabbixhw/pkg/repository/idgen"
+	"zabbixhw/pkg/repository/repotest"
+)
+
+// newTestNode opens a fresh engine issuing UUIDs in dir and tracks its
+// revisions
+func newTestNode(t *testing.T, dir string, opts ...Option) *Node {
+	t.Helper()
+
+	db, err := filedb.Open(filepath.Join(dir, "db.json"), filedb.WithIDStrategy(idgen.NewUUIDv7()))
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	n, err := Open(db, filepath.Join(dir, "db.json.sync"), opts...)
+	if err != nil {
+		db.Close()
+		t.Fatalf("Open failed: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return n
+}
+
+// serve answers other instances on behalf of n like the API server does
+func serve(t *testing.T, n *Node) *httptest.Server {
+	t.Helper()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET "+ChangesPath, func(w http.ResponseWriter, r *http.Request) {
+		since, _ := strconv.ParseUint(r.URL.Query().Get("since"), 10, 64)
+		limit, _ := strconv.Atoi(r.URL.Query().Get("limit"))
+		changes, err := n.Changes(r.Context(), since, limit)
+		respond(w, changes, err)
+	})
+	mux.HandleFunc("POST "+RevisionsPath, func(w http.ResponseWriter, r *http.Request) {
+		var docs []Doc
+		decoder := json.NewDecoder(r.Body)
+		decoder.UseNumber()
+		if err := decoder.Decode(&docs); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		applied, err := n.ApplyRevisions(r.Context(), docs)
+		respond(w, applied, err)
+	})
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	return server
+}
+
+func respond(w http.ResponseWriter, v interface{}, err error) {
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(v)
+}
+
+// create creates a record named name through n and returns its ID
+func create(t *testing.T, n *Node, name string) repository.ID {
+	t.Helper()
+
+	record := map[string]interface{}{"name": name}
+	if err := n.CreateRecord(context.Background(), record); err != nil {
+		t.Fatalf("CreateRecord failed: %v", err)
+	}
+	id, _ := repository.FormatID(record["id"])
+	return id
+}
+
+// update sets the name of the record id through n
+func update(t *testing.T, n *Node, id repository.ID, name string) {
+	t.Helper()
+
+	if err := n.UpdateRecord(context.Background(), id, map[string]interface{}{"name": name}); err != nil {
+		t.Fatalf("UpdateRecord failed: %v", err)
+	}
+}
+
+// expectName checks the current name of the record id on n, empty for a
+// deleted record
+func expectName(t *testing.T, n *Node, id repository.ID, expected string) {
+	t.Helper()
+
+	record, err := n.ReadRecord(context.Background(), id)
+	switch {
+	case expected == "" && !errors.Is(err, dberr.ErrNotFound):
+		t.Errorf("expected %s deleted, got %v (%v)", id, record, err)
+	case expected != "" && (err != nil || record["name"] != expected):
+		t.Errorf("expected %s as %s, got %v (%v)", expected, id, record, err)
+	}
+}
+
+// syncWith syncs n with the instance served at url
+func syncWith(t *testing.T, n *Node, url string) *Report {
+	t.Helper()
+
+	report, err := n.Sync(context.Background(), url)
+	if err != nil {
+		t.Fatalf("Sync failed: %v", err)
+	}
+	return report
+}
+
+// names returns the names of the revisions of the record id that are not
+// deleted, the current one first
+func names(t *testing.T, n *Node, id repository.ID) []string {
+	t.Helper()
+
+	conflict, err := n.Conflicts(context.Background(), id)
+	if err != nil {
+		t.Fatalf("Conflicts failed: %v", err)
+	}
+	names := []string{}
+	for _, rev := range conflict.Revisions {
+		names = append(names, rev.Record["name"].(string))
+	}
+	return names
+}
+
+func Test_Revisions(t *testing.T) {
+	ctx := context.Background()
+	n := newTestNode(t, t.TempDir())
+	id := create(t, n, "db01")
+	update(t, n, id, "db01b")
+
+	conflict, err := n.Conflicts(ctx, id)
+	if err != nil {
+		t.Fatalf("Conflicts failed: %v", err)
+	}
+	rev := conflict.Revisions[0]
+	if len(conflict.Revisions) != 1 || !strings.HasPrefix(rev.Rev, "2-") || len(rev.History) != 1 || !strings.HasPrefix(rev.History[0], "1-") {
+		t.Errorf("unexpected revisions %+v", conflict)
+	}
+
+	// The same edits give the same revisions on any instance
+	if first := newRevision(nil, map[string]interface{}{"id": "x", "name": "db01"}, false); first.Rev != rev.History[0] {
+		t.Errorf("expected %s, got %s", rev.History[0], first.Rev)
+	}
+	if ids, _ := n.ConflictIDs(ctx); len(ids) != 0 {
+		t.Errorf("expected no conflicts, got %v", ids)
+	}
+
+	if err := n.DeleteRecord(ctx, id); err != nil {
+		t.Fatalf("DeleteRecord failed: %v", err)
+	}
+	if conflict, err := n.Conflicts(ctx, id); err != nil || conflict.Rev[:2] != "3-" || len(conflict.Revisions) != 0 {
+		t.Errorf("expected a deleted revision, got %+v (%v)", conflict, err)
+	}
+	if _, err := n.Conflicts(ctx, "nope"); !errors.Is(err, dberr.ErrNotFound) {
+		t.Errorf("expected ErrNotFound, got %v", err)
+	}
+}
+
+func Test_Sync(t *testing.T) {
+	central := newTestNode(t, t.TempDir())
+	site := newTestNode(t, t.TempDir(), WithBatchSize(2))
+	server := serve(t, central)
+
+	fromCentral := create(t, central, "central")
+	var fromSite []repository.ID
+	for _, name := range []string{"a", "b", "c"} {
+		fromSite = append(fromSite, create(t, site, name))
+	}
+
+	report := syncWith(t, site, server.URL)
+	if report.Pulled != 1 || report.Pushed != 3 || len(report.Conflicts) != 0 || report.Error != "" {
+		t.Errorf("unexpected report %+v", report)
+	}
+	expectName(t, site, fromCentral, "central")
+	for i, name := range []string{"a", "b", "c"} {
+		expectName(t, central, fromSite[i], name)
+	}
+
+	// Only the changes since the checkpoints are exchanged
+	update(t, central, fromSite[0], "a2")
+	if err := site.DeleteRecord(context.Background(), fromCentral); err != nil {
+		t.Fatalf("DeleteRecord failed: %v", err)
+	}
+	report = syncWith(t, site, server.URL)
+	if report.Pulled != 1 || report.Pushed != 1 {
+		t.Errorf("unexpected report %+v", report)
+	}
+	expectName(t, site, fromSite[0], "a2")
+	expectName(t, central, fromCentral, "")
+	if report = syncWith(t, site, server.URL); report.Pulled != 0 || report.Pushed != 0 {
+		t.Errorf("expected nothing left to sync, got %+v", report)
+	}
+
+	status, err := site.Status(context.Background())
+	if err != nil || len(status.Checkpoints) != 2 || status.LastSync == nil || status.Conflicts != 0 {
+		t.Errorf("unexpected status %+v (%v)", status, err)
+	}
+	if status.Checkpoints["pull "+server.URL].Instance != central.state.Instance {
+		t.Errorf("expected the checkpoint of the central instance, got %+v", status.Checkpoints)
+	}
+
+	// Syncing with a server that is not there fails
+	server.Close()
+	if _, err := site.Sync(context.Background(), server.URL); err == nil {
+		t.Errorf("expected Sync to fail")
+	}
+	if status, _ := site.Status(context.Background()); status.LastSync.Error == "" {
+		t.Errorf("expected the error in the status, got %+v", status.LastSync)
+	}
+}
+
+func Test_Conflicts(t *testing.T) {
+	ctx := context.Background()
+	central := newTestNode(t, t.TempDir())
+	site := newTestNode(t, t.TempDir())
+	server := serve(t, central)
+
+	edited := create(t, central, "db01")
+	deleted := create(t, central, "db02")
+	syncWith(t, site, server.URL)
+
+	// Both sides change the same records while apart
+	update(t, central, edited, "central")
+	update(t, site, edited, "site")
+	update(t, central, deleted, "central")
+	if err := site.DeleteRecord(ctx, deleted); err != nil {
+		t.Fatalf("DeleteRecord failed: %v", err)
+	}
+
+	report := syncWith(t, site, server.URL)
+	if !reflect.DeepEqual(report.Conflicts, []repository.ID{edited}) {
+		t.Errorf("expected a conflict on %s, got %+v", edited, report)
+	}
+	// Both keep both revisions and serve the same one, an update wins over
+	// a delete
+	for _, n := range []*Node{central, site} {
+		got := names(t, n, edited)
+		if len(got) != 2 || !reflect.DeepEqual(got, names(t, central, edited)) {
+			t.Errorf("expected both revisions, the same one current, got %v", got)
+		}
+		expectName(t, n, edited, got[0])
+		expectName(t, n, deleted, "central")
+	}
+	if ids, _ := central.ConflictIDs(ctx); !reflect.DeepEqual(ids, []repository.ID{edited}) {
+		t.Errorf("expected the conflict listed, got %v", ids)
+	}
+
+	// The site keeps the revision that lost, and the central instance drops
+	// the other one once synced
+	conflict, _ := site.Conflicts(ctx, edited)
+	loser := conflict.Revisions[1]
+	if err := site.Resolve(ctx, edited, "9-nope"); !errors.Is(err, dberr.ErrNotFound) {
+		t.Errorf("expected ErrNotFound, got %v", err)
+	}
+	if err := site.Resolve(ctx, edited, loser.Rev); err != nil {
+		t.Fatalf("Resolve failed: %v", err)
+	}
+	syncWith(t, site, server.URL)
+	for _, n := range []*Node{central, site} {
+		if got := names(t, n, edited); len(got) != 1 || got[0] != loser.Record["name"] {
+			t.Errorf("expected the conflict resolved with %v, got %v", loser.Record["name"], got)
+		}
+		if status, _ := n.Status(ctx); status.Conflicts != 0 {
+			t.Errorf("expected no conflicts, got %+v", status)
+		}
+	}
+}
+
+func Test_PolicyNewest(t *testing.T) {
+	central := newTestNode(t, t.TempDir(), WithPolicy(PolicyNewest))
+	site := newTestNode(t, t.TempDir(), WithPolicy(PolicyNewest))
+	server := serve(t, central)
+
+	id := create(t, central, "db01")
+	syncWith(t, site, server.URL)
+	update(t, site, id, "older")
+	time.Sleep(time.Millisecond)
+	update(t, central, id, "newer")
+
+	if report := syncWith(t, site, server.URL); len(report.Conflicts) != 0 {
+		t.Errorf("expected the conflict resolved, got %+v", report)
+	}
+	syncWith(t, site, server.URL)
+	for _, n := range []*Node{central, site} {
+		if got := names(t, n, id); !reflect.DeepEqual(got, []string{"newer"}) {
+			t.Errorf("expected the newest revision kept, got %v", got)
+		}
+	}
+}
+
+func Test_Open(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	db, err := filedb.Open(filepath.Join(dir, "seq.json"))
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer db.Close()
+	if _, err := Open(db, filepath.Join(dir, "seq.json.sync")); err == nil {
+		t.Errorf("expected sequential IDs to be refused")
+	}
+
+	// Revisions and the instance are kept across restarts, and changes made
+	// while sync was off get revisions of their own
+	n := newTestNode(t, dir)
+	kept, changed, removed := create(t, n, "kept"), create(t, n, "changed"), create(t, n, "removed")
+	before, _ := n.Conflicts(ctx, kept)
+	instance := n.state.Instance
+	n.engine.UpdateRecord(ctx, changed, map[string]interface{}{"name": "changed offline"})
+	n.engine.DeleteRecord(ctx, removed)
+	n.engine.(*filedb.FileDB).Close()
+
+	n = newTestNode(t, dir)
+	if n.state.Instance != instance {
+		t.Errorf("expected instance %s, got %s", instance, n.state.Instance)
+	}
+	if after, _ := n.Conflicts(ctx, kept); after.Rev != before.Rev {
+		t.Errorf("expected revision %s kept, got %s", before.Rev, after.Rev)
+	}
+	if conflict, _ := n.Conflicts(ctx, changed); !strings.HasPrefix(conflict.Rev, "2-") {
+		t.Errorf("expected a new revision, got %+v", conflict)
+	}
+	if conflict, _ := n.Conflicts(ctx, removed); len(conflict.Revisions) != 0 {
+		t.Errorf("expected the record deleted, got %+v", conflict)
+	}
+}
+
+func Test_Rollback(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	faulty := fsys.NewFaulty(fsys.NewMemFS())
+
+	n := newTestNode(t, dir, WithFS(faulty))
+	id := create(t, n, "Alice")
+	before, _ := n.Conflicts(ctx, id)
+	seq := n.state.Seq
+
+	// A change whose revision cannot be saved is not made
+	faulty.Inject(fsys.Fault{Op: fsys.OpSync, Err: syscall.EIO, Times: -1})
+	if err := n.CreateRecord(ctx, map[string]interface{}{"name": "Bob"}); !errors.Is(err, syscall.EIO) {
+		t.Errorf("expected %v, got %v", syscall.EIO, err)
+	}
+	if err := n.UpdateRecord(ctx, id, map[string]interface{}{"name": "Alicia"}); !errors.Is(err, syscall.EIO) {
+		t.Errorf("expected %v, got %v", syscall.EIO, err)
+	}
+	if err := n.DeleteRecord(ctx, id); !errors.Is(err, syscall.EIO) {
+		t.Errorf("expected %v, got %v", syscall.EIO, err)
+	}
+	if current, _, err := n.engine.Snapshot(ctx); err != nil || len(current.Records) != 1 {
+		t.Errorf("expected only the first record, got %v (%v)", current, err)
+	}
+	expectName(t, n, id, "Alice")
+	if after, err := n.Conflicts(ctx, id); err != nil || after.Rev != before.Rev || n.state.Seq != seq {
+		t.Errorf("expected revision %s at %d, got %+v at %d (%v)", before.Rev, seq, after, n.state.Seq, err)
+	}
+
+	// What a failed save left in the file is dropped
+	faulty.Clear()
+	update(t, n, id, "Alicia")
+	after, _ := n.Conflicts(ctx, id)
+	n.engine.(*filedb.FileDB).Close()
+	n = newTestNode(t, dir, WithFS(faulty))
+	expectName(t, n, id, "Alicia")
+	if reopened, err := n.Conflicts(ctx, id); err != nil || reopened.Rev != after.Rev || n.state.Seq != seq+1 {
+		t.Errorf("expected revision %s at %d, got %+v at %d (%v)", after.Rev, seq+1, reopened, n.state.Seq, err)
+	}
+}
+
+func Test_StateFile(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	path := filepath.Join(dir, "db.json.sync")
+	mem := fsys.NewMemFS()
+	keys := repotest.Keyring(t, 1)
+
+	n := newTestNode(t, dir, WithFS(mem))
+	ids := []repository.ID{}
+	for _, name := range []string{"Alice", "Bob", "Carol", "Dave", "Erin"} {
+		ids = append(ids, create(t, n, name))
+	}
+	n.engine.(*filedb.FileDB).Close()
+
+	// A plaintext file is encrypted once there are keys
+	n = newTestNode(t, dir, WithFS(mem), WithKeys(keys))
+	content, _ := mem.ReadFile(path)
+	if bytes.Contains(content, []byte(ids[0])) || bytes.Contains(content, []byte(n.state.Instance)) {
+		t.Errorf("expected the state file to be encrypted, got %q", content)
+	}
+
+	// Changes are appended until they outgrow the whole state
+	appended, compacted := 0, false
+	for i := 0; i < 100 && !compacted; i++ {
+		update(t, n, ids[0], fmt.Sprintf("Alice %d", i))
+		next, _ := mem.ReadFile(path)
+		if bytes.HasPrefix(next, content) {
+			appended++
+		} else {
+			compacted = true
+		}
+		content = next
+	}
+	if appended < 2 || !compacted {
+		t.Errorf("expected changes appended then the file rewritten, got %d appended", appended)
+	}
+	update(t, n, ids[1], "Bobby")
+	instance, seq := n.state.Instance, n.state.Seq
+	want, _ := n.Conflicts(ctx, ids[0])
+	n.engine.(*filedb.FileDB).Close()
+
+	n = newTestNode(t, dir, WithFS(mem), WithKeys(keys))
+	if got, _ := n.Conflicts(ctx, ids[0]); n.state.Instance != instance || n.state.Seq != seq || !reflect.DeepEqual(got, want) {
+		t.Errorf("expected %s at %d with %+v, got %s at %d with %+v", instance, seq, want, n.state.Instance, n.state.Seq, got)
+	}
+	expectName(t, n, ids[1], "Bobby")
+	n.engine.(*filedb.FileDB).Close()
+
+	db, err := filedb.Open(filepath.Join(dir, "db.json"), filedb.WithIDStrategy(idgen.NewUUIDv7()))
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer db.Close()
+	if _, err := Open(db, path, WithFS(mem)); !errors.Is(err, dbfile.ErrEncrypted) {
+		t.Errorf("expected %v without the keys, got %v", dbfile.ErrEncrypted, err)
+	}
+}
+
+func Test_Rekey(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	keys := repotest.Keyring(t, 1)
+	rekeyed := repotest.Keyring(t, 2)
+	open := func(engineKeys, stateKeys *dbfile.Keyring) (*Node, error) {
+		t.Helper()
+		db, err := filedb.Open(filepath.Join(dir, "db.json"), filedb.WithIDStrategy(idgen.NewUUIDv7()), filedb.WithKeys(engineKeys))
+		if err != nil {
+			t.Fatalf("Open failed: %v", err)
+		}
+		t.Cleanup(func() { db.Close() })
+		return Open(db, filepath.Join(dir, "db.json.sync"), WithKeys(stateKeys))
+	}
+
+	n, err := open(keys, keys)
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	id := create(t, n, "Alice")
+	update(t, n, id, "Alicia")
+	want, _ := n.Conflicts(ctx, id)
+	if err := n.Rekey(ctx, rekeyed); err != nil {
+		t.Fatalf("Rekey failed: %v", err)
+	}
+	n.engine.(*filedb.FileDB).Close()
+
+	// The state file is read without the previous key
+	n, err = open(rekeyed, rekeyed)
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	if got, err := n.Conflicts(ctx, id); err != nil || !reflect.DeepEqual(got, want) {
+		t.Errorf("expected %+v, got %+v (%v)", want, got, err)
+	}
+	expectName(t, n, id, "Alicia")
+	n.engine.(*filedb.FileDB).Close()
+
+	if _, err := open(rekeyed, keys); err == nil {
+		t.Errorf("expected the previous key not to read the state file")
+	}
+}
+
+func Test_ParsePolicy(t *testing.T) {
+	tests := []struct {
+		name    string
+		wantErr bool
+	}{
+		{"manual", false},
+		{"newest", false},
+		{"oldest", true},
+		{"", true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			policy, err := ParsePolicy(test.name)
+			if (err != nil) != test.wantErr || (err == nil && string(policy) != test.name) {
+				t.Errorf("unexpected result %q (%v)", policy, err)
+			}
+		})
+	}
+}
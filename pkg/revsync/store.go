@@ -0,0 +1,195 @@
+package revsync
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"zabbixhw/pkg/fsys"
+	"zabbixhw/pkg/repository"
+	"zabbixhw/pkg/repository/dbfile"
+)
+
+// state is what a node keeps next to the database file: the revision tree
+// of every record, the update sequence and the checkpoints of past syncs.
+//
+// The state file holds frames, see dbfile.AppendFrame: the whole state,
+// followed by a state per save holding the records and checkpoints changed
+// by it. Once the changes outgrow the whole state, the file is rewritten as
+// the whole state again. Each frame is encrypted when there are keys
+type state struct {
+	Instance    string                 `json:"instance,omitempty"`
+	Seq         uint64                 `json:"seq"`
+	Docs        map[repository.ID]*doc `json:"docs,omitempty"`
+	Checkpoints map[string]Checkpoint  `json:"checkpoints,omitempty"` // By direction and remote URL
+
+	changedDocs        map[repository.ID]bool // Changed since the last save
+	changedCheckpoints map[string]bool
+	size               int64 // End of the last frame of the file
+	base               int64 // End of the frame of the whole state
+	compact            bool  // Whether the next save rewrites the file
+}
+
+// newState returns an empty state
+func newState() *state {
+	return &state{
+		Docs:               map[repository.ID]*doc{},
+		Checkpoints:        map[string]Checkpoint{},
+		changedDocs:        map[repository.ID]bool{},
+		changedCheckpoints: map[string]bool{},
+	}
+}
+
+// newInstanceID returns a random name for a new instance
+func newInstanceID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// setDoc makes d the revision tree of the record id
+func (s *state) setDoc(id repository.ID, d *doc) {
+	if d == nil {
+		delete(s.Docs, id)
+	} else {
+		s.Docs[id] = d
+	}
+	s.changedDocs[id] = true
+}
+
+// setCheckpoint saves checkpoint under key
+func (s *state) setCheckpoint(key string, checkpoint Checkpoint) {
+	s.Checkpoints[key] = checkpoint
+	s.changedCheckpoints[key] = true
+}
+
+// loadState reads the state file at path, or starts a new state when there
+// is none. A state cut off at the end of the file, by a crash while saving
+// it, is left out and overwritten by the next save. The file is rewritten
+// on the next save when it is not encrypted with the primary key of keys
+func loadState(files fsys.FS, path string, keys *dbfile.Keyring) (*state, error) {
+	s := newState()
+	content, err := readFile(files, path)
+	if errors.Is(err, fs.ErrNotExist) {
+		s.Instance = newInstanceID()
+		s.compact = true
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	frames, err := dbfile.ReadFrames(content)
+	if err != nil {
+		return nil, fmt.Errorf("error decoding %s: %w", path, err)
+	}
+	if len(frames) == 0 {
+		return nil, fmt.Errorf("error decoding %s: no state", path)
+	}
+	for _, frame := range frames {
+		var changes state
+		stale, err := decodeState(frame.Content, keys, &changes)
+		if err != nil {
+			return nil, fmt.Errorf("error decoding %s: %w", path, err)
+		}
+		if changes.Instance != "" {
+			s.Instance = changes.Instance
+		}
+		s.Seq = changes.Seq
+		for id, d := range changes.Docs {
+			s.Docs[id] = d
+		}
+		for key, checkpoint := range changes.Checkpoints {
+			s.Checkpoints[key] = checkpoint
+		}
+		s.compact = s.compact || stale
+	}
+	s.base, s.size = frames[0].End, frames[len(frames)-1].End
+	return s, nil
+}
+
+// readFile returns the content of the file at path
+func readFile(files fsys.FS, path string) ([]byte, error) {
+	file, err := files.OpenFile(path, os.O_RDONLY, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return io.ReadAll(file)
+}
+
+// save appends what changed since the last save to the state file at path,
+// or rewrites it as the whole state once the changes outgrow it, so each
+// change costs as much to write as its records do on average
+func (s *state) save(files fsys.FS, path string, keys *dbfile.Keyring) error {
+	if s.compact || s.size-s.base > s.base {
+		data, err := encodeState(s, keys)
+		if err != nil {
+			return err
+		}
+		frame := dbfile.AppendFrame(nil, data)
+		if err := fsys.WriteFile(files, path, frame, 0600); err != nil {
+			return err
+		}
+		s.size, s.base, s.compact = int64(len(frame)), int64(len(frame)), false
+		s.changedDocs, s.changedCheckpoints = map[repository.ID]bool{}, map[string]bool{}
+		return nil
+	}
+	if len(s.changedDocs) == 0 && len(s.changedCheckpoints) == 0 {
+		return nil
+	}
+
+	changes := &state{Seq: s.Seq, Docs: map[repository.ID]*doc{}, Checkpoints: map[string]Checkpoint{}}
+	for id := range s.changedDocs {
+		if d := s.Docs[id]; d != nil {
+			changes.Docs[id] = d
+		}
+	}
+	for key := range s.changedCheckpoints {
+		changes.Checkpoints[key] = s.Checkpoints[key]
+	}
+	data, err := encodeState(changes, keys)
+	if err != nil {
+		return err
+	}
+	frame := dbfile.AppendFrame(nil, data)
+	if err := fsys.WriteAt(files, path, s.size, frame, 0600); err != nil {
+		return err
+	}
+	s.size += int64(len(frame))
+	s.changedDocs, s.changedCheckpoints = map[repository.ID]bool{}, map[string]bool{}
+	return nil
+}
+
+// encodeState returns s in JSON, encrypted with the primary key if there
+// are keys
+func encodeState(s *state, keys *dbfile.Keyring) ([]byte, error) {
+	data, err := json.Marshal(s)
+	if err != nil || keys == nil {
+		return data, err
+	}
+	return dbfile.Encrypt(data, keys.Primary())
+}
+
+// decodeState decrypts content and decodes it into s. Numbers are kept as
+// json.Number, like the engines read them. stale reports whether content is
+// not encrypted with the primary key while there are keys
+func decodeState(content []byte, keys *dbfile.Keyring, s *state) (stale bool, err error) {
+	plain, id, err := dbfile.Decrypt(content, keys)
+	if err != nil {
+		return false, err
+	}
+	decoder := json.NewDecoder(bytes.NewReader(plain))
+	decoder.UseNumber()
+	if err := decoder.Decode(s); err != nil {
+		return false, err
+	}
+	return keys != nil && id != keys.Primary().ID, nil
+}
@@ -0,0 +1,331 @@
+package revsync
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"zabbixhw/pkg/repository"
+	"zabbixhw/pkg/repository/dberr"
+)
+
+// TokenHeader carries the shared secret of instances syncing together
+const TokenHeader = "X-Sync-Token"
+
+// Paths an instance serves the others on
+const (
+	ChangesPath   = "/sync/changes"
+	RevisionsPath = "/sync/revisions"
+)
+
+// Doc is a record as sent to another instance: the revisions it ends with,
+// with their content
+type Doc struct {
+	ID        repository.ID `json:"id"`
+	Seq       uint64        `json:"seq"`
+	Revisions []Revision    `json:"revisions"` // The current revision first
+}
+
+// Changes holds the records changed after an update sequence
+type Changes struct {
+	Instance string `json:"instance"`
+	LastSeq  uint64 `json:"lastSeq"` // Update sequence to ask for changes after next time
+	Docs     []Doc  `json:"docs"`
+}
+
+// Applied is the outcome of sending revisions to an instance
+type Applied struct {
+	Instance  string          `json:"instance"`
+	Revisions int             `json:"revisions"` // Revisions the instance did not have
+	Conflicts []repository.ID `json:"conflicts"` // Records left with conflicts
+}
+
+// Checkpoint is how far a sync with a remote instance got. The sequence is
+// only meaningful for the instance it was reached with: a remote server
+// started over from a new database is synced again from the start
+type Checkpoint struct {
+	Instance string `json:"instance"`
+	Seq      uint64 `json:"seq"`
+}
+
+// Report is the outcome of a sync with a remote instance
+type Report struct {
+	Remote    string          `json:"remote"`
+	Time      time.Time       `json:"time"`
+	Pulled    int             `json:"pulled"`    // Revisions received
+	Pushed    int             `json:"pushed"`    // Revisions the remote instance received
+	Conflicts []repository.ID `json:"conflicts"` // Records left with conflicts on either side
+	Error     string          `json:"error,omitempty"`
+}
+
+// Changes returns up to limit records changed after the update sequence
+// since, in the order they were changed
+func (n *Node) Changes(ctx context.Context, since uint64, limit int) (*Changes, error) {
+	if err := n.mu.RLock(ctx); err != nil {
+		return nil, err
+	}
+	defer n.mu.RUnlock()
+
+	ids := []repository.ID{}
+	for id, d := range n.state.Docs {
+		if d.Seq > since {
+			ids = append(ids, id)
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool { return n.state.Docs[ids[i]].Seq < n.state.Docs[ids[j]].Seq })
+	if limit > 0 && len(ids) > limit {
+		ids = ids[:limit]
+	}
+
+	changes := &Changes{Instance: n.state.Instance, LastSeq: n.state.Seq, Docs: []Doc{}}
+	for _, id := range ids {
+		d := n.state.Docs[id]
+		revisions, err := n.leaves(ctx, id, d)
+		if err != nil {
+			return nil, err
+		}
+		changes.Docs = append(changes.Docs, Doc{ID: id, Seq: d.Seq, Revisions: revisions})
+	}
+	if len(ids) == limit && limit > 0 {
+		changes.LastSeq = n.state.Docs[ids[len(ids)-1]].Seq
+	}
+	return changes, nil
+}
+
+// ApplyRevisions adds the revisions of docs made on another instance. A
+// revision following the current one of a record replaces it, one that
+// does not starts a conflict, which the policy of the node may resolve
+func (n *Node) ApplyRevisions(ctx context.Context, docs []Doc) (*Applied, error) {
+	if err := n.mu.Lock(ctx); err != nil {
+		return nil, err
+	}
+	defer n.mu.Unlock()
+
+	applied := &Applied{Instance: n.state.Instance, Conflicts: []repository.ID{}}
+	var err error
+	for _, d := range docs {
+		var count int
+		if count, err = n.applyDoc(ctx, d); err != nil {
+			break
+		}
+		applied.Revisions += count
+		if current := n.state.Docs[d.ID]; current != nil && live(current.Leaves) > 1 {
+			applied.Conflicts = append(applied.Conflicts, d.ID)
+		}
+	}
+	if applied.Revisions > 0 {
+		// Save what was applied before a failure too
+		if saveErr := n.save(); err == nil {
+			err = saveErr
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return applied, nil
+}
+
+// applyDoc merges the revisions of d into the record and returns how many
+// were new
+func (n *Node) applyDoc(ctx context.Context, d Doc) (int, error) {
+	current := n.state.Docs[d.ID]
+	var leaves []Revision
+	if current != nil {
+		leaves = append(leaves, current.Leaves...)
+	}
+
+	count := 0
+	for _, rev := range d.Revisions {
+		if rev.Rev == "" || (!rev.Deleted && rev.Record == nil) {
+			return 0, dberr.Validation("revision %q of %s has no content", rev.Rev, d.ID)
+		}
+		if rev.Deleted {
+			rev.Record = nil
+		}
+		if merged := merge(leaves, rev); merged != nil {
+			leaves = merged
+			count++
+		}
+	}
+	if count == 0 {
+		return 0, nil
+	}
+
+	if n.policy == PolicyNewest && live(leaves) > 1 {
+		newest := -1
+		for i := range leaves {
+			if !leaves[i].Deleted && (newest < 0 || leaves[i].Time.After(leaves[newest].Time) ||
+				(leaves[i].Time.Equal(leaves[newest].Time) && beats(&leaves[i], &leaves[newest]))) {
+				newest = i
+			}
+		}
+		leaves = resolve(leaves, newest)
+	}
+	return count, n.setLeaves(ctx, d.ID, leaves, n.held(current))
+}
+
+// Sync exchanges changes with the instance served at remote, such as
+// http://central:8080: it pulls the changes made there since the last
+// sync, then pushes those made here
+func (n *Node) Sync(ctx context.Context, remote string) (*Report, error) {
+	n.syncMu.Lock()
+	defer n.syncMu.Unlock()
+
+	remote = strings.TrimSuffix(remote, "/")
+	report := &Report{Remote: remote, Time: time.Now().UTC(), Conflicts: []repository.ID{}}
+	err := n.sync(ctx, remote, report)
+	if err != nil {
+		report.Error = err.Error()
+	}
+	sort.Slice(report.Conflicts, func(i, j int) bool { return report.Conflicts[i] < report.Conflicts[j] })
+
+	n.statusMu.Lock()
+	n.last = report
+	n.statusMu.Unlock()
+	return report, err
+}
+
+func (n *Node) sync(ctx context.Context, remote string, report *Report) error {
+	conflicts := map[repository.ID]bool{}
+	defer func() {
+		for id := range conflicts {
+			report.Conflicts = append(report.Conflicts, id)
+		}
+	}()
+
+	// Pull
+	pullKey, pushKey := "pull "+remote, "push "+remote
+	checkpoint := n.checkpoint(pullKey)
+	for {
+		var changes Changes
+		query := url.Values{"since": {strconv.FormatUint(checkpoint.Seq, 10)}, "limit": {strconv.Itoa(n.batch)}}
+		if err := n.request(ctx, http.MethodGet, remote+ChangesPath+"?"+query.Encode(), nil, &changes); err != nil {
+			return err
+		}
+		if changes.Instance != checkpoint.Instance && checkpoint.Seq > 0 {
+			// Another database is served there now
+			checkpoint = Checkpoint{Instance: changes.Instance}
+			continue
+		}
+		applied, err := n.ApplyRevisions(ctx, changes.Docs)
+		if err != nil {
+			return err
+		}
+		report.Pulled += applied.Revisions
+		for _, id := range applied.Conflicts {
+			conflicts[id] = true
+		}
+		checkpoint = Checkpoint{Instance: changes.Instance, Seq: changes.LastSeq}
+		if err := n.setCheckpoint(ctx, pullKey, checkpoint); err != nil {
+			return err
+		}
+		if len(changes.Docs) < n.batch {
+			break
+		}
+	}
+
+	// Push, from the start if the remote instance is not the one of the
+	// checkpoint
+	instance := checkpoint.Instance
+	checkpoint = n.checkpoint(pushKey)
+	if checkpoint.Instance != instance {
+		checkpoint = Checkpoint{Instance: instance}
+	}
+	for {
+		changes, err := n.Changes(ctx, checkpoint.Seq, n.batch)
+		if err != nil {
+			return err
+		}
+		if len(changes.Docs) > 0 {
+			var applied Applied
+			if err := n.request(ctx, http.MethodPost, remote+RevisionsPath, changes.Docs, &applied); err != nil {
+				return err
+			}
+			report.Pushed += applied.Revisions
+			for _, id := range applied.Conflicts {
+				conflicts[id] = true
+			}
+		}
+		checkpoint.Seq = changes.LastSeq
+		if err := n.setCheckpoint(ctx, pushKey, checkpoint); err != nil {
+			return err
+		}
+		if len(changes.Docs) < n.batch {
+			return nil
+		}
+	}
+}
+
+// checkpoint returns the checkpoint saved under key
+func (n *Node) checkpoint(key string) Checkpoint {
+	n.mu.RLock(context.Background())
+	defer n.mu.RUnlock()
+	return n.state.Checkpoints[key]
+}
+
+// setCheckpoint saves checkpoint under key
+func (n *Node) setCheckpoint(ctx context.Context, key string, checkpoint Checkpoint) error {
+	if err := n.mu.Lock(ctx); err != nil {
+		return err
+	}
+	defer n.mu.Unlock()
+	if n.state.Checkpoints[key] == checkpoint {
+		return nil
+	}
+	n.state.setCheckpoint(key, checkpoint)
+	return n.save()
+}
+
+// request sends v, unless it is nil, to target and decodes the response
+// into resp. Numbers are kept as json.Number, like the engines read them
+func (n *Node) request(ctx context.Context, method, target string, v, resp interface{}) error {
+	var body io.Reader
+	if v != nil {
+		data, err := json.Marshal(v)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(data)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, target, body)
+	if err != nil {
+		return err
+	}
+	if v != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if n.token != "" {
+		req.Header.Set(TokenHeader, n.token)
+	}
+	r, err := n.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer r.Body.Close()
+
+	if r.StatusCode != http.StatusOK {
+		// Problem details explain the failure best, fall back to the body
+		data, _ := io.ReadAll(io.LimitReader(r.Body, 4096))
+		var problem struct {
+			Code   string `json:"code"`
+			Detail string `json:"detail"`
+		}
+		if json.Unmarshal(data, &problem) == nil && problem.Code != "" {
+			return fmt.Errorf("remote answered %s: %s %s", r.Status, problem.Code, problem.Detail)
+		}
+		return fmt.Errorf("remote answered %s: %s", r.Status, strings.TrimSpace(string(data)))
+	}
+	decoder := json.NewDecoder(r.Body)
+	decoder.UseNumber()
+	if err := decoder.Decode(resp); err != nil {
+		return fmt.Errorf("error decoding response of the remote: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,174 @@
+package revsync
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxHistory bounds the ancestors kept with a revision. Branches that
+// diverged further back are taken for conflicts
+const maxHistory = 100
+
+// Revision is a version of a record. Rev is its generation, the number of
+// edits it is from the creation of the record, and a hash of its parent and
+// content, so the same edit made on two instances gives the same revision
+type Revision struct {
+	Rev     string                 `json:"rev"`
+	History []string               `json:"history,omitempty"` // Ancestors, the parent first
+	Deleted bool                   `json:"deleted,omitempty"`
+	Time    time.Time              `json:"time"` // When the edit was made, where it was made
+	Record  map[string]interface{} `json:"record,omitempty"`
+}
+
+// newRevision returns the revision following parent, nil for the first
+// one of a record, with record as its content
+func newRevision(parent *Revision, record map[string]interface{}, deleted bool) Revision {
+	rev := Revision{Deleted: deleted, Time: time.Now().UTC(), Record: record}
+	if deleted {
+		rev.Record = nil
+	}
+	generation, parentRev := 1, ""
+	if parent != nil {
+		generation, parentRev = generationOf(parent.Rev)+1, parent.Rev
+		rev.History = append([]string{parent.Rev}, parent.History...)
+		if len(rev.History) > maxHistory {
+			rev.History = rev.History[:maxHistory]
+		}
+	}
+	rev.Rev = strconv.Itoa(generation) + "-" + contentHash(parentRev, record, deleted)
+	return rev
+}
+
+// contentHash hashes an edit of the revision parent. The ID of the record
+// is left out, it is the same in every revision
+func contentHash(parent string, record map[string]interface{}, deleted bool) string {
+	h := sha256.New()
+	h.Write([]byte(parent))
+	if deleted {
+		h.Write([]byte("\x00deleted"))
+	} else {
+		body := make(map[string]interface{}, len(record))
+		for k, v := range record {
+			if k != "id" {
+				body[k] = v
+			}
+		}
+		// Maps are encoded with sorted keys
+		data, _ := json.Marshal(body)
+		h.Write([]byte("\x00"))
+		h.Write(data)
+	}
+	return hex.EncodeToString(h.Sum(nil)[:16])
+}
+
+// matches reports whether rev is the revision of record following parent,
+// that is whether record was not changed since rev was made
+func (rev *Revision) matches(record map[string]interface{}) bool {
+	parent := ""
+	if len(rev.History) > 0 {
+		parent = rev.History[0]
+	}
+	_, hash, _ := strings.Cut(rev.Rev, "-")
+	return !rev.Deleted && hash == contentHash(parent, record, false)
+}
+
+// generationOf returns the generation of a revision
+func generationOf(rev string) int {
+	text, _, _ := strings.Cut(rev, "-")
+	generation, _ := strconv.Atoi(text)
+	return generation
+}
+
+// knows reports whether rev is the revision or one of its ancestors
+func (rev *Revision) knows(other string) bool {
+	if rev.Rev == other {
+		return true
+	}
+	for _, ancestor := range rev.History {
+		if ancestor == other {
+			return true
+		}
+	}
+	return false
+}
+
+// beats reports whether a wins over b as the current revision of a record.
+// Every instance picks the same winner: records that exist win over deleted
+// ones, then the longest edit history, then the greatest hash
+func beats(a, b *Revision) bool {
+	if a.Deleted != b.Deleted {
+		return !a.Deleted
+	}
+	if ga, gb := generationOf(a.Rev), generationOf(b.Rev); ga != gb {
+		return ga > gb
+	}
+	return a.Rev > b.Rev
+}
+
+// doc is the revision tree of a record, as the revisions it ends with. The
+// content of the winner is in the engine, that of the others in Record
+type doc struct {
+	Seq    uint64     `json:"seq"` // Update sequence of the last change
+	Leaves []Revision `json:"leaves"`
+}
+
+// winner returns the position of the current revision among leaves, -1 if
+// there are none
+func winner(leaves []Revision) int {
+	w := -1
+	for i := range leaves {
+		if w < 0 || beats(&leaves[i], &leaves[w]) {
+			w = i
+		}
+	}
+	return w
+}
+
+// live returns how many leaves are not deleted. More than one is a conflict
+func live(leaves []Revision) int {
+	count := 0
+	for _, leaf := range leaves {
+		if !leaf.Deleted {
+			count++
+		}
+	}
+	return count
+}
+
+// merge adds rev, made on another instance, to leaves. It returns nil if
+// the leaves know rev already. Leaves rev descends from are replaced with
+// it, otherwise it starts a branch of its own
+func merge(leaves []Revision, rev Revision) []Revision {
+	for i := range leaves {
+		if leaves[i].knows(rev.Rev) {
+			return nil
+		}
+	}
+
+	merged := []Revision{}
+	for _, leaf := range leaves {
+		if !rev.knows(leaf.Rev) {
+			merged = append(merged, leaf)
+		}
+	}
+	if len(rev.History) > maxHistory {
+		rev.History = rev.History[:maxHistory]
+	}
+	return append(merged, rev)
+}
+
+// copyRecord returns a shallow copy of record
+func copyRecord(record map[string]interface{}) map[string]interface{} {
+	if record == nil {
+		return nil
+	}
+	c := make(map[string]interface{}, len(record))
+	for k, v := range record {
+		c[k] = v
+	}
+	return c
+}